@@ -0,0 +1,347 @@
+/*
+	This file supports access control lists of datasets and data: reads and writes of a
+	dataset, or of specific data within it, can be limited to users and groups of users.
+	Groups are defined server-wide.
+*/
+
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// GroupPrefix marks an ACL entry as the name of a group rather than a user.
+const GroupPrefix = "@"
+
+// groupsKey is the name of the server key holding the user groups.
+const groupsKey = "groups"
+
+// ACL limits access to a dataset or data.  Entries are user names or group names
+// marked by GroupPrefix, e.g., "@proofreaders".
+type ACL struct {
+	// Readers may read.  If empty, anyone may read.
+	Readers []string
+
+	// Writers may read and write.  If empty, whoever may read may also write.
+	Writers []string
+}
+
+// copy returns a copy of the ACL that shares none of its entries, or nil for a nil ACL.
+func (acl *ACL) copy() *ACL {
+	if acl == nil {
+		return nil
+	}
+	return &ACL{
+		Readers: append([]string{}, acl.Readers...),
+		Writers: append([]string{}, acl.Writers...),
+	}
+}
+
+// AccessError is returned when a user is not allowed to read or write a dataset or data.
+type AccessError struct {
+	Node  dvid.UUID
+	Data  dvid.DataString
+	User  string
+	Write bool
+}
+
+func (e *AccessError) Error() string {
+	user := e.User
+	if user == "" {
+		user = "anonymous user"
+	}
+	access := "Reads"
+	if e.Write {
+		access = "Writes"
+	}
+	if e.Data == "" {
+		return fmt.Sprintf("%s of dataset with node %s are not permitted for %s", access, e.Node, user)
+	}
+	return fmt.Sprintf("%s of data '%s' at node %s are not permitted for %s", access, e.Data, e.Node, user)
+}
+
+// userGroups holds the user groups of a service, which are loaded from storage on
+// first use.
+type userGroups struct {
+	sync.Mutex
+	loaded  bool
+	members map[string][]string
+}
+
+// loadGroups reads the user groups from storage if they have not been read.  The caller
+// must hold the lock.
+func (s *Service) loadGroups() error {
+	groups := &s.groups
+	if groups.loaded {
+		return nil
+	}
+	value, err := s.kvGetter.Get(&ServerKey{groupsKey})
+	if err != nil {
+		return err
+	}
+	groups.members = make(map[string][]string)
+	if value != nil {
+		if err = dvid.Deserialize(value, &groups.members); err != nil {
+			return fmt.Errorf("Unable to read user groups: %s", err.Error())
+		}
+	}
+	groups.loaded = true
+	return nil
+}
+
+// SetGroup sets the members of a group, which can be given in ACLs by prefixing its
+// name with GroupPrefix.  If no members are given, the group is deleted.
+func (s *Service) SetGroup(name string, members []string) error {
+	name = strings.TrimPrefix(name, GroupPrefix)
+	if name == "" {
+		return fmt.Errorf("Groups must have a name")
+	}
+	groups := &s.groups
+	groups.Lock()
+	defer groups.Unlock()
+	if err := s.loadGroups(); err != nil {
+		return err
+	}
+	old, existed := groups.members[name]
+	if len(members) == 0 {
+		if !existed {
+			return fmt.Errorf("No group named %q", name)
+		}
+		delete(groups.members, name)
+	} else {
+		sorted := append([]string{}, members...)
+		sort.Strings(sorted)
+		groups.members[name] = sorted
+	}
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	serialization, err := dvid.Serialize(groups.members, compression, dvid.CRC32)
+	if err == nil {
+		err = s.kvSetter.Put(&ServerKey{groupsKey}, serialization)
+	}
+	if err != nil {
+		if existed {
+			groups.members[name] = old
+		} else {
+			delete(groups.members, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// GroupsJSON returns JSON giving the members of each group.
+func (s *Service) GroupsJSON() (string, error) {
+	groups := &s.groups
+	groups.Lock()
+	defer groups.Unlock()
+	if err := s.loadGroups(); err != nil {
+		return "{}", err
+	}
+	m, err := json.Marshal(groups.members)
+	if err != nil {
+		return "{}", err
+	}
+	return string(m), nil
+}
+
+// listed returns true if the user is one of the entries or a member of a group among
+// them.
+func (s *Service) listed(user string, entries []string) (bool, error) {
+	groups := &s.groups
+	groups.Lock()
+	defer groups.Unlock()
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry, GroupPrefix) {
+			if entry == user {
+				return true, nil
+			}
+			continue
+		}
+		if err := s.loadGroups(); err != nil {
+			return false, err
+		}
+		for _, member := range groups.members[strings.TrimPrefix(entry, GroupPrefix)] {
+			if member == user {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// aclFor returns the ACL of the named data, else the ACL of the dataset, or nil if
+// access is not limited.  The caller must hold the dataset's map lock.
+func (dset *Dataset) aclFor(dataname dvid.DataString) *ACL {
+	if dataname != "" {
+		if data, err := dset.DataService(dataname); err == nil {
+			dataname = data.DataName()
+		}
+		if acl, found := dset.DataACLs[dataname]; found {
+			return acl
+		}
+	}
+	return dset.ACL
+}
+
+// SetACL sets the ACL of the dataset with the node of the given UUID or, if dataname is
+// not empty, of the named data.  A nil ACL removes the limits, so data is again
+// governed by the dataset's ACL.
+func (s *Service) SetACL(u dvid.UUID, dataname dvid.DataString, acl *ACL) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	if acl != nil {
+		acl = acl.copy()
+		sort.Strings(acl.Readers)
+		sort.Strings(acl.Writers)
+	}
+	dataset.mapLock.Lock()
+	if dataname == "" {
+		dataset.ACL = acl
+	} else {
+		data, found := dataset.DataMap[dataname]
+		if !found {
+			dataset.mapLock.Unlock()
+			return fmt.Errorf("No data '%s' in dataset with node %s", dataname, u)
+		}
+		dataname = data.DataName()
+		if acl == nil {
+			delete(dataset.DataACLs, dataname)
+		} else {
+			if dataset.DataACLs == nil {
+				dataset.DataACLs = make(map[dvid.DataString]*ACL)
+			}
+			dataset.DataACLs[dataname] = acl
+		}
+	}
+	dataset.mapLock.Unlock()
+	s.InvalidateMetadata()
+	return dataset.Put(s.kvSetter)
+}
+
+// CheckAccess returns an *AccessError if the user may not read, or write if write is
+// true, the dataset with the node of the given UUID or, if dataname is not empty, the
+// named data.
+func (s *Service) CheckAccess(u dvid.UUID, dataname dvid.DataString, user string, write bool) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	dataset.mapLock.Lock()
+	acl := dataset.aclFor(dataname)
+	dataset.mapLock.Unlock()
+	if acl == nil {
+		return nil
+	}
+	if len(acl.Writers) != 0 {
+		writer, err := s.listed(user, acl.Writers)
+		if err != nil || writer {
+			return err
+		}
+		if write {
+			return &AccessError{Node: u, Data: dataname, User: user, Write: write}
+		}
+	}
+	if len(acl.Readers) == 0 {
+		return nil
+	}
+	if reader, err := s.listed(user, acl.Readers); err != nil || reader {
+		return err
+	}
+	return &AccessError{Node: u, Data: dataname, User: user, Write: write}
+}
+
+// ACLJSON returns JSON for the ACL that applies to the dataset with the node of the given
+// UUID or, if dataname is not empty, to the named data, or "null" if access is not limited.
+func (s *Service) ACLJSON(u dvid.UUID, dataname dvid.DataString) (string, error) {
+	if s.Datasets == nil {
+		return "", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return "", err
+	}
+	dataset.mapLock.Lock()
+	m, err := json.Marshal(dataset.aclFor(dataname))
+	dataset.mapLock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
+
+// readableDatasets returns the datasets the user may read.
+func (s *Service) readableDatasets(user string) ([]*Dataset, error) {
+	s.Datasets.writeLock.Lock()
+	list := append([]*Dataset{}, s.Datasets.list...)
+	s.Datasets.writeLock.Unlock()
+	var readable []*Dataset
+	for _, dset := range list {
+		err := s.CheckAccess(dset.Root, "", user, false)
+		if _, denied := err.(*AccessError); denied {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		readable = append(readable, dset)
+	}
+	return readable, nil
+}
+
+// ReadableDatasetsListJSON returns the JSON of DatasetsListJSON limited to the datasets
+// the user may read.
+func (s *Service) ReadableDatasetsListJSON(user string) (string, error) {
+	if s.Datasets == nil {
+		return "{}", nil
+	}
+	readable, err := s.readableDatasets(user)
+	if err != nil {
+		return "", err
+	}
+	sdata := s.Datasets.serializableStruct()
+	sdata.DatasetsUUID = []dvid.UUID{}
+	for _, dset := range readable {
+		sdata.DatasetsUUID = append(sdata.DatasetsUUID, dset.Root)
+	}
+	m, err := json.Marshal(sdata)
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
+
+// ReadableDatasetsAllJSON returns the JSON of DatasetsAllJSON limited to the datasets
+// the user may read.
+func (s *Service) ReadableDatasetsAllJSON(user string) (string, error) {
+	if s.Datasets == nil {
+		return "{}", nil
+	}
+	readable, err := s.readableDatasets(user)
+	if err != nil {
+		return "", err
+	}
+	if readable == nil {
+		readable = []*Dataset{}
+	}
+	m, err := json.Marshal(struct {
+		Datasets []*Dataset
+	}{readable})
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"strings"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestACLs(c *C) {
+	compiled := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype", "example.com/testtype", "0.1")}}
+	CompiledTypes[compiled.DatatypeUrl()] = compiled
+	defer delete(CompiledTypes, compiled.DatatypeUrl())
+
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "public", dvid.NewConfig()), IsNil)
+	c.Assert(service.NewData(root, "testtype", "private", dvid.NewConfig()), IsNil)
+	c.Assert(service.CheckAccess(root, "", "", true), IsNil)
+
+	// Only the lab reads the dataset, and only alice writes it.
+	c.Assert(service.SetGroup("@lab", []string{"bob", "alice"}), IsNil)
+	c.Assert(service.SetACL(root, "", &ACL{Readers: []string{"@lab"}, Writers: []string{"alice"}}), IsNil)
+	c.Assert(service.CheckAccess(root, "public", "alice", true), IsNil)
+	c.Assert(service.CheckAccess(root, "public", "bob", false), IsNil)
+	err = service.CheckAccess(root, "public", "bob", true)
+	_, denied := err.(*AccessError)
+	c.Assert(denied, Equals, true)
+	c.Assert(service.CheckAccess(root, "", "carol", false), NotNil)
+
+	// Datasets are only listed for users who may read them.
+	jsonStr, err := service.ReadableDatasetsListJSON("bob")
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(jsonStr, string(root)), Equals, true)
+	jsonStr, err = service.ReadableDatasetsAllJSON("carol")
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, `{"Datasets":[]}`)
+
+	// Data ACLs replace the dataset's ACL, and empty writers lets readers write.
+	c.Assert(service.SetACL(root, "private", &ACL{Readers: []string{"carol"}}), IsNil)
+	c.Assert(service.CheckAccess(root, "private", "carol", true), IsNil)
+	c.Assert(service.CheckAccess(root, "private", "alice", false), NotNil)
+	c.Assert(service.SetACL(root, "missing", &ACL{}), NotNil)
+	service.Shutdown()
+
+	// ACLs and groups persist.
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	c.Assert(service.CheckAccess(root, "public", "bob", false), IsNil)
+	c.Assert(service.CheckAccess(root, "private", "alice", false), NotNil)
+	jsonStr, err = service.ACLJSON(root, "private")
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, `{"Readers":["carol"],"Writers":null}`)
+	jsonStr, err = service.GroupsJSON()
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, `{"lab":["alice","bob"]}`)
+
+	c.Assert(service.SetGroup("lab", nil), IsNil)
+	c.Assert(service.SetGroup("lab", nil), NotNil)
+	c.Assert(service.CheckAccess(root, "public", "bob", false), NotNil)
+	c.Assert(service.SetACL(root, "private", nil), IsNil)
+	c.Assert(service.CheckAccess(root, "private", "alice", true), IsNil)
+	c.Assert(service.SetACL(root, "", nil), IsNil)
+	c.Assert(service.CheckAccess(root, "private", "carol", true), IsNil)
+	jsonStr, err = service.ACLJSON(root, "")
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, "null")
+}
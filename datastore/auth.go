@@ -0,0 +1,247 @@
+/*
+	This file supports bearer tokens that authenticate users of a DVID server.  Only a
+	hash of each token is stored, so issued tokens cannot be recovered from the datastore.
+*/
+
+package datastore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// TokenIDLength is the number of hexadecimal characters of a token ID.
+const TokenIDLength = 12
+
+// tokensKey is the name of the server key holding the issued tokens.
+const tokensKey = "tokens"
+
+// AuthToken describes an issued bearer token.
+type AuthToken struct {
+	// ID identifies the token in listings and revocations without revealing it.
+	ID string
+
+	// User is the identity of requests authenticated by the token.
+	User string
+
+	// Admin tokens can issue and revoke tokens.
+	Admin bool
+
+	Note    string `json:",omitempty"`
+	Created time.Time
+
+	// Expires is the time the token stops authenticating requests or zero if it
+	// does not expire.
+	Expires time.Time
+
+	// Hash is the hexadecimal SHA-256 hash of the token.
+	Hash string `json:"-"`
+}
+
+// Expired returns true if the token does not authenticate requests at the given time.
+func (t *AuthToken) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+// authTokens holds the issued tokens of a service, which are loaded from storage on
+// first use.
+type authTokens struct {
+	sync.Mutex
+	loaded bool
+	byHash map[string]*AuthToken
+}
+
+type tokensByID []*AuthToken
+
+func (t tokensByID) Len() int           { return len(t) }
+func (t tokensByID) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t tokensByID) Less(i, j int) bool { return t[i].ID < t[j].ID }
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadTokens reads the issued tokens from storage if they have not been read.  The
+// caller must hold the lock.
+func (s *Service) loadTokens() error {
+	tokens := &s.tokens
+	if tokens.loaded {
+		return nil
+	}
+	value, err := s.kvGetter.Get(&ServerKey{tokensKey})
+	if err != nil {
+		return err
+	}
+	var list []*AuthToken
+	if value != nil {
+		if err = dvid.Deserialize(value, &list); err != nil {
+			return fmt.Errorf("Unable to read authentication tokens: %s", err.Error())
+		}
+	}
+	tokens.byHash = make(map[string]*AuthToken, len(list))
+	for _, token := range list {
+		tokens.byHash[token.Hash] = token
+	}
+	tokens.loaded = true
+	return nil
+}
+
+// putTokens stores the issued tokens.  The caller must hold the lock.
+func (s *Service) putTokens() error {
+	list := s.tokenList()
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	serialization, err := dvid.Serialize(list, compression, dvid.CRC32)
+	if err != nil {
+		return err
+	}
+	return s.kvSetter.Put(&ServerKey{tokensKey}, serialization)
+}
+
+// tokenList returns the issued tokens sorted by ID.  The caller must hold the lock.
+func (s *Service) tokenList() []*AuthToken {
+	list := make([]*AuthToken, 0, len(s.tokens.byHash))
+	for _, token := range s.tokens.byHash {
+		list = append(list, token)
+	}
+	sort.Sort(tokensByID(list))
+	return list
+}
+
+// IssueToken creates a token authenticating requests as the given user and returns
+// the token, which cannot be retrieved later, and its description.  If ttl is not
+// zero, the token expires after that duration.  Expired tokens are dropped so tokens
+// issued for short sessions do not accumulate.
+func (s *Service) IssueToken(user string, admin bool, ttl time.Duration, note string) (string, *AuthToken, error) {
+	if user == "" {
+		return "", nil, fmt.Errorf("Tokens must be issued to a user")
+	}
+	if ttl < 0 {
+		return "", nil, fmt.Errorf("Token time-to-live must not be negative: %s", ttl)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("Unable to generate token: %s", err.Error())
+	}
+	secret := hex.EncodeToString(b)
+	hash := hashToken(secret)
+	token := &AuthToken{
+		ID:      hash[:TokenIDLength],
+		User:    user,
+		Admin:   admin,
+		Note:    note,
+		Created: time.Now(),
+		Hash:    hash,
+	}
+	if ttl != 0 {
+		token.Expires = token.Created.Add(ttl)
+	}
+
+	tokens := &s.tokens
+	tokens.Lock()
+	defer tokens.Unlock()
+	if err := s.loadTokens(); err != nil {
+		return "", nil, err
+	}
+	expired := make(map[string]*AuthToken)
+	for h, t := range tokens.byHash {
+		if t.Expired(token.Created) {
+			expired[h] = t
+			delete(tokens.byHash, h)
+		}
+	}
+	tokens.byHash[hash] = token
+	if err := s.putTokens(); err != nil {
+		delete(tokens.byHash, hash)
+		for h, t := range expired {
+			tokens.byHash[h] = t
+		}
+		return "", nil, err
+	}
+	described := *token
+	return secret, &described, nil
+}
+
+// RevokeToken deletes the token with the given ID so it no longer authenticates requests.
+func (s *Service) RevokeToken(id string) error {
+	tokens := &s.tokens
+	tokens.Lock()
+	defer tokens.Unlock()
+	if err := s.loadTokens(); err != nil {
+		return err
+	}
+	for hash, token := range tokens.byHash {
+		if token.ID == id {
+			delete(tokens.byHash, hash)
+			if err := s.putTokens(); err != nil {
+				tokens.byHash[hash] = token
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("No token with ID %q", id)
+}
+
+// Authenticate returns the description of an issued, unexpired token.
+func (s *Service) Authenticate(secret string) (*AuthToken, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("No token given")
+	}
+	tokens := &s.tokens
+	tokens.Lock()
+	defer tokens.Unlock()
+	if err := s.loadTokens(); err != nil {
+		return nil, err
+	}
+	token, found := tokens.byHash[hashToken(secret)]
+	if !found {
+		return nil, fmt.Errorf("Unknown or revoked token")
+	}
+	if token.Expired(time.Now()) {
+		return nil, fmt.Errorf("Token %s expired at %s", token.ID, token.Expires.Format(time.RFC3339))
+	}
+	described := *token
+	return &described, nil
+}
+
+// NumAdminTokens returns the number of unexpired admin tokens.
+func (s *Service) NumAdminTokens() (int, error) {
+	tokens := &s.tokens
+	tokens.Lock()
+	defer tokens.Unlock()
+	if err := s.loadTokens(); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var num int
+	for _, token := range tokens.byHash {
+		if token.Admin && !token.Expired(now) {
+			num++
+		}
+	}
+	return num, nil
+}
+
+// TokensJSON returns JSON describing the issued tokens, sorted by ID.
+func (s *Service) TokensJSON() (string, error) {
+	tokens := &s.tokens
+	tokens.Lock()
+	defer tokens.Unlock()
+	if err := s.loadTokens(); err != nil {
+		return "[]", err
+	}
+	m, err := json.Marshal(s.tokenList())
+	if err != nil {
+		return "[]", err
+	}
+	return string(m), nil
+}
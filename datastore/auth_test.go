@@ -0,0 +1,79 @@
+package datastore
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestAuthTokens(c *C) {
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+
+	numAdmin, err := service.NumAdminTokens()
+	c.Assert(err, IsNil)
+	c.Assert(numAdmin, Equals, 0)
+	_, _, err = service.IssueToken("", false, 0, "")
+	c.Assert(err, NotNil)
+
+	adminSecret, admin, err := service.IssueToken("alice", true, 0, "setup")
+	c.Assert(err, IsNil)
+	c.Assert(admin.ID, Equals, hashToken(adminSecret)[:TokenIDLength])
+	userSecret, user, err := service.IssueToken("bob", false, time.Hour, "")
+	c.Assert(err, IsNil)
+	expiredSecret, _, err := service.IssueToken("carol", true, time.Nanosecond, "")
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond)
+
+	token, err := service.Authenticate(userSecret)
+	c.Assert(err, IsNil)
+	c.Assert(token.User, Equals, "bob")
+	c.Assert(token.Admin, Equals, false)
+	_, err = service.Authenticate(expiredSecret)
+	c.Assert(err, NotNil)
+	_, err = service.Authenticate("not a token")
+	c.Assert(err, NotNil)
+	_, err = service.Authenticate("")
+	c.Assert(err, NotNil)
+	numAdmin, err = service.NumAdminTokens()
+	c.Assert(err, IsNil)
+	c.Assert(numAdmin, Equals, 1)
+
+	// Listings never reveal tokens or their hashes.
+	jsonStr, err := service.TokensJSON()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(jsonStr, userSecret), Equals, false)
+	c.Assert(strings.Contains(jsonStr, user.Hash), Equals, false)
+	c.Assert(strings.Contains(jsonStr, `"User":"bob"`), Equals, true)
+	c.Assert(strings.Contains(jsonStr, `"User":"carol"`), Equals, true)
+
+	// Expired tokens are dropped when another token is issued.
+	_, _, err = service.IssueToken("dave", false, time.Hour, "")
+	c.Assert(err, IsNil)
+	jsonStr, err = service.TokensJSON()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(jsonStr, `"User":"carol"`), Equals, false)
+
+	c.Assert(service.RevokeToken(user.ID), IsNil)
+	c.Assert(service.RevokeToken(user.ID), NotNil)
+	_, err = service.Authenticate(userSecret)
+	c.Assert(err, NotNil)
+
+	// Tokens persist.
+	service.Shutdown()
+	reopened, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	defer reopened.Shutdown()
+	token, err = reopened.Authenticate(adminSecret)
+	c.Assert(err, IsNil)
+	c.Assert(token.ID, Equals, admin.ID)
+	c.Assert(token.Admin, Equals, true)
+	c.Assert(token.Note, Equals, "setup")
+	_, err = reopened.Authenticate(userSecret)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,400 @@
+/*
+	This file supports backups of a running datastore into a tar archive.  Values are
+	read from a snapshot of the storage engine when it supports one, so the backup is
+	consistent even while writes continue.  Each dataset is stored as a stream in the
+	replication format, split into archive files of limited size, and a manifest
+	listing the versions, data instances, and checksums of the backup ends the archive.
+*/
+
+package datastore
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+const (
+	// BackupFormat is the version of the archive format written by WriteBackup.
+	BackupFormat = 1
+
+	// BackupManifestName is the name of the manifest file within a backup archive.
+	BackupManifestName = "manifest.json"
+)
+
+// BackupPartSize is the maximum number of bytes of a dataset's stream held in one
+// file of a backup archive.  Parts are buffered in memory while being written.
+var BackupPartSize = 64 * dvid.Mega
+
+// BackupSelection selects what to back up.  Each key is the UUID of any node of a
+// dataset to back up, and its value names the data to back up, or all data if empty.
+// If the selection is empty, all datasets are backed up.
+type BackupSelection map[dvid.UUID][]dvid.DataString
+
+// BackupManifest describes a backup archive.
+type BackupManifest struct {
+	Format  int
+	Created time.Time
+
+	// Snapshot is true if all values were read from one snapshot of the store.  If
+	// false, values at unlocked nodes may have changed while the backup was written.
+	Snapshot bool
+
+	Datasets []*BackupDataset
+}
+
+// BackupDataset describes a dataset within a backup archive.
+type BackupDataset struct {
+	Root  dvid.UUID
+	Alias string
+
+	// Nodes are all nodes of the dataset with parents before children.
+	Nodes []BackupNode
+
+	Data []*BackupData
+
+	// Parts are the archive files holding the dataset's stream in order.
+	Parts []BackupPart
+}
+
+// BackupNode describes a version node within a backup archive.
+type BackupNode struct {
+	UUID    dvid.UUID
+	Parents []dvid.UUID `json:",omitempty"`
+	Locked  bool
+}
+
+// BackupData describes a data instance within a backup archive.  Its checksum is the
+// SHA-256 of its key/value pairs in stream order as computed by hashBackupValue.
+type BackupData struct {
+	Name        dvid.DataString
+	TypeURL     UrlString
+	TypeVersion string
+	Keys        int64
+	Bytes       int64
+	SHA256      string
+}
+
+// BackupPart is a file of a backup archive holding part of a dataset's stream.
+type BackupPart struct {
+	Name   string
+	Bytes  int64
+	SHA256 string
+}
+
+// hashBackupValue adds a key/value pair of data at a node to a data checksum.
+func hashBackupValue(h hash.Hash, node dvid.UUID, index, value []byte) {
+	var length [4]byte
+	for _, b := range [][]byte{[]byte(node), index, value} {
+		binary.BigEndian.PutUint32(length[:], uint32(len(b)))
+		h.Write(length[:])
+		h.Write(b)
+	}
+}
+
+// backupSource is a dataset selected for backup with its metadata as of the backup.
+type backupSource struct {
+	dataset  *Dataset
+	nodes    []dvid.UUID
+	versions map[dvid.UUID]dvid.VersionLocalID
+	header   *replicationHeader
+	dataMap  map[dvid.DataString]DataService
+	names    []dvid.DataString
+}
+
+// newBackupSource copies the metadata of a dataset and its named data, or all data.
+func newBackupSource(dataset *Dataset, datanames []dvid.DataString) (*backupSource, error) {
+	dataMap, err := dataset.cloneDataMap()
+	if err != nil {
+		return nil, err
+	}
+	if len(datanames) != 0 {
+		selected := make(map[dvid.DataString]DataService, len(datanames))
+		for _, name := range datanames {
+			data, found := dataMap[name]
+			if !found {
+				return nil, fmt.Errorf("No data '%s' in dataset %s", name, dataset.Root)
+			}
+			selected[name] = data
+		}
+		dataMap = selected
+	}
+	src := &backupSource{
+		dataset:  dataset,
+		versions: make(map[dvid.UUID]dvid.VersionLocalID),
+		dataMap:  dataMap,
+	}
+	names := make([]string, 0, len(dataMap))
+	for name, data := range dataMap {
+		if _, ok := data.(replicableData); !ok {
+			return nil, fmt.Errorf("Data '%s' cannot be backed up", name)
+		}
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		src.names = append(src.names, dvid.DataString(name))
+	}
+
+	dataset.mapLock.Lock()
+	for u, versionID := range dataset.VersionMap {
+		src.nodes = append(src.nodes, u)
+		src.versions[u] = versionID
+	}
+	dataset.mapLock.Unlock()
+	sort.Sort(uuidsByVersion{src.nodes, src.versions})
+
+	src.header = &replicationHeader{Format: ReplicationFormat, Root: dataset.Root, Alias: dataset.Alias}
+	for _, u := range src.nodes {
+		node, err := dataset.node(u)
+		if err != nil {
+			return nil, err
+		}
+		src.header.Nodes = append(src.header.Nodes, newReplicatedNode(node))
+	}
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	if src.header.DataMap, err = dvid.Serialize(dataMap, compression, dvid.NoChecksum); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// write adds the dataset's stream to an archive, reading values from db.
+func (src *backupSource) write(tw *tar.Writer, db storage.KeyValueGetter, created time.Time,
+	job *Job) (*BackupDataset, error) {
+
+	dataset := src.dataset
+	backup := &BackupDataset{Root: dataset.Root, Alias: dataset.Alias}
+	for _, replicated := range src.header.Nodes {
+		node := BackupNode{UUID: replicated.Version.GlobalID, Locked: replicated.Version.Locked}
+		if len(replicated.Version.Parents) != 0 {
+			node.Parents = replicated.Version.Parents
+		}
+		backup.Nodes = append(backup.Nodes, node)
+	}
+
+	parts := &backupPartWriter{tw: tw, prefix: fmt.Sprintf("datasets/%s", dataset.Root), modTime: created}
+	enc := gob.NewEncoder(parts)
+	if err := enc.Encode(src.header); err != nil {
+		return nil, err
+	}
+	for _, dataname := range src.names {
+		service := src.dataMap[dataname]
+		data := service.(replicableData)
+		backupData := &BackupData{
+			Name:        dataname,
+			TypeURL:     service.DatatypeUrl(),
+			TypeVersion: service.DatatypeVersion(),
+		}
+		h := sha256.New()
+		dsetID, dataID := dataset.DatasetID, data.LocalID()
+		for _, u := range src.nodes {
+			versionID := src.versions[u]
+			var encodeErr error
+			minKey, maxKey := versionKeyRange(dsetID, dataID, versionID)
+			err := db.ProcessRange(job.Context(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+				if encodeErr != nil {
+					return
+				}
+				dataKey, ok := chunk.K.(*DataKey)
+				if !ok || dataKey.Dataset != dsetID || dataKey.Data != dataID || dataKey.Version != versionID {
+					return
+				}
+				index := dataKey.Index.Bytes()
+				encodeErr = enc.Encode(&replicatedKeyValue{Data: dataname, Node: u, Index: index, Value: chunk.V})
+				hashBackupValue(h, u, index, chunk.V)
+				backupData.Keys++
+				backupData.Bytes += int64(len(index) + len(chunk.V))
+				job.Throttle(len(index) + len(chunk.V))
+			})
+			if err != nil {
+				return nil, err
+			}
+			if encodeErr != nil {
+				return nil, encodeErr
+			}
+			deleted, err := tombstonedIndices(context.Background(), db, dsetID, dataID, versionID, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, index := range deleted {
+				if err = enc.Encode(&replicatedKeyValue{Data: dataname, Node: u, Index: index, Deleted: true}); err != nil {
+					return nil, err
+				}
+				hashBackupValue(h, u, index, nil)
+			}
+			job.Advance(1)
+		}
+		backupData.SHA256 = hex.EncodeToString(h.Sum(nil))
+		backup.Data = append(backup.Data, backupData)
+		job.Logf("Backed up %d keys of '%s' in dataset %s", backupData.Keys, dataname, dataset.Root)
+	}
+	if err := enc.Encode(&replicatedKeyValue{}); err != nil {
+		return nil, err
+	}
+	if err := parts.flush(); err != nil {
+		return nil, err
+	}
+	backup.Parts = parts.parts
+	return backup, nil
+}
+
+// backupPartWriter splits a stream into archive files of at most BackupPartSize bytes,
+// recording the size and checksum of each.
+type backupPartWriter struct {
+	tw      *tar.Writer
+	prefix  string
+	modTime time.Time
+	buf     bytes.Buffer
+	parts   []BackupPart
+}
+
+func (pw *backupPartWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := BackupPartSize - pw.buf.Len()
+		if room > len(p) {
+			room = len(p)
+		}
+		pw.buf.Write(p[:room])
+		p = p[room:]
+		if pw.buf.Len() >= BackupPartSize {
+			if err := pw.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush writes any buffered bytes as the next part.
+func (pw *backupPartWriter) flush() error {
+	if pw.buf.Len() == 0 {
+		return nil
+	}
+	name := fmt.Sprintf("%s/part-%06d", pw.prefix, len(pw.parts)+1)
+	if err := writeTarFile(pw.tw, name, pw.buf.Bytes(), pw.modTime); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(pw.buf.Bytes())
+	pw.parts = append(pw.parts, BackupPart{name, int64(pw.buf.Len()), hex.EncodeToString(sum[:])})
+	pw.buf.Reset()
+	return nil
+}
+
+// writeTarFile adds a file to an archive.
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// snapshot returns a getter reading a snapshot of the store and a function releasing
+// it, or an error if the storage engine does not support snapshots.
+func (s *Service) snapshot() (storage.KeyValueGetter, func(), error) {
+	snapshotter, ok := s.engine.(storage.Snapshotter)
+	if !ok {
+		return nil, nil, fmt.Errorf("Storage engine %s does not support snapshots", s.engine.GetName())
+	}
+	return snapshotter.Snapshot()
+}
+
+// WriteBackup writes a tar archive holding the selected datasets and data, with all
+// their versions, followed by a manifest, which is returned.  The backup reports its
+// progress through the job.
+func (s *Service) WriteBackup(w io.Writer, selection BackupSelection, job *Job) (*BackupManifest, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+
+	// Take the snapshot before copying metadata so all values read belong to nodes and
+	// data in the manifest.
+	manifest := &BackupManifest{Format: BackupFormat, Created: time.Now(), Datasets: []*BackupDataset{}}
+	db, release, err := s.snapshot()
+	if err == nil {
+		defer release()
+		manifest.Snapshot = true
+	} else {
+		dvid.Log(dvid.Normal, "Backup will read unlocked nodes while they may change: %s\n", err.Error())
+		db = s.kvGetter
+	}
+
+	var sources []*backupSource
+	if len(selection) == 0 {
+		s.Datasets.writeLock.Lock()
+		datasets := make([]*Dataset, len(s.Datasets.list))
+		copy(datasets, s.Datasets.list)
+		s.Datasets.writeLock.Unlock()
+		for _, dataset := range datasets {
+			src, err := newBackupSource(dataset, nil)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, src)
+		}
+	} else {
+		selected := make(map[dvid.UUID]bool)
+		uuids := make([]string, 0, len(selection))
+		for u := range selection {
+			uuids = append(uuids, string(u))
+		}
+		sort.Strings(uuids)
+		for _, u := range uuids {
+			dataset, err := s.Datasets.DatasetFromUUID(dvid.UUID(u))
+			if err != nil {
+				return nil, err
+			}
+			if selected[dataset.Root] {
+				return nil, fmt.Errorf("Dataset %s is selected more than once for backup", dataset.Root)
+			}
+			selected[dataset.Root] = true
+			src, err := newBackupSource(dataset, selection[dvid.UUID(u)])
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, src)
+		}
+	}
+
+	var total int64
+	for _, src := range sources {
+		total += int64(len(src.names) * len(src.nodes))
+	}
+	job.SetTotal(total)
+
+	tw := tar.NewWriter(w)
+	for _, src := range sources {
+		backup, err := src.write(tw, db, manifest.Created, job)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Datasets = append(manifest.Datasets, backup)
+	}
+	m, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = writeTarFile(tw, BackupManifestName, m, manifest.Created); err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
@@ -0,0 +1,69 @@
+package datastore
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestBackup(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+	c.Assert(service.NewData(root, "testtype", "other", versioned), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), []byte("root b")), IsNil)
+	c.Assert(service.Commit(root, CommitInfo{Author: "alice"}), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("a")), []byte("child a")), IsNil)
+
+	_, err = service.WriteBackup(ioutil.Discard, BackupSelection{child: {"unknown"}}, nil)
+	c.Assert(err, NotNil)
+
+	var buf bytes.Buffer
+	manifest, err := service.WriteBackup(&buf, BackupSelection{child: {"mydata"}}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Datasets, HasLen, 1)
+	backup := manifest.Datasets[0]
+	c.Assert(backup.Root, Equals, root)
+	c.Assert(backup.Nodes, DeepEquals, []BackupNode{{UUID: root, Locked: true}, {UUID: child, Parents: []dvid.UUID{root}}})
+	c.Assert(backup.Data, HasLen, 1)
+	c.Assert(backup.Data[0].Name, Equals, dvid.DataString("mydata"))
+	c.Assert(backup.Data[0].Keys, Equals, int64(3))
+	c.Assert(backup.Parts, HasLen, 1)
+
+	// The archive holds the dataset's stream and ends with the manifest.
+	tr := tar.NewReader(&buf)
+	header, err := tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, backup.Parts[0].Name)
+	part, err := ioutil.ReadAll(tr)
+	c.Assert(err, IsNil)
+	sum := sha256.Sum256(part)
+	c.Assert(hex.EncodeToString(sum[:]), Equals, backup.Parts[0].SHA256)
+	header, err = tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, BackupManifestName)
+	var stored BackupManifest
+	c.Assert(json.NewDecoder(tr).Decode(&stored), IsNil)
+	c.Assert(stored.Datasets[0].Data[0].SHA256, Equals, backup.Data[0].SHA256)
+	_, err = tr.Next()
+	c.Assert(err, Equals, io.EOF)
+}
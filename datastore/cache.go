@@ -0,0 +1,83 @@
+/*
+	This file supports an in-process cache of metadata derived from datasets, data
+	instances, and version DAGs so it needn't be regenerated for every request.
+*/
+
+package datastore
+
+import "sync"
+
+// maxMetadataEntries bounds the number of entries in the metadata cache, which has
+// a few entries per dataset.
+const maxMetadataEntries = 1024
+
+// metadataCache holds rendered metadata, e.g., JSON descriptions of datasets, until
+// a mutation invalidates it.  Each invalidation increments a consistency version so
+// clients can detect that metadata has changed.  Once it holds maxMetadataEntries,
+// an arbitrary entry is evicted for each new one.
+type metadataCache struct {
+	sync.RWMutex
+	version uint64
+	entries map[string]string
+}
+
+// get returns a cached entry or computes and caches it.  An entry computed while
+// an invalidation occurs is returned but not cached since it may be stale.
+func (c *metadataCache) get(key string, compute func() (string, error)) (string, error) {
+	c.RLock()
+	value, found := c.entries[key]
+	version := c.version
+	c.RUnlock()
+	if found {
+		return value, nil
+	}
+
+	value, err := compute()
+	if err != nil {
+		return value, err
+	}
+
+	c.Lock()
+	if c.version == version {
+		if c.entries == nil {
+			c.entries = make(map[string]string)
+		}
+		if len(c.entries) >= maxMetadataEntries {
+			for evicted := range c.entries {
+				delete(c.entries, evicted)
+				break
+			}
+		}
+		c.entries[key] = value
+	}
+	c.Unlock()
+	return value, nil
+}
+
+// invalidate discards all cached entries and increments the consistency version.
+func (c *metadataCache) invalidate() {
+	c.Lock()
+	c.version++
+	c.entries = nil
+	c.Unlock()
+}
+
+func (c *metadataCache) currentVersion() uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.version
+}
+
+// MetadataVersion returns a consistency version that changes whenever datasets,
+// data instances, or version DAGs of this service are modified.
+func (s *Service) MetadataVersion() uint64 {
+	return s.cache.currentVersion()
+}
+
+// InvalidateMetadata discards cached metadata.  It is called by all Service methods
+// that modify datasets and must be called by any code that alters metadata without
+// going through the Service, e.g., by changing instance properties in memory without
+// calling SaveDataset.
+func (s *Service) InvalidateMetadata() {
+	s.cache.invalidate()
+}
@@ -0,0 +1,39 @@
+package datastore
+
+import (
+	"fmt"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *DataSuite) TestMetadataCache(c *C) {
+	root, _, err := s.service.NewDataset()
+	c.Assert(err, IsNil)
+
+	version := s.service.MetadataVersion()
+	oldJSON, err := s.service.DatasetJSON(root)
+	c.Assert(err, IsNil)
+	cachedJSON, err := s.service.DatasetJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(cachedJSON, Equals, oldJSON)
+	c.Assert(s.service.MetadataVersion(), Equals, version)
+
+	// Mutations should invalidate cached metadata.
+	c.Assert(s.service.Lock(root), IsNil)
+	c.Assert(s.service.MetadataVersion() > version, Equals, true)
+	child, err := s.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	newJSON, err := s.service.DatasetJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(newJSON, Not(Equals), oldJSON)
+	c.Assert(newJSON, Matches, ".*"+string(child)+".*")
+
+	// The cache is bounded.
+	var cache metadataCache
+	for i := 0; i < maxMetadataEntries+10; i++ {
+		value, err := cache.get(fmt.Sprintf("key%d", i), func() (string, error) { return "value", nil })
+		c.Assert(err, IsNil)
+		c.Assert(value, Equals, "value")
+	}
+	c.Assert(cache.entries, HasLen, maxMetadataEntries)
+}
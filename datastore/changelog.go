@@ -0,0 +1,408 @@
+/*
+	This file supports changelogs: persistent, ordered logs of the mutation events of
+	data instances.  External systems can read a changelog from any offset to stay in
+	sync with DVID or to rebuild derived data after failures.  Changelogs are enabled
+	per instance with the "Changelog" configuration setting.
+*/
+
+package datastore
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// EventSchema is the version of the encoding of changelog events.  Events are stored
+// with their schema version so older events remain readable as the encoding evolves.
+const EventSchema = 1
+
+// DefaultChangelogRead is the number of events returned by a changelog read if no
+// maximum is given.
+const DefaultChangelogRead = 1000
+
+// MaxChangelogRead is the largest number of events returned by a changelog read.
+const MaxChangelogRead = 100000
+
+// Event is a mutation of data at a version.  The type of event is datatype-specific,
+// e.g., "put" or "delete", and determines the structure of its JSON payload.
+type Event struct {
+	Offset  uint64
+	Schema  uint8
+	Type    string
+	Version dvid.UUID
+	Time    time.Time
+	Payload json.RawMessage `json:",omitempty"`
+}
+
+// MarshalBinary encodes an event compactly, without its offset, which is in its key.
+func (e *Event) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 9, 9+2*binary.MaxVarintLen64+len(e.Type)+len(e.Version)+len(e.Payload))
+	buf[0] = EventSchema
+	binary.BigEndian.PutUint64(buf[1:9], uint64(e.Time.UnixNano()))
+	buf = appendUvarintBytes(buf, []byte(e.Type))
+	buf = appendUvarintBytes(buf, []byte(e.Version))
+	return append(buf, e.Payload...), nil
+}
+
+// appendUvarintBytes appends bytes preceded by their length.
+func appendUvarintBytes(buf, b []byte) []byte {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(b)))
+	buf = append(buf, length[:n]...)
+	return append(buf, b...)
+}
+
+// UnmarshalBinary decodes an event encoded with any supported schema.
+func (e *Event) UnmarshalBinary(b []byte) error {
+	if len(b) < 9 {
+		return fmt.Errorf("Changelog event has only %d bytes", len(b))
+	}
+	e.Schema = b[0]
+	if e.Schema != EventSchema {
+		return fmt.Errorf("Changelog event has unknown schema %d", e.Schema)
+	}
+	e.Time = time.Unix(0, int64(binary.BigEndian.Uint64(b[1:9])))
+	b = b[9:]
+	var fields [2][]byte
+	for i := range fields {
+		length, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < length {
+			return fmt.Errorf("Changelog event is truncated")
+		}
+		fields[i] = b[n : n+int(length)]
+		b = b[n+int(length):]
+	}
+	e.Type = string(fields[0])
+	e.Version = dvid.UUID(fields[1])
+	e.Payload = nil
+	if len(b) != 0 {
+		e.Payload = json.RawMessage(append([]byte{}, b...))
+	}
+	return nil
+}
+
+// changelogData is fulfilled by any data service embedding Data.
+type changelogData interface {
+	DataName() dvid.DataString
+	DatasetID() dvid.DatasetLocalID
+	LocalID() dvid.DataLocalID
+	ChangelogEnabled() bool
+}
+
+// ChangelogEnabled returns true if mutation events of this data are logged.
+func (d *Data) ChangelogEnabled() bool {
+	return d.Changelog
+}
+
+type changelogID struct {
+	Dataset dvid.DatasetLocalID
+	Data    dvid.DataLocalID
+}
+
+// changelog tracks the offsets of the first and next events of a data instance's
+// changelog.  Offsets are loaded from storage on first use.
+type changelog struct {
+	sync.Mutex
+	loaded      bool
+	first, next uint64
+}
+
+// changelogHeadOffset is the offset of the key holding the offset of the next event of
+// a changelog, so the offset is loaded without reading every event.
+const changelogHeadOffset = ^uint64(0)
+
+// load reads the offsets of the first and next events of a changelog.  Changelogs
+// written before their next offset was stored are read event by event.
+func (log *changelog) load(db storage.KeyValueGetter, id changelogID) error {
+	head, err := db.Get(&ChangelogKey{id.Dataset, id.Data, changelogHeadOffset})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	minKey, _ := changelogRange(id)
+	maxKey := &ChangelogKey{id.Dataset, id.Data, changelogHeadOffset - 1}
+	var numEvents int
+	err = db.ProcessRange(ctx, minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		changelogKey, ok := chunk.K.(*ChangelogKey)
+		if !ok || changelogKey.Data != id.Data {
+			return
+		}
+		if numEvents == 0 {
+			log.first = changelogKey.Offset
+		}
+		log.next = changelogKey.Offset + 1
+		numEvents++
+		if head != nil {
+			cancel()
+		}
+	})
+	if err != nil && err != context.Canceled {
+		return err
+	}
+	if len(head) == 8 {
+		log.next = binary.BigEndian.Uint64(head)
+	}
+	log.loaded = true
+	return nil
+}
+
+// changelogs holds the changelogs in use by a service.
+type changelogs struct {
+	sync.Mutex
+	logs map[changelogID]*changelog
+}
+
+// get returns the locked changelog for a data instance.
+func (c *changelogs) get(db storage.KeyValueGetter, id changelogID) (*changelog, error) {
+	c.Lock()
+	if c.logs == nil {
+		c.logs = make(map[changelogID]*changelog)
+	}
+	log, found := c.logs[id]
+	if !found {
+		log = new(changelog)
+		c.logs[id] = log
+	}
+	c.Unlock()
+
+	log.Lock()
+	if !log.loaded {
+		if err := log.load(db, id); err != nil {
+			log.Unlock()
+			return nil, err
+		}
+	}
+	return log, nil
+}
+
+// forget discards the state of a data instance's changelog after its keys are deleted.
+func (c *changelogs) forget(id changelogID) {
+	c.Lock()
+	delete(c.logs, id)
+	c.Unlock()
+}
+
+func changelogRange(id changelogID) (minKey, maxKey *ChangelogKey) {
+	minKey = &ChangelogKey{id.Dataset, id.Data, 0}
+	if id.Data == maxDataLocalID {
+		maxKey = &ChangelogKey{id.Dataset + 1, 0, 0}
+	} else {
+		maxKey = &ChangelogKey{id.Dataset, id.Data + 1, 0}
+	}
+	return
+}
+
+// MutationEvent is a mutation event to be appended to a changelog.  The payload is
+// encoded as JSON.
+type MutationEvent struct {
+	Type    string
+	Payload interface{}
+}
+
+// AppendEvent appends a mutation event to the changelog of the data if its changelog is
+// enabled and returns the offset of the event.  The payload is encoded as JSON.
+// Mutations stored in a batch should use CommitEvents instead, so the event is stored
+// with them.
+func (s *Service) AppendEvent(dataservice DataService, u dvid.UUID, eventType string,
+	payload interface{}) (offset uint64, err error) {
+
+	data, ok := dataservice.(changelogData)
+	if !ok || !data.ChangelogEnabled() {
+		return 0, nil
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return 0, err
+	}
+	return s.commitEvents(batcher.NewBatch(), data, u, []MutationEvent{{eventType, payload}})
+}
+
+// CommitEvents appends mutation events to the changelog of the data, if its changelog
+// is enabled, within a batch holding the mutation and commits the batch, so either the
+// mutation and its events are stored or neither is.
+func (s *Service) CommitEvents(batch storage.Batch, dataservice DataService, u dvid.UUID,
+	events ...MutationEvent) error {
+
+	data, ok := dataservice.(changelogData)
+	if !ok || !data.ChangelogEnabled() || len(events) == 0 {
+		return batch.Commit()
+	}
+	_, err := s.commitEvents(batch, data, u, events)
+	return err
+}
+
+// commitEvents puts events into a batch after the last event of the data's changelog,
+// commits the batch, and returns the offset of the first event.  The changelog stays
+// locked until the batch is committed so offsets are assigned in commit order.
+func (s *Service) commitEvents(batch storage.Batch, data changelogData, u dvid.UUID,
+	events []MutationEvent) (offset uint64, err error) {
+
+	values := make([][]byte, len(events))
+	now := time.Now()
+	for i, mutation := range events {
+		event := &Event{Schema: EventSchema, Type: mutation.Type, Version: u, Time: now}
+		if mutation.Payload != nil {
+			if event.Payload, err = json.Marshal(mutation.Payload); err != nil {
+				return 0, fmt.Errorf("Unable to encode %s event of data '%s': %s", mutation.Type,
+					data.DataName(), err.Error())
+			}
+		}
+		if values[i], err = event.MarshalBinary(); err != nil {
+			return 0, err
+		}
+	}
+
+	log, err := s.changelogs.get(s.kvGetter, changelogID{data.DatasetID(), data.LocalID()})
+	if err != nil {
+		return 0, err
+	}
+	defer log.Unlock()
+	offset = log.next
+	for i, value := range values {
+		batch.Put(&ChangelogKey{data.DatasetID(), data.LocalID(), offset + uint64(i)}, value)
+	}
+	head := make([]byte, 8)
+	binary.BigEndian.PutUint64(head, offset+uint64(len(values)))
+	batch.Put(&ChangelogKey{data.DatasetID(), data.LocalID(), changelogHeadOffset}, head)
+	if err = batch.Commit(); err != nil {
+		return 0, err
+	}
+	log.next += uint64(len(values))
+	return offset, nil
+}
+
+// ReadEvents returns up to max events, starting at an offset, from the changelog of data
+// in the dataset specified by a UUID, along with the offset to read next.  Offsets of
+// truncated events are not reused, so reading from a truncated offset starts at the
+// first remaining event.
+func (s *Service) ReadEvents(u dvid.UUID, dataname dvid.DataString, from uint64, max int) (
+	events []*Event, next uint64, err error) {
+
+	id, err := s.changelogID(u, dataname)
+	if err != nil {
+		return nil, from, err
+	}
+	if max <= 0 {
+		max = DefaultChangelogRead
+	}
+	if max > MaxChangelogRead {
+		max = MaxChangelogRead
+	}
+	log, err := s.changelogs.get(s.kvGetter, id)
+	if err != nil {
+		return nil, from, err
+	}
+	if from < log.first {
+		from = log.first
+	}
+	end := log.next
+	log.Unlock()
+	if from >= end {
+		return []*Event{}, from, nil
+	}
+	if end-from > uint64(max) {
+		end = from + uint64(max)
+	}
+	endKey := &ChangelogKey{id.Dataset, id.Data, end - 1}
+	kvs, err := s.kvGetter.GetRange(context.Background(), &ChangelogKey{id.Dataset, id.Data, from}, endKey)
+	if err != nil {
+		return nil, from, err
+	}
+	next = from
+	events = []*Event{}
+	for _, kv := range kvs {
+		key, ok := kv.K.(*ChangelogKey)
+		if !ok || key.Data != id.Data {
+			continue
+		}
+		event := new(Event)
+		if err = event.UnmarshalBinary(kv.V); err != nil {
+			return nil, from, fmt.Errorf("Bad changelog event %d of data '%s': %s", key.Offset, dataname, err.Error())
+		}
+		event.Offset = key.Offset
+		events = append(events, event)
+		if len(events) == max {
+			break
+		}
+	}
+	if len(events) != 0 {
+		next = events[len(events)-1].Offset + 1
+	}
+	return events, next, nil
+}
+
+// ChangelogJSON returns JSON with the events read by ReadEvents and the offset to read
+// next.
+func (s *Service) ChangelogJSON(u dvid.UUID, dataname dvid.DataString, from uint64, max int) (string, error) {
+	events, next, err := s.ReadEvents(u, dataname, from, max)
+	if err != nil {
+		return "", err
+	}
+	m, err := json.Marshal(struct {
+		Events []*Event
+		Next   uint64
+	}{events, next})
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
+
+// TruncateChangelog deletes all events before an offset from the changelog of data in
+// the dataset specified by a UUID, returning the number of events deleted.  The last
+// event is always kept so offsets are never reused.
+func (s *Service) TruncateChangelog(u dvid.UUID, dataname dvid.DataString, before uint64) (int, error) {
+	id, err := s.changelogID(u, dataname)
+	if err != nil {
+		return 0, err
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return 0, err
+	}
+	log, err := s.changelogs.get(s.kvGetter, id)
+	if err != nil {
+		return 0, err
+	}
+	defer log.Unlock()
+	if log.next > 0 && before > log.next-1 {
+		before = log.next - 1
+	}
+	if before <= log.first {
+		return 0, nil
+	}
+	minKey, _ := changelogRange(id)
+	numDeleted, err := deleteKeyRange(s.kvGetter, batcher, nil, minKey, &ChangelogKey{id.Dataset, id.Data, before - 1},
+		func(key storage.Key) bool {
+			changelogKey, ok := key.(*ChangelogKey)
+			return ok && changelogKey.Data == id.Data
+		})
+	if err != nil {
+		return numDeleted, err
+	}
+	log.first = before
+	return numDeleted, nil
+}
+
+// changelogID returns the changelog of the named data, which must have an enabled
+// changelog.
+func (s *Service) changelogID(u dvid.UUID, dataname dvid.DataString) (changelogID, error) {
+	dataservice, err := s.DataServiceByUUID(u, dataname)
+	if err != nil {
+		return changelogID{}, err
+	}
+	data, ok := dataservice.(changelogData)
+	if !ok || !data.ChangelogEnabled() {
+		return changelogID{}, fmt.Errorf("Data '%s' does not have a changelog.  Set 'Changelog' to enable it.",
+			dataname)
+	}
+	return changelogID{data.DatasetID(), data.LocalID()}, nil
+}
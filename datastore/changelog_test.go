@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestChangelog(c *C) {
+	compiled := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype", "example.com/testtype", "0.1")}}
+	CompiledTypes[compiled.DatatypeUrl()] = compiled
+	defer delete(CompiledTypes, compiled.DatatypeUrl())
+
+	dir := c.MkDir()
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "unlogged", dvid.NewConfig()), IsNil)
+	config := dvid.NewConfig()
+	config.Set("Changelog", "true")
+	c.Assert(service.NewData(root, "testtype", "logged", config), IsNil)
+	c.Assert(service.NewData(root, "testtype", "other", config), IsNil)
+
+	unlogged, err := service.DataServiceByUUID(root, "unlogged")
+	c.Assert(err, IsNil)
+	offset, err := service.AppendEvent(unlogged, root, "put", nil)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, uint64(0))
+	_, _, err = service.ReadEvents(root, "unlogged", 0, 0)
+	c.Assert(err, NotNil)
+
+	logged, err := service.DataServiceByUUID(root, "logged")
+	c.Assert(err, IsNil)
+	other, err := service.DataServiceByUUID(root, "other")
+	c.Assert(err, IsNil)
+	for i := 0; i < 5; i++ {
+		offset, err = service.AppendEvent(logged, root, "put", map[string]int{"Key": i})
+		c.Assert(err, IsNil)
+		c.Assert(offset, Equals, uint64(i))
+	}
+	_, err = service.AppendEvent(other, root, "delete", nil)
+	c.Assert(err, IsNil)
+
+	events, next, err := service.ReadEvents(root, "logged", 1, 2)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 2)
+	c.Assert(next, Equals, uint64(3))
+	c.Assert(events[0].Offset, Equals, uint64(1))
+	c.Assert(events[0].Schema, Equals, uint8(EventSchema))
+	c.Assert(events[0].Type, Equals, "put")
+	c.Assert(events[0].Version, Equals, root)
+	c.Assert(string(events[1].Payload), Equals, `{"Key":2}`)
+
+	// Offsets continue after the service is reopened.
+	service.Shutdown()
+	service, err = Open(dir)
+	c.Assert(err, IsNil)
+	defer service.Shutdown()
+	logged, err = service.DataServiceByUUID(root, "logged")
+	c.Assert(err, IsNil)
+	offset, err = service.AppendEvent(logged, root, "delete", nil)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, uint64(5))
+
+	// Truncation keeps the last event and reads skip truncated offsets.
+	numDeleted, err := service.TruncateChangelog(root, "logged", 3)
+	c.Assert(err, IsNil)
+	c.Assert(numDeleted, Equals, 3)
+	events, next, err = service.ReadEvents(root, "logged", 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 3)
+	c.Assert(events[0].Offset, Equals, uint64(3))
+	c.Assert(events[2].Payload, IsNil)
+	c.Assert(next, Equals, uint64(6))
+	numDeleted, err = service.TruncateChangelog(root, "logged", 100)
+	c.Assert(err, IsNil)
+	c.Assert(numDeleted, Equals, 2)
+	events, _, err = service.ReadEvents(root, "logged", 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].Offset, Equals, uint64(5))
+
+	jsonStr, err := service.ChangelogJSON(root, "other", 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Matches, `\{"Events":\[\{"Offset":0,"Schema":1,"Type":"delete".*\],"Next":1\}`)
+
+	// Events committed with a mutation are stored in the same batch.
+	batcher, err := service.Batcher()
+	c.Assert(err, IsNil)
+	batch := batcher.NewBatch()
+	key := logged.(*testData).DataKey(0, dvid.IndexString("k"))
+	batch.Put(key, []byte("v"))
+	c.Assert(service.CommitEvents(batch, logged, root, MutationEvent{Type: "put", Payload: "k"}), IsNil)
+	value, err := service.kvGetter.Get(key)
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []byte("v"))
+	events, next, err = service.ReadEvents(root, "logged", 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[1].Offset, Equals, uint64(6))
+	c.Assert(next, Equals, uint64(7))
+}
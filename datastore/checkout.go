@@ -0,0 +1,227 @@
+/*
+	This file supports checkout of a version into a new standalone datastore, copying
+	the values of selected data as resolved at that version so the new datastore holds
+	a single flattened root node without the history of its ancestors.  Data that are
+	SubsetCloner can also be cloned in part, limited to a box of voxel coordinates.
+*/
+
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Number of key/value pairs copied per batch when checking out a version.
+const checkoutBatchSize = 1000
+
+// copyResolvedVersion copies the key/value pairs of data resolved at the given versions
+// into a version of data with the local IDs of dst, which may be in another dataset and
+// store.  If ranges is not nil, only indices within the ranges are copied.  The I/O is
+// throttled by the job, which may be nil.
+func copyResolvedVersion(db storage.KeyValueGetter, batcher storage.Batcher, job *Job, dsetID dvid.DatasetLocalID,
+	dataID dvid.DataLocalID, versions []dvid.VersionLocalID, dst *DataKey, ranges dvid.IndexRanges) (int, error) {
+
+	found := make(map[string]bool)
+	batch := batcher.NewBatch()
+	var numKeys, numBatched int
+	for _, versionID := range versions {
+		var commitErr error
+		minKey, maxKey := versionKeyRange(dsetID, dataID, versionID)
+		err := db.ProcessRange(context.Background(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+			dataKey, ok := chunk.K.(*DataKey)
+			if commitErr != nil || !ok || dataKey.Dataset != dsetID || dataKey.Data != dataID ||
+				dataKey.Version != versionID {
+				return
+			}
+			if ranges != nil && !ranges.Contains(dataKey.Index) {
+				return
+			}
+			index := string(dataKey.Index.Bytes())
+			if found[index] {
+				return
+			}
+			found[index] = true
+			job.Throttle(len(index) + len(chunk.V))
+			batch.Put(&DataKey{dst.Dataset, dst.Data, dst.Version, dataKey.Index}, chunk.V)
+			numKeys++
+			numBatched++
+			if numBatched >= checkoutBatchSize {
+				if commitErr = batch.Commit(); commitErr != nil {
+					return
+				}
+				batch = batcher.NewBatch()
+				numBatched = 0
+			}
+		})
+		if err != nil {
+			return numKeys, err
+		}
+		if commitErr != nil {
+			return numKeys, commitErr
+		}
+		if err = addTombstones(context.Background(), db, dsetID, dataID, versionID, nil, nil, found); err != nil {
+			return numKeys, err
+		}
+	}
+	return numKeys, batch.Commit()
+}
+
+// Checkout creates a new datastore at the given path holding one dataset whose root
+// node has the named data as resolved at the node with the given UUID.  Values the
+// node inherits from ancestors are copied, so the new datastore does not need the
+// history of this one.  If no data names are given, all data are checked out.  The
+// new datastore uses the key encoding of this datastore.
+func (s *Service) Checkout(u dvid.UUID, path string, datanames []dvid.DataString) (root dvid.UUID, err error) {
+	return s.checkout(u, path, datanames, nil)
+}
+
+// CloneSubset creates a new datastore at the given path like Checkout, holding only
+// the part of the named data within the box from minPt to maxPt, inclusive, in voxel
+// coordinates.  The data must be a SubsetCloner, and the clone's available extents
+// are limited to the box.
+func (s *Service) CloneSubset(u dvid.UUID, path string, dataname dvid.DataString,
+	minPt, maxPt dvid.Point) (root dvid.UUID, err error) {
+
+	dataservice, err := s.DataServiceByUUID(u, dataname)
+	if err != nil {
+		return
+	}
+	subsetter, ok := dataservice.(SubsetCloner)
+	if !ok {
+		err = fmt.Errorf("Data '%s' cannot be partially cloned", dataname)
+		return
+	}
+	ranges, err := subsetter.SubsetIndices(minPt, maxPt)
+	if err != nil {
+		return
+	}
+	if len(ranges) == 0 {
+		err = fmt.Errorf("No part of data '%s' is within the box %s to %s", dataname, minPt, maxPt)
+		return
+	}
+	subsets := map[dvid.DataString]dvid.IndexRanges{dataname: ranges}
+	return s.checkout(u, path, []dvid.DataString{dataname}, subsets)
+}
+
+// checkout creates a new datastore holding the named data resolved at a node.  Data
+// with index ranges in subsets only have indices within those ranges copied.
+func (s *Service) checkout(u dvid.UUID, path string, datanames []dvid.DataString,
+	subsets map[dvid.DataString]dvid.IndexRanges) (root dvid.UUID, err error) {
+
+	if s.Datasets == nil {
+		err = fmt.Errorf("Datastore service has no datasets available")
+		return
+	}
+	src, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return
+	}
+	if _, found := src.Nodes[u]; !found {
+		err = fmt.Errorf("No node found with UUID %s", u)
+		return
+	}
+	if _, statErr := os.Stat(path); statErr == nil {
+		err = fmt.Errorf("Cannot checkout into existing path %s", path)
+		return
+	}
+	srcMap, err := src.cloneDataMap()
+	if err != nil {
+		return
+	}
+	dataMap := make(map[dvid.DataString]DataService)
+	if len(datanames) == 0 {
+		dataMap = srcMap
+	}
+	for _, name := range datanames {
+		data, found := srcMap[name]
+		if !found {
+			err = fmt.Errorf("Cannot find data '%s' to checkout", name)
+			return
+		}
+		dataMap[name] = data
+	}
+	for name, data := range dataMap {
+		if _, ok := data.(forkableData); !ok {
+			err = fmt.Errorf("Data '%s' cannot be checked out into a new datastore", name)
+			return
+		}
+	}
+
+	engine, err := storage.NewStore(path, true, dvid.Config{})
+	if err != nil {
+		err = fmt.Errorf("Error initializing datastore (%s): %s", path, err.Error())
+		return
+	}
+	defer engine.Close()
+	kvSetter, ok := engine.(storage.KeyValueSetter)
+	if !ok {
+		err = fmt.Errorf("Datastore at %s does not support setting of key-value pairs!", path)
+		return
+	}
+	batcher, ok := engine.(storage.Batcher)
+	if !ok {
+		err = fmt.Errorf("Datastore at %s does not support batch write", path)
+		return
+	}
+
+	datasets := &Datasets{
+		mapUUID:     make(map[dvid.UUID]*Dataset),
+		dsetIDs:     make(map[dvid.DatasetLocalID]*Dataset),
+		keyEncoding: s.Datasets.keyEncoding,
+	}
+	dset, err := datasets.newDataset()
+	if err != nil {
+		return
+	}
+	dset.ForkedFrom = u
+	dset.Alias = src.Alias
+	dset.NewDataID = src.NewDataID
+	dset.Nodes[dset.Root].NodeText = &NodeText{Note: fmt.Sprintf("Checked out from node %s", u)}
+	for _, data := range dataMap {
+		data.(forkableData).setDatasetID(dset.DatasetID)
+	}
+	dset.DataMap = dataMap
+	for name, data := range dataMap {
+		if forker, ok := data.(Forker); ok {
+			if err = forker.Forked(dset.DatasetID); err != nil {
+				return
+			}
+		}
+		var versions []dvid.VersionLocalID
+		versions, err = s.DataVersions(u, name)
+		if err != nil {
+			return
+		}
+		ranges := subsets[name]
+		if ranges != nil {
+			subsetter, ok := data.(SubsetCloner)
+			if !ok {
+				err = fmt.Errorf("Data '%s' cannot be partially cloned", name)
+				return
+			}
+			subsetter.SetAvailableExtents(ranges.Span().Intersect(subsetter.AvailableExtents()))
+		}
+		dataID := data.(forkableData).LocalID()
+		var numKeys int
+		numKeys, err = copyResolvedVersion(s.kvGetter, batcher, nil, src.DatasetID, dataID, versions,
+			&DataKey{dset.DatasetID, dataID, 0, nil}, ranges)
+		if err != nil {
+			return
+		}
+		dvid.Log(dvid.Debug, "Checked out data '%s' with %d key/value pairs from node %s\n", name, numKeys, u)
+	}
+
+	if err = datasets.Put(kvSetter); err != nil {
+		return
+	}
+	if err = dset.Put(kvSetter); err != nil {
+		return
+	}
+	root = dset.Root
+	return
+}
@@ -0,0 +1,60 @@
+package datastore
+
+import (
+	"path/filepath"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestCheckout(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", config), IsNil)
+	c.Assert(service.NewData(root, "testtype", "other", config), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	rootID := service.Datasets.mapUUID[root].VersionMap[root]
+	c.Assert(service.kvSetter.Put(data.DataKey(rootID, dvid.IndexBytes("a")), []byte("value a")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(rootID, dvid.IndexBytes("b")), []byte("value b")), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	childID := service.Datasets.mapUUID[child].VersionMap[child]
+	c.Assert(service.kvSetter.Put(data.DataKey(childID, dvid.IndexBytes("b")), []byte("new b")), IsNil)
+
+	path := filepath.Join(c.MkDir(), "checkout")
+	_, err = service.Checkout(child, path, []dvid.DataString{"unknown"})
+	c.Assert(err, NotNil)
+	checkoutRoot, err := service.Checkout(child, path, []dvid.DataString{"mydata"})
+	c.Assert(err, IsNil)
+	_, err = service.Checkout(child, path, nil)
+	c.Assert(err, NotNil) // path exists
+
+	checkout, err := Open(path)
+	c.Assert(err, IsNil)
+	defer checkout.Shutdown()
+	dset, err := checkout.DatasetFromUUID(checkoutRoot)
+	c.Assert(err, IsNil)
+	c.Assert(dset.ForkedFrom, Equals, child)
+	c.Assert(dset.Nodes, HasLen, 1)
+	_, err = dset.DataService("other")
+	c.Assert(err, NotNil)
+	checkoutService, err := dset.DataService("mydata")
+	c.Assert(err, IsNil)
+	checkoutData := checkoutService.(*testData)
+
+	value, err := checkout.kvGetter.Get(checkoutData.DataKey(0, dvid.IndexBytes("a")))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "value a")
+	value, err = checkout.kvGetter.Get(checkoutData.DataKey(0, dvid.IndexBytes("b")))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "new b")
+}
@@ -0,0 +1,186 @@
+/*
+	This file supports cloning a data instance into a new instance of the same or another
+	dataset, e.g., so users can experiment on a copy of a label volume.  The clone keeps
+	the type-specific metadata of its source and holds the source's values as resolved
+	at a node, optionally limited to a box or ROI for data that are SubsetCloner.
+*/
+
+package datastore
+
+import (
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// CloneOptions limits a clone to part of its source data.  At most one of a box or an
+// ROI can be given, and only for data that are SubsetCloner.
+type CloneOptions struct {
+	// MinPt and MaxPt, if not nil, give the inclusive box of voxel coordinates to clone.
+	MinPt, MaxPt dvid.Point
+
+	// ROI, if not nil, gives the blocks to clone.
+	ROI *dvid.ROI
+}
+
+// clonableData is fulfilled by any data service embedding Data.
+type clonableData interface {
+	replicableData
+	setName(name dvid.DataString)
+}
+
+func (d *Data) setName(name dvid.DataString) {
+	d.DataID.Name = name
+}
+
+// subsetRanges returns the index ranges of data selected by the options, or nil if all
+// indices are selected.
+func (opts CloneOptions) subsetRanges(dataservice DataService) (dvid.IndexRanges, error) {
+	box := opts.MinPt != nil || opts.MaxPt != nil
+	if !box && opts.ROI == nil {
+		return nil, nil
+	}
+	subsetter, ok := dataservice.(SubsetCloner)
+	if !ok {
+		return nil, fmt.Errorf("Data '%s' cannot be partially cloned", dataservice.DataName())
+	}
+	var ranges dvid.IndexRanges
+	var err error
+	switch {
+	case box && opts.ROI != nil:
+		return nil, fmt.Errorf("Clones can be limited to a box or an ROI but not both")
+	case box:
+		if opts.MinPt == nil || opts.MaxPt == nil {
+			return nil, fmt.Errorf("Clones limited to a box need both its minimum and maximum points")
+		}
+		ranges, err = subsetter.SubsetIndices(opts.MinPt, opts.MaxPt)
+	default:
+		ranges, err = subsetter.ROIIndices(opts.ROI)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("No part of data '%s' is within the selected blocks", dataservice.DataName())
+	}
+	return ranges, nil
+}
+
+// CloneData creates data with a new name holding the values of the named data as
+// resolved at the node with UUID u.  The clone is added to the dataset of the unlocked
+// node with UUID dest, which may be in another dataset, and its values are stored at
+// that node.  The clone reports its progress through the job and returns the number of
+// key/value pairs copied.
+func (s *Service) CloneData(u dvid.UUID, name dvid.DataString, dest dvid.UUID, newName dvid.DataString,
+	opts CloneOptions, job *Job) (int, error) {
+
+	if s.Datasets == nil {
+		return 0, fmt.Errorf("Datastore service has no datasets available")
+	}
+	if newName == "" {
+		return 0, fmt.Errorf("Clone of data '%s' requires a new data name", name)
+	}
+	src, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = src.node(u); err != nil {
+		return 0, err
+	}
+	dataservice, err := src.DataService(name)
+	if err != nil {
+		return 0, err
+	}
+	ranges, err := opts.subsetRanges(dataservice)
+	if err != nil {
+		return 0, err
+	}
+	versions, err := s.DataVersions(u, name)
+	if err != nil {
+		return 0, err
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(dest)
+	if err != nil {
+		return 0, err
+	}
+	node, err := dataset.node(dest)
+	if err != nil {
+		return 0, err
+	}
+	if node.Locked {
+		return 0, fmt.Errorf("Cannot clone data into locked node %s", dest)
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return 0, err
+	}
+
+	// Copy the metadata of the source data and reserve a local ID for the clone.
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	serialization, err := dvid.Serialize(map[dvid.DataString]DataService{name: dataservice},
+		compression, dvid.NoChecksum)
+	if err != nil {
+		return 0, err
+	}
+	copied := make(map[dvid.DataString]DataService)
+	if err = dvid.Deserialize(serialization, &copied); err != nil {
+		return 0, err
+	}
+	copiedData := copied[name]
+	clone, ok := copiedData.(clonableData)
+	if !ok {
+		return 0, fmt.Errorf("Data '%s' cannot be cloned", name)
+	}
+	if ranges != nil {
+		subsetter := copiedData.(SubsetCloner)
+		subsetter.SetAvailableExtents(ranges.Span().Intersect(subsetter.AvailableExtents()))
+	}
+	dataset.mapLock.Lock()
+	_, exists := dataset.DataMap[newName]
+	if !exists && dataset.scratchIndex(newName) < 0 {
+		clone.setName(newName)
+		clone.setDatasetID(dataset.DatasetID)
+		clone.setLocalID(dataset.NewDataID)
+		dataset.NewDataID++
+	}
+	dataset.mapLock.Unlock()
+	if exists || copiedData.DataName() != newName {
+		return 0, fmt.Errorf("Data named '%s' already exists in dataset %s", newName, dataset.Root)
+	}
+	if forker, ok := copiedData.(Forker); ok {
+		if err = forker.Forked(dataset.DatasetID); err != nil {
+			return 0, err
+		}
+	}
+
+	// Copy the resolved values, discarding them if the copy fails.
+	dst := &DataKey{dataset.DatasetID, clone.LocalID(), node.VersionID, nil}
+	numKeys, err := copyResolvedVersion(s.kvGetter, batcher, job, src.DatasetID,
+		dataservice.(versionedData).LocalID(), versions, dst, ranges)
+	if err == nil {
+		dataset.mapLock.Lock()
+		if _, exists = dataset.DataMap[newName]; !exists {
+			dataset.DataMap[newName] = copiedData
+		}
+		dataset.mapLock.Unlock()
+		if exists {
+			err = fmt.Errorf("Data named '%s' was added to dataset %s during the clone", newName, dataset.Root)
+		}
+	}
+	if err != nil {
+		minKey, maxKey := versionKeyRange(dst.Dataset, dst.Data, dst.Version)
+		selected := func(key storage.Key) bool {
+			dataKey, ok := key.(*DataKey)
+			return ok && dataKey.Dataset == dst.Dataset && dataKey.Data == dst.Data
+		}
+		if _, delErr := deleteKeyRange(s.kvGetter, batcher, nil, minKey, maxKey, selected); delErr != nil {
+			dvid.Log(dvid.Normal, "Unable to discard values of failed clone: %s\n", delErr.Error())
+		}
+		return 0, err
+	}
+	job.Logf("Cloned %d key/value pairs of '%s' at node %s into '%s' at node %s", numKeys, name, u, newName, dest)
+
+	s.InvalidateMetadata()
+	return numKeys, dataset.Put(s.kvSetter)
+}
@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestCloneData(c *C) {
+	compiled := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype", "example.com/testtype", "0.1")}}
+	CompiledTypes[compiled.DatatypeUrl()] = compiled
+	defer delete(CompiledTypes, compiled.DatatypeUrl())
+
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+	dset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	data := dset.DataMap["mydata"].(*testData)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), []byte("root b")), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	childID := dset.VersionMap[child]
+	c.Assert(service.kvSetter.Put(data.DataKey(childID, dvid.IndexBytes("b")), []byte("child b")), IsNil)
+
+	_, err = service.CloneData(child, "mydata", root, "copy", CloneOptions{}, nil)
+	c.Assert(err, NotNil)
+	_, err = service.CloneData(child, "mydata", child, "mydata", CloneOptions{}, nil)
+	c.Assert(err, NotNil)
+	_, err = service.CloneData(child, "mydata", child, "copy", CloneOptions{MinPt: dvid.Point3d{0, 0, 0},
+		MaxPt: dvid.Point3d{1, 1, 1}}, nil)
+	c.Assert(err, NotNil)
+
+	// Values inherited from ancestors are stored at the node holding the clone.
+	numKeys, err := service.CloneData(child, "mydata", child, "copy", CloneOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(numKeys, Equals, 2)
+	clone := dset.DataMap["copy"].(*testData)
+	c.Assert(clone.DataName(), Equals, dvid.DataString("copy"))
+	c.Assert(clone.LocalID(), Not(Equals), data.LocalID())
+	c.Assert(clone.IsVersioned(), Equals, true)
+	c.Assert(data.DataName(), Equals, dvid.DataString("mydata"))
+	value, err := service.kvGetter.Get(clone.DataKey(childID, dvid.IndexBytes("a")))
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []byte("root a"))
+	value, err = service.kvGetter.Get(clone.DataKey(childID, dvid.IndexBytes("b")))
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []byte("child b"))
+
+	// Clones into another dataset survive a restart.
+	other, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	numKeys, err = service.CloneData(root, "mydata", other, "mydata", CloneOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(numKeys, Equals, 2)
+	service.Shutdown()
+	reopened, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	defer reopened.Shutdown()
+	dataservice, err := reopened.DataServiceByUUID(other, "mydata")
+	c.Assert(err, IsNil)
+	otherDset, err := reopened.DatasetFromUUID(other)
+	c.Assert(err, IsNil)
+	value, err = reopened.kvGetter.Get(dataservice.(*testData).DataKey(otherDset.VersionMap[other], dvid.IndexBytes("b")))
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []byte("root b"))
+}
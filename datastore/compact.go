@@ -0,0 +1,145 @@
+/*
+	This file supports compaction of the storage engine, which reclaims the space of
+	deleted and overwritten values, e.g., after deleting data or garbage collection.
+	Either the whole store or the key ranges of selected data are compacted.
+*/
+
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// CompactedRange gives the approximate stored size of a compacted key range before and
+// after compaction.
+type CompactedRange struct {
+	// Dataset and Name are empty if the range is the whole store.
+	Dataset dvid.UUID       `json:",omitempty"`
+	Name    dvid.DataString `json:",omitempty"`
+
+	SizeBefore uint64
+	SizeAfter  uint64
+}
+
+// CompactReport is the result of a compaction.  If Sized is false, the storage engine
+// cannot estimate stored sizes and all sizes are zero.
+type CompactReport struct {
+	Ranges     []*CompactedRange
+	Sized      bool
+	SizeBefore uint64
+	SizeAfter  uint64
+	Duration   time.Duration
+}
+
+func (r *CompactReport) String() string {
+	if !r.Sized {
+		return fmt.Sprintf("Compacted %d key ranges in %s; storage engine cannot estimate sizes\n",
+			len(r.Ranges), r.Duration)
+	}
+	text := fmt.Sprintf("Compacted %d key ranges in %s: %d bytes before, %d bytes after\n",
+		len(r.Ranges), r.Duration, r.SizeBefore, r.SizeAfter)
+	for _, compacted := range r.Ranges {
+		if compacted.Name == "" {
+			continue
+		}
+		text += fmt.Sprintf("  %s '%s': %d bytes before, %d bytes after\n", compacted.Dataset,
+			compacted.Name, compacted.SizeBefore, compacted.SizeAfter)
+	}
+	return text
+}
+
+// Compact compacts the whole store if u is empty, or else the named data, or all data,
+// of the dataset with the node of the given UUID.  The compaction reports its progress
+// through the job and returns when all ranges are compacted.
+func (s *Service) Compact(u dvid.UUID, datanames []dvid.DataString, job *Job) (*CompactReport, error) {
+	compacter, ok := s.engine.(storage.Compacter)
+	if !ok {
+		return nil, fmt.Errorf("Storage engine %s does not support compaction", s.engine.GetName())
+	}
+	sizer, sized := s.engine.(storage.Sizer)
+
+	// Find the key ranges to compact.
+	type keyRange struct {
+		minKey, maxKey storage.Key
+	}
+	report := &CompactReport{Sized: sized}
+	var ranges []keyRange
+	if u == "" {
+		if len(datanames) != 0 {
+			return nil, fmt.Errorf("Data can only be selected for compaction along with a UUID")
+		}
+		ranges = []keyRange{{nil, nil}}
+		report.Ranges = []*CompactedRange{{}}
+	} else {
+		if s.Datasets == nil {
+			return nil, fmt.Errorf("Datastore service has no datasets available")
+		}
+		dataset, err := s.Datasets.DatasetFromUUID(u)
+		if err != nil {
+			return nil, err
+		}
+		if len(datanames) == 0 {
+			dataMap, err := dataset.cloneDataMap()
+			if err != nil {
+				return nil, err
+			}
+			names := make([]string, 0, len(dataMap))
+			for name := range dataMap {
+				names = append(names, string(name))
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				datanames = append(datanames, dvid.DataString(name))
+			}
+		}
+		for _, name := range datanames {
+			dataservice, err := dataset.DataService(name)
+			if err != nil {
+				return nil, err
+			}
+			data, ok := dataservice.(profiledData)
+			if !ok {
+				return nil, fmt.Errorf("Data '%s' cannot be compacted", name)
+			}
+			minKey, maxKey := data.dataKeyRange()
+			ranges = append(ranges, keyRange{minKey, maxKey})
+			report.Ranges = append(report.Ranges, &CompactedRange{Dataset: dataset.Root, Name: name})
+		}
+	}
+	job.SetTotal(int64(len(ranges)))
+
+	start := time.Now()
+	for i, r := range ranges {
+		compacted := report.Ranges[i]
+		var err error
+		if sized {
+			if compacted.SizeBefore, err = sizer.ApproximateSize(r.minKey, r.maxKey); err != nil {
+				return nil, err
+			}
+		}
+		if err = compacter.Compact(r.minKey, r.maxKey); err != nil {
+			return nil, err
+		}
+		if sized {
+			if compacted.SizeAfter, err = sizer.ApproximateSize(r.minKey, r.maxKey); err != nil {
+				return nil, err
+			}
+		}
+		report.SizeBefore += compacted.SizeBefore
+		report.SizeAfter += compacted.SizeAfter
+		job.Advance(1)
+		if compacted.Name == "" {
+			job.Logf("Compacted store: %d bytes before, %d bytes after", compacted.SizeBefore, compacted.SizeAfter)
+		} else {
+			job.Logf("Compacted '%s': %d bytes before, %d bytes after", compacted.Name,
+				compacted.SizeBefore, compacted.SizeAfter)
+		}
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
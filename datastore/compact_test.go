@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestCompact(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+	c.Assert(service.NewData(root, "testtype", "other", versioned), IsNil)
+	dset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	data := dset.DataMap["mydata"].(*testData)
+	value := make([]byte, 1000)
+	for i := 0; i < 100; i++ {
+		key := data.DataKey(0, dvid.IndexBytes(fmt.Sprintf("%03d", i)))
+		c.Assert(service.kvSetter.Put(key, value), IsNil)
+		c.Assert(service.kvSetter.Delete(key), IsNil)
+	}
+
+	_, err = service.Compact("", []dvid.DataString{"mydata"}, nil)
+	c.Assert(err, NotNil)
+	_, err = service.Compact(root, []dvid.DataString{"missing"}, nil)
+	c.Assert(err, NotNil)
+
+	report, err := service.Compact(root, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(report.Ranges, HasLen, 2)
+	c.Assert(report.Ranges[0].Name, Equals, dvid.DataString("mydata"))
+	c.Assert(report.Ranges[1].Name, Equals, dvid.DataString("other"))
+	c.Assert(report.Ranges[0].Dataset, Equals, root)
+	c.Assert(report.Ranges[0].SizeAfter <= report.Ranges[0].SizeBefore, Equals, true)
+
+	report, err = service.Compact("", nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(report.Ranges, HasLen, 1)
+	c.Assert(report.Ranges[0].Name, Equals, dvid.DataString(""))
+	values, err := service.kvGetter.GetRange(context.Background(), data.DataKey(0, dvid.IndexBytes("000")),
+		data.DataKey(0, dvid.IndexBytes("099")))
+	c.Assert(err, IsNil)
+	c.Assert(values, HasLen, 0)
+}
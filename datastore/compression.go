@@ -0,0 +1,84 @@
+/*
+	This file supports training of shared compression dictionaries for data instances.
+*/
+
+package datastore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// DefaultDictionarySamples is the number of stored values sampled to train a
+// compression dictionary if not otherwise specified.
+const DefaultDictionarySamples = 1000
+
+// DictionaryTrainer is a data service that can train a shared compression dictionary
+// from its stored values and use it for all subsequent serializations.
+type DictionaryTrainer interface {
+	TrainDictionary(db storage.KeyValueGetter, numSamples int) (*dvid.Dictionary, error)
+}
+
+// TrainDictionary samples up to numSamples stored values evenly spaced across all
+// versions of this data, trains a compression dictionary from them, and switches this
+// data to DEFLATE compression with that dictionary.  Previously stored values are
+// unaffected and remain readable since any earlier dictionary is kept in the data's
+// PriorDictionaries.  Dictionaries are kept in the data's metadata, so the dataset
+// should be saved after training.
+func (d *Data) TrainDictionary(db storage.KeyValueGetter, numSamples int) (*dvid.Dictionary, error) {
+	if numSamples <= 0 {
+		numSamples = DefaultDictionarySamples
+	}
+	minKey, maxKey := d.dataKeyRange()
+	keys, err := db.KeysInRange(context.Background(), minKey, maxKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Data '%s' has no stored values to train a dictionary", d.DataName())
+	}
+	step := len(keys) / numSamples
+	if step < 1 {
+		step = 1
+	}
+	samples := [][]byte{}
+	for i := 0; i < len(keys) && len(samples) < numSamples; i += step {
+		value, err := db.Get(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		data, _, err := dvid.DeserializeData(value, true)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read value for key %s: %s", keys[i], err.Error())
+		}
+		samples = append(samples, data)
+	}
+
+	dictData := dvid.TrainDictionary(samples, dvid.MaxDictionarySize)
+	if dictData == nil {
+		return nil, fmt.Errorf("No repeated content in %d samples of data '%s' to train a dictionary",
+			len(samples), d.DataName())
+	}
+	dict, err := dvid.NewDictionary(dictData)
+	if err != nil {
+		return nil, err
+	}
+	level := dvid.CompressionLevel(dvid.DefaultCompression)
+	current := d.UseCompression()
+	if current.Format() == dvid.Gzip || current.Format() == dvid.DeflateDict {
+		level = current.Level()
+	}
+	compression, err := dvid.NewDictCompression(dict, level)
+	if err != nil {
+		return nil, err
+	}
+	d.setCompression(compression)
+	dvid.Log(dvid.Normal, "Trained %s from %d samples for data '%s'\n", dict, len(samples), d.DataName())
+	return dict, nil
+}
@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"fmt"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// dictionarySamples returns serializable samples that share content that is poorly
+// compressible within any one sample.
+func dictionarySamples(seed uint32, num int) [][]byte {
+	common := make([]byte, 1024)
+	for j := range common {
+		seed = seed*1103515245 + 12345
+		common[j] = byte(seed >> 16)
+	}
+	samples := make([][]byte, num)
+	for i := range samples {
+		samples[i] = make([]byte, len(common))
+		copy(samples[i], common)
+		samples[i][1000] = byte(i)
+	}
+	return samples
+}
+
+func (s *DataSuite) TestRetrainDictionary(c *C) {
+	compiled := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype", "example.com/testtype", "0.1")}}
+	CompiledTypes[compiled.DatatypeUrl()] = compiled
+	defer delete(CompiledTypes, compiled.DatatypeUrl())
+
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "mydata", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	_, rootID, err := service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+
+	put := func(prefix string, samples [][]byte) {
+		for i, sample := range samples {
+			value, err := dvid.SerializeData(sample, data.UseCompression(), dvid.CRC32)
+			c.Assert(err, IsNil)
+			index := dvid.IndexBytes(fmt.Sprintf("%s%03d", prefix, i))
+			c.Assert(service.kvSetter.Put(data.DataKey(rootID, index), value), IsNil)
+		}
+	}
+	put("a", dictionarySamples(17, 20))
+	dict1, err := data.TrainDictionary(service.kvGetter, 0)
+	c.Assert(err, IsNil)
+
+	// Values compressed with the first dictionary must stay readable after retraining.
+	put("b", dictionarySamples(17, 20))
+	for i := 0; i < 3; i++ {
+		put(fmt.Sprintf("c%d", i), dictionarySamples(uint32(31+i), 20))
+	}
+	dict2, err := data.TrainDictionary(service.kvGetter, 0)
+	c.Assert(err, IsNil)
+	c.Assert(dict2.ID(), Not(Equals), dict1.ID())
+	c.Assert(data.PriorDictionaries, HasLen, 1)
+	c.Assert(data.PriorDictionaries[0].ID(), Equals, dict1.ID())
+	c.Assert(service.SaveDataset(root), IsNil)
+	service.Shutdown()
+
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	dataservice, err = service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data = dataservice.(*testData)
+	c.Assert(data.UseCompression().Dictionary().ID(), Equals, dict2.ID())
+	c.Assert(data.PriorDictionaries, HasLen, 1)
+	c.Assert(data.PriorDictionaries[0].ID(), Equals, dict1.ID())
+	value, err := service.kvGetter.Get(data.DataKey(rootID, dvid.IndexBytes("b000")))
+	c.Assert(err, IsNil)
+	sample, format, err := dvid.DeserializeData(value, true)
+	c.Assert(err, IsNil)
+	c.Assert(format, Equals, dvid.CompressionFormat(dvid.DeflateDict))
+	c.Assert(sample, DeepEquals, dictionarySamples(17, 20)[0])
+
+	// Switching away from dictionary compression keeps the current dictionary too.
+	lz4, _ := dvid.NewCompression(dvid.LZ4, dvid.DefaultCompression)
+	data.setCompression(lz4)
+	c.Assert(data.PriorDictionaries, HasLen, 2)
+	c.Assert(data.PriorDictionaries[1].ID(), Equals, dict2.ID())
+}
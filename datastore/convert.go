@@ -0,0 +1,417 @@
+/*
+	This file supports the conversion of data instances from a deprecated data type to its
+	successor.  A datatype package registers its successor along with a function that
+	converts stored key/value pairs, and conversions run as resumable jobs that preserve
+	all versions of the data, so datasets are not stranded as datatype code evolves.
+	The source data cannot be modified until its conversion is done, since writes behind
+	the conversion's progress would be missing from the converted data.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Number of converted key/value pairs per batch.  Conversion progress is saved after
+// each batch, so an interrupted conversion redoes at most one batch.
+var conversionBatchSize = 1000
+
+// ConvertFunc converts one stored key/value pair of data of a deprecated type into the
+// key/value pair of the data of its successor type.  The value is as stored, i.e.,
+// possibly compressed and checksummed by the source data.  A nil value drops the
+// key/value pair from the converted data.
+type ConvertFunc func(src, dst DataService, index, value []byte) (dstIndex, dstValue []byte, err error)
+
+// Successor describes how data of a deprecated type is converted to its successor type.
+type Successor struct {
+	From UrlString
+	To   UrlString
+
+	// Convert converts each key/value pair.  If nil, key/value pairs are copied as is.
+	Convert ConvertFunc
+}
+
+var (
+	successors     = make(map[UrlString]*Successor)
+	successorsLock sync.RWMutex
+)
+
+// RegisterSuccessor deprecates a data type in favor of another data type.  It is
+// usually called from the init() of the successor's package.
+func RegisterSuccessor(from, to UrlString, convert ConvertFunc) {
+	successorsLock.Lock()
+	successors[from] = &Successor{From: from, To: to, Convert: convert}
+	successorsLock.Unlock()
+}
+
+// SuccessorOf returns the successor of a deprecated data type or nil if the data type
+// is not deprecated.
+func SuccessorOf(url UrlString) *Successor {
+	successorsLock.RLock()
+	defer successorsLock.RUnlock()
+	return successors[url]
+}
+
+// DeprecatedData describes a stored data instance of a deprecated data type.
+type DeprecatedData struct {
+	Dataset   dvid.UUID
+	Name      dvid.DataString
+	TypeUrl   UrlString
+	Successor UrlString
+}
+
+func (d DeprecatedData) String() string {
+	return fmt.Sprintf("Data '%s' in dataset %s has deprecated type %s; convert it to %s",
+		d.Name, d.Dataset, d.TypeUrl, d.Successor)
+}
+
+// DeprecatedData returns all data instances whose data type has a registered successor,
+// sorted by dataset and data name.
+func (dsets *Datasets) DeprecatedData() []DeprecatedData {
+	deprecated := []DeprecatedData{}
+	for _, dset := range dsets.list {
+		dset.mapLock.Lock()
+		names := make([]string, 0, len(dset.DataMap))
+		for name, _ := range dset.DataMap {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			data := dset.DataMap[dvid.DataString(name)]
+			if successor := SuccessorOf(data.DatatypeUrl()); successor != nil {
+				deprecated = append(deprecated, DeprecatedData{
+					Dataset:   dset.Root,
+					Name:      dvid.DataString(name),
+					TypeUrl:   data.DatatypeUrl(),
+					Successor: successor.To,
+				})
+			}
+		}
+		dset.mapLock.Unlock()
+	}
+	return deprecated
+}
+
+// Conversion is the persisted state of the conversion of data to a successor data type.
+type Conversion struct {
+	Source dvid.DataString
+	Dest   dvid.DataString
+	From   UrlString
+	To     UrlString
+
+	Started time.Time
+	Updated time.Time
+
+	// Keys is the number of source key/value pairs converted so far.
+	Keys int64
+
+	// LastVersion and LastIndex give the last converted source key/value pair.
+	LastVersion dvid.VersionLocalID `json:"-"`
+	LastIndex   []byte              `json:"-"`
+
+	Done  bool
+	Error string `json:",omitempty"`
+
+	running bool
+}
+
+// conversion returns the conversion into the named data.
+func (dset *Dataset) conversion(dest dvid.DataString) *Conversion {
+	for _, conv := range dset.Conversions {
+		if conv.Dest == dest {
+			return conv
+		}
+	}
+	return nil
+}
+
+// NewConversion adds new data of the successor type of the named source data and
+// registers a conversion of the source data into it.  The conversion is started with
+// RunConversion.
+func (s *Service) NewConversion(u dvid.UUID, source, dest dvid.DataString, config dvid.Config) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	srcService, err := dataset.DataService(source)
+	if err != nil {
+		return err
+	}
+	successor := SuccessorOf(srcService.DatatypeUrl())
+	if successor == nil {
+		return fmt.Errorf("Data '%s' has type %s, which is not deprecated", source, srcService.DatatypeUrl())
+	}
+	typeService, found := CompiledTypes[successor.To]
+	if !found {
+		return fmt.Errorf("Successor type %s of data '%s' is not compiled into this DVID server",
+			successor.To, source)
+	}
+	// The converted data keeps the versioning of the source data.
+	config.SetVersioned(srcService.IsVersioned())
+	if err = dataset.newData(dest, typeService.DatatypeName(), config); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	dataset.mapLock.Lock()
+	for _, node := range dataset.Nodes {
+		if avail, found := node.Avail[source]; found {
+			node.Avail[dest] = avail
+		}
+	}
+	dataset.Conversions = append(dataset.Conversions, &Conversion{
+		Source:  source,
+		Dest:    dest,
+		From:    successor.From,
+		To:      successor.To,
+		Started: now,
+		Updated: now,
+	})
+	dataset.mapLock.Unlock()
+	s.InvalidateMetadata()
+	return dataset.Put(s.kvSetter)
+}
+
+// RunConversion converts all key/value pairs of the source data into the named data,
+// resuming from the last saved progress of an earlier run.  Version identifiers are
+// kept so the converted data has the same versions as the source data.  The conversion
+// runs as a job with the given limits.
+func (s *Service) RunConversion(u dvid.UUID, dest dvid.DataString, limits JobLimits) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	dataset.mapLock.Lock()
+	conv := dataset.conversion(dest)
+	if conv == nil {
+		dataset.mapLock.Unlock()
+		return fmt.Errorf("No conversion into data '%s' in dataset %s", dest, dataset.Root)
+	}
+	if conv.running {
+		dataset.mapLock.Unlock()
+		return fmt.Errorf("Conversion into data '%s' is already running", dest)
+	}
+	if conv.Done {
+		dataset.mapLock.Unlock()
+		return nil
+	}
+	conv.running = true
+	conv.Error = ""
+	dataset.mapLock.Unlock()
+
+	job := StartJob("conversion", fmt.Sprintf("convert '%s' into '%s'", conv.Source, dest), limits)
+	err = s.runConversion(dataset, conv, job)
+	job.Finish()
+
+	dataset.mapLock.Lock()
+	conv.running = false
+	conv.Updated = time.Now()
+	if err != nil {
+		conv.Error = err.Error()
+	} else {
+		conv.Done = true
+	}
+	dataset.mapLock.Unlock()
+	if putErr := dataset.Put(s.kvSetter); putErr != nil && err == nil {
+		err = putErr
+	}
+	return err
+}
+
+func (s *Service) runConversion(dataset *Dataset, conv *Conversion, job *Job) error {
+	successor := SuccessorOf(conv.From)
+	if successor == nil || successor.To != conv.To {
+		return fmt.Errorf("No registered conversion from %s to %s", conv.From, conv.To)
+	}
+	srcService, err := dataset.DataService(conv.Source)
+	if err != nil {
+		return err
+	}
+	dstService, err := dataset.DataService(conv.Dest)
+	if err != nil {
+		return err
+	}
+	src, ok := srcService.(profiledData)
+	if !ok {
+		return fmt.Errorf("Data '%s' cannot be converted", conv.Source)
+	}
+	dst, ok := dstService.(forkableData)
+	if !ok {
+		return fmt.Errorf("Data '%s' cannot hold converted data", conv.Dest)
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return err
+	}
+
+	minKey, maxKey := src.dataKeyRange()
+	dataset.mapLock.Lock()
+	resumed := conv.Keys > 0
+	if resumed {
+		minKey.Version = conv.LastVersion
+		minKey.Index = dvid.IndexBytes(conv.LastIndex)
+	}
+	dataset.mapLock.Unlock()
+
+	batch := batcher.NewBatch()
+	var numBatched int
+	var lastKey *DataKey
+	var convErr error
+	err = s.kvGetter.ProcessRange(job.Context(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		if convErr != nil {
+			return
+		}
+		job.Throttle(len(chunk.V))
+		dataKey, ok := chunk.K.(*DataKey)
+		if !ok || dataKey.Dataset != dataset.DatasetID || dataKey.Data != minKey.Data {
+			return
+		}
+		var index []byte
+		if dataKey.Index != nil {
+			index = dataKey.Index.Bytes()
+		}
+		if resumed && dataKey.Version == minKey.Version && bytes.Equal(index, conv.LastIndex) {
+			return
+		}
+		dstIndex, dstValue := index, chunk.V
+		if successor.Convert != nil {
+			dstIndex, dstValue, convErr = successor.Convert(srcService, dstService, index, chunk.V)
+			if convErr != nil {
+				convErr = fmt.Errorf("Unable to convert key %s of data '%s': %s", dataKey, conv.Source, convErr.Error())
+				return
+			}
+		}
+		if dstValue != nil {
+			batch.Put(&DataKey{dataset.DatasetID, dst.LocalID(), dataKey.Version, dvid.IndexBytes(dstIndex)}, dstValue)
+		}
+		lastKey = &DataKey{dataKey.Dataset, dataKey.Data, dataKey.Version, dvid.IndexBytes(index)}
+		numBatched++
+		if numBatched >= conversionBatchSize {
+			convErr = s.commitConversion(dataset, conv, batch, numBatched, lastKey)
+			batch = batcher.NewBatch()
+			numBatched = 0
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if convErr != nil {
+		return convErr
+	}
+	return s.commitConversion(dataset, conv, batch, numBatched, lastKey)
+}
+
+// commitConversion commits a batch of converted key/value pairs and saves the progress
+// of the conversion.
+func (s *Service) commitConversion(dataset *Dataset, conv *Conversion, batch storage.Batch,
+	numBatched int, lastKey *DataKey) error {
+
+	if numBatched == 0 {
+		return nil
+	}
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+	dataset.mapLock.Lock()
+	conv.Keys += int64(numBatched)
+	conv.LastVersion = lastKey.Version
+	conv.LastIndex = lastKey.Index.Bytes()
+	conv.Updated = time.Now()
+	dataset.mapLock.Unlock()
+	return dataset.Put(s.kvSetter)
+}
+
+// ConversionsJSON returns JSON listing the conversions of data in the dataset specified
+// by a UUID.
+func (s *Service) ConversionsJSON(u dvid.UUID) (string, error) {
+	if s.Datasets == nil {
+		return "[]", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return "[]", err
+	}
+	dataset.mapLock.Lock()
+	defer dataset.mapLock.Unlock()
+	if dataset.Conversions == nil {
+		return "[]", nil
+	}
+	m, err := json.Marshal(dataset.Conversions)
+	if err != nil {
+		return "[]", err
+	}
+	return string(m), nil
+}
+
+// CheckConverting returns an error if the named data in the dataset with the node of
+// the given UUID is the source of an unfinished conversion.  Conversions whose converted
+// data was deleted no longer hold back writes.
+func (s *Service) CheckConverting(u dvid.UUID, dataname dvid.DataString) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	dataset.mapLock.Lock()
+	defer dataset.mapLock.Unlock()
+	for _, conv := range dataset.Conversions {
+		if conv.Source != dataname || conv.Done {
+			continue
+		}
+		if _, found := dataset.DataMap[conv.Dest]; found {
+			return fmt.Errorf("Data '%s' cannot be modified until its conversion into '%s' is done",
+				dataname, conv.Dest)
+		}
+	}
+	return nil
+}
+
+// ResumeConversions runs all unfinished conversions in all datasets, e.g., after a
+// server restart, returning the number of conversions completed.  A failed conversion
+// is logged and the others are still run; the first error is returned.
+func (s *Service) ResumeConversions() (int, error) {
+	if s.Datasets == nil {
+		return 0, fmt.Errorf("Datastore service has no datasets available")
+	}
+	var completed int
+	var firstErr error
+	for _, dataset := range s.Datasets.list {
+		var dests []dvid.DataString
+		dataset.mapLock.Lock()
+		for _, conv := range dataset.Conversions {
+			if !conv.Done && !conv.running {
+				dests = append(dests, conv.Dest)
+			}
+		}
+		dataset.mapLock.Unlock()
+		for _, dest := range dests {
+			if err := s.RunConversion(dataset.Root, dest, JobLimits{}); err != nil {
+				dvid.Error("Error converting into data '%s' in dataset %s: %s", dest, dataset.Root, err.Error())
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			dvid.Log(dvid.Normal, "Completed conversion into data '%s' in dataset %s\n", dest, dataset.Root)
+			completed++
+		}
+	}
+	return completed, firstErr
+}
@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestConvertDeprecated(c *C) {
+	deprecated := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype", "example.com/testtype", "0.1")}}
+	CompiledTypes[deprecated.DatatypeUrl()] = deprecated
+	defer delete(CompiledTypes, deprecated.DatatypeUrl())
+	successor := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype2", "example.com/testtype2", "0.1")}}
+	CompiledTypes[successor.DatatypeUrl()] = successor
+	defer delete(CompiledTypes, successor.DatatypeUrl())
+
+	oldBatchSize := conversionBatchSize
+	conversionBatchSize = 2
+	defer func() { conversionBatchSize = oldBatchSize }()
+
+	// Convert values to upper case, dropping "skip", and fail once on "c".  Conversions
+	// into "broken" always fail.
+	converted := make(map[string]int)
+	failOn := "c"
+	RegisterSuccessor(deprecated.DatatypeUrl(), successor.DatatypeUrl(),
+		func(src, dst DataService, index, value []byte) ([]byte, []byte, error) {
+			if dst.DataName() == "broken" {
+				return nil, nil, fmt.Errorf("broken conversion")
+			}
+			if string(value) == failOn {
+				failOn = ""
+				return nil, nil, fmt.Errorf("injected failure")
+			}
+			converted[string(value)]++
+			if string(value) == "skip" {
+				return index, nil, nil
+			}
+			return index, bytes.ToUpper(value), nil
+		})
+	defer func() {
+		successorsLock.Lock()
+		delete(successors, deprecated.DatatypeUrl())
+		successorsLock.Unlock()
+	}()
+
+	dir := c.MkDir()
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+	defer service.Shutdown()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "old", dvid.NewConfig()), IsNil)
+	c.Assert(service.DeprecatedData(), HasLen, 1)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	_, rootID, err := service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+	_, childID, err := service.LocalIDFromUUID(child)
+	c.Assert(err, IsNil)
+
+	dataservice, err := service.DataServiceByUUID(root, "old")
+	c.Assert(err, IsNil)
+	old := dataservice.(*testData)
+	for _, kv := range []struct {
+		version dvid.VersionLocalID
+		index   string
+		value   string
+	}{
+		{rootID, "a", "a"}, {rootID, "b", "b"}, {rootID, "c", "c"}, {rootID, "d", "skip"},
+		{childID, "a", "child a"}, {childID, "e", "e"},
+	} {
+		c.Assert(service.kvSetter.Put(old.DataKey(kv.version, dvid.IndexBytes(kv.index)), []byte(kv.value)), IsNil)
+	}
+
+	c.Assert(service.NewConversion(root, "old", "old", dvid.NewConfig()), NotNil) // name already exists
+	c.Assert(service.CheckConverting(root, "old"), IsNil)
+	c.Assert(service.NewConversion(root, "old", "broken", dvid.NewConfig()), IsNil)
+	c.Assert(service.NewConversion(root, "old", "old2", dvid.NewConfig()), IsNil)
+	c.Assert(service.NewConversion(root, "old2", "old3", dvid.NewConfig()), NotNil) // not deprecated
+
+	// The source can't be modified while it is converted.
+	c.Assert(service.CheckConverting(root, "old"), ErrorMatches, ".*cannot be modified until.*")
+	c.Assert(service.CheckConverting(root, "old2"), IsNil)
+
+	// The first run fails after converting one batch.
+	err = service.RunConversion(root, "old2", JobLimits{})
+	c.Assert(err, NotNil)
+	jsonStr, err := service.ConversionsJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Matches, `.*"Keys":2,.*"Done":false,"Error":".*injected failure.*`)
+
+	// Conversions persist and resume where they stopped.  A failed conversion does not
+	// hold back the others.
+	service.Shutdown()
+	service, err = Open(dir)
+	c.Assert(err, IsNil)
+	completed, err := service.ResumeConversions()
+	c.Assert(err, ErrorMatches, ".*broken conversion.*")
+	c.Assert(completed, Equals, 1)
+	for _, value := range []string{"a", "b", "c", "skip", "child a", "e"} {
+		c.Assert(converted[value], Equals, 1)
+	}
+	jsonStr, err = service.ConversionsJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Matches, `.*"Keys":6,.*"Done":true.*`)
+
+	dataservice, err = service.DataServiceByUUID(root, "old2")
+	c.Assert(err, IsNil)
+	c.Assert(dataservice.DatatypeName(), Equals, dvid.TypeString("testtype2"))
+	c.Assert(service.DeprecatedData(), HasLen, 1) // source is kept until deleted
+	dst := dataservice.(*testData)
+	for _, kv := range []struct {
+		version dvid.VersionLocalID
+		index   string
+		value   string
+	}{
+		{rootID, "a", "A"}, {rootID, "c", "C"}, {childID, "a", "CHILD A"}, {childID, "e", "E"},
+	} {
+		value, err := service.kvGetter.Get(dst.DataKey(kv.version, dvid.IndexBytes(kv.index)))
+		c.Assert(err, IsNil)
+		c.Assert(string(value), Equals, kv.value)
+	}
+	value, err := service.kvGetter.Get(dst.DataKey(rootID, dvid.IndexBytes("d")))
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+	c.Assert(service.RunConversion(root, "old2", JobLimits{}), IsNil) // already done
+
+	// Deleting the converted data of an unfinished conversion abandons it.
+	c.Assert(service.CheckConverting(root, "old"), NotNil)
+	c.Assert(service.DeleteData(root, "broken"), IsNil)
+	c.Assert(service.CheckConverting(root, "old"), IsNil)
+}
@@ -0,0 +1,291 @@
+/*
+	This file supports introspection of a dataset's version DAG as JSON or Graphviz DOT,
+	e.g., for rendering the history of a dataset, and traversal of the DAG, e.g., for
+	datatypes that walk ancestors to read or merge versioned data.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// DAGNode describes a version node with its edges, lock state, and commit metadata.
+type DAGNode struct {
+	UUID      dvid.UUID
+	VersionID dvid.VersionLocalID
+	Parents   []dvid.UUID
+	Children  []dvid.UUID
+	Locked    bool
+	Abandoned bool
+	Author    string
+	Message   string
+	Note      string
+	Created   time.Time
+	Updated   time.Time
+	Committed time.Time
+}
+
+// DAGDescription describes the version DAG of a dataset.  Nodes are in the order
+// they were created.
+type DAGDescription struct {
+	Root       dvid.UUID
+	Alias      string
+	ForkedFrom dvid.UUID
+	Nodes      []DAGNode
+}
+
+type dagNodesByVersion []DAGNode
+
+func (n dagNodesByVersion) Len() int           { return len(n) }
+func (n dagNodesByVersion) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n dagNodesByVersion) Less(i, j int) bool { return n[i].VersionID < n[j].VersionID }
+
+// Describe returns a description of the dataset's version DAG.
+func (dset *Dataset) Describe() *DAGDescription {
+	desc := &DAGDescription{Root: dset.Root, Alias: dset.Alias, ForkedFrom: dset.ForkedFrom}
+	dset.mapLock.Lock()
+	for u, node := range dset.Nodes {
+		node.writeLock.Lock()
+		dagNode := DAGNode{
+			UUID:      u,
+			VersionID: node.VersionID,
+			Parents:   append([]dvid.UUID{}, node.Parents...),
+			Children:  append([]dvid.UUID{}, node.Children...),
+			Locked:    node.Locked,
+			Abandoned: node.Abandoned,
+			Author:    node.Author,
+			Message:   node.Message,
+			Created:   node.Created,
+			Updated:   node.Updated,
+			Committed: node.Committed,
+		}
+		if node.NodeText != nil {
+			dagNode.Note = node.Note
+		}
+		node.writeLock.Unlock()
+		desc.Nodes = append(desc.Nodes, dagNode)
+	}
+	dset.mapLock.Unlock()
+	sort.Sort(dagNodesByVersion(desc.Nodes))
+	return desc
+}
+
+// DOT returns the version DAG in the Graphviz DOT language.  Locked nodes are filled,
+// abandoned nodes are dashed, and node labels give the shortened UUID and commit
+// metadata.
+func (desc *DAGDescription) DOT() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "digraph %q {\n", "dataset "+string(desc.Root))
+	fmt.Fprintf(&buf, "\tnode [shape=box];\n")
+	for _, node := range desc.Nodes {
+		label := string(node.UUID)
+		if len(label) > 8 {
+			label = label[:8]
+		}
+		if node.Author != "" {
+			label += "\n" + node.Author
+		}
+		if node.Message != "" {
+			label += "\n" + node.Message
+		}
+		var styles []string
+		if node.Locked {
+			styles = append(styles, "filled")
+		}
+		if node.Abandoned {
+			styles = append(styles, "dashed")
+		}
+		fmt.Fprintf(&buf, "\t%q [label=%q", node.UUID, label)
+		if len(styles) != 0 {
+			fmt.Fprintf(&buf, ", style=%q", strings.Join(styles, ","))
+		}
+		fmt.Fprintf(&buf, "];\n")
+	}
+	for _, node := range desc.Nodes {
+		for _, parent := range node.Parents {
+			fmt.Fprintf(&buf, "\t%q -> %q;\n", parent, node.UUID)
+		}
+	}
+	fmt.Fprintf(&buf, "}\n")
+	return buf.String()
+}
+
+// DAGJSON returns JSON describing the version DAG of the dataset with the given UUID.
+func (s *Service) DAGJSON(u dvid.UUID) (string, error) {
+	if s.Datasets == nil {
+		return "{}", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return "{}", err
+	}
+	return s.cache.get("dag/"+string(dataset.Root), func() (string, error) {
+		m, err := json.Marshal(dataset.Describe())
+		if err != nil {
+			return "{}", err
+		}
+		return string(m), nil
+	})
+}
+
+// DAGDot returns the version DAG of the dataset with the given UUID in the Graphviz
+// DOT language.
+func (s *Service) DAGDot(u dvid.UUID) (string, error) {
+	if s.Datasets == nil {
+		return "", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return "", err
+	}
+	return s.cache.get("dag-dot/"+string(dataset.Root), func() (string, error) {
+		return dataset.Describe().DOT(), nil
+	})
+}
+
+// node returns the node with the given UUID.
+func (dag *VersionDAG) node(u dvid.UUID) (*Node, error) {
+	dag.mapLock.Lock()
+	node, found := dag.Nodes[u]
+	dag.mapLock.Unlock()
+	if !found {
+		return nil, fmt.Errorf("No node found with UUID %s", u)
+	}
+	return node, nil
+}
+
+// Parents returns the UUIDs of the parents of a node.  Merge nodes have more than one
+// parent and the root has none.
+func (dag *VersionDAG) Parents(u dvid.UUID) ([]dvid.UUID, error) {
+	node, err := dag.node(u)
+	if err != nil {
+		return nil, err
+	}
+	return append([]dvid.UUID{}, node.Parents...), nil
+}
+
+// Children returns the UUIDs of the children of a node in the order they were created.
+func (dag *VersionDAG) Children(u dvid.UUID) ([]dvid.UUID, error) {
+	node, err := dag.node(u)
+	if err != nil {
+		return nil, err
+	}
+	node.writeLock.Lock()
+	defer node.writeLock.Unlock()
+	return append([]dvid.UUID{}, node.Children...), nil
+}
+
+// WalkAncestors calls f for a node and then each of its ancestors once, in breadth-first
+// order of parents so nearer ancestors come first.  The walk stops if f returns false.
+func (dag *VersionDAG) WalkAncestors(u dvid.UUID, f func(dvid.UUID) bool) error {
+	visited := make(map[dvid.UUID]bool)
+	queue := []dvid.UUID{u}
+	for len(queue) != 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if visited[cur] {
+			continue
+		}
+		visited[cur] = true
+		node, err := dag.node(cur)
+		if err != nil {
+			return err
+		}
+		if !f(cur) {
+			return nil
+		}
+		queue = append(queue, node.Parents...)
+	}
+	return nil
+}
+
+// Ancestors returns the UUIDs of all ancestors of a node, nearest first, as visited
+// by WalkAncestors.
+func (dag *VersionDAG) Ancestors(u dvid.UUID) ([]dvid.UUID, error) {
+	ancestors := []dvid.UUID{}
+	err := dag.WalkAncestors(u, func(cur dvid.UUID) bool {
+		if cur != u {
+			ancestors = append(ancestors, cur)
+		}
+		return true
+	})
+	return ancestors, err
+}
+
+// IsAncestor returns true if node a is an ancestor of node b.  A node is not its own
+// ancestor.
+func (dag *VersionDAG) IsAncestor(a, b dvid.UUID) (bool, error) {
+	if _, err := dag.node(a); err != nil {
+		return false, err
+	}
+	var found bool
+	err := dag.WalkAncestors(b, func(cur dvid.UUID) bool {
+		found = cur == a && cur != b
+		return !found
+	})
+	return found, err
+}
+
+// LowestCommonAncestors returns the common ancestors of nodes a and b that are not
+// ancestors of other common ancestors, in order of creation.  A node counts as its
+// own ancestor here, so if a is an ancestor of b, a is returned.  Because of merges,
+// there can be more than one lowest common ancestor.
+func (dag *VersionDAG) LowestCommonAncestors(a, b dvid.UUID) ([]dvid.UUID, error) {
+	ofA := make(map[dvid.UUID]bool)
+	if err := dag.WalkAncestors(a, func(cur dvid.UUID) bool {
+		ofA[cur] = true
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	var common []dvid.UUID
+	if err := dag.WalkAncestors(b, func(cur dvid.UUID) bool {
+		if ofA[cur] {
+			common = append(common, cur)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	// Drop common ancestors that are ancestors of other common ancestors.
+	dominated := make(map[dvid.UUID]bool)
+	for _, u := range common {
+		ancestors, err := dag.Ancestors(u)
+		if err != nil {
+			return nil, err
+		}
+		for _, ancestor := range ancestors {
+			dominated[ancestor] = true
+		}
+	}
+	lowest := []dvid.UUID{}
+	for _, u := range common {
+		if !dominated[u] {
+			lowest = append(lowest, u)
+		}
+	}
+	dag.mapLock.Lock()
+	sort.Sort(uuidsByVersion{lowest, dag.VersionMap})
+	dag.mapLock.Unlock()
+	return lowest, nil
+}
+
+type uuidsByVersion struct {
+	uuids    []dvid.UUID
+	versions map[dvid.UUID]dvid.VersionLocalID
+}
+
+func (u uuidsByVersion) Len() int      { return len(u.uuids) }
+func (u uuidsByVersion) Swap(i, j int) { u.uuids[i], u.uuids[j] = u.uuids[j], u.uuids[i] }
+func (u uuidsByVersion) Less(i, j int) bool {
+	return u.versions[u.uuids[i]] < u.versions[u.uuids[j]]
+}
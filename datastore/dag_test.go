@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestDAGTraversal(c *C) {
+	root, _, err := s.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(s.service.Lock(root), IsNil)
+	a, err := s.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	b, err := s.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(s.service.Lock(a), IsNil)
+	c.Assert(s.service.Lock(b), IsNil)
+
+	// Criss-cross merges have two lowest common ancestors.
+	ab, err := s.service.MergeVersions([]dvid.UUID{a, b})
+	c.Assert(err, IsNil)
+	ba, err := s.service.MergeVersions([]dvid.UUID{b, a})
+	c.Assert(err, IsNil)
+	dset, err := s.service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+
+	parents, err := dset.Parents(ab)
+	c.Assert(err, IsNil)
+	c.Assert(parents, DeepEquals, []dvid.UUID{a, b})
+	children, err := dset.Children(root)
+	c.Assert(err, IsNil)
+	c.Assert(children, DeepEquals, []dvid.UUID{a, b})
+	ancestors, err := dset.Ancestors(ba)
+	c.Assert(err, IsNil)
+	c.Assert(ancestors, DeepEquals, []dvid.UUID{b, a, root})
+	ancestors, err = dset.Ancestors(root)
+	c.Assert(err, IsNil)
+	c.Assert(ancestors, HasLen, 0)
+
+	isAncestor, err := dset.IsAncestor(root, ab)
+	c.Assert(err, IsNil)
+	c.Assert(isAncestor, Equals, true)
+	isAncestor, err = dset.IsAncestor(ab, ab)
+	c.Assert(err, IsNil)
+	c.Assert(isAncestor, Equals, false)
+
+	var walked []dvid.UUID
+	err = dset.WalkAncestors(ab, func(u dvid.UUID) bool {
+		walked = append(walked, u)
+		return u != a
+	})
+	c.Assert(err, IsNil)
+	c.Assert(walked, DeepEquals, []dvid.UUID{ab, a})
+
+	lca, err := dset.LowestCommonAncestors(ab, ba)
+	c.Assert(err, IsNil)
+	c.Assert(lca, DeepEquals, []dvid.UUID{a, b})
+	lca, err = dset.LowestCommonAncestors(a, b)
+	c.Assert(err, IsNil)
+	c.Assert(lca, DeepEquals, []dvid.UUID{root})
+	lca, err = dset.LowestCommonAncestors(a, ab)
+	c.Assert(err, IsNil)
+	c.Assert(lca, DeepEquals, []dvid.UUID{a})
+	_, err = dset.LowestCommonAncestors(a, "unknown")
+	c.Assert(err, NotNil)
+}
+
+func (s *DataSuite) TestDAGDescription(c *C) {
+	dir := c.MkDir()
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+	defer service.Shutdown()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.Commit(root, CommitInfo{Author: "alice", Message: "import"}), IsNil)
+	child1, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	child2, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(service.AbandonVersion(child2), IsNil)
+
+	jsonStr, err := service.DAGJSON(child1)
+	c.Assert(err, IsNil)
+	var desc DAGDescription
+	c.Assert(json.Unmarshal([]byte(jsonStr), &desc), IsNil)
+	c.Assert(desc.Root, Equals, root)
+	c.Assert(desc.Nodes, HasLen, 3)
+	c.Assert(desc.Nodes[0].UUID, Equals, root)
+	c.Assert(desc.Nodes[0].Locked, Equals, true)
+	c.Assert(desc.Nodes[0].Author, Equals, "alice")
+	c.Assert(desc.Nodes[0].Children, DeepEquals, []dvid.UUID{child1, child2})
+	c.Assert(desc.Nodes[1].UUID, Equals, child1)
+	c.Assert(desc.Nodes[1].Parents, DeepEquals, []dvid.UUID{root})
+	c.Assert(desc.Nodes[2].Abandoned, Equals, true)
+
+	dot, err := service.DAGDot(root)
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(dot, "digraph "), Equals, true)
+	c.Assert(strings.Contains(dot, fmt.Sprintf("%q -> %q;", root, child1)), Equals, true)
+	c.Assert(strings.Contains(dot, fmt.Sprintf("%q -> %q;", root, child2)), Equals, true)
+	c.Assert(strings.Contains(dot, `style="dashed"`), Equals, true)
+}
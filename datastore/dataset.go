@@ -6,8 +6,11 @@
 package datastore
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -32,6 +35,11 @@ type Datasets struct {
 
 	// Counter that provides the local ID of the next new dataset.
 	newDatasetID dvid.DatasetLocalID
+
+	// Encoding of data keys and encodings whose keys have yet to be deleted after a
+	// key migration.
+	keyEncoding       KeyEncoding
+	staleKeyEncodings []KeyEncoding
 }
 
 // DataServiceByUUID returns a service for data of a given name under a Dataset referenced by UUID.
@@ -41,7 +49,11 @@ func (dsets *Datasets) DataServiceByUUID(u dvid.UUID, name dvid.DataString) (Dat
 	if !found {
 		return nil, fmt.Errorf("No node with UUID %s found", u)
 	}
-	dataservice, err := dataset.DataService(name)
+	dataservice, found, err := dataset.scratchService(u, name)
+	if found {
+		return dataservice, err
+	}
+	dataservice, err = dataset.DataService(name)
 	if err != nil {
 		return nil, fmt.Errorf("No data named '%s' at node with UUID %s: %s", name, u, err.Error())
 	}
@@ -83,23 +95,53 @@ func (dsets *Datasets) DatasetFromLocalID(id dvid.DatasetLocalID) (*Dataset, err
 	return dataset, nil
 }
 
+// MinUUIDPrefix is the minimum length of a partial UUID string, which prevents
+// accidental matches of very short strings.
+const MinUUIDPrefix = 3
+
+// AmbiguousUUIDError is returned when a partial UUID string matches more than one node.
+type AmbiguousUUIDError struct {
+	Prefix     string
+	Candidates []dvid.UUID
+}
+
+func (e *AmbiguousUUIDError) Error() string {
+	candidates := make([]string, len(e.Candidates))
+	for i, u := range e.Candidates {
+		candidates[i] = string(u)
+	}
+	return fmt.Sprintf("More than one UUID matches %s: %s", e.Prefix, strings.Join(candidates, ", "))
+}
+
 // DatasetFromString returns a dataset from a UUID string.
 // Partial matches are accepted as long as they are unique for a datastore.  So if
 // a datastore has nodes with UUID strings 3FA22..., 7CD11..., and 836EE...,
 // we can still find a match even if given the minimum 3 letters.  (We don't
-// allow UUID strings of less than 3 letters just to prevent mistakes.)
+// allow UUID strings of less than 3 letters just to prevent mistakes.)  Surrounding
+// whitespace and case are ignored, and a partial match that is not unique returns an
+// *AmbiguousUUIDError listing the matching UUIDs.
 func (dsets *Datasets) DatasetFromString(str string) (dataset *Dataset, u dvid.UUID, err error) {
-	numMatches := 0
+	prefix := strings.ToLower(strings.TrimSpace(str))
+	if dset, found := dsets.mapUUID[dvid.UUID(prefix)]; found {
+		return dset, dvid.UUID(prefix), nil
+	}
+	if len(prefix) < MinUUIDPrefix {
+		err = fmt.Errorf("UUID string %q must have at least %d characters", str, MinUUIDPrefix)
+		return
+	}
+	var candidates []dvid.UUID
 	for dsetUUID, dset := range dsets.mapUUID {
-		if strings.HasPrefix(string(dsetUUID), str) {
-			numMatches++
+		if strings.HasPrefix(strings.ToLower(string(dsetUUID)), prefix) {
+			candidates = append(candidates, dsetUUID)
 			dataset = dset
 			u = dsetUUID
 		}
 	}
-	if numMatches > 1 {
-		err = fmt.Errorf("More than one UUID matches %s!", str)
-	} else if numMatches == 0 {
+	if len(candidates) > 1 {
+		sort.Sort(uuidsByString(candidates))
+		err = &AmbiguousUUIDError{Prefix: prefix, Candidates: candidates}
+		dataset, u = nil, ""
+	} else if len(candidates) == 0 {
 		err = fmt.Errorf("Could not find UUID with partial match to %s!", str)
 	}
 	return
@@ -118,24 +160,118 @@ func (dsets *Datasets) Datatypes() map[UrlString]TypeService {
 	return typemap
 }
 
-// VerifyCompiledTypes will return an error if any required data type in the datastore
-// configuration was not compiled into DVID executable.  Check is done by more exact
-// URL and not the data type name.
-func (dsets *Datasets) VerifyCompiledTypes() error {
-	var errMsg string
+// TypeProblem describes a stored data instance that this DVID executable cannot fully support.
+type TypeProblem struct {
+	Dataset         dvid.UUID
+	Name            dvid.DataString
+	TypeName        dvid.TypeString
+	TypeUrl         UrlString
+	StoredVersion   string
+	CompiledVersion string // empty if the data type was not compiled into DVID
+}
+
+func (p TypeProblem) String() string {
+	if p.CompiledVersion == "" {
+		return fmt.Sprintf("Data '%s' in dataset %s has data type %s [%s] version %s, "+
+			"which was not compiled into this DVID.",
+			p.Name, p.Dataset, p.TypeName, p.TypeUrl, p.StoredVersion)
+	}
+	return fmt.Sprintf("Data '%s' in dataset %s has data type %s [%s] version %s, "+
+		"which is incompatible with compiled version %s.",
+		p.Name, p.Dataset, p.TypeName, p.TypeUrl, p.StoredVersion, p.CompiledVersion)
+}
+
+// CompatibleVersions returns true if code of the compiled data type version can read data
+// stored by the given version.  Versions are dot-separated numbers and are compatible if
+// they have the same major number and the stored version is not newer.
+func CompatibleVersions(stored, compiled string) bool {
+	if stored == compiled {
+		return true
+	}
+	storedNums, err := parseVersion(stored)
+	if err != nil {
+		return false
+	}
+	compiledNums, err := parseVersion(compiled)
+	if err != nil {
+		return false
+	}
+	if storedNums[0] != compiledNums[0] {
+		return false
+	}
+	for i := 1; i < len(storedNums); i++ {
+		if i >= len(compiledNums) {
+			return storedNums[i] == 0
+		}
+		if storedNums[i] != compiledNums[i] {
+			return storedNums[i] < compiledNums[i]
+		}
+	}
+	return true
+}
+
+func parseVersion(version string) ([]int, error) {
+	parts := strings.Split(version, ".")
+	nums := make([]int, len(parts))
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("Illegal version '%s'", version)
+		}
+		nums[i] = num
+	}
+	return nums, nil
+}
+
+// CheckCompiledTypes returns the stored data instances whose data type is not compiled into
+// this DVID executable or whose stored version is incompatible with the compiled one.
+// Problems are sorted by dataset and data name.
+func (dsets *Datasets) CheckCompiledTypes() []TypeProblem {
+	problems := []TypeProblem{}
 	for _, dset := range dsets.list {
-		for name, data := range dset.DataMap {
-			_, found := CompiledTypes[data.DatatypeUrl()]
-			if !found {
-				errMsg += fmt.Sprintf("DVID not compiled with support for %s, data type %s [%s]\n",
-					name, data.DatatypeName(), data.DatatypeUrl())
+		names := make([]string, 0, len(dset.DataMap))
+		for name, _ := range dset.DataMap {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			data := dset.DataMap[dvid.DataString(name)]
+			problem := TypeProblem{
+				Dataset:       dset.Root,
+				Name:          dvid.DataString(name),
+				TypeName:      data.DatatypeName(),
+				TypeUrl:       data.DatatypeUrl(),
+				StoredVersion: data.DatatypeVersion(),
 			}
+			compiled, found := CompiledTypes[data.DatatypeUrl()]
+			if found {
+				problem.CompiledVersion = compiled.DatatypeVersion()
+				if CompatibleVersions(problem.StoredVersion, problem.CompiledVersion) {
+					continue
+				}
+			}
+			problems = append(problems, problem)
 		}
 	}
-	if errMsg != "" {
-		return fmt.Errorf(errMsg)
+	return problems
+}
+
+// VerifyCompiledTypes will return an error if any required data type in the datastore
+// configuration was not compiled into DVID executable or has an incompatible version.
+// Check is done by more exact URL and not the data type name.  The error summarizes
+// all unsupported data instances and how to fix them.
+func (dsets *Datasets) VerifyCompiledTypes() error {
+	problems := dsets.CheckCompiledTypes()
+	if len(problems) == 0 {
+		return nil
 	}
-	return nil
+	errMsg := fmt.Sprintf("%d data instance(s) would be unreadable:\n", len(problems))
+	for _, problem := range problems {
+		errMsg += "  " + problem.String() + "\n"
+	}
+	errMsg += "Use a DVID executable compiled with the listed data type versions.\n"
+	errMsg += "Compiled data types:\n" + CompiledTypeChart()
+	return fmt.Errorf(errMsg)
 }
 
 // newDataset creates a new Dataset, which constitutes a version DAG and allows storing
@@ -175,17 +311,59 @@ func (dsets *Datasets) newChild(parent dvid.UUID) (dset *Dataset, u dvid.UUID, e
 	return
 }
 
+// mergeDataset returns the Dataset holding the LOCKED nodes to be merged.  Will return
+// an error if the nodes cannot be merged.
+func (dsets *Datasets) mergeDataset(parents []dvid.UUID) (dset *Dataset, err error) {
+	for _, parent := range parents {
+		parentDset, found := dsets.mapUUID[parent]
+		if !found {
+			err = fmt.Errorf("No node found with UUID %s", parent)
+			return
+		}
+		if dset == nil {
+			dset = parentDset
+		} else if parentDset != dset {
+			err = fmt.Errorf("Cannot merge nodes of different datasets: %s and %s", parents[0], parent)
+			return
+		}
+	}
+	if dset == nil {
+		err = fmt.Errorf("Merging requires at least two parent nodes")
+		return
+	}
+	_, err = dset.VersionDAG.mergeParents(parents)
+	return
+}
+
+// newMerge adds a node with the given UUID and reserved version whose parents are the
+// LOCKED nodes of a Dataset.
+func (dsets *Datasets) newMerge(dset *Dataset, parents []dvid.UUID, u dvid.UUID,
+	versionID dvid.VersionLocalID) error {
+
+	if err := dset.VersionDAG.newMerge(parents, u, versionID); err != nil {
+		return err
+	}
+	dsets.mapUUID[u] = dset
+	return nil
+}
+
 // -- Datasets Serialization and Deserialization ---
 
 type serializableDatasets struct {
-	DatasetsUUID []dvid.UUID
-	NewDatasetID dvid.DatasetLocalID
+	DatasetsUUID      []dvid.UUID
+	NewDatasetID      dvid.DatasetLocalID
+	KeyEncoding       KeyEncoding
+	StaleKeyEncodings []int `json:",omitempty"`
 }
 
 func (dsets *Datasets) serializableStruct() (sdata *serializableDatasets) {
 	sdata = &serializableDatasets{
 		DatasetsUUID: []dvid.UUID{},
 		NewDatasetID: dsets.newDatasetID,
+		KeyEncoding:  dsets.keyEncoding,
+	}
+	for _, encoding := range dsets.staleKeyEncodings {
+		sdata.StaleKeyEncodings = append(sdata.StaleKeyEncodings, int(encoding))
 	}
 	for _, dset := range dsets.list {
 		sdata.DatasetsUUID = append(sdata.DatasetsUUID, dset.Root)
@@ -193,13 +371,15 @@ func (dsets *Datasets) serializableStruct() (sdata *serializableDatasets) {
 	return
 }
 
-// MarshalBinary fulfills the encoding.BinaryMarshaler interface.
+// MarshalBinary fulfills the encoding.BinaryMarshaler interface.  The list of datasets
+// is stored as uncompressed JSON so external tools can read it directly from storage.
+// Older, Gob-encoded lists are still readable.
 func (dsets *Datasets) MarshalBinary() ([]byte, error) {
-	compression, err := dvid.NewCompression(dvid.LZ4, dvid.DefaultCompression)
+	compression, err := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
 	if err != nil {
 		return nil, err
 	}
-	return dvid.Serialize(dsets.serializableStruct(), compression, dvid.CRC32)
+	return dvid.SerializeWith(dsets.serializableStruct(), dvid.JSONEncoding, compression, dvid.CRC32)
 }
 
 // Deserialize converts a serialization to Datasets
@@ -241,7 +421,7 @@ func (dsets *Datasets) Load(db storage.KeyValueGetter) (err error) {
 	}
 
 	// Get every Dataset (range query)
-	keyvalues, err := db.GetRange(MinDatasetKey(), MaxDatasetKey())
+	keyvalues, err := db.GetRange(context.Background(), MinDatasetKey(), MaxDatasetKey())
 	if err != nil {
 		return err
 	}
@@ -256,6 +436,11 @@ func (dsets *Datasets) Load(db storage.KeyValueGetter) (err error) {
 			deserialization.NewDatasetID, len(keyvalues))
 	}
 	dsets.newDatasetID = deserialization.NewDatasetID
+	dsets.keyEncoding = deserialization.KeyEncoding
+	dsets.staleKeyEncodings = nil
+	for _, encoding := range deserialization.StaleKeyEncodings {
+		dsets.staleKeyEncodings = append(dsets.staleKeyEncodings, KeyEncoding(encoding))
+	}
 
 	// Reconstruct the Datasets by associating UUIDs.
 	dsets.list = []*Dataset{}
@@ -265,7 +450,7 @@ func (dsets *Datasets) Load(db storage.KeyValueGetter) (err error) {
 		dataset := new(Dataset)
 		err := dvid.Deserialize(value.V, dataset)
 		if err != nil {
-			return err
+			return &DatasetDecodeError{value.K, err}
 		}
 		dsets.list = append(dsets.list, dataset)
 		for u, _ := range dataset.Nodes {
@@ -276,6 +461,19 @@ func (dsets *Datasets) Load(db storage.KeyValueGetter) (err error) {
 	return
 }
 
+// DatasetDecodeError is returned when a stored dataset cannot be decoded, usually
+// because it holds data of a type not compiled into this DVID.
+type DatasetDecodeError struct {
+	Key storage.Key
+	Err error
+}
+
+func (e *DatasetDecodeError) Error() string {
+	return fmt.Sprintf("Dataset with key %s could not be decoded (%s).  It may hold data of a "+
+		"type not compiled into this DVID, which has data types:\n%s", e.Key, e.Err.Error(),
+		CompiledTypeChart())
+}
+
 // Put stores Datasets, overwriting whatever was there before.
 func (dsets *Datasets) Put(db storage.KeyValueSetter) error {
 	var mutex sync.Mutex
@@ -304,11 +502,41 @@ type Dataset struct {
 	// DatasetID is the 32-bit identifier that is DVID server-specific.
 	DatasetID dvid.DatasetLocalID
 
+	// ForkedFrom is the UUID of the node in another dataset whose data was copied
+	// into this dataset's root, or empty if this dataset was not forked.
+	ForkedFrom dvid.UUID
+
 	// DataMap keeps the dataset-specific names for instances of data types
 	// in this dataset.  Although this is public, access should be through
 	// the DataService(name) function to also match possible prefix data names,
 	// e.g., multichannel types.
 	DataMap map[dvid.DataString]DataService
+
+	// Trash holds deleted data that is hidden from listings but can be restored
+	// until garbage collection reclaims it.
+	Trash []*TrashedData `json:"-"`
+
+	// Scratch holds temporary data tied to a version node that is hidden from
+	// listings and reclaimed once it expires.
+	Scratch []*ScratchData `json:"-"`
+
+	// Conversions holds the progress of converting data of deprecated data types
+	// into data of their successor types.
+	Conversions []*Conversion `json:"-"`
+
+	// Transfers holds the progress of data being transferred from other servers.
+	Transfers []*Transfer `json:"-"`
+
+	// WriteRules restricts writes of data at nodes or branches to specific users.
+	WriteRules []*WriteRule `json:"-"`
+
+	// WebHooks receive events of the dataset via HTTP POST.
+	WebHooks []*WebHook `json:"-"`
+
+	// ACL limits access to the dataset, and DataACLs limit access to specific data in
+	// place of the dataset's ACL.
+	ACL      *ACL                     `json:"-"`
+	DataACLs map[dvid.DataString]*ACL `json:"-"`
 }
 
 // TypeService returns the TypeService underlying data of a given name.
@@ -381,6 +609,12 @@ func (dset *Dataset) newData(name dvid.DataString, typeName dvid.TypeString, con
 	if found {
 		return fmt.Errorf("Data named '%s' already exists in dataset %s", name, dset.Root)
 	}
+	dset.mapLock.Lock()
+	scratchIndex := dset.scratchIndex(name)
+	dset.mapLock.Unlock()
+	if scratchIndex >= 0 {
+		return fmt.Errorf("Scratch data named '%s' already exists in dataset %s", name, dset.Root)
+	}
 
 	// Create new data for this dataset.
 	typeService, err := TypeServiceByName(typeName)
@@ -449,14 +683,46 @@ type NodeVersion struct {
 	// Locked nodes are read-only and can be branched.
 	Locked bool
 
+	// Abandoned nodes cannot be branched, and data only reachable from them is
+	// reclaimed by garbage collection.
+	Abandoned bool
+
 	// Parents is an ordered list of parent nodes.
 	Parents []dvid.UUID
 
 	// Children is a list of child nodes.
 	Children []dvid.UUID
 
+	// Author identifies who created the node or, if given on commit, who committed it.
+	Author string
+
+	// Message is a free-text log message describing the node.
+	Message string
+
 	Created time.Time
 	Updated time.Time
+
+	// Committed is the time the node was locked, or zero if it is unlocked.
+	Committed time.Time
+}
+
+// CommitInfo is the author and log message given when creating or committing a node.
+// Empty fields leave the node's author or message unchanged.
+type CommitInfo struct {
+	Author  string
+	Message string
+}
+
+// setInfo sets the author and log message of a node.
+func (node *Node) setInfo(info CommitInfo) {
+	node.writeLock.Lock()
+	defer node.writeLock.Unlock()
+	if info.Author != "" {
+		node.Author = info.Author
+	}
+	if info.Message != "" {
+		node.Message = info.Message
+	}
 }
 
 // NodeText holds provenance and other information useful for analysis.  It's
@@ -477,9 +743,9 @@ type Node struct {
 
 	// Avail is used for data compression/deltas in version DAG, depending on
 	// type of data (e.g., versioned) and whether nodes are archived or not.
-	// If there is no map or data availability is not explicitly set, we use
-	// the default for that data, e.g., DataComplete if versioned or DataRoot
-	// if unversioned.
+	// If there is no map or data availability is not explicitly set, versioned
+	// data is a delta, so reads traverse ancestors, while unversioned data is
+	// read only from the node.  Flattened data is DataComplete.
 	Avail map[dvid.DataString]DataAvail
 
 	writeLock sync.Mutex
@@ -525,55 +791,140 @@ func NewVersionDAG() *VersionDAG {
 // Lock locks a node.  This is an irreversible operation since some nodes
 // can be cloned externally.
 func (dag *VersionDAG) Lock(u dvid.UUID) error {
+	_, err := dag.commit(u, CommitInfo{})
+	return err
+}
+
+// commit locks a node, recording the commit time and the given author and message, and
+// returns true if the node was not already locked.  Committing a locked node only
+// updates its author and message.
+func (dag *VersionDAG) commit(u dvid.UUID, info CommitInfo) (locked bool, err error) {
 	node, found := dag.Nodes[u]
 	if !found {
-		return fmt.Errorf("No node found with UUID %s", u)
+		return false, fmt.Errorf("No node found with UUID %s", u)
 	}
-	node.Locked = true
-	return nil
+	node.setInfo(info)
+	node.writeLock.Lock()
+	if !node.Locked {
+		node.Locked = true
+		node.Committed = time.Now()
+		node.Updated = node.Committed
+		locked = true
+	}
+	node.writeLock.Unlock()
+	return
 }
 
 // newChild creates a new child node off a LOCKED parent node.  Will return
 // an error if the parent node has not been locked.
 func (dag *VersionDAG) newChild(parent dvid.UUID) (u dvid.UUID, err error) {
-	node, found := dag.Nodes[parent]
-	if !found {
-		err = fmt.Errorf("No node found with UUID %s", parent)
-		return
+	return dag.newNode([]dvid.UUID{parent})
+}
+
+// mergeParents returns the nodes with the given UUIDs, which must be at least two
+// distinct LOCKED nodes.
+func (dag *VersionDAG) mergeParents(parents []dvid.UUID) ([]*Node, error) {
+	if len(parents) < 2 {
+		return nil, fmt.Errorf("Merging requires at least two parent nodes, got %d", len(parents))
 	}
-	if !node.Locked {
-		err = fmt.Errorf("Cannot create a child of an unlocked node %s", parent)
-		return
+	for i, parent := range parents {
+		for _, other := range parents[:i] {
+			if parent == other {
+				return nil, fmt.Errorf("Cannot merge node %s with itself", parent)
+			}
+		}
 	}
+	return dag.parentNodes(parents)
+}
+
+// newMerge creates a node with the given UUID and reserved version whose parents are
+// the given LOCKED nodes, in order.
+func (dag *VersionDAG) newMerge(parents []dvid.UUID, u dvid.UUID, versionID dvid.VersionLocalID) error {
+	nodes, err := dag.mergeParents(parents)
+	if err != nil {
+		return err
+	}
+	dag.addNode(nodes, u, versionID)
+	return nil
+}
 
+// reserveVersion returns a version ID that is never given to another node.
+func (dag *VersionDAG) reserveVersion() dvid.VersionLocalID {
+	dag.mapLock.Lock()
+	defer dag.mapLock.Unlock()
+	versionID := dag.NewVersionID
+	dag.NewVersionID++
+	return versionID
+}
+
+// parentNodes returns the nodes with the given UUIDs, which must be LOCKED and not
+// abandoned.
+func (dag *VersionDAG) parentNodes(parents []dvid.UUID) ([]*Node, error) {
+	nodes := make([]*Node, len(parents))
+	for i, parent := range parents {
+		node, found := dag.Nodes[parent]
+		if !found {
+			return nil, fmt.Errorf("No node found with UUID %s", parent)
+		}
+		if !node.Locked {
+			return nil, fmt.Errorf("Cannot create a child of an unlocked node %s", parent)
+		}
+		if node.Abandoned {
+			return nil, fmt.Errorf("Cannot create a child of an abandoned node %s", parent)
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+// newNode creates a new node with the given LOCKED parent nodes.
+func (dag *VersionDAG) newNode(parents []dvid.UUID) (u dvid.UUID, err error) {
+	nodes, err := dag.parentNodes(parents)
+	if err != nil {
+		return
+	}
 	u = dvid.NewUUID()
-	t := time.Now()
+	dag.addNode(nodes, u, dag.reserveVersion())
+	return
+}
 
-	node.writeLock.Lock()
-	node.Children = append(node.Children, u)
-	node.Updated = t
-	node.writeLock.Unlock()
+// addNode adds a node with the given UUID and version as a child of the parent nodes.
+func (dag *VersionDAG) addNode(parents []*Node, u dvid.UUID, versionID dvid.VersionLocalID) {
+	t := time.Now()
+	uuids := make([]dvid.UUID, len(parents))
+	for i, node := range parents {
+		node.writeLock.Lock()
+		node.Children = append(node.Children, u)
+		node.Updated = t
+		node.writeLock.Unlock()
+		uuids[i] = node.GlobalID
+	}
 
 	dag.mapLock.Lock()
 	version := &NodeVersion{
 		GlobalID:  u,
-		VersionID: dag.NewVersionID,
+		VersionID: versionID,
 		Created:   t,
 		Updated:   t,
-		Parents:   []dvid.UUID{parent},
+		Parents:   uuids,
 	}
 	dag.Nodes[u] = &Node{NodeVersion: version}
 	dag.VersionMap[u] = version.VersionID
-	dag.NewVersionID++
 	dag.mapLock.Unlock()
-	return
 }
 
 // LogInfo returns provenance information for all the version nodes.
 func (dag *VersionDAG) LogInfo() string {
 	text := "Versions:\n"
 	for _, node := range dag.Nodes {
-		text += fmt.Sprintf("%s  (%d)\n", node.GlobalID, node.VersionID)
+		text += fmt.Sprintf("%s  (%d)", node.GlobalID, node.VersionID)
+		if node.Author != "" {
+			text += fmt.Sprintf("  %s", node.Author)
+		}
+		if node.Message != "" {
+			text += fmt.Sprintf(": %s", node.Message)
+		}
+		text += "\n"
 	}
 	return text
 }
@@ -1,9 +1,15 @@
 package datastore
 
 import (
-	. "github.com/janelia-flyem/go/gocheck"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"strings"
 	_ "testing"
 
+	. "github.com/janelia-flyem/go/gocheck"
+
 	"github.com/janelia-flyem/dvid/dvid"
 )
 
@@ -67,3 +73,229 @@ func (s *DataSuite) TestNewDatasetDifferent(c *C) {
 	c.Assert(datasetID1, Not(Equals), datasetID2)
 	c.Assert(root1, Not(Equals), root2)
 }
+
+func (s *DataSuite) TestDatasetFromString(c *C) {
+	dset := &Dataset{VersionDAG: NewVersionDAG()}
+	dsets := &Datasets{mapUUID: map[dvid.UUID]*Dataset{
+		"3fa22aaa": dset,
+		"3fa25bbb": dset,
+		"7cd11ccc": dset,
+	}}
+
+	_, u, err := dsets.DatasetFromString("7cd")
+	c.Assert(err, IsNil)
+	c.Assert(u, Equals, dvid.UUID("7cd11ccc"))
+	_, u, err = dsets.DatasetFromString(" 3FA25 \n")
+	c.Assert(err, IsNil)
+	c.Assert(u, Equals, dvid.UUID("3fa25bbb"))
+
+	_, u, err = dsets.DatasetFromString("3fa2")
+	ambiguous, ok := err.(*AmbiguousUUIDError)
+	c.Assert(ok, Equals, true)
+	c.Assert(u, Equals, dvid.UUID(""))
+	c.Assert(ambiguous.Prefix, Equals, "3fa2")
+	c.Assert(ambiguous.Candidates, DeepEquals, []dvid.UUID{"3fa22aaa", "3fa25bbb"})
+
+	_, _, err = dsets.DatasetFromString("3f")
+	c.Assert(err, NotNil)
+	_, _, err = dsets.DatasetFromString("abc")
+	c.Assert(err, NotNil)
+}
+
+func (s *DataSuite) TestNodeUUIDs(c *C) {
+	root, _, err := s.service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(s.service.Lock(root), IsNil)
+	child, err := s.service.NewVersion(root)
+	c.Assert(err, IsNil)
+
+	uuids, err := s.service.NodeUUIDs(child)
+	c.Assert(err, IsNil)
+	c.Assert(uuids, DeepEquals, []dvid.UUID{root, child})
+	jsonStr, err := s.service.NodeUUIDsJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, fmt.Sprintf("[%q,%q]", root, child))
+}
+
+func (s *DataSuite) TestCompatibleVersions(c *C) {
+	c.Assert(CompatibleVersions("0.8", "0.8"), Equals, true)
+	c.Assert(CompatibleVersions("0.7", "0.8"), Equals, true)
+	c.Assert(CompatibleVersions("0.8", "0.8.1"), Equals, true)
+	c.Assert(CompatibleVersions("0.8.0", "0.8"), Equals, true)
+	c.Assert(CompatibleVersions("0.9", "0.8"), Equals, false)
+	c.Assert(CompatibleVersions("0.8.1", "0.8"), Equals, false)
+	c.Assert(CompatibleVersions("1.0", "0.8"), Equals, false)
+	c.Assert(CompatibleVersions("beta", "0.8"), Equals, false)
+}
+
+// testType and testData are a minimal TypeService and DataService for checking
+// stored data types.
+type testType struct {
+	*Datatype
+}
+
+func (t *testType) NewDataService(id *DataID, config dvid.Config) (DataService, error) {
+	data, err := NewDataService(id, t, config)
+	return &testData{data}, err
+}
+
+type testData struct {
+	*Data
+}
+
+func init() {
+	gob.Register(&testType{})
+	gob.Register(&testData{})
+	gob.Register(&resolvingData{})
+	gob.Register(&storingData{})
+	gob.Register(&rollbackingData{})
+	gob.Register(&flatteningData{})
+}
+
+func (d *testData) DoRPC(ctx context.Context, request Request, reply *Response) error { return nil }
+
+func (d *testData) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// openTestService opens a new datastore in a test directory with testType registered.
+// The returned function shuts down the service and unregisters testType.
+func openTestService(c *C) (*Service, string, func()) {
+	compiled := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype", "example.com/testtype", "0.1")}}
+	CompiledTypes[compiled.DatatypeUrl()] = compiled
+
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+	return service, dir, func() {
+		service.Shutdown()
+		delete(CompiledTypes, compiled.DatatypeUrl())
+	}
+}
+
+func (s *DataSuite) TestCheckCompiledTypes(c *C) {
+	compiled := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype", "example.com/testtype", "0.2")}}
+	CompiledTypes[compiled.DatatypeUrl()] = compiled
+	defer delete(CompiledTypes, compiled.DatatypeUrl())
+
+	newData := func(name string, id *DatatypeID) DataService {
+		dataID := &DataID{dvid.DataString(name), 1, 1}
+		return &testData{&Data{DataID: dataID, TypeService: &testType{&Datatype{DatatypeID: id}}}}
+	}
+	dset := &Dataset{
+		VersionDAG: NewVersionDAG(),
+		DataMap: map[dvid.DataString]DataService{
+			"ok":      newData("ok", MakeDatatypeID("testtype", "example.com/testtype", "0.1")),
+			"newer":   newData("newer", MakeDatatypeID("testtype", "example.com/testtype", "0.3")),
+			"missing": newData("missing", MakeDatatypeID("other", "example.com/other", "0.1")),
+		},
+	}
+	dsets := &Datasets{list: []*Dataset{dset}}
+
+	problems := dsets.CheckCompiledTypes()
+	c.Assert(problems, HasLen, 2)
+	c.Assert(problems[0].Name, Equals, dvid.DataString("missing"))
+	c.Assert(problems[0].CompiledVersion, Equals, "")
+	c.Assert(problems[1].Name, Equals, dvid.DataString("newer"))
+	c.Assert(problems[1].StoredVersion, Equals, "0.3")
+	c.Assert(problems[1].CompiledVersion, Equals, "0.2")
+
+	err := dsets.VerifyCompiledTypes()
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, "(?s)2 data instance.*'missing'.*'newer'.*")
+
+	delete(dset.DataMap, "newer")
+	delete(dset.DataMap, "missing")
+	c.Assert(dsets.VerifyCompiledTypes(), IsNil)
+}
+
+func (s *DataSuite) TestDatasetDecodeError(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	dset, err := service.Datasets.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	value, err := dvid.Serialize("not a dataset", compression, dvid.CRC32)
+	c.Assert(err, IsNil)
+	c.Assert(service.kvSetter.Put(dset.Key(), value), IsNil)
+
+	err = new(Datasets).Load(service.kvGetter)
+	decodeErr, ok := err.(*DatasetDecodeError)
+	c.Assert(ok, Equals, true, Commentf("got error %v", err))
+	c.Assert(decodeErr.Key, NotNil)
+	c.Assert(err, ErrorMatches, "(?s)Dataset with key .* could not be decoded.*testtype.*")
+}
+
+func (s *DataSuite) TestLocked(c *C) {
+	dir := c.MkDir()
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+	defer service.Shutdown()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	locked, err := service.Locked(root)
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, false)
+	c.Assert(service.Lock(root), IsNil)
+	locked, err = service.Locked(root)
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	locked, err = service.Locked(child)
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, false)
+
+	_, err = service.Locked(dvid.UUID("bad uuid"))
+	c.Assert(err, NotNil)
+}
+
+func (s *DataSuite) TestCommitInfo(c *C) {
+	dir := c.MkDir()
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	dset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	c.Assert(dset.Nodes[root].Committed.IsZero(), Equals, true)
+	c.Assert(service.Commit(root, CommitInfo{Author: "alice", Message: "initial import"}), IsNil)
+	committed := dset.Nodes[root].Committed
+	c.Assert(committed.IsZero(), Equals, false)
+	c.Assert(dset.Nodes[root].Author, Equals, "alice")
+	c.Assert(dset.Nodes[root].Message, Equals, "initial import")
+
+	// Committing again only updates the log message.
+	c.Assert(service.Commit(root, CommitInfo{Message: "initial import of tiles"}), IsNil)
+	c.Assert(dset.Nodes[root].Committed, Equals, committed)
+	c.Assert(dset.Nodes[root].Author, Equals, "alice")
+	c.Assert(dset.Nodes[root].Message, Equals, "initial import of tiles")
+
+	child, err := service.NewVersionWithInfo(root, CommitInfo{Author: "bob", Message: "proofreading"})
+	c.Assert(err, IsNil)
+	service.Shutdown()
+
+	service, err = Open(dir)
+	c.Assert(err, IsNil)
+	defer service.Shutdown()
+	jsonStr, err := service.DatasetJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(jsonStr, `"Author":"bob"`), Equals, true)
+	dset, err = service.DatasetFromUUID(child)
+	c.Assert(err, IsNil)
+	c.Assert(dset.Nodes[child].Author, Equals, "bob")
+	c.Assert(dset.Nodes[child].Message, Equals, "proofreading")
+	c.Assert(dset.Nodes[child].Committed.IsZero(), Equals, true)
+	c.Assert(dset.Nodes[root].Committed.Equal(committed), Equals, true)
+}
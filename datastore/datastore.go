@@ -50,7 +50,7 @@ func Init(directory string, create bool, config dvid.Config) error {
 	if !ok {
 		return fmt.Errorf("Datastore at %s does not support setting of key-value pairs!", directory)
 	}
-	datasets := new(Datasets)
+	datasets := &Datasets{keyEncoding: LatestKeyEncoding}
 	err = datasets.Put(db)
 	return err
 }
@@ -65,6 +65,27 @@ type Service struct {
 	kvDB     storage.KeyValueDB
 	kvSetter storage.KeyValueSetter
 	kvGetter storage.KeyValueGetter
+
+	// Cache of metadata derived from Datasets.
+	cache metadataCache
+
+	// Offsets of data changelogs.
+	changelogs changelogs
+
+	// Subscribers to invalidations of changed data.
+	invalidations invalidationBus
+
+	// In-process hooks run on commits, new nodes, and data mutations.
+	hooks hookRegistry
+
+	// Bearer tokens authenticating users of the server.
+	tokens authTokens
+
+	// Groups of users that can be given in ACLs.
+	groups userGroups
+
+	// Stats of locked versions of data.
+	stats statsCache
 }
 
 type OpenErrorType int
@@ -80,12 +101,16 @@ type OpenError struct {
 	ErrorType OpenErrorType
 }
 
+// StoreSettings are the storage engine settings, e.g., CacheSize, used when opening
+// a datastore.
+var StoreSettings dvid.Config
+
 // Open opens a DVID datastore at the given path (directory, url, etc) and returns
 // a Service that allows operations on that datastore.
 func Open(path string) (s *Service, openErr *OpenError) {
 	// Open the datastore
 	create := false
-	engine, err := storage.NewStore(path, create, dvid.Config{})
+	engine, err := storage.NewStore(path, create, StoreSettings)
 	if err != nil {
 		openErr = &OpenError{
 			fmt.Errorf("Error opening datastore (%s): %s", path, err.Error()),
@@ -93,6 +118,18 @@ func Open(path string) (s *Service, openErr *OpenError) {
 		}
 		return
 	}
+	if storage.DefaultCache.Enabled() {
+		cached, err := storage.NewCachedStore(engine, storage.DefaultCache)
+		if err != nil {
+			engine.Close()
+			openErr = &OpenError{
+				fmt.Errorf("Error setting up cache for datastore (%s): %s", path, err.Error()),
+				ErrorOpening,
+			}
+			return
+		}
+		engine = cached
+	}
 
 	// Get interfaces this engine supports.
 	kvGetter, ok := engine.(storage.KeyValueGetter)
@@ -130,6 +167,14 @@ func Open(path string) (s *Service, openErr *OpenError) {
 		}
 		return
 	}
+	if _, err = keySchema(datasets.keyEncoding); err != nil {
+		openErr = &OpenError{
+			fmt.Errorf("Error reading datasets: %s", err.Error()),
+			ErrorDatasets,
+		}
+		return
+	}
+	setKeyEncoding(datasets.keyEncoding)
 
 	// Verify that the runtime configuration can be supported by this DVID's
 	// compiled-in data types.
@@ -142,12 +187,28 @@ func Open(path string) (s *Service, openErr *OpenError) {
 		}
 		return
 	}
+	var numData int
+	for _, dset := range datasets.list {
+		numData += len(dset.DataMap)
+	}
+	dvid.Fmt(dvid.Debug, "Verified data types of %d data instances in %d datasets.\n",
+		numData, len(datasets.list))
 
 	fmt.Printf("\nDatastoreService successfully opened: %s\n", path)
-	s = &Service{datasets, engine, kvDB, kvSetter, kvGetter}
+	s = &Service{Datasets: datasets, engine: engine, kvDB: kvDB, kvSetter: kvSetter, kvGetter: kvGetter}
 	return
 }
 
+// CacheStats returns the statistics of the storage cache hierarchy and false if the
+// storage engine is not cached.
+func (s *Service) CacheStats() (storage.CacheStats, bool) {
+	cached, ok := s.engine.(*storage.CachedStore)
+	if !ok {
+		return storage.CacheStats{}, false
+	}
+	return cached.Stats(), true
+}
+
 // StorageEngine returns a a key-value database interface.
 func (s *Service) StorageEngine() storage.Engine {
 	return s.engine
@@ -178,8 +239,15 @@ func (s *Service) Batcher() (db storage.Batcher, err error) {
 	return
 }
 
-// Shutdown closes a DVID datastore.
+// Shutdown flushes pending writes to disk if the storage engine supports it and closes
+// a DVID datastore.
 func (s *Service) Shutdown() {
+	s.hooks.stopWebHooks()
+	if syncer, ok := s.engine.(storage.Syncer); ok {
+		if err := syncer.Sync(); err != nil {
+			dvid.Error("Unable to flush writes before closing datastore: %s", err.Error())
+		}
+	}
 	s.engine.Close()
 }
 
@@ -189,12 +257,10 @@ func (s *Service) DatasetsListJSON() (stringJSON string, err error) {
 		stringJSON = "{}"
 		return
 	}
-	var bytesJSON []byte
-	bytesJSON, err = s.Datasets.MarshalJSON()
-	if err != nil {
-		return
-	}
-	return string(bytesJSON), nil
+	return s.cache.get("datasets/list", func() (string, error) {
+		bytesJSON, err := s.Datasets.MarshalJSON()
+		return string(bytesJSON), err
+	})
 }
 
 // DatasetsAllJSON returns JSON of a list of datasets.
@@ -203,12 +269,10 @@ func (s *Service) DatasetsAllJSON() (stringJSON string, err error) {
 		stringJSON = "{}"
 		return
 	}
-	var bytesJSON []byte
-	bytesJSON, err = s.Datasets.AllJSON()
-	if err != nil {
-		return
-	}
-	return string(bytesJSON), nil
+	return s.cache.get("datasets/info", func() (string, error) {
+		bytesJSON, err := s.Datasets.AllJSON()
+		return string(bytesJSON), err
+	})
 }
 
 // DatasetJSON returns JSON for a particular dataset referenced by a uuid.
@@ -221,8 +285,7 @@ func (s *Service) DatasetJSON(root dvid.UUID) (stringJSON string, err error) {
 	if err != nil {
 		return "{}", err
 	}
-	stringJSON, err = dataset.JSONString()
-	return
+	return s.cache.get("dataset/"+string(root), dataset.JSONString)
 }
 
 // NOTE: Alterations of Datasets should invoke persistence to the key-value database.
@@ -240,6 +303,7 @@ func (s *Service) NewDataset() (root dvid.UUID, datasetID dvid.DatasetLocalID, e
 	if err != nil {
 		return
 	}
+	s.InvalidateMetadata()
 	err = s.Datasets.Put(s.kvSetter) // Need to persist change to list of Dataset
 	if err != nil {
 		return
@@ -253,6 +317,12 @@ func (s *Service) NewDataset() (root dvid.UUID, datasetID dvid.DatasetLocalID, e
 // NewVersions creates a new version (child node) off of a LOCKED parent node.
 // Will return an error if the parent node has not been locked.
 func (s *Service) NewVersion(parent dvid.UUID) (u dvid.UUID, err error) {
+	return s.NewVersionWithInfo(parent, CommitInfo{})
+}
+
+// NewVersionWithInfo creates a new version (child node) off of a LOCKED parent node
+// with the given author and log message.
+func (s *Service) NewVersionWithInfo(parent dvid.UUID, info CommitInfo) (u dvid.UUID, err error) {
 	if s.Datasets == nil {
 		err = fmt.Errorf("Datastore service has no datasets available")
 		return
@@ -262,7 +332,69 @@ func (s *Service) NewVersion(parent dvid.UUID) (u dvid.UUID, err error) {
 	if err != nil {
 		return
 	}
-	err = dataset.Put(s.kvSetter)
+	dataset.Nodes[u].setInfo(info)
+	s.InvalidateMetadata()
+	if err = dataset.Put(s.kvSetter); err != nil {
+		return
+	}
+	s.runHooks(&HookEvent{Type: HookBranch, Node: u, Parents: []dvid.UUID{parent},
+		Author: info.Author, Message: info.Message})
+	return
+}
+
+// MergeVersions creates a new version (child node) whose parents are the given LOCKED
+// nodes of a dataset, in order.  Will return an error if any parent has not been locked.
+// Values of versioned data changed by any parent are copied into the new node, and
+// conflicting changes are resolved by data that are MergeResolver, else the merge fails.
+// The node is only added once all values are written, so a failed merge adds no node.
+func (s *Service) MergeVersions(parents []dvid.UUID) (u dvid.UUID, err error) {
+	if s.Datasets == nil {
+		err = fmt.Errorf("Datastore service has no datasets available")
+		return
+	}
+	dataset, err := s.Datasets.mergeDataset(parents)
+	if err != nil {
+		return
+	}
+	plans, err := s.planMerges(dataset, parents)
+	if err != nil {
+		return
+	}
+
+	// Store the reserved version before writing into it so it is never reused.
+	merged := dvid.NewUUID()
+	versionID := dataset.reserveVersion()
+	if err = dataset.Put(s.kvSetter); err != nil {
+		return
+	}
+	var applied []*mergePlan
+	for name, plan := range plans {
+		applied = append(applied, plan)
+		if err = s.applyMerge(plan, parents, merged, versionID); err != nil {
+			err = fmt.Errorf("Unable to merge data '%s' into node %s: %s", name, merged, err.Error())
+			break
+		}
+		dvid.Log(dvid.Debug, "Merged data '%s' into node %s: %d values with %d resolved conflicts\n",
+			name, merged, len(plan.writes), plan.conflicts)
+	}
+	if err == nil {
+		err = s.Datasets.newMerge(dataset, parents, merged, versionID)
+	}
+	if err != nil {
+		for _, plan := range applied {
+			if discardErr := s.discardMerge(plan, versionID); discardErr != nil {
+				dvid.Log(dvid.Normal, "Unable to discard values of failed merge into version %d: %s\n",
+					versionID, discardErr.Error())
+			}
+		}
+		return
+	}
+	u = merged
+	s.InvalidateMetadata()
+	if err = dataset.Put(s.kvSetter); err != nil {
+		return
+	}
+	s.runHooks(&HookEvent{Type: HookMerge, Node: u, Parents: append([]dvid.UUID{}, parents...)})
 	return
 }
 
@@ -279,6 +411,7 @@ func (s *Service) NewData(u dvid.UUID, typename dvid.TypeString, dataname dvid.D
 	if err != nil {
 		return err
 	}
+	s.InvalidateMetadata()
 	return dataset.Put(s.kvSetter)
 }
 
@@ -292,14 +425,22 @@ func (s *Service) ModifyData(u dvid.UUID, dataname dvid.DataString, config dvid.
 		return err
 	}
 	err = dataset.modifyData(dataname, config)
+	s.InvalidateMetadata()
 	if err != nil {
 		return err
 	}
 	return dataset.Put(s.kvSetter)
 }
 
-// Locks the node with the given UUID.
+// Lock commits the node with the given UUID, making it immutable.  This is an
+// irreversible operation.
 func (s *Service) Lock(u dvid.UUID) error {
+	return s.Commit(u, CommitInfo{})
+}
+
+// Commit locks the node with the given UUID like Lock, recording the commit time and
+// the given author and log message.
+func (s *Service) Commit(u dvid.UUID, info CommitInfo) error {
 	if s.Datasets == nil {
 		return fmt.Errorf("Datastore service has no datasets available")
 	}
@@ -307,19 +448,45 @@ func (s *Service) Lock(u dvid.UUID) error {
 	if err != nil {
 		return err
 	}
-	err = dataset.Lock(u)
+	locked, err := dataset.commit(u, info)
 	if err != nil {
 		return err
 	}
-	return dataset.Put(s.kvSetter)
+	s.InvalidateMetadata()
+	if err = dataset.Put(s.kvSetter); err != nil {
+		return err
+	}
+	if locked {
+		node := dataset.Nodes[u]
+		s.runHooks(&HookEvent{Type: HookCommit, Node: u, Author: node.Author, Message: node.Message})
+	}
+	return nil
+}
+
+// Locked returns true if the node with the given UUID is locked.  Locked nodes are
+// immutable: their data cannot be modified, although children can be created off them.
+func (s *Service) Locked(u dvid.UUID) (bool, error) {
+	if s.Datasets == nil {
+		return false, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return false, err
+	}
+	node, found := dataset.Nodes[u]
+	if !found {
+		return false, fmt.Errorf("No node found with UUID %s", u)
+	}
+	return node.Locked, nil
 }
 
 // SaveDataset forces this service to persist the dataset with given UUID.
-// It is useful when modifying datasets internally.
+// It is useful when modifying datasets internally and invalidates cached metadata.
 func (s *Service) SaveDataset(u dvid.UUID) error {
 	if s.Datasets == nil {
 		return fmt.Errorf("Datastore service has no datasets available")
 	}
+	s.InvalidateMetadata()
 	dataset, err := s.Datasets.DatasetFromUUID(u)
 	if err != nil {
 		return err
@@ -368,6 +535,38 @@ func (s *Service) NodeIDFromString(str string) (u dvid.UUID, dID dvid.DatasetLoc
 	return
 }
 
+// NodeUUIDs returns the UUIDs of all nodes in the dataset with the given UUID in the
+// order they were created.
+func (s *Service) NodeUUIDs(u dvid.UUID) ([]dvid.UUID, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	nodes := dataset.Describe().Nodes
+	uuids := make([]dvid.UUID, len(nodes))
+	for i, node := range nodes {
+		uuids[i] = node.UUID
+	}
+	return uuids, nil
+}
+
+// NodeUUIDsJSON returns JSON listing the UUIDs of all nodes in the dataset with the
+// given UUID in the order they were created.
+func (s *Service) NodeUUIDsJSON(u dvid.UUID) (string, error) {
+	uuids, err := s.NodeUUIDs(u)
+	if err != nil {
+		return "[]", err
+	}
+	m, err := json.Marshal(uuids)
+	if err != nil {
+		return "[]", err
+	}
+	return string(m), nil
+}
+
 // SupportedDataChart returns a chart (names/urls) of data referenced by this datastore
 func (s *Service) SupportedDataChart() string {
 	text := CompiledTypeChart()
@@ -1,9 +1,10 @@
 package datastore
 
 import (
-	. "github.com/janelia-flyem/go/gocheck"
 	"testing"
 
+	. "github.com/janelia-flyem/go/gocheck"
+
 	"github.com/janelia-flyem/dvid/dvid"
 )
 
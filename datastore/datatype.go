@@ -5,6 +5,7 @@
 package datastore
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -52,7 +53,6 @@ type TypeService interface {
 // Subsetter is a type that can tell us its range of Index and how much it has
 // actually available in this server.  It's used to implement limited cloning,
 // e.g., only cloning a quarter of an image volume.
-// TODO: Fulfill implementation for voxels data type.
 type Subsetter interface {
 	// MaximumExtents returns a range of indices for which data is available at
 	// some DVID server.
@@ -63,13 +63,31 @@ type Subsetter interface {
 	AvailableExtents() dvid.IndexRange
 }
 
+// SubsetCloner is a Subsetter that can be cloned in part via Service.CloneSubset or
+// Service.CloneData.
+type SubsetCloner interface {
+	Subsetter
+
+	// SubsetIndices returns the index ranges of data within the box from minPt to
+	// maxPt, inclusive, in voxel coordinates.
+	SubsetIndices(minPt, maxPt dvid.Point) (dvid.IndexRanges, error)
+
+	// ROIIndices returns the index ranges of data within the blocks of an ROI.
+	ROIIndices(roi *dvid.ROI) (dvid.IndexRanges, error)
+
+	// SetAvailableExtents records the range of indices available after a partial clone.
+	SetAvailableExtents(extents dvid.IndexRange)
+}
+
 // DataService is an interface for operations on arbitrary data that
 // use a supported TypeService.  Chunk handlers are allocated at this level,
 // so an implementation can own a number of goroutines.
 //
 // DataService operations are completely type-specific, and each datatype
-// handles operations through RPC (DoRPC) and HTTP (DoHTTP).
-// TODO -- Add SPDY as wrapper to HTTP.
+// handles operations through RPC (DoRPC) and HTTP (DoHTTP).  HTTP requests may arrive
+// over HTTP/1.1 or multiplexed over HTTP/2.  Each operation is given a context that is
+// canceled when the client disconnects or the request's deadline passes, and long reads
+// and chunk processing should stop once it is done.
 type DataService interface {
 	TypeService
 
@@ -84,10 +102,10 @@ type DataService interface {
 	ModifyConfig(config dvid.Config) error
 
 	// DoRPC handles command line and RPC commands specific to a data type
-	DoRPC(request Request, reply *Response) error
+	DoRPC(ctx context.Context, request Request, reply *Response) error
 
 	// DoHTTP handles HTTP requests specific to a data type
-	DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error
+	DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error
 
 	// Returns standard error response for unknown commands
 	UnknownCommand(r Request) error
@@ -97,6 +115,9 @@ type DataService interface {
 type Request struct {
 	dvid.Command
 	Input []byte
+
+	// Token authenticates the request if the server requires authentication.
+	Token string
 }
 
 var (
@@ -258,20 +279,56 @@ type Data struct {
 	*DataID
 	TypeService
 
-	// Compression of serialized data, e.g., the value in a key-value.
+	// Compression of serialized data, e.g., the value in a key-value.  Use
+	// UseCompression to read it while the data is in use.
 	Compression dvid.Compression
 
+	// PriorDictionaries are the compression dictionaries this data used before its
+	// current compression.  They are registered when the metadata is loaded, so values
+	// compressed with them remain readable after a restart.
+	PriorDictionaries []*dvid.Dictionary
+
 	// Checksum approach for serialized data.
 	Checksum dvid.Checksum
 
 	// If false (default), we allow changes along nodes.
 	Unversioned bool
+
+	// If true, mutation events are appended to this data's changelog.
+	Changelog bool
 }
 
+// compressionLock guards the Compression of all data, which can change while the data
+// is in use, e.g., after a dictionary is trained.  It isn't held by each Data since
+// types embed and copy Data by value.
+var compressionLock sync.RWMutex
+
 func (d *Data) UseCompression() dvid.Compression {
+	compressionLock.RLock()
+	defer compressionLock.RUnlock()
 	return d.Compression
 }
 
+// setCompression changes the compression of subsequent serializations.  Any dictionary
+// of the replaced compression is kept in PriorDictionaries since stored values may still
+// use it.
+func (d *Data) setCompression(compression dvid.Compression) {
+	compressionLock.Lock()
+	defer compressionLock.Unlock()
+	if old := d.Compression.Dictionary(); old != nil {
+		kept := compression.Dictionary() != nil && compression.Dictionary().ID() == old.ID()
+		for _, prior := range d.PriorDictionaries {
+			if prior.ID() == old.ID() {
+				kept = true
+			}
+		}
+		if !kept {
+			d.PriorDictionaries = append(d.PriorDictionaries, old)
+		}
+	}
+	d.Compression = compression
+}
+
 func (d *Data) UseChecksum() dvid.Checksum {
 	return d.Checksum
 }
@@ -287,22 +344,31 @@ func (d *Data) ModifyConfig(config dvid.Config) error {
 	}
 	d.Unversioned = !versioned
 
+	changelog, found, err := config.GetBool("Changelog")
+	if err != nil {
+		return err
+	}
+	if found {
+		d.Changelog = changelog
+	}
+
 	// Set compression for this instance
 	s, found, err := config.GetString("Compression")
 	if err != nil {
 		return err
 	}
 	if found {
+		var compression dvid.Compression
 		format := strings.ToLower(s)
 		switch format {
 		case "none":
-			d.Compression, _ = dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+			compression, _ = dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
 		case "snappy":
-			d.Compression, _ = dvid.NewCompression(dvid.Snappy, dvid.DefaultCompression)
+			compression, _ = dvid.NewCompression(dvid.Snappy, dvid.DefaultCompression)
 		case "lz4":
-			d.Compression, _ = dvid.NewCompression(dvid.LZ4, dvid.DefaultCompression)
+			compression, _ = dvid.NewCompression(dvid.LZ4, dvid.DefaultCompression)
 		case "gzip":
-			d.Compression, _ = dvid.NewCompression(dvid.Gzip, dvid.DefaultCompression)
+			compression, _ = dvid.NewCompression(dvid.Gzip, dvid.DefaultCompression)
 		default:
 			// Check for gzip + compression level
 			parts := strings.Split(format, ":")
@@ -311,11 +377,12 @@ func (d *Data) ModifyConfig(config dvid.Config) error {
 				if err != nil {
 					return fmt.Errorf("Unable to parse gzip compression level ('%d').  Should be 'gzip:<level>'.", parts[1])
 				}
-				d.Compression, _ = dvid.NewCompression(dvid.Gzip, dvid.CompressionLevel(level))
+				compression, _ = dvid.NewCompression(dvid.Gzip, dvid.CompressionLevel(level))
 			} else {
 				return fmt.Errorf("Illegal compression specified: %s", s)
 			}
 		}
+		d.setCompression(compression)
 	}
 
 	// Set checksum for this instance
@@ -330,6 +397,8 @@ func (d *Data) ModifyConfig(config dvid.Config) error {
 			d.Checksum = dvid.NoChecksum
 		case "crc32":
 			d.Checksum = dvid.CRC32
+		case "sha256":
+			d.Checksum = dvid.SHA256
 		default:
 			return fmt.Errorf("Illegal checksum specified: %s", s)
 		}
@@ -0,0 +1,513 @@
+/*
+	This file supports delta storage of versioned data: a version only stores the
+	key/value pairs that differ from its ancestors, and reads resolve each index to the
+	nearest version in the DAG that stores it.  Deleting a pair at a version stores a
+	tombstone key so the index is not resolved to a value of an ancestor.  Flattening a
+	version copies the values it inherits so it no longer depends on its ancestors, and
+	rolling back a version deletes the values and tombstones it stores so it again reads
+	those of its parent.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Number of key/value pairs copied per batch when flattening a version.
+const flattenBatchSize = 1000
+
+// ancestry returns the local IDs of a node and its ancestors in the order that reads
+// of the named data are resolved: the node, then its ancestors in breadth-first order
+// of parents.  Ancestors of nodes where the data is complete are not traversed.
+func (dag *VersionDAG) ancestry(u dvid.UUID, name dvid.DataString) ([]dvid.VersionLocalID, error) {
+	var versions []dvid.VersionLocalID
+	visited := make(map[dvid.UUID]bool)
+	queue := []dvid.UUID{u}
+	for len(queue) != 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if visited[cur] {
+			continue
+		}
+		visited[cur] = true
+		node, found := dag.Nodes[cur]
+		if !found {
+			return nil, fmt.Errorf("No node found with UUID %s", cur)
+		}
+		versions = append(versions, node.VersionID)
+		if avail, found := node.Avail[name]; found && avail == DataComplete {
+			continue
+		}
+		queue = append(queue, node.Parents...)
+	}
+	return versions, nil
+}
+
+// DataVersions returns the local IDs of the versions that must be read, in order, to
+// resolve the named data at the node with the given UUID.  The first version is the
+// node's own.  Unversioned data only needs the node's own version.
+func (s *Service) DataVersions(u dvid.UUID, dataname dvid.DataString) ([]dvid.VersionLocalID, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	dataservice, err := dataset.DataService(dataname)
+	if err != nil {
+		return nil, err
+	}
+	if !dataservice.IsVersioned() {
+		versionID, found := dataset.VersionMap[u]
+		if !found {
+			return nil, fmt.Errorf("UUID (%s) not found in dataset", u)
+		}
+		return []dvid.VersionLocalID{versionID}, nil
+	}
+	return dataset.ancestry(u, dataname)
+}
+
+// Value stored at tombstone keys, which only need to exist.
+var tombstoneValue = []byte{1}
+
+// DeleteVersioned adds to a batch the deletion of a key/value pair of data, where the
+// key's version is the first of the given versions read to resolve the data.  If the
+// version has ancestors, a tombstone is also stored so the deleted index is not resolved
+// to a value stored by an ancestor.
+func DeleteVersioned(batch storage.Batch, key *DataKey, versions []dvid.VersionLocalID) {
+	batch.Delete(key)
+	if len(versions) > 1 {
+		batch.Put(key.Tombstone(), tombstoneValue)
+	}
+}
+
+// tombstonedIndices returns the indices of data from indexBeg to indexEnd, inclusive,
+// that were deleted at a version, in index order.  Nil indices extend the range to the
+// first or last index of the version.
+func tombstonedIndices(ctx context.Context, db storage.KeyValueGetter, dsetID dvid.DatasetLocalID,
+	dataID dvid.DataLocalID, versionID dvid.VersionLocalID, indexBeg, indexEnd dvid.Index) ([][]byte, error) {
+
+	minKey := &TombstoneKey{dsetID, dataID, versionID, indexBeg}
+	if indexBeg == nil {
+		minKey.Index = dvid.IndexBytes{}
+	}
+	maxKey := &TombstoneKey{dsetID, dataID, versionID, indexEnd}
+	if indexEnd == nil {
+		maxKey = &TombstoneKey{dsetID, dataID, versionID + 1, nil}
+	}
+	keys, err := db.KeysInRange(ctx, minKey, maxKey)
+	if err != nil {
+		return nil, err
+	}
+	var indices [][]byte
+	for _, key := range keys {
+		tombstone, ok := key.(*TombstoneKey)
+		if !ok || tombstone.Dataset != dsetID || tombstone.Data != dataID || tombstone.Version != versionID {
+			continue
+		}
+		if tombstone.Index == nil {
+			indices = append(indices, []byte{})
+		} else {
+			indices = append(indices, tombstone.Index.Bytes())
+		}
+	}
+	return indices, nil
+}
+
+// addTombstones marks as found the indices of data from indexBeg to indexEnd, inclusive,
+// that were deleted at a version, so they are not resolved to values of later versions.
+func addTombstones(ctx context.Context, db storage.KeyValueGetter, dsetID dvid.DatasetLocalID,
+	dataID dvid.DataLocalID, versionID dvid.VersionLocalID, indexBeg, indexEnd dvid.Index,
+	found map[string]bool) error {
+
+	indices, err := tombstonedIndices(ctx, db, dsetID, dataID, versionID, indexBeg, indexEnd)
+	if err != nil {
+		return err
+	}
+	for _, index := range indices {
+		found[string(index)] = true
+	}
+	return nil
+}
+
+// GetVersionedValue returns the value of an index of data resolved to the first of the
+// given versions that stores it, or nil if no version stores it or it was deleted at a
+// version before one that stores it.
+func GetVersionedValue(db storage.KeyValueGetter, dataID DataID, versions []dvid.VersionLocalID,
+	index dvid.Index) ([]byte, error) {
+
+	for i, versionID := range versions {
+		key := &DataKey{dataID.DsetID, dataID.ID, versionID, index}
+		value, err := db.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil || i == len(versions)-1 {
+			return value, nil
+		}
+		tombstone, err := db.Get(key.Tombstone())
+		if err != nil {
+			return nil, err
+		}
+		if tombstone != nil {
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+type keyValuesByIndex []storage.KeyValue
+
+func (kvs keyValuesByIndex) Len() int      { return len(kvs) }
+func (kvs keyValuesByIndex) Swap(i, j int) { kvs[i], kvs[j] = kvs[j], kvs[i] }
+func (kvs keyValuesByIndex) Less(i, j int) bool {
+	return bytes.Compare(kvs[i].K.(*DataKey).Index.Bytes(), kvs[j].K.(*DataKey).Index.Bytes()) < 0
+}
+
+// GetVersionedRange returns the key/value pairs of data with indices from indexBeg to
+// indexEnd, inclusive, resolving each index to the first of the given versions that
+// stores it unless the index was deleted at an earlier version.  Returned keys are in
+// index order and use the first version, so values inherited from ancestors are written
+// to the first version if modified.  The read stops early with an error if the context
+// is canceled.
+func GetVersionedRange(ctx context.Context, db storage.KeyValueGetter, dataID DataID, versions []dvid.VersionLocalID,
+	indexBeg, indexEnd dvid.Index) ([]storage.KeyValue, error) {
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("No versions given for range of data '%s'", dataID.DataName())
+	}
+	if len(versions) == 1 {
+		return db.GetRange(ctx, &DataKey{dataID.DsetID, dataID.ID, versions[0], indexBeg},
+			&DataKey{dataID.DsetID, dataID.ID, versions[0], indexEnd})
+	}
+	var resolved []storage.KeyValue
+	found := make(map[string]bool)
+	for i, versionID := range versions {
+		keyvalues, err := db.GetRange(ctx, &DataKey{dataID.DsetID, dataID.ID, versionID, indexBeg},
+			&DataKey{dataID.DsetID, dataID.ID, versionID, indexEnd})
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range keyvalues {
+			dataKey, ok := kv.K.(*DataKey)
+			if !ok {
+				return nil, fmt.Errorf("Expected DataKey in range of data '%s', got %s", dataID.DataName(), kv.K)
+			}
+			index := string(dataKey.Index.Bytes())
+			if found[index] {
+				continue
+			}
+			found[index] = true
+			kv.K = &DataKey{dataKey.Dataset, dataKey.Data, versions[0], dataKey.Index}
+			resolved = append(resolved, kv)
+		}
+		if i < len(versions)-1 {
+			err = addTombstones(ctx, db, dataID.DsetID, dataID.ID, versionID, indexBeg, indexEnd, found)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Sort(keyValuesByIndex(resolved))
+	return resolved, nil
+}
+
+type keysByIndex []storage.Key
+
+func (keys keysByIndex) Len() int      { return len(keys) }
+func (keys keysByIndex) Swap(i, j int) { keys[i], keys[j] = keys[j], keys[i] }
+func (keys keysByIndex) Less(i, j int) bool {
+	return bytes.Compare(keys[i].(*DataKey).Index.Bytes(), keys[j].(*DataKey).Index.Bytes()) < 0
+}
+
+// KeysInVersionedRange returns the keys of data with indices from indexBeg to indexEnd,
+// inclusive, that resolve to a value at the first of the given versions that stores it,
+// like GetVersionedRange but without reading values.  Returned keys are in index order
+// and use the first version.
+func KeysInVersionedRange(ctx context.Context, db storage.KeyValueGetter, dataID DataID,
+	versions []dvid.VersionLocalID, indexBeg, indexEnd dvid.Index) ([]storage.Key, error) {
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("No versions given for range of data '%s'", dataID.DataName())
+	}
+	if len(versions) == 1 {
+		return db.KeysInRange(ctx, &DataKey{dataID.DsetID, dataID.ID, versions[0], indexBeg},
+			&DataKey{dataID.DsetID, dataID.ID, versions[0], indexEnd})
+	}
+	var resolved []storage.Key
+	found := make(map[string]bool)
+	for i, versionID := range versions {
+		keys, err := db.KeysInRange(ctx, &DataKey{dataID.DsetID, dataID.ID, versionID, indexBeg},
+			&DataKey{dataID.DsetID, dataID.ID, versionID, indexEnd})
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			dataKey, ok := key.(*DataKey)
+			if !ok {
+				return nil, fmt.Errorf("Expected DataKey in range of data '%s', got %s", dataID.DataName(), key)
+			}
+			index := string(dataKey.Index.Bytes())
+			if found[index] {
+				continue
+			}
+			found[index] = true
+			resolved = append(resolved, &DataKey{dataKey.Dataset, dataKey.Data, versions[0], dataKey.Index})
+		}
+		if i < len(versions)-1 {
+			err = addTombstones(ctx, db, dataID.DsetID, dataID.ID, versionID, indexBeg, indexEnd, found)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Sort(keysByIndex(resolved))
+	return resolved, nil
+}
+
+// ProcessVersionedRange sends the key/value pairs of data with indices from indexBeg to
+// indexEnd, inclusive, to a chunk handler like storage ProcessRange, resolving each
+// index to the first of the given versions that stores it.  No chunks are sent after the
+// context is canceled.
+func ProcessVersionedRange(ctx context.Context, db storage.KeyValueGetter, dataID DataID, versions []dvid.VersionLocalID,
+	indexBeg, indexEnd dvid.Index, op *storage.ChunkOp, f func(*storage.Chunk)) error {
+
+	if len(versions) == 1 {
+		return db.ProcessRange(ctx, &DataKey{dataID.DsetID, dataID.ID, versions[0], indexBeg},
+			&DataKey{dataID.DsetID, dataID.ID, versions[0], indexEnd}, op, f)
+	}
+	keyvalues, err := GetVersionedRange(ctx, db, dataID, versions, indexBeg, indexEnd)
+	if err != nil {
+		return err
+	}
+	for _, kv := range keyvalues {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if op.Wg != nil {
+			op.Wg.Add(1)
+		}
+		f(&storage.Chunk{ChunkOp: op, KeyValue: kv})
+	}
+	return nil
+}
+
+// VersionFlattener is a data service that serializes the flattening of its data at a
+// version with its own mutations, e.g., by holding its PUT or mutation lock.
+type VersionFlattener interface {
+	// FlattenVersion calls flatten, which copies inherited key/value pairs into the node
+	// with the given UUID, and returns the number of copied pairs.
+	FlattenVersion(u dvid.UUID, flatten func() (int, error)) (int, error)
+}
+
+// FlattenVersion copies into the node with the given UUID all key/value pairs of the
+// named data that it inherits from ancestors, then marks the data complete at the node
+// so reads no longer traverse its ancestors.  Pairs already stored at the node when
+// they are copied are kept.  Data that is a VersionFlattener holds off its own
+// mutations during the copy.  Returns the number of copied pairs.
+func (s *Service) FlattenVersion(u dvid.UUID, dataname dvid.DataString) (int, error) {
+	if s.Datasets == nil {
+		return 0, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return 0, err
+	}
+	dataservice, err := dataset.DataService(dataname)
+	if err != nil {
+		return 0, err
+	}
+	data, ok := dataservice.(versionedData)
+	if !ok {
+		return 0, fmt.Errorf("Data '%s' cannot be flattened", dataname)
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return 0, err
+	}
+	dsetID, dataID := data.DatasetID(), data.LocalID()
+
+	flatten := func() (int, error) {
+		versions, err := s.DataVersions(u, dataname)
+		if err != nil {
+			return 0, err
+		}
+		found := make(map[string]bool)
+		batch := batcher.NewBatch()
+		var numCopied, numBatched int
+		for i, versionID := range versions {
+			var copyErr error
+			minKey, maxKey := versionKeyRange(dsetID, dataID, versionID)
+			err = s.kvGetter.ProcessRange(context.Background(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+				dataKey, ok := chunk.K.(*DataKey)
+				if copyErr != nil || !ok || dataKey.Dataset != dsetID || dataKey.Data != dataID ||
+					dataKey.Version != versionID {
+					return
+				}
+				index := string(dataKey.Index.Bytes())
+				if found[index] {
+					return
+				}
+				found[index] = true
+				if i == 0 {
+					return
+				}
+				// Keep any value written to the node since it was read.
+				key := &DataKey{dsetID, dataID, versions[0], dataKey.Index}
+				var existing []byte
+				if existing, copyErr = s.kvGetter.Get(key); copyErr != nil || existing != nil {
+					return
+				}
+				batch.Put(key, chunk.V)
+				numCopied++
+				numBatched++
+				if numBatched >= flattenBatchSize {
+					if copyErr = batch.Commit(); copyErr != nil {
+						return
+					}
+					batch = batcher.NewBatch()
+					numBatched = 0
+				}
+			})
+			if err != nil {
+				return numCopied, err
+			}
+			if copyErr != nil {
+				return numCopied, copyErr
+			}
+			err = addTombstones(context.Background(), s.kvGetter, dsetID, dataID, versionID, nil, nil, found)
+			if err != nil {
+				return numCopied, err
+			}
+		}
+		return numCopied, batch.Commit()
+	}
+	var numCopied int
+	if flattener, ok := dataservice.(VersionFlattener); ok {
+		numCopied, err = flattener.FlattenVersion(u, flatten)
+	} else {
+		numCopied, err = flatten()
+	}
+	if err != nil {
+		return numCopied, err
+	}
+
+	node := dataset.Nodes[u]
+	node.writeLock.Lock()
+	if node.Avail == nil {
+		node.Avail = make(map[dvid.DataString]DataAvail)
+	}
+	node.Avail[dataname] = DataComplete
+	node.writeLock.Unlock()
+	if err = s.forgetStats(dataset.Root, u, dataID); err != nil {
+		return numCopied, err
+	}
+	s.InvalidateMetadata()
+	return numCopied, dataset.Put(s.kvSetter)
+}
+
+// VersionRollbacker is a data service that takes part in the rollback of its data at a
+// version, e.g., to serialize the rollback with its own mutations or to restore metadata
+// like extents that is shared by all versions.
+type VersionRollbacker interface {
+	// RollbackVersion calls rollback, which discards the data's key/value pairs at the
+	// node with the given UUID, and returns the number of pairs deleted after restoring
+	// any state that depended on them.
+	RollbackVersion(u dvid.UUID, rollback func() (int, error)) (int, error)
+}
+
+// RollbackVersion discards all key/value pairs and tombstones of the named data stored at
+// the unlocked node with the given UUID, so the data again reads as it does at the node's
+// parent.  Data that is a VersionRollbacker runs the rollback itself, and its metadata is
+// saved afterwards.
+// Merge nodes cannot be rolled back since they store the resolution of their parents.
+// Returns the number of deleted pairs.
+func (s *Service) RollbackVersion(u dvid.UUID, dataname dvid.DataString) (int, error) {
+	if s.Datasets == nil {
+		return 0, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return 0, err
+	}
+	dataservice, err := dataset.DataService(dataname)
+	if err != nil {
+		return 0, err
+	}
+	data, ok := dataservice.(versionedData)
+	if !ok || !dataservice.IsVersioned() {
+		return 0, fmt.Errorf("Data '%s' is not versioned and cannot be rolled back", dataname)
+	}
+	node, found := dataset.Nodes[u]
+	if !found {
+		return 0, fmt.Errorf("No node found with UUID %s", u)
+	}
+	node.writeLock.Lock()
+	locked, numParents := node.Locked, len(node.Parents)
+	node.writeLock.Unlock()
+	if locked {
+		return 0, fmt.Errorf("Node %s is locked and cannot be rolled back", u)
+	}
+	if numParents > 1 {
+		return 0, fmt.Errorf("Merge node %s cannot be rolled back", u)
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return 0, err
+	}
+	dsetID, dataID, versionID := data.DatasetID(), data.LocalID(), node.VersionID
+
+	rollback := func() (int, error) {
+		minKey, maxKey := versionKeyRange(dsetID, dataID, versionID)
+		numDeleted, err := deleteKeyRange(s.kvGetter, batcher, nil, minKey, maxKey, func(key storage.Key) bool {
+			dataKey, ok := key.(*DataKey)
+			return ok && dataKey.Dataset == dsetID && dataKey.Data == dataID && dataKey.Version == versionID
+		})
+		var numTombstones int
+		if err == nil {
+			numTombstones, err = deleteKeyRange(s.kvGetter, batcher, nil, minKey.Tombstone(), maxKey.Tombstone(),
+				func(key storage.Key) bool {
+					tombstone, ok := key.(*TombstoneKey)
+					return ok && tombstone.Dataset == dsetID && tombstone.Data == dataID && tombstone.Version == versionID
+				})
+		}
+		if numDeleted+numTombstones != 0 {
+			s.Invalidate(dataservice, u, nil)
+		}
+		return numDeleted, err
+	}
+	var numDeleted int
+	rollbacker, restores := dataservice.(VersionRollbacker)
+	if restores {
+		numDeleted, err = rollbacker.RollbackVersion(u, rollback)
+	} else {
+		numDeleted, err = rollback()
+	}
+	if err != nil {
+		return numDeleted, err
+	}
+	if _, err = s.AppendEvent(dataservice, u, "rollback", nil); err != nil {
+		return numDeleted, err
+	}
+
+	// A flattened node must again read its ancestors.
+	node.writeLock.Lock()
+	avail, found := node.Avail[dataname]
+	if found && avail == DataComplete {
+		delete(node.Avail, dataname)
+	}
+	node.writeLock.Unlock()
+	if !restores && (!found || avail != DataComplete) {
+		return numDeleted, nil
+	}
+	s.InvalidateMetadata()
+	return numDeleted, dataset.Put(s.kvSetter)
+}
@@ -0,0 +1,277 @@
+package datastore
+
+import (
+	"context"
+	"net/http"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestDataVersions(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+	c.Assert(service.NewData(root, "testtype", "unversioned", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+
+	c.Assert(service.Lock(root), IsNil)
+	child1, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	child2, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(service.Lock(child1), IsNil)
+	c.Assert(service.Lock(child2), IsNil)
+	merged, err := service.MergeVersions([]dvid.UUID{child2, child1})
+	c.Assert(err, IsNil)
+
+	versions, err := service.DataVersions(merged, "mydata")
+	c.Assert(err, IsNil)
+	c.Assert(versions, DeepEquals, []dvid.VersionLocalID{3, 2, 1, 0})
+	versions, err = service.DataVersions(merged, "unversioned")
+	c.Assert(err, IsNil)
+	c.Assert(versions, DeepEquals, []dvid.VersionLocalID{3})
+
+	// Values of nearer versions take precedence.
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), []byte("root b")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("b")), []byte("child1 b")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(2, dvid.IndexBytes("b")), []byte("child2 b")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("c")), []byte("child1 c")), IsNil)
+	versions, err = service.DataVersions(merged, "mydata")
+	c.Assert(err, IsNil)
+	keyvalues, err := GetVersionedRange(context.Background(), service.kvGetter, *data.DataID, versions, dvid.IndexBytes("a"), dvid.IndexBytes("z"))
+	c.Assert(err, IsNil)
+	c.Assert(keyvalues, HasLen, 3)
+	expected := []string{"root a", "child2 b", "child1 c"}
+	for i, kv := range keyvalues {
+		c.Assert(string(kv.V), Equals, expected[i])
+		c.Assert(kv.K.(*DataKey).Version, Equals, dvid.VersionLocalID(3))
+	}
+
+	numCopied, err := service.FlattenVersion(merged, "mydata")
+	c.Assert(err, IsNil)
+	c.Assert(numCopied, Equals, 3)
+	versions, err = service.DataVersions(merged, "mydata")
+	c.Assert(err, IsNil)
+	c.Assert(versions, DeepEquals, []dvid.VersionLocalID{3})
+	value, err := service.kvGetter.Get(data.DataKey(3, dvid.IndexBytes("b")))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "child2 b")
+}
+
+func (s *DataSuite) TestRollbackVersion(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+	c.Assert(service.NewData(root, "testtype", "unversioned", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("a")), []byte("child a")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("b")), []byte("child b")), IsNil)
+	numCopied, err := service.FlattenVersion(child, "mydata")
+	c.Assert(err, IsNil)
+	c.Assert(numCopied, Equals, 0)
+
+	_, err = service.RollbackVersion(root, "mydata")
+	c.Assert(err, NotNil) // root is locked
+	_, err = service.RollbackVersion(child, "unversioned")
+	c.Assert(err, NotNil)
+
+	var invalidated []*Invalidation
+	id := service.SubscribeInvalidations(func(inv *Invalidation) { invalidated = append(invalidated, inv) })
+	defer service.UnsubscribeInvalidations(id)
+	numDeleted, err := service.RollbackVersion(child, "mydata")
+	c.Assert(err, IsNil)
+	c.Assert(numDeleted, Equals, 2)
+	c.Assert(invalidated, HasLen, 1)
+	c.Assert(invalidated[0].Version, Equals, child)
+
+	versions, err := service.DataVersions(child, "mydata")
+	c.Assert(err, IsNil)
+	c.Assert(versions, DeepEquals, []dvid.VersionLocalID{1, 0})
+	keyvalues, err := GetVersionedRange(context.Background(), service.kvGetter, *data.DataID, versions, dvid.IndexBytes("a"), dvid.IndexBytes("z"))
+	c.Assert(err, IsNil)
+	c.Assert(keyvalues, HasLen, 1)
+	c.Assert(string(keyvalues[0].V), Equals, "root a")
+
+	// Data that is a VersionRollbacker runs the rollback itself.
+	dset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	rollbacker := &rollbackingData{Data: data.Data}
+	dset.DataMap["mydata"] = rollbacker
+	c.Assert(service.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("c")), []byte("child c")), IsNil)
+	numDeleted, err = service.RollbackVersion(child, "mydata")
+	c.Assert(err, IsNil)
+	c.Assert(numDeleted, Equals, 1)
+	c.Assert(rollbacker.rolledBack, DeepEquals, []int{1})
+}
+
+// rollbackingData records the number of key/value pairs deleted by each rollback.
+type rollbackingData struct {
+	*Data
+	rolledBack []int
+}
+
+func (d *rollbackingData) DoRPC(ctx context.Context, request Request, reply *Response) error {
+	return nil
+}
+
+func (d *rollbackingData) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (d *rollbackingData) RollbackVersion(u dvid.UUID, rollback func() (int, error)) (int, error) {
+	numDeleted, err := rollback()
+	d.rolledBack = append(d.rolledBack, numDeleted)
+	return numDeleted, err
+}
+
+func (s *DataSuite) TestFlattenVersionFlattener(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), []byte("root b")), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+
+	// Data that is a VersionFlattener runs the flatten itself, and values written to the
+	// node are kept.
+	dset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	flattener := &flatteningData{Data: data.Data, write: func() {
+		c.Assert(service.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("b")), []byte("child b")), IsNil)
+	}}
+	dset.DataMap["mydata"] = flattener
+	numCopied, err := service.FlattenVersion(child, "mydata")
+	c.Assert(err, IsNil)
+	c.Assert(numCopied, Equals, 1)
+	c.Assert(flattener.flattened, DeepEquals, []int{1})
+	for index, expected := range map[string]string{"a": "root a", "b": "child b"} {
+		value, err := service.kvGetter.Get(data.DataKey(1, dvid.IndexBytes(index)))
+		c.Assert(err, IsNil)
+		c.Assert(string(value), Equals, expected)
+	}
+}
+
+// flatteningData makes a write before each flatten and records the number of key/value
+// pairs copied by each flatten.
+type flatteningData struct {
+	*Data
+	write     func()
+	flattened []int
+}
+
+func (d *flatteningData) DoRPC(ctx context.Context, request Request, reply *Response) error {
+	return nil
+}
+
+func (d *flatteningData) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (d *flatteningData) FlattenVersion(u dvid.UUID, flatten func() (int, error)) (int, error) {
+	d.write()
+	numCopied, err := flatten()
+	d.flattened = append(d.flattened, numCopied)
+	return numCopied, err
+}
+
+func (s *DataSuite) TestVersionedDeletes(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), []byte("root b")), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+
+	// The child reads the values of its parent.
+	versions, err := service.DataVersions(child, "mydata")
+	c.Assert(err, IsNil)
+	value, err := GetVersionedValue(service.kvGetter, *data.DataID, versions, dvid.IndexBytes("b"))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "root b")
+	keys, err := KeysInVersionedRange(context.Background(), service.kvGetter, *data.DataID, versions,
+		dvid.IndexBytes("a"), dvid.IndexBytes("z"))
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+
+	// Deleting an inherited value at the child hides it without changing the parent.
+	batcher, err := service.Batcher()
+	c.Assert(err, IsNil)
+	batch := batcher.NewBatch()
+	DeleteVersioned(batch, data.DataKey(versions[0], dvid.IndexBytes("b")), versions)
+	c.Assert(batch.Commit(), IsNil)
+	value, err = GetVersionedValue(service.kvGetter, *data.DataID, versions, dvid.IndexBytes("b"))
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+	keyvalues, err := GetVersionedRange(context.Background(), service.kvGetter, *data.DataID, versions,
+		dvid.IndexBytes("a"), dvid.IndexBytes("z"))
+	c.Assert(err, IsNil)
+	c.Assert(keyvalues, HasLen, 1)
+	c.Assert(string(keyvalues[0].V), Equals, "root a")
+	keys, err = KeysInVersionedRange(context.Background(), service.kvGetter, *data.DataID, versions,
+		dvid.IndexBytes("a"), dvid.IndexBytes("z"))
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+	value, err = service.GetValue(root, "mydata", dvid.IndexBytes("b"))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "root b")
+
+	// A value put after the delete is read again.
+	c.Assert(service.kvSetter.Put(data.DataKey(versions[0], dvid.IndexBytes("b")), []byte("child b")), IsNil)
+	value, err = service.GetValue(child, "mydata", dvid.IndexBytes("b"))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "child b")
+
+	// Rolling back the child discards its deletes.
+	batch = batcher.NewBatch()
+	DeleteVersioned(batch, data.DataKey(versions[0], dvid.IndexBytes("a")), versions)
+	c.Assert(batch.Commit(), IsNil)
+	value, err = service.GetValue(child, "mydata", dvid.IndexBytes("a"))
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+	_, err = service.RollbackVersion(child, "mydata")
+	c.Assert(err, IsNil)
+	value, err = service.GetValue(child, "mydata", dvid.IndexBytes("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "root a")
+}
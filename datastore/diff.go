@@ -0,0 +1,192 @@
+/*
+	This file supports diffs of data between two versions, listing the indices whose
+	key/value pairs were added, deleted, or modified so downstream tools can sync or
+	check only what changed.
+*/
+
+package datastore
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Kinds of changes of an index between two versions.
+const (
+	DiffAdded    = "added"
+	DiffDeleted  = "deleted"
+	DiffModified = "modified"
+)
+
+// DiffEntry is an index whose key/value pair differs between two versions.  The index
+// is hexadecimal, e.g., the bytes of a block's spatial index for voxels data.  Value
+// is the value in the later version and is only included if values were requested.
+type DiffEntry struct {
+	Index  string
+	Change string
+	Value  []byte `json:",omitempty"`
+}
+
+// VersionDiff lists the indices of data that differ between two versions, in index
+// order.  Values inherited from ancestor versions are compared, and since stored values
+// are compared, values with different compression are reported as modified.
+type VersionDiff struct {
+	Name    dvid.DataString
+	From    dvid.UUID
+	To      dvid.UUID
+	Changes []DiffEntry
+}
+
+// versionedData is fulfilled by any data service embedding Data.
+type versionedData interface {
+	DataName() dvid.DataString
+	DatasetID() dvid.DatasetLocalID
+	LocalID() dvid.DataLocalID
+}
+
+// versionKeyRange returns the range of keys spanning a version of data.
+func versionKeyRange(dsetID dvid.DatasetLocalID, dataID dvid.DataLocalID,
+	versionID dvid.VersionLocalID) (minKey, maxKey *DataKey) {
+
+	minKey = &DataKey{dsetID, dataID, versionID, dvid.IndexBytes{}}
+	maxKey = &DataKey{dsetID, dataID, versionID + 1, nil}
+	return
+}
+
+// DiffVersions returns the indices of the named data whose key/value pairs differ from
+// version "from" to version "to".  If values is true, the values of added and modified
+// indices at version "to" are included.
+func (s *Service) DiffVersions(from, to dvid.UUID, dataname dvid.DataString, values bool) (*VersionDiff, error) {
+	fromDset, fromVersion, err := s.LocalIDFromUUID(from)
+	if err != nil {
+		return nil, err
+	}
+	toDset, toVersion, err := s.LocalIDFromUUID(to)
+	if err != nil {
+		return nil, err
+	}
+	if fromDset != toDset {
+		return nil, fmt.Errorf("Cannot diff nodes of different datasets: %s and %s", from, to)
+	}
+	dataservice, err := s.DataServiceByUUID(to, dataname)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := dataservice.(versionedData)
+	if !ok {
+		return nil, fmt.Errorf("Data '%s' does not support version diffs", dataname)
+	}
+	dsetID, dataID := data.DatasetID(), data.LocalID()
+	fromVersions, err := s.DataVersions(from, dataname)
+	if err != nil {
+		return nil, err
+	}
+	toVersions, err := s.DataVersions(to, dataname)
+	if err != nil {
+		return nil, err
+	}
+	if fromVersions[0] != fromVersion || toVersions[0] != toVersion {
+		return nil, fmt.Errorf("Unable to resolve versions of data '%s'", dataname)
+	}
+
+	// Compare the value checksums of each version, including values inherited from
+	// ancestors.
+	fromSums, _, err := s.resolvedSums(dsetID, dataID, fromVersions, false)
+	if err != nil {
+		return nil, err
+	}
+	toSums, toValues, err := s.resolvedSums(dsetID, dataID, toVersions, values)
+	if err != nil {
+		return nil, err
+	}
+	var indices []string
+	for index, sum := range toSums {
+		if fromSum, found := fromSums[index]; !found || fromSum != sum {
+			indices = append(indices, index)
+		}
+	}
+	for index := range fromSums {
+		if _, found := toSums[index]; !found {
+			indices = append(indices, index)
+		}
+	}
+	sort.Strings(indices)
+
+	diff := &VersionDiff{Name: dataname, From: from, To: to, Changes: make([]DiffEntry, len(indices))}
+	for i, index := range indices {
+		entry := DiffEntry{Index: hex.EncodeToString([]byte(index))}
+		_, inFrom := fromSums[index]
+		_, inTo := toSums[index]
+		switch {
+		case !inFrom:
+			entry.Change = DiffAdded
+		case !inTo:
+			entry.Change = DiffDeleted
+		default:
+			entry.Change = DiffModified
+		}
+		if inTo {
+			entry.Value = toValues[index]
+		}
+		diff.Changes[i] = entry
+	}
+	return diff, nil
+}
+
+// resolvedSums returns the value checksums of data by index, resolving each index to the
+// first of the given versions that stores it unless deleted at a version before it.  If values is true, the values are also
+// returned.
+func (s *Service) resolvedSums(dsetID dvid.DatasetLocalID, dataID dvid.DataLocalID,
+	versions []dvid.VersionLocalID, values bool) (map[string][sha1.Size]byte, map[string][]byte, error) {
+
+	sums := make(map[string][sha1.Size]byte)
+	deleted := make(map[string]bool)
+	var resolved map[string][]byte
+	if values {
+		resolved = make(map[string][]byte)
+	}
+	for _, versionID := range versions {
+		minKey, maxKey := versionKeyRange(dsetID, dataID, versionID)
+		err := s.kvGetter.ProcessRange(context.Background(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+			dataKey, ok := chunk.K.(*DataKey)
+			if !ok || dataKey.Dataset != dsetID || dataKey.Data != dataID || dataKey.Version != versionID {
+				return
+			}
+			index := string(dataKey.Index.Bytes())
+			if _, found := sums[index]; found || deleted[index] {
+				return
+			}
+			sums[index] = sha1.Sum(chunk.V)
+			if values {
+				resolved[index] = append([]byte{}, chunk.V...)
+			}
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = addTombstones(context.Background(), s.kvGetter, dsetID, dataID, versionID, nil, nil, deleted); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sums, resolved, nil
+}
+
+// DiffJSON returns JSON for the diff of the named data from one version to another.
+func (s *Service) DiffJSON(from, to dvid.UUID, dataname dvid.DataString, values bool) (string, error) {
+	diff, err := s.DiffVersions(from, to, dataname, values)
+	if err != nil {
+		return "", err
+	}
+	m, err := json.Marshal(diff)
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
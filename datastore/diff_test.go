@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestDiffVersions(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "mydata", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	_, rootVersion, err := service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+	_, childVersion, err := service.LocalIDFromUUID(child)
+	c.Assert(err, IsNil)
+
+	for _, index := range []string{"a", "b", "c", "e"} {
+		c.Assert(service.kvSetter.Put(data.DataKey(rootVersion, dvid.IndexBytes(index)), []byte(index)), IsNil)
+	}
+	c.Assert(service.kvSetter.Put(data.DataKey(childVersion, dvid.IndexBytes("b")), []byte("b")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(childVersion, dvid.IndexBytes("c")), []byte("new c")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(childVersion, dvid.IndexBytes("d")), []byte("d")), IsNil)
+
+	diff, err := service.DiffVersions(root, child, "mydata", false)
+	c.Assert(err, IsNil)
+	c.Assert(diff.Changes, DeepEquals, []DiffEntry{
+		{Index: "61", Change: DiffDeleted},
+		{Index: "63", Change: DiffModified},
+		{Index: "64", Change: DiffAdded},
+		{Index: "65", Change: DiffDeleted},
+	})
+
+	diff, err = service.DiffVersions(root, child, "mydata", true)
+	c.Assert(err, IsNil)
+	c.Assert(string(diff.Changes[1].Value), Equals, "new c")
+	c.Assert(diff.Changes[0].Value, IsNil)
+
+	diff, err = service.DiffVersions(child, child, "mydata", false)
+	c.Assert(err, IsNil)
+	c.Assert(diff.Changes, HasLen, 0)
+
+	_, err = service.DiffVersions(root, child, "nodata", false)
+	c.Assert(err, NotNil)
+}
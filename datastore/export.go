@@ -0,0 +1,227 @@
+/*
+	This file supports exporting data instances at one version into a portable tar
+	archive that another DVID server can import, e.g., to ship data to collaborators who
+	cannot reach this server.  Unlike a backup, an export holds no version history: each
+	instance's key/value pairs are those it has at the exported node, resolved from the
+	node's ancestors.
+*/
+
+package datastore
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+const (
+	// ExportFormat is the version of the archive format written by WriteExport.
+	ExportFormat = 1
+
+	// ExportManifestName is the name of the manifest file within an export archive.
+	ExportManifestName = "export.json"
+
+	// ExportMetadataName is the name of the file within an export archive holding the
+	// serialized data services of the exported instances.
+	ExportMetadataName = "metadata"
+)
+
+// ExportManifest describes an export archive.  The archive starts with the metadata
+// file, then holds the parts of each instance's stream of key/value pairs, and ends
+// with the manifest.  Each pair of a stream is the length of its index as a big-endian
+// uint32, the index, the length of its value as a big-endian uint32, and the value.
+type ExportManifest struct {
+	Format  int
+	Created time.Time
+
+	// Node is the UUID of the exported node, and Root and Alias those of its dataset.
+	Node  dvid.UUID
+	Root  dvid.UUID
+	Alias string
+
+	// Snapshot is true if all values were read from one snapshot of the store.  If
+	// false and the node is unlocked, values may have changed during the export.
+	Snapshot bool
+
+	// MetadataSHA256 is the checksum of the metadata file.
+	MetadataSHA256 string
+
+	Instances []*ExportInstance
+}
+
+// ExportInstance describes a data instance within an export archive.
+type ExportInstance struct {
+	Name        dvid.DataString
+	TypeName    dvid.TypeString
+	TypeURL     UrlString
+	TypeVersion string
+	Versioned   bool
+	Keys        int64
+	Bytes       int64
+
+	// Parts are the archive files holding the instance's stream in order.
+	Parts []BackupPart
+}
+
+// writeExportPair adds a key/value pair to an instance's stream.
+func writeExportPair(w io.Writer, index, value []byte) error {
+	var length [4]byte
+	for _, b := range [][]byte{index, value} {
+		binary.BigEndian.PutUint32(length[:], uint32(len(b)))
+		if _, err := w.Write(length[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteExport writes a tar archive holding the named data, or all data, as of the node
+// with the given UUID, followed by a manifest, which is returned.  The export reports
+// its progress through the job.
+func (s *Service) WriteExport(w io.Writer, u dvid.UUID, datanames []dvid.DataString,
+	job *Job) (*ExportManifest, error) {
+
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &ExportManifest{
+		Format:    ExportFormat,
+		Created:   time.Now(),
+		Node:      u,
+		Root:      dataset.Root,
+		Alias:     dataset.Alias,
+		Instances: []*ExportInstance{},
+	}
+	db, release, err := s.snapshot()
+	if err == nil {
+		defer release()
+		manifest.Snapshot = true
+	} else {
+		dvid.Log(dvid.Normal, "Export will read node %s while it may change: %s\n", u, err.Error())
+		db = s.kvGetter
+	}
+
+	// Select the data, sorted by name.
+	dataMap, err := dataset.cloneDataMap()
+	if err != nil {
+		return nil, err
+	}
+	if len(datanames) != 0 {
+		selected := make(map[dvid.DataString]DataService, len(datanames))
+		for _, name := range datanames {
+			data, found := dataMap[name]
+			if !found {
+				return nil, fmt.Errorf("No data '%s' in dataset %s", name, dataset.Root)
+			}
+			selected[name] = data
+		}
+		dataMap = selected
+	}
+	names := make([]string, 0, len(dataMap))
+	for name, data := range dataMap {
+		if _, ok := data.(replicableData); !ok {
+			return nil, fmt.Errorf("Data '%s' cannot be exported", name)
+		}
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	job.SetTotal(int64(len(names)))
+
+	tw := tar.NewWriter(w)
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	metadata, err := dvid.Serialize(dataMap, compression, dvid.NoChecksum)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeTarFile(tw, ExportMetadataName, metadata, manifest.Created); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(metadata)
+	manifest.MetadataSHA256 = hex.EncodeToString(sum[:])
+
+	for _, name := range names {
+		dataname := dvid.DataString(name)
+		service := dataMap[dataname]
+		instance := &ExportInstance{
+			Name:        dataname,
+			TypeName:    service.DatatypeName(),
+			TypeURL:     service.DatatypeUrl(),
+			TypeVersion: service.DatatypeVersion(),
+			Versioned:   service.IsVersioned(),
+		}
+		versions, err := s.DataVersions(u, dataname)
+		if err != nil {
+			return nil, err
+		}
+		parts := &backupPartWriter{tw: tw, prefix: "instances/" + name, modTime: manifest.Created}
+		dsetID, dataID := dataset.DatasetID, service.(replicableData).LocalID()
+
+		// Resolve each index to the first version storing it, as reads do.
+		found := make(map[string]bool)
+		for _, versionID := range versions {
+			var writeErr error
+			minKey, maxKey := versionKeyRange(dsetID, dataID, versionID)
+			err = db.ProcessRange(context.Background(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+				dataKey, ok := chunk.K.(*DataKey)
+				if writeErr != nil || !ok || dataKey.Dataset != dsetID || dataKey.Data != dataID ||
+					dataKey.Version != versionID {
+					return
+				}
+				index := dataKey.Index.Bytes()
+				if found[string(index)] {
+					return
+				}
+				found[string(index)] = true
+				writeErr = writeExportPair(parts, index, chunk.V)
+				instance.Keys++
+				instance.Bytes += int64(len(index) + len(chunk.V))
+				job.Throttle(len(index) + len(chunk.V))
+			})
+			if err != nil {
+				return nil, err
+			}
+			if writeErr != nil {
+				return nil, writeErr
+			}
+			if err = addTombstones(context.Background(), db, dsetID, dataID, versionID, nil, nil, found); err != nil {
+				return nil, err
+			}
+		}
+		if err = parts.flush(); err != nil {
+			return nil, err
+		}
+		instance.Parts = parts.parts
+		manifest.Instances = append(manifest.Instances, instance)
+		job.Advance(1)
+		job.Logf("Exported %d keys of '%s' at node %s", instance.Keys, dataname, u)
+	}
+
+	m, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = writeTarFile(tw, ExportManifestName, m, manifest.Created); err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestExport(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+	c.Assert(service.NewData(root, "testtype", "other", versioned), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), []byte("root b")), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("a")), []byte("child a")), IsNil)
+
+	_, err = service.WriteExport(ioutil.Discard, child, []dvid.DataString{"unknown"}, nil)
+	c.Assert(err, NotNil)
+
+	var buf bytes.Buffer
+	manifest, err := service.WriteExport(&buf, child, []dvid.DataString{"mydata"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Node, Equals, child)
+	c.Assert(manifest.Root, Equals, root)
+	c.Assert(manifest.Instances, HasLen, 1)
+	instance := manifest.Instances[0]
+	c.Assert(instance.Name, Equals, dvid.DataString("mydata"))
+	c.Assert(instance.TypeName, Equals, dvid.TypeString("testtype"))
+	c.Assert(instance.TypeVersion, Equals, "0.1")
+	c.Assert(instance.Versioned, Equals, true)
+	c.Assert(instance.Keys, Equals, int64(2))
+	c.Assert(instance.Parts, HasLen, 1)
+
+	// The archive holds the metadata, the values resolved at the child, and the manifest.
+	tr := tar.NewReader(&buf)
+	header, err := tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, ExportMetadataName)
+	header, err = tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, instance.Parts[0].Name)
+	part, err := ioutil.ReadAll(tr)
+	c.Assert(err, IsNil)
+	values := make(map[string]string)
+	for len(part) > 0 {
+		n := binary.BigEndian.Uint32(part)
+		index := string(part[4 : 4+n])
+		part = part[4+n:]
+		n = binary.BigEndian.Uint32(part)
+		values[index] = string(part[4 : 4+n])
+		part = part[4+n:]
+	}
+	c.Assert(values, DeepEquals, map[string]string{"a": "child a", "b": "root b"})
+	header, err = tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, ExportManifestName)
+	var stored ExportManifest
+	c.Assert(json.NewDecoder(tr).Decode(&stored), IsNil)
+	c.Assert(stored.Instances[0].Parts, DeepEquals, instance.Parts)
+}
@@ -0,0 +1,136 @@
+/*
+	This file supports forking a dataset, creating a new dataset with its own version DAG
+	that starts with the data of a node in another dataset.
+*/
+
+package datastore
+
+import (
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Forker is a data service that must adjust its properties when forked into a new
+// dataset, e.g., to reference other data within the new dataset.
+type Forker interface {
+	Forked(dsetID dvid.DatasetLocalID) error
+}
+
+// forkableData is fulfilled by any data service embedding Data.
+type forkableData interface {
+	LocalID() dvid.DataLocalID
+	setDatasetID(dsetID dvid.DatasetLocalID)
+}
+
+func (d *Data) setDatasetID(dsetID dvid.DatasetLocalID) {
+	d.DataID.DsetID = dsetID
+}
+
+// cloneDataMap returns a deep copy of this dataset's data services.
+func (dset *Dataset) cloneDataMap() (map[dvid.DataString]DataService, error) {
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	dset.mapLock.Lock()
+	serialization, err := dvid.Serialize(dset.DataMap, compression, dvid.NoChecksum)
+	dset.mapLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	dataMap := make(map[dvid.DataString]DataService)
+	if err = dvid.Deserialize(serialization, &dataMap); err != nil {
+		return nil, err
+	}
+	return dataMap, nil
+}
+
+// ForkDataset creates a new dataset whose root node holds a copy of all data at the
+// given LOCKED node of an existing dataset.  The new dataset has its own version DAG,
+// so it can be modified and branched without affecting the original dataset.  Since
+// keys are partitioned by dataset, values as read at the node, including those it
+// inherits from ancestors, are copied into the new dataset.  The
+// new dataset keeps the ACLs of the original so forking does not expose limited data.
+func (s *Service) ForkDataset(u dvid.UUID) (root dvid.UUID, err error) {
+	if s.Datasets == nil {
+		err = fmt.Errorf("Datastore service has no datasets available")
+		return
+	}
+	src, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return
+	}
+	node, found := src.Nodes[u]
+	if !found {
+		err = fmt.Errorf("No node found with UUID %s", u)
+		return
+	}
+	if !node.Locked {
+		err = fmt.Errorf("Cannot fork dataset from an unlocked node %s", u)
+		return
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return
+	}
+	dataMap, err := src.cloneDataMap()
+	if err != nil {
+		return
+	}
+	for name, data := range dataMap {
+		if _, ok := data.(forkableData); !ok {
+			err = fmt.Errorf("Data '%s' cannot be forked into a new dataset", name)
+			return
+		}
+	}
+
+	dset, err := s.Datasets.newDataset()
+	if err != nil {
+		return
+	}
+	dset.ForkedFrom = u
+	dset.Alias = src.Alias
+	dset.NewDataID = src.NewDataID
+	src.mapLock.Lock()
+	dset.ACL = src.ACL.copy()
+	for name, acl := range src.DataACLs {
+		if dset.DataACLs == nil {
+			dset.DataACLs = make(map[dvid.DataString]*ACL)
+		}
+		dset.DataACLs[name] = acl.copy()
+	}
+	src.mapLock.Unlock()
+	dset.Nodes[dset.Root].NodeText = &NodeText{Note: fmt.Sprintf("Forked from node %s", u)}
+	for _, data := range dataMap {
+		data.(forkableData).setDatasetID(dset.DatasetID)
+	}
+	dset.DataMap = dataMap
+	for name, data := range dataMap {
+		if forker, ok := data.(Forker); ok {
+			if err = forker.Forked(dset.DatasetID); err != nil {
+				return
+			}
+		}
+		var versions []dvid.VersionLocalID
+		versions, err = s.DataVersions(u, name)
+		if err != nil {
+			return
+		}
+		dataID := data.(forkableData).LocalID()
+		var numKeys int
+		numKeys, err = copyResolvedVersion(s.kvGetter, batcher, nil, src.DatasetID, dataID, versions,
+			&DataKey{dset.DatasetID, dataID, 0, nil}, nil)
+		if err != nil {
+			return
+		}
+		dvid.Log(dvid.Debug, "Forked data '%s' with %d key/value pairs from node %s\n", name, numKeys, u)
+	}
+
+	s.InvalidateMetadata()
+	if err = s.Datasets.Put(s.kvSetter); err != nil {
+		return
+	}
+	if err = dset.Put(s.kvSetter); err != nil {
+		return
+	}
+	root = dset.Root
+	return
+}
@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestForkDataset(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, dsetID, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "mydata", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("value a")), IsNil)
+
+	_, err = service.ForkDataset(root)
+	c.Assert(err, NotNil) // node is not locked
+	c.Assert(service.Lock(root), IsNil)
+	forkRoot, err := service.ForkDataset(root)
+	c.Assert(err, IsNil)
+	c.Assert(forkRoot, Not(Equals), root)
+
+	fork, err := service.DatasetFromUUID(forkRoot)
+	c.Assert(err, IsNil)
+	c.Assert(fork.ForkedFrom, Equals, root)
+	c.Assert(fork.DatasetID, Not(Equals), dsetID)
+	forkService, err := fork.DataService("mydata")
+	c.Assert(err, IsNil)
+	forkData := forkService.(*testData)
+	c.Assert(forkData.DatasetID(), Equals, fork.DatasetID)
+	c.Assert(data.DatasetID(), Equals, dsetID)
+
+	value, err := service.kvGetter.Get(forkData.DataKey(0, dvid.IndexBytes("a")))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "value a")
+
+	// The fork is independent of the original dataset.
+	forkChild, err := service.NewVersion(forkRoot)
+	c.Assert(err, NotNil) // fork root is unlocked
+	c.Assert(service.Lock(forkRoot), IsNil)
+	forkChild, err = service.NewVersion(forkRoot)
+	c.Assert(err, IsNil)
+	dset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	_, found := dset.Nodes[forkChild]
+	c.Assert(found, Equals, false)
+}
+
+func (s *DataSuite) TestForkInheritedData(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), []byte("root b")), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	versions, err := service.DataVersions(child, "mydata")
+	c.Assert(err, IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(versions[0], dvid.IndexBytes("c")), []byte("child c")), IsNil)
+	batcher, err := service.Batcher()
+	c.Assert(err, IsNil)
+	batch := batcher.NewBatch()
+	DeleteVersioned(batch, data.DataKey(versions[0], dvid.IndexBytes("b")), versions)
+	c.Assert(batch.Commit(), IsNil)
+	c.Assert(service.Lock(child), IsNil)
+
+	// The fork of the child holds the values it inherits but not those it deleted.
+	forkRoot, err := service.ForkDataset(child)
+	c.Assert(err, IsNil)
+	value, err := service.GetValue(forkRoot, "mydata", dvid.IndexBytes("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "root a")
+	value, err = service.GetValue(forkRoot, "mydata", dvid.IndexBytes("b"))
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+	value, err = service.GetValue(forkRoot, "mydata", dvid.IndexBytes("c"))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "child c")
+}
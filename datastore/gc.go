@@ -0,0 +1,233 @@
+/*
+	This file supports garbage collection of abandoned versions: key/value pairs stored at
+	version nodes that are abandoned, and not inherited by any live node, are deleted.
+*/
+
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// GCDataReport gives the versions of data that are reclaimable by garbage collection
+// and the number of key/value pairs and bytes stored at those versions.
+type GCDataReport struct {
+	Dataset  dvid.UUID
+	Name     dvid.DataString
+	Versions []dvid.UUID
+	Keys     int
+	Bytes    int64
+}
+
+// GCReport is the result of a garbage collection.  If DryRun is true, nothing was
+// deleted and the report gives what would be reclaimed.
+type GCReport struct {
+	DryRun bool
+	Data   []*GCDataReport
+	Keys   int
+	Bytes  int64
+}
+
+// AbandonVersion marks the node with the given UUID as abandoned, so data only
+// reachable from it is reclaimed by the next garbage collection.  Abandoned nodes
+// cannot have new children.
+func (s *Service) AbandonVersion(u dvid.UUID) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	node, found := dataset.Nodes[u]
+	if !found {
+		return fmt.Errorf("No node found with UUID %s", u)
+	}
+	node.writeLock.Lock()
+	node.Abandoned = true
+	node.writeLock.Unlock()
+	s.InvalidateMetadata()
+	return dataset.Put(s.kvSetter)
+}
+
+// liveNode returns true if the named data at a node must be kept.
+func (node *Node) liveNode(name dvid.DataString) bool {
+	if node.Abandoned {
+		return false
+	}
+	avail, found := node.Avail[name]
+	return !found || avail != DataDeleted
+}
+
+// reclaimableVersions returns the nodes whose key/value pairs of the named data are
+// not read by any live node, sorted by UUID.
+func (dset *Dataset) reclaimableVersions(name dvid.DataString, versioned bool) ([]dvid.UUID, error) {
+	needed := make(map[dvid.VersionLocalID]bool)
+	for u, node := range dset.Nodes {
+		if !node.liveNode(name) {
+			continue
+		}
+		if !versioned {
+			needed[node.VersionID] = true
+			continue
+		}
+		versions, err := dset.ancestry(u, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, versionID := range versions {
+			needed[versionID] = true
+		}
+	}
+	var reclaimable []dvid.UUID
+	for u, node := range dset.Nodes {
+		if !needed[node.VersionID] {
+			reclaimable = append(reclaimable, u)
+		}
+	}
+	sort.Sort(uuidsByString(reclaimable))
+	return reclaimable, nil
+}
+
+type uuidsByString []dvid.UUID
+
+func (u uuidsByString) Len() int           { return len(u) }
+func (u uuidsByString) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u uuidsByString) Less(i, j int) bool { return u[i] < u[j] }
+
+// CollectVersions deletes the key/value pairs of all data stored at versions that are
+// only reachable from abandoned nodes, or nodes where the data was deleted, and returns
+// a report of reclaimed versions, keys, and bytes per data.  If dryRun is true, nothing
+// is deleted.  Collection runs as a job with the given limits.
+func (s *Service) CollectVersions(dryRun bool, limits JobLimits) (*GCReport, error) {
+	job := StartJob("gc", gcJobName, limits)
+	defer job.Finish()
+	report, err := s.collectVersions(job, dryRun)
+	job.SetResult(report, err)
+	return report, err
+}
+
+// StartCollectVersions runs CollectVersions as a background job and returns the job,
+// whose result is the GCReport.
+func (s *Service) StartCollectVersions(dryRun bool, limits JobLimits) *Job {
+	return RunJob("gc", gcJobName, limits, func(job *Job) (interface{}, error) {
+		report, err := s.collectVersions(job, dryRun)
+		if report == nil {
+			return nil, err
+		}
+		return report, err
+	})
+}
+
+const gcJobName = "garbage collection of abandoned versions"
+
+// collectVersions does the work of CollectVersions within a job, reporting progress
+// as the data of each dataset is examined.
+func (s *Service) collectVersions(job *Job, dryRun bool) (*GCReport, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return nil, err
+	}
+
+	var numData int64
+	for _, dset := range s.Datasets.list {
+		numData += int64(len(dset.DataMap))
+	}
+	var examined int64
+
+	report := &GCReport{DryRun: dryRun, Data: []*GCDataReport{}}
+	for _, dset := range s.Datasets.list {
+		names := make([]string, 0, len(dset.DataMap))
+		for name := range dset.DataMap {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			job.Progress(examined, numData)
+			examined++
+			dataname := dvid.DataString(name)
+			data, ok := dset.DataMap[dataname].(versionedData)
+			if !ok {
+				continue
+			}
+			reclaimable, err := dset.reclaimableVersions(dataname, dset.DataMap[dataname].IsVersioned())
+			if err != nil {
+				return report, err
+			}
+			if len(reclaimable) == 0 {
+				continue
+			}
+			dataReport := &GCDataReport{Dataset: dset.Root, Name: dataname, Versions: []dvid.UUID{}}
+			dsetID, dataID := data.DatasetID(), data.LocalID()
+			for _, u := range reclaimable {
+				versionID := dset.Nodes[u].VersionID
+				selected := func(key storage.Key) bool {
+					dataKey, ok := key.(*DataKey)
+					return ok && dataKey.Dataset == dsetID && dataKey.Data == dataID && dataKey.Version == versionID
+				}
+				var numKeys int
+				minKey, maxKey := versionKeyRange(dsetID, dataID, versionID)
+				err = s.kvGetter.ProcessRange(job.Context(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+					job.Throttle(len(chunk.K.Bytes()) + len(chunk.V))
+					if selected(chunk.K) {
+						numKeys++
+						dataReport.Bytes += int64(len(chunk.K.Bytes()) + len(chunk.V))
+					}
+				})
+				if err != nil {
+					return report, err
+				}
+				if numKeys == 0 {
+					continue
+				}
+				dataReport.Versions = append(dataReport.Versions, u)
+				dataReport.Keys += numKeys
+				if dryRun {
+					continue
+				}
+				if _, err = deleteKeyRange(s.kvGetter, batcher, job, minKey, maxKey, selected); err != nil {
+					return report, err
+				}
+				selectedTombstone := func(key storage.Key) bool {
+					tombstone, ok := key.(*TombstoneKey)
+					return ok && tombstone.Dataset == dsetID && tombstone.Data == dataID && tombstone.Version == versionID
+				}
+				_, err = deleteKeyRange(s.kvGetter, batcher, job, minKey.Tombstone(), maxKey.Tombstone(), selectedTombstone)
+				if err != nil {
+					return report, err
+				}
+			}
+			if dataReport.Keys == 0 {
+				continue
+			}
+			job.Logf("Reclaimed %d keys (%d bytes) of '%s' in dataset %s", dataReport.Keys,
+				dataReport.Bytes, dataname, dset.Root)
+			report.Data = append(report.Data, dataReport)
+			report.Keys += dataReport.Keys
+			report.Bytes += dataReport.Bytes
+		}
+	}
+	job.Progress(numData, numData)
+	return report, nil
+}
+
+// CollectVersionsJSON returns JSON for the report of CollectVersions.
+func (s *Service) CollectVersionsJSON(dryRun bool, limits JobLimits) (string, error) {
+	report, err := s.CollectVersions(dryRun, limits)
+	if err != nil {
+		return "", err
+	}
+	m, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
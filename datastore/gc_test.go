@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"fmt"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestCollectVersions(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", config), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+
+	// Abandon an exploratory branch whose locked node has a live child, and a leaf.
+	c.Assert(service.Lock(root), IsNil)
+	explore, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(service.Lock(explore), IsNil)
+	live, err := service.NewVersion(explore)
+	c.Assert(err, IsNil)
+	leaf, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	for i, u := range []dvid.UUID{root, explore, live, leaf} {
+		_, versionID, err := service.LocalIDFromUUID(u)
+		c.Assert(err, IsNil)
+		key := data.DataKey(versionID, dvid.IndexBytes("a"))
+		c.Assert(service.kvSetter.Put(key, []byte(fmt.Sprintf("value %d", i))), IsNil)
+	}
+	c.Assert(service.AbandonVersion(explore), IsNil)
+	c.Assert(service.AbandonVersion(leaf), IsNil)
+	_, err = service.NewVersion(explore)
+	c.Assert(err, NotNil)
+
+	report, err := service.CollectVersions(true, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(report.DryRun, Equals, true)
+	c.Assert(report.Data, HasLen, 1)
+	c.Assert(report.Data[0].Versions, DeepEquals, []dvid.UUID{leaf})
+	c.Assert(report.Keys, Equals, 1)
+	c.Assert(report.Bytes > 0, Equals, true)
+
+	report, err = service.CollectVersions(false, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Keys, Equals, 1)
+	_, leafVersion, err := service.LocalIDFromUUID(leaf)
+	c.Assert(err, IsNil)
+	value, err := service.kvGetter.Get(data.DataKey(leafVersion, dvid.IndexBytes("a")))
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+	_, exploreVersion, err := service.LocalIDFromUUID(explore)
+	c.Assert(err, IsNil)
+	value, err = service.kvGetter.Get(data.DataKey(exploreVersion, dvid.IndexBytes("a")))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "value 1")
+
+	// Once the child is abandoned too, the whole branch is reclaimed.
+	c.Assert(service.AbandonVersion(live), IsNil)
+	report, err = service.CollectVersions(false, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Keys, Equals, 2)
+	report, err = service.CollectVersions(true, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Data, HasLen, 0)
+}
@@ -0,0 +1,397 @@
+/*
+	This file supports hooks that run when a node is committed, a node is created by
+	branching or merging, or data is mutated, e.g., to trigger regeneration of derived
+	data downstream.  Hooks are either functions registered in-process or webhooks
+	configured per dataset, which receive events as JSON via HTTP POST.  Events are
+	posted to each webhook in order from a bounded queue, and failed posts are retried.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// HookType is the kind of event that triggers hooks.
+type HookType string
+
+const (
+	// HookCommit is triggered when a node is locked.
+	HookCommit HookType = "commit"
+
+	// HookBranch is triggered when a child node is created.
+	HookBranch HookType = "branch"
+
+	// HookMerge is triggered when a node merging other nodes is created.
+	HookMerge HookType = "merge"
+
+	// HookMutation is triggered when data is written at a node.
+	HookMutation HookType = "mutation"
+)
+
+// HookTypes lists all hook types.
+var HookTypes = []HookType{HookCommit, HookBranch, HookMerge, HookMutation}
+
+// WebHookTimeout is the time allowed for a webhook to accept an event.
+const WebHookTimeout = 10 * time.Second
+
+// WebHookQueueSize is the number of events held for a webhook while earlier events are
+// posted.  Events for a webhook with a full queue are dropped.
+const WebHookQueueSize = 1000
+
+// WebHookRetries is the number of times a failed post of an event is retried.
+const WebHookRetries = 3
+
+// webHookRetryDelay is the wait before the first retry of a post, doubled for each
+// later retry.
+var webHookRetryDelay = time.Second
+
+// PrivateWebHooks allows webhooks at loopback, private, and link-local addresses.  They
+// are refused by default so webhooks cannot reach services inside the server's network.
+var PrivateWebHooks bool
+
+// HookEvent describes the event passed to hooks.  Node is the node committed, created,
+// or whose data was mutated.
+type HookEvent struct {
+	Type    HookType
+	Node    dvid.UUID
+	Parents []dvid.UUID     `json:",omitempty"`
+	Name    dvid.DataString `json:",omitempty"`
+	Author  string          `json:",omitempty"`
+	Message string          `json:",omitempty"`
+	Time    time.Time
+}
+
+// HookFunc is a hook registered in-process.  Hooks are called synchronously by the
+// code triggering the event, so they must return quickly, e.g., by starting a goroutine
+// for slow work.
+type HookFunc func(*HookEvent)
+
+type hookEntry struct {
+	hookType HookType
+	f        HookFunc
+}
+
+// hookRegistry holds the in-process hooks of a service and the queues of events posted
+// to webhooks.
+type hookRegistry struct {
+	sync.RWMutex
+	nextID int
+	hooks  map[int]hookEntry
+
+	queueLock sync.Mutex
+	queues    map[string]chan []byte
+	stop      chan struct{}
+	stopped   bool
+}
+
+// AddHook registers a function called on events of the given type and returns an ID
+// for removing it.
+func (s *Service) AddHook(hookType HookType, f HookFunc) int {
+	registry := &s.hooks
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.hooks == nil {
+		registry.hooks = make(map[int]hookEntry)
+	}
+	registry.nextID++
+	registry.hooks[registry.nextID] = hookEntry{hookType, f}
+	return registry.nextID
+}
+
+// RemoveHook removes the in-process hook with the given ID.
+func (s *Service) RemoveHook(id int) {
+	registry := &s.hooks
+	registry.Lock()
+	delete(registry.hooks, id)
+	registry.Unlock()
+}
+
+// WebHook is a URL that receives events of the given types in a dataset.
+type WebHook struct {
+	URL   string
+	Types []HookType
+}
+
+// handles returns true if the webhook receives events of the given type.
+func (hook *WebHook) handles(hookType HookType) bool {
+	for _, t := range hook.Types {
+		if t == hookType {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseHookType returns the hook type with the given name.
+func ParseHookType(name string) (HookType, error) {
+	for _, t := range HookTypes {
+		if string(t) == name {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown hook type '%s': use %v", name, HookTypes)
+}
+
+// AddWebHook configures a URL to receive events of the given types in the dataset with
+// the given UUID, replacing any webhook with the same URL.
+func (s *Service) AddWebHook(u dvid.UUID, url string, types []HookType) error {
+	if len(types) == 0 {
+		return fmt.Errorf("Webhook %s must receive at least one type of event", url)
+	}
+	if err := checkWebHookURL(url); err != nil {
+		return err
+	}
+	return s.setWebHook(u, url, &WebHook{URL: url, Types: append([]HookType{}, types...)})
+}
+
+// checkWebHookURL returns an error unless a webhook URL is an http or https URL whose
+// host, if given as an address, may receive webhooks.  Addresses of named hosts are
+// checked when each event is posted.
+func checkWebHookURL(rawurl string) error {
+	parsed, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("Bad webhook URL %s: %s", rawurl, err.Error())
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("Webhook URL %s must use http or https", rawurl)
+	}
+	host := parsed.Hostname()
+	if host == "" {
+		return fmt.Errorf("Webhook URL %s has no host", rawurl)
+	}
+	if ip := net.ParseIP(host); ip != nil && !webHookAddress(ip) {
+		return fmt.Errorf("Webhook URL %s is at a loopback, private, or link-local address", rawurl)
+	}
+	return nil
+}
+
+// webHookAddress returns true if webhooks may be posted to an IP address.
+func webHookAddress(ip net.IP) bool {
+	if PrivateWebHooks {
+		return true
+	}
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified()
+}
+
+// RemoveWebHook removes the webhook with the given URL from the dataset with the given
+// UUID.
+func (s *Service) RemoveWebHook(u dvid.UUID, url string) error {
+	return s.setWebHook(u, url, nil)
+}
+
+func (s *Service) setWebHook(u dvid.UUID, url string, hook *WebHook) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	dataset.mapLock.Lock()
+	var hooks []*WebHook
+	var found bool
+	for _, existing := range dataset.WebHooks {
+		if existing.URL == url {
+			found = true
+		} else {
+			hooks = append(hooks, existing)
+		}
+	}
+	if hook == nil && !found {
+		dataset.mapLock.Unlock()
+		return fmt.Errorf("No webhook %s in dataset with node %s", url, u)
+	}
+	if hook != nil {
+		hooks = append(hooks, hook)
+	}
+	dataset.WebHooks = hooks
+	dataset.mapLock.Unlock()
+	s.InvalidateMetadata()
+	return dataset.Put(s.kvSetter)
+}
+
+type webHooksByURL []*WebHook
+
+func (h webHooksByURL) Len() int           { return len(h) }
+func (h webHooksByURL) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h webHooksByURL) Less(i, j int) bool { return h[i].URL < h[j].URL }
+
+// WebHooksJSON returns JSON listing the webhooks of the dataset with the given UUID.
+func (s *Service) WebHooksJSON(u dvid.UUID) (string, error) {
+	if s.Datasets == nil {
+		return "[]", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return "[]", err
+	}
+	dataset.mapLock.Lock()
+	hooks := append([]*WebHook{}, dataset.WebHooks...)
+	dataset.mapLock.Unlock()
+	sort.Sort(webHooksByURL(hooks))
+	m, err := json.Marshal(hooks)
+	if err != nil {
+		return "[]", err
+	}
+	return string(m), nil
+}
+
+// runHooks calls the in-process hooks for an event and posts it to the webhooks of
+// the event node's dataset in the background.
+func (s *Service) runHooks(event *HookEvent) {
+	event.Time = time.Now()
+	registry := &s.hooks
+	registry.RLock()
+	for _, entry := range registry.hooks {
+		if entry.hookType == event.Type {
+			entry.f(event)
+		}
+	}
+	registry.RUnlock()
+
+	if s.Datasets == nil {
+		return
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(event.Node)
+	if err != nil {
+		return
+	}
+	dataset.mapLock.Lock()
+	var urls []string
+	for _, hook := range dataset.WebHooks {
+		if hook.handles(event.Type) {
+			urls = append(urls, hook.URL)
+		}
+	}
+	dataset.mapLock.Unlock()
+	if len(urls) == 0 {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		dvid.Log(dvid.Normal, "Unable to encode %s event for webhooks: %s\n", event.Type, err.Error())
+		return
+	}
+	for _, url := range urls {
+		registry.enqueue(url, body)
+	}
+}
+
+// enqueue adds an event to the queue of a webhook, starting the queue's poster on the
+// first event.  The event is dropped if the queue is full.
+func (registry *hookRegistry) enqueue(url string, body []byte) {
+	registry.queueLock.Lock()
+	if registry.stopped {
+		registry.queueLock.Unlock()
+		return
+	}
+	if registry.queues == nil {
+		registry.queues = make(map[string]chan []byte)
+		registry.stop = make(chan struct{})
+	}
+	queue, found := registry.queues[url]
+	if !found {
+		queue = make(chan []byte, WebHookQueueSize)
+		registry.queues[url] = queue
+		go postWebHooks(url, queue, registry.stop)
+	}
+	registry.queueLock.Unlock()
+
+	select {
+	case queue <- body:
+	default:
+		dvid.Log(dvid.Normal, "Dropped event for webhook %s: %d events are already queued\n",
+			url, WebHookQueueSize)
+	}
+}
+
+// stopWebHooks stops posting queued events to webhooks.
+func (registry *hookRegistry) stopWebHooks() {
+	registry.queueLock.Lock()
+	defer registry.queueLock.Unlock()
+	if !registry.stopped && registry.stop != nil {
+		close(registry.stop)
+	}
+	registry.stopped = true
+}
+
+// postWebHooks posts the queued events of a webhook in order until stopped, retrying
+// each failed post with increasing delays.
+func postWebHooks(url string, queue chan []byte, stop chan struct{}) {
+	for {
+		var body []byte
+		select {
+		case body = <-queue:
+		case <-stop:
+			return
+		}
+		delay := webHookRetryDelay
+		for attempt := 0; ; attempt++ {
+			retry, err := postWebHook(url, body)
+			if err == nil {
+				break
+			}
+			if !retry || attempt == WebHookRetries {
+				dvid.Log(dvid.Normal, "Dropped event for webhook %s after %d attempts: %s\n",
+					url, attempt+1, err.Error())
+				break
+			}
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+			delay *= 2
+		}
+	}
+}
+
+// webHookClient posts events only to addresses allowed for webhooks, checked when each
+// connection is made, so redirects and changes of DNS cannot reach other addresses.
+var webHookClient = &http.Client{
+	Timeout: WebHookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: WebHookTimeout,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !webHookAddress(ip) {
+					return fmt.Errorf("Webhooks cannot be posted to address %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: WebHookTimeout,
+	},
+}
+
+// postWebHook posts a JSON-encoded event to a webhook.  Returns whether a failed post
+// should be retried, which is the case unless the webhook rejected the event.
+func postWebHook(url string, body []byte) (retry bool, err error) {
+	resp, err := webHookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("Webhook rejected event with status %s", resp.Status)
+	}
+	return false, nil
+}
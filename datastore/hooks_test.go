@@ -0,0 +1,137 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestHooks(c *C) {
+	dir := c.MkDir()
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+	defer service.Shutdown()
+
+	var events []*HookEvent
+	record := func(event *HookEvent) { events = append(events, event) }
+	for _, hookType := range []HookType{HookCommit, HookBranch, HookMerge} {
+		id := service.AddHook(hookType, record)
+		defer service.RemoveHook(id)
+	}
+
+	posted := make(chan *HookEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := new(HookEvent)
+		if err := json.NewDecoder(r.Body).Decode(event); err == nil {
+			posted <- event
+		}
+	}))
+	defer server.Close()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.AddWebHook(root, server.URL, []HookType{HookCommit}), NotNil)
+	c.Assert(service.AddWebHook(root, "ftp://example.com/events", []HookType{HookCommit}), NotNil)
+	c.Assert(service.AddWebHook(root, "http://169.254.169.254/", []HookType{HookCommit}), NotNil)
+	PrivateWebHooks = true
+	defer func() { PrivateWebHooks = false }()
+	c.Assert(service.AddWebHook(root, server.URL, []HookType{HookCommit}), IsNil)
+	c.Assert(service.AddWebHook(root, "http://example.com/unused", nil), NotNil)
+	jsonStr, err := service.WebHooksJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, fmt.Sprintf(`[{"URL":%q,"Types":["commit"]}]`, server.URL))
+
+	c.Assert(service.Commit(root, CommitInfo{Author: "alice"}), IsNil)
+	c.Assert(service.Commit(root, CommitInfo{Message: "relabeled"}), IsNil) // already locked
+	a, err := service.NewVersionWithInfo(root, CommitInfo{Author: "bob"})
+	c.Assert(err, IsNil)
+	b, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(service.Lock(a), IsNil)
+	c.Assert(service.Lock(b), IsNil)
+	merged, err := service.MergeVersions([]dvid.UUID{a, b})
+	c.Assert(err, IsNil)
+
+	c.Assert(events, HasLen, 6)
+	c.Assert(events[0].Type, Equals, HookCommit)
+	c.Assert(events[0].Node, Equals, root)
+	c.Assert(events[0].Author, Equals, "alice")
+	c.Assert(events[1].Type, Equals, HookBranch)
+	c.Assert(events[1].Node, Equals, a)
+	c.Assert(events[1].Parents, DeepEquals, []dvid.UUID{root})
+	c.Assert(events[1].Author, Equals, "bob")
+	c.Assert(events[5].Type, Equals, HookMerge)
+	c.Assert(events[5].Node, Equals, merged)
+	c.Assert(events[5].Parents, DeepEquals, []dvid.UUID{a, b})
+
+	// Only commits are posted to the webhook.
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-posted:
+			c.Assert(event.Type, Equals, HookCommit)
+		case <-time.After(WebHookTimeout):
+			c.Fatalf("Webhook did not receive commit event %d", i)
+		}
+	}
+	c.Assert(service.RemoveWebHook(root, server.URL), IsNil)
+	c.Assert(service.RemoveWebHook(root, server.URL), NotNil)
+}
+
+func (s *DataSuite) TestWebHookRetries(c *C) {
+	dir := c.MkDir()
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+	defer service.Shutdown()
+
+	PrivateWebHooks = true
+	delay := webHookRetryDelay
+	webHookRetryDelay = time.Millisecond
+	defer func() {
+		PrivateWebHooks = false
+		webHookRetryDelay = delay
+	}()
+
+	// The first post fails, so the first event is retried before the second is posted.
+	posted := make(chan *HookEvent, 10)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		event := new(HookEvent)
+		if err := json.NewDecoder(r.Body).Decode(event); err == nil {
+			posted <- event
+		}
+	}))
+	defer server.Close()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.AddWebHook(root, server.URL, []HookType{HookCommit, HookBranch}), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+
+	for _, expected := range []*HookEvent{{Type: HookCommit, Node: root}, {Type: HookBranch, Node: child}} {
+		select {
+		case event := <-posted:
+			c.Assert(event.Type, Equals, expected.Type)
+			c.Assert(event.Node, Equals, expected.Node)
+		case <-time.After(WebHookTimeout):
+			c.Fatalf("Webhook did not receive %s event", expected.Type)
+		}
+	}
+	c.Assert(requests, Equals, 3)
+}
@@ -0,0 +1,226 @@
+/*
+	This file supports importing export archives written by WriteExport, either as a new
+	dataset whose root node holds the imported data or grafted onto an unlocked node of
+	an existing dataset.  Imported data get local IDs of this datastore, and types must
+	be compiled into this server with versions compatible with the exporting server's.
+*/
+
+package datastore
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// ImportResult describes data imported from an export archive.
+type ImportResult struct {
+	// Root is the root of the dataset holding the imported data, and Node the node
+	// whose version holds their values.
+	Root dvid.UUID
+	Node dvid.UUID
+
+	Data []dvid.DataString
+	Keys int
+}
+
+// ReadExportManifest returns the manifest of an export archive and leaves the archive
+// positioned at its start.
+func ReadExportManifest(r io.ReadSeeker) (*ExportManifest, error) {
+	manifest := new(ExportManifest)
+	if err := readArchiveManifest(r, ExportManifestName, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Format != ExportFormat {
+		return nil, fmt.Errorf("Export archive has format %d but this server reads format %d",
+			manifest.Format, ExportFormat)
+	}
+	return manifest, nil
+}
+
+// checkImportTypes returns an error if the type of an exported instance is not compiled
+// into this server or its version is incompatible.
+func checkImportTypes(manifest *ExportManifest) error {
+	for _, instance := range manifest.Instances {
+		compiled, found := CompiledTypes[instance.TypeURL]
+		if !found {
+			return fmt.Errorf("Data '%s' has type %s (%s), which is not compiled into this server",
+				instance.Name, instance.TypeName, instance.TypeURL)
+		}
+		if !CompatibleVersions(instance.TypeVersion, compiled.DatatypeVersion()) {
+			return fmt.Errorf("Data '%s' has type %s version %s, which this server's version %s cannot read",
+				instance.Name, instance.TypeName, instance.TypeVersion, compiled.DatatypeVersion())
+		}
+	}
+	return nil
+}
+
+// exportPairReader reads the key/value pairs of an instance's stream.
+type exportPairReader struct {
+	r *bufio.Reader
+}
+
+// next returns the next pair, or io.EOF if the stream has ended.
+func (pr *exportPairReader) next() (index, value []byte, err error) {
+	if index, err = pr.read(); err != nil {
+		return
+	}
+	if value, err = pr.read(); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// read returns the next length-prefixed bytes of the stream.
+func (pr *exportPairReader) read() ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(pr.r, length[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(pr.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// ImportExport imports the data of an export archive, reporting its progress through
+// the job.  If u is empty, a new dataset is created whose unlocked root holds the data.
+// Otherwise the data are added to the unlocked node with that UUID, which must not
+// already have data with the same names.  Nothing is imported if the archive is corrupt.
+func (s *Service) ImportExport(r io.ReadSeeker, u dvid.UUID, job *Job) (*ImportResult, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	manifest, err := ReadExportManifest(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkImportTypes(manifest); err != nil {
+		return nil, err
+	}
+
+	// Read the metadata of the exported instances.
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read export archive: %s", err.Error())
+	}
+	if header.Name != ExportMetadataName {
+		return nil, fmt.Errorf("Export archive starts with %s instead of its metadata", header.Name)
+	}
+	metadata, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(metadata)
+	if hex.EncodeToString(sum[:]) != manifest.MetadataSHA256 {
+		return nil, fmt.Errorf("Metadata of export archive is corrupt: its checksum does not match the manifest")
+	}
+	dataMap := make(map[dvid.DataString]DataService)
+	if err = dvid.Deserialize(metadata, &dataMap); err != nil {
+		return nil, err
+	}
+	result := &ImportResult{Node: u}
+	for _, instance := range manifest.Instances {
+		if _, found := dataMap[instance.Name]; !found {
+			return nil, fmt.Errorf("Metadata of export archive lacks data '%s'", instance.Name)
+		}
+		result.Data = append(result.Data, instance.Name)
+	}
+	if len(dataMap) != len(manifest.Instances) {
+		return nil, fmt.Errorf("Metadata of export archive holds data missing from its manifest")
+	}
+
+	// Add a new dataset or graft onto an existing node.
+	repHeader := &replicationHeader{Format: ReplicationFormat, DataMap: metadata}
+	if u == "" {
+		t := time.Now()
+		result.Node = dvid.NewUUID()
+		repHeader.Root = result.Node
+		repHeader.Alias = manifest.Alias
+		repHeader.Nodes = []replicatedNode{{
+			Version: &NodeVersion{
+				GlobalID: result.Node,
+				Message:  fmt.Sprintf("Imported from node %s of dataset %s", manifest.Node, manifest.Root),
+				Created:  t,
+				Updated:  t,
+			},
+		}}
+	} else {
+		dataset, err := s.Datasets.DatasetFromUUID(u)
+		if err != nil {
+			return nil, err
+		}
+		node, err := dataset.node(u)
+		if err != nil {
+			return nil, err
+		}
+		if node.Locked {
+			return nil, fmt.Errorf("Cannot import into locked node %s", u)
+		}
+		for _, instance := range manifest.Instances {
+			if _, err := dataset.DataService(instance.Name); err == nil {
+				return nil, fmt.Errorf("Dataset %s already has data '%s'", dataset.Root, instance.Name)
+			}
+		}
+		repHeader.Root = dataset.Root
+	}
+	result.Root = repHeader.Root
+
+	var total int64
+	for _, instance := range manifest.Instances {
+		for _, part := range instance.Parts {
+			total += part.Bytes
+		}
+	}
+	job.SetTotal(total)
+
+	// Pass the pairs of each instance in turn, ending with an empty pair.
+	var instanceNum int
+	var pairs *exportPairReader
+	var numKeys int64
+	next := func() (*replicatedKeyValue, error) {
+		for instanceNum < len(manifest.Instances) {
+			instance := manifest.Instances[instanceNum]
+			if pairs == nil {
+				parts := &backupPartsReader{tr: tr, parts: instance.Parts, job: job}
+				pairs = &exportPairReader{bufio.NewReader(parts)}
+				numKeys = 0
+			}
+			index, value, err := pairs.next()
+			if err == io.EOF {
+				if numKeys != instance.Keys {
+					return nil, fmt.Errorf("Export archive holds %d keys of data '%s' but its manifest lists %d",
+						numKeys, instance.Name, instance.Keys)
+				}
+				job.Logf("Imported %d keys of '%s'", numKeys, instance.Name)
+				instanceNum++
+				pairs = nil
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read data '%s' from export archive: %s", instance.Name, err.Error())
+			}
+			numKeys++
+			return &replicatedKeyValue{Data: instance.Name, Node: result.Node, Index: index, Value: value}, nil
+		}
+		return &replicatedKeyValue{}, nil
+	}
+	_, result.Keys, err = s.storeReplication(repHeader, next)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestImportExport(c *C) {
+	source, _, done := openTestService(c)
+	defer done()
+	dest, _, destDone := openTestService(c)
+	defer destDone()
+
+	root, _, err := source.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(source.NewData(root, "testtype", "mydata", versioned), IsNil)
+	dataservice, err := source.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(source.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(source.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), []byte("root b")), IsNil)
+	c.Assert(source.Lock(root), IsNil)
+	child, err := source.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(source.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("a")), []byte("child a")), IsNil)
+	var buf bytes.Buffer
+	_, err = source.WriteExport(&buf, child, nil, nil)
+	c.Assert(err, IsNil)
+	archive := buf.Bytes()
+
+	// The destination holds other data, so local IDs differ from the source's.
+	destRoot, _, err := dest.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(dest.NewData(destRoot, "testtype", "local", versioned), IsNil)
+
+	resolve := func(u dvid.UUID) map[string]string {
+		dataservice, err := dest.DataServiceByUUID(u, "mydata")
+		c.Assert(err, IsNil)
+		versions, err := dest.DataVersions(u, "mydata")
+		c.Assert(err, IsNil)
+		keyvalues, err := GetVersionedRange(context.Background(), dest.kvGetter, *dataservice.(*testData).DataID,
+			versions, dvid.IndexBytes("a"), dvid.IndexBytes("z"))
+		c.Assert(err, IsNil)
+		values := make(map[string]string)
+		for _, kv := range keyvalues {
+			values[string(kv.K.(*DataKey).Index.Bytes())] = string(kv.V)
+		}
+		return values
+	}
+
+	// Import as a new dataset.
+	result, err := dest.ImportExport(bytes.NewReader(archive), "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(result.Root, Equals, result.Node)
+	c.Assert(result.Root, Not(Equals), root)
+	c.Assert(result.Data, DeepEquals, []dvid.DataString{"mydata"})
+	c.Assert(result.Keys, Equals, 2)
+	c.Assert(resolve(result.Node), DeepEquals, map[string]string{"a": "child a", "b": "root b"})
+
+	// Graft onto an unlocked node of an existing dataset.
+	result, err = dest.ImportExport(bytes.NewReader(archive), destRoot, nil)
+	c.Assert(err, IsNil)
+	c.Assert(result.Root, Equals, destRoot)
+	c.Assert(resolve(destRoot), DeepEquals, map[string]string{"a": "child a", "b": "root b"})
+	_, err = dest.ImportExport(bytes.NewReader(archive), destRoot, nil)
+	c.Assert(err, NotNil) // data already exist
+	c.Assert(dest.Lock(destRoot), IsNil)
+	destChild, err := dest.NewVersion(destRoot)
+	c.Assert(err, IsNil)
+	c.Assert(dest.Lock(destChild), IsNil)
+	_, err = dest.ImportExport(bytes.NewReader(archive), destChild, nil)
+	c.Assert(err, NotNil) // locked node
+
+	// Incompatible types and corrupt archives import nothing.
+	numDatasets := len(dest.Datasets.list)
+	compiled := CompiledTypes["example.com/testtype"]
+	CompiledTypes["example.com/testtype"] = &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype",
+		"example.com/testtype", "0.0")}}
+	_, err = dest.ImportExport(bytes.NewReader(archive), "", nil)
+	c.Assert(err, NotNil)
+	CompiledTypes["example.com/testtype"] = compiled
+	manifest, err := ReadExportManifest(bytes.NewReader(archive))
+	c.Assert(err, IsNil)
+	var corrupt bytes.Buffer
+	tr, tw := tar.NewReader(bytes.NewReader(archive)), tar.NewWriter(&corrupt)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		contents, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+		if header.Name == manifest.Instances[0].Parts[0].Name {
+			contents[len(contents)-1] ^= 0xff
+		}
+		c.Assert(tw.WriteHeader(header), IsNil)
+		_, err = tw.Write(contents)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	_, err = dest.ImportExport(bytes.NewReader(corrupt.Bytes()), "", nil)
+	c.Assert(err, NotNil)
+	c.Assert(dest.Datasets.list, HasLen, numDatasets)
+}
@@ -0,0 +1,121 @@
+/*
+	This file supports an invalidation bus: when values of data change at a version node,
+	an invalidation is published to subscribers such as block and tile caches, so they
+	stop serving stale values.
+*/
+
+package datastore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Invalidation announces that values of data at a version node have changed.  If
+// Indices is nil, all values of the data at the node may have changed.
+type Invalidation struct {
+	Name    dvid.DataString
+	Version dvid.UUID
+	Indices []dvid.Index
+}
+
+// MarshalJSON encodes the indices of an invalidation as hexadecimal strings.
+func (inv *Invalidation) MarshalJSON() ([]byte, error) {
+	var indices []string
+	if inv.Indices != nil {
+		indices = make([]string, len(inv.Indices))
+		for i, index := range inv.Indices {
+			indices[i] = hex.EncodeToString(index.Bytes())
+		}
+	}
+	return json.Marshal(struct {
+		Name    dvid.DataString
+		Version dvid.UUID
+		Indices []string
+	}{inv.Name, inv.Version, indices})
+}
+
+// InvalidationHandler receives published invalidations.  Handlers are called
+// synchronously by the publisher, so they must return quickly and must not publish
+// invalidations themselves.
+type InvalidationHandler func(*Invalidation)
+
+// invalidationBus holds the invalidation handlers of a service and counts the
+// mutations of each data instance.
+type invalidationBus struct {
+	sync.RWMutex
+	nextID   int
+	handlers map[int]InvalidationHandler
+
+	mutationLock sync.Mutex
+	mutations    map[mutationKey]uint64
+}
+
+// mutationKey identifies data across the datasets of a service.
+type mutationKey struct {
+	dataset dvid.DatasetLocalID
+	name    dvid.DataString
+}
+
+// dataMutationKey returns the key of a data service's mutation count.
+func dataMutationKey(dataservice DataService) mutationKey {
+	key := mutationKey{name: dataservice.DataName()}
+	if data, ok := dataservice.(versionedData); ok {
+		key.dataset = data.DatasetID()
+	}
+	return key
+}
+
+// MutationID returns the number of invalidations of the data since the service was
+// opened.  It changes whenever values of the data at any version may have changed.
+func (s *Service) MutationID(dataservice DataService) uint64 {
+	bus := &s.invalidations
+	bus.mutationLock.Lock()
+	defer bus.mutationLock.Unlock()
+	return bus.mutations[dataMutationKey(dataservice)]
+}
+
+// SubscribeInvalidations registers a handler for all invalidations published by this
+// service and returns an ID for unsubscribing.
+func (s *Service) SubscribeInvalidations(handler InvalidationHandler) int {
+	bus := &s.invalidations
+	bus.Lock()
+	defer bus.Unlock()
+	if bus.handlers == nil {
+		bus.handlers = make(map[int]InvalidationHandler)
+	}
+	bus.nextID++
+	bus.handlers[bus.nextID] = handler
+	return bus.nextID
+}
+
+// UnsubscribeInvalidations removes the handler with the given subscription ID.
+func (s *Service) UnsubscribeInvalidations(id int) {
+	bus := &s.invalidations
+	bus.Lock()
+	delete(bus.handlers, id)
+	bus.Unlock()
+}
+
+// Invalidate publishes an invalidation of values of data at the node with the given
+// UUID and runs mutation hooks.  Datatypes call it after writes have been stored.  A
+// nil indices invalidates all values of the data at the node.
+func (s *Service) Invalidate(dataservice DataService, u dvid.UUID, indices []dvid.Index) {
+	inv := &Invalidation{Name: dataservice.DataName(), Version: u, Indices: indices}
+	bus := &s.invalidations
+	bus.mutationLock.Lock()
+	if bus.mutations == nil {
+		bus.mutations = make(map[mutationKey]uint64)
+	}
+	bus.mutations[dataMutationKey(dataservice)]++
+	bus.mutationLock.Unlock()
+	bus.RLock()
+	for _, handler := range bus.handlers {
+		handler(inv)
+	}
+	bus.RUnlock()
+	s.runHooks(&HookEvent{Type: HookMutation, Node: u, Name: inv.Name})
+}
@@ -0,0 +1,36 @@
+package datastore
+
+import (
+	"encoding/json"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestInvalidations(c *C) {
+	data := &testData{&Data{DataID: &DataID{Name: "mydata"}}}
+	var first, second []*Invalidation
+	id1 := s.service.SubscribeInvalidations(func(inv *Invalidation) { first = append(first, inv) })
+	id2 := s.service.SubscribeInvalidations(func(inv *Invalidation) { second = append(second, inv) })
+	c.Assert(id1, Not(Equals), id2)
+
+	before := s.service.MutationID(data)
+	s.service.Invalidate(data, "abc", []dvid.Index{dvid.IndexBytes("a"), dvid.IndexBytes("b")})
+	s.service.UnsubscribeInvalidations(id1)
+	s.service.Invalidate(data, "abc", nil)
+	s.service.UnsubscribeInvalidations(id2)
+	c.Assert(s.service.MutationID(data), Equals, before+2)
+	other := &testData{&Data{DataID: &DataID{Name: "otherdata"}}}
+	c.Assert(s.service.MutationID(other), Equals, uint64(0))
+	c.Assert(first, HasLen, 1)
+	c.Assert(second, HasLen, 2)
+	c.Assert(second[1].Indices, IsNil)
+
+	m, err := json.Marshal(first[0])
+	c.Assert(err, IsNil)
+	c.Assert(string(m), Equals, `{"Name":"mydata","Version":"abc","Indices":["61","62"]}`)
+	m, err = json.Marshal(second[1])
+	c.Assert(err, IsNil)
+	c.Assert(string(m), Equals, `{"Name":"mydata","Version":"abc","Indices":null}`)
+}
@@ -0,0 +1,566 @@
+/*
+	This file supports throttling of background jobs like tile generation, garbage
+	collection, and surface computation.  Each job is assigned a number of CPU workers
+	and an I/O rate limit when submitted, and both can be adjusted while the job runs so
+	interactive requests stay responsive during maintenance.
+
+	Jobs also report their progress and log lines, which clients can follow as events
+	instead of blocking on a long request, and finished jobs are kept for a while so
+	their results can be retrieved.  At shutdown, running jobs are cancelled: their
+	contexts are done, and workers and throttled I/O stop waiting.
+*/
+
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// JobLimits are the resources a background job may use.
+type JobLimits struct {
+	// Workers is the maximum number of concurrent workers.  If 0, the job may use as
+	// many workers as there are CPUs available to DVID.
+	Workers int
+
+	// IORate is the maximum rate of I/O in bytes per second.  If 0, I/O is unlimited.
+	IORate float64
+}
+
+// JobLimitsFromConfig returns job limits from the "workers" and "iorate" settings,
+// where "iorate" is given in megabytes per second.
+func JobLimitsFromConfig(config dvid.Config) (limits JobLimits, err error) {
+	var found bool
+	limits.Workers, found, err = config.GetInt("workers")
+	if err != nil {
+		return limits, fmt.Errorf("Illegal 'workers' setting: %s", err.Error())
+	}
+	if found && limits.Workers < 1 {
+		return limits, fmt.Errorf("Jobs must have at least 1 worker, not %d", limits.Workers)
+	}
+	rateStr, found, err := config.GetString("iorate")
+	if err != nil || !found {
+		return
+	}
+	var rate float64
+	if _, err = fmt.Sscanf(rateStr, "%g", &rate); err != nil || rate <= 0 {
+		return limits, fmt.Errorf("Illegal 'iorate' setting '%s': must be positive MB per second", rateStr)
+	}
+	limits.IORate = rate * dvid.Mega
+	return limits, nil
+}
+
+// Job is a background job whose resource use is throttled.  Except for Go, Wait, Done,
+// Result, and Subscribe, methods may be called on a nil Job, which is unthrottled.
+type Job struct {
+	ID      int
+	Kind    string
+	Name    string
+	Started time.Time
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limits JobLimits
+	active int
+
+	// User that started the job, who may change its limits, or "" if only admins may.
+	owner string
+
+	// I/O since the rate limit was last set.
+	ioBytes int64
+	ioStart time.Time
+	ioTotal int64
+
+	wg  sync.WaitGroup
+	err error
+
+	// Done when the job is cancelled.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Progress as units done of a total, and the last log lines.
+	done, total int64
+	percent     int
+	log         []string
+	subscribers map[chan JobEvent]bool
+
+	// Closed when the job is finished, with the job's result and error.
+	finished chan struct{}
+	ended    time.Time
+	result   interface{}
+	failure  error
+}
+
+// JobEvent is a change in a job's progress or a line logged by the job.
+type JobEvent struct {
+	Type    string // "progress" or "log"
+	Time    time.Time
+	Percent int
+	Message string `json:",omitempty"`
+}
+
+const (
+	// JobEventBuffer is the number of events buffered for a job subscriber.  Events
+	// are dropped for subscribers that fall further behind.
+	JobEventBuffer = 100
+
+	// JobLogLines is the number of a job's most recent log lines kept.
+	JobLogLines = 100
+
+	// FinishedJobsKept is the number of finished jobs kept for retrieval of results.
+	FinishedJobsKept = 50
+)
+
+var (
+	jobs         = make(map[int]*Job)
+	finishedJobs []*Job
+	jobsLock     sync.Mutex
+	nextJobID    = 1
+)
+
+// StartJob registers a background job of a kind, e.g., "gc", with the given limits.
+// Finish must be called when the job is done.
+func StartJob(kind, name string, limits JobLimits) *Job {
+	now := time.Now()
+	job := &Job{Kind: kind, Name: name, Started: now, limits: limits, ioStart: now,
+		subscribers: make(map[chan JobEvent]bool), finished: make(chan struct{})}
+	job.cond = sync.NewCond(&job.mu)
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	jobsLock.Lock()
+	job.ID = nextJobID
+	nextJobID++
+	jobs[job.ID] = job
+	jobsLock.Unlock()
+	dvid.Log(dvid.Debug, "Started %s job %d: %s\n", kind, job.ID, name)
+	return job
+}
+
+// RunJob starts a job that runs f in the background, recording the result and error
+// returned by f and finishing the job when f returns.
+func RunJob(kind, name string, limits JobLimits, f func(*Job) (interface{}, error)) *Job {
+	job := StartJob(kind, name, limits)
+	go func() {
+		defer job.Finish()
+		result, err := f(job)
+		job.SetResult(result, err)
+	}()
+	return job
+}
+
+// Finish removes a job from the running jobs, keeping it among the recently finished
+// jobs, and ends the event streams of its subscribers.
+func (j *Job) Finish() {
+	if j == nil {
+		return
+	}
+	jobsLock.Lock()
+	delete(jobs, j.ID)
+	finishedJobs = append(finishedJobs, j)
+	if len(finishedJobs) > FinishedJobsKept {
+		finishedJobs = finishedJobs[len(finishedJobs)-FinishedJobsKept:]
+	}
+	jobsLock.Unlock()
+
+	j.mu.Lock()
+	j.ended = time.Now()
+	for ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+	close(j.finished)
+	j.mu.Unlock()
+	j.cancel()
+	dvid.Log(dvid.Debug, "Finished %s job %d after %s\n", j.Kind, j.ID, time.Since(j.Started))
+}
+
+// SetResult records the result of a job and the error, if any, that ended it.
+func (j *Job) SetResult(result interface{}, err error) {
+	if j == nil {
+		return
+	}
+	if err != nil {
+		j.Logf("Failed: %s", err.Error())
+	}
+	j.mu.Lock()
+	j.result = result
+	j.failure = err
+	j.mu.Unlock()
+}
+
+// Context returns a context that is done when the job is cancelled, so reads of the
+// job's data can stop early.  A nil Job is never cancelled.
+func (j *Job) Context() context.Context {
+	if j == nil {
+		return context.Background()
+	}
+	return j.ctx
+}
+
+// Cancel asks the job to stop.  Workers not yet started by Go are not run, and the
+// job's context is done.  The job must still be finished by whoever started it.
+func (j *Job) Cancel() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.cancel()
+	j.mu.Unlock()
+	j.cond.Broadcast()
+}
+
+// Cancelled returns true if the job has been cancelled.
+func (j *Job) Cancelled() bool {
+	return j != nil && j.ctx.Err() != nil
+}
+
+// Done returns a channel that is closed when the job is finished.
+func (j *Job) Done() <-chan struct{} {
+	return j.finished
+}
+
+// Result returns the result and error recorded for the job.
+func (j *Job) Result() (interface{}, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.result, j.failure
+}
+
+// Progress records that done of total units of the job's work are complete.
+func (j *Job) Progress(done, total int64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.done, j.total = done, total
+	j.updatePercent()
+	j.mu.Unlock()
+}
+
+// SetTotal sets the total units of the job's work, which workers can then report
+// with Advance.
+func (j *Job) SetTotal(total int64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.total = total
+	j.updatePercent()
+	j.mu.Unlock()
+}
+
+// Advance records that n more units of the job's work are complete.
+func (j *Job) Advance(n int64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.done += n
+	j.updatePercent()
+	j.mu.Unlock()
+}
+
+// updatePercent sends a progress event if the percent complete has changed.  The job
+// must be locked.
+func (j *Job) updatePercent() {
+	if j.total <= 0 {
+		return
+	}
+	percent := int(j.done * 100 / j.total)
+	if percent > 100 {
+		percent = 100
+	}
+	if percent == j.percent {
+		return
+	}
+	j.percent = percent
+	j.send(JobEvent{Type: "progress", Time: time.Now(), Percent: percent})
+}
+
+// Logf adds a line to the job's log.
+func (j *Job) Logf(format string, args ...interface{}) {
+	if j == nil {
+		return
+	}
+	line := fmt.Sprintf(format, args...)
+	dvid.Log(dvid.Debug, "Job %d: %s\n", j.ID, line)
+	j.mu.Lock()
+	j.log = append(j.log, line)
+	if len(j.log) > JobLogLines {
+		j.log = j.log[len(j.log)-JobLogLines:]
+	}
+	j.send(JobEvent{Type: "log", Time: time.Now(), Percent: j.percent, Message: line})
+	j.mu.Unlock()
+}
+
+// send delivers an event to subscribers with room for it.  The job must be locked.
+func (j *Job) send(event JobEvent) {
+	for ch := range j.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of the job's events, which is closed when the job is
+// finished, and a function that ends the subscription.
+func (j *Job) Subscribe() (<-chan JobEvent, func()) {
+	ch := make(chan JobEvent, JobEventBuffer)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.subscribers == nil {
+		close(ch)
+		return ch, func() {}
+	}
+	j.subscribers[ch] = true
+	return ch, func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if j.subscribers[ch] {
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Limits returns the current limits of the job.
+func (j *Job) Limits() JobLimits {
+	if j == nil {
+		return JobLimits{}
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.limits
+}
+
+// Owner returns the user that started the job or "" if not known.
+func (j *Job) Owner() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.owner
+}
+
+// SetOwner records the user that started the job.
+func (j *Job) SetOwner(user string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.owner = user
+	j.mu.Unlock()
+}
+
+// SetLimits changes the limits of a job, waking workers that are now allowed to run.
+func (j *Job) SetLimits(limits JobLimits) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.limits = limits
+	j.ioBytes = 0
+	j.ioStart = time.Now()
+	j.mu.Unlock()
+	j.cond.Broadcast()
+}
+
+// maxWorkers returns the number of workers allowed.  The job must be locked.
+func (j *Job) maxWorkers() int {
+	if j.limits.Workers > 0 {
+		return j.limits.Workers
+	}
+	return dvid.NumCPU
+}
+
+// Acquire blocks until the job may start another worker.
+func (j *Job) Acquire() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	for j.active >= j.maxWorkers() && !j.Cancelled() {
+		j.cond.Wait()
+	}
+	j.active++
+	j.mu.Unlock()
+}
+
+// Release ends a worker started with Acquire.
+func (j *Job) Release() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.active--
+	j.mu.Unlock()
+	j.cond.Signal()
+}
+
+// Go runs a function in a new worker once one is available.  The first error is
+// returned by Wait and cancels the job, so workers still running can stop early.  Once
+// the job is cancelled, functions are not run and Wait returns context.Canceled unless
+// a worker failed first.
+func (j *Job) Go(f func() error) {
+	j.Acquire()
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		defer j.Release()
+		err := j.ctx.Err()
+		if err == nil {
+			err = f()
+		}
+		if err != nil {
+			j.mu.Lock()
+			first := j.err == nil
+			if first {
+				j.err = err
+			}
+			j.mu.Unlock()
+			if first {
+				j.Cancel()
+			}
+		}
+	}()
+}
+
+// Wait blocks until all workers started with Go are done and returns the first error
+// of any worker.
+func (j *Job) Wait() error {
+	j.wg.Wait()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// Throttle records bytes of I/O by the job and sleeps as needed to keep the job's I/O
+// under its rate limit.
+func (j *Job) Throttle(bytes int) {
+	if j == nil || bytes <= 0 {
+		return
+	}
+	j.mu.Lock()
+	j.ioTotal += int64(bytes)
+	j.ioBytes += int64(bytes)
+	rate := j.limits.IORate
+	var wait time.Duration
+	if rate > 0 {
+		due := j.ioStart.Add(time.Duration(float64(j.ioBytes) / rate * float64(time.Second)))
+		wait = due.Sub(time.Now())
+	}
+	j.mu.Unlock()
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-j.ctx.Done():
+			timer.Stop()
+		}
+	}
+}
+
+// MarshalJSON returns the job's identity, limits, and progress, and once finished,
+// its result or error.
+func (j *Job) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var finished *time.Time
+	if !j.ended.IsZero() {
+		finished = &j.ended
+	}
+	var errorStr string
+	if j.failure != nil {
+		errorStr = j.failure.Error()
+	}
+	return json.Marshal(struct {
+		ID            int
+		Kind          string
+		Name          string
+		Owner         string `json:",omitempty"`
+		Started       time.Time
+		Workers       int
+		IORate        float64
+		ActiveWorkers int
+		BytesIO       int64
+		Percent       int
+		Log           []string    `json:",omitempty"`
+		Finished      *time.Time  `json:",omitempty"`
+		Error         string      `json:",omitempty"`
+		Result        interface{} `json:",omitempty"`
+	}{j.ID, j.Kind, j.Name, j.owner, j.Started, j.limits.Workers, j.limits.IORate, j.active, j.ioTotal,
+		j.percent, j.log, finished, errorStr, j.result})
+}
+
+// FindJob returns a running or recently finished job.
+func FindJob(id int) (*Job, error) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	if job, found := jobs[id]; found {
+		return job, nil
+	}
+	for _, job := range finishedJobs {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("No running or recently finished job with id %d", id)
+}
+
+// JobByID returns a running job.
+func JobByID(id int) (*Job, error) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	job, found := jobs[id]
+	if !found {
+		return nil, fmt.Errorf("No running job with id %d", id)
+	}
+	return job, nil
+}
+
+// RunningJobs returns all running jobs in the order they were started.
+func RunningJobs() []*Job {
+	jobsLock.Lock()
+	running := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		running = append(running, job)
+	}
+	jobsLock.Unlock()
+	sort.Sort(jobsByID(running))
+	return running
+}
+
+// CancelJobs cancels all running jobs and waits until they finish or the context is
+// done.  It returns the jobs still running.
+func CancelJobs(ctx context.Context) []*Job {
+	for _, job := range RunningJobs() {
+		job.Cancel()
+	}
+	for _, job := range RunningJobs() {
+		select {
+		case <-job.Done():
+		case <-ctx.Done():
+			return RunningJobs()
+		}
+	}
+	return nil
+}
+
+type jobsByID []*Job
+
+func (j jobsByID) Len() int           { return len(j) }
+func (j jobsByID) Swap(a, b int)      { j[a], j[b] = j[b], j[a] }
+func (j jobsByID) Less(a, b int) bool { return j[a].ID < j[b].ID }
+
+// JobsJSON returns JSON listing the running jobs.
+func JobsJSON() (string, error) {
+	m, err := json.Marshal(RunningJobs())
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
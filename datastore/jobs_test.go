@@ -0,0 +1,186 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestJobLimits(c *C) {
+	config := dvid.NewConfig()
+	config.Set("workers", "0")
+	_, err := JobLimitsFromConfig(config)
+	c.Assert(err, NotNil)
+	config.Set("workers", "1")
+	config.Set("iorate", "0.5")
+	limits, err := JobLimitsFromConfig(config)
+	c.Assert(err, IsNil)
+	c.Assert(limits, DeepEquals, JobLimits{Workers: 1, IORate: 0.5 * dvid.Mega})
+
+	job := StartJob("test", "throttled job", JobLimits{Workers: 1})
+	found, err := JobByID(job.ID)
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, job)
+
+	// A single worker blocks others until the limit is raised.
+	job.Acquire()
+	acquired := make(chan bool)
+	go func() {
+		job.Acquire()
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		c.Fatalf("Job exceeded its worker limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	job.SetLimits(JobLimits{Workers: 2})
+	<-acquired
+	job.Release()
+	job.Release()
+
+	// Workers started with Go report the first error, which cancels the job so later
+	// workers don't run.
+	failing := StartJob("test", "failing job", JobLimits{Workers: 1})
+	var ran []int
+	for i := 0; i < 4; i++ {
+		i := i
+		failing.Go(func() error {
+			ran = append(ran, i)
+			if i == 1 {
+				return fmt.Errorf("worker failed")
+			}
+			return nil
+		})
+	}
+	c.Assert(failing.Wait(), ErrorMatches, "worker failed")
+	c.Assert(ran, DeepEquals, []int{0, 1})
+	c.Assert(failing.Cancelled(), Equals, true)
+	failing.Finish()
+
+	// I/O is delayed to stay under the rate limit.
+	job.SetLimits(JobLimits{IORate: 10000})
+	start := time.Now()
+	job.Throttle(500)
+	c.Assert(time.Since(start) >= 40*time.Millisecond, Equals, true)
+
+	jsonStr, err := JobsJSON()
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Matches, `.*"Kind":"test","Name":"throttled job".*"IORate":10000,"ActiveWorkers":0,"BytesIO":500.*`)
+	job.Finish()
+	_, err = JobByID(job.ID)
+	c.Assert(err, NotNil)
+
+	var nilJob *Job
+	nilJob.Acquire()
+	nilJob.Throttle(100)
+	nilJob.Release()
+	nilJob.Finish()
+}
+
+func (s *DataSuite) TestCancelJobs(c *C) {
+	// A cancelled job stops waiting for workers and I/O, and runs no more workers.
+	job := StartJob("test", "cancelled job", JobLimits{Workers: 1, IORate: 1})
+	job.Acquire()
+	acquired := make(chan bool)
+	go func() {
+		job.Acquire()
+		acquired <- true
+	}()
+	throttled := make(chan bool)
+	go func() {
+		job.Throttle(1000)
+		throttled <- true
+	}()
+
+	stopped := RunJob("test", "job stopping on cancel", JobLimits{}, func(job *Job) (interface{}, error) {
+		<-job.Context().Done()
+		return nil, job.Context().Err()
+	})
+	go func() {
+		<-acquired
+		<-throttled
+		job.Release()
+		job.Release()
+		job.Finish()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Assert(CancelJobs(ctx), HasLen, 0)
+	c.Assert(job.Cancelled(), Equals, true)
+	_, err := stopped.Result()
+	c.Assert(err, Equals, context.Canceled)
+
+	ran := false
+	job.Go(func() error {
+		ran = true
+		return nil
+	})
+	c.Assert(job.Wait(), Equals, context.Canceled)
+	c.Assert(ran, Equals, false)
+
+	var nilJob *Job
+	nilJob.Cancel()
+	c.Assert(nilJob.Cancelled(), Equals, false)
+	c.Assert(nilJob.Context().Err(), IsNil)
+}
+
+func (s *DataSuite) TestJobProgress(c *C) {
+	release := make(chan bool)
+	job := RunJob("test", "reporting job", JobLimits{}, func(job *Job) (interface{}, error) {
+		<-release
+		job.SetTotal(4)
+		job.Advance(1)
+		job.Advance(1)
+		job.Logf("halfway after %d steps", 2)
+		job.Progress(4, 4)
+		return "all done", nil
+	})
+	events, unsubscribe := job.Subscribe()
+	defer unsubscribe()
+	close(release)
+
+	var got []JobEvent
+	for event := range events {
+		got = append(got, event)
+	}
+	c.Assert(got, HasLen, 4)
+	c.Assert(got[0].Type, Equals, "progress")
+	c.Assert(got[0].Percent, Equals, 25)
+	c.Assert(got[1].Percent, Equals, 50)
+	c.Assert(got[2].Type, Equals, "log")
+	c.Assert(got[2].Message, Equals, "halfway after 2 steps")
+	c.Assert(got[3].Percent, Equals, 100)
+
+	<-job.Done()
+	result, err := job.Result()
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "all done")
+
+	// Finished jobs can be found but are no longer running.
+	_, err = JobByID(job.ID)
+	c.Assert(err, NotNil)
+	found, err := FindJob(job.ID)
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, job)
+	m, err := json.Marshal(found)
+	c.Assert(err, IsNil)
+	c.Assert(string(m), Matches, `.*"Percent":100,"Log":\["halfway after 2 steps"\],"Finished":.*"Result":"all done".*`)
+
+	// Subscribing to a finished job gives a closed channel.
+	events, _ = job.Subscribe()
+	_, open := <-events
+	c.Assert(open, Equals, false)
+
+	failed := RunJob("test", "failing job", JobLimits{}, func(job *Job) (interface{}, error) {
+		return nil, fmt.Errorf("job failed")
+	})
+	<-failed.Done()
+	_, err = failed.Result()
+	c.Assert(err, ErrorMatches, "job failed")
+}
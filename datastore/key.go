@@ -6,6 +6,7 @@
 package datastore
 
 import (
+	"encoding/binary"
 	"fmt"
 	"reflect"
 
@@ -115,7 +116,8 @@ type DataKey struct {
 	Index dvid.Index
 }
 
-// The offset to the Index in bytes of a DataKey bytes representation
+// The offset to the Index in bytes of a DataKey bytes representation in the legacy
+// key encoding.  Use DataKeyIndexBytes for keys in any encoding.
 const DataKeyIndexOffset = dvid.LocalIDSize*2 + dvid.LocalID32Size + 1
 
 // DataKey returns a DataKey for this data given a local version and a data-specific Index.
@@ -140,52 +142,210 @@ func KeyToChunkIndexer(key storage.Key) (dvid.ChunkIndexer, error) {
 // ------ Key Interface ----------
 
 func (key *DataKey) KeyType() storage.KeyType {
-	return storage.KeyData
+	return currentKeySchema().KeyType()
 }
 
-// BytesToKey returns a DataKey given a slice of bytes
+// BytesToKey returns a DataKey given a slice of bytes in any supported key encoding.
 func (key *DataKey) BytesToKey(b []byte) (storage.Key, error) {
-	if len(b) < 9 {
-		return nil, fmt.Errorf("Malformed DataKey bytes (too few): %x", b)
+	encoding, err := keyEncodingOf(b)
+	if err != nil {
+		return nil, err
 	}
-	if b[0] != byte(storage.KeyData) {
-		return nil, fmt.Errorf("Cannot convert %s Key Type into DataKey", storage.KeyType(b[0]))
+	schema, err := keySchema(encoding)
+	if err != nil {
+		return nil, err
+	}
+	dataset, data, version, indexBytes, err := schema.Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	var index dvid.Index
+	if len(indexBytes) != 0 {
+		index, err = key.Index.IndexFromBytes(indexBytes)
+	}
+	return &DataKey{dataset, data, version, index}, err
+}
+
+// Bytes returns a slice of bytes derived from the concatenation of the key elements
+// in the current key encoding.
+func (key *DataKey) Bytes() (b []byte) {
+	return currentKeySchema().Encode(key)
+}
+
+// Bytes returns a string derived from the concatenation of the key elements.
+func (key *DataKey) BytesString() string {
+	return string(key.Bytes())
+}
+
+// String returns a hexadecimal representation of the bytes encoding a key
+// so it is readable on a terminal.
+func (key *DataKey) String() string {
+	return fmt.Sprintf("%x", key.Bytes())
+}
+
+// ServerKey is an implementation of storage.Key for named server-wide metadata that is
+// not part of any Dataset, e.g., authentication tokens.
+type ServerKey struct {
+	Name string
+}
+
+func (k ServerKey) KeyType() storage.KeyType {
+	return storage.KeyServer
+}
+
+func (k ServerKey) BytesToKey(b []byte) (storage.Key, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("Malformed ServerKey bytes (too few): %x", b)
+	}
+	if b[0] != byte(storage.KeyServer) {
+		return nil, fmt.Errorf("Cannot convert %s Key Type into ServerKey", storage.KeyType(b[0]))
+	}
+	return &ServerKey{string(b[1:])}, nil
+}
+
+func (k ServerKey) Bytes() []byte {
+	return append([]byte{byte(storage.KeyServer)}, k.Name...)
+}
+
+func (k ServerKey) BytesString() string {
+	return string(k.Bytes())
+}
+
+func (k ServerKey) String() string {
+	return fmt.Sprintf("%x", k.Bytes())
+}
+
+// QuarantineKey is an implementation of storage.Key for key/value pairs moved out of
+// the data key space by verification because they were corrupt or orphaned.  It holds
+// the bytes of the original key so the pair can be inspected or put back.
+type QuarantineKey struct {
+	Original []byte
+}
+
+func (k QuarantineKey) KeyType() storage.KeyType {
+	return storage.KeyQuarantine
+}
+
+func (k QuarantineKey) BytesToKey(b []byte) (storage.Key, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("Malformed QuarantineKey bytes (too few): %x", b)
+	}
+	if b[0] != byte(storage.KeyQuarantine) {
+		return nil, fmt.Errorf("Cannot convert %s Key Type into QuarantineKey", storage.KeyType(b[0]))
+	}
+	return &QuarantineKey{append([]byte{}, b[1:]...)}, nil
+}
+
+func (k QuarantineKey) Bytes() []byte {
+	return append([]byte{byte(storage.KeyQuarantine)}, k.Original...)
+}
+
+func (k QuarantineKey) BytesString() string {
+	return string(k.Bytes())
+}
+
+func (k QuarantineKey) String() string {
+	return fmt.Sprintf("%x", k.Bytes())
+}
+
+// ChangelogKey is an implementation of storage.Key for the mutation events of a Data,
+// ordered by the offset of each event in the Data's changelog.
+type ChangelogKey struct {
+	Dataset dvid.DatasetLocalID
+	Data    dvid.DataLocalID
+	Offset  uint64
+}
+
+// The size in bytes of a ChangelogKey bytes representation
+const ChangelogKeySize = 1 + dvid.LocalID32Size + dvid.LocalIDSize + 8
+
+func (key *ChangelogKey) KeyType() storage.KeyType {
+	return storage.KeyChangelog
+}
+
+// BytesToKey returns a ChangelogKey given a slice of bytes
+func (key *ChangelogKey) BytesToKey(b []byte) (storage.Key, error) {
+	if len(b) != ChangelogKeySize {
+		return nil, fmt.Errorf("Malformed ChangelogKey bytes (expected %d bytes): %x", ChangelogKeySize, b)
+	}
+	if b[0] != byte(storage.KeyChangelog) {
+		return nil, fmt.Errorf("Cannot convert %s Key Type into ChangelogKey", storage.KeyType(b[0]))
 	}
 	start := 1
 	dataset, length := dvid.LocalID32FromBytes(b[start:])
 	start += length
 	data, length := dvid.LocalIDFromBytes(b[start:])
 	start += length
-	version, _ := dvid.LocalIDFromBytes(b[start:])
-	start += length
-
-	var index dvid.Index
-	var err error
-	if start < len(b) {
-		index, err = key.Index.IndexFromBytes(b[start:])
-	}
-	return &DataKey{dvid.DatasetLocalID(dataset), dvid.DataLocalID(data), dvid.VersionLocalID(version), index}, err
+	offset := binary.BigEndian.Uint64(b[start:])
+	return &ChangelogKey{dvid.DatasetLocalID(dataset), dvid.DataLocalID(data), offset}, nil
 }
 
 // Bytes returns a slice of bytes derived from the concatenation of the key elements.
-func (key *DataKey) Bytes() (b []byte) {
-	b = []byte{byte(storage.KeyData)}
+func (key *ChangelogKey) Bytes() (b []byte) {
+	b = []byte{byte(storage.KeyChangelog)}
 	b = append(b, dvid.LocalID32(key.Dataset).Bytes()...)
 	b = append(b, dvid.LocalID(key.Data).Bytes()...)
-	b = append(b, dvid.LocalID(key.Version).Bytes()...)
-	if key.Index != nil {
-		b = append(b, key.Index.Bytes()...)
+	offset := make([]byte, 8)
+	binary.BigEndian.PutUint64(offset, key.Offset)
+	return append(b, offset...)
+}
+
+func (key *ChangelogKey) BytesString() string {
+	return string(key.Bytes())
+}
+
+func (key *ChangelogKey) String() string {
+	return fmt.Sprintf("%x", key.Bytes())
+}
+
+// TombstoneKey is an implementation of storage.Key that marks the deletion of the data
+// key/value pair with the same local IDs and index.  Reads of the version do not resolve
+// the index to values stored by its ancestors.  The key layout is independent of the
+// key encoding of data.
+type TombstoneKey struct {
+	Dataset dvid.DatasetLocalID
+	Data    dvid.DataLocalID
+	Version dvid.VersionLocalID
+	Index   dvid.Index
+}
+
+// Tombstone returns the key marking the deletion of this key's pair.
+func (key *DataKey) Tombstone() *TombstoneKey {
+	return &TombstoneKey{key.Dataset, key.Data, key.Version, key.Index}
+}
+
+func (key *TombstoneKey) KeyType() storage.KeyType {
+	return storage.KeyTombstone
+}
+
+// BytesToKey returns a TombstoneKey given a slice of bytes.
+func (key *TombstoneKey) BytesToKey(b []byte) (storage.Key, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("Malformed TombstoneKey bytes (too few): %x", b)
 	}
-	return
+	if b[0] != byte(storage.KeyTombstone) {
+		return nil, fmt.Errorf("Cannot convert %s Key Type into TombstoneKey", storage.KeyType(b[0]))
+	}
+	dataset, data, version, indexBytes, err := decodeDataKeyFields(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	var index dvid.Index
+	if len(indexBytes) != 0 {
+		index, err = key.Index.IndexFromBytes(indexBytes)
+	}
+	return &TombstoneKey{dataset, data, version, index}, err
 }
 
-// Bytes returns a string derived from the concatenation of the key elements.
-func (key *DataKey) BytesString() string {
+// Bytes returns a slice of bytes derived from the concatenation of the key elements.
+func (key *TombstoneKey) Bytes() []byte {
+	return appendDataKeyFields([]byte{byte(storage.KeyTombstone)}, &DataKey{key.Dataset, key.Data, key.Version, key.Index})
+}
+
+func (key *TombstoneKey) BytesString() string {
 	return string(key.Bytes())
 }
 
-// String returns a hexadecimal representation of the bytes encoding a key
-// so it is readable on a terminal.
-func (key *DataKey) String() string {
+func (key *TombstoneKey) String() string {
 	return fmt.Sprintf("%x", key.Bytes())
 }
@@ -0,0 +1,480 @@
+/*
+	This file supports versioned encodings of data keys.  How the dataset, data, and version
+	local IDs and the index of a DataKey compose into a storage key is determined by the key
+	encoding of the datastore, and every encoding after the legacy one stores its encoding
+	byte in each key so keys of different encodings can coexist in one store.  Keys are
+	rewritten from one encoding to another by a background key migration.
+*/
+
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// KeyEncoding identifies how the components of a DataKey compose into a storage key.
+type KeyEncoding uint8
+
+const (
+	// LegacyKeyEncoding is the KeyData key type followed by the dataset, data, and
+	// version local IDs and the index.  It has no encoding byte.
+	LegacyKeyEncoding KeyEncoding = 0
+
+	// KeyEncodingV1 is the KeyEncodedData key type and the encoding byte followed by the
+	// components of the legacy encoding.
+	KeyEncodingV1 KeyEncoding = 1
+
+	// LatestKeyEncoding is the key encoding of newly created datastores.
+	LatestKeyEncoding = KeyEncodingV1
+)
+
+// Number of migrated key/value pairs per batch.
+var keyMigrationBatchSize = 1000
+
+// KeySchema composes the components of a DataKey into a storage key for one key encoding.
+// Every encoding except the legacy one must begin keys with the KeyEncodedData key type
+// and the encoding byte.
+type KeySchema interface {
+	// KeyType returns the key type of encoded keys.
+	KeyType() storage.KeyType
+
+	// Encode returns the storage key of a DataKey.
+	Encode(key *DataKey) []byte
+
+	// Decode returns the components of a storage key, with the index as bytes.
+	Decode(b []byte) (dataset dvid.DatasetLocalID, data dvid.DataLocalID,
+		version dvid.VersionLocalID, index []byte, err error)
+}
+
+var (
+	keySchemas = map[KeyEncoding]KeySchema{
+		LegacyKeyEncoding: legacyKeySchema{},
+		KeyEncodingV1:     keySchemaV1{},
+	}
+	keySchemasLock sync.RWMutex
+
+	// The key encoding used by DataKey.Bytes().  It is set from the datastore on Open.
+	keyEncoding uint32
+)
+
+// RegisterKeySchema adds a key encoding, usually in an init() preceding the release that
+// makes it the latest encoding.
+func RegisterKeySchema(encoding KeyEncoding, schema KeySchema) {
+	keySchemasLock.Lock()
+	keySchemas[encoding] = schema
+	keySchemasLock.Unlock()
+}
+
+// keySchema returns the schema of a key encoding.
+func keySchema(encoding KeyEncoding) (KeySchema, error) {
+	keySchemasLock.RLock()
+	defer keySchemasLock.RUnlock()
+	schema, found := keySchemas[encoding]
+	if !found {
+		return nil, fmt.Errorf("Key encoding %d is not supported by this DVID server", encoding)
+	}
+	return schema, nil
+}
+
+// CurrentKeyEncoding returns the key encoding of newly written data keys.
+func CurrentKeyEncoding() KeyEncoding {
+	return KeyEncoding(atomic.LoadUint32(&keyEncoding))
+}
+
+func setKeyEncoding(encoding KeyEncoding) {
+	atomic.StoreUint32(&keyEncoding, uint32(encoding))
+}
+
+// currentKeySchema returns the schema of the current key encoding.
+func currentKeySchema() KeySchema {
+	schema, err := keySchema(CurrentKeyEncoding())
+	if err != nil {
+		// Only supported encodings are set as current.
+		panic(err.Error())
+	}
+	return schema
+}
+
+// keyEncodingOf returns the key encoding of the bytes of a data key.
+func keyEncodingOf(b []byte) (KeyEncoding, error) {
+	switch {
+	case len(b) > 0 && b[0] == byte(storage.KeyData):
+		return LegacyKeyEncoding, nil
+	case len(b) > 1 && b[0] == byte(storage.KeyEncodedData):
+		return KeyEncoding(b[1]), nil
+	case len(b) > 0:
+		return 0, fmt.Errorf("Cannot convert %s Key Type into DataKey", storage.KeyType(b[0]))
+	default:
+		return 0, fmt.Errorf("Malformed DataKey bytes (too few): %x", b)
+	}
+}
+
+// appendDataKeyFields appends the local IDs and index of a data key.
+func appendDataKeyFields(b []byte, key *DataKey) []byte {
+	b = append(b, dvid.LocalID32(key.Dataset).Bytes()...)
+	b = append(b, dvid.LocalID(key.Data).Bytes()...)
+	b = append(b, dvid.LocalID(key.Version).Bytes()...)
+	if key.Index != nil {
+		b = append(b, key.Index.Bytes()...)
+	}
+	return b
+}
+
+// decodeDataKeyFields decodes the local IDs and index appended by appendDataKeyFields.
+func decodeDataKeyFields(b []byte) (dataset dvid.DatasetLocalID, data dvid.DataLocalID,
+	version dvid.VersionLocalID, index []byte, err error) {
+
+	if len(b) < dvid.LocalID32Size+2*dvid.LocalIDSize {
+		err = fmt.Errorf("Malformed DataKey bytes (too few): %x", b)
+		return
+	}
+	start := 0
+	datasetID, length := dvid.LocalID32FromBytes(b[start:])
+	start += length
+	dataID, length := dvid.LocalIDFromBytes(b[start:])
+	start += length
+	versionID, length := dvid.LocalIDFromBytes(b[start:])
+	start += length
+	return dvid.DatasetLocalID(datasetID), dvid.DataLocalID(dataID), dvid.VersionLocalID(versionID), b[start:], nil
+}
+
+type legacyKeySchema struct{}
+
+func (legacyKeySchema) KeyType() storage.KeyType {
+	return storage.KeyData
+}
+
+func (legacyKeySchema) Encode(key *DataKey) []byte {
+	return appendDataKeyFields([]byte{byte(storage.KeyData)}, key)
+}
+
+func (legacyKeySchema) Decode(b []byte) (dvid.DatasetLocalID, dvid.DataLocalID, dvid.VersionLocalID, []byte, error) {
+	return decodeDataKeyFields(b[1:])
+}
+
+type keySchemaV1 struct{}
+
+func (keySchemaV1) KeyType() storage.KeyType {
+	return storage.KeyEncodedData
+}
+
+func (keySchemaV1) Encode(key *DataKey) []byte {
+	return appendDataKeyFields([]byte{byte(storage.KeyEncodedData), byte(KeyEncodingV1)}, key)
+}
+
+func (keySchemaV1) Decode(b []byte) (dvid.DatasetLocalID, dvid.DataLocalID, dvid.VersionLocalID, []byte, error) {
+	return decodeDataKeyFields(b[2:])
+}
+
+// DataKeyIndexBytes returns the bytes of the index of a data key in any key encoding.
+func DataKeyIndexBytes(key storage.Key) ([]byte, error) {
+	dataKey, ok := key.(*DataKey)
+	if !ok {
+		return nil, fmt.Errorf("Can't convert Key (%s) to DataKey", key)
+	}
+	if dataKey.Index == nil {
+		return []byte{}, nil
+	}
+	return dataKey.Index.Bytes(), nil
+}
+
+// encodedKey is a data key in a given encoding rather than the current one.  Keys read
+// in a range query starting from an encodedKey keep the encoding of their stored bytes.
+type encodedKey struct {
+	*DataKey
+	encoding KeyEncoding
+}
+
+func (k *encodedKey) KeyType() storage.KeyType {
+	schema, err := keySchema(k.encoding)
+	if err != nil {
+		return storage.KeyEncodedData
+	}
+	return schema.KeyType()
+}
+
+func (k *encodedKey) BytesToKey(b []byte) (storage.Key, error) {
+	key, err := k.DataKey.BytesToKey(b)
+	if err != nil {
+		return nil, err
+	}
+	encoding, err := keyEncodingOf(b)
+	if err != nil {
+		return nil, err
+	}
+	return &encodedKey{key.(*DataKey), encoding}, nil
+}
+
+func (k *encodedKey) Bytes() []byte {
+	schema, err := keySchema(k.encoding)
+	if err != nil {
+		return nil
+	}
+	return schema.Encode(k.DataKey)
+}
+
+func (k *encodedKey) BytesString() string {
+	return string(k.Bytes())
+}
+
+func (k *encodedKey) String() string {
+	return fmt.Sprintf("%x", k.Bytes())
+}
+
+// encodedKeyRange returns the range of all data keys in a key encoding.
+func encodedKeyRange(encoding KeyEncoding) (minKey, maxKey *encodedKey) {
+	minKey = &encodedKey{&DataKey{0, 0, 0, dvid.IndexBytes{}}, encoding}
+	maxKey = &encodedKey{&DataKey{maxDatasetLocalID, maxDataLocalID, dvid.MaxLocalID, nil}, encoding}
+	return
+}
+
+// KeyMigration is the state of a key migration.
+type KeyMigration struct {
+	From    KeyEncoding
+	To      KeyEncoding
+	Started time.Time
+
+	// Keys is the number of key/value pairs rewritten so far.
+	Keys int64
+
+	// ReadOnly is true while keys are copied into the new encoding, when the server
+	// refuses requests that modify data.
+	ReadOnly bool
+}
+
+var (
+	keyMigration     *KeyMigration
+	keyMigrationLock sync.Mutex
+)
+
+// KeyMigrationJSON returns JSON describing the running key migration and the key
+// encodings of the datastore.
+func (s *Service) KeyMigrationJSON() (string, error) {
+	keyMigrationLock.Lock()
+	defer keyMigrationLock.Unlock()
+	s.Datasets.writeLock.Lock()
+	stale := []int{}
+	for _, encoding := range s.Datasets.staleKeyEncodings {
+		stale = append(stale, int(encoding))
+	}
+	s.Datasets.writeLock.Unlock()
+	m, err := json.Marshal(struct {
+		KeyEncoding       KeyEncoding
+		StaleKeyEncodings []int
+		Migration         *KeyMigration
+	}{CurrentKeyEncoding(), stale, keyMigration})
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
+
+// KeysReadOnly returns true while a key migration copies keys into a new encoding,
+// when requests that modify data must be refused since modifications of keys already
+// copied would not be carried over.
+func KeysReadOnly() bool {
+	keyMigrationLock.Lock()
+	defer keyMigrationLock.Unlock()
+	return keyMigration != nil && keyMigration.ReadOnly
+}
+
+// CheckKeyMigration returns an error if keys cannot be migrated into a key encoding now
+// because a migration is running or, if keys must be copied, another background job
+// that could modify data while keys are copied is running.
+func CheckKeyMigration(to KeyEncoding) error {
+	keyMigrationLock.Lock()
+	defer keyMigrationLock.Unlock()
+	return checkKeyMigration(to)
+}
+
+// checkKeyMigration is CheckKeyMigration for callers holding keyMigrationLock.
+func checkKeyMigration(to KeyEncoding) error {
+	if keyMigration != nil {
+		return fmt.Errorf("Keys are already being migrated from encoding %d to %d",
+			keyMigration.From, keyMigration.To)
+	}
+	if to == CurrentKeyEncoding() {
+		return nil
+	}
+	if running := RunningJobs(); len(running) != 0 {
+		return fmt.Errorf("Keys cannot be migrated while %d background jobs are running", len(running))
+	}
+	return nil
+}
+
+// MigrateKeys rewrites all data keys into a key encoding, returning the number of
+// key/value pairs rewritten.  Keys are copied into the new encoding, the datastore
+// switches to the new encoding, and the keys in the old encoding are then deleted.
+// While keys are copied, KeysReadOnly is true and the server refuses modifications.
+// The migration runs as a job with the given limits.
+func (s *Service) MigrateKeys(to KeyEncoding, limits JobLimits) (int64, error) {
+	if s.Datasets == nil {
+		return 0, fmt.Errorf("Datastore service has no datasets available")
+	}
+	if _, err := keySchema(to); err != nil {
+		return 0, err
+	}
+	from := CurrentKeyEncoding()
+	keyMigrationLock.Lock()
+	if err := checkKeyMigration(to); err != nil {
+		keyMigrationLock.Unlock()
+		return 0, err
+	}
+	migration := &KeyMigration{From: from, To: to, Started: time.Now(), ReadOnly: from != to}
+	keyMigration = migration
+	keyMigrationLock.Unlock()
+	defer func() {
+		keyMigrationLock.Lock()
+		keyMigration = nil
+		keyMigrationLock.Unlock()
+	}()
+
+	job := StartJob("migration", fmt.Sprintf("migrate keys from encoding %d to %d", from, to), limits)
+	defer job.Finish()
+
+	if from != to {
+		if err := s.copyEncodedKeys(migration, job); err != nil {
+			return migration.Keys, err
+		}
+		s.Datasets.writeLock.Lock()
+		s.Datasets.keyEncoding = to
+		s.Datasets.staleKeyEncodings = append(s.Datasets.staleKeyEncodings, from)
+		s.Datasets.writeLock.Unlock()
+		if err := s.Datasets.Put(s.kvSetter); err != nil {
+			return migration.Keys, err
+		}
+		setKeyEncoding(to)
+		keyMigrationLock.Lock()
+		migration.ReadOnly = false
+		keyMigrationLock.Unlock()
+		dvid.Log(dvid.Normal, "Switched to key encoding %d after copying %d key/value pairs\n",
+			to, migration.Keys)
+	}
+	return migration.Keys, s.deleteStaleKeys(job)
+}
+
+// copyEncodedKeys copies all key/value pairs in the migration's old key encoding into
+// its new encoding.
+func (s *Service) copyEncodedKeys(migration *KeyMigration, job *Job) error {
+	batcher, err := s.Batcher()
+	if err != nil {
+		return err
+	}
+	minKey, maxKey := encodedKeyRange(migration.From)
+	batch := batcher.NewBatch()
+	var numBatched int
+	var copyErr error
+	err = s.kvGetter.ProcessRange(job.Context(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		if copyErr != nil {
+			return
+		}
+		job.Throttle(len(chunk.V))
+		key, ok := chunk.K.(*encodedKey)
+		if !ok {
+			return
+		}
+		batch.Put(&encodedKey{key.DataKey, migration.To}, chunk.V)
+		numBatched++
+		if numBatched >= keyMigrationBatchSize {
+			copyErr = batch.Commit()
+			batch = batcher.NewBatch()
+			keyMigrationLock.Lock()
+			migration.Keys += int64(numBatched)
+			keyMigrationLock.Unlock()
+			numBatched = 0
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+	if numBatched == 0 {
+		return nil
+	}
+	if err = batch.Commit(); err != nil {
+		return err
+	}
+	keyMigrationLock.Lock()
+	migration.Keys += int64(numBatched)
+	keyMigrationLock.Unlock()
+	return nil
+}
+
+// deleteStaleKeys deletes the keys of key encodings that are no longer used.
+func (s *Service) deleteStaleKeys(job *Job) error {
+	batcher, err := s.Batcher()
+	if err != nil {
+		return err
+	}
+	for {
+		s.Datasets.writeLock.Lock()
+		if len(s.Datasets.staleKeyEncodings) == 0 {
+			s.Datasets.writeLock.Unlock()
+			return nil
+		}
+		stale := s.Datasets.staleKeyEncodings[0]
+		s.Datasets.writeLock.Unlock()
+
+		minKey, maxKey := encodedKeyRange(stale)
+		numDeleted, err := deleteKeyRange(s.kvGetter, batcher, job, minKey, maxKey,
+			func(key storage.Key) bool {
+				_, ok := key.(*encodedKey)
+				return ok
+			})
+		if err != nil {
+			return err
+		}
+		dvid.Log(dvid.Normal, "Deleted %d key/value pairs in stale key encoding %d\n", numDeleted, stale)
+
+		s.Datasets.writeLock.Lock()
+		s.Datasets.staleKeyEncodings = s.Datasets.staleKeyEncodings[1:]
+		s.Datasets.writeLock.Unlock()
+		if err = s.Datasets.Put(s.kvSetter); err != nil {
+			return err
+		}
+	}
+}
+
+// ResumeKeyMigration deletes keys left in stale key encodings by an interrupted key
+// migration, e.g., after a server restart.
+func (s *Service) ResumeKeyMigration() error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	s.Datasets.writeLock.Lock()
+	numStale := len(s.Datasets.staleKeyEncodings)
+	s.Datasets.writeLock.Unlock()
+	if numStale == 0 {
+		return nil
+	}
+	_, err := s.MigrateKeys(CurrentKeyEncoding(), JobLimits{})
+	return err
+}
+
+// KeyEncodings returns the supported key encodings in increasing order.
+func KeyEncodings() []KeyEncoding {
+	keySchemasLock.RLock()
+	defer keySchemasLock.RUnlock()
+	encodings := make([]KeyEncoding, 0, len(keySchemas))
+	for encoding := range keySchemas {
+		encodings = append(encodings, encoding)
+	}
+	sort.Sort(keyEncodings(encodings))
+	return encodings
+}
+
+type keyEncodings []KeyEncoding
+
+func (k keyEncodings) Len() int           { return len(k) }
+func (k keyEncodings) Swap(a, b int)      { k[a], k[b] = k[b], k[a] }
+func (k keyEncodings) Less(a, b int) bool { return k[a] < k[b] }
@@ -0,0 +1,370 @@
+/*
+	This file supports merging of the data of version nodes.  Indices changed in any
+	merged parent since their common ancestors are copied into the merge node, and
+	indices changed differently by more than one parent are resolved by the data's type.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Number of key/value pairs written per batch when merging versions.
+const mergeBatchSize = 1000
+
+// MergeConflict is an index of data whose stored values were changed differently by
+// more than one parent of a merge.  Base is the value at the parents' common ancestors,
+// or nil if the index was not stored there.  Parents, Updated, and Values hold, in
+// merge order, the parents that changed the index, the time each parent node was last
+// updated, and each parent's value, which is nil if the parent deleted the index.
+type MergeConflict struct {
+	Name    dvid.DataString
+	Index   []byte
+	Base    []byte
+	Parents []dvid.UUID
+	Updated []time.Time
+	Values  [][]byte
+}
+
+// MergeResolver is a data service that can resolve merge conflicts by returning the
+// value stored in the merge node, or nil to delete the index there.  Merges of data
+// whose type is not a MergeResolver fail if there are any conflicts.
+type MergeResolver interface {
+	ResolveConflict(conflict *MergeConflict) ([]byte, error)
+}
+
+// changedValue is the version of a parent's ancestry that last changed an index since
+// the parents' common ancestry, either storing a value or deleting the index.
+type changedValue struct {
+	version dvid.VersionLocalID
+	deleted bool
+}
+
+// mergeWrite is a value written into a merge node, either copied from a version or
+// given by a resolver, or a deletion of the index.
+type mergeWrite struct {
+	index   []byte
+	version dvid.VersionLocalID
+	value   []byte
+	deleted bool
+}
+
+// mergePlan holds the writes needed to merge the data of parents.
+type mergePlan struct {
+	data      DataService
+	dsetID    dvid.DatasetLocalID
+	dataID    dvid.DataLocalID
+	writes    []mergeWrite
+	conflicts int
+}
+
+// changedIndices returns the indices of data that resolve, in the given ancestry of a
+// parent, to a version not shared by all parents.  Only the keys of unshared versions
+// are read, so the common ancestry is not scanned.  An index is unchanged if a shared
+// version read before the unshared one also stores or deletes it.
+func (s *Service) changedIndices(dsetID dvid.DatasetLocalID, dataID dvid.DataLocalID,
+	versions []dvid.VersionLocalID, shared map[dvid.VersionLocalID]bool) (map[string]changedValue, error) {
+
+	changed := make(map[string]changedValue)
+	seen := make(map[string]bool)
+	for pos, versionID := range versions {
+		if shared[versionID] {
+			continue
+		}
+		var indices []string
+		var deletions []bool
+		minKey, maxKey := versionKeyRange(dsetID, dataID, versionID)
+		keys, err := s.kvGetter.KeysInRange(context.Background(), minKey, maxKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			dataKey, ok := key.(*DataKey)
+			if !ok || dataKey.Dataset != dsetID || dataKey.Data != dataID || dataKey.Version != versionID {
+				continue
+			}
+			indices = append(indices, string(dataKey.Index.Bytes()))
+			deletions = append(deletions, false)
+		}
+		deleted, err := tombstonedIndices(context.Background(), s.kvGetter, dsetID, dataID, versionID, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range deleted {
+			indices = append(indices, string(index))
+			deletions = append(deletions, true)
+		}
+		for i, index := range indices {
+			if seen[index] {
+				continue
+			}
+			seen[index] = true
+			earlier, err := s.storedAtShared(dsetID, dataID, versions[:pos], shared, index)
+			if err != nil {
+				return nil, err
+			}
+			if !earlier {
+				changed[index] = changedValue{versionID, deletions[i]}
+			}
+		}
+	}
+	return changed, nil
+}
+
+// storedAtShared returns true if any of the given versions that are shared by all
+// parents stores or deletes an index.
+func (s *Service) storedAtShared(dsetID dvid.DatasetLocalID, dataID dvid.DataLocalID,
+	versions []dvid.VersionLocalID, shared map[dvid.VersionLocalID]bool, index string) (bool, error) {
+
+	for _, versionID := range versions {
+		if !shared[versionID] {
+			continue
+		}
+		found, err := s.storedAt(dsetID, dataID, versionID, index)
+		if found || err != nil {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// storedAt returns true if a version stores or deletes an index of data.
+func (s *Service) storedAt(dsetID dvid.DatasetLocalID, dataID dvid.DataLocalID,
+	versionID dvid.VersionLocalID, index string) (bool, error) {
+
+	key := &DataKey{dsetID, dataID, versionID, dvid.IndexBytes(index)}
+	for _, k := range []storage.Key{key, key.Tombstone()} {
+		value, err := s.kvGetter.Get(k)
+		if err != nil {
+			return false, err
+		}
+		if value != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// baseValue returns the value of an index resolved at the parents' common ancestry, or
+// nil if the index is not stored there.
+func (s *Service) baseValue(plan *mergePlan, baseVersions []dvid.VersionLocalID, index string) ([]byte, error) {
+	for _, versionID := range baseVersions {
+		found, err := s.storedAt(plan.dsetID, plan.dataID, versionID, index)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return s.versionValue(plan, versionID, index)
+		}
+	}
+	return nil, nil
+}
+
+// planMerge returns the writes that merge the named data of the given parents, using
+// the data's MergeResolver for conflicts.
+func (s *Service) planMerge(dset *Dataset, parents []dvid.UUID, name dvid.DataString,
+	data versionedData) (*mergePlan, error) {
+
+	plan := &mergePlan{dsetID: data.DatasetID(), dataID: data.LocalID()}
+
+	// Versions read by all parents hold the common ancestry.
+	ancestries := make([][]dvid.VersionLocalID, len(parents))
+	counts := make(map[dvid.VersionLocalID]int)
+	for i, parent := range parents {
+		versions, err := dset.ancestry(parent, name)
+		if err != nil {
+			return nil, err
+		}
+		ancestries[i] = versions
+		for _, versionID := range versions {
+			counts[versionID]++
+		}
+	}
+	shared := make(map[dvid.VersionLocalID]bool)
+	var baseVersions []dvid.VersionLocalID
+	for _, versionID := range ancestries[0] {
+		if counts[versionID] == len(parents) {
+			shared[versionID] = true
+			baseVersions = append(baseVersions, versionID)
+		}
+	}
+	changes := make([]map[string]changedValue, len(parents))
+	changed := make(map[string]bool)
+	for i, versions := range ancestries {
+		var err error
+		if changes[i], err = s.changedIndices(plan.dsetID, plan.dataID, versions, shared); err != nil {
+			return nil, err
+		}
+		for index := range changes[i] {
+			changed[index] = true
+		}
+	}
+	indices := make([]string, 0, len(changed))
+	for index := range changed {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+
+	resolver, canResolve := data.(MergeResolver)
+	for _, index := range indices {
+		var changers []int
+		for i := range parents {
+			if _, found := changes[i][index]; found {
+				changers = append(changers, i)
+			}
+		}
+		first := changes[changers[0]][index]
+		if len(changers) == 1 {
+			plan.writes = append(plan.writes, mergeWrite{index: []byte(index), version: first.version,
+				deleted: first.deleted})
+			continue
+		}
+
+		// Values are only read for indices changed by more than one parent.
+		values := make([][]byte, len(changers))
+		conflict := false
+		for n, i := range changers {
+			change := changes[i][index]
+			if !change.deleted {
+				value, err := s.versionValue(plan, change.version, index)
+				if err != nil {
+					return nil, err
+				}
+				values[n] = value
+			}
+			if change.deleted != first.deleted || !bytes.Equal(values[n], values[0]) {
+				conflict = true
+			}
+		}
+		if !conflict {
+			plan.writes = append(plan.writes, mergeWrite{index: []byte(index), version: first.version,
+				deleted: first.deleted})
+			continue
+		}
+		if !canResolve {
+			return nil, fmt.Errorf("Data '%s' has conflicting changes at index %x and cannot resolve conflicts",
+				name, index)
+		}
+		base, err := s.baseValue(plan, baseVersions, index)
+		if err != nil {
+			return nil, err
+		}
+		mergeConflict := &MergeConflict{Name: name, Index: []byte(index), Base: base, Values: values}
+		for _, i := range changers {
+			mergeConflict.Parents = append(mergeConflict.Parents, parents[i])
+			mergeConflict.Updated = append(mergeConflict.Updated, dset.Nodes[parents[i]].Updated)
+		}
+		value, err := resolver.ResolveConflict(mergeConflict)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to merge data '%s' at index %x: %s", name, index, err.Error())
+		}
+		plan.writes = append(plan.writes, mergeWrite{index: []byte(index), value: value, deleted: value == nil})
+		plan.conflicts++
+	}
+	return plan, nil
+}
+
+// versionValue returns the value of an index stored at a version of planned data.
+func (s *Service) versionValue(plan *mergePlan, versionID dvid.VersionLocalID, index string) ([]byte, error) {
+	return s.kvGetter.Get(&DataKey{plan.dsetID, plan.dataID, versionID, dvid.IndexBytes(index)})
+}
+
+// MergeEvent is the changelog payload of a merge of version nodes, which writes the
+// values changed by any parent into the merged node.
+type MergeEvent struct {
+	Parents   []dvid.UUID
+	Values    int
+	Conflicts int
+}
+
+// applyMerge writes the planned values and deletions into the merged node with the
+// given UUID and version.  The last batch of writes is committed with the merge's
+// changelog event.
+func (s *Service) applyMerge(plan *mergePlan, parents []dvid.UUID, u dvid.UUID,
+	versionID dvid.VersionLocalID) error {
+
+	batcher, err := s.Batcher()
+	if err != nil {
+		return err
+	}
+	batch := batcher.NewBatch()
+	for i, write := range plan.writes {
+		key := &DataKey{plan.dsetID, plan.dataID, versionID, dvid.IndexBytes(write.index)}
+		value := write.value
+		switch {
+		case write.deleted:
+			batch.Put(key.Tombstone(), tombstoneValue)
+		case value == nil:
+			if value, err = s.versionValue(plan, write.version, string(write.index)); err != nil {
+				return err
+			}
+			fallthrough
+		default:
+			batch.Put(key, value)
+		}
+		if (i+1)%mergeBatchSize == 0 {
+			if err = batch.Commit(); err != nil {
+				return err
+			}
+			batch = batcher.NewBatch()
+		}
+	}
+	event := MutationEvent{Type: "merge", Payload: MergeEvent{parents, len(plan.writes), plan.conflicts}}
+	return s.CommitEvents(batch, plan.data, u, event)
+}
+
+// discardMerge deletes the planned values and deletions written into the merge version
+// of a merge that failed.
+func (s *Service) discardMerge(plan *mergePlan, versionID dvid.VersionLocalID) error {
+	batcher, err := s.Batcher()
+	if err != nil {
+		return err
+	}
+	batch := batcher.NewBatch()
+	for i, write := range plan.writes {
+		key := &DataKey{plan.dsetID, plan.dataID, versionID, dvid.IndexBytes(write.index)}
+		batch.Delete(key)
+		batch.Delete(key.Tombstone())
+		if (i+1)%mergeBatchSize == 0 {
+			if err = batch.Commit(); err != nil {
+				return err
+			}
+			batch = batcher.NewBatch()
+		}
+	}
+	return batch.Commit()
+}
+
+// planMerges returns the plans that merge all versioned data of the given parents in
+// a dataset.
+func (s *Service) planMerges(dset *Dataset, parents []dvid.UUID) (map[dvid.DataString]*mergePlan, error) {
+	dset.mapLock.Lock()
+	dataMap := make(map[dvid.DataString]DataService, len(dset.DataMap))
+	for name, dataservice := range dset.DataMap {
+		dataMap[name] = dataservice
+	}
+	dset.mapLock.Unlock()
+
+	plans := make(map[dvid.DataString]*mergePlan)
+	for name, dataservice := range dataMap {
+		data, ok := dataservice.(versionedData)
+		if !ok || !dataservice.IsVersioned() {
+			continue
+		}
+		plan, err := s.planMerge(dset, parents, name, data)
+		if err != nil {
+			return nil, err
+		}
+		plan.data = dataservice
+		plans[name] = plan
+	}
+	return plans, nil
+}
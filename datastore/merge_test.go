@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestMergeVersions(c *C) {
+	dir := c.MkDir()
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child1, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	child2, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+
+	_, err = service.MergeVersions([]dvid.UUID{child1, child2})
+	c.Assert(err, NotNil) // parents are not locked
+	c.Assert(service.Lock(child1), IsNil)
+	c.Assert(service.Lock(child2), IsNil)
+	_, err = service.MergeVersions([]dvid.UUID{child1})
+	c.Assert(err, NotNil)
+	_, err = service.MergeVersions([]dvid.UUID{child1, child1})
+	c.Assert(err, NotNil)
+	otherRoot, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.Lock(otherRoot), IsNil)
+	_, err = service.MergeVersions([]dvid.UUID{child1, otherRoot})
+	c.Assert(err, NotNil)
+
+	merged, err := service.MergeVersions([]dvid.UUID{child2, child1})
+	c.Assert(err, IsNil)
+	dset, err := service.DatasetFromUUID(merged)
+	c.Assert(err, IsNil)
+	c.Assert(dset.Nodes[merged].Parents, DeepEquals, []dvid.UUID{child2, child1})
+	c.Assert(dset.Nodes[child1].Children, DeepEquals, []dvid.UUID{merged})
+	c.Assert(dset.Nodes[child2].Children, DeepEquals, []dvid.UUID{merged})
+	service.Shutdown()
+
+	service, err = Open(dir)
+	c.Assert(err, IsNil)
+	defer service.Shutdown()
+	dset, err = service.DatasetFromUUID(merged)
+	c.Assert(err, IsNil)
+	c.Assert(dset.Nodes[merged].Parents, DeepEquals, []dvid.UUID{child2, child1})
+}
+
+// resolvingData joins the conflicting values of a merge after the base value.
+type resolvingData struct {
+	*Data
+}
+
+func (d *resolvingData) DoRPC(ctx context.Context, request Request, reply *Response) error {
+	return nil
+}
+
+func (d *resolvingData) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (d *resolvingData) ResolveConflict(conflict *MergeConflict) ([]byte, error) {
+	values := [][]byte{conflict.Base}
+	values = append(values, conflict.Values...)
+	return bytes.Join(values, []byte("+")), nil
+}
+
+func (s *DataSuite) TestMergeConflicts(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", config), IsNil)
+	dset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	data := dset.DataMap["mydata"].(*testData)
+	put := func(u dvid.UUID, index, value string) {
+		key := data.DataKey(dset.VersionMap[u], dvid.IndexBytes(index))
+		c.Assert(service.kvSetter.Put(key, []byte(value)), IsNil)
+	}
+	get := func(u dvid.UUID, index string) string {
+		value, err := service.kvGetter.Get(data.DataKey(dset.VersionMap[u], dvid.IndexBytes(index)))
+		c.Assert(err, IsNil)
+		return string(value)
+	}
+	put(root, "a", "base a")
+	put(root, "b", "base b")
+	put(root, "c", "base c")
+	put(root, "e", "base e")
+	c.Assert(service.Lock(root), IsNil)
+	child1, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	child2, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	put(child1, "a", "one a")
+	put(child1, "b", "one b")
+	put(child1, "e", "one e")
+	put(child2, "b", "two b")
+	put(child2, "d", "two d")
+	deleted := data.DataKey(dset.VersionMap[child2], dvid.IndexBytes("e")).Tombstone()
+	c.Assert(service.kvSetter.Put(deleted, tombstoneValue), IsNil)
+	c.Assert(service.Lock(child1), IsNil)
+	c.Assert(service.Lock(child2), IsNil)
+
+	// Without a resolver, the conflicting change of "b" fails the merge.
+	_, err = service.MergeVersions([]dvid.UUID{child1, child2})
+	c.Assert(err, NotNil)
+	c.Assert(dset.Nodes[child1].Children, HasLen, 0)
+
+	dset.DataMap["mydata"] = &resolvingData{data.Data}
+	merged, err := service.MergeVersions([]dvid.UUID{child1, child2})
+	c.Assert(err, IsNil)
+	c.Assert(get(merged, "a"), Equals, "one a")
+	c.Assert(get(merged, "b"), Equals, "base b+one b+two b")
+	c.Assert(get(merged, "c"), Equals, "")
+	c.Assert(get(merged, "d"), Equals, "two d")
+
+	// A deleting parent's value is nil.
+	c.Assert(get(merged, "e"), Equals, "base e+one e+")
+}
@@ -0,0 +1,618 @@
+/*
+	This file supports upgrading datastores created by older DVID versions to the on-disk
+	formats of this version, e.g., key encodings and the schema and serialization envelope
+	of stored metadata.  Each upgrade is a registered Migration.  A datastore is migrated
+	by copying it, running the needed migrations on the copy, and validating the result,
+	so a failure leaves the original datastore untouched.  The migrated copy either goes
+	into a new directory or replaces the original.
+
+	All key/value pairs are copied, including those of key types unknown to this version,
+	and the copy must hold as many key/value pairs as were read from the original.
+*/
+
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Number of key/value pairs copied per batch when copying a datastore for migration.
+const migrationBatchSize = 1000
+
+// Migration is an upgrade of the on-disk format of a datastore.
+type Migration struct {
+	Name        string
+	Description string
+
+	// Needed returns true if the datastore is not yet in the format of the migration.
+	Needed func(s *Service) (bool, error)
+
+	// Run upgrades the datastore as a job with the given limits.
+	Run func(s *Service, limits JobLimits) error
+
+	// Validate returns an error if the datastore is not in the format of the migration.
+	Validate func(s *Service) error
+}
+
+var (
+	// Migrations in the order they are run.
+	migrations = []*Migration{
+		{
+			Name:        "metadata",
+			Description: "rewrites datasets metadata in the current schema and serialization envelope",
+			Needed:      metadataMigrationNeeded,
+			Run:         migrateMetadata,
+			Validate:    validateMetadata,
+		},
+		{
+			Name:        "keys",
+			Description: "rewrites data keys into the latest key encoding",
+			Needed:      keyMigrationNeeded,
+			Run:         migrateToLatestKeys,
+			Validate:    validateKeys,
+		},
+		{
+			Name:        "envelopes",
+			Description: "rewrites serialized data values in the current serialization envelope",
+			Needed:      envelopeMigrationNeeded,
+			Run:         migrateEnvelopes,
+			Validate:    validateEnvelopes,
+		},
+	}
+	migrationsLock sync.RWMutex
+)
+
+// RegisterMigration adds a migration run after all previously registered ones, usually
+// in an init() of the release that changes an on-disk format.
+func RegisterMigration(m *Migration) error {
+	if m.Name == "" || m.Needed == nil || m.Run == nil || m.Validate == nil {
+		return fmt.Errorf("Migration must have a name and Needed, Run, and Validate functions")
+	}
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+	for _, registered := range migrations {
+		if registered.Name == m.Name {
+			return fmt.Errorf("Migration '%s' is already registered", m.Name)
+		}
+	}
+	migrations = append(migrations, m)
+	return nil
+}
+
+// Migrations returns the registered migrations in the order they are run.
+func Migrations() []*Migration {
+	migrationsLock.RLock()
+	defer migrationsLock.RUnlock()
+	return append([]*Migration{}, migrations...)
+}
+
+// NeededMigrations returns the migrations the datastore needs in the order they are run.
+func (s *Service) NeededMigrations() ([]*Migration, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	var needed []*Migration
+	for _, m := range Migrations() {
+		isNeeded, err := m.Needed(s)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to check migration '%s': %s", m.Name, err.Error())
+		}
+		if isNeeded {
+			needed = append(needed, m)
+		}
+	}
+	return needed, nil
+}
+
+// MigrationReport describes a migration of a datastore.
+type MigrationReport struct {
+	// Path of the migrated datastore.
+	Path string
+
+	// Names of the migrations needed by the datastore, which were all run unless this
+	// was a dry run.
+	Needed []string
+
+	// Keys is the number of key/value pairs copied from the original datastore.
+	Keys int64
+
+	DryRun bool
+}
+
+func (r *MigrationReport) String() string {
+	if len(r.Needed) == 0 {
+		return fmt.Sprintf("Datastore %s is up to date and needs no migrations.", r.Path)
+	}
+	if r.DryRun {
+		return fmt.Sprintf("Datastore %s needs migrations: %s", r.Path, strings.Join(r.Needed, ", "))
+	}
+	return fmt.Sprintf("Migrated datastore %s with %d key/value pairs: %s", r.Path, r.Keys,
+		strings.Join(r.Needed, ", "))
+}
+
+// MigrateDatastore upgrades the datastore at path, which must not be open, to the
+// on-disk formats of this DVID.  If newPath is not empty, the migrated datastore is
+// written there and the original is left as is.  Otherwise the migrated datastore
+// replaces the original.  Either way the original is copied and the migrations run on
+// the copy, which is removed if any migration or validation fails.  A dry run only
+// reports the needed migrations.  Copying and migrating run as jobs with the given
+// limits.
+func MigrateDatastore(path, newPath string, dryRun bool, limits JobLimits) (*MigrationReport, error) {
+	report := &MigrationReport{Path: path, DryRun: dryRun}
+	needed, err := neededMigrationsAt(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range needed {
+		report.Needed = append(report.Needed, m.Name)
+	}
+	if dryRun || (len(needed) == 0 && newPath == "") {
+		return report, nil
+	}
+
+	target := newPath
+	if target == "" {
+		target = path + ".migrating"
+	}
+	if _, err := os.Stat(target); err == nil {
+		return nil, fmt.Errorf("Cannot migrate into existing path %s", target)
+	}
+	report.Keys, err = copyDatastore(path, target, limits)
+	if err == nil {
+		err = migrateCopy(target, limits)
+	}
+	if err != nil {
+		if removeErr := os.RemoveAll(target); removeErr != nil {
+			dvid.Error("Unable to remove failed migration at %s: %s", target, removeErr.Error())
+		}
+		return nil, fmt.Errorf("Migration of %s failed and was rolled back: %s", path, err.Error())
+	}
+	if newPath != "" {
+		report.Path = newPath
+		return report, nil
+	}
+
+	// Swap the migrated copy into place, keeping the original until the swap succeeds.
+	original := path + ".premigrate"
+	if err = os.Rename(path, original); err != nil {
+		os.RemoveAll(target)
+		return nil, fmt.Errorf("Unable to replace %s with migrated datastore: %s", path, err.Error())
+	}
+	if err = os.Rename(target, path); err != nil {
+		if restoreErr := os.Rename(original, path); restoreErr != nil {
+			return nil, fmt.Errorf("Unable to replace datastore with migrated copy (%s) and the "+
+				"original remains at %s: %s", err.Error(), original, restoreErr.Error())
+		}
+		os.RemoveAll(target)
+		return nil, fmt.Errorf("Unable to replace %s with migrated datastore: %s", path, err.Error())
+	}
+	if err = os.RemoveAll(original); err != nil {
+		dvid.Error("Unable to remove original datastore at %s: %s", original, err.Error())
+	}
+	return report, nil
+}
+
+// neededMigrationsAt returns the migrations needed by the datastore at a path.
+func neededMigrationsAt(path string) ([]*Migration, error) {
+	s, openErr := Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer s.Shutdown()
+	return s.NeededMigrations()
+}
+
+// migrateCopy runs the needed migrations on the datastore at a path and validates the
+// datasets it holds afterwards.
+func migrateCopy(path string, limits JobLimits) error {
+	s, openErr := Open(path)
+	if openErr != nil {
+		return openErr
+	}
+	defer s.Shutdown()
+	before := s.datasetSummary()
+	needed, err := s.NeededMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range needed {
+		dvid.Log(dvid.Normal, "Running migration '%s', which %s\n", m.Name, m.Description)
+		if err = m.Run(s, limits); err != nil {
+			return fmt.Errorf("Migration '%s' failed: %s", m.Name, err.Error())
+		}
+		if err = m.Validate(s); err != nil {
+			return fmt.Errorf("Migration '%s' did not validate: %s", m.Name, err.Error())
+		}
+	}
+
+	// The datasets read back from storage must match those before migration.
+	stored := new(Datasets)
+	if err = stored.Load(s.kvGetter); err != nil {
+		return fmt.Errorf("Unable to read migrated datasets: %s", err.Error())
+	}
+	if err = stored.VerifyCompiledTypes(); err != nil {
+		return fmt.Errorf("Migrated datasets are not supported: %s", err.Error())
+	}
+	after := stored.datasetSummary()
+	for root, names := range before {
+		if after[root] != names {
+			return fmt.Errorf("Dataset %s has data (%s) after migration instead of (%s)", root,
+				after[root], names)
+		}
+	}
+	if len(after) != len(before) {
+		return fmt.Errorf("Migrated datastore has %d datasets instead of %d", len(after), len(before))
+	}
+	return nil
+}
+
+// datasetSummary returns the sorted data names of each dataset by root UUID.
+func (dsets *Datasets) datasetSummary() map[dvid.UUID]string {
+	summary := make(map[dvid.UUID]string, len(dsets.list))
+	for _, dset := range dsets.list {
+		var names []string
+		for name := range dset.DataMap {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		summary[dset.Root] = strings.Join(names, ", ")
+	}
+	return summary
+}
+
+// rawKey is a storage key of any key type, used to copy stored key/value pairs as is.
+type rawKey []byte
+
+func (k rawKey) KeyType() storage.KeyType {
+	if len(k) == 0 {
+		return storage.KeyDatasets
+	}
+	return storage.KeyType(k[0])
+}
+
+func (k rawKey) BytesToKey(b []byte) (storage.Key, error) {
+	return rawKey(append([]byte{}, b...)), nil
+}
+
+func (k rawKey) Bytes() []byte {
+	return []byte(k)
+}
+
+func (k rawKey) BytesString() string {
+	return string(k)
+}
+
+func (k rawKey) String() string {
+	return fmt.Sprintf("%x", []byte(k))
+}
+
+// copyDatastore copies all key/value pairs of the datastore at path into a new datastore
+// at newPath, returning the number of key/value pairs copied.
+func copyDatastore(path, newPath string, limits JobLimits) (int64, error) {
+	srcEngine, err := storage.NewStore(path, false, StoreSettings)
+	if err != nil {
+		return 0, fmt.Errorf("Error opening datastore (%s): %s", path, err.Error())
+	}
+	defer srcEngine.Close()
+	src, ok := srcEngine.(storage.KeyValueGetter)
+	if !ok {
+		return 0, fmt.Errorf("Datastore at %s cannot get key-value pairs", path)
+	}
+	dstEngine, err := storage.NewStore(newPath, true, StoreSettings)
+	if err != nil {
+		return 0, fmt.Errorf("Error initializing datastore (%s): %s", newPath, err.Error())
+	}
+	defer dstEngine.Close()
+	batcher, ok := dstEngine.(storage.Batcher)
+	if !ok {
+		return 0, fmt.Errorf("Datastore at %s does not support batch write", newPath)
+	}
+
+	job := StartJob("migration", fmt.Sprintf("copy datastore %s to %s", path, newPath), limits)
+	defer job.Finish()
+
+	// Every key starts with a key type byte less than 0xff, so the range holds keys of all
+	// types, including those unknown to this DVID.
+	var numKeys int64
+	var numBatched int
+	var commitErr error
+	batch := batcher.NewBatch()
+	minKey, maxKey := rawKey{}, rawKey{0xff}
+	err = src.ProcessRange(job.Context(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		if commitErr != nil {
+			return
+		}
+		key := chunk.K.(rawKey)
+		job.Throttle(len(key) + len(chunk.V))
+		batch.Put(key, chunk.V)
+		numBatched++
+		if numBatched >= migrationBatchSize {
+			if commitErr = batch.Commit(); commitErr != nil {
+				return
+			}
+			batch = batcher.NewBatch()
+			numKeys += int64(numBatched)
+			numBatched = 0
+		}
+	})
+	if err == nil {
+		err = commitErr
+	}
+	if err != nil {
+		return numKeys, fmt.Errorf("Error copying datastore %s: %s", path, err.Error())
+	}
+	if numBatched != 0 {
+		if err = batch.Commit(); err != nil {
+			return numKeys, err
+		}
+		numKeys += int64(numBatched)
+	}
+
+	// The copy must hold every key/value pair read from the original.
+	dst, ok := dstEngine.(storage.KeyValueGetter)
+	if !ok {
+		return numKeys, fmt.Errorf("Datastore at %s cannot get key-value pairs", newPath)
+	}
+	var numCopied int64
+	err = dst.ProcessRange(job.Context(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		numCopied++
+	})
+	if err != nil {
+		return numKeys, fmt.Errorf("Error counting copied key/value pairs: %s", err.Error())
+	}
+	if numCopied != numKeys {
+		return numKeys, fmt.Errorf("Copied datastore %s has %d key/value pairs instead of the %d in %s",
+			newPath, numCopied, numKeys, path)
+	}
+	dvid.Log(dvid.Normal, "Copied %d key/value pairs from datastore %s to %s\n", numKeys, path, newPath)
+	return numKeys, nil
+}
+
+// metadataMigrationNeeded returns true if the datasets list is not stored as JSON in an
+// object envelope or any dataset is not stored in the current envelope.
+func metadataMigrationNeeded(s *Service) (bool, error) {
+	value, err := s.kvGetter.Get(&DatasetsKey{})
+	if err != nil {
+		return false, err
+	}
+	env, err := dvid.DecodeEnvelope(value)
+	if err != nil {
+		return false, err
+	}
+	if env.Encoding != dvid.JSONEncoding {
+		return true, nil
+	}
+	keyvalues, err := s.kvGetter.GetRange(context.Background(), MinDatasetKey(), MaxDatasetKey())
+	if err != nil {
+		return false, err
+	}
+	for _, kv := range keyvalues {
+		env, err := dvid.DecodeEnvelope(kv.V)
+		if err != nil {
+			return false, fmt.Errorf("Dataset with key %s: %s", kv.K, err.Error())
+		}
+		if env.Version != dvid.CurrentEnvelope {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// migrateMetadata stores the datasets list and every dataset anew.
+func migrateMetadata(s *Service, limits JobLimits) error {
+	if err := s.Datasets.Put(s.kvSetter); err != nil {
+		return err
+	}
+	for _, dset := range s.Datasets.list {
+		if err := dset.Put(s.kvSetter); err != nil {
+			return err
+		}
+	}
+	s.InvalidateMetadata()
+	return nil
+}
+
+func validateMetadata(s *Service) error {
+	needed, err := metadataMigrationNeeded(s)
+	if err != nil {
+		return err
+	}
+	if needed {
+		return fmt.Errorf("Datasets metadata is still stored in an earlier format")
+	}
+	return nil
+}
+
+// keyMigrationNeeded returns true if the datastore does not use the latest key encoding
+// or has keys left in stale encodings.
+func keyMigrationNeeded(s *Service) (bool, error) {
+	s.Datasets.writeLock.Lock()
+	numStale := len(s.Datasets.staleKeyEncodings)
+	s.Datasets.writeLock.Unlock()
+	return CurrentKeyEncoding() != LatestKeyEncoding || numStale != 0, nil
+}
+
+func migrateToLatestKeys(s *Service, limits JobLimits) error {
+	_, err := s.MigrateKeys(LatestKeyEncoding, limits)
+	return err
+}
+
+// validateKeys checks that the datastore uses the latest key encoding and that no data
+// keys remain in other encodings.
+func validateKeys(s *Service) error {
+	if needed, _ := keyMigrationNeeded(s); needed {
+		return fmt.Errorf("Datastore uses key encoding %d instead of %d", CurrentKeyEncoding(),
+			LatestKeyEncoding)
+	}
+	for _, encoding := range KeyEncodings() {
+		if encoding == LatestKeyEncoding {
+			continue
+		}
+		found, err := s.hasEncodedKeys(encoding)
+		if err != nil {
+			return err
+		}
+		if found {
+			return fmt.Errorf("Data keys remain in key encoding %d", encoding)
+		}
+	}
+	return nil
+}
+
+// hasEncodedKeys returns true if any data key is stored in the key encoding.
+func (s *Service) hasEncodedKeys(encoding KeyEncoding) (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var found bool
+	minKey, maxKey := encodedKeyRange(encoding)
+	err := s.kvGetter.ProcessRange(ctx, minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		if key, ok := chunk.K.(*encodedKey); ok && key.encoding == encoding {
+			found = true
+			cancel()
+		}
+	})
+	if found {
+		return true, nil
+	}
+	return false, err
+}
+
+// SerializedIndexer is data that stores values serialized by dvid.SerializeData at some
+// of its indices, e.g., its blocks, which the envelope migration rewrites in the current
+// serialization envelope.  Values of data that is not a SerializedIndexer are left as
+// stored.
+type SerializedIndexer interface {
+	SerializedIndex(index []byte) bool
+}
+
+// legacyEnvelope returns true if a value is a readable serialization in the legacy
+// envelope.  Values that can't be deserialized are left to verification.
+func legacyEnvelope(value []byte) bool {
+	if len(value) == 0 {
+		return false
+	}
+	env, err := dvid.DecodeEnvelope(value)
+	if err != nil || env.Version != dvid.LegacyEnvelope {
+		return false
+	}
+	_, _, err = dvid.DeserializeData(value, env.Checksum == dvid.NoChecksum)
+	return err == nil
+}
+
+// processLegacyEnvelopes calls f with each serialized data value stored in the legacy
+// envelope until the context is canceled.
+func (s *Service) processLegacyEnvelopes(ctx context.Context, f func(key storage.Key, value []byte)) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	for _, dset := range s.Datasets.list {
+		for _, dataservice := range dset.DataMap {
+			indexer, ok := dataservice.(SerializedIndexer)
+			if !ok {
+				continue
+			}
+			data, ok := dataservice.(profiledData)
+			if !ok {
+				continue
+			}
+			minKey, maxKey := data.dataKeyRange()
+			err := s.kvGetter.ProcessRange(ctx, minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+				dataKey, ok := chunk.K.(*DataKey)
+				if !ok || dataKey.Index == nil || !indexer.SerializedIndex(dataKey.Index.Bytes()) {
+					return
+				}
+				if legacyEnvelope(chunk.V) {
+					f(chunk.K, chunk.V)
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// envelopeMigrationNeeded returns true if any serialized data value is stored in the
+// legacy envelope.
+func envelopeMigrationNeeded(s *Service) (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var found bool
+	err := s.processLegacyEnvelopes(ctx, func(key storage.Key, value []byte) {
+		found = true
+		cancel()
+	})
+	if found {
+		return true, nil
+	}
+	return false, err
+}
+
+// migrateEnvelopes rewrites serialized data values from the legacy envelope into the
+// current one.  Checksums and possibly compressed data are unchanged.
+func migrateEnvelopes(s *Service, limits JobLimits) error {
+	batcher, err := s.Batcher()
+	if err != nil {
+		return err
+	}
+	job := StartJob("migration", "rewrite serialization envelopes", limits)
+	defer job.Finish()
+
+	var numMigrated, numBatched int
+	var migrateErr error
+	batch := batcher.NewBatch()
+	err = s.processLegacyEnvelopes(job.Context(), func(key storage.Key, value []byte) {
+		if migrateErr != nil {
+			return
+		}
+		job.Throttle(len(value))
+		var migrated []byte
+		if migrated, migrateErr = dvid.MigrateEnvelope(value); migrateErr != nil {
+			return
+		}
+		batch.Put(key, migrated)
+		numBatched++
+		if numBatched >= migrationBatchSize {
+			if migrateErr = batch.Commit(); migrateErr != nil {
+				return
+			}
+			batch = batcher.NewBatch()
+			numMigrated += numBatched
+			numBatched = 0
+		}
+	})
+	if err == nil {
+		err = migrateErr
+	}
+	if err != nil {
+		return err
+	}
+	if numBatched != 0 {
+		if err = batch.Commit(); err != nil {
+			return err
+		}
+		numMigrated += numBatched
+	}
+	job.Logf("Rewrote %d serialized values in the current envelope", numMigrated)
+	return nil
+}
+
+func validateEnvelopes(s *Service) error {
+	needed, err := envelopeMigrationNeeded(s)
+	if err != nil {
+		return err
+	}
+	if needed {
+		return fmt.Errorf("Serialized data values remain in the legacy envelope")
+	}
+	return nil
+}
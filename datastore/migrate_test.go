@@ -0,0 +1,258 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+func (s *DataSuite) TestMigrateKeys(c *C) {
+	compiled := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype", "example.com/testtype", "0.1")}}
+	CompiledTypes[compiled.DatatypeUrl()] = compiled
+	defer delete(CompiledTypes, compiled.DatatypeUrl())
+
+	oldBatchSize := keyMigrationBatchSize
+	keyMigrationBatchSize = 2
+	defer func() { keyMigrationBatchSize = oldBatchSize }()
+
+	dir := c.MkDir()
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+	c.Assert(CurrentKeyEncoding(), Equals, LatestKeyEncoding)
+
+	// Make the datastore use the legacy key encoding.
+	service.Datasets.keyEncoding = LegacyKeyEncoding
+	c.Assert(service.Datasets.Put(service.kvSetter), IsNil)
+	service.Shutdown()
+	service, err = Open(dir)
+	c.Assert(err, IsNil)
+	c.Assert(CurrentKeyEncoding(), Equals, LegacyKeyEncoding)
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "data", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "data")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	_, rootID, err := service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+
+	values := []string{"a", "b", "c", "d", "e"}
+	for _, value := range values {
+		key := data.DataKey(rootID, dvid.IndexBytes(value))
+		c.Assert(key.Bytes()[0], Equals, byte(storage.KeyData))
+		c.Assert(service.kvSetter.Put(key, []byte(value)), IsNil)
+	}
+
+	_, err = service.MigrateKeys(KeyEncoding(99), JobLimits{})
+	c.Assert(err, NotNil)
+
+	// Keys are not copied while other jobs could modify data.
+	running := StartJob("test", "running job", JobLimits{})
+	c.Assert(CheckKeyMigration(KeyEncodingV1), NotNil)
+	_, err = service.MigrateKeys(KeyEncodingV1, JobLimits{})
+	c.Assert(err, NotNil)
+	running.Finish()
+	c.Assert(KeysReadOnly(), Equals, false)
+
+	migrated, err := service.MigrateKeys(KeyEncodingV1, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(migrated, Equals, int64(len(values)))
+	c.Assert(CurrentKeyEncoding(), Equals, KeyEncodingV1)
+
+	// Data is read through keys in the new encoding and old keys are gone.
+	minKey, maxKey := data.dataKeyRange()
+	c.Assert(minKey.Bytes()[:2], DeepEquals, []byte{byte(storage.KeyEncodedData), byte(KeyEncodingV1)})
+	kvs, err := service.kvGetter.GetRange(context.Background(), minKey, maxKey)
+	c.Assert(err, IsNil)
+	c.Assert(kvs, HasLen, len(values))
+	for i, kv := range kvs {
+		indexBytes, err := DataKeyIndexBytes(kv.K)
+		c.Assert(err, IsNil)
+		c.Assert(string(indexBytes), Equals, values[i])
+		c.Assert(string(kv.V), Equals, values[i])
+	}
+	oldMin, oldMax := encodedKeyRange(LegacyKeyEncoding)
+	keys, err := service.kvGetter.KeysInRange(context.Background(), oldMin, oldMax)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+	jsonStr, err := service.KeyMigrationJSON()
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, `{"KeyEncoding":1,"StaleKeyEncodings":[],"Migration":null}`)
+
+	// Legacy keys can still be decoded.
+	legacy := (&encodedKey{data.DataKey(rootID, dvid.IndexBytes("a")), LegacyKeyEncoding}).Bytes()
+	key, err := minKey.BytesToKey(legacy)
+	c.Assert(err, IsNil)
+	c.Assert(key.(*DataKey).Index, DeepEquals, dvid.Index(dvid.IndexBytes("a")))
+
+	// The new encoding persists.
+	service.Shutdown()
+	service, err = Open(dir)
+	c.Assert(err, IsNil)
+	c.Assert(CurrentKeyEncoding(), Equals, KeyEncodingV1)
+	service.Shutdown()
+}
+
+func (s *DataSuite) TestMigrateDatastore(c *C) {
+	compiled := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype", "example.com/testtype", "0.1")}}
+	CompiledTypes[compiled.DatatypeUrl()] = compiled
+	defer delete(CompiledTypes, compiled.DatatypeUrl())
+
+	// Make a datastore with legacy keys and a Gob-encoded datasets list.
+	dir := filepath.Join(c.MkDir(), "old")
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+	service.Datasets.keyEncoding = LegacyKeyEncoding
+	setKeyEncoding(LegacyKeyEncoding)
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "data", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "data")
+	c.Assert(err, IsNil)
+	_, rootID, err := service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+	values := []string{"a", "b", "c"}
+	for _, value := range values {
+		key := dataservice.(*testData).DataKey(rootID, dvid.IndexBytes(value))
+		c.Assert(service.kvSetter.Put(key, []byte(value)), IsNil)
+	}
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	gobDatasets, err := dvid.Serialize(service.Datasets.serializableStruct(), compression, dvid.CRC32)
+	c.Assert(err, IsNil)
+	c.Assert(service.kvSetter.Put(&DatasetsKey{}, gobDatasets), IsNil)
+	unknownKey := rawKey{0xf0, 'x'}
+	c.Assert(service.kvSetter.Put(unknownKey, []byte("unknown key type")), IsNil)
+	service.Shutdown()
+
+	report, err := MigrateDatastore(dir, "", true, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Needed, DeepEquals, []string{"metadata", "keys"})
+
+	// A failing migration leaves no copy and the original as is.
+	failing := &Migration{
+		Name:     "failing",
+		Needed:   func(s *Service) (bool, error) { return true, nil },
+		Run:      func(s *Service, limits JobLimits) error { return fmt.Errorf("failed") },
+		Validate: func(s *Service) error { return nil },
+	}
+	c.Assert(RegisterMigration(failing), IsNil)
+	c.Assert(RegisterMigration(failing), NotNil)
+	_, err = MigrateDatastore(dir, "", false, JobLimits{})
+	migrationsLock.Lock()
+	migrations = migrations[:len(migrations)-1]
+	migrationsLock.Unlock()
+	c.Assert(err, NotNil)
+	_, err = os.Stat(dir + ".migrating")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	report, err = MigrateDatastore(dir, "", true, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Needed, HasLen, 2)
+
+	// Migrate into a new directory, leaving the original.
+	newDir := filepath.Join(filepath.Dir(dir), "new")
+	report, err = MigrateDatastore(dir, newDir, false, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Keys > int64(len(values)), Equals, true)
+	report, err = MigrateDatastore(dir, "", true, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Needed, HasLen, 2)
+
+	checkMigrated := func(path string) {
+		var err error
+		service, err := Open(path)
+		c.Assert(err, IsNil)
+		defer service.Shutdown()
+		c.Assert(CurrentKeyEncoding(), Equals, LatestKeyEncoding)
+		needed, err := service.NeededMigrations()
+		c.Assert(err, IsNil)
+		c.Assert(needed, HasLen, 0)
+		dataservice, err := service.DataServiceByUUID(root, "data")
+		c.Assert(err, IsNil)
+		minKey, maxKey := dataservice.(*testData).dataKeyRange()
+		kvs, err := service.kvGetter.GetRange(context.Background(), minKey, maxKey)
+		c.Assert(err, IsNil)
+		c.Assert(kvs, HasLen, len(values))
+		for i, kv := range kvs {
+			c.Assert(string(kv.V), Equals, values[i])
+		}
+		value, err := service.kvGetter.Get(unknownKey)
+		c.Assert(err, IsNil)
+		c.Assert(string(value), Equals, "unknown key type")
+	}
+	checkMigrated(newDir)
+
+	// Migrate in place.
+	report, err = MigrateDatastore(dir, "", false, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Path, Equals, dir)
+	checkMigrated(dir)
+	_, err = os.Stat(dir + ".premigrate")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	report, err = MigrateDatastore(dir, "", false, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(report.Needed, HasLen, 0)
+}
+
+func (s *DataSuite) TestMigrateEnvelopes(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "mydata", dvid.NewConfig()), IsNil)
+	dset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	data := dset.DataMap["mydata"].(*testData)
+	_, rootID, err := service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	current, err := dvid.SerializeData([]byte("current a"), compression, dvid.CRC32)
+	c.Assert(err, IsNil)
+	serialized, err := dvid.SerializeData([]byte("legacy b"), compression, dvid.CRC32)
+	c.Assert(err, IsNil)
+	legacy := append([]byte{serialized[0] &^ 0x01}, serialized[2:]...)
+	values := map[string][]byte{"a": current, "b": legacy, "c": []byte("not serialized")}
+	for index, value := range values {
+		c.Assert(service.kvSetter.Put(data.DataKey(rootID, dvid.IndexBytes(index)), value), IsNil)
+	}
+	get := func(index string) []byte {
+		value, err := service.kvGetter.Get(data.DataKey(rootID, dvid.IndexBytes(index)))
+		c.Assert(err, IsNil)
+		return value
+	}
+
+	// Values of data that doesn't say which are serialized are left as stored.
+	needed, err := envelopeMigrationNeeded(service)
+	c.Assert(err, IsNil)
+	c.Assert(needed, Equals, false)
+
+	dset.DataMap["mydata"] = &serializedData{data.Data}
+	needed, err = envelopeMigrationNeeded(service)
+	c.Assert(err, IsNil)
+	c.Assert(needed, Equals, true)
+	c.Assert(validateEnvelopes(service), NotNil)
+	c.Assert(migrateEnvelopes(service, JobLimits{}), IsNil)
+	c.Assert(validateEnvelopes(service), IsNil)
+
+	env, err := dvid.DecodeEnvelope(get("b"))
+	c.Assert(err, IsNil)
+	c.Assert(env.Version, Equals, dvid.CurrentEnvelope)
+	c.Assert(env.Checksum, Equals, dvid.Checksum(dvid.CRC32))
+	value, _, err := dvid.DeserializeData(get("b"), true)
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "legacy b")
+	c.Assert(get("a"), DeepEquals, current)
+	c.Assert(string(get("c")), Equals, "not serialized")
+}
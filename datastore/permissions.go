@@ -0,0 +1,145 @@
+/*
+	This file supports write permissions of version nodes: writes of data at a node, or at
+	any node of a branch, can be restricted to specific users.
+*/
+
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// WriteRule restricts writes of data at a node to the given users.  If Branch is true,
+// the rule also applies to all descendants of the node that have no closer rule.
+type WriteRule struct {
+	Node   dvid.UUID
+	Branch bool
+	Users  []string
+}
+
+// Allows returns true if the user may write under this rule.
+func (rule *WriteRule) Allows(user string) bool {
+	for _, allowed := range rule.Users {
+		if allowed == user {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionError is returned when a user is not allowed to write at a node.
+type PermissionError struct {
+	Node dvid.UUID
+	User string
+	Rule *WriteRule
+}
+
+func (e *PermissionError) Error() string {
+	user := e.User
+	if user == "" {
+		user = "anonymous user"
+	}
+	if e.Rule.Node == e.Node {
+		return fmt.Sprintf("Writes to node %s are not permitted for %s", e.Node, user)
+	}
+	return fmt.Sprintf("Writes to node %s are not permitted for %s by the rule for branch %s",
+		e.Node, user, e.Rule.Node)
+}
+
+// writeRule returns the rule that applies to a node: the node's own rule, else the
+// branch rule of the closest ancestor in the order of WalkAncestors, or nil if no rule
+// applies.
+func (dset *Dataset) writeRule(u dvid.UUID) (*WriteRule, error) {
+	dset.mapLock.Lock()
+	rules := make(map[dvid.UUID]*WriteRule, len(dset.WriteRules))
+	for _, rule := range dset.WriteRules {
+		rules[rule.Node] = rule
+	}
+	dset.mapLock.Unlock()
+	var applied *WriteRule
+	err := dset.WalkAncestors(u, func(cur dvid.UUID) bool {
+		if rule, found := rules[cur]; found && (cur == u || rule.Branch) {
+			applied = rule
+			return false
+		}
+		return true
+	})
+	return applied, err
+}
+
+// SetWriteRule restricts writes of data at the node with the given UUID, or at its
+// branch if branch is true, to the given users.  If no users are given, the node's
+// rule is removed.
+func (s *Service) SetWriteRule(u dvid.UUID, branch bool, users []string) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	if _, found := dataset.Nodes[u]; !found {
+		return fmt.Errorf("No node found with UUID %s", u)
+	}
+	dataset.mapLock.Lock()
+	var rules []*WriteRule
+	for _, rule := range dataset.WriteRules {
+		if rule.Node != u {
+			rules = append(rules, rule)
+		}
+	}
+	if len(users) != 0 {
+		sorted := append([]string{}, users...)
+		sort.Strings(sorted)
+		rules = append(rules, &WriteRule{Node: u, Branch: branch, Users: sorted})
+	}
+	dataset.WriteRules = rules
+	dataset.mapLock.Unlock()
+	s.InvalidateMetadata()
+	return dataset.Put(s.kvSetter)
+}
+
+// CheckWritePermission returns a *PermissionError if the user may not write data at the
+// node with the given UUID.
+func (s *Service) CheckWritePermission(u dvid.UUID, user string) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	rule, err := dataset.writeRule(u)
+	if err != nil {
+		return err
+	}
+	if rule != nil && !rule.Allows(user) {
+		return &PermissionError{Node: u, User: user, Rule: rule}
+	}
+	return nil
+}
+
+// WriteRuleJSON returns JSON for the write rule that applies to the node with the given
+// UUID, or "null" if writes are unrestricted.
+func (s *Service) WriteRuleJSON(u dvid.UUID) (string, error) {
+	if s.Datasets == nil {
+		return "", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return "", err
+	}
+	rule, err := dataset.writeRule(u)
+	if err != nil {
+		return "", err
+	}
+	m, err := json.Marshal(rule)
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
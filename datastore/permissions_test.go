@@ -0,0 +1,56 @@
+package datastore
+
+import (
+	"strings"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestWriteRules(c *C) {
+	dir := c.MkDir()
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	master, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(service.Lock(master), IsNil)
+	child, err := service.NewVersion(master)
+	c.Assert(err, IsNil)
+	sibling, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(service.CheckWritePermission(child, ""), IsNil)
+
+	// A branch rule applies to descendants, and a node rule overrides it.
+	c.Assert(service.SetWriteRule(master, true, []string{"lead"}), IsNil)
+	c.Assert(service.CheckWritePermission(master, "lead"), IsNil)
+	c.Assert(service.CheckWritePermission(child, "lead"), IsNil)
+	err = service.CheckWritePermission(child, "alice")
+	_, denied := err.(*PermissionError)
+	c.Assert(denied, Equals, true)
+	c.Assert(service.CheckWritePermission(sibling, "alice"), IsNil)
+	c.Assert(service.SetWriteRule(child, false, []string{"alice", "lead"}), IsNil)
+	c.Assert(service.CheckWritePermission(child, "alice"), IsNil)
+	service.Shutdown()
+
+	service, err = Open(dir)
+	c.Assert(err, IsNil)
+	defer service.Shutdown()
+	c.Assert(service.CheckWritePermission(master, "alice"), NotNil)
+	jsonStr, err := service.WriteRuleJSON(child)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(jsonStr, `"Users":["alice","lead"]`), Equals, true)
+	c.Assert(service.SetWriteRule(child, false, nil), IsNil)
+	c.Assert(service.CheckWritePermission(child, "alice"), NotNil)
+	c.Assert(service.SetWriteRule(master, false, nil), IsNil)
+	c.Assert(service.CheckWritePermission(child, "alice"), IsNil)
+	jsonStr, err = service.WriteRuleJSON(child)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, "null")
+}
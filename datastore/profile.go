@@ -0,0 +1,321 @@
+/*
+	This file supports profiling of the stored keyspace.  A profile breaks down the number
+	and size of key/value pairs per data instance, per version, and per index range, e.g.,
+	z-slabs of blocks, for capacity planning and locating bloated regions of data.
+*/
+
+package datastore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// DefaultProfilePrefix is the number of leading index bytes used to group the keys of
+// data without its own index ranges.
+const DefaultProfilePrefix = 4
+
+// IndexRanger is a data service that can name the range of its index holding a stored
+// index, e.g., the z-slab of a block, so profiles can be grouped meaningfully.
+type IndexRanger interface {
+	IndexRange(index []byte) (string, error)
+}
+
+// ProfileOptions control how the keyspace is profiled.
+type ProfileOptions struct {
+	// Stride samples the keyspace by reading only the value of every Stride-th key and
+	// scaling its size.  Keys are always counted exactly.  A Stride of 0 or 1 reads
+	// every value.
+	Stride int
+
+	// PrefixBytes is the number of leading index bytes used to group keys of data that
+	// is not an IndexRanger.  If 0, DefaultProfilePrefix is used.
+	PrefixBytes int
+}
+
+// KeyStats counts key/value pairs and their sizes in bytes.  ValueBytes is an estimate if
+// the keyspace was sampled.
+type KeyStats struct {
+	Keys       int64
+	KeyBytes   int64
+	ValueBytes int64
+}
+
+// add tallies a key and the estimated bytes of the values it stands for.
+func (s *KeyStats) add(keyBytes int, valueBytes int64) {
+	s.Keys++
+	s.KeyBytes += int64(keyBytes)
+	s.ValueBytes += valueBytes
+}
+
+// IndexRangeStats are the KeyStats of one index range of data.
+type IndexRangeStats struct {
+	Range string
+	KeyStats
+}
+
+// DataProfile describes the stored key/value pairs of one data instance.
+type DataProfile struct {
+	Name     dvid.DataString
+	TypeName dvid.TypeString
+
+	// Status is "trash" or "scratch" for deleted or scratch data, or empty otherwise.
+	Status string `json:",omitempty"`
+
+	Total KeyStats
+
+	// Versions holds the stats for each version node, keyed by UUID.
+	Versions map[dvid.UUID]*KeyStats
+
+	// Ranges holds the stats for each index range in the order first stored.
+	Ranges []*IndexRangeStats
+}
+
+// KeyProfile describes the stored key/value pairs of all data in a dataset.
+type KeyProfile struct {
+	Root   dvid.UUID
+	Stride int
+	Total  KeyStats
+	Data   []*DataProfile
+}
+
+// profiledData is fulfilled by any data service embedding Data.
+type profiledData interface {
+	dataKeyRange() (minKey, maxKey *DataKey)
+}
+
+// indexRangeFunc returns a function naming the index range of a stored index.
+func indexRangeFunc(dataservice DataService, prefixBytes int) func([]byte) (string, error) {
+	if ranger, ok := dataservice.(IndexRanger); ok {
+		return ranger.IndexRange
+	}
+	return func(index []byte) (string, error) {
+		if len(index) > prefixBytes {
+			index = index[:prefixBytes]
+		}
+		return hex.EncodeToString(index), nil
+	}
+}
+
+// profileData tallies the stored key/value pairs of a data instance across all versions.
+// If sampling, keys are listed without their values and only every stride-th value is
+// read.
+func profileData(job *Job, db storage.KeyValueGetter, dataservice DataService,
+	uuids map[dvid.VersionLocalID]dvid.UUID, opts ProfileOptions) (*DataProfile, error) {
+
+	data, ok := dataservice.(profiledData)
+	if !ok {
+		return nil, fmt.Errorf("Data '%s' cannot be profiled", dataservice.DataName())
+	}
+	stride := int64(opts.Stride)
+	if stride < 1 {
+		stride = 1
+	}
+	prefixBytes := opts.PrefixBytes
+	if prefixBytes <= 0 {
+		prefixBytes = DefaultProfilePrefix
+	}
+	indexRange := indexRangeFunc(dataservice, prefixBytes)
+
+	profile := &DataProfile{
+		Name:     dataservice.DataName(),
+		TypeName: dataservice.DatatypeName(),
+		Versions: make(map[dvid.UUID]*KeyStats),
+	}
+	ranges := make(map[string]*IndexRangeStats)
+	tally := func(key storage.Key, valueBytes int64) error {
+		dataKey, ok := key.(*DataKey)
+		if !ok {
+			return nil
+		}
+		keyBytes := len(key.Bytes())
+		profile.Total.add(keyBytes, valueBytes)
+
+		uuid, found := uuids[dataKey.Version]
+		if !found {
+			uuid = dvid.UUID(fmt.Sprintf("unknown version %d", dataKey.Version))
+		}
+		versionStats, found := profile.Versions[uuid]
+		if !found {
+			versionStats = new(KeyStats)
+			profile.Versions[uuid] = versionStats
+		}
+		versionStats.add(keyBytes, valueBytes)
+
+		var index []byte
+		if dataKey.Index != nil {
+			index = dataKey.Index.Bytes()
+		}
+		name, err := indexRange(index)
+		if err != nil {
+			return fmt.Errorf("Unable to profile index %x of data '%s': %s", index, profile.Name, err.Error())
+		}
+		rangeStats, found := ranges[name]
+		if !found {
+			rangeStats = &IndexRangeStats{Range: name}
+			ranges[name] = rangeStats
+			profile.Ranges = append(profile.Ranges, rangeStats)
+		}
+		rangeStats.add(keyBytes, valueBytes)
+		return nil
+	}
+
+	minKey, maxKey := data.dataKeyRange()
+	if stride > 1 {
+		keys, err := db.KeysInRange(job.Context(), minKey, maxKey)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			var valueBytes int64
+			if int64(i)%stride == 0 {
+				if job.Cancelled() {
+					return nil, job.Context().Err()
+				}
+				value, err := db.Get(key)
+				if err != nil {
+					return nil, err
+				}
+				job.Throttle(len(value))
+				valueBytes = int64(len(value)) * stride
+			}
+			if err = tally(key, valueBytes); err != nil {
+				return nil, err
+			}
+		}
+		return profile, nil
+	}
+
+	var tallyErr error
+	err := db.ProcessRange(job.Context(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		if tallyErr != nil {
+			return
+		}
+		job.Throttle(len(chunk.V))
+		tallyErr = tally(chunk.K, int64(len(chunk.V)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tallyErr != nil {
+		return nil, tallyErr
+	}
+	return profile, nil
+}
+
+// ProfileKeys profiles the key/value pairs of all data, including deleted and scratch
+// data, in the dataset specified by a UUID.  Profiling scans all key/value pairs of the
+// dataset, so it runs as a job with the given limits.
+func (s *Service) ProfileKeys(u dvid.UUID, opts ProfileOptions, limits JobLimits) (*KeyProfile, error) {
+	job := StartJob("profile", profileJobName(u), limits)
+	defer job.Finish()
+	profile, err := s.profileKeys(job, u, opts)
+	job.SetResult(profile, err)
+	return profile, err
+}
+
+// StartProfileKeys runs ProfileKeys as a background job and returns the job, whose
+// result is the KeyProfile.
+func (s *Service) StartProfileKeys(u dvid.UUID, opts ProfileOptions, limits JobLimits) *Job {
+	return RunJob("profile", profileJobName(u), limits, func(job *Job) (interface{}, error) {
+		profile, err := s.profileKeys(job, u, opts)
+		if profile == nil {
+			return nil, err
+		}
+		return profile, err
+	})
+}
+
+func profileJobName(u dvid.UUID) string {
+	return "profile keys of dataset " + string(u)
+}
+
+// profileKeys does the work of ProfileKeys within a job, reporting progress as each
+// data instance is profiled.
+func (s *Service) profileKeys(job *Job, u dvid.UUID, opts ProfileOptions) (*KeyProfile, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	db, err := s.KeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+
+	dataset.mapLock.Lock()
+	uuids := make(map[dvid.VersionLocalID]dvid.UUID, len(dataset.VersionMap))
+	for uuid, versionID := range dataset.VersionMap {
+		uuids[versionID] = uuid
+	}
+	var dataservices []DataService
+	var statuses []string
+	for _, dataservice := range dataset.DataMap {
+		dataservices = append(dataservices, dataservice)
+		statuses = append(statuses, "")
+	}
+	for _, trashed := range dataset.Trash {
+		dataservices = append(dataservices, trashed.Data)
+		statuses = append(statuses, "trash")
+	}
+	for _, scratch := range dataset.Scratch {
+		dataservices = append(dataservices, scratch.Data)
+		statuses = append(statuses, "scratch")
+	}
+	dataset.mapLock.Unlock()
+
+	profile := &KeyProfile{Root: dataset.Root, Stride: opts.Stride}
+	if profile.Stride < 1 {
+		profile.Stride = 1
+	}
+	for i, dataservice := range dataservices {
+		job.Progress(int64(i), int64(len(dataservices)))
+		dataProfile, err := profileData(job, db, dataservice, uuids, opts)
+		if err != nil {
+			return nil, err
+		}
+		dataProfile.Status = statuses[i]
+		profile.Total.Keys += dataProfile.Total.Keys
+		profile.Total.KeyBytes += dataProfile.Total.KeyBytes
+		profile.Total.ValueBytes += dataProfile.Total.ValueBytes
+		profile.Data = append(profile.Data, dataProfile)
+		job.Logf("Profiled %d keys of data '%s'", dataProfile.Total.Keys, dataProfile.Name)
+	}
+	job.Progress(int64(len(dataservices)), int64(len(dataservices)))
+	sort.Sort(dataProfilesBySize(profile.Data))
+	return profile, nil
+}
+
+// dataProfilesBySize sorts data profiles from largest to smallest.
+type dataProfilesBySize []*DataProfile
+
+func (p dataProfilesBySize) Len() int      { return len(p) }
+func (p dataProfilesBySize) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p dataProfilesBySize) Less(i, j int) bool {
+	sizeI := p[i].Total.KeyBytes + p[i].Total.ValueBytes
+	sizeJ := p[j].Total.KeyBytes + p[j].Total.ValueBytes
+	if sizeI != sizeJ {
+		return sizeI > sizeJ
+	}
+	return p[i].Name < p[j].Name
+}
+
+// ProfileJSON returns JSON for the key profile of the dataset specified by a UUID.
+func (s *Service) ProfileJSON(u dvid.UUID, opts ProfileOptions, limits JobLimits) (string, error) {
+	profile, err := s.ProfileKeys(u, opts, limits)
+	if err != nil {
+		return "", err
+	}
+	m, err := json.Marshal(profile)
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
@@ -0,0 +1,70 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestProfileKeys(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "big", dvid.NewConfig()), IsNil)
+	c.Assert(service.NewData(root, "testtype", "small", dvid.NewConfig()), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+
+	dataservice, err := service.DataServiceByUUID(root, "big")
+	c.Assert(err, IsNil)
+	big := dataservice.(*testData)
+	for _, index := range []string{"aa1", "aa2", "ab1", "ab2"} {
+		c.Assert(service.kvSetter.Put(big.DataKey(0, dvid.IndexBytes(index)), []byte("0123456789")), IsNil)
+	}
+	c.Assert(service.kvSetter.Put(big.DataKey(1, dvid.IndexBytes("aa1")), []byte("01234")), IsNil)
+	dataservice, err = service.DataServiceByUUID(root, "small")
+	c.Assert(err, IsNil)
+	small := dataservice.(*testData)
+	c.Assert(service.kvSetter.Put(small.DataKey(0, dvid.IndexBytes("z")), []byte("0")), IsNil)
+
+	profile, err := service.ProfileKeys(root, ProfileOptions{PrefixBytes: 2}, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(profile.Total.Keys, Equals, int64(6))
+	c.Assert(profile.Total.ValueBytes, Equals, int64(46))
+	c.Assert(profile.Data, HasLen, 2)
+
+	bigProfile := profile.Data[0]
+	c.Assert(bigProfile.Name, Equals, dvid.DataString("big"))
+	c.Assert(bigProfile.Total.Keys, Equals, int64(5))
+	c.Assert(bigProfile.Versions[root].Keys, Equals, int64(4))
+	c.Assert(bigProfile.Versions[root].ValueBytes, Equals, int64(40))
+	c.Assert(bigProfile.Versions[child].ValueBytes, Equals, int64(5))
+	c.Assert(bigProfile.Ranges, HasLen, 2)
+	c.Assert(bigProfile.Ranges[0].Range, Equals, "6161")
+	c.Assert(bigProfile.Ranges[0].Keys, Equals, int64(3))
+	c.Assert(bigProfile.Ranges[1].Range, Equals, "6162")
+	c.Assert(bigProfile.Ranges[1].Keys, Equals, int64(2))
+
+	// Sampling counts every key but scales the sizes of sampled values.
+	profile, err = service.ProfileKeys(root, ProfileOptions{Stride: 2}, JobLimits{})
+	c.Assert(err, IsNil)
+	c.Assert(profile.Stride, Equals, 2)
+	c.Assert(profile.Data[0].Total.Keys, Equals, int64(5))
+	c.Assert(profile.Data[0].Total.KeyBytes, Equals, bigProfile.Total.KeyBytes)
+	c.Assert(profile.Data[0].Total.ValueBytes%2, Equals, int64(0))
+	c.Assert(profile.Data[0].Total.ValueBytes >= 50, Equals, true)
+
+	// Deleted data is still profiled since it occupies storage.
+	c.Assert(service.DeleteData(root, "small"), IsNil)
+	job := service.StartProfileKeys(root, ProfileOptions{}, JobLimits{})
+	<-job.Done()
+	result, err := job.Result()
+	c.Assert(err, IsNil)
+	profile, ok := result.(*KeyProfile)
+	c.Assert(ok, Equals, true)
+	c.Assert(profile.Data, HasLen, 2)
+	c.Assert(profile.Data[1].Status, Equals, "trash")
+}
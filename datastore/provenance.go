@@ -0,0 +1,100 @@
+/*
+	This file supports provenance queries of versioned data: since a version only stores
+	the key/value pairs it writes, the version owning the value of an index read at a
+	node is the first version in the node's ancestry that stores the index.
+*/
+
+package datastore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Provenance gives the version node that last wrote the value of an index read at a
+// node.  Owner is empty if no version read by the node stores the index.  Inherited is
+// true if the owner is an ancestor of the node.
+type Provenance struct {
+	Name      dvid.DataString
+	Index     string
+	Node      dvid.UUID
+	Owner     dvid.UUID `json:",omitempty"`
+	Inherited bool
+	Bytes     int
+}
+
+// Provenance returns the version node that owns the value of an index of the named data
+// as read at the node with the given UUID.
+func (s *Service) Provenance(u dvid.UUID, dataname dvid.DataString, index dvid.Index) (*Provenance, error) {
+	dataservice, err := s.DataServiceByUUID(u, dataname)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := dataservice.(versionedData)
+	if !ok {
+		return nil, fmt.Errorf("Data '%s' does not support provenance queries", dataname)
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.DataVersions(u, dataname)
+	if err != nil {
+		return nil, err
+	}
+	prov := &Provenance{Name: dataname, Index: hex.EncodeToString(index.Bytes()), Node: u}
+	for i, versionID := range versions {
+		key := &DataKey{data.DatasetID(), data.LocalID(), versionID, index}
+		value, err := s.kvGetter.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			tombstone, err := s.kvGetter.Get(key.Tombstone())
+			if err != nil {
+				return nil, err
+			}
+			if tombstone != nil {
+				break
+			}
+			continue
+		}
+		owner, found := dataset.versionUUID(versionID)
+		if !found {
+			return nil, fmt.Errorf("No node found with version %d", versionID)
+		}
+		prov.Owner = owner
+		prov.Inherited = i != 0
+		prov.Bytes = len(value)
+		break
+	}
+	return prov, nil
+}
+
+// ProvenanceJSON returns JSON for the provenance of an index of the named data.
+func (s *Service) ProvenanceJSON(u dvid.UUID, dataname dvid.DataString, index dvid.Index) (string, error) {
+	prov, err := s.Provenance(u, dataname, index)
+	if err != nil {
+		return "", err
+	}
+	m, err := json.Marshal(prov)
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
+
+// versionUUID returns the UUID of the node with the given local version ID.
+func (dag *VersionDAG) versionUUID(versionID dvid.VersionLocalID) (dvid.UUID, bool) {
+	dag.mapLock.Lock()
+	defer dag.mapLock.Unlock()
+	for u, v := range dag.VersionMap {
+		if v == versionID {
+			return u, true
+		}
+	}
+	return "", false
+}
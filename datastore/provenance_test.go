@@ -0,0 +1,43 @@
+package datastore
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestProvenance(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", config), IsNil)
+	dset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	data := dset.DataMap["mydata"].(*testData)
+	key := data.DataKey(dset.VersionMap[root], dvid.IndexBytes("a"))
+	c.Assert(service.kvSetter.Put(key, []byte("root a")), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+
+	prov, err := service.Provenance(child, "mydata", dvid.IndexBytes("a"))
+	c.Assert(err, IsNil)
+	c.Assert(prov.Owner, Equals, root)
+	c.Assert(prov.Inherited, Equals, true)
+	c.Assert(prov.Bytes, Equals, len("root a"))
+
+	key = data.DataKey(dset.VersionMap[child], dvid.IndexBytes("a"))
+	c.Assert(service.kvSetter.Put(key, []byte("child a")), IsNil)
+	prov, err = service.Provenance(child, "mydata", dvid.IndexBytes("a"))
+	c.Assert(err, IsNil)
+	c.Assert(prov.Owner, Equals, child)
+	c.Assert(prov.Inherited, Equals, false)
+
+	prov, err = service.Provenance(child, "mydata", dvid.IndexBytes("b"))
+	c.Assert(err, IsNil)
+	c.Assert(prov.Owner, Equals, dvid.UUID(""))
+}
@@ -0,0 +1,595 @@
+/*
+	This file supports replication of versions between DVID servers.  Like git, a server
+	only transfers the nodes a replica is missing along with the key/value pairs stored
+	at those nodes, which for versioned data are the deltas from their parents.  Since
+	only locked nodes are replicated and locked nodes cannot change, nodes a replica
+	already holds never need to be sent again.  Replicated nodes keep their UUIDs, so a
+	dataset and its replicas share the same root.
+*/
+
+package datastore
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// ReplicationFormat is the version of the stream format written by WriteReplication.
+const ReplicationFormat = 1
+
+// Number of key/value pairs stored per batch when reading a replication stream.
+const replicationBatchSize = 1000
+
+// pendingData is data being added to a dataset by a replication stream.
+type pendingData struct {
+	dsetID dvid.DatasetLocalID
+	name   dvid.DataString
+}
+
+// pendingReplication holds the new datasets, nodes, and data of replication streams
+// being stored, so concurrent streams cannot both add them.  It is only locked while
+// a stream reserves local IDs, not while its key/value pairs are stored.
+var pendingReplication = struct {
+	sync.Mutex
+	roots map[dvid.UUID]bool
+	nodes map[dvid.UUID]bool
+	data  map[pendingData]bool
+}{
+	roots: make(map[dvid.UUID]bool),
+	nodes: make(map[dvid.UUID]bool),
+	data:  make(map[pendingData]bool),
+}
+
+// Replicator is a data service that must update its properties when values of the same
+// data are replicated from another server, e.g., to extend its extents.
+type Replicator interface {
+	Replicated(source DataService) error
+}
+
+// ReplicaState describes what a server holds of a dataset, so a server sending nodes
+// can omit the nodes and values the replica already has.
+type ReplicaState struct {
+	Root  dvid.UUID
+	Nodes []dvid.UUID
+	Data  []dvid.DataString
+}
+
+// replicatedNode is a node in a replication stream.  Local version IDs are
+// server-specific, so the receiving server assigns its own.
+type replicatedNode struct {
+	Version *NodeVersion
+	Text    *NodeText
+	Avail   map[dvid.DataString]DataAvail
+}
+
+// replicationHeader begins a replication stream.
+type replicationHeader struct {
+	Format int
+	Root   dvid.UUID
+	Alias  string
+
+	// Nodes are the transferred nodes with parents before children.
+	Nodes []replicatedNode
+
+	// DataMap is the serialization of the transferred data instances.
+	DataMap []byte
+}
+
+// newReplicatedNode returns a copy of a node for a replication stream.
+func newReplicatedNode(node *Node) replicatedNode {
+	node.writeLock.Lock()
+	defer node.writeLock.Unlock()
+	version := *node.NodeVersion
+	version.Children = nil
+	replicated := replicatedNode{Version: &version, Avail: make(map[dvid.DataString]DataAvail)}
+	if node.NodeText != nil {
+		text := *node.NodeText
+		replicated.Text = &text
+	}
+	for name, avail := range node.Avail {
+		replicated.Avail[name] = avail
+	}
+	return replicated
+}
+
+// replicatedKeyValue is a key/value pair of data stored at a node in a replication
+// stream, or a tombstone of an index deleted at the node if Deleted is set.  A pair
+// without a data name ends the stream.
+type replicatedKeyValue struct {
+	Data    dvid.DataString
+	Node    dvid.UUID
+	Index   []byte
+	Value   []byte
+	Deleted bool
+}
+
+// replicableData is fulfilled by any data service embedding Data.
+type replicableData interface {
+	forkableData
+	setLocalID(dataID dvid.DataLocalID)
+}
+
+func (d *Data) setLocalID(dataID dvid.DataLocalID) {
+	d.DataID.ID = dataID
+}
+
+// ReplicaState returns what this server holds of the dataset with a node of the given
+// UUID.  If this server does not hold the node, it is taken as the root of a dataset
+// and the state lists no nodes or data.
+func (s *Service) ReplicaState(u dvid.UUID) (*ReplicaState, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	state := &ReplicaState{Root: u, Nodes: []dvid.UUID{}, Data: []dvid.DataString{}}
+	dataset, found := s.Datasets.mapUUID[u]
+	if !found {
+		return state, nil
+	}
+	state.Root = dataset.Root
+	dataset.mapLock.Lock()
+	for v := range dataset.Nodes {
+		state.Nodes = append(state.Nodes, v)
+	}
+	names := make([]string, 0, len(dataset.DataMap))
+	for name := range dataset.DataMap {
+		names = append(names, string(name))
+	}
+	dataset.mapLock.Unlock()
+	sort.Sort(uuidsByString(state.Nodes))
+	sort.Strings(names)
+	for _, name := range names {
+		state.Data = append(state.Data, dvid.DataString(name))
+	}
+	return state, nil
+}
+
+// WriteReplication writes a replication stream holding the LOCKED node with the given
+// UUID and those of its ancestors missing from a replica in the given state, along
+// with the key/value pairs of the named data, or all data, stored at the sent nodes.
+// Values of data the replica lacks are sent for all ancestors.  Returns the number of
+// sent nodes and key/value pairs.
+func (s *Service) WriteReplication(w io.Writer, u dvid.UUID, state *ReplicaState,
+	datanames []dvid.DataString) (numNodes, numKeys int, err error) {
+
+	if s.Datasets == nil {
+		err = fmt.Errorf("Datastore service has no datasets available")
+		return
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return
+	}
+	if state.Root != "" && state.Root != dataset.Root {
+		err = fmt.Errorf("Replica of dataset %s cannot receive node %s of dataset %s",
+			state.Root, u, dataset.Root)
+		return
+	}
+	locked, err := s.Locked(u)
+	if err != nil {
+		return
+	}
+	if !locked {
+		err = fmt.Errorf("Cannot replicate unlocked node %s: lock it first", u)
+		return
+	}
+	ancestors, err := dataset.Ancestors(u)
+	if err != nil {
+		return
+	}
+	lineage := append([]dvid.UUID{u}, ancestors...)
+	dataset.mapLock.Lock()
+	sort.Sort(uuidsByVersion{lineage, dataset.VersionMap})
+	dataset.mapLock.Unlock()
+
+	haveNode := make(map[dvid.UUID]bool, len(state.Nodes))
+	for _, v := range state.Nodes {
+		haveNode[v] = true
+	}
+	haveData := make(map[dvid.DataString]bool, len(state.Data))
+	for _, name := range state.Data {
+		haveData[name] = true
+	}
+
+	// Describe the nodes the replica is missing.
+	header := &replicationHeader{Format: ReplicationFormat, Root: dataset.Root, Alias: dataset.Alias}
+	for _, v := range lineage {
+		if haveNode[v] {
+			continue
+		}
+		var node *Node
+		if node, err = dataset.node(v); err != nil {
+			return
+		}
+		header.Nodes = append(header.Nodes, newReplicatedNode(node))
+	}
+
+	// Select the data to send.
+	dataMap, err := dataset.cloneDataMap()
+	if err != nil {
+		return
+	}
+	if len(datanames) != 0 {
+		selected := make(map[dvid.DataString]DataService, len(datanames))
+		for _, name := range datanames {
+			data, found := dataMap[name]
+			if !found {
+				err = fmt.Errorf("No data '%s' in dataset %s", name, dataset.Root)
+				return
+			}
+			selected[name] = data
+		}
+		dataMap = selected
+	}
+	names := make([]string, 0, len(dataMap))
+	for name, data := range dataMap {
+		if _, ok := data.(replicableData); !ok {
+			err = fmt.Errorf("Data '%s' cannot be replicated", name)
+			return
+		}
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	if header.DataMap, err = dvid.Serialize(dataMap, compression, dvid.NoChecksum); err != nil {
+		return
+	}
+
+	enc := gob.NewEncoder(w)
+	if err = enc.Encode(header); err != nil {
+		return
+	}
+	numNodes = len(header.Nodes)
+	for _, name := range names {
+		dataname := dvid.DataString(name)
+		data := dataMap[dataname].(replicableData)
+		dsetID, dataID := dataset.DatasetID, data.LocalID()
+		for _, v := range lineage {
+			if haveNode[v] && haveData[dataname] {
+				continue
+			}
+			dataset.mapLock.Lock()
+			versionID := dataset.VersionMap[v]
+			dataset.mapLock.Unlock()
+			var encodeErr error
+			minKey, maxKey := versionKeyRange(dsetID, dataID, versionID)
+			err = s.kvGetter.ProcessRange(context.Background(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+				if encodeErr != nil {
+					return
+				}
+				dataKey, ok := chunk.K.(*DataKey)
+				if !ok || dataKey.Dataset != dsetID || dataKey.Data != dataID || dataKey.Version != versionID {
+					return
+				}
+				encodeErr = enc.Encode(&replicatedKeyValue{Data: dataname, Node: v, Index: dataKey.Index.Bytes(), Value: chunk.V})
+				numKeys++
+			})
+			if err != nil {
+				return
+			}
+			if encodeErr != nil {
+				err = encodeErr
+				return
+			}
+			var deleted [][]byte
+			deleted, err = tombstonedIndices(context.Background(), s.kvGetter, dsetID, dataID, versionID, nil, nil)
+			if err != nil {
+				return
+			}
+			for _, index := range deleted {
+				if err = enc.Encode(&replicatedKeyValue{Data: dataname, Node: v, Index: index, Deleted: true}); err != nil {
+					return
+				}
+			}
+		}
+	}
+	err = enc.Encode(&replicatedKeyValue{})
+	return
+}
+
+// ReadReplication stores the nodes and key/value pairs of a replication stream written
+// by WriteReplication on another server, creating the dataset if this server does not
+// hold it.  Received nodes and data only become visible after the whole stream has been
+// stored, and values already stored are discarded if the stream fails.  Returns the
+// number of received nodes and key/value pairs.
+func (s *Service) ReadReplication(r io.Reader) (numNodes, numKeys int, err error) {
+	if s.Datasets == nil {
+		err = fmt.Errorf("Datastore service has no datasets available")
+		return
+	}
+	dec := gob.NewDecoder(r)
+	var header replicationHeader
+	if err = dec.Decode(&header); err != nil {
+		err = fmt.Errorf("Unable to read header of replication stream: %s", err.Error())
+		return
+	}
+	if header.Format != ReplicationFormat {
+		err = fmt.Errorf("Replication stream has format %d but this server reads format %d",
+			header.Format, ReplicationFormat)
+		return
+	}
+	return s.storeReplication(&header, func() (*replicatedKeyValue, error) {
+		kv := new(replicatedKeyValue)
+		if err := dec.Decode(kv); err != nil {
+			return nil, fmt.Errorf("Replication stream ended before its last key/value pair: %s", err.Error())
+		}
+		return kv, nil
+	})
+}
+
+// storeReplication stores the nodes and data of a replication stream's header and the
+// key/value pairs returned by next until it returns one without a data name.
+func (s *Service) storeReplication(header *replicationHeader,
+	next func() (*replicatedKeyValue, error)) (numNodes, numKeys int, err error) {
+
+	dataMap := make(map[dvid.DataString]DataService)
+	if err = dvid.Deserialize(header.DataMap, &dataMap); err != nil {
+		return
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return
+	}
+
+	// Reserve local IDs for the dataset, new nodes, and new data, marking them pending.
+	dsets := s.Datasets
+	var dataset *Dataset
+	var found bool
+	versions := make(map[dvid.UUID]dvid.VersionLocalID)
+	newNodes := make(map[dvid.UUID]*Node)
+	var newOrder []dvid.UUID
+	dataIDs := make(map[dvid.DataString]dvid.DataLocalID, len(dataMap))
+	newData := make(map[dvid.DataString]DataService)
+	updatedData := make(map[dvid.DataString]DataService)
+	if err = func() error {
+		pendingReplication.Lock()
+		defer pendingReplication.Unlock()
+		if pendingReplication.roots[header.Root] {
+			return fmt.Errorf("Dataset %s is already being replicated to this server", header.Root)
+		}
+
+		dsets.writeLock.Lock()
+		dataset, found = dsets.mapUUID[header.Root]
+		if !found {
+			dataset = &Dataset{
+				VersionDAG: &VersionDAG{
+					Root:       header.Root,
+					Nodes:      make(map[dvid.UUID]*Node),
+					VersionMap: make(map[dvid.UUID]dvid.VersionLocalID),
+				},
+				Alias:     header.Alias,
+				DatasetID: dsets.newDatasetID,
+				DataMap:   make(map[dvid.DataString]DataService),
+			}
+			dsets.newDatasetID++
+		}
+		dsets.writeLock.Unlock()
+		if dataset.Root != header.Root {
+			return fmt.Errorf("Node %s is not the root of its dataset %s on this server", header.Root, dataset.Root)
+		}
+		dsetID := dataset.DatasetID
+
+		dataset.mapLock.Lock()
+		defer dataset.mapLock.Unlock()
+		for u, versionID := range dataset.VersionMap {
+			versions[u] = versionID
+		}
+		for _, replicated := range header.Nodes {
+			u := replicated.Version.GlobalID
+			if _, exists := versions[u]; exists {
+				continue
+			}
+			if pendingReplication.nodes[u] {
+				return fmt.Errorf("Node %s is already being replicated to this server", u)
+			}
+			if len(replicated.Version.Parents) == 0 && u != header.Root {
+				return fmt.Errorf("Replicated node %s has no parents but is not the root %s", u, header.Root)
+			}
+			for _, parent := range replicated.Version.Parents {
+				if _, exists := versions[parent]; !exists {
+					return fmt.Errorf("Parent %s of replicated node %s is not on this server", parent, u)
+				}
+			}
+			version := replicated.Version
+			version.VersionID = dataset.NewVersionID
+			dataset.NewVersionID++
+			node := &Node{NodeVersion: version, NodeText: replicated.Text, Avail: replicated.Avail}
+			versions[u] = version.VersionID
+			newNodes[u] = node
+			newOrder = append(newOrder, u)
+		}
+		if !found && len(newNodes) == 0 {
+			return fmt.Errorf("Replication stream does not hold root %s of new dataset", header.Root)
+		}
+		for name, data := range dataMap {
+			if existing, exists := dataset.DataMap[name]; exists {
+				if existing.DatatypeUrl() != data.DatatypeUrl() {
+					return fmt.Errorf("Data '%s' has type %s on this server but %s in replication stream",
+						name, existing.DatatypeUrl(), data.DatatypeUrl())
+				}
+				dataIDs[name] = existing.(versionedData).LocalID()
+				updatedData[name] = data
+				continue
+			}
+			if pendingReplication.data[pendingData{dsetID, name}] {
+				return fmt.Errorf("Data '%s' is already being replicated to this server", name)
+			}
+			replicable, ok := data.(replicableData)
+			if !ok {
+				return fmt.Errorf("Data '%s' cannot be replicated", name)
+			}
+			replicable.setDatasetID(dsetID)
+			replicable.setLocalID(dataset.NewDataID)
+			dataIDs[name] = dataset.NewDataID
+			dataset.NewDataID++
+			newData[name] = data
+		}
+
+		if !found {
+			pendingReplication.roots[header.Root] = true
+		}
+		for _, u := range newOrder {
+			pendingReplication.nodes[u] = true
+		}
+		for name := range newData {
+			pendingReplication.data[pendingData{dsetID, name}] = true
+		}
+		return nil
+	}(); err != nil {
+		return
+	}
+	dsetID := dataset.DatasetID
+	defer func() {
+		pendingReplication.Lock()
+		if !found {
+			delete(pendingReplication.roots, header.Root)
+		}
+		for _, u := range newOrder {
+			delete(pendingReplication.nodes, u)
+		}
+		for name := range newData {
+			delete(pendingReplication.data, pendingData{dsetID, name})
+		}
+		pendingReplication.Unlock()
+	}()
+	for _, data := range newData {
+		if forker, ok := data.(Forker); ok {
+			if err = forker.Forked(dsetID); err != nil {
+				return
+			}
+		}
+	}
+
+	// Store received key/value pairs, discarding them if the stream fails.
+	type dataVersion struct {
+		dataID    dvid.DataLocalID
+		versionID dvid.VersionLocalID
+	}
+	written := make(map[dataVersion]bool)
+	batch := batcher.NewBatch()
+	var numBatched int
+	for {
+		var kv *replicatedKeyValue
+		if kv, err = next(); err != nil {
+			break
+		}
+		if kv.Data == "" {
+			break
+		}
+		dataID, ok := dataIDs[kv.Data]
+		if !ok {
+			err = fmt.Errorf("Replication stream holds values of unknown data '%s'", kv.Data)
+			break
+		}
+		versionID, ok := versions[kv.Node]
+		if !ok {
+			err = fmt.Errorf("Replication stream holds values at unknown node %s", kv.Node)
+			break
+		}
+		// Values of data at nodes already on this server cannot have changed.
+		if _, isNew := newData[kv.Data]; !isNew && newNodes[kv.Node] == nil {
+			continue
+		}
+		key := &DataKey{dsetID, dataID, versionID, dvid.IndexBytes(kv.Index)}
+		if kv.Deleted {
+			batch.Put(key.Tombstone(), tombstoneValue)
+		} else {
+			batch.Put(key, kv.Value)
+			numKeys++
+		}
+		written[dataVersion{dataID, versionID}] = true
+		numBatched++
+		if numBatched >= replicationBatchSize {
+			if err = batch.Commit(); err != nil {
+				break
+			}
+			batch = batcher.NewBatch()
+			numBatched = 0
+		}
+	}
+	if err == nil {
+		err = batch.Commit()
+	}
+	for name, data := range updatedData {
+		if err != nil {
+			break
+		}
+		dataset.mapLock.Lock()
+		replicator, ok := dataset.DataMap[name].(Replicator)
+		dataset.mapLock.Unlock()
+		if ok {
+			err = replicator.Replicated(data)
+		}
+	}
+	if err != nil {
+		for dv := range written {
+			minKey, maxKey := versionKeyRange(dsetID, dv.dataID, dv.versionID)
+			selected := func(key storage.Key) bool {
+				dataKey, ok := key.(*DataKey)
+				return ok && dataKey.Dataset == dsetID && dataKey.Data == dv.dataID &&
+					dataKey.Version == dv.versionID
+			}
+			if _, delErr := deleteKeyRange(s.kvGetter, batcher, nil, minKey, maxKey, selected); delErr != nil {
+				dvid.Log(dvid.Normal, "Unable to discard replicated values of failed stream: %s\n",
+					delErr.Error())
+			}
+			selectedTombstone := func(key storage.Key) bool {
+				tombstone, ok := key.(*TombstoneKey)
+				return ok && tombstone.Dataset == dsetID && tombstone.Data == dv.dataID &&
+					tombstone.Version == dv.versionID
+			}
+			_, delErr := deleteKeyRange(s.kvGetter, batcher, nil, minKey.Tombstone(), maxKey.Tombstone(), selectedTombstone)
+			if delErr != nil {
+				dvid.Log(dvid.Normal, "Unable to discard replicated tombstones of failed stream: %s\n",
+					delErr.Error())
+			}
+		}
+		return 0, 0, err
+	}
+
+	// Make the received nodes and data visible.
+	dataset.mapLock.Lock()
+	for _, u := range newOrder {
+		node := newNodes[u]
+		dataset.Nodes[u] = node
+		dataset.VersionMap[u] = node.VersionID
+		for _, parent := range node.Parents {
+			parentNode := dataset.Nodes[parent]
+			parentNode.writeLock.Lock()
+			parentNode.Children = append(parentNode.Children, u)
+			parentNode.writeLock.Unlock()
+		}
+	}
+	for name, data := range newData {
+		dataset.DataMap[name] = data
+	}
+	dataset.mapLock.Unlock()
+	dsets.writeLock.Lock()
+	for _, u := range newOrder {
+		dsets.mapUUID[u] = dataset
+	}
+	if !found {
+		dsets.list = append(dsets.list, dataset)
+		dsets.dsetIDs[dsetID] = dataset
+	}
+	dsets.writeLock.Unlock()
+
+	s.InvalidateMetadata()
+	if !found {
+		if err = dsets.Put(s.kvSetter); err != nil {
+			return
+		}
+	}
+	if err = dataset.Put(s.kvSetter); err != nil {
+		return
+	}
+	dvid.Log(dvid.Debug, "Replicated %d nodes and %d key/value pairs into dataset %s\n",
+		len(newOrder), numKeys, header.Root)
+	return len(newOrder), numKeys, nil
+}
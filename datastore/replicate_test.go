@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestReplication(c *C) {
+	source, _, done := openTestService(c)
+	defer done()
+	replicaDir := c.MkDir()
+	c.Assert(Init(replicaDir, true, dvid.Config{}), IsNil)
+	replica, openErr := Open(replicaDir)
+	c.Assert(openErr, IsNil)
+
+	// The replica holds another dataset, so local IDs differ from the source's.
+	_, _, err := replica.NewDataset()
+	c.Assert(err, IsNil)
+
+	root, _, err := source.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(source.NewData(root, "testtype", "mydata", versioned), IsNil)
+	c.Assert(source.NewData(root, "testtype", "other", versioned), IsNil)
+	dataservice, err := source.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(source.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(source.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), []byte("root b")), IsNil)
+	c.Assert(source.Commit(root, CommitInfo{Author: "alice"}), IsNil)
+	child, err := source.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(source.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("a")), []byte("child a")), IsNil)
+
+	replicate := func(u dvid.UUID, datanames []dvid.DataString) (int, int, error) {
+		state, err := replica.ReplicaState(root)
+		c.Assert(err, IsNil)
+		var buf bytes.Buffer
+		sentNodes, sentKeys, err := source.WriteReplication(&buf, u, state, datanames)
+		if err != nil {
+			return 0, 0, err
+		}
+		numNodes, numKeys, err := replica.ReadReplication(&buf)
+		c.Assert(numNodes, Equals, sentNodes)
+		c.Assert(numKeys, Equals, sentKeys)
+		return numNodes, numKeys, err
+	}
+	resolve := func(u dvid.UUID, dataname dvid.DataString) map[string]string {
+		dataservice, err := replica.DataServiceByUUID(u, dataname)
+		c.Assert(err, IsNil)
+		versions, err := replica.DataVersions(u, dataname)
+		c.Assert(err, IsNil)
+		keyvalues, err := GetVersionedRange(context.Background(), replica.kvGetter, *dataservice.(*testData).DataID, versions,
+			dvid.IndexBytes("a"), dvid.IndexBytes("z"))
+		c.Assert(err, IsNil)
+		values := make(map[string]string)
+		for _, kv := range keyvalues {
+			values[string(kv.K.(*DataKey).Index.Bytes())] = string(kv.V)
+		}
+		return values
+	}
+
+	_, _, err = replicate(child, nil)
+	c.Assert(err, NotNil) // child is unlocked
+	_, _, err = replicate(root, []dvid.DataString{"unknown"})
+	c.Assert(err, NotNil)
+
+	numNodes, numKeys, err := replicate(root, []dvid.DataString{"mydata"})
+	c.Assert(err, IsNil)
+	c.Assert(numNodes, Equals, 1)
+	c.Assert(numKeys, Equals, 2)
+	c.Assert(resolve(root, "mydata"), DeepEquals, map[string]string{"a": "root a", "b": "root b"})
+	_, err = replica.DataServiceByUUID(root, "other")
+	c.Assert(err, NotNil)
+	state, err := replica.ReplicaState(root)
+	c.Assert(err, IsNil)
+	c.Assert(state.Nodes, DeepEquals, []dvid.UUID{root})
+	c.Assert(state.Data, DeepEquals, []dvid.DataString{"mydata"})
+
+	// Only the new node's delta is sent.
+	c.Assert(source.Lock(child), IsNil)
+	numNodes, numKeys, err = replicate(child, nil)
+	c.Assert(err, IsNil)
+	c.Assert(numNodes, Equals, 1)
+	c.Assert(numKeys, Equals, 1)
+	c.Assert(resolve(child, "mydata"), DeepEquals, map[string]string{"a": "child a", "b": "root b"})
+	c.Assert(resolve(child, "other"), HasLen, 0)
+	locked, err := replica.Locked(child)
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+	children, err := replica.Datasets.mapUUID[root].Children(root)
+	c.Assert(err, IsNil)
+	c.Assert(children, DeepEquals, []dvid.UUID{child})
+
+	numNodes, numKeys, err = replicate(child, nil)
+	c.Assert(err, IsNil)
+	c.Assert(numNodes, Equals, 0)
+	c.Assert(numKeys, Equals, 0)
+
+	// A truncated stream leaves the replica unchanged.
+	grandchild, err := source.NewVersion(child)
+	c.Assert(err, IsNil)
+	c.Assert(source.kvSetter.Put(data.DataKey(2, dvid.IndexBytes("c")), []byte("grandchild c")), IsNil)
+	c.Assert(source.Lock(grandchild), IsNil)
+	state, err = replica.ReplicaState(root)
+	c.Assert(err, IsNil)
+	var buf bytes.Buffer
+	_, _, err = source.WriteReplication(&buf, grandchild, state, nil)
+	c.Assert(err, IsNil)
+	_, _, err = replica.ReadReplication(bytes.NewReader(buf.Bytes()[:buf.Len()-10]))
+	c.Assert(err, NotNil)
+	_, err = replica.Locked(grandchild)
+	c.Assert(err, NotNil)
+
+	// Replicas persist.
+	dagJSON, err := replica.DAGJSON(root)
+	c.Assert(err, IsNil)
+	replica.Shutdown()
+	reopened, openErr := Open(replicaDir)
+	c.Assert(openErr, IsNil)
+	defer reopened.Shutdown()
+	reopenedJSON, err := reopened.DAGJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(reopenedJSON, Equals, dagJSON)
+	state, err = reopened.ReplicaState(root)
+	c.Assert(err, IsNil)
+	c.Assert(state.Data, DeepEquals, []dvid.DataString{"mydata", "other"})
+}
@@ -0,0 +1,345 @@
+/*
+	This file supports restoring datasets from backup archives written by WriteBackup.
+	A restore can be limited to one dataset, some of its data, and the subtree of
+	versions descending from a node, and can add to a datastore already holding the
+	dataset.  As with replication, nodes and data the datastore already holds are kept
+	and only the missing ones are restored.  Checksums of the archive's parts and of
+	each data's values are verified, and nothing of a dataset is kept if they fail.
+*/
+
+package datastore
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// RestoreSelection selects what to restore from a backup archive.
+type RestoreSelection struct {
+	// Node is the UUID, or a unique prefix of it, of a node in the backup whose dataset
+	// is restored.  If empty, all datasets are restored.
+	Node string
+
+	// Subtree limits the restore to Node, its descendants, and their ancestors.
+	Subtree bool
+
+	// Data names the data to restore, or all data if empty.
+	Data []dvid.DataString
+}
+
+// RestoredDataset describes what was restored of a dataset.
+type RestoredDataset struct {
+	Root  dvid.UUID
+	Nodes int
+	Keys  int
+}
+
+// ReadBackupManifest returns the manifest of a backup archive and leaves the archive
+// positioned at its start.
+func ReadBackupManifest(r io.ReadSeeker) (*BackupManifest, error) {
+	manifest := new(BackupManifest)
+	if err := readArchiveManifest(r, BackupManifestName, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Format != BackupFormat {
+		return nil, fmt.Errorf("Backup archive has format %d but this server reads format %d",
+			manifest.Format, BackupFormat)
+	}
+	return manifest, nil
+}
+
+// readArchiveManifest decodes the named JSON manifest of a tar archive, which may be
+// its last file, and leaves the archive positioned at its start.
+func readArchiveManifest(r io.ReadSeeker, name string, manifest interface{}) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("Archive has no %s; it may be incomplete", name)
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to read archive: %s", err.Error())
+		}
+		if header.Name != name {
+			continue
+		}
+		if err = json.NewDecoder(tr).Decode(manifest); err != nil {
+			return fmt.Errorf("Unable to decode %s of archive: %s", name, err.Error())
+		}
+		_, err = r.Seek(0, io.SeekStart)
+		return err
+	}
+}
+
+// selectedNodes returns the nodes of a backed up dataset to restore: all nodes, or if
+// a subtree is selected, the node, its descendants, and all their ancestors.
+func (selection *RestoreSelection) selectedNodes(backup *BackupDataset, node dvid.UUID) map[dvid.UUID]bool {
+	selected := make(map[dvid.UUID]bool, len(backup.Nodes))
+	if !selection.Subtree {
+		for _, n := range backup.Nodes {
+			selected[n.UUID] = true
+		}
+		return selected
+	}
+	// Nodes are ordered with parents before children, so one pass finds descendants.
+	parents := make(map[dvid.UUID][]dvid.UUID, len(backup.Nodes))
+	selected[node] = true
+	for _, n := range backup.Nodes {
+		parents[n.UUID] = n.Parents
+		for _, parent := range n.Parents {
+			if selected[parent] {
+				selected[n.UUID] = true
+			}
+		}
+	}
+	var stack []dvid.UUID
+	for u := range selected {
+		stack = append(stack, u)
+	}
+	for len(stack) > 0 {
+		u := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, parent := range parents[u] {
+			if !selected[parent] {
+				selected[parent] = true
+				stack = append(stack, parent)
+			}
+		}
+	}
+	return selected
+}
+
+// matchBackupNode returns the dataset of a backup holding the node with a UUID or
+// unique prefix of it, and the node's full UUID.
+func matchBackupNode(manifest *BackupManifest, prefix string) (*BackupDataset, dvid.UUID, error) {
+	var matched *BackupDataset
+	var matches []dvid.UUID
+	for _, backup := range manifest.Datasets {
+		for _, n := range backup.Nodes {
+			if strings.HasPrefix(string(n.UUID), prefix) {
+				matched = backup
+				matches = append(matches, n.UUID)
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, "", fmt.Errorf("Backup holds no node with UUID %q", prefix)
+	case 1:
+		return matched, matches[0], nil
+	default:
+		return nil, "", fmt.Errorf("UUID prefix %q matches %d nodes in backup", prefix, len(matches))
+	}
+}
+
+// backupPartsReader reads a dataset's stream from the consecutive parts of a backup
+// archive, verifying the checksum of each part.
+type backupPartsReader struct {
+	tr    *tar.Reader
+	parts []BackupPart
+	next  int
+	open  bool
+	h     hash.Hash
+	job   *Job
+}
+
+func (pr *backupPartsReader) Read(p []byte) (int, error) {
+	for {
+		if pr.open {
+			n, err := pr.tr.Read(p)
+			pr.h.Write(p[:n])
+			pr.job.Throttle(n)
+			pr.job.Advance(int64(n))
+			if err == io.EOF {
+				if err = pr.closePart(); err != nil {
+					return n, err
+				}
+				if n == 0 {
+					continue
+				}
+				return n, nil
+			}
+			return n, err
+		}
+		if pr.next >= len(pr.parts) {
+			return 0, io.EOF
+		}
+		if err := pr.openPart(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// openPart moves to the archive file of the next part.
+func (pr *backupPartsReader) openPart() error {
+	part := pr.parts[pr.next]
+	header, err := pr.tr.Next()
+	if err != nil {
+		return fmt.Errorf("Backup archive ended before part %s: %s", part.Name, err.Error())
+	}
+	if header.Name != part.Name {
+		return fmt.Errorf("Backup archive holds %s where part %s was expected", header.Name, part.Name)
+	}
+	pr.h = sha256.New()
+	pr.open = true
+	return nil
+}
+
+// closePart verifies the checksum of the part just read.
+func (pr *backupPartsReader) closePart() error {
+	part := pr.parts[pr.next]
+	pr.open = false
+	pr.next++
+	if hex.EncodeToString(pr.h.Sum(nil)) != part.SHA256 {
+		return fmt.Errorf("Backup part %s is corrupt: its checksum does not match the manifest", part.Name)
+	}
+	return nil
+}
+
+// skip moves past all parts without reading them.
+func (pr *backupPartsReader) skip() error {
+	for pr.next < len(pr.parts) {
+		if err := pr.openPart(); err != nil {
+			return err
+		}
+		pr.open = false
+		pr.next++
+	}
+	return nil
+}
+
+// RestoreBackup restores the selected datasets, data, and versions from a backup
+// archive, reporting its progress through the job.  Datasets are restored one at a
+// time, so if a later dataset fails, earlier ones remain restored.
+func (s *Service) RestoreBackup(r io.ReadSeeker, selection RestoreSelection, job *Job) ([]RestoredDataset, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	manifest, err := ReadBackupManifest(r)
+	if err != nil {
+		return nil, err
+	}
+	var target *BackupDataset
+	var node dvid.UUID
+	if selection.Node != "" {
+		if target, node, err = matchBackupNode(manifest, selection.Node); err != nil {
+			return nil, err
+		}
+	} else if selection.Subtree || len(selection.Data) != 0 {
+		return nil, fmt.Errorf("Restore of a subtree or of data requires the UUID of a node in the backup")
+	}
+
+	var total int64
+	for _, backup := range manifest.Datasets {
+		if target == nil || backup == target {
+			for _, part := range backup.Parts {
+				total += part.Bytes
+			}
+		}
+	}
+	job.SetTotal(total)
+
+	tr := tar.NewReader(r)
+	restored := []RestoredDataset{}
+	for _, backup := range manifest.Datasets {
+		parts := &backupPartsReader{tr: tr, parts: backup.Parts, job: job}
+		if target != nil && backup != target {
+			if err := parts.skip(); err != nil {
+				return restored, err
+			}
+			continue
+		}
+		numNodes, numKeys, err := s.restoreDataset(parts, backup, selection, node)
+		if err != nil {
+			return restored, fmt.Errorf("Unable to restore dataset %s: %s", backup.Root, err.Error())
+		}
+		restored = append(restored, RestoredDataset{backup.Root, numNodes, numKeys})
+		job.Logf("Restored %d nodes and %d key/value pairs of dataset %s", numNodes, numKeys, backup.Root)
+	}
+	return restored, nil
+}
+
+// restoreDataset stores the selected nodes and data of a dataset's stream, verifying
+// the checksums of all its data.
+func (s *Service) restoreDataset(r io.Reader, backup *BackupDataset, selection RestoreSelection,
+	node dvid.UUID) (numNodes, numKeys int, err error) {
+
+	dec := gob.NewDecoder(r)
+	var header replicationHeader
+	if err = dec.Decode(&header); err != nil {
+		return 0, 0, fmt.Errorf("Unable to read header of dataset stream: %s", err.Error())
+	}
+	if header.Format != ReplicationFormat {
+		return 0, 0, fmt.Errorf("Dataset stream has format %d but this server reads format %d",
+			header.Format, ReplicationFormat)
+	}
+
+	// Select the nodes and data to restore.
+	nodes := selection.selectedNodes(backup, node)
+	var selectedNodes []replicatedNode
+	for _, replicated := range header.Nodes {
+		if nodes[replicated.Version.GlobalID] {
+			selectedNodes = append(selectedNodes, replicated)
+		}
+	}
+	header.Nodes = selectedNodes
+	dataMap := make(map[dvid.DataString]DataService)
+	if err = dvid.Deserialize(header.DataMap, &dataMap); err != nil {
+		return
+	}
+	if len(selection.Data) != 0 {
+		selected := make(map[dvid.DataString]DataService, len(selection.Data))
+		for _, name := range selection.Data {
+			data, found := dataMap[name]
+			if !found {
+				return 0, 0, fmt.Errorf("Backup of dataset %s holds no data '%s'", backup.Root, name)
+			}
+			selected[name] = data
+		}
+		dataMap = selected
+		compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+		if header.DataMap, err = dvid.Serialize(dataMap, compression, dvid.NoChecksum); err != nil {
+			return
+		}
+	}
+
+	// Verify the checksums of all data while passing on values of the selected ones.
+	hashes := make(map[dvid.DataString]hash.Hash, len(backup.Data))
+	for _, data := range backup.Data {
+		hashes[data.Name] = sha256.New()
+	}
+	next := func() (*replicatedKeyValue, error) {
+		for {
+			kv := new(replicatedKeyValue)
+			if err := dec.Decode(kv); err != nil {
+				return nil, fmt.Errorf("Dataset stream ended before its last key/value pair: %s", err.Error())
+			}
+			if kv.Data == "" {
+				for _, data := range backup.Data {
+					if hex.EncodeToString(hashes[data.Name].Sum(nil)) != data.SHA256 {
+						return nil, fmt.Errorf("Values of data '%s' do not match the manifest checksum", data.Name)
+					}
+				}
+				return kv, nil
+			}
+			h, found := hashes[kv.Data]
+			if !found {
+				return nil, fmt.Errorf("Dataset stream holds values of data '%s' missing from manifest", kv.Data)
+			}
+			hashBackupValue(h, kv.Node, kv.Index, kv.Value)
+			if _, selected := dataMap[kv.Data]; selected && nodes[kv.Node] {
+				return kv, nil
+			}
+		}
+	}
+	return s.storeReplication(&header, next)
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestRestoreBackup(c *C) {
+	source, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := source.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(source.NewData(root, "testtype", "mydata", versioned), IsNil)
+	c.Assert(source.NewData(root, "testtype", "other", versioned), IsNil)
+	dataservice, err := source.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(source.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(source.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), []byte("root b")), IsNil)
+	c.Assert(source.Lock(root), IsNil)
+	child, err := source.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(source.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("a")), []byte("child a")), IsNil)
+	sibling, err := source.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(source.kvSetter.Put(data.DataKey(2, dvid.IndexBytes("c")), []byte("sibling c")), IsNil)
+
+	var buf bytes.Buffer
+	_, err = source.WriteBackup(&buf, nil, nil)
+	c.Assert(err, IsNil)
+	archive := buf.Bytes()
+
+	restoreInto := func() *Service {
+		dir := c.MkDir()
+		c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+		service, err := Open(dir)
+		c.Assert(err, IsNil)
+		return service
+	}
+	resolve := func(service *Service, u dvid.UUID) map[string]string {
+		dataservice, err := service.DataServiceByUUID(u, "mydata")
+		c.Assert(err, IsNil)
+		versions, err := service.DataVersions(u, "mydata")
+		c.Assert(err, IsNil)
+		keyvalues, err := GetVersionedRange(context.Background(), service.kvGetter, *dataservice.(*testData).DataID,
+			versions, dvid.IndexBytes("a"), dvid.IndexBytes("z"))
+		c.Assert(err, IsNil)
+		values := make(map[string]string)
+		for _, kv := range keyvalues {
+			values[string(kv.K.(*DataKey).Index.Bytes())] = string(kv.V)
+		}
+		return values
+	}
+
+	// A full restore.
+	full := restoreInto()
+	defer full.Shutdown()
+	restored, err := full.RestoreBackup(bytes.NewReader(archive), RestoreSelection{}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(restored, DeepEquals, []RestoredDataset{{root, 3, 4}})
+	c.Assert(resolve(full, child), DeepEquals, map[string]string{"a": "child a", "b": "root b"})
+	c.Assert(resolve(full, sibling), DeepEquals, map[string]string{"a": "root a", "b": "root b", "c": "sibling c"})
+	locked, err := full.Locked(root)
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+	restored, err = full.RestoreBackup(bytes.NewReader(archive), RestoreSelection{}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(restored, DeepEquals, []RestoredDataset{{root, 0, 0}})
+
+	// A selective restore of one data's subtree, later extended with another subtree.
+	partial := restoreInto()
+	defer partial.Shutdown()
+	_, err = partial.RestoreBackup(bytes.NewReader(archive), RestoreSelection{Subtree: true}, nil)
+	c.Assert(err, NotNil)
+	_, err = partial.RestoreBackup(bytes.NewReader(archive),
+		RestoreSelection{Node: string(child), Data: []dvid.DataString{"unknown"}}, nil)
+	c.Assert(err, NotNil)
+	selection := RestoreSelection{Node: string(child)[:8], Subtree: true, Data: []dvid.DataString{"mydata"}}
+	restored, err = partial.RestoreBackup(bytes.NewReader(archive), selection, nil)
+	c.Assert(err, IsNil)
+	c.Assert(restored, DeepEquals, []RestoredDataset{{root, 2, 3}})
+	c.Assert(resolve(partial, child), DeepEquals, map[string]string{"a": "child a", "b": "root b"})
+	_, err = partial.DataServiceByUUID(root, "other")
+	c.Assert(err, NotNil)
+	_, err = partial.Locked(sibling)
+	c.Assert(err, NotNil)
+	selection.Node = string(sibling)
+	restored, err = partial.RestoreBackup(bytes.NewReader(archive), selection, nil)
+	c.Assert(err, IsNil)
+	c.Assert(restored, DeepEquals, []RestoredDataset{{root, 1, 1}})
+	c.Assert(resolve(partial, sibling), DeepEquals, map[string]string{"a": "root a", "b": "root b", "c": "sibling c"})
+
+	// A corrupt archive restores nothing.
+	manifest, err := ReadBackupManifest(bytes.NewReader(archive))
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Datasets, HasLen, 1)
+	corrupt := append([]byte{}, archive...)
+	corrupt[600] ^= 0xff // within the first part, after its 512 byte tar header
+	empty := restoreInto()
+	defer empty.Shutdown()
+	_, err = empty.RestoreBackup(bytes.NewReader(corrupt), RestoreSelection{}, nil)
+	c.Assert(err, NotNil)
+	_, err = empty.Locked(root)
+	c.Assert(err, NotNil)
+	_, err = empty.RestoreBackup(bytes.NewReader(archive[:len(archive)-2048]), RestoreSelection{}, nil)
+	c.Assert(err, NotNil)
+}
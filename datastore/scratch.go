@@ -0,0 +1,243 @@
+/*
+	This file supports scratch data: temporary data instances tied to a single version
+	node that are hidden from data listings and reclaimed once they expire.  Pipelines
+	can stage intermediate results in scratch data without adding permanent instances.
+*/
+
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// DefaultScratchTTL is how long scratch data lives if no time-to-live is given.
+const DefaultScratchTTL = 24 * time.Hour
+
+// MaxScratchTTL is the longest time-to-live allowed for scratch data.
+const MaxScratchTTL = 30 * 24 * time.Hour
+
+// ScratchData is a temporary data instance that is only accessible at one version node
+// and is reclaimed once it expires.
+type ScratchData struct {
+	Data    DataService
+	Version dvid.UUID
+
+	// Session is an optional client-supplied identifier, e.g., a pipeline run, that
+	// groups scratch data.
+	Session string
+
+	Expires time.Time
+}
+
+// MarshalJSON describes the scratch data without its type-specific properties.
+func (s *ScratchData) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name     dvid.DataString
+		TypeName dvid.TypeString
+		Version  dvid.UUID
+		Session  string
+		Expires  time.Time
+	}{
+		s.Data.DataName(),
+		s.Data.DatatypeName(),
+		s.Version,
+		s.Session,
+		s.Expires,
+	})
+}
+
+// scratchIndex returns the index of the named scratch data or -1 if there is none.
+// The dataset must be locked.
+func (dset *Dataset) scratchIndex(name dvid.DataString) int {
+	for i, scratch := range dset.Scratch {
+		if scratch.Data.DataName() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// scratchService returns the named scratch data if accessible from the version with the
+// given UUID.  The returned bool is false if there is no scratch data of that name.
+func (dset *Dataset) scratchService(u dvid.UUID, name dvid.DataString) (DataService, bool, error) {
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+
+	i := dset.scratchIndex(name)
+	if i < 0 {
+		return nil, false, nil
+	}
+	scratch := dset.Scratch[i]
+	if scratch.Version != u {
+		return nil, true, fmt.Errorf("Scratch data '%s' is only accessible at node %s", name, scratch.Version)
+	}
+	if time.Now().After(scratch.Expires) {
+		return nil, true, fmt.Errorf("Scratch data '%s' expired at %s", name, scratch.Expires)
+	}
+	return scratch.Data, true, nil
+}
+
+// newScratchData creates scratch data at the version with the given UUID.
+func (dset *Dataset) newScratchData(u dvid.UUID, name dvid.DataString, typeName dvid.TypeString,
+	config dvid.Config, session string, ttl time.Duration) error {
+
+	if ttl <= 0 || ttl > MaxScratchTTL {
+		return fmt.Errorf("Scratch data time-to-live must be positive and at most %s, not %s",
+			MaxScratchTTL, ttl)
+	}
+	typeService, err := TypeServiceByName(typeName)
+	if err != nil {
+		return fmt.Errorf("No data type '%s' found [%s]", typeName, err)
+	}
+
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+
+	if _, found := dset.DataMap[name]; found || dset.scratchIndex(name) >= 0 {
+		return fmt.Errorf("Data named '%s' already exists in dataset %s", name, dset.Root)
+	}
+	dataID := &DataID{name, dset.NewDataID, dset.DatasetID}
+	dset.NewDataID++
+	dataservice, err := typeService.NewDataService(dataID, config)
+	if err != nil {
+		return err
+	}
+	dset.Scratch = append(dset.Scratch, &ScratchData{dataservice, u, session, time.Now().Add(ttl)})
+	return nil
+}
+
+// removeScratch removes and returns the scratch data for which the test is true.
+func (dset *Dataset) removeScratch(test func(*ScratchData) bool) []*ScratchData {
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+
+	var removed, kept []*ScratchData
+	for _, scratch := range dset.Scratch {
+		if test(scratch) {
+			removed = append(removed, scratch)
+		} else {
+			kept = append(kept, scratch)
+		}
+	}
+	dset.Scratch = kept
+	return removed
+}
+
+// NewScratchData creates scratch data of given name and type that is accessible only at
+// the version node with the given UUID and expires after the time-to-live.
+func (s *Service) NewScratchData(u dvid.UUID, typename dvid.TypeString, dataname dvid.DataString,
+	config dvid.Config, session string, ttl time.Duration) error {
+
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	if err = dataset.newScratchData(u, dataname, typename, config, session, ttl); err != nil {
+		return err
+	}
+	s.InvalidateMetadata()
+	return dataset.Put(s.kvSetter)
+}
+
+// ScratchJSON returns JSON listing the scratch data of the dataset specified by a UUID.
+func (s *Service) ScratchJSON(u dvid.UUID) (string, error) {
+	if s.Datasets == nil {
+		return "[]", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return "[]", err
+	}
+	dataset.mapLock.Lock()
+	defer dataset.mapLock.Unlock()
+	if dataset.Scratch == nil {
+		return "[]", nil
+	}
+	m, err := json.Marshal(dataset.Scratch)
+	if err != nil {
+		return "[]", err
+	}
+	return string(m), nil
+}
+
+// DeleteScratch immediately deletes scratch data and its key/value pairs.
+func (s *Service) DeleteScratch(u dvid.UUID, dataname dvid.DataString) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	removed := dataset.removeScratch(func(scratch *ScratchData) bool {
+		return scratch.Data.DataName() == dataname
+	})
+	if len(removed) == 0 {
+		return fmt.Errorf("No scratch data '%s' found in dataset %s", dataname, dataset.Root)
+	}
+	_, err = s.reclaimScratch(dataset, removed, nil)
+	return err
+}
+
+// CollectScratch deletes all scratch data that expired before the given time, returning
+// the number of data instances reclaimed.
+func (s *Service) CollectScratch(now time.Time) (int, error) {
+	if s.Datasets == nil {
+		return 0, fmt.Errorf("Datastore service has no datasets available")
+	}
+	var reclaimed int
+	var job *Job
+	for _, dataset := range s.Datasets.list {
+		expired := dataset.removeScratch(func(scratch *ScratchData) bool {
+			return scratch.Expires.Before(now)
+		})
+		if len(expired) == 0 {
+			continue
+		}
+		if job == nil {
+			job = StartJob("gc", "scratch collection", GCLimits)
+			defer job.Finish()
+		}
+		n, err := s.reclaimScratch(dataset, expired, job)
+		reclaimed += n
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
+
+// reclaimScratch saves a dataset after scratch data was removed and deletes the
+// key/value pairs of that data, throttled by the job if not nil.
+func (s *Service) reclaimScratch(dataset *Dataset, removed []*ScratchData, job *Job) (int, error) {
+	s.InvalidateMetadata()
+	if err := dataset.Put(s.kvSetter); err != nil {
+		return 0, err
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return 0, err
+	}
+	var reclaimed int
+	for _, scratch := range removed {
+		data, ok := scratch.Data.(forkableData)
+		if !ok {
+			return reclaimed, fmt.Errorf("Cannot reclaim keys of scratch data '%s'", scratch.Data.DataName())
+		}
+		numKeys, err := s.deleteDataKeys(batcher, dataset.DatasetID, data.LocalID(), job)
+		if err != nil {
+			return reclaimed, err
+		}
+		dvid.Log(dvid.Normal, "Reclaimed scratch data '%s' with %d key/value pairs from dataset %s\n",
+			scratch.Data.DataName(), numKeys, dataset.Root)
+		reclaimed++
+	}
+	return reclaimed, nil
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestScratchData(c *C) {
+	compiled := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype", "example.com/testtype", "0.1")}}
+	CompiledTypes[compiled.DatatypeUrl()] = compiled
+	defer delete(CompiledTypes, compiled.DatatypeUrl())
+
+	dir := c.MkDir()
+	err := Init(dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+	service, err := Open(dir)
+	c.Assert(err, IsNil)
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "mydata", dvid.NewConfig()), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+
+	err = service.NewScratchData(child, "testtype", "mydata", dvid.NewConfig(), "", time.Hour)
+	c.Assert(err, NotNil)
+	err = service.NewScratchData(child, "testtype", "staged", dvid.NewConfig(), "run1", MaxScratchTTL+time.Hour)
+	c.Assert(err, NotNil)
+	version := service.MetadataVersion()
+	err = service.NewScratchData(child, "testtype", "staged", dvid.NewConfig(), "run1", time.Hour)
+	c.Assert(err, IsNil)
+	c.Assert(service.MetadataVersion() > version, Equals, true)
+	c.Assert(service.NewData(child, "testtype", "staged", dvid.NewConfig()), NotNil)
+
+	// Scratch data is only accessible at its version and hidden from listings.
+	dataservice, err := service.DataServiceByUUID(child, "staged")
+	c.Assert(err, IsNil)
+	_, err = service.DataServiceByUUID(root, "staged")
+	c.Assert(err, NotNil)
+	jsonStr, err := service.DatasetJSON(child)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Not(Matches), ".*staged.*")
+	jsonStr, err = service.ScratchJSON(child)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Matches, `\[\{"Name":"staged","TypeName":"testtype","Version":"`+string(child)+`","Session":"run1".*`)
+
+	key := dataservice.(*testData).DataKey(1, dvid.IndexBytes("a"))
+	c.Assert(service.kvSetter.Put(key, []byte("intermediate")), IsNil)
+
+	// Scratch data persists until it expires.
+	service.Shutdown()
+	service, err = Open(dir)
+	c.Assert(err, IsNil)
+	defer service.Shutdown()
+	_, err = service.DataServiceByUUID(child, "staged")
+	c.Assert(err, IsNil)
+
+	reclaimed, err := service.CollectScratch(time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(reclaimed, Equals, 0)
+	reclaimed, err = service.CollectScratch(time.Now().Add(2 * time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(reclaimed, Equals, 1)
+	value, err := service.kvGetter.Get(key)
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+	_, err = service.DataServiceByUUID(child, "staged")
+	c.Assert(err, NotNil)
+
+	err = service.NewScratchData(child, "testtype", "temp", dvid.NewConfig(), "", time.Hour)
+	c.Assert(err, IsNil)
+	version = service.MetadataVersion()
+	c.Assert(service.DeleteScratch(child, "temp"), IsNil)
+	c.Assert(service.MetadataVersion() > version, Equals, true)
+	c.Assert(service.DeleteScratch(child, "temp"), NotNil)
+}
@@ -0,0 +1,378 @@
+/*
+	This file supports stats of the stored data of datasets: key counts, stored and
+	estimated uncompressed bytes, blocks and their extents, and versions per data.
+	Unlike a key profile, stats are gathered incrementally.  Values at locked nodes
+	cannot change, so the stats of each locked version of data are scanned once and
+	kept in the datastore, and later requests only scan unlocked versions.
+*/
+
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// statsKey is the name of the server key holding stats of locked versions.
+const statsKey = "stats"
+
+// StatsSampleStride is the stride of values decompressed to estimate uncompressed bytes.
+const StatsSampleStride = 64
+
+// IndexDecoder is a data service whose stored indices have a known structure, e.g.,
+// block coordinates, so stats can count its blocks and their extents.
+type IndexDecoder interface {
+	DecodeIndex(index []byte) (dvid.Index, error)
+}
+
+// DataStats describes the stored key/value pairs of a data instance across versions.
+type DataStats struct {
+	Name     dvid.DataString
+	TypeName dvid.TypeString
+	KeyStats
+
+	// UncompressedBytes estimates the value bytes if uncompressed from a sample of values.
+	UncompressedBytes int64
+
+	// Blocks counts stored blocks, including those of each version, for data whose
+	// indices are blocks, and MinBlock and MaxBlock are their extents.
+	Blocks   int64              `json:",omitempty"`
+	MinBlock *dvid.ChunkPoint3d `json:",omitempty"`
+	MaxBlock *dvid.ChunkPoint3d `json:",omitempty"`
+
+	// Versions counts the versions storing any key/value pairs of the data.
+	Versions int
+}
+
+// DatasetStats describes the stored key/value pairs of all data in a dataset.
+type DatasetStats struct {
+	Root  dvid.UUID
+	Alias string `json:",omitempty"`
+
+	// Versions counts the nodes of the dataset.
+	Versions int
+
+	KeyStats
+	UncompressedBytes int64
+	Data              []*DataStats
+
+	// Scanned and Cached count the versions of data whose stats were scanned and
+	// those whose stats were kept from earlier requests.
+	Scanned int
+	Cached  int
+}
+
+// versionStatsKey identifies the stats of data at a version.  The local ID of the data
+// is used since data deleted and added again with the same name get a new one.
+type versionStatsKey struct {
+	Root dvid.UUID
+	Node dvid.UUID
+	Data dvid.DataLocalID
+}
+
+// versionStats describe the key/value pairs of data stored at one version.
+type versionStats struct {
+	KeyStats
+
+	// Bytes of sampled values as stored and uncompressed.
+	SampledBytes        int64
+	SampledUncompressed int64
+
+	Blocks   int64
+	MinBlock dvid.ChunkPoint3d
+	MaxBlock dvid.ChunkPoint3d
+}
+
+// statsCache holds the stats of locked versions of data, which are loaded from storage
+// on first use.
+type statsCache struct {
+	sync.Mutex
+	loaded   bool
+	versions map[versionStatsKey]*versionStats
+}
+
+// loadStats reads the stats of locked versions from storage if they have not been
+// read.  The caller must hold the lock.
+func (s *Service) loadStats() error {
+	cache := &s.stats
+	if cache.loaded {
+		return nil
+	}
+	value, err := s.kvGetter.Get(&ServerKey{statsKey})
+	if err != nil {
+		return err
+	}
+	cache.versions = make(map[versionStatsKey]*versionStats)
+	if value != nil {
+		if err = dvid.Deserialize(value, &cache.versions); err != nil {
+			return fmt.Errorf("Unable to read data stats: %s", err.Error())
+		}
+	}
+	cache.loaded = true
+	return nil
+}
+
+// saveStats writes the stats of locked versions to storage.  The caller must hold the
+// lock.
+func (s *Service) saveStats() error {
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	serialization, err := dvid.Serialize(s.stats.versions, compression, dvid.CRC32)
+	if err != nil {
+		return err
+	}
+	return s.kvSetter.Put(&ServerKey{statsKey}, serialization)
+}
+
+// forgetStats discards any kept stats of data at a version, e.g., after values are
+// added to a locked node by flattening.
+func (s *Service) forgetStats(root, u dvid.UUID, dataID dvid.DataLocalID) error {
+	cache := &s.stats
+	cache.Lock()
+	defer cache.Unlock()
+	if err := s.loadStats(); err != nil {
+		return err
+	}
+	key := versionStatsKey{root, u, dataID}
+	if _, found := cache.versions[key]; !found {
+		return nil
+	}
+	delete(cache.versions, key)
+	return s.saveStats()
+}
+
+// scanVersionStats tallies the key/value pairs of data stored at a version.
+func scanVersionStats(db storage.KeyValueGetter, dataservice DataService, dsetID dvid.DatasetLocalID,
+	dataID dvid.DataLocalID, versionID dvid.VersionLocalID) (*versionStats, error) {
+
+	decoder, decodes := dataservice.(IndexDecoder)
+	stats := &versionStats{
+		MinBlock: dvid.ChunkPoint3d{math.MaxInt32, math.MaxInt32, math.MaxInt32},
+		MaxBlock: dvid.ChunkPoint3d{math.MinInt32, math.MinInt32, math.MinInt32},
+	}
+	minKey, maxKey := versionKeyRange(dsetID, dataID, versionID)
+	err := db.ProcessRange(context.Background(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		dataKey, ok := chunk.K.(*DataKey)
+		if !ok || dataKey.Dataset != dsetID || dataKey.Data != dataID || dataKey.Version != versionID {
+			return
+		}
+		stats.add(len(chunk.K.Bytes()), int64(len(chunk.V)))
+		if (stats.Keys-1)%StatsSampleStride == 0 {
+			if uncompressed, _, err := dvid.DeserializeData(chunk.V, true); err == nil {
+				stats.SampledBytes += int64(len(chunk.V))
+				stats.SampledUncompressed += int64(len(uncompressed))
+			}
+		}
+		if !decodes || dataKey.Index == nil {
+			return
+		}
+		index, err := decoder.DecodeIndex(dataKey.Index.Bytes())
+		if err != nil {
+			return
+		}
+		indexer, ok := index.(dvid.ChunkIndexer)
+		if !ok {
+			return
+		}
+		stats.Blocks++
+		for dim := uint8(0); dim < 3; dim++ {
+			value := indexer.Value(dim)
+			if value < stats.MinBlock[dim] {
+				stats.MinBlock[dim] = value
+			}
+			if value > stats.MaxBlock[dim] {
+				stats.MaxBlock[dim] = value
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// add tallies the stats of data at a version into the stats of the data.
+func (stats *DataStats) add(vstats *versionStats) {
+	if vstats.Keys == 0 {
+		return
+	}
+	stats.Versions++
+	stats.Keys += vstats.Keys
+	stats.KeyBytes += vstats.KeyBytes
+	stats.ValueBytes += vstats.ValueBytes
+	if vstats.Blocks == 0 {
+		return
+	}
+	stats.Blocks += vstats.Blocks
+	if stats.MinBlock == nil {
+		minBlock, maxBlock := vstats.MinBlock, vstats.MaxBlock
+		stats.MinBlock, stats.MaxBlock = &minBlock, &maxBlock
+		return
+	}
+	for dim := 0; dim < 3; dim++ {
+		if vstats.MinBlock[dim] < stats.MinBlock[dim] {
+			stats.MinBlock[dim] = vstats.MinBlock[dim]
+		}
+		if vstats.MaxBlock[dim] > stats.MaxBlock[dim] {
+			stats.MaxBlock[dim] = vstats.MaxBlock[dim]
+		}
+	}
+}
+
+// datasetStats returns the stats of a dataset, scanning versions of data whose stats
+// are not kept, or all versions if refresh is true.
+func (s *Service) datasetStats(db storage.KeyValueGetter, dataset *Dataset, refresh bool) (*DatasetStats, error) {
+	dataset.mapLock.Lock()
+	var dataservices []DataService
+	for _, dataservice := range dataset.DataMap {
+		dataservices = append(dataservices, dataservice)
+	}
+	nodes := make([]*Node, 0, len(dataset.Nodes))
+	for _, node := range dataset.Nodes {
+		nodes = append(nodes, node)
+	}
+	dataset.mapLock.Unlock()
+
+	stats := &DatasetStats{Root: dataset.Root, Alias: dataset.Alias, Versions: len(nodes), Data: []*DataStats{}}
+	cache := &s.stats
+	seen := make(map[versionStatsKey]bool)
+	var changed bool
+	for _, dataservice := range dataservices {
+		data, ok := dataservice.(versionedData)
+		if !ok {
+			return nil, fmt.Errorf("Data '%s' does not support stats", dataservice.DataName())
+		}
+		dataStats := &DataStats{Name: dataservice.DataName(), TypeName: dataservice.DatatypeName()}
+		var sampledBytes, sampledUncompressed int64
+		for _, node := range nodes {
+			node.writeLock.Lock()
+			u, versionID, keep := node.GlobalID, node.VersionID, node.Locked && !node.Abandoned
+			node.writeLock.Unlock()
+			key := versionStatsKey{dataset.Root, u, data.LocalID()}
+			cache.Lock()
+			vstats, found := cache.versions[key]
+			cache.Unlock()
+			if found && keep && !refresh {
+				stats.Cached++
+			} else {
+				var err error
+				vstats, err = scanVersionStats(db, dataservice, dataset.DatasetID, data.LocalID(), versionID)
+				if err != nil {
+					return nil, err
+				}
+				stats.Scanned++
+				cache.Lock()
+				if keep {
+					cache.versions[key] = vstats
+					changed = true
+				} else if found {
+					delete(cache.versions, key)
+					changed = true
+				}
+				cache.Unlock()
+			}
+			if keep {
+				seen[key] = true
+			}
+			dataStats.add(vstats)
+			sampledBytes += vstats.SampledBytes
+			sampledUncompressed += vstats.SampledUncompressed
+		}
+		dataStats.UncompressedBytes = dataStats.ValueBytes
+		if sampledBytes > 0 {
+			ratio := float64(sampledUncompressed) / float64(sampledBytes)
+			dataStats.UncompressedBytes = int64(math.Round(float64(dataStats.ValueBytes) * ratio))
+		}
+		stats.Keys += dataStats.Keys
+		stats.KeyBytes += dataStats.KeyBytes
+		stats.ValueBytes += dataStats.ValueBytes
+		stats.UncompressedBytes += dataStats.UncompressedBytes
+		stats.Data = append(stats.Data, dataStats)
+	}
+	sort.Sort(dataStatsByName(stats.Data))
+
+	// Discard kept stats of data or versions no longer in the dataset.
+	cache.Lock()
+	defer cache.Unlock()
+	for key := range cache.versions {
+		if key.Root == dataset.Root && !seen[key] {
+			delete(cache.versions, key)
+			changed = true
+		}
+	}
+	if changed {
+		if err := s.saveStats(); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// dataStatsByName sorts data stats by data name.
+type dataStatsByName []*DataStats
+
+func (d dataStatsByName) Len() int           { return len(d) }
+func (d dataStatsByName) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d dataStatsByName) Less(i, j int) bool { return d[i].Name < d[j].Name }
+
+// Stats returns the stats of the dataset with the node of the given UUID, or of all
+// datasets if u is empty.  Only versions of data that are unlocked or whose stats were
+// not kept by earlier requests are scanned, unless refresh is true.
+func (s *Service) Stats(u dvid.UUID, refresh bool) ([]*DatasetStats, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	var datasets []*Dataset
+	if u == "" {
+		s.Datasets.writeLock.Lock()
+		datasets = make([]*Dataset, len(s.Datasets.list))
+		copy(datasets, s.Datasets.list)
+		s.Datasets.writeLock.Unlock()
+	} else {
+		dataset, err := s.Datasets.DatasetFromUUID(u)
+		if err != nil {
+			return nil, err
+		}
+		datasets = []*Dataset{dataset}
+	}
+	db, err := s.KeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	s.stats.Lock()
+	err = s.loadStats()
+	s.stats.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	allStats := []*DatasetStats{}
+	for _, dataset := range datasets {
+		stats, err := s.datasetStats(db, dataset, refresh)
+		if err != nil {
+			return nil, err
+		}
+		allStats = append(allStats, stats)
+	}
+	return allStats, nil
+}
+
+// StatsJSON returns JSON for the stats of the dataset with the node of the given UUID,
+// or of all datasets if u is empty.
+func (s *Service) StatsJSON(u dvid.UUID, refresh bool) (string, error) {
+	stats, err := s.Stats(u, refresh)
+	if err != nil {
+		return "", err
+	}
+	m, err := json.Marshal(stats)
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
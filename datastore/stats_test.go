@@ -0,0 +1,73 @@
+package datastore
+
+import (
+	"bytes"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestStats(c *C) {
+	compiled := &testType{&Datatype{DatatypeID: MakeDatatypeID("testtype", "example.com/testtype", "0.1")}}
+	CompiledTypes[compiled.DatatypeUrl()] = compiled
+	defer delete(CompiledTypes, compiled.DatatypeUrl())
+
+	dir := c.MkDir()
+	c.Assert(Init(dir, true, dvid.Config{}), IsNil)
+	service, openErr := Open(dir)
+	c.Assert(openErr, IsNil)
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+	c.Assert(service.NewData(root, "testtype", "other", versioned), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	compression, _ := dvid.NewCompression(dvid.Gzip, dvid.DefaultCompression)
+	value, err := dvid.SerializeData(bytes.Repeat([]byte("a"), 1000), compression, dvid.CRC32)
+	c.Assert(err, IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), value), IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), value), IsNil)
+	c.Assert(service.Lock(root), IsNil)
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(service.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("a")), value), IsNil)
+
+	stats, err := service.Stats(child, false)
+	c.Assert(err, IsNil)
+	c.Assert(stats, HasLen, 1)
+	dsetStats := stats[0]
+	c.Assert(dsetStats.Root, Equals, root)
+	c.Assert(dsetStats.Versions, Equals, 2)
+	c.Assert(dsetStats.Keys, Equals, int64(3))
+	c.Assert(dsetStats.ValueBytes, Equals, int64(3*len(value)))
+	c.Assert(dsetStats.UncompressedBytes, Equals, int64(3000))
+	c.Assert(dsetStats.Scanned, Equals, 4)
+	c.Assert(dsetStats.Cached, Equals, 0)
+	c.Assert(dsetStats.Data, HasLen, 2)
+	c.Assert(dsetStats.Data[0].Name, Equals, dvid.DataString("mydata"))
+	c.Assert(dsetStats.Data[0].Versions, Equals, 2)
+	c.Assert(dsetStats.Data[0].Keys, Equals, int64(3))
+	c.Assert(dsetStats.Data[1].Keys, Equals, int64(0))
+
+	// Only the unlocked child is scanned again, even after the datastore is reopened.
+	c.Assert(service.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("c")), value), IsNil)
+	service.Shutdown()
+	service, openErr = Open(dir)
+	c.Assert(openErr, IsNil)
+	defer service.Shutdown()
+	stats, err = service.Stats("", false)
+	c.Assert(err, IsNil)
+	c.Assert(stats, HasLen, 1)
+	c.Assert(stats[0].Keys, Equals, int64(4))
+	c.Assert(stats[0].Scanned, Equals, 2)
+	c.Assert(stats[0].Cached, Equals, 2)
+	stats, err = service.Stats(root, true)
+	c.Assert(err, IsNil)
+	c.Assert(stats[0].Keys, Equals, int64(4))
+	c.Assert(stats[0].Scanned, Equals, 4)
+}
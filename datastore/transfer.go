@@ -0,0 +1,364 @@
+/*
+	This file supports transfers of data between running DVID servers, e.g., to move data
+	off an overloaded server without downtime.  The source server reads the key/value
+	pairs of data as resolved at a node in batches, and the destination server stores
+	each batch at the same node and saves the progress of the transfer, so an interrupted
+	transfer resumes after the last stored batch.  The destination server must already
+	hold the node, e.g., through replication.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// DefaultTransferBatchBytes is the default number of bytes of key/value pairs read
+// per transfer batch.
+const DefaultTransferBatchBytes = 8 * dvid.Mega
+
+// transferMutex serializes storing of transfer batches so concurrent transfers of the
+// same data cannot both store a batch.
+var transferMutex sync.Mutex
+
+// TransferCursor is a position within the key/value pairs of data resolved at a node.
+type TransferCursor struct {
+	// Version is the position of the version being read in the ancestry of the node,
+	// starting with the node itself.
+	Version int
+
+	// Index is the last index read at that version, or nil if none has been read.
+	Index []byte
+}
+
+// TransferSource describes data to be transferred from a source server.
+type TransferSource struct {
+	Node dvid.UUID
+	Data dvid.DataString
+
+	// DataMap is the serialization of a map holding only the transferred data.
+	DataMap []byte
+}
+
+// TransferPair is a key/value pair in a transfer batch.
+type TransferPair struct {
+	Index []byte
+	Value []byte
+}
+
+// TransferBatch holds the key/value pairs of data resolved at a node from the Start
+// cursor up to the Next cursor.  Done is true if no pairs remain after the batch.
+type TransferBatch struct {
+	Start TransferCursor
+	Next  TransferCursor
+	Done  bool
+	Pairs []TransferPair
+}
+
+// Transfer is the persisted progress of data being transferred into a dataset.
+type Transfer struct {
+	Data dvid.DataString
+	Node dvid.UUID
+
+	Started time.Time
+	Updated time.Time
+
+	// Keys and Bytes count the key/value pairs stored so far.
+	Keys  int64
+	Bytes int64
+
+	// Next is the position of the next batch to store.
+	Next TransferCursor
+
+	Done bool
+}
+
+// transfer returns the transfer into the named data.
+func (dset *Dataset) transfer(name dvid.DataString) *Transfer {
+	for _, transfer := range dset.Transfers {
+		if transfer.Data == name {
+			return transfer
+		}
+	}
+	return nil
+}
+
+// TransferSource returns the description of the named data for a transfer of its
+// values as resolved at the node with the given UUID.
+func (s *Service) TransferSource(u dvid.UUID, name dvid.DataString) (*TransferSource, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	dataservice, err := dataset.DataService(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := dataservice.(replicableData); !ok {
+		return nil, fmt.Errorf("Data '%s' cannot be transferred", name)
+	}
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	dataset.mapLock.Lock()
+	serialization, err := dvid.Serialize(map[dvid.DataString]DataService{name: dataservice},
+		compression, dvid.NoChecksum)
+	dataset.mapLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return &TransferSource{Node: u, Data: name, DataMap: serialization}, nil
+}
+
+// ReadTransferBatch returns the key/value pairs of the named data resolved at the node
+// with the given UUID, starting after the cursor, until they hold at least maxBytes.
+func (s *Service) ReadTransferBatch(u dvid.UUID, name dvid.DataString, start TransferCursor,
+	maxBytes int) (*TransferBatch, error) {
+
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	dataservice, err := dataset.DataService(name)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := dataservice.(versionedData)
+	if !ok {
+		return nil, fmt.Errorf("Data '%s' cannot be transferred", name)
+	}
+	versions, err := s.DataVersions(u, name)
+	if err != nil {
+		return nil, err
+	}
+	if start.Version < 0 || start.Version > len(versions) {
+		return nil, fmt.Errorf("Transfer cursor is at version %d but data '%s' has %d versions at node %s",
+			start.Version, name, len(versions), u)
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultTransferBatchBytes
+	}
+
+	batch := &TransferBatch{Start: start, Next: start}
+	dsetID, dataID := dataset.DatasetID, data.LocalID()
+	var numBytes int
+	for batch.Next.Version < len(versions) {
+		pos := batch.Next.Version
+		versionID := versions[pos]
+		minKey, maxKey := versionKeyRange(dsetID, dataID, versionID)
+		if batch.Next.Index != nil {
+			// The smallest index after the last index read.
+			minKey.Index = dvid.IndexBytes(append(append([]byte{}, batch.Next.Index...), 0))
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		var full bool
+		var readErr error
+		err = s.kvGetter.ProcessRange(ctx, minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+			dataKey, ok := chunk.K.(*DataKey)
+			if full || readErr != nil || !ok || dataKey.Dataset != dsetID || dataKey.Data != dataID ||
+				dataKey.Version != versionID {
+				return
+			}
+			// Indices stored or deleted at nearer versions were resolved with those versions.
+			for _, nearer := range versions[:pos] {
+				var value, tombstone []byte
+				nearerKey := &DataKey{dsetID, dataID, nearer, dataKey.Index}
+				value, readErr = s.kvGetter.Get(nearerKey)
+				if readErr != nil || value != nil {
+					return
+				}
+				tombstone, readErr = s.kvGetter.Get(nearerKey.Tombstone())
+				if readErr != nil || tombstone != nil {
+					return
+				}
+			}
+			index := dataKey.Index.Bytes()
+			batch.Pairs = append(batch.Pairs, TransferPair{index, chunk.V})
+			batch.Next.Index = index
+			numBytes += len(index) + len(chunk.V)
+			if numBytes >= maxBytes {
+				full = true
+				cancel()
+			}
+		})
+		cancel()
+		if err != nil && !full {
+			return nil, err
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+		if full {
+			return batch, nil
+		}
+		batch.Next = TransferCursor{Version: pos + 1}
+	}
+	batch.Done = true
+	return batch, nil
+}
+
+// BeginTransfer adds the data of a transfer source to the dataset holding the source's
+// node and returns the progress of the transfer into it.  If an unfinished transfer
+// into the data already exists, its progress is returned so it can be resumed.
+func (s *Service) BeginTransfer(source *TransferSource) (*Transfer, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(source.Node)
+	if err != nil {
+		return nil, fmt.Errorf("Node %s must be replicated to this server before its data is transferred: %s",
+			source.Node, err.Error())
+	}
+	dataMap := make(map[dvid.DataString]DataService)
+	if err = dvid.Deserialize(source.DataMap, &dataMap); err != nil {
+		return nil, err
+	}
+	dataservice, found := dataMap[source.Data]
+	if !found || len(dataMap) != 1 {
+		return nil, fmt.Errorf("Transfer source must describe only data '%s'", source.Data)
+	}
+	compiled, found := CompiledTypes[dataservice.DatatypeUrl()]
+	if !found {
+		return nil, fmt.Errorf("Data '%s' has type %s, which is not compiled into this server",
+			source.Data, dataservice.DatatypeUrl())
+	}
+	if !CompatibleVersions(dataservice.DatatypeVersion(), compiled.DatatypeVersion()) {
+		return nil, fmt.Errorf("Data '%s' has type %s version %s, which this server's version %s cannot read",
+			source.Data, dataservice.DatatypeName(), dataservice.DatatypeVersion(), compiled.DatatypeVersion())
+	}
+	data, ok := dataservice.(replicableData)
+	if !ok {
+		return nil, fmt.Errorf("Data '%s' cannot be transferred", source.Data)
+	}
+
+	dataset.mapLock.Lock()
+	transfer := dataset.transfer(source.Data)
+	_, exists := dataset.DataMap[source.Data]
+	switch {
+	case transfer != nil && !transfer.Done && exists:
+		if transfer.Node != source.Node {
+			err = fmt.Errorf("Data '%s' is being transferred at node %s, not %s", source.Data,
+				transfer.Node, source.Node)
+		}
+		progress := *transfer
+		dataset.mapLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return &progress, nil
+	case exists || dataset.scratchIndex(source.Data) >= 0:
+		err = fmt.Errorf("Data named '%s' already exists in dataset %s", source.Data, dataset.Root)
+	default:
+		data.setDatasetID(dataset.DatasetID)
+		data.setLocalID(dataset.NewDataID)
+		dataset.NewDataID++
+		if forker, ok := dataservice.(Forker); ok {
+			err = forker.Forked(dataset.DatasetID)
+		}
+	}
+	if err != nil {
+		dataset.mapLock.Unlock()
+		return nil, err
+	}
+	now := time.Now()
+	transfer = &Transfer{Data: source.Data, Node: source.Node, Started: now, Updated: now}
+	var kept []*Transfer
+	for _, old := range dataset.Transfers {
+		if old.Data != source.Data {
+			kept = append(kept, old)
+		}
+	}
+	dataset.Transfers = append(kept, transfer)
+	dataset.DataMap[source.Data] = dataservice
+	progress := *transfer
+	dataset.mapLock.Unlock()
+
+	s.InvalidateMetadata()
+	if err = dataset.Put(s.kvSetter); err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
+
+// StoreTransferBatch stores a batch of a transfer into the named data of the dataset
+// with the node of the given UUID and returns the progress of the transfer.  The batch
+// must start where the last stored batch ended.  A batch that was already stored is
+// ignored, so a batch can be sent again if its response was lost.
+func (s *Service) StoreTransferBatch(u dvid.UUID, name dvid.DataString, batch *TransferBatch) (*Transfer, error) {
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return nil, err
+	}
+	transferMutex.Lock()
+	defer transferMutex.Unlock()
+
+	dataset.mapLock.Lock()
+	transfer := dataset.transfer(name)
+	dataservice, found := dataset.DataMap[name]
+	versionID := dataset.VersionMap[u]
+	var progress Transfer
+	if transfer != nil {
+		progress = *transfer
+	}
+	dataset.mapLock.Unlock()
+	switch {
+	case transfer == nil || !found:
+		return nil, fmt.Errorf("No transfer into data '%s' in dataset %s", name, dataset.Root)
+	case progress.Node != u:
+		return nil, fmt.Errorf("Data '%s' is being transferred at node %s, not %s", name, progress.Node, u)
+	case sameCursor(batch.Next, progress.Next) && (batch.Done || !progress.Done):
+		return &progress, nil
+	case progress.Done:
+		return nil, fmt.Errorf("Transfer into data '%s' is already done", name)
+	case !sameCursor(batch.Start, progress.Next):
+		return nil, fmt.Errorf("Transfer batch starts at version %d index %x but transfer into '%s' is at version %d index %x",
+			batch.Start.Version, batch.Start.Index, name, progress.Next.Version, progress.Next.Index)
+	}
+
+	dataID := dataservice.(versionedData).LocalID()
+	b := batcher.NewBatch()
+	var numBytes int64
+	for _, pair := range batch.Pairs {
+		b.Put(&DataKey{dataset.DatasetID, dataID, versionID, dvid.IndexBytes(pair.Index)}, pair.Value)
+		numBytes += int64(len(pair.Index) + len(pair.Value))
+	}
+	if err = b.Commit(); err != nil {
+		return nil, err
+	}
+
+	dataset.mapLock.Lock()
+	transfer.Keys += int64(len(batch.Pairs))
+	transfer.Bytes += numBytes
+	transfer.Next = batch.Next
+	transfer.Done = batch.Done
+	transfer.Updated = time.Now()
+	progress = *transfer
+	dataset.mapLock.Unlock()
+	if err = dataset.Put(s.kvSetter); err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
+
+// sameCursor returns true if two cursors are at the same position.
+func sameCursor(c1, c2 TransferCursor) bool {
+	return c1.Version == c2.Version && bytes.Equal(c1.Index, c2.Index)
+}
@@ -0,0 +1,105 @@
+package datastore
+
+import (
+	"bytes"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func (s *DataSuite) TestTransfer(c *C) {
+	source, _, done := openTestService(c)
+	defer done()
+	destDir := c.MkDir()
+	c.Assert(Init(destDir, true, dvid.Config{}), IsNil)
+	dest, openErr := Open(destDir)
+	c.Assert(openErr, IsNil)
+
+	root, _, err := source.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(source.NewData(root, "testtype", "mydata", versioned), IsNil)
+	c.Assert(source.NewData(root, "testtype", "other", versioned), IsNil)
+	dataservice, err := source.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	c.Assert(source.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("a")), []byte("root a")), IsNil)
+	c.Assert(source.kvSetter.Put(data.DataKey(0, dvid.IndexBytes("b")), []byte("root b")), IsNil)
+	c.Assert(source.Lock(root), IsNil)
+	child, err := source.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(source.kvSetter.Put(data.DataKey(1, dvid.IndexBytes("a")), []byte("child a")), IsNil)
+	c.Assert(source.Lock(child), IsNil)
+
+	// The destination must hold the node before data is transferred to it.
+	transferSource, err := source.TransferSource(child, "mydata")
+	c.Assert(err, IsNil)
+	_, err = dest.BeginTransfer(transferSource)
+	c.Assert(err, NotNil)
+	state, err := dest.ReplicaState(root)
+	c.Assert(err, IsNil)
+	var buf bytes.Buffer
+	_, _, err = source.WriteReplication(&buf, child, state, []dvid.DataString{"other"})
+	c.Assert(err, IsNil)
+	_, _, err = dest.ReadReplication(&buf)
+	c.Assert(err, IsNil)
+
+	// Each batch holds one pair, and indices of nearer versions are read once.
+	transfer, err := dest.BeginTransfer(transferSource)
+	c.Assert(err, IsNil)
+	c.Assert(transfer.Keys, Equals, int64(0))
+	first, err := source.ReadTransferBatch(child, "mydata", transfer.Next, 1)
+	c.Assert(err, IsNil)
+	c.Assert(first.Done, Equals, false)
+	c.Assert(first.Pairs, DeepEquals, []TransferPair{{[]byte("a"), []byte("child a")}})
+	transfer, err = dest.StoreTransferBatch(child, "mydata", first)
+	c.Assert(err, IsNil)
+	c.Assert(transfer.Keys, Equals, int64(1))
+
+	// Interrupted transfers resume after the last stored batch.
+	dest.Shutdown()
+	reopened, openErr := Open(destDir)
+	c.Assert(openErr, IsNil)
+	defer reopened.Shutdown()
+	transfer, err = reopened.BeginTransfer(transferSource)
+	c.Assert(err, IsNil)
+	c.Assert(transfer.Keys, Equals, int64(1))
+	c.Assert(transfer.Next, DeepEquals, first.Next)
+
+	// Batches already stored are ignored, and batches out of order are rejected.
+	transfer, err = reopened.StoreTransferBatch(child, "mydata", first)
+	c.Assert(err, IsNil)
+	c.Assert(transfer.Keys, Equals, int64(1))
+	last, err := source.ReadTransferBatch(child, "mydata", TransferCursor{Version: 2}, 1)
+	c.Assert(err, IsNil)
+	c.Assert(last.Done, Equals, true)
+	c.Assert(last.Pairs, HasLen, 0)
+	_, err = reopened.StoreTransferBatch(child, "mydata", last)
+	c.Assert(err, NotNil)
+
+	for !transfer.Done {
+		batch, err := source.ReadTransferBatch(child, "mydata", transfer.Next, 1)
+		c.Assert(err, IsNil)
+		transfer, err = reopened.StoreTransferBatch(child, "mydata", batch)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(transfer.Keys, Equals, int64(2))
+	_, err = reopened.BeginTransfer(transferSource)
+	c.Assert(err, NotNil)
+
+	// The transferred values are stored at the node.
+	dataservice, err = reopened.DataServiceByUUID(child, "mydata")
+	c.Assert(err, IsNil)
+	transferred := dataservice.(*testData)
+	dset, err := reopened.DatasetFromUUID(child)
+	c.Assert(err, IsNil)
+	childID := dset.VersionMap[child]
+	value, err := reopened.kvGetter.Get(transferred.DataKey(childID, dvid.IndexBytes("a")))
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []byte("child a"))
+	value, err = reopened.kvGetter.Get(transferred.DataKey(childID, dvid.IndexBytes("b")))
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, []byte("root b"))
+}
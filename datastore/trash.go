@@ -0,0 +1,458 @@
+/*
+	This file supports soft deletion of data instances.  Deleted data is moved into its
+	dataset's trash, where it is hidden from listings but can be restored until garbage
+	collection reclaims its key/value pairs.  Data can also be purged, deleting its
+	key/value pairs right away, once the purge is confirmed with a nonce.  Purged data
+	stays in the trash, where it cannot be restored, until its keys are deleted, so
+	garbage collection finishes purges interrupted by a restart.
+*/
+
+package datastore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// TrashRetention is how long deleted data can be restored before garbage collection
+// may reclaim it.
+var TrashRetention = 7 * 24 * time.Hour
+
+// Number of key/value pairs deleted per batch when reclaiming trashed data.
+const trashBatchSize = 1000
+
+// GCLimits are the resource limits of garbage collection jobs reclaiming deleted and
+// expired scratch data.
+var GCLimits JobLimits
+
+// PurgeConfirmationTTL is how long a nonce confirming the purge of data is valid.
+var PurgeConfirmationTTL = 5 * time.Minute
+
+// TrashedData is a soft-deleted data instance.
+type TrashedData struct {
+	Data    DataService
+	Deleted time.Time
+
+	// Purged is true if the data is being permanently deleted and cannot be restored.
+	Purged bool
+}
+
+// MarshalJSON describes the trashed data without its type-specific properties.
+func (t *TrashedData) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name     dvid.DataString
+		TypeName dvid.TypeString
+		Deleted  time.Time
+		Expires  time.Time
+		Purged   bool `json:",omitempty"`
+	}{
+		t.Data.DataName(),
+		t.Data.DatatypeName(),
+		t.Deleted,
+		t.Deleted.Add(TrashRetention),
+		t.Purged,
+	})
+}
+
+// trashData moves the named data from the dataset's data map into its trash.
+func (dset *Dataset) trashData(name dvid.DataString) error {
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+
+	dataservice, found := dset.DataMap[name]
+	if !found {
+		return fmt.Errorf("Data '%s' not found in dataset %s", name, dset.Root)
+	}
+	delete(dset.DataMap, name)
+	dset.Trash = append(dset.Trash, &TrashedData{Data: dataservice, Deleted: time.Now()})
+	return nil
+}
+
+// restoreData moves the most recently deleted data of the given name from the trash
+// back into the dataset's data map.
+func (dset *Dataset) restoreData(name dvid.DataString) error {
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+
+	if _, found := dset.DataMap[name]; found {
+		return fmt.Errorf("Cannot restore '%s': data with that name already exists in dataset %s",
+			name, dset.Root)
+	}
+	for i := len(dset.Trash) - 1; i >= 0; i-- {
+		trashed := dset.Trash[i]
+		if trashed.Data.DataName() != name || trashed.Purged {
+			continue
+		}
+		if dset.DataMap == nil {
+			dset.DataMap = make(map[dvid.DataString]DataService)
+		}
+		dset.DataMap[name] = trashed.Data
+		dset.Trash = append(dset.Trash[:i], dset.Trash[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("No deleted data '%s' found in trash of dataset %s", name, dset.Root)
+}
+
+// purgeData marks the named data as purged, moving it into the trash if it has not
+// been deleted, and returns its trash entry.
+func (dset *Dataset) purgeData(name dvid.DataString) (*TrashedData, error) {
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+
+	delete(dset.DataACLs, name)
+	if dataservice, found := dset.DataMap[name]; found {
+		delete(dset.DataMap, name)
+		trashed := &TrashedData{Data: dataservice, Deleted: time.Now(), Purged: true}
+		dset.Trash = append(dset.Trash, trashed)
+		return trashed, nil
+	}
+	for i := len(dset.Trash) - 1; i >= 0; i-- {
+		trashed := dset.Trash[i]
+		if trashed.Data.DataName() == name && !trashed.Purged {
+			trashed.Purged = true
+			return trashed, nil
+		}
+	}
+	return nil, fmt.Errorf("Data '%s' not found in dataset %s or its trash", name, dset.Root)
+}
+
+// removeTrashed removes an entry from the trash if it is still there.
+func (dset *Dataset) removeTrashed(trashed *TrashedData) {
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+
+	for i, t := range dset.Trash {
+		if t == trashed {
+			dset.Trash = append(dset.Trash[:i], dset.Trash[i+1:]...)
+			return
+		}
+	}
+}
+
+// hasData returns true if the named data is in the dataset or, unless purged, its trash.
+func (dset *Dataset) hasData(name dvid.DataString) bool {
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+
+	if _, found := dset.DataMap[name]; found {
+		return true
+	}
+	for _, trashed := range dset.Trash {
+		if trashed.Data.DataName() == name && !trashed.Purged {
+			return true
+		}
+	}
+	return false
+}
+
+// expiredTrash returns purged data and trashed data deleted before the given time,
+// marking the latter purged so it can no longer be restored.  The entries stay in the
+// trash until their keys are deleted.
+func (dset *Dataset) expiredTrash(cutoff time.Time) []*TrashedData {
+	dset.mapLock.Lock()
+	defer dset.mapLock.Unlock()
+
+	var expired []*TrashedData
+	for _, trashed := range dset.Trash {
+		if trashed.Purged || trashed.Deleted.Before(cutoff) {
+			trashed.Purged = true
+			expired = append(expired, trashed)
+		}
+	}
+	return expired
+}
+
+// deleteDataKeys deletes all key/value pairs across all versions of the given data,
+// including its tombstones and changelog.  The I/O is throttled by the job, which may be nil.
+func (s *Service) deleteDataKeys(batcher storage.Batcher, dsetID dvid.DatasetLocalID,
+	dataID dvid.DataLocalID, job *Job) (int, error) {
+
+	minKey := &DataKey{dsetID, dataID, 0, dvid.IndexBytes{}}
+	maxKey := &DataKey{dsetID, dataID + 1, 0, nil}
+	numKeys, err := deleteKeyRange(s.kvGetter, batcher, job, minKey, maxKey, func(key storage.Key) bool {
+		dataKey, ok := key.(*DataKey)
+		return ok && dataKey.Data == dataID
+	})
+	if err != nil {
+		return numKeys, err
+	}
+	numTombstones, err := deleteKeyRange(s.kvGetter, batcher, job, minKey.Tombstone(), maxKey.Tombstone(),
+		func(key storage.Key) bool {
+			tombstone, ok := key.(*TombstoneKey)
+			return ok && tombstone.Data == dataID
+		})
+	numKeys += numTombstones
+	if err != nil {
+		return numKeys, err
+	}
+	id := changelogID{dsetID, dataID}
+	minLogKey, maxLogKey := changelogRange(id)
+	numEvents, err := deleteKeyRange(s.kvGetter, batcher, job, minLogKey, maxLogKey, func(key storage.Key) bool {
+		changelogKey, ok := key.(*ChangelogKey)
+		return ok && changelogKey.Data == dataID
+	})
+	s.changelogs.forget(id)
+	return numKeys + numEvents, err
+}
+
+// deleteKeyRange deletes the keys within a range that are selected by a function, in
+// batches of trashBatchSize as the range is read, returning the number of keys deleted.
+// The I/O is throttled by the job, which may be nil.
+func deleteKeyRange(db storage.KeyValueGetter, batcher storage.Batcher, job *Job, minKey, maxKey storage.Key,
+	selected func(storage.Key) bool) (int, error) {
+
+	var numDeleted, numBatched int
+	var commitErr error
+	batch := batcher.NewBatch()
+	err := db.ProcessRange(job.Context(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		if commitErr != nil {
+			return
+		}
+		job.Throttle(len(chunk.K.Bytes()) + len(chunk.V))
+		if !selected(chunk.K) {
+			return
+		}
+		batch.Delete(chunk.K)
+		numBatched++
+		if numBatched >= trashBatchSize {
+			if commitErr = batch.Commit(); commitErr != nil {
+				return
+			}
+			numDeleted += numBatched
+			batch = batcher.NewBatch()
+			numBatched = 0
+		}
+	})
+	if commitErr != nil {
+		return numDeleted, commitErr
+	}
+	if err != nil {
+		return numDeleted, err
+	}
+	if err = batch.Commit(); err != nil {
+		return numDeleted, err
+	}
+	return numDeleted + numBatched, nil
+}
+
+// DeleteData moves data of given name in the dataset specified by a UUID into the
+// dataset's trash.  It can be restored until it is older than TrashRetention and
+// reclaimed by CollectTrash.
+func (s *Service) DeleteData(u dvid.UUID, dataname dvid.DataString) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	if err = dataset.trashData(dataname); err != nil {
+		return err
+	}
+	s.InvalidateMetadata()
+	return dataset.Put(s.kvSetter)
+}
+
+// RestoreData moves the most recently deleted data of given name out of the trash
+// of the dataset specified by a UUID.
+func (s *Service) RestoreData(u dvid.UUID, dataname dvid.DataString) error {
+	if s.Datasets == nil {
+		return fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return err
+	}
+	if err = dataset.restoreData(dataname); err != nil {
+		return err
+	}
+	s.InvalidateMetadata()
+	return dataset.Put(s.kvSetter)
+}
+
+// TrashJSON returns JSON listing the deleted data of the dataset specified by a UUID.
+func (s *Service) TrashJSON(u dvid.UUID) (string, error) {
+	if s.Datasets == nil {
+		return "[]", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return "[]", err
+	}
+	dataset.mapLock.Lock()
+	m, err := json.Marshal(dataset.Trash)
+	dataset.mapLock.Unlock()
+	if err != nil {
+		return "[]", err
+	}
+	if dataset.Trash == nil {
+		return "[]", nil
+	}
+	return string(m), nil
+}
+
+// A pending confirmation of a purge.
+type purgeConfirmation struct {
+	root     dvid.UUID
+	dataname dvid.DataString
+	expires  time.Time
+}
+
+var (
+	purgeConfirmations     = make(map[string]purgeConfirmation)
+	purgeConfirmationsLock sync.Mutex
+)
+
+// PurgeNonce returns a nonce that must be given to PurgeData within PurgeConfirmationTTL
+// to permanently delete the named data in the dataset specified by a UUID.
+func (s *Service) PurgeNonce(u dvid.UUID, dataname dvid.DataString) (string, error) {
+	if s.Datasets == nil {
+		return "", fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return "", err
+	}
+	if !dataset.hasData(dataname) {
+		return "", fmt.Errorf("Data '%s' not found in dataset %s or its trash", dataname, dataset.Root)
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Unable to generate purge confirmation: %s", err.Error())
+	}
+	nonce := hex.EncodeToString(b)
+
+	now := time.Now()
+	purgeConfirmationsLock.Lock()
+	defer purgeConfirmationsLock.Unlock()
+	for n, confirmation := range purgeConfirmations {
+		if now.After(confirmation.expires) {
+			delete(purgeConfirmations, n)
+		}
+	}
+	purgeConfirmations[nonce] = purgeConfirmation{dataset.Root, dataname, now.Add(PurgeConfirmationTTL)}
+	return nonce, nil
+}
+
+// PurgeData permanently deletes the named data in the dataset specified by a UUID,
+// including its trashed copy if it was already deleted, given the nonce returned by
+// PurgeNonce.  The data is removed from the dataset and its key/value pairs are deleted,
+// in the background if async is true, by a job with GCLimits.  The number of deleted
+// key/value pairs is returned unless the deletion is asynchronous.
+func (s *Service) PurgeData(u dvid.UUID, dataname dvid.DataString, nonce string, async bool) (int, error) {
+	if s.Datasets == nil {
+		return 0, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return 0, err
+	}
+	purgeConfirmationsLock.Lock()
+	confirmation, found := purgeConfirmations[nonce]
+	if found && confirmation.root == dataset.Root && confirmation.dataname == dataname {
+		delete(purgeConfirmations, nonce)
+	}
+	purgeConfirmationsLock.Unlock()
+	switch {
+	case !found || confirmation.root != dataset.Root || confirmation.dataname != dataname:
+		return 0, fmt.Errorf("Purge of data '%s' was not confirmed: get a new confirmation nonce", dataname)
+	case time.Now().After(confirmation.expires):
+		return 0, fmt.Errorf("Purge confirmation of data '%s' expired: get a new confirmation nonce", dataname)
+	}
+
+	trashed, err := dataset.purgeData(dataname)
+	if err != nil {
+		return 0, err
+	}
+	data, ok := trashed.Data.(forkableData)
+	if !ok {
+		return 0, fmt.Errorf("Cannot delete keys of data '%s'", dataname)
+	}
+	s.InvalidateMetadata()
+	if err = dataset.Put(s.kvSetter); err != nil {
+		return 0, err
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return 0, err
+	}
+	purge := func() (int, error) {
+		job := StartJob("gc", fmt.Sprintf("purge data '%s' of dataset %s", dataname, dataset.Root), GCLimits)
+		defer job.Finish()
+		numKeys, err := s.deleteDataKeys(batcher, dataset.DatasetID, data.LocalID(), job)
+		if err != nil {
+			return numKeys, err
+		}
+		dataset.removeTrashed(trashed)
+		if err = dataset.Put(s.kvSetter); err != nil {
+			return numKeys, err
+		}
+		dvid.Log(dvid.Normal, "Purged data '%s' with %d key/value pairs from dataset %s\n",
+			dataname, numKeys, dataset.Root)
+		return numKeys, nil
+	}
+	if !async {
+		return purge()
+	}
+	go func() {
+		if _, err := purge(); err != nil {
+			dvid.Error("Error purging data '%s' of dataset %s: %s", dataname, dataset.Root, err.Error())
+		}
+	}()
+	return 0, nil
+}
+
+// CollectTrash permanently deletes all data that has been in the trash longer than
+// the given retention, returning the number of data instances reclaimed.  Data whose
+// deletion is interrupted, e.g., by shutdown canceling the job, stays in the trash as
+// purged and is reclaimed by the next collection.
+func (s *Service) CollectTrash(retention time.Duration) (int, error) {
+	if s.Datasets == nil {
+		return 0, fmt.Errorf("Datastore service has no datasets available")
+	}
+	batcher, err := s.Batcher()
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-retention)
+	var reclaimed int
+	var job *Job
+	for _, dataset := range s.Datasets.list {
+		expired := dataset.expiredTrash(cutoff)
+		if len(expired) == 0 {
+			continue
+		}
+		if job == nil {
+			job = StartJob("gc", "trash collection", GCLimits)
+			defer job.Finish()
+		}
+		if err = dataset.Put(s.kvSetter); err != nil {
+			return reclaimed, err
+		}
+		for _, trashed := range expired {
+			data, ok := trashed.Data.(forkableData)
+			if !ok {
+				return reclaimed, fmt.Errorf("Cannot reclaim keys of deleted data '%s'", trashed.Data.DataName())
+			}
+			numKeys, err := s.deleteDataKeys(batcher, dataset.DatasetID, data.LocalID(), job)
+			if err != nil {
+				return reclaimed, err
+			}
+			dataset.removeTrashed(trashed)
+			if err = dataset.Put(s.kvSetter); err != nil {
+				return reclaimed, err
+			}
+			dvid.Log(dvid.Normal, "Reclaimed deleted data '%s' with %d key/value pairs from dataset %s\n",
+				trashed.Data.DataName(), numKeys, dataset.Root)
+			reclaimed++
+		}
+	}
+	return reclaimed, nil
+}
@@ -0,0 +1,163 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+func (s *DataSuite) TestTrashRestore(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "mydata", dvid.NewConfig()), IsNil)
+	dataservice, err := service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	key := dataservice.(*testData).DataKey(0, dvid.IndexBytes("a"))
+	c.Assert(service.kvSetter.Put(key, []byte("value a")), IsNil)
+
+	// Deleted data is hidden but restorable.
+	c.Assert(service.DeleteData(root, "mydata"), IsNil)
+	_, err = service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, NotNil)
+	jsonStr, err := service.DatasetJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Not(Matches), ".*mydata.*")
+	jsonStr, err = service.TrashJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Matches, `\[\{"Name":"mydata","TypeName":"testtype".*`)
+
+	c.Assert(service.RestoreData(root, "mydata"), IsNil)
+	_, err = service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, IsNil)
+	c.Assert(service.RestoreData(root, "mydata"), NotNil)
+
+	// Unexpired trash is kept while expired trash is reclaimed with its keys.
+	c.Assert(service.DeleteData(root, "mydata"), IsNil)
+	reclaimed, err := service.CollectTrash(time.Hour)
+	c.Assert(err, IsNil)
+	c.Assert(reclaimed, Equals, 0)
+	value, err := service.kvGetter.Get(key)
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "value a")
+
+	reclaimed, err = service.CollectTrash(0)
+	c.Assert(err, IsNil)
+	c.Assert(reclaimed, Equals, 1)
+	value, err = service.kvGetter.Get(key)
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+	c.Assert(service.RestoreData(root, "mydata"), NotNil)
+
+	// Keys are deleted in batches, and expired data whose deletion is interrupted stays
+	// unrestorable in the trash until the next collection.
+	c.Assert(service.NewData(root, "testtype", "bigdata", dvid.NewConfig()), IsNil)
+	dataservice, err = service.DataServiceByUUID(root, "bigdata")
+	c.Assert(err, IsNil)
+	data := dataservice.(*testData)
+	numKeys := 2*trashBatchSize + 1
+	for i := 0; i < numKeys; i++ {
+		key := data.DataKey(0, dvid.IndexBytes(fmt.Sprintf("%05d", i)))
+		c.Assert(service.kvSetter.Put(key, []byte("value")), IsNil)
+	}
+	c.Assert(service.DeleteData(root, "bigdata"), IsNil)
+	dataset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	c.Assert(dataset.expiredTrash(time.Now()), HasLen, 1)
+	batcher, err := service.Batcher()
+	c.Assert(err, IsNil)
+	job := StartJob("gc", "canceled collection", GCLimits)
+	job.Cancel()
+	_, err = service.deleteDataKeys(batcher, dataset.DatasetID, data.LocalID(), job)
+	job.Finish()
+	c.Assert(err, NotNil)
+	c.Assert(service.RestoreData(root, "bigdata"), NotNil)
+	numDeleted, err := service.deleteDataKeys(batcher, dataset.DatasetID, data.LocalID(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(numDeleted, Equals, numKeys)
+	reclaimed, err = service.CollectTrash(time.Hour)
+	c.Assert(err, IsNil)
+	c.Assert(reclaimed, Equals, 1)
+	jsonStr, err = service.TrashJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, "[]")
+}
+
+func (s *DataSuite) TestPurgeData(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	c.Assert(service.NewData(root, "testtype", "mydata", dvid.NewConfig()), IsNil)
+	c.Assert(service.NewData(root, "testtype", "trashed", dvid.NewConfig()), IsNil)
+	var keys []storage.Key
+	for _, name := range []dvid.DataString{"mydata", "trashed"} {
+		dataservice, err := service.DataServiceByUUID(root, name)
+		c.Assert(err, IsNil)
+		key := dataservice.(*testData).DataKey(0, dvid.IndexBytes("a"))
+		c.Assert(service.kvSetter.Put(key, []byte("value a")), IsNil)
+		keys = append(keys, key)
+	}
+
+	// Purges need a nonce confirming the same data.
+	_, err = service.PurgeNonce(root, "nodata")
+	c.Assert(err, NotNil)
+	nonce, err := service.PurgeNonce(root, "mydata")
+	c.Assert(err, IsNil)
+	_, err = service.PurgeData(root, "mydata", "badnonce", false)
+	c.Assert(err, NotNil)
+	_, err = service.PurgeData(root, "trashed", nonce, false)
+	c.Assert(err, NotNil)
+	numKeys, err := service.PurgeData(root, "mydata", nonce, false)
+	c.Assert(err, IsNil)
+	c.Assert(numKeys, Equals, 1)
+	_, err = service.PurgeData(root, "mydata", nonce, false)
+	c.Assert(err, NotNil)
+	_, err = service.DataServiceByUUID(root, "mydata")
+	c.Assert(err, NotNil)
+	value, err := service.kvGetter.Get(keys[0])
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+	jsonStr, err := service.TrashJSON(root)
+	c.Assert(err, IsNil)
+	c.Assert(jsonStr, Equals, "[]")
+
+	// Expired nonces are rejected.
+	oldTTL := PurgeConfirmationTTL
+	PurgeConfirmationTTL = -time.Second
+	nonce, err = service.PurgeNonce(root, "trashed")
+	PurgeConfirmationTTL = oldTTL
+	c.Assert(err, IsNil)
+	_, err = service.PurgeData(root, "trashed", nonce, false)
+	c.Assert(err, NotNil)
+
+	// Trashed data can be purged and is not restorable while its keys are deleted.
+	c.Assert(service.DeleteData(root, "trashed"), IsNil)
+	nonce, err = service.PurgeNonce(root, "trashed")
+	c.Assert(err, IsNil)
+	dataset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	trashed, err := dataset.purgeData("trashed")
+	c.Assert(err, IsNil)
+	c.Assert(trashed.Purged, Equals, true)
+	c.Assert(service.RestoreData(root, "trashed"), NotNil)
+	_, err = service.PurgeNonce(root, "trashed")
+	c.Assert(err, NotNil)
+
+	// Garbage collection finishes interrupted purges.
+	reclaimed, err := service.CollectTrash(time.Hour)
+	c.Assert(err, IsNil)
+	c.Assert(reclaimed, Equals, 1)
+	value, err = service.kvGetter.Get(keys[1])
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+	_, err = service.PurgeData(root, "trashed", nonce, false)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,119 @@
+/*
+	This file supports reads and writes of the stored values of data by index, e.g.,
+	blocks of voxels, for clients that transfer values without type-specific
+	processing.  Values are transferred as stored, i.e., serialized with the data's
+	compression and checksum, and reads are resolved through ancestors.
+*/
+
+package datastore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// StoredValuePutter is data that accepts stored values written by PutValue.  The data
+// stores each value through its own write path, keeping whatever it derives from its
+// values, e.g., extents, consistent.  Data that does not implement it refuses PutValue.
+type StoredValuePutter interface {
+	// PutStoredValue stores a serialized value of an index at a version of the node
+	// with the given UUID.
+	PutStoredValue(u dvid.UUID, versionID dvid.VersionLocalID, index dvid.Index, value []byte) error
+}
+
+// storedData returns the data service with the given name and the versions that must
+// be read to resolve it at the node with the given UUID.
+func (s *Service) storedData(u dvid.UUID, dataname dvid.DataString) (DataService, versionedData,
+	[]dvid.VersionLocalID, error) {
+
+	if s.Datasets == nil {
+		return nil, nil, nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataservice, err := s.DataServiceByUUID(u, dataname)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	data, ok := dataservice.(versionedData)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("Data '%s' does not support access to stored values", dataname)
+	}
+	versions, err := s.DataVersions(u, dataname)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return dataservice, data, versions, nil
+}
+
+// GetValue returns the stored value of an index of the named data as read at the node
+// with the given UUID, or nil if no value is stored.
+func (s *Service) GetValue(u dvid.UUID, dataname dvid.DataString, index dvid.Index) ([]byte, error) {
+	_, data, versions, err := s.storedData(u, dataname)
+	if err != nil {
+		return nil, err
+	}
+	dataID := DataID{Name: dataname, ID: data.LocalID(), DsetID: data.DatasetID()}
+	return GetVersionedValue(s.kvGetter, dataID, versions, index)
+}
+
+// ProcessValues calls f with each index and stored value of the named data with indices
+// from indexBeg to indexEnd, inclusive, as read at the node with the given UUID.
+// Values are sent in index order and processing stops at the first error returned by f
+// or when the context is canceled.
+func (s *Service) ProcessValues(ctx context.Context, u dvid.UUID, dataname dvid.DataString, indexBeg, indexEnd dvid.Index,
+	f func(index, value []byte) error) error {
+
+	_, data, versions, err := s.storedData(u, dataname)
+	if err != nil {
+		return err
+	}
+	dataID := DataID{Name: dataname, ID: data.LocalID(), DsetID: data.DatasetID()}
+	keyvalues, err := GetVersionedRange(ctx, s.kvGetter, dataID, versions, indexBeg, indexEnd)
+	if err != nil {
+		return err
+	}
+	for _, kv := range keyvalues {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dataKey, ok := kv.K.(*DataKey)
+		if !ok {
+			return fmt.Errorf("Expected DataKey in range of data '%s', got %s", dataname, kv.K)
+		}
+		if err := f(dataKey.Index.Bytes(), kv.V); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutValue stores a serialized value of an index of the named data at the unlocked node
+// with the given UUID.  The value must deserialize, e.g., it was read by GetValue, and
+// the data must be a StoredValuePutter.
+func (s *Service) PutValue(u dvid.UUID, dataname dvid.DataString, index dvid.Index, value []byte) error {
+	dataservice, _, versions, err := s.storedData(u, dataname)
+	if err != nil {
+		return err
+	}
+	putter, ok := dataservice.(StoredValuePutter)
+	if !ok {
+		return fmt.Errorf("Data '%s' of type %s does not accept stored values; use its own API",
+			dataname, dataservice.DatatypeName())
+	}
+	locked, err := s.Locked(u)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return fmt.Errorf("Node %s is locked and cannot be modified", u)
+	}
+	if _, _, err := dvid.DeserializeData(value, false); err != nil {
+		return fmt.Errorf("Value of data '%s' is not serialized: %s", dataname, err.Error())
+	}
+	if err := putter.PutStoredValue(u, versions[0], index, value); err != nil {
+		return err
+	}
+	s.Invalidate(dataservice, u, []dvid.Index{index})
+	return nil
+}
@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"context"
+	"net/http"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// serializedData stores only serialized values.
+type serializedData struct {
+	*Data
+}
+
+func (d *serializedData) DoRPC(ctx context.Context, request Request, reply *Response) error {
+	return nil
+}
+
+func (d *serializedData) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (d *serializedData) SerializedIndex(index []byte) bool {
+	return true
+}
+
+// storingData accepts stored values, putting them directly into the store.
+type storingData struct {
+	*Data
+	db storage.KeyValueSetter
+}
+
+func (d *storingData) DoRPC(ctx context.Context, request Request, reply *Response) error {
+	return nil
+}
+
+func (d *storingData) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (d *storingData) PutStoredValue(u dvid.UUID, versionID dvid.VersionLocalID, index dvid.Index, value []byte) error {
+	return d.db.Put(d.DataKey(versionID, index), value)
+}
+
+func (s *DataSuite) TestStoredValues(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	serialize := func(value string) []byte {
+		s, err := dvid.SerializeData([]byte(value), compression, dvid.CRC32)
+		c.Assert(err, IsNil)
+		return s
+	}
+	c.Assert(service.PutValue(root, "mydata", dvid.IndexBytes("a"), serialize("root a")), NotNil)
+	dset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	data := dset.DataMap["mydata"].(*testData)
+	dset.DataMap["mydata"] = &storingData{data.Data, service.kvSetter}
+	c.Assert(service.PutValue(root, "mydata", dvid.IndexBytes("a"), serialize("root a")), IsNil)
+	c.Assert(service.PutValue(root, "mydata", dvid.IndexBytes("b"), serialize("root b")), IsNil)
+	c.Assert(service.PutValue(root, "mydata", dvid.IndexBytes("c"), []byte("not serialized")), NotNil)
+	c.Assert(service.Lock(root), IsNil)
+	c.Assert(service.PutValue(root, "mydata", dvid.IndexBytes("c"), serialize("root c")), NotNil)
+
+	child, err := service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(service.PutValue(child, "mydata", dvid.IndexBytes("b"), serialize("child b")), IsNil)
+
+	value, err := service.GetValue(child, "mydata", dvid.IndexBytes("a"))
+	c.Assert(err, IsNil)
+	c.Assert(value, DeepEquals, serialize("root a"))
+	value, err = service.GetValue(child, "mydata", dvid.IndexBytes("z"))
+	c.Assert(err, IsNil)
+	c.Assert(value, IsNil)
+
+	var values []string
+	err = service.ProcessValues(context.Background(), child, "mydata", dvid.IndexBytes("a"), dvid.IndexBytes("z"),
+		func(index, value []byte) error {
+			data, _, err := dvid.DeserializeData(value, true)
+			values = append(values, string(index)+"="+string(data))
+			return err
+		})
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []string{"a=root a", "b=child b"})
+}
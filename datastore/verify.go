@@ -0,0 +1,404 @@
+/*
+	This file supports verification of stored data against its checksums.  Verification
+	of a dataset also checks that each stored index of data is well formed and finds
+	orphaned keys, i.e., those of versions or data no longer in the dataset, and can
+	move corrupt and orphaned key/value pairs into quarantine.
+*/
+
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Verifier is a data service that can check the integrity of all its stored values.
+type Verifier interface {
+	Verify(db storage.KeyValueGetter) (*VerifyReport, error)
+}
+
+// VerifyReport summarizes a verification traversal of a data instance.
+type VerifyReport struct {
+	// Name of the verified data.
+	Name dvid.DataString
+
+	// Number of key/value pairs read across all versions.
+	KeysChecked int
+
+	// Number of values that were stored without any checksum and therefore
+	// could only be checked for readability.
+	Unchecksummed int
+
+	// Hexadecimal keys of values that failed checksum verification.
+	CorruptKeys []string
+
+	// Hexadecimal keys whose index does not decode to a well-formed index of the data.
+	MalformedKeys []string `json:",omitempty"`
+
+	// Hexadecimal keys of versions that are not in the dataset.
+	OrphanedKeys []string `json:",omitempty"`
+}
+
+func (r *VerifyReport) String() string {
+	text := fmt.Sprintf("Verified data '%s': %d keys checked, %d without checksum, %d corrupt\n",
+		r.Name, r.KeysChecked, r.Unchecksummed, len(r.CorruptKeys))
+	for _, key := range r.CorruptKeys {
+		text += fmt.Sprintf("  corrupt key: %s\n", key)
+	}
+	for _, key := range r.MalformedKeys {
+		text += fmt.Sprintf("  malformed key: %s\n", key)
+	}
+	for _, key := range r.OrphanedKeys {
+		text += fmt.Sprintf("  orphaned key: %s\n", key)
+	}
+	return text
+}
+
+// VerifyOptions control verification of a dataset.
+type VerifyOptions struct {
+	// Quarantine moves corrupt, malformed, and orphaned key/value pairs under
+	// QuarantineKeys, where they are kept but no longer read as data.
+	Quarantine bool
+}
+
+// DatasetVerifyReport summarizes verification of data in a dataset.
+type DatasetVerifyReport struct {
+	Root dvid.UUID
+	Data []*VerifyReport
+
+	// OrphanedKeys are hexadecimal keys of data not in the dataset, which are only
+	// found when all data of the dataset are verified.
+	OrphanedKeys []string
+
+	// Quarantined counts the key/value pairs moved into quarantine.
+	Quarantined int
+}
+
+func (r *DatasetVerifyReport) String() string {
+	var text string
+	for _, report := range r.Data {
+		text += report.String()
+	}
+	if len(r.OrphanedKeys) != 0 {
+		text += fmt.Sprintf("Dataset %s has %d keys of unknown data\n", r.Root, len(r.OrphanedKeys))
+		for _, key := range r.OrphanedKeys {
+			text += fmt.Sprintf("  orphaned key: %s\n", key)
+		}
+	}
+	if r.Quarantined != 0 {
+		text += fmt.Sprintf("Moved %d key/value pairs into quarantine\n", r.Quarantined)
+	}
+	return text
+}
+
+// verifyQuarantineBatchSize is the number of key/value pairs moved into quarantine
+// per batch.
+const verifyQuarantineBatchSize = 1000
+
+// IndexValidator is a data service that checks its own stored indices, e.g., because it
+// stores denormalizations alongside its blocks.  Verification prefers it to IndexDecoder.
+type IndexValidator interface {
+	ValidIndex(index []byte) bool
+}
+
+// verifyValue checks the checksum of a stored value, counting values without one, and
+// returns false if the value is corrupt.  Empty values, which data use as markers, are
+// never corrupt.
+func verifyValue(report *VerifyReport, key storage.Key, value []byte) bool {
+	if len(value) == 0 {
+		return true
+	}
+	env, err := dvid.DecodeEnvelope(value)
+	if err != nil {
+		dvid.Log(dvid.Normal, "Verification of data '%s' failed for key %s: %s\n",
+			report.Name, key, err.Error())
+		return false
+	}
+	compression, checksum := env.Compression, env.Checksum
+	uncompress := false
+	if checksum == dvid.NoChecksum {
+		// Gzip has its own checksum that is checked on uncompression.  Otherwise,
+		// the best we can do is make sure the value is readable.
+		if compression != dvid.Gzip {
+			report.Unchecksummed++
+		}
+		uncompress = true
+	}
+	if _, _, err := dvid.DeserializeData(value, uncompress); err != nil {
+		dvid.Log(dvid.Normal, "Verification of data '%s' failed for key %s: %s\n",
+			report.Name, key, err.Error())
+		return false
+	}
+	return true
+}
+
+// wellFormedIndex returns true if the data validates a stored index, or if the index
+// decodes to an index of the data that encodes back to the same bytes.  Indices of data
+// that is neither an IndexValidator nor an IndexDecoder are always well formed.
+func wellFormedIndex(dataservice DataService, index []byte) bool {
+	if validator, ok := dataservice.(IndexValidator); ok {
+		return validator.ValidIndex(index)
+	}
+	decoder, ok := dataservice.(IndexDecoder)
+	if !ok {
+		return true
+	}
+	decoded, err := decoder.DecodeIndex(index)
+	return err == nil && decoded != nil && bytes.Equal(decoded.Bytes(), index)
+}
+
+// dataKeyRange returns the range of keys spanning all versions of this data.
+func (d *Data) dataKeyRange() (minKey, maxKey *DataKey) {
+	minKey = &DataKey{d.DsetID, d.ID, 0, dvid.IndexBytes{}}
+	if d.ID == maxDataLocalID {
+		maxKey = &DataKey{d.DsetID + 1, 0, 0, nil}
+	} else {
+		maxKey = &DataKey{d.DsetID, d.ID + 1, 0, nil}
+	}
+	return
+}
+
+// Verify traverses all stored values for this data across all versions, recomputing
+// their checksums, and returns a report that includes any corrupt keys.
+func (d *Data) Verify(db storage.KeyValueGetter) (*VerifyReport, error) {
+	report := &VerifyReport{Name: d.DataName()}
+	minKey, maxKey := d.dataKeyRange()
+	err := db.ProcessRange(context.Background(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		report.KeysChecked++
+		if !verifyValue(report, chunk.K, chunk.V) {
+			report.CorruptKeys = append(report.CorruptKeys, chunk.K.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// VerifyDataset verifies the named data, or all data, of the dataset with the node of
+// the given UUID, reporting its progress through the job.  Each key/value pair is checked
+// for a readable value with a matching checksum, a well-formed index, and a version in
+// the dataset.  If all data are verified, keys of data that are not current, deleted, or
+// scratch data of the dataset are also reported as orphaned.
+func (s *Service) VerifyDataset(u dvid.UUID, datanames []dvid.DataString, opts VerifyOptions,
+	job *Job) (*DatasetVerifyReport, error) {
+
+	if s.Datasets == nil {
+		return nil, fmt.Errorf("Datastore service has no datasets available")
+	}
+	dataset, err := s.Datasets.DatasetFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// Take the snapshot before finding data and versions so every key read belongs to
+	// data and versions that are known.  Without a snapshot, orphaned keys are checked
+	// again before they are quarantined.
+	db, release, err := s.snapshot()
+	if err == nil {
+		defer release()
+	} else {
+		dvid.Log(dvid.Normal, "Verification will read the dataset while it may change: %s\n", err.Error())
+		db = s.kvGetter
+	}
+
+	// Find the selected data and all known data and versions.
+	current, known, versions, err := keyOwners(dataset)
+	if err != nil {
+		return nil, err
+	}
+	var selected []DataService
+	for _, name := range datanames {
+		dataservice, err := dataset.DataService(name)
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, dataservice)
+	}
+
+	// Verify the key range of each selected data, or the whole dataset.
+	type keyRange struct {
+		minKey, maxKey *DataKey
+	}
+	var ranges []keyRange
+	if selected == nil {
+		ranges = []keyRange{{
+			&DataKey{dataset.DatasetID, 0, 0, dvid.IndexBytes{}},
+			&DataKey{dataset.DatasetID + 1, 0, 0, nil},
+		}}
+	} else {
+		for _, dataservice := range selected {
+			data, ok := dataservice.(profiledData)
+			if !ok {
+				return nil, fmt.Errorf("Data '%s' cannot be verified", dataservice.DataName())
+			}
+			minKey, maxKey := data.dataKeyRange()
+			ranges = append(ranges, keyRange{minKey, maxKey})
+		}
+	}
+	job.SetTotal(int64(len(ranges)))
+
+	report := &DatasetVerifyReport{Root: dataset.Root}
+	reports := make(map[dvid.DataLocalID]*VerifyReport)
+	if selected == nil {
+		selected = current
+	}
+	for _, dataservice := range selected {
+		dataReport := &VerifyReport{Name: dataservice.DataName()}
+		reports[dataservice.(versionedData).LocalID()] = dataReport
+		report.Data = append(report.Data, dataReport)
+	}
+	var bad []badKey
+	for _, r := range ranges {
+		err = db.ProcessRange(job.Context(), r.minKey, r.maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+			job.Throttle(len(chunk.V))
+			dataKey, ok := chunk.K.(*DataKey)
+			if !ok || dataKey.Dataset != dataset.DatasetID {
+				return
+			}
+			dataservice, found := known[dataKey.Data]
+			if !found {
+				report.OrphanedKeys = append(report.OrphanedKeys, chunk.K.String())
+				bad = append(bad, badKey{dataKey, true, false})
+				return
+			}
+			dataReport, found := reports[dataKey.Data]
+			if !found {
+				dataReport = &VerifyReport{Name: dataservice.DataName()}
+				reports[dataKey.Data] = dataReport
+				report.Data = append(report.Data, dataReport)
+			}
+			dataReport.KeysChecked++
+			var index []byte
+			if dataKey.Index != nil {
+				index = dataKey.Index.Bytes()
+			}
+			switch {
+			case !versions[dataKey.Version]:
+				dataReport.OrphanedKeys = append(dataReport.OrphanedKeys, chunk.K.String())
+				bad = append(bad, badKey{dataKey, true, false})
+			case !wellFormedIndex(dataservice, index):
+				dataReport.MalformedKeys = append(dataReport.MalformedKeys, chunk.K.String())
+				bad = append(bad, badKey{dataKey, false, false})
+			case !verifyValue(dataReport, chunk.K, chunk.V):
+				dataReport.CorruptKeys = append(dataReport.CorruptKeys, chunk.K.String())
+				bad = append(bad, badKey{dataKey, false, true})
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		job.Advance(1)
+	}
+	sort.Sort(verifyReportsByName(report.Data))
+	for _, dataReport := range report.Data {
+		job.Logf("Verified %d keys of data '%s': %d corrupt, %d malformed, %d orphaned", dataReport.KeysChecked,
+			dataReport.Name, len(dataReport.CorruptKeys), len(dataReport.MalformedKeys), len(dataReport.OrphanedKeys))
+	}
+
+	if opts.Quarantine && len(bad) != 0 {
+		report.Quarantined, err = s.quarantine(dataset, bad)
+		if err != nil {
+			return report, err
+		}
+		job.Logf("Moved %d key/value pairs into quarantine", report.Quarantined)
+	}
+	return report, nil
+}
+
+// keyOwners returns the current data of a dataset, all data that may have stored keys,
+// i.e., current, deleted, and scratch data, by local ID, and the dataset's versions.
+func keyOwners(dataset *Dataset) ([]DataService, map[dvid.DataLocalID]DataService,
+	map[dvid.VersionLocalID]bool, error) {
+
+	dataset.mapLock.Lock()
+	var current, others []DataService
+	for _, dataservice := range dataset.DataMap {
+		current = append(current, dataservice)
+	}
+	for _, trashed := range dataset.Trash {
+		others = append(others, trashed.Data)
+	}
+	for _, scratch := range dataset.Scratch {
+		others = append(others, scratch.Data)
+	}
+	versions := make(map[dvid.VersionLocalID]bool, len(dataset.VersionMap))
+	for _, versionID := range dataset.VersionMap {
+		versions[versionID] = true
+	}
+	dataset.mapLock.Unlock()
+	known := make(map[dvid.DataLocalID]DataService)
+	for _, dataservice := range append(current, others...) {
+		data, ok := dataservice.(versionedData)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("Data '%s' cannot be verified", dataservice.DataName())
+		}
+		known[data.LocalID()] = dataservice
+	}
+	return current, known, versions, nil
+}
+
+// verifyReportsByName sorts verify reports by data name.
+type verifyReportsByName []*VerifyReport
+
+func (r verifyReportsByName) Len() int           { return len(r) }
+func (r verifyReportsByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r verifyReportsByName) Less(i, j int) bool { return r[i].Name < r[j].Name }
+
+// badKey is a key found by verification.  Only keys are kept so verification of large
+// datasets does not hold their values.
+type badKey struct {
+	key      *DataKey
+	orphaned bool
+	corrupt  bool
+}
+
+// quarantine moves the key/value pairs of bad keys of a dataset under QuarantineKeys in
+// batches, returning the number moved.  Values are read again from the store, and keys
+// that were rewritten or whose data and version became known after verification read
+// them are left in place.
+func (s *Service) quarantine(dataset *Dataset, bad []badKey) (int, error) {
+	batcher, err := s.Batcher()
+	if err != nil {
+		return 0, err
+	}
+	_, known, versions, err := keyOwners(dataset)
+	if err != nil {
+		return 0, err
+	}
+	var moved int
+	batch := batcher.NewBatch()
+	var batched int
+	for _, b := range bad {
+		if b.orphaned && known[b.key.Data] != nil && versions[b.key.Version] {
+			continue
+		}
+		value, err := s.kvGetter.Get(b.key)
+		if err != nil {
+			return moved, err
+		}
+		if b.corrupt && verifyValue(&VerifyReport{}, b.key, value) {
+			continue
+		}
+		batch.Put(&QuarantineKey{b.key.Bytes()}, value)
+		batch.Delete(b.key)
+		batched++
+		if batched == verifyQuarantineBatchSize {
+			if err = batch.Commit(); err != nil {
+				return moved, err
+			}
+			moved += batched
+			batched = 0
+			batch = batcher.NewBatch()
+		}
+	}
+	if err = batch.Commit(); err != nil {
+		return moved, err
+	}
+	return moved + batched, nil
+}
@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"context"
+	"net/http"
+
+	. "github.com/janelia-flyem/go/gocheck"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// decodingData stores values at block indices.
+type decodingData struct {
+	*Data
+}
+
+func (d *decodingData) DoRPC(ctx context.Context, request Request, reply *Response) error {
+	return nil
+}
+
+func (d *decodingData) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (d *decodingData) DecodeIndex(index []byte) (dvid.Index, error) {
+	return dvid.IndexZYX{}.IndexFromBytes(index)
+}
+
+func (s *DataSuite) TestVerifyDataset(c *C) {
+	service, _, done := openTestService(c)
+	defer done()
+
+	root, _, err := service.NewDataset()
+	c.Assert(err, IsNil)
+	versioned := dvid.NewConfig()
+	versioned.SetVersioned(true)
+	c.Assert(service.NewData(root, "testtype", "mydata", versioned), IsNil)
+	c.Assert(service.NewData(root, "testtype", "other", versioned), IsNil)
+	dset, err := service.DatasetFromUUID(root)
+	c.Assert(err, IsNil)
+	data := dset.DataMap["mydata"].(*testData)
+	dset.DataMap["mydata"] = &decodingData{data.Data}
+
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	value, err := dvid.SerializeData([]byte("block"), compression, dvid.CRC32)
+	c.Assert(err, IsNil)
+	corruptValue := append([]byte{}, value...)
+	corruptValue[len(corruptValue)-1] ^= 0xff
+	block := dvid.IndexZYX{1, 2, 3}
+	good := data.DataKey(0, block)
+	corrupt := data.DataKey(0, dvid.IndexZYX{4, 5, 6})
+	malformed := data.DataKey(0, dvid.IndexBytes("x"))
+	orphanedVersion := data.DataKey(99, block)
+	orphanedData := &DataKey{dset.DatasetID, 200, 0, block}
+	for key, v := range map[*DataKey][]byte{good: value, corrupt: corruptValue, malformed: value,
+		orphanedVersion: value, orphanedData: value} {
+		c.Assert(service.kvSetter.Put(key, v), IsNil)
+	}
+
+	report, err := service.VerifyDataset(root, []dvid.DataString{"other"}, VerifyOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(report.Data, HasLen, 1)
+	c.Assert(report.Data[0].KeysChecked, Equals, 0)
+	c.Assert(report.OrphanedKeys, HasLen, 0)
+
+	report, err = service.VerifyDataset(root, nil, VerifyOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(report.Data, HasLen, 2)
+	mine := report.Data[0]
+	c.Assert(mine.Name, Equals, dvid.DataString("mydata"))
+	c.Assert(mine.KeysChecked, Equals, 4)
+	c.Assert(mine.CorruptKeys, DeepEquals, []string{corrupt.String()})
+	c.Assert(mine.MalformedKeys, DeepEquals, []string{malformed.String()})
+	c.Assert(mine.OrphanedKeys, DeepEquals, []string{orphanedVersion.String()})
+	c.Assert(report.OrphanedKeys, DeepEquals, []string{orphanedData.String()})
+	c.Assert(report.Quarantined, Equals, 0)
+
+	// Quarantined pairs are kept under their original keys but no longer read as data.
+	report, err = service.VerifyDataset(root, nil, VerifyOptions{Quarantine: true}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(report.Quarantined, Equals, 4)
+	kept, err := service.kvGetter.Get(&QuarantineKey{corrupt.Bytes()})
+	c.Assert(err, IsNil)
+	c.Assert(kept, DeepEquals, corruptValue)
+	stored, err := service.kvGetter.Get(corrupt)
+	c.Assert(err, IsNil)
+	c.Assert(stored, IsNil)
+	report, err = service.VerifyDataset(root, nil, VerifyOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(report.Data[0].KeysChecked, Equals, 1)
+	c.Assert(report.Data[0].CorruptKeys, HasLen, 0)
+	c.Assert(report.OrphanedKeys, HasLen, 0)
+}
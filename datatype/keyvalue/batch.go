@@ -0,0 +1,72 @@
+/*
+	This file supports batches of keyvalue puts and deletes that are applied atomically
+	within a version, so clients can keep related keys, e.g., an index and its payload,
+	consistent with each other.
+*/
+
+package keyvalue
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// BatchOp is a put or delete of a key within a batch.  In JSON, values are base64
+// encoded strings.
+type BatchOp struct {
+	// Op is "put" or "delete".
+	Op    string
+	Key   string
+	Value []byte `json:",omitempty"`
+}
+
+// ApplyBatch applies the puts and deletes of a batch in order to a version.  All
+// operations are checked and serialized before any are written, and the writes are
+// committed with their changelog events as a single storage batch so either all or
+// none are applied.
+func (d *Data) ApplyBatch(uuid dvid.UUID, ops []BatchOp) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("Batch for keyvalue '%s' has no operations", d.DataName())
+	}
+	versions, err := server.DatastoreService().DataVersions(uuid, d.DataName())
+	if err != nil {
+		return err
+	}
+	batcher, err := server.Batcher()
+	if err != nil {
+		return err
+	}
+	batch := batcher.NewBatch()
+	indices := make([]dvid.Index, len(ops))
+	events := make([]datastore.MutationEvent, len(ops))
+	for n, op := range ops {
+		if op.Key == "" {
+			return fmt.Errorf("Batch operation %d has no key", n)
+		}
+		indices[n] = dvid.IndexString(op.Key)
+		events[n] = datastore.MutationEvent{Type: strings.ToLower(op.Op), Payload: KeyEvent{op.Key}}
+		key := d.DataKey(versions[0], indices[n])
+		switch strings.ToLower(op.Op) {
+		case "put":
+			serialization, err := d.serializeValue(op.Value)
+			if err != nil {
+				return fmt.Errorf("Unable to serialize data for key '%s': %s", op.Key, err.Error())
+			}
+			batch.Put(key, serialization)
+		case "delete":
+			datastore.DeleteVersioned(batch, key, versions)
+		default:
+			return fmt.Errorf("Batch operation %d on key '%s' must be 'put' or 'delete', not '%s'",
+				n, op.Key, op.Op)
+		}
+	}
+	if err := server.DatastoreService().CommitEvents(batch, d, uuid, events...); err != nil {
+		return fmt.Errorf("Unable to commit batch of %d operations: %s", len(ops), err.Error())
+	}
+	server.DatastoreService().Invalidate(d, uuid, indices)
+	return nil
+}
@@ -5,6 +5,7 @@
 package keyvalue
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -75,7 +76,7 @@ func (d Dir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 	if err != nil {
 		return nil, fuse.EIO
 	}
-	keys, err := db.KeysInRange(minDataKey, maxDataKey)
+	keys, err := db.KeysInRange(context.Background(), minDataKey, maxDataKey)
 	if err != nil {
 		return nil, fuse.EIO
 	}
@@ -4,6 +4,7 @@
 package keyvalue
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
@@ -47,6 +48,12 @@ $ dvid dataset <UUID> new keyvalue <data name> <settings...>
     Configuration Settings (case-insensitive keys)
 
     Versioned      "true" or "false" (default)
+    Changelog      "true" or "false" (default).  If true, each put and delete is logged as
+                     a "put" or "delete" event with a {"Key": <key>} payload that can be
+                     read from the changelog endpoint of the node API.
+    MergePolicy    "error" (default) or "last-writer-wins".  Sets how a key changed
+                     differently in merged nodes is resolved: either the merge fails or
+                     the most recently written value is kept.
 
 $ dvid node <UUID> <data name> get <key>
 
@@ -118,6 +125,28 @@ POST <api URL>/node/<UUID>/<data name>/info
     data name     Name of voxels data.
 
 
+POST <api URL>/node/<UUID>/<data name>/batch
+
+    Applies a batch of puts and deletes to the version node atomically: either all
+    operations are applied or none are.  Operations are applied in order, so a later
+    operation on a key overrides an earlier one.  The request body is a JSON list of
+    operations where values are base64 encoded:
+
+    [
+        { "Op": "put", "Key": "index", "Value": "aW5kZXggZGF0YQ==" },
+        { "Op": "put", "Key": "payload", "Value": "cGF5bG9hZA==" },
+        { "Op": "delete", "Key": "stale" }
+    ]
+
+    Since "batch" is a reserved endpoint, a key named "batch" cannot be posted directly
+    but can be written within a batch.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of keyvalue data.
+
+
 GET  <api URL>/node/<UUID>/<data name>/<key>[/<format>]
 POST <api URL>/node/<UUID>/<data name>/<key>
 DEL  <api URL>/node/<UUID>/<data name>/<key>  (TO DO)
@@ -181,27 +210,128 @@ func (dtype *Datatype) NewDataService(id *datastore.DataID, c dvid.Config) (data
 	if err != nil {
 		return nil, err
 	}
-	return &Data{Data: basedata}, nil
+	data := &Data{Data: basedata, WriteTimes: true}
+	if err = data.ModifyConfig(c); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 func (dtype *Datatype) Help() string {
 	return fmt.Sprintf(HelpMessage)
 }
 
-// Data embeds the datastore's Data and extends it with keyvalue properties (none for now).
+// KeyEvent is the changelog payload of a put or delete of a key.
+type KeyEvent struct {
+	Key string
+}
+
+// Merge policies for keys changed differently in merged version nodes.
+const (
+	MergeError          = "error"
+	MergeLastWriterWins = "last-writer-wins"
+)
+
+// Data embeds the datastore's Data and extends it with keyvalue properties.
 type Data struct {
 	*datastore.Data
+
+	// MergePolicy is how conflicting changes of a key are resolved when merging
+	// version nodes.  An empty policy is the same as MergeError.
+	MergePolicy string
+
+	// WriteTimes is true if each stored value begins with the time it was written.
+	// Data created before write times were stored resolves merges by node update time.
+	WriteTimes bool
+}
+
+// ModifyConfig modifies the configuration of this keyvalue data.
+func (d *Data) ModifyConfig(config dvid.Config) error {
+	if err := d.Data.ModifyConfig(config); err != nil {
+		return err
+	}
+	policy, found, err := config.GetString("MergePolicy")
+	if err != nil {
+		return err
+	}
+	if found {
+		policy = strings.ToLower(policy)
+		if policy != MergeError && policy != MergeLastWriterWins {
+			return fmt.Errorf("Illegal merge policy for keyvalue data: %s", policy)
+		}
+		d.MergePolicy = policy
+	}
+	return nil
 }
 
-// GetData gets a value using a key at a given uuid
+// ResolveConflict resolves a key changed differently in merged version nodes according
+// to the merge policy.  The last writer is given by the write time of each value, or by
+// the update time of a node that deleted the key or stored no write time.
+func (d *Data) ResolveConflict(conflict *datastore.MergeConflict) ([]byte, error) {
+	if d.MergePolicy != MergeLastWriterWins {
+		return nil, fmt.Errorf("Key '%s' was changed in merged nodes %v", conflict.Index, conflict.Parents)
+	}
+	last := 0
+	var lastWritten time.Time
+	for i, value := range conflict.Values {
+		written := conflict.Updated[i]
+		if d.WriteTimes && value != nil {
+			_, t, err := d.deserializeValue(value)
+			if err != nil {
+				return nil, err
+			}
+			written = t
+		}
+		if i == 0 || written.After(lastWritten) {
+			last, lastWritten = i, written
+		}
+	}
+	return conflict.Values[last], nil
+}
+
+// SerializedIndex returns true since every stored value of keyvalue data is serialized,
+// so migrations can upgrade the envelopes of all values.
+func (d *Data) SerializedIndex(index []byte) bool {
+	return true
+}
+
+// serializeValue returns the stored form of a value, which begins with the write time if
+// the data stores write times.
+func (d *Data) serializeValue(value []byte) ([]byte, error) {
+	if d.WriteTimes {
+		timed := make([]byte, 8+len(value))
+		binary.BigEndian.PutUint64(timed, uint64(time.Now().UnixNano()))
+		copy(timed[8:], value)
+		value = timed
+	}
+	return dvid.SerializeData(value, d.UseCompression(), d.Checksum)
+}
+
+// deserializeValue returns a value and its write time from its stored form.  The write
+// time is zero if the data does not store write times.
+func (d *Data) deserializeValue(data []byte) (value []byte, written time.Time, err error) {
+	uncompress := true
+	value, _, err = dvid.DeserializeData(data, uncompress)
+	if err != nil || !d.WriteTimes {
+		return
+	}
+	if len(value) < 8 {
+		err = fmt.Errorf("Stored value of %d bytes has no write time", len(value))
+		return
+	}
+	written = time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+	value = value[8:]
+	return
+}
+
+// GetData gets a value using a key at a given uuid, including values inherited from
+// ancestor versions.
 func (d *Data) GetData(uuid dvid.UUID, keyStr string) (value []byte, found bool, err error) {
-	// Compute the key
-	versionID, e := server.VersionLocalID(uuid)
+	versions, e := server.DatastoreService().DataVersions(uuid, d.DataName())
 	if e != nil {
 		err = e
 		return
 	}
-	key := d.DataKey(versionID, dvid.IndexString(keyStr))
 
 	// Get the data
 	db, e := server.KeyValueGetter()
@@ -209,7 +339,7 @@ func (d *Data) GetData(uuid dvid.UUID, keyStr string) (value []byte, found bool,
 		err = e
 		return
 	}
-	data, e := db.Get(key)
+	data, e := datastore.GetVersionedValue(db, *d.DataID, versions, dvid.IndexString(keyStr))
 	if e != nil {
 		err = fmt.Errorf("Error in retrieving key '%s': %s", keyStr, e.Error())
 		return
@@ -218,8 +348,7 @@ func (d *Data) GetData(uuid dvid.UUID, keyStr string) (value []byte, found bool,
 		return
 	}
 	found = true
-	uncompress := true
-	value, _, e = dvid.DeserializeData(data, uncompress)
+	value, _, e = d.deserializeValue(data)
 	if e != nil {
 		err = fmt.Errorf("Unable to deserialize data for key '%s': %s\n", keyStr, e.Error())
 		return
@@ -236,16 +365,23 @@ func (d *Data) PutData(uuid dvid.UUID, keyStr string, value []byte) error {
 	}
 	key := d.DataKey(versionID, dvid.IndexString(keyStr))
 
-	// PUT the file
-	db, err := server.KeyValueSetter()
+	// PUT the file with its changelog event.
+	batcher, err := server.Batcher()
 	if err != nil {
 		return err
 	}
-	serialization, err := dvid.SerializeData(value, d.Compression, d.Checksum)
+	serialization, err := d.serializeValue(value)
 	if err != nil {
 		return fmt.Errorf("Unable to serialize data: %s\n", err.Error())
 	}
-	return db.Put(key, serialization)
+	batch := batcher.NewBatch()
+	batch.Put(key, serialization)
+	event := datastore.MutationEvent{Type: "put", Payload: KeyEvent{keyStr}}
+	if err = server.DatastoreService().CommitEvents(batch, d, uuid, event); err != nil {
+		return err
+	}
+	server.DatastoreService().Invalidate(d, uuid, []dvid.Index{dvid.IndexString(keyStr)})
+	return nil
 }
 
 // JSONString returns the JSON for this Data's configuration
@@ -260,7 +396,7 @@ func (d *Data) JSONString() (jsonStr string, err error) {
 // --- DataService interface ---
 
 // DoRPC acts as a switchboard for RPC commands.
-func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error {
+func (d *Data) DoRPC(ctx context.Context, request datastore.Request, reply *datastore.Response) error {
 	switch request.TypeCommand() {
 	case "get":
 		return d.Get(request, reply)
@@ -275,7 +411,7 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 }
 
 // DoHTTP handles all incoming HTTP requests for this data.
-func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+func (d *Data) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
 
 	// Allow cross-origin resource sharing.
@@ -300,6 +436,25 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, jsonStr)
 		return nil
+	case "batch":
+		if strings.ToLower(r.Method) != "post" {
+			err := fmt.Errorf("Batch operations require HTTP POST")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		var ops []BatchOp
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			err = fmt.Errorf("Unable to decode batch operations: %s", err.Error())
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if err := d.ApplyBatch(uuid, ops); err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP POST keyvalue '%s' batch of %d operations (%s)",
+			d.DataName(), len(ops), url)
+		return nil
 	default:
 	}
 
@@ -101,3 +101,186 @@ func (suite *DataSuite) TestRoundTrip(c *C) {
 
 	c.Assert(retrieved, DeepEquals, value)
 }
+
+func (suite *DataSuite) TestVerify(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+	config.Set("Checksum", "sha256")
+
+	err = suite.service.NewData(root, "keyvalue", "archived", config)
+	c.Assert(err, IsNil)
+
+	kvservice, err := suite.service.DataServiceByUUID(root, "archived")
+	c.Assert(err, IsNil)
+	kvdata, ok := kvservice.(*Data)
+	c.Assert(ok, Equals, true)
+	c.Assert(kvdata.Checksum, Equals, dvid.Checksum(dvid.SHA256))
+
+	for _, key := range []string{"a", "b", "c"} {
+		err = kvdata.PutData(root, key, []byte("some archival data for "+key))
+		c.Assert(err, IsNil)
+	}
+
+	db, err := server.KeyValueDB()
+	c.Assert(err, IsNil)
+	report, err := kvdata.Verify(db)
+	c.Assert(err, IsNil)
+	c.Assert(report.KeysChecked, Equals, 3)
+	c.Assert(report.CorruptKeys, HasLen, 0)
+
+	// Corrupt one of the stored values.
+	versionID, err := server.VersionLocalID(root)
+	c.Assert(err, IsNil)
+	key := kvdata.DataKey(versionID, dvid.IndexString("b"))
+	value, err := db.Get(key)
+	c.Assert(err, IsNil)
+	value[len(value)-1] ^= 0x01
+	c.Assert(db.Put(key, value), IsNil)
+
+	report, err = kvdata.Verify(db)
+	c.Assert(err, IsNil)
+	c.Assert(report.KeysChecked, Equals, 3)
+	c.Assert(report.CorruptKeys, DeepEquals, []string{key.String()})
+}
+
+func (suite *DataSuite) TestApplyBatch(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+
+	err = suite.service.NewData(root, "keyvalue", "batched", config)
+	c.Assert(err, IsNil)
+
+	kvservice, err := suite.service.DataServiceByUUID(root, "batched")
+	c.Assert(err, IsNil)
+	kvdata, ok := kvservice.(*Data)
+	c.Assert(ok, Equals, true)
+
+	c.Assert(kvdata.PutData(root, "stale", []byte("old data")), IsNil)
+	err = kvdata.ApplyBatch(root, []BatchOp{
+		{Op: "put", Key: "index", Value: []byte("index data")},
+		{Op: "put", Key: "payload", Value: []byte("payload data")},
+		{Op: "delete", Key: "stale"},
+	})
+	c.Assert(err, IsNil)
+
+	value, found, err := kvdata.GetData(root, "index")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(value, DeepEquals, []byte("index data"))
+
+	value, found, err = kvdata.GetData(root, "payload")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(value, DeepEquals, []byte("payload data"))
+
+	_, found, err = kvdata.GetData(root, "stale")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+
+	// A batch with an illegal operation should not apply any of its operations.
+	err = kvdata.ApplyBatch(root, []BatchOp{
+		{Op: "put", Key: "index", Value: []byte("new index data")},
+		{Op: "rename", Key: "payload"},
+	})
+	c.Assert(err, NotNil)
+
+	value, found, err = kvdata.GetData(root, "index")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(value, DeepEquals, []byte("index data"))
+
+	err = kvdata.ApplyBatch(root, nil)
+	c.Assert(err, NotNil)
+}
+
+func (suite *DataSuite) TestChangelog(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+	config.Set("Changelog", "true")
+
+	err = suite.service.NewData(root, "keyvalue", "logged", config)
+	c.Assert(err, IsNil)
+
+	kvservice, err := suite.service.DataServiceByUUID(root, "logged")
+	c.Assert(err, IsNil)
+	kvdata, ok := kvservice.(*Data)
+	c.Assert(ok, Equals, true)
+
+	c.Assert(kvdata.PutData(root, "stale", []byte("old data")), IsNil)
+	err = kvdata.ApplyBatch(root, []BatchOp{
+		{Op: "put", Key: "index", Value: []byte("index data")},
+		{Op: "delete", Key: "stale"},
+	})
+	c.Assert(err, IsNil)
+
+	events, next, err := suite.service.ReadEvents(root, "logged", 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(next, Equals, uint64(3))
+	c.Assert(events, HasLen, 3)
+	c.Assert(events[0].Type, Equals, "put")
+	c.Assert(string(events[0].Payload), Equals, `{"Key":"stale"}`)
+	c.Assert(events[1].Type, Equals, "put")
+	c.Assert(string(events[1].Payload), Equals, `{"Key":"index"}`)
+	c.Assert(events[2].Type, Equals, "delete")
+	c.Assert(string(events[2].Payload), Equals, `{"Key":"stale"}`)
+}
+
+func (suite *DataSuite) TestMergePolicy(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+	config.Set("MergePolicy", "first")
+	c.Assert(suite.service.NewData(root, "keyvalue", "bad", config), NotNil)
+
+	config.Set("MergePolicy", "last-writer-wins")
+	c.Assert(suite.service.NewData(root, "keyvalue", "lww", config), IsNil)
+	dataservice, err := suite.service.DataServiceByUUID(root, "lww")
+	c.Assert(err, IsNil)
+	kvdata, ok := dataservice.(*Data)
+	c.Assert(ok, Equals, true)
+	c.Assert(kvdata.MergePolicy, Equals, MergeLastWriterWins)
+
+	c.Assert(kvdata.PutData(root, "mykey", []byte("root value")), IsNil)
+	c.Assert(suite.service.Lock(root), IsNil)
+	child1, err := suite.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	child2, err := suite.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	c.Assert(kvdata.PutData(child1, "mykey", []byte("first value")), IsNil)
+	c.Assert(kvdata.PutData(child2, "mykey", []byte("second value")), IsNil)
+
+	// The last write of a key wins even if its node was updated earlier.
+	c.Assert(kvdata.PutData(child2, "later", []byte("second value")), IsNil)
+	c.Assert(kvdata.PutData(child1, "later", []byte("first value")), IsNil)
+
+	// A deletion is as recent as the update of its node.
+	c.Assert(kvdata.PutData(child2, "gone", []byte("second value")), IsNil)
+	c.Assert(kvdata.ApplyBatch(child1, []BatchOp{{Op: "delete", Key: "gone"}}), IsNil)
+	c.Assert(suite.service.Lock(child1), IsNil)
+	c.Assert(suite.service.Lock(child2), IsNil)
+
+	merged, err := suite.service.MergeVersions([]dvid.UUID{child2, child1})
+	c.Assert(err, IsNil)
+	value, found, err := kvdata.GetData(merged, "mykey")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(string(value), Equals, "second value")
+	value, found, err = kvdata.GetData(merged, "later")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(string(value), Equals, "first value")
+	_, found, err = kvdata.GetData(merged, "gone")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+}
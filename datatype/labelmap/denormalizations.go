@@ -8,6 +8,7 @@ package labelmap
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -658,10 +659,11 @@ func (d *Data) computeAndSaveSurface(vol *sparseVol) error {
 
 // GetSizeRange returns a JSON list of mapped labels that have volumes within the given range.
 func (d *Data) GetSizeRange(uuid dvid.UUID, minSize, maxSize uint64) (string, error) {
-	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+	versions, err := server.DatastoreService().DataVersions(uuid, d.DataName())
 	if err != nil {
 		return "{}", err
 	}
+	versionID := versions[0]
 	db, err := server.KeyValueGetter()
 	if err != nil {
 		return "{}", err
@@ -671,8 +673,9 @@ func (d *Data) GetSizeRange(uuid dvid.UUID, minSize, maxSize uint64) (string, er
 	firstKey := d.NewLabelSizesKey(versionID, minSize, 0)
 	lastKey := d.NewLabelSizesKey(versionID, maxSize, MaxLabel)
 
-	// Grab all keys for this range in one sequential read.
-	keys, err := db.KeysInRange(firstKey, lastKey)
+	// Grab all keys for this range, including those inherited from ancestor versions.
+	keys, err := datastore.KeysInVersionedRange(context.Background(), db, *d.DataID, versions,
+		firstKey.Index, lastKey.Index)
 	if err != nil {
 		return "{}", err
 	}
@@ -691,9 +694,34 @@ func (d *Data) GetSizeRange(uuid dvid.UUID, minSize, maxSize uint64) (string, er
 	return string(m), nil
 }
 
+// GetLabels returns a JSON page of mapped labels, starting at a label, present in the
+// version specified by a UUID.
+func (d *Data) GetLabels(ctx context.Context, uuid dvid.UUID, start uint64, limit int, sizes bool) (string, error) {
+	versions, err := server.DatastoreService().DataVersions(uuid, d.DataName())
+	if err != nil {
+		return "{}", err
+	}
+	db, err := server.KeyValueGetter()
+	if err != nil {
+		return "{}", err
+	}
+	list, err := labels64.ListLabels(ctx, db, *d.DataID, versions, func(label uint64, block dvid.IndexZYX) *datastore.DataKey {
+		return d.NewLabelSpatialMapKey(versions[0], label, block)
+	}, start, limit, sizes)
+	if err != nil {
+		return "{}", err
+	}
+	m, err := json.Marshal(list)
+	if err != nil {
+		return "{}", err
+	}
+	return string(m), nil
+}
+
 // GetLabelAtPoint returns a mapped label for a given point.
-func (d *Data) GetLabelAtPoint(uuid dvid.UUID, pt dvid.Point) (uint64, error) {
-	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+func (d *Data) GetLabelAtPoint(ctx context.Context, uuid dvid.UUID, pt dvid.Point) (uint64, error) {
+	service := server.DatastoreService()
+	versions, err := service.DataVersions(uuid, d.DataName())
 	if err != nil {
 		return 0, err
 	}
@@ -713,10 +741,13 @@ func (d *Data) GetLabelAtPoint(uuid dvid.UUID, pt dvid.Point) (uint64, error) {
 	}
 	blockSize := labels.BlockSize()
 	blockCoord := coord.Chunk(blockSize).(dvid.ChunkPoint3d) // TODO -- Get rid of this cast
-	key := d.DataKey(versionID, dvid.IndexZYX(blockCoord))
+	labelVersions, err := service.DataVersions(uuid, labels.DataName())
+	if err != nil {
+		return 0, err
+	}
 
 	// Retrieve the block of labels
-	serialization, err := db.Get(key)
+	serialization, err := datastore.GetVersionedValue(db, labels.DataID(), labelVersions, dvid.IndexZYX(blockCoord))
 	if err != nil {
 		return 0, fmt.Errorf("Error getting '%s' block for index %s\n",
 			d.DataName(), blockCoord)
@@ -734,7 +765,7 @@ func (d *Data) GetLabelAtPoint(uuid dvid.UUID, pt dvid.Point) (uint64, error) {
 	i := (ptInBlock.Value(0) + ptInBlock.Value(1)*nx + ptInBlock.Value(2)*nxy) * 8
 
 	// Apply mapping.
-	return d.GetLabelMapping(versionID, labelData[i:i+8])
+	return d.GetLabelMapping(ctx, versions, labelData[i:i+8])
 }
 
 // GetSparseVol returns an encoded sparse volume given a label.  The encoding has the
@@ -758,10 +789,11 @@ func (d *Data) GetLabelAtPoint(uuid dvid.UUID, pt dvid.Point) (uint64, error) {
 //        bytes   Optional payload dependent on first byte descriptor
 //
 func (d *Data) GetSparseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
-	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+	versions, err := server.DatastoreService().DataVersions(uuid, d.DataName())
 	if err != nil {
 		return nil, err
 	}
+	versionID := versions[0]
 	db, err := server.KeyValueGetter()
 	if err != nil {
 		return nil, err
@@ -783,7 +815,8 @@ func (d *Data) GetSparseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
 	// Process all the b+s keys and their values, which contain RLE runs for that label.
 	wg := new(sync.WaitGroup)
 	op := &sparseOp{versionID: versionID, encoding: buf.Bytes()}
-	err = db.ProcessRange(firstKey, lastKey, &storage.ChunkOp{op, wg}, d.processLabelRuns)
+	err = datastore.ProcessVersionedRange(context.Background(), db, *d.DataID, versions, firstKey.Index,
+		lastKey.Index, &storage.ChunkOp{op, wg}, d.processLabelRuns)
 	if err != nil {
 		return nil, err
 	}
@@ -796,25 +829,34 @@ func (d *Data) GetSparseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
 	return op.encoding, nil
 }
 
+// GetSparseVolOp returns the encoded result of a set operation on the sparse volumes of
+// mapped labels.  For a difference, voxels of the first label that are in none of the
+// other labels are returned.
+func (d *Data) GetSparseVolOp(uuid dvid.UUID, op labels64.SparseVolOp, labels []uint64) ([]byte, error) {
+	return labels64.CombineLabelSparseVols(op, labels, func(label uint64) ([]byte, error) {
+		return d.GetSparseVol(uuid, label)
+	})
+}
+
 // GetSurface returns a byte array with # voxels and float32 arrays for vertices and
 // normals.
 func (d *Data) GetSurface(uuid dvid.UUID, label uint64) (s []byte, found bool, err error) {
 	service := server.DatastoreService()
-	_, versionID, e := service.LocalIDFromUUID(uuid)
+	versions, e := service.DataVersions(uuid, d.DataName())
 	if e != nil {
-		err = fmt.Errorf("Error in getting version ID from UUID '%s': %s\n", uuid, e.Error())
+		err = fmt.Errorf("Error in getting versions from UUID '%s': %s\n", uuid, e.Error())
 		return
 	}
 
 	// Retrieve the precomputed surface or that it's not available.
-	key := d.NewLabelSurfaceKey(versionID, label)
+	key := d.NewLabelSurfaceKey(versions[0], label)
 
 	db, e := server.KeyValueGetter()
 	if e != nil {
 		err = e
 		return
 	}
-	data, e := db.Get(key)
+	data, e := datastore.GetVersionedValue(db, *d.DataID, versions, key.Index)
 	if e != nil {
 		err = fmt.Errorf("Error in retrieving surface for key '%s': %s", key, e.Error())
 		return
@@ -832,11 +874,16 @@ func (d *Data) GetSurface(uuid dvid.UUID, label uint64) (s []byte, found bool, e
 	return
 }
 
+// denormOp holds the labels read and written when applying a label map at a version.
+// The versions read to resolve the label map and the source labels at that version are
+// given in versions and sourceVersions.
 type denormOp struct {
-	source    *labels64.Data
-	mapped    *labels64.Data
-	versionID dvid.VersionLocalID
-	mapping   map[string]uint64
+	source         *labels64.Data
+	mapped         *labels64.Data
+	versionID      dvid.VersionLocalID
+	versions       []dvid.VersionLocalID
+	sourceVersions []dvid.VersionLocalID
+	mapping        map[string]uint64
 }
 
 // Iterate through all blocks in the associated label volume, computing the spatial indices
@@ -844,11 +891,12 @@ type denormOp struct {
 func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 	dvid.Log(dvid.Normal, "Adding spatial information from label volume %s ...\n", d.DataName())
 
-	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+	versions, err := server.DatastoreService().DataVersions(uuid, d.DataName())
 	if err != nil {
-		dvid.Error("Could not determine versionID in %s.ProcessSpatially(): %s", d.DataID.DataName(), err.Error())
+		dvid.Error("Could not determine versions in %s.ProcessSpatially(): %s", d.DataID.DataName(), err.Error())
 		return
 	}
+	versionID := versions[0]
 	db, err := server.KeyValueDB()
 	if err != nil {
 		dvid.Error("Could not determine key value datastore in %s.ProcessSpatially(): %s\n", d.DataID.DataName(), err.Error())
@@ -858,13 +906,19 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 	labels, err := d.Labels.GetData()
 	if err != nil {
 		dvid.Error("Could not get labels64 data for '%s'", d.Labels)
+		return
+	}
+	sourceVersions, err := server.DatastoreService().DataVersions(uuid, labels.DataName())
+	if err != nil {
+		dvid.Error("Could not determine versions of '%s': %s", labels.DataName(), err.Error())
+		return
 	}
 
 	// Iterate through all labels chunks incrementally in Z, loading and then using the maps
 	// for all blocks in that layer.
 	startTime := time.Now()
 	wg := new(sync.WaitGroup)
-	op := &denormOp{labels, nil, versionID, nil}
+	op := &denormOp{labels, nil, versionID, versions, sourceVersions, nil}
 
 	dataID := labels.DataID()
 	extents := labels.Extents()
@@ -885,10 +939,9 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 		minIndex := dvid.IndexZYX(minChunkPt)
 		maxIndex := dvid.IndexZYX(maxChunkPt)
 		if op.mapping != nil {
-			startKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, minIndex}
-			endKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, maxIndex}
 			chunkOp := &storage.ChunkOp{op, wg}
-			err = db.ProcessRange(startKey, endKey, chunkOp, d.DenormalizeChunk)
+			err = datastore.ProcessVersionedRange(context.Background(), db, dataID, sourceVersions, minIndex, maxIndex,
+				chunkOp, d.DenormalizeChunk)
 			wg.Wait()
 		}
 
@@ -927,10 +980,12 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 		if err := server.DatastoreService().SaveDataset(uuid); err != nil {
 			dvid.Error("Could not save READY state to data '%s', uuid %s: %s", d.DataName(), uuid, err.Error())
 		}
+		// The sizes and surfaces are new values, so cached replies are stale.
+		server.DatastoreService().Invalidate(d, uuid, nil)
 	}()
 
 	// Iterate through all mapped labels and send to size and surface processing goroutines.
-	err = db.ProcessRange(startKey, endKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+	err = db.ProcessRange(context.Background(), startKey, endKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
 		// Get label associated with this sparse volume.
 		dataKey := chunk.K.(*datastore.DataKey)
 		indexBytes := dataKey.Index.Bytes()
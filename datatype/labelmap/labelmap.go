@@ -9,6 +9,7 @@ package labelmap
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
@@ -146,6 +147,21 @@ GET <api URL>/node/<UUID>/<data name>/sparsevol-by-point/<coord>
     coord     	  Coordinate of voxel with underscore as separator, e.g., 10_20_30
 
 
+GET <api URL>/node/<UUID>/<data name>/sparsevol-<op>/<labels>
+
+	Returns the union, intersection, or difference of the sparse volumes of labels as a
+	single sparse volume encoded as described in the "sparsevol" request above.  Runs are
+	ordered by z, y, and then x, and the header gives the number of voxels.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of mapping data.
+    op            "union", "intersection", or "difference".  A difference returns voxels
+                    of the first label that are in none of the other labels.
+    labels        Up to 100 labels with underscore as separator, e.g., 23_51_7
+
+
 GET <api URL>/node/<UUID>/<data name>/surface/<label>
 
 	Returns array of vertices and normals of surface voxels of given label.
@@ -182,6 +198,25 @@ GET <api URL>/node/<UUID>/<data name>/sizerange/<min size>/<max size>
     max size      Maximum # of voxels.
 
 
+GET <api URL>/node/<UUID>/<data name>/labels[?start=<label>&limit=<n>&sizes=true]
+
+    Returns a JSON page of the mapped labels present in the version, in increasing order:
+
+    { "Labels": [23, 51, ...], "Sizes": [1022, 73, ...], "Next": 6120 }
+
+    Sizes holds the # of voxels of each label and is only returned if "sizes=true".
+    Next is the start label of the next page and is omitted from the last page.
+    Labels are read from the label index, so the sparse volumes must be computed.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of mapping data.
+    start         First label of the page.  Default is 0.
+    limit         Maximum # of labels in the page.  Default is 1000, maximum is 100000.
+    sizes         If "true", the # of voxels of each label is returned.
+
+
 GET <api URL>/node/<UUID>/<data name>/mapping/<label>
 
     Returns the label to which the given label has been mapped.
@@ -397,6 +432,13 @@ func (ref LabelsRef) String() string {
 	return string(ref.name)
 }
 
+// Forked fulfills the datastore.Forker interface, referencing the labels of the same
+// name in the new dataset.
+func (d *Data) Forked(dsetID dvid.DatasetLocalID) error {
+	d.Labels = LabelsRef{name: d.Labels.name, dset: dsetID}
+	return nil
+}
+
 // Data embeds the datastore's Data and extends it with keyvalue properties (none for now).
 type Data struct {
 	*datastore.Data
@@ -420,7 +462,7 @@ func (d *Data) JSONString() (jsonStr string, err error) {
 // --- DataService interface ---
 
 // DoRPC acts as a switchboard for RPC commands.
-func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error {
+func (d *Data) DoRPC(ctx context.Context, request datastore.Request, reply *datastore.Response) error {
 	switch request.TypeCommand() {
 	case "load":
 		if len(request.Command) < 7 {
@@ -444,7 +486,7 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 }
 
 // DoHTTP handles all incoming HTTP requests for this data.
-func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+func (d *Data) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
 
 	// Allow cross-origin resource sharing.
@@ -483,14 +525,14 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			server.BadRequest(w, r, err.Error())
 			return err
 		}
-		_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+		versions, err := server.DatastoreService().DataVersions(uuid, d.DataName())
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
 			return err
 		}
 		labelBytes := make([]byte, 8, 8)
 		binary.BigEndian.PutUint64(labelBytes, label)
-		mapping, err := d.GetLabelMapping(versionID, labelBytes)
+		mapping, err := d.GetLabelMapping(ctx, versions, labelBytes)
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
 			return err
@@ -537,7 +579,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			server.BadRequest(w, r, err.Error())
 			return err
 		}
-		label, err := d.GetLabelAtPoint(uuid, coord)
+		label, err := d.GetLabelAtPoint(ctx, uuid, coord)
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
 			return err
@@ -556,6 +598,33 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: sparsevol-by-point at %s (%s)",
 			r.Method, coord, r.URL)
 
+	case "sparsevol-union", "sparsevol-intersection", "sparsevol-difference":
+		// GET <api URL>/node/<UUID>/<data name>/sparsevol-<op>/<labels>
+		if len(parts) < 5 {
+			err := fmt.Errorf("ERROR: DVID requires labels to follow '%s' command", parts[3])
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		labels, err := labels64.ParseLabelList(parts[4], "_")
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		op := labels64.SparseVolOp(strings.TrimPrefix(parts[3], "sparsevol-"))
+		data, err := d.GetSparseVolOp(uuid, op, labels)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-type", "application/octet-stream")
+		_, err = w.Write(data)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: sparsevol %s of labels %v (%s)",
+			r.Method, op, labels, r.URL)
+
 	case "surface":
 		// GET <api URL>/node/<UUID>/<data name>/surface/<label>
 		fmt.Printf("Getting surface: %s\n", url)
@@ -597,7 +666,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			server.BadRequest(w, r, err.Error())
 			return err
 		}
-		label, err := d.GetLabelAtPoint(uuid, coord)
+		label, err := d.GetLabelAtPoint(ctx, uuid, coord)
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
 			return err
@@ -644,6 +713,23 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: get labels with volume > %d and < %d (%s)",
 			r.Method, minSize, maxSize, r.URL)
 
+	case "labels":
+		// GET <api URL>/node/<UUID>/<data name>/labels[?start=<label>&limit=<n>&sizes=true]
+		start, limit, sizes, err := labels64.ParseLabelListQuery(r.URL.Query())
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		jsonStr, err := d.GetLabels(ctx, uuid, start, limit, sizes)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-type", "application/json")
+		fmt.Fprintf(w, jsonStr)
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: get %d labels starting at %d (%s)",
+			r.Method, limit, start, r.URL)
+
 	default:
 		return fmt.Errorf("Unrecognized API call '%s' for labels64 data '%s'.  See API help.", parts[3], d.DataName())
 	}
@@ -837,6 +923,7 @@ func (d *Data) LoadRavelerMaps(request datastore.Request, reply *datastore.Respo
 	}
 	dvid.Log(dvid.Normal, "Added %d forward and inverse mappings\n", linenum)
 	dvid.ElapsedTime(dvid.Normal, startTime, "Processed Raveler superpixel->body files")
+	service.Invalidate(d, uuid, nil)
 
 	// Spawn goroutine to do spatial processing on associated label volume.
 	go d.ProcessSpatially(uuid)
@@ -859,10 +946,11 @@ func (d *Data) ApplyLabelMap(request datastore.Request, reply *datastore.Respons
 		return err
 	}
 	service := server.DatastoreService()
-	_, versionID, err := service.LocalIDFromUUID(uuid)
+	versions, err := service.DataVersions(uuid, d.DataName())
 	if err != nil {
 		return err
 	}
+	versionID := versions[0]
 	db, err := server.KeyValueDB()
 	if err != nil {
 		return err
@@ -889,8 +977,12 @@ func (d *Data) ApplyLabelMap(request datastore.Request, reply *datastore.Respons
 	if err != nil {
 		return err
 	}
+	sourceVersions, err := service.DataVersions(uuid, labels.DataName())
+	if err != nil {
+		return err
+	}
 	wg := new(sync.WaitGroup)
-	op := &denormOp{labels, dest, versionID, nil}
+	op := &denormOp{labels, dest, versionID, versions, sourceVersions, nil}
 
 	dataID := labels.DataID()
 	extents := labels.Extents()
@@ -910,10 +1002,9 @@ func (d *Data) ApplyLabelMap(request datastore.Request, reply *datastore.Respons
 		minIndex := dvid.IndexZYX(minChunkPt)
 		maxIndex := dvid.IndexZYX(maxChunkPt)
 		if op.mapping != nil {
-			startKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, minIndex}
-			endKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, maxIndex}
 			chunkOp := &storage.ChunkOp{op, wg}
-			err = db.ProcessRange(startKey, endKey, chunkOp, d.ChunkApplyMap)
+			err = datastore.ProcessVersionedRange(context.Background(), db, dataID, sourceVersions, minIndex, maxIndex,
+				chunkOp, d.ChunkApplyMap)
 			wg.Wait()
 		}
 
@@ -925,6 +1016,7 @@ func (d *Data) ApplyLabelMap(request datastore.Request, reply *datastore.Respons
 
 	// Set new mapped data to same extents.
 	dest.Properties = labels.Properties
+	server.DatastoreService().Invalidate(dest, uuid, nil)
 	if err := server.DatastoreService().SaveDataset(uuid); err != nil {
 		dvid.Log(dvid.Normal, "Could not save READY state to data '%s', uuid %s: %s",
 			d.DataName(), uuid, err.Error())
@@ -933,16 +1025,16 @@ func (d *Data) ApplyLabelMap(request datastore.Request, reply *datastore.Respons
 	return nil
 }
 
-// GetLabelMapping returns the mapping for a label.
-func (d *Data) GetLabelMapping(versionID dvid.VersionLocalID, label []byte) (uint64, error) {
-	firstKey := d.NewForwardMapKey(versionID, label, 0)
-	lastKey := d.NewForwardMapKey(versionID, label, MaxLabel)
+// GetLabelMapping returns the mapping for a label, resolved through the given versions.
+func (d *Data) GetLabelMapping(ctx context.Context, versions []dvid.VersionLocalID, label []byte) (uint64, error) {
+	firstKey := d.NewForwardMapKey(versions[0], label, 0)
+	lastKey := d.NewForwardMapKey(versions[0], label, MaxLabel)
 
 	db, err := server.KeyValueGetter()
 	if err != nil {
 		return 0, err
 	}
-	keys, err := db.KeysInRange(firstKey, lastKey)
+	keys, err := datastore.KeysInVersionedRange(ctx, db, *d.DataID, versions, firstKey.Index, lastKey.Index)
 	if err != nil {
 		return 0, err
 	}
@@ -958,25 +1050,29 @@ func (d *Data) GetLabelMapping(versionID dvid.VersionLocalID, label []byte) (uin
 		return 0, fmt.Errorf("Label %d is mapped to more than one label: %s", label, mapped)
 	}
 
-	b := keys[0].Bytes()
-	indexBytes := b[datastore.DataKeyIndexOffset:]
+	indexBytes, err := datastore.DataKeyIndexBytes(keys[0])
+	if err != nil {
+		return 0, err
+	}
 	mapping := binary.BigEndian.Uint64(indexBytes[9:17])
 
 	return mapping, nil
 }
 
-// GetBlockMapping returns the label -> mappedLabel map for a given block.
-func (d *Data) GetBlockMapping(vID dvid.VersionLocalID, block dvid.IndexZYX) (map[string]uint64, error) {
+// GetBlockMapping returns the label -> mappedLabel map for a given block, resolved
+// through the given versions.
+func (d *Data) GetBlockMapping(versions []dvid.VersionLocalID, block dvid.IndexZYX) (map[string]uint64, error) {
 	db, err := server.KeyValueGetter()
 	if err != nil {
 		return nil, err
 	}
 
-	firstKey := d.NewSpatialMapKey(vID, block, nil, 0)
+	firstKey := d.NewSpatialMapKey(versions[0], block, nil, 0)
 	maxLabel := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
-	lastKey := d.NewSpatialMapKey(vID, block, maxLabel, MaxLabel)
+	lastKey := d.NewSpatialMapKey(versions[0], block, maxLabel, MaxLabel)
 
-	keys, err := db.KeysInRange(firstKey, lastKey)
+	keys, err := datastore.KeysInVersionedRange(context.Background(), db, *d.DataID, versions,
+		firstKey.Index, lastKey.Index)
 	if err != nil {
 		return nil, err
 	}
@@ -1017,7 +1113,8 @@ func (d *Data) GetBlockLayerMapping(blockZ int32, op *denormOp) (minChunkPt, max
 		return
 	}
 	var keys []storage.Key
-	keys, err = db.KeysInRange(firstKey, lastKey)
+	keys, err = datastore.KeysInVersionedRange(context.Background(), db, *d.DataID, op.versions,
+		firstKey.Index, lastKey.Index)
 	if err != nil {
 		err = fmt.Errorf("Could not find mapping with slice between %d and %d: %s",
 			minZ, maxZ, err.Error())
@@ -1029,8 +1126,11 @@ func (d *Data) GetBlockLayerMapping(blockZ int32, op *denormOp) (minChunkPt, max
 	if numKeys != 0 {
 		op.mapping = make(map[string]uint64, numKeys)
 		for _, key := range keys {
-			keyBytes := key.Bytes()
-			indexBytes := keyBytes[datastore.DataKeyIndexOffset:]
+			var indexBytes []byte
+			indexBytes, err = datastore.DataKeyIndexBytes(key)
+			if err != nil {
+				return
+			}
 			label := string(indexBytes[1:9])
 			mappedLabel := binary.BigEndian.Uint64(indexBytes[9:17])
 			op.mapping[label] = mappedLabel
@@ -1115,7 +1215,7 @@ func (d *Data) chunkApplyMap(chunk *storage.Chunk) {
 		Version: op.versionID,
 		Index:   dataKey.Index,
 	}
-	serialization, err := dvid.SerializeData(mappedData, d.Compression, d.Checksum)
+	serialization, err := dvid.SerializeData(mappedData, d.UseCompression(), d.Checksum)
 	if err != nil {
 		dvid.Log(dvid.Normal, "Unable to serialize block: %s\n", err.Error())
 		return
@@ -5,6 +5,7 @@ import (
 	. "github.com/janelia-flyem/go/gocheck"
 
 	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/labels64"
 	"github.com/janelia-flyem/dvid/dvid"
 	"github.com/janelia-flyem/dvid/server"
 )
@@ -40,6 +41,7 @@ func (suite *DataSuite) SetUpSuite(c *C) {
 	// Create a new dataset
 	root, _, err := suite.service.NewDataset()
 	c.Assert(err, IsNil)
+	suite.head = root
 
 	// Add data
 	config := dvid.NewConfig()
@@ -80,3 +82,37 @@ func (suite *DataSuite) TestSerialization(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(ref.name, Equals, dvid.DataString("mylabels"))
 }
+
+// Label denormalizations, including those with empty values, must verify as well-formed.
+func (suite *DataSuite) TestVerifyLabels(c *C) {
+	labels, ok := suite.mylabels.(*labels64.Data)
+	c.Assert(ok, Equals, true)
+	versions, err := suite.service.DataVersions(suite.head, "mylabels")
+	c.Assert(err, IsNil)
+	db, err := suite.service.KeyValueSetter()
+	c.Assert(err, IsNil)
+
+	compression, _ := dvid.NewCompression(dvid.Uncompressed, dvid.DefaultCompression)
+	value, err := dvid.SerializeData([]byte("labels"), compression, dvid.CRC32)
+	c.Assert(err, IsNil)
+	block := dvid.IndexZYX{1, 2, 3}
+	v := versions[0]
+	for key, stored := range map[*datastore.DataKey][]byte{
+		labels.DataKey(v, block):                   value,
+		labels.NewLabelSpatialMapKey(v, 23, block): value,
+		labels.NewLabelSizesKey(v, 100, 23):        []byte{},
+		labels.NewLabelSurfaceKey(v, 23):           value,
+	} {
+		c.Assert(db.Put(key, stored), IsNil)
+	}
+
+	report, err := suite.service.VerifyDataset(suite.head, []dvid.DataString{"mylabels"},
+		datastore.VerifyOptions{Quarantine: true}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(report.Data, HasLen, 1)
+	c.Assert(report.Data[0].KeysChecked, Equals, 4)
+	c.Assert(report.Data[0].CorruptKeys, HasLen, 0)
+	c.Assert(report.Data[0].MalformedKeys, HasLen, 0)
+	c.Assert(report.Data[0].OrphanedKeys, HasLen, 0)
+	c.Assert(report.Quarantined, Equals, 0)
+}
@@ -0,0 +1,442 @@
+/*
+	This file supports named checkpoints within an unlocked version node so proofreaders
+	can roll label edits back to a "save point" during long sessions.
+
+	While a version node has any checkpoints, each POST of label voxels is given the next
+	mutation sequence number and the previous values of all blocks it touches are stored
+	in a mutation log.  A checkpoint records the sequence number at its creation, and
+	rolling back restores logged blocks in reverse order of sequence.
+*/
+
+package labels64
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Serializes logged label writes, checkpoint creation, and rollbacks so sequence numbers
+// match the order in which blocks are modified.  Label writes to nodes without checkpoints
+// hold a read lock so a checkpoint can't be created while they go unlogged.
+var mutationLock sync.RWMutex
+
+// Checkpoint is a named point in the mutation log of a version node.
+type Checkpoint struct {
+	Name     string
+	Sequence uint64
+	Created  time.Time
+}
+
+// RollbackEvent is the changelog payload of a rollback to a checkpoint.
+type RollbackEvent struct {
+	Checkpoint string
+	Mutations  int
+}
+
+// Checkpoints sorts checkpoints by sequence number.
+type Checkpoints []Checkpoint
+
+func (c Checkpoints) Len() int      { return len(c) }
+func (c Checkpoints) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c Checkpoints) Less(i, j int) bool {
+	if c[i].Sequence == c[j].Sequence {
+		return c[i].Created.Before(c[j].Created)
+	}
+	return c[i].Sequence < c[j].Sequence
+}
+
+// Flags for the previous state of a block in a mutation log record.
+const (
+	blockAbsent  byte = 0
+	blockPresent byte = 1
+)
+
+// newCheckpointKey returns a key for a checkpoint name, or for the start or end
+// of all checkpoints if the name is empty.
+func (d *Data) newCheckpointKey(vID dvid.VersionLocalID, name string) *datastore.DataKey {
+	index := append([]byte{byte(KeyCheckpoint)}, name...)
+	return d.DataKey(vID, dvid.IndexBytes(index))
+}
+
+// newMutationSeqKey returns the key holding the last mutation sequence number.
+func (d *Data) newMutationSeqKey(vID dvid.VersionLocalID) *datastore.DataKey {
+	return d.DataKey(vID, dvid.IndexBytes{byte(KeyMutationLog)})
+}
+
+// newMutationLogKey returns a key for the previous value of a block before the
+// mutation with the given sequence number.
+func (d *Data) newMutationLogKey(vID dvid.VersionLocalID, seq uint64, block []byte) *datastore.DataKey {
+	index := make([]byte, 9+len(block))
+	index[0] = byte(KeyMutationLog)
+	binary.BigEndian.PutUint64(index[1:9], seq)
+	copy(index[9:], block)
+	return d.DataKey(vID, dvid.IndexBytes(index))
+}
+
+// unlockedVersion returns the version ID of a node that must not be locked.
+func unlockedVersion(uuid dvid.UUID) (dvid.VersionLocalID, error) {
+	service := server.DatastoreService()
+	dataset, err := service.DatasetFromUUID(uuid)
+	if err != nil {
+		return 0, err
+	}
+	node, found := dataset.Nodes[uuid]
+	if !found {
+		return 0, fmt.Errorf("No node found with UUID %s", uuid)
+	}
+	if node.Locked {
+		return 0, fmt.Errorf("Checkpoints are only available in unlocked nodes, and %s is locked", uuid)
+	}
+	return node.VersionID, nil
+}
+
+// GetCheckpoints returns the checkpoints of a version sorted by sequence number.
+// Checkpoints and the mutation log are local to the unlocked node holding them and are
+// not resolved through ancestors like label blocks, since a rollback restores only
+// blocks logged in that node and removes the node's own blocks to again read those
+// of its ancestors.
+func (d *Data) GetCheckpoints(versionID dvid.VersionLocalID) (Checkpoints, error) {
+	db, err := server.KeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	begKey := d.newCheckpointKey(versionID, "")
+	endKey := d.DataKey(versionID, dvid.IndexBytes{byte(KeyCheckpoint) + 1})
+	keyvalues, err := db.GetRange(context.Background(), begKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	var checkpoints Checkpoints
+	for _, kv := range keyvalues {
+		dataKey, ok := kv.K.(*datastore.DataKey)
+		if !ok || len(dataKey.Index.Bytes()) == 0 || dataKey.Index.Bytes()[0] != byte(KeyCheckpoint) {
+			continue
+		}
+		var checkpoint Checkpoint
+		if err := json.Unmarshal(kv.V, &checkpoint); err != nil {
+			return nil, fmt.Errorf("Bad checkpoint in '%s': %s", d.DataName(), err.Error())
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	sort.Sort(checkpoints)
+	return checkpoints, nil
+}
+
+// lastSequence returns the sequence number of the last logged mutation.
+func (d *Data) lastSequence(db storage.KeyValueGetter, versionID dvid.VersionLocalID) (uint64, error) {
+	value, err := db.Get(d.newMutationSeqKey(versionID))
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+// CreateCheckpoint adds a named checkpoint at the current state of an unlocked node.
+func (d *Data) CreateCheckpoint(uuid dvid.UUID, name string) (*Checkpoint, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Checkpoints must be named")
+	}
+	versionID, err := unlockedVersion(uuid)
+	if err != nil {
+		return nil, err
+	}
+	db, err := server.KeyValueDB()
+	if err != nil {
+		return nil, err
+	}
+
+	mutationLock.Lock()
+	defer mutationLock.Unlock()
+
+	key := d.newCheckpointKey(versionID, name)
+	if value, err := db.Get(key); err != nil {
+		return nil, err
+	} else if value != nil {
+		return nil, fmt.Errorf("Checkpoint '%s' already exists for '%s' in node %s", name, d.DataName(), uuid)
+	}
+	seq, err := d.lastSequence(db, versionID)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &Checkpoint{name, seq, time.Now()}
+	value, err := json.Marshal(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Put(key, value); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// PutLabels writes label voxels, logging the previous blocks if the node has any
+// checkpoints so the write can be rolled back.
+func (d *Data) PutLabels(ctx context.Context, uuid dvid.UUID, e voxels.ExtHandler) error {
+	service := server.DatastoreService()
+	_, versionID, err := service.LocalIDFromUUID(uuid)
+	if err != nil {
+		return err
+	}
+	mutationLock.RLock()
+	checkpoints, err := d.GetCheckpoints(versionID)
+	if err != nil {
+		mutationLock.RUnlock()
+		return err
+	}
+	if len(checkpoints) == 0 {
+		defer mutationLock.RUnlock()
+		return voxels.PutVoxels(ctx, uuid, d, e)
+	}
+	mutationLock.RUnlock()
+
+	// Checkpoints may be removed by a rollback before the write lock is held.  Logging
+	// the write anyway is harmless since later checkpoints start after it.
+	mutationLock.Lock()
+	defer mutationLock.Unlock()
+
+	if err := d.logMutation(versionID, e); err != nil {
+		return err
+	}
+	return voxels.PutVoxels(ctx, uuid, d, e)
+}
+
+// RollbackVersion discards the labels stored at a version while no label writes,
+// checkpoints, or checkpoint rollbacks are in progress, then shrinks the extents.
+func (d *Data) RollbackVersion(u dvid.UUID, rollback func() (int, error)) (int, error) {
+	mutationLock.Lock()
+	defer mutationLock.Unlock()
+	return d.Data.RollbackVersion(u, rollback)
+}
+
+// FlattenVersion copies the labels inherited by a version into it while no label writes,
+// checkpoints, or checkpoint rollbacks are in progress.
+func (d *Data) FlattenVersion(u dvid.UUID, flatten func() (int, error)) (int, error) {
+	mutationLock.Lock()
+	defer mutationLock.Unlock()
+	return d.Data.FlattenVersion(u, flatten)
+}
+
+// logMutation stores the current values of all blocks intersecting the voxels
+// under the next mutation sequence number.
+func (d *Data) logMutation(versionID dvid.VersionLocalID, e voxels.ExtHandler) error {
+	db, err := server.KeyValueGetter()
+	if err != nil {
+		return err
+	}
+	batcher, err := server.DatastoreService().Batcher()
+	if err != nil {
+		return err
+	}
+	seq, err := d.lastSequence(db, versionID)
+	if err != nil {
+		return err
+	}
+	seq++
+
+	batch := batcher.NewBatch()
+	for it, err := e.IndexIterator(d.BlockSize()); err == nil && it.Valid(); it.NextSpan() {
+		indexBeg, indexEnd, err := it.IndexSpan()
+		if err != nil {
+			return err
+		}
+		keyvalues, err := db.GetRange(context.Background(), d.DataKey(versionID, indexBeg), d.DataKey(versionID, indexEnd))
+		if err != nil {
+			return err
+		}
+		stored := make(map[string][]byte, len(keyvalues))
+		for _, kv := range keyvalues {
+			if dataKey, ok := kv.K.(*datastore.DataKey); ok {
+				stored[string(dataKey.Index.Bytes())] = kv.V
+			}
+		}
+		ptBeg := indexBeg.(dvid.ChunkIndexer)
+		ptEnd := indexEnd.(dvid.ChunkIndexer)
+		c := dvid.ChunkPoint3d{ptBeg.Value(0), ptBeg.Value(1), ptBeg.Value(2)}
+		for x := ptBeg.Value(0); x <= ptEnd.Value(0); x++ {
+			c[0] = x
+			block := e.Index(c).Bytes()
+			value := []byte{blockAbsent}
+			if old, found := stored[string(block)]; found {
+				value = append([]byte{blockPresent}, old...)
+			}
+			batch.Put(d.newMutationLogKey(versionID, seq, block), value)
+		}
+	}
+	seqBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqBytes, seq)
+	batch.Put(d.newMutationSeqKey(versionID), seqBytes)
+	return batch.Commit()
+}
+
+// Rollback restores label blocks of an unlocked node to their state when the named
+// checkpoint was created.  Checkpoints created after it are removed.  Denormalizations
+// are not updated, as with other label POSTs.
+func (d *Data) Rollback(uuid dvid.UUID, name string) (mutations int, err error) {
+	versionID, err := unlockedVersion(uuid)
+	if err != nil {
+		return
+	}
+	db, err := server.KeyValueGetter()
+	if err != nil {
+		return
+	}
+	batcher, err := server.DatastoreService().Batcher()
+	if err != nil {
+		return
+	}
+
+	mutationLock.Lock()
+	defer mutationLock.Unlock()
+
+	checkpoints, err := d.GetCheckpoints(versionID)
+	if err != nil {
+		return
+	}
+	var target *Checkpoint
+	for i := range checkpoints {
+		if checkpoints[i].Name == name {
+			target = &checkpoints[i]
+		}
+	}
+	if target == nil {
+		err = fmt.Errorf("No checkpoint '%s' for '%s' in node %s", name, d.DataName(), uuid)
+		return
+	}
+
+	// Get all log records after the checkpoint.
+	begKey := d.newMutationLogKey(versionID, target.Sequence+1, nil)
+	endKey := d.DataKey(versionID, dvid.IndexBytes{byte(KeyMutationLog) + 1})
+	keyvalues, err := db.GetRange(context.Background(), begKey, endKey)
+	if err != nil {
+		return
+	}
+
+	// Restore blocks from the latest mutation back to the checkpoint.
+	batch := batcher.NewBatch()
+	var restored []dvid.Index
+	lastSeq := target.Sequence
+	for i := len(keyvalues) - 1; i >= 0; i-- {
+		kv := keyvalues[i]
+		dataKey, ok := kv.K.(*datastore.DataKey)
+		if !ok {
+			continue
+		}
+		index := dataKey.Index.Bytes()
+		if len(index) <= 9 || index[0] != byte(KeyMutationLog) || len(kv.V) == 0 {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(index[1:9])
+		if seq != lastSeq {
+			lastSeq = seq
+			mutations++
+		}
+		var block dvid.Index
+		block, err = dvid.IndexZYX{}.IndexFromBytes(index[9:])
+		if err != nil {
+			return
+		}
+		restored = append(restored, block)
+		blockKey := d.DataKey(versionID, block)
+		if kv.V[0] == blockPresent {
+			batch.Put(blockKey, kv.V[1:])
+		} else {
+			batch.Delete(blockKey)
+		}
+		batch.Delete(dataKey)
+	}
+	for _, checkpoint := range checkpoints {
+		if checkpoint.Sequence > target.Sequence ||
+			(checkpoint.Sequence == target.Sequence && checkpoint.Created.After(target.Created)) {
+			batch.Delete(d.newCheckpointKey(versionID, checkpoint.Name))
+		}
+	}
+	seqBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqBytes, target.Sequence)
+	batch.Put(d.newMutationSeqKey(versionID), seqBytes)
+	event := datastore.MutationEvent{Type: "rollback", Payload: RollbackEvent{name, mutations}}
+	if err = server.DatastoreService().CommitEvents(batch, d, uuid, event); err != nil {
+		return
+	}
+	server.DatastoreService().Invalidate(d, uuid, restored)
+	return
+}
+
+// checkpointHTTP handles the "checkpoints", "checkpoint", and "rollback" endpoints:
+// GET  <api URL>/node/<UUID>/<data name>/checkpoints
+// POST <api URL>/node/<UUID>/<data name>/checkpoint/<name>
+// POST <api URL>/node/<UUID>/<data name>/rollback/<name>
+func (d *Data) checkpointHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request, parts []string) error {
+	endpoint := parts[3]
+	if endpoint == "checkpoints" {
+		_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		checkpoints, err := d.GetCheckpoints(versionID)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if checkpoints == nil {
+			checkpoints = Checkpoints{}
+		}
+		m, err := json.Marshal(checkpoints)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+		return nil
+	}
+
+	if r.Method != "POST" {
+		err := fmt.Errorf("'%s' requests must be made with HTTP POST method", endpoint)
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	if len(parts) < 5 || parts[4] == "" {
+		err := fmt.Errorf("'%s' must be followed by a checkpoint name", endpoint)
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	name := parts[4]
+	w.Header().Set("Content-Type", "application/json")
+	if endpoint == "checkpoint" {
+		checkpoint, err := d.CreateCheckpoint(uuid, name)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		m, err := json.Marshal(checkpoint)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Write(m)
+		return nil
+	}
+	mutations, err := d.Rollback(uuid, name)
+	if err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	fmt.Fprintf(w, "{%q: %q, %q: %d}", "Checkpoint", name, "RolledBack", mutations)
+	return nil
+}
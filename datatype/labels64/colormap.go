@@ -0,0 +1,172 @@
+/*
+	This file supports per-instance color maps so overlays rendered by DVID and external
+	viewers color labels consistently.
+*/
+
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// ColorMap holds user-assigned label colors.  Labels without an override are colored
+// by a deterministic hash of the label.
+type ColorMap struct {
+	mu        sync.RWMutex
+	Overrides map[uint64]color.NRGBA
+}
+
+// Get returns the override color for a label, if any.
+func (cm *ColorMap) Get(label uint64) (c color.NRGBA, found bool) {
+	cm.mu.RLock()
+	c, found = cm.Overrides[label]
+	cm.mu.RUnlock()
+	return
+}
+
+// Set assigns override colors to labels.
+func (cm *ColorMap) Set(colors map[uint64]color.NRGBA) {
+	cm.mu.Lock()
+	if cm.Overrides == nil {
+		cm.Overrides = make(map[uint64]color.NRGBA, len(colors))
+	}
+	for label, c := range colors {
+		cm.Overrides[label] = c
+	}
+	cm.mu.Unlock()
+}
+
+// Delete removes any override colors for the labels.
+func (cm *ColorMap) Delete(labels []uint64) {
+	cm.mu.Lock()
+	for _, label := range labels {
+		delete(cm.Overrides, label)
+	}
+	cm.mu.Unlock()
+}
+
+// LabelColor returns the color for a label, using any user override before falling
+// back to the same hash as composite rgba8 data.  Unless overridden, the background
+// label 0 is fully transparent.
+func (d *Data) LabelColor(label uint64) color.NRGBA {
+	if c, found := d.Colors.Get(label); found {
+		return c
+	}
+	if label == 0 {
+		return color.NRGBA{}
+	}
+	labelBytes := make([]byte, 8)
+	d.ByteOrder.PutUint64(labelBytes, label)
+	hashBuf := make([]byte, 4)
+	murmurhash3(labelBytes, hashBuf)
+	return color.NRGBA{hashBuf[0], hashBuf[1], hashBuf[2], 255}
+}
+
+// colorsJSON converts label colors to JSON where each label string maps to [R,G,B,A].
+func colorsJSON(colors map[uint64]color.NRGBA) ([]byte, error) {
+	m := make(map[string][4]uint8, len(colors))
+	for label, c := range colors {
+		m[strconv.FormatUint(label, 10)] = [4]uint8{c.R, c.G, c.B, c.A}
+	}
+	return json.Marshal(m)
+}
+
+// colorsHTTP handles the "colors" endpoint:
+// GET  <api URL>/node/<UUID>/<data name>/colors[/<label1>_<label2>...]
+// POST <api URL>/node/<UUID>/<data name>/colors
+func (d *Data) colorsHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request, parts []string) error {
+	switch strings.ToLower(r.Method) {
+	case "get":
+		var colors map[uint64]color.NRGBA
+		if len(parts) < 5 || parts[4] == "" {
+			d.Colors.mu.RLock()
+			colors = make(map[uint64]color.NRGBA, len(d.Colors.Overrides))
+			for label, c := range d.Colors.Overrides {
+				colors[label] = c
+			}
+			d.Colors.mu.RUnlock()
+		} else {
+			labelStrs := strings.Split(parts[4], "_")
+			colors = make(map[uint64]color.NRGBA, len(labelStrs))
+			for _, labelStr := range labelStrs {
+				label, err := strconv.ParseUint(labelStr, 10, 64)
+				if err != nil {
+					server.BadRequest(w, r, fmt.Sprintf("Illegal label '%s': %s", labelStr, err.Error()))
+					return err
+				}
+				colors[label] = d.LabelColor(label)
+			}
+		}
+		m, err := colorsJSON(colors)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+		return nil
+
+	case "post":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		var posted map[string][]int
+		if err = json.Unmarshal(data, &posted); err != nil {
+			server.BadRequest(w, r, fmt.Sprintf("Bad color map JSON: %s", err.Error()))
+			return err
+		}
+		colors := make(map[uint64]color.NRGBA, len(posted))
+		removed := []uint64{}
+		for labelStr, rgba := range posted {
+			label, err := strconv.ParseUint(labelStr, 10, 64)
+			if err != nil {
+				server.BadRequest(w, r, fmt.Sprintf("Illegal label '%s': %s", labelStr, err.Error()))
+				return err
+			}
+			for _, value := range rgba {
+				if value < 0 || value > 255 {
+					err := fmt.Errorf("Color values for label %d must be between 0 and 255", label)
+					server.BadRequest(w, r, err.Error())
+					return err
+				}
+			}
+			switch len(rgba) {
+			case 0:
+				removed = append(removed, label)
+			case 3:
+				colors[label] = color.NRGBA{uint8(rgba[0]), uint8(rgba[1]), uint8(rgba[2]), 255}
+			case 4:
+				colors[label] = color.NRGBA{uint8(rgba[0]), uint8(rgba[1]), uint8(rgba[2]), uint8(rgba[3])}
+			default:
+				err := fmt.Errorf("Color for label %d must be [R,G,B], [R,G,B,A] or [] to remove", label)
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+		}
+		d.Colors.Set(colors)
+		d.Colors.Delete(removed)
+		if err := server.DatastoreService().SaveDataset(uuid); err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		fmt.Fprintf(w, "Set %d and removed %d label colors for '%s'\n", len(colors), len(removed), d.DataName())
+		return nil
+
+	default:
+		err := fmt.Errorf("Can only GET or POST colors")
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+}
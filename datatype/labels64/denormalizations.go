@@ -8,6 +8,7 @@ package labels64
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -99,6 +100,13 @@ const (
 	// KeyLabelSizes have keys of form 'v+b'.
 	// They allow rapid size range queries.
 	KeyLabelSizes
+
+	// KeyMutationLog have keys of form 'q+s' where q is a mutation sequence number.
+	// They hold the value of a block before a mutation so it can be rolled back.
+	KeyMutationLog
+
+	// KeyCheckpoint have keys of form 'n' where n is a checkpoint name.
+	KeyCheckpoint
 )
 
 var (
@@ -120,6 +128,10 @@ func (t KeyType) String() string {
 		return "Forward Label to Spatial Index Map"
 	case KeyLabelSizes:
 		return "Forward Label sorted by volume"
+	case KeyMutationLog:
+		return "Block values before mutations"
+	case KeyCheckpoint:
+		return "Mutation log checkpoints"
 	default:
 		return "Unknown Key Type"
 	}
@@ -151,6 +163,42 @@ func (d *Data) NewLabelSurfaceKey(vID dvid.VersionLocalID, label uint64) *datast
 	return d.DataKey(vID, dvid.IndexBytes(index))
 }
 
+// PutStoredValue refuses stored blocks, which would bypass the label denormalizations
+// computed from PUTs of labels.
+func (d *Data) PutStoredValue(uuid dvid.UUID, versionID dvid.VersionLocalID, index dvid.Index,
+	value []byte) error {
+
+	return fmt.Errorf("Data '%s' of type labels64 does not accept stored blocks; PUT labels instead",
+		d.DataName())
+}
+
+// ValidIndex returns true if a stored index is a block index or the index of one of the
+// label denormalizations, mutation log entries, or checkpoints, so verification does not
+// take denormalizations for malformed blocks.
+func (d *Data) ValidIndex(index []byte) bool {
+	switch {
+	case len(index) == dvid.IndexZYXSize:
+		decoded, err := d.DecodeIndex(index)
+		return err == nil && decoded != nil && bytes.Equal(decoded.Bytes(), index)
+	case len(index) == 8:
+		return true // label surface
+	case len(index) == 0:
+		return false
+	}
+	switch KeyType(index[0]) {
+	case KeyLabelSpatialMap:
+		return len(index) == 1+8+dvid.IndexZYXSize
+	case KeyLabelSizes:
+		return len(index) == 17
+	case KeyMutationLog:
+		return len(index) == 1 || len(index) > 9
+	case KeyCheckpoint:
+		return true
+	default:
+		return false
+	}
+}
+
 type sparseOp struct {
 	versionID dvid.VersionLocalID
 	encoding  []byte
@@ -619,11 +667,12 @@ func (d *Data) computeSurface(surfaceCh chan *storage.Chunk, db storage.KeyValue
 // GetSizeRange returns a JSON list of mapped labels that have volumes within the given range.
 func (d *Data) GetSizeRange(uuid dvid.UUID, minSize, maxSize uint64) (string, error) {
 	service := server.DatastoreService()
-	_, versionID, err := service.LocalIDFromUUID(uuid)
+	versions, err := service.DataVersions(uuid, d.DataName())
 	if err != nil {
-		err = fmt.Errorf("Error in getting version ID from UUID '%s': %s\n", uuid, err.Error())
+		err = fmt.Errorf("Error in getting versions from UUID '%s': %s\n", uuid, err.Error())
 		return "{}", err
 	}
+	versionID := versions[0]
 
 	db, err := server.KeyValueGetter()
 	if err != nil {
@@ -634,8 +683,9 @@ func (d *Data) GetSizeRange(uuid dvid.UUID, minSize, maxSize uint64) (string, er
 	firstKey := d.NewLabelSizesKey(versionID, minSize, 0)
 	lastKey := d.NewLabelSizesKey(versionID, maxSize, MaxLabel)
 
-	// Grab all keys for this range in one sequential read.
-	keys, err := db.KeysInRange(firstKey, lastKey)
+	// Grab all keys for this range, including those inherited from ancestor versions.
+	keys, err := datastore.KeysInVersionedRange(context.Background(), db, d.DataID(), versions,
+		firstKey.Index, lastKey.Index)
 	if err != nil {
 		return "{}", err
 	}
@@ -657,9 +707,9 @@ func (d *Data) GetSizeRange(uuid dvid.UUID, minSize, maxSize uint64) (string, er
 // GetLabelAtPoint returns a mapped label for a given point.
 func (d *Data) GetLabelAtPoint(uuid dvid.UUID, pt dvid.Point) (uint64, error) {
 	service := server.DatastoreService()
-	_, versionID, err := service.LocalIDFromUUID(uuid)
+	versions, err := service.DataVersions(uuid, d.DataName())
 	if err != nil {
-		err = fmt.Errorf("Error in getting version ID from UUID '%s': %s\n", uuid, err.Error())
+		err = fmt.Errorf("Error in getting versions from UUID '%s': %s\n", uuid, err.Error())
 		return 0, err
 	}
 
@@ -675,10 +725,9 @@ func (d *Data) GetLabelAtPoint(uuid dvid.UUID, pt dvid.Point) (uint64, error) {
 	}
 	blockSize := d.BlockSize()
 	blockCoord := coord.Chunk(blockSize).(dvid.ChunkPoint3d) // TODO -- Get rid of this cast
-	key := d.DataKey(versionID, dvid.IndexZYX(blockCoord))
 
 	// Retrieve the block of labels
-	serialization, err := db.Get(key)
+	serialization, err := datastore.GetVersionedValue(db, d.DataID(), versions, dvid.IndexZYX(blockCoord))
 	if err != nil {
 		return 0, fmt.Errorf("Error getting '%s' block for index %s\n",
 			d.DataName(), blockCoord)
@@ -719,11 +768,12 @@ func (d *Data) GetLabelAtPoint(uuid dvid.UUID, pt dvid.Point) (uint64, error) {
 //
 func (d *Data) GetSparseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
 	service := server.DatastoreService()
-	_, versionID, err := service.LocalIDFromUUID(uuid)
+	versions, err := service.DataVersions(uuid, d.DataName())
 	if err != nil {
-		err = fmt.Errorf("Error in getting version ID from UUID '%s': %s\n", uuid, err.Error())
+		err = fmt.Errorf("Error in getting versions from UUID '%s': %s\n", uuid, err.Error())
 		return nil, err
 	}
+	versionID := versions[0]
 
 	db, err := server.KeyValueGetter()
 	if err != nil {
@@ -746,7 +796,8 @@ func (d *Data) GetSparseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
 	// Process all the b+s keys and their values, which contain RLE runs for that label.
 	wg := new(sync.WaitGroup)
 	op := &sparseOp{versionID: versionID, encoding: buf.Bytes()}
-	err = db.ProcessRange(firstKey, lastKey, &storage.ChunkOp{op, wg}, d.processLabelRuns)
+	err = datastore.ProcessVersionedRange(context.Background(), db, d.DataID(), versions, firstKey.Index,
+		lastKey.Index, &storage.ChunkOp{op, wg}, d.processLabelRuns)
 	if err != nil {
 		return nil, err
 	}
@@ -763,21 +814,21 @@ func (d *Data) GetSparseVol(uuid dvid.UUID, label uint64) ([]byte, error) {
 // normals.
 func (d *Data) GetSurface(uuid dvid.UUID, label uint64) (s []byte, found bool, err error) {
 	service := server.DatastoreService()
-	_, versionID, e := service.LocalIDFromUUID(uuid)
+	versions, e := service.DataVersions(uuid, d.DataName())
 	if e != nil {
-		err = fmt.Errorf("Error in getting version ID from UUID '%s': %s\n", uuid, e.Error())
+		err = fmt.Errorf("Error in getting versions from UUID '%s': %s\n", uuid, e.Error())
 		return
 	}
 
 	// Retrieve the precomputed surface or that it's not available.
-	key := d.NewLabelSurfaceKey(versionID, label)
+	key := d.NewLabelSurfaceKey(versions[0], label)
 
 	db, e := server.KeyValueGetter()
 	if e != nil {
 		err = e
 		return
 	}
-	data, e := db.Get(key)
+	data, e := datastore.GetVersionedValue(db, d.DataID(), versions, key.Index)
 	if e != nil {
 		err = fmt.Errorf("Error in retrieving surface for key '%s': %s", key, e.Error())
 		return
@@ -798,19 +849,22 @@ func (d *Data) GetSurface(uuid dvid.UUID, label uint64) (s []byte, found bool, e
 type denormOp struct {
 	source    *Data
 	versionID dvid.VersionLocalID
+	job       *datastore.Job
 }
 
 // Iterate through all blocks in the associated label volume, computing the spatial indices
-// for bodies and the mappings for each spatial index.
-func (d *Data) ProcessSpatially(uuid dvid.UUID) {
+// for bodies and the mappings for each spatial index.  Processing runs as a job with the
+// given limits.
+func (d *Data) ProcessSpatially(uuid dvid.UUID, limits datastore.JobLimits) {
 	dvid.Log(dvid.Normal, "Adding spatial information from label volume %s ...\n", d.DataName())
 
 	service := server.DatastoreService()
-	_, versionID, err := service.LocalIDFromUUID(uuid)
+	versions, err := service.DataVersions(uuid, d.DataName())
 	if err != nil {
-		dvid.Log(dvid.Normal, "Error in getting version ID from UUID '%s': %s\n", uuid, err.Error())
+		dvid.Log(dvid.Normal, "Error in getting versions from UUID '%s': %s\n", uuid, err.Error())
 		return
 	}
+	versionID := versions[0]
 
 	db, err := server.KeyValueDB()
 	if err != nil {
@@ -823,7 +877,8 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 	// for all blocks in that layer.
 	startTime := time.Now()
 	wg := new(sync.WaitGroup)
-	op := &denormOp{d, versionID}
+	job := datastore.StartJob("surface", fmt.Sprintf("sizes and surfaces of '%s' at %s", d.DataName(), uuid), limits)
+	op := &denormOp{d, versionID, job}
 
 	dataID := d.DataID()
 	extents := d.Extents()
@@ -838,11 +893,15 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 		// Process the labels chunks for this Z
 		minIndex := dvid.IndexZYX(minChunkPt)
 		maxIndex := dvid.IndexZYX(maxChunkPt)
-		startKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, minIndex}
-		endKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, maxIndex}
 		chunkOp := &storage.ChunkOp{op, wg}
-		err = db.ProcessRange(startKey, endKey, chunkOp, d.DenormalizeChunk)
+		err = datastore.ProcessVersionedRange(job.Context(), db, dataID, versions, minIndex, maxIndex, chunkOp, d.DenormalizeChunk)
 		wg.Wait()
+		if job.Cancelled() {
+			dvid.Log(dvid.Normal, "Stopped adding spatial information from %s: %s\n", d.DataName(),
+				job.Context().Err())
+			job.Finish()
+			return
+		}
 
 		dvid.ElapsedTime(dvid.Debug, t, "Processed all '%s' blocks for layer %d/%d",
 			d.DataName(), z-minIndexZ+1, maxIndexZ-minIndexZ+1)
@@ -870,15 +929,20 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 	// Wait for results then set Updating.
 	go func() {
 		wg.Wait()
+		job.Finish()
 		dvid.ElapsedTime(dvid.Debug, startTime, "Finished processing all RLEs for labels '%s'", d.DataName())
 		d.Ready = true
 		if err := server.DatastoreService().SaveDataset(uuid); err != nil {
 			dvid.Log(dvid.Normal, "Could not save READY state to data '%s', uuid %s: %s",
 				d.DataName(), uuid, err.Error())
 		}
+		// The sizes and surfaces are new values, so cached replies are stale.
+		server.DatastoreService().Invalidate(d, uuid, nil)
 	}()
 
-	err = db.ProcessRange(startKey, endKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+	err = db.ProcessRange(job.Context(), startKey, endKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		job.Throttle(len(chunk.V))
+
 		// Get label associated with this sparse volume.
 		dataKey := chunk.K.(*datastore.DataKey)
 		indexBytes := dataKey.Index.Bytes()
@@ -891,6 +955,7 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 	})
 	if err != nil {
 		dvid.Log(dvid.Normal, "Error indexing sizes for %s: %s\n", d.DataName(), err.Error())
+		job.Finish()
 		return
 	}
 	sizeCh <- nil
@@ -904,14 +969,18 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 // Only some multiple of the # of CPU cores can be used for chunk handling before
 // it waits for chunk processing to abate via the buffered server.HandlerToken channel.
 func (d *Data) DenormalizeChunk(chunk *storage.Chunk) {
+	op := chunk.Op.(*denormOp)
+	op.job.Acquire()
+	op.job.Throttle(len(chunk.V))
 	<-server.HandlerToken
 	go d.denormalizeChunk(chunk)
 }
 
 func (d *Data) denormalizeChunk(chunk *storage.Chunk) {
 	defer func() {
-		// After processing a chunk, return the token.
+		// After processing a chunk, return the tokens.
 		server.HandlerToken <- 1
+		chunk.Op.(*denormOp).job.Release()
 
 		// Notify the requestor that this chunk is done.
 		if chunk.Wg != nil {
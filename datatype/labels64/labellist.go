@@ -0,0 +1,181 @@
+/*
+	This file supports paginated listing of the labels present in a version, optionally
+	with their sizes, using the label to spatial index keys instead of a full volume scan.
+*/
+
+package labels64
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// DefaultLabelListLimit is the number of labels returned in a page if no limit is given.
+const DefaultLabelListLimit = 1000
+
+// MaxLabelListLimit is the largest number of labels returned in a page.
+const MaxLabelListLimit = 100000
+
+// LabelList is a page of labels in increasing order.  If sizes were requested, Sizes
+// holds the number of voxels of each label.  Next is the first label of the next page
+// and is omitted for the last page.
+type LabelList struct {
+	Labels []uint64
+	Sizes  []uint64 `json:",omitempty"`
+	Next   *uint64  `json:",omitempty"`
+}
+
+// LabelSpatialKeyFunc returns the key of a label's sparse volume runs within a block.
+type LabelSpatialKeyFunc func(label uint64, block dvid.IndexZYX) *datastore.DataKey
+
+// ParseLabelListQuery returns the start label, page size, and whether sizes are requested
+// from "start", "limit", and "sizes" query strings.
+func ParseLabelListQuery(query url.Values) (start uint64, limit int, sizes bool, err error) {
+	if s := query.Get("start"); s != "" {
+		if start, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return 0, 0, false, fmt.Errorf("Bad start label '%s' for label listing", s)
+		}
+	}
+	limit = DefaultLabelListLimit
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return 0, 0, false, fmt.Errorf("Bad limit '%s' for label listing", s)
+		}
+	}
+	if limit > MaxLabelListLimit {
+		limit = MaxLabelListLimit
+	}
+	sizes = query.Get("sizes") == "true"
+	return start, limit, sizes, nil
+}
+
+// ListLabels returns up to limit labels, starting at a label, that have keys in the
+// label to spatial index of data resolved through the given versions, which include
+// the ancestors of the version.  Labels are read in windows of label IDs that double in
+// size until the page is full, so a page only reads keys of nearby labels.  Values are
+// only read if sizes are requested.  Reading stops if the context is canceled.
+func ListLabels(ctx context.Context, db storage.KeyValueGetter, dataID datastore.DataID,
+	versions []dvid.VersionLocalID, labelKey LabelSpatialKeyFunc, start uint64, limit int,
+	sizes bool) (*LabelList, error) {
+
+	if limit <= 0 {
+		limit = DefaultLabelListLimit
+	}
+	list := &LabelList{Labels: []uint64{}}
+	var numVoxels []uint64
+
+	// addKey adds the label of a key, with the voxels of its runs if sizes are requested,
+	// and returns false once the page is full.
+	addKey := func(key storage.Key, runs []byte) (bool, error) {
+		dataKey, ok := key.(*datastore.DataKey)
+		if !ok {
+			return true, nil
+		}
+		indexBytes := dataKey.Index.Bytes()
+		if len(indexBytes) < 9 {
+			return true, nil
+		}
+		label := binary.BigEndian.Uint64(indexBytes[1:9])
+		last := len(list.Labels) - 1
+		if last < 0 || list.Labels[last] != label {
+			if len(list.Labels) == limit {
+				list.Next = &label
+				return false, nil
+			}
+			list.Labels = append(list.Labels, label)
+			numVoxels = append(numVoxels, 0)
+			last++
+		}
+		if sizes {
+			blockVoxels, _, err := statsRuns(runs)
+			if err != nil {
+				return false, err
+			}
+			numVoxels[last] += uint64(blockVoxels)
+		}
+		return true, nil
+	}
+
+	window := uint64(limit)
+	for lo := start; ; {
+		hi := lo + window - 1
+		if hi < lo {
+			hi = MaxLabel
+		}
+		indexBeg, indexEnd := labelKey(lo, dvid.MinIndexZYX).Index, labelKey(hi, dvid.MaxIndexZYX).Index
+		if sizes {
+			var addErr error
+			more := true
+			err := datastore.ProcessVersionedRange(ctx, db, dataID, versions, indexBeg, indexEnd,
+				&storage.ChunkOp{}, func(chunk *storage.Chunk) {
+					if more && addErr == nil {
+						more, addErr = addKey(chunk.K, chunk.V)
+					}
+				})
+			if err != nil {
+				return nil, err
+			}
+			if addErr != nil {
+				return nil, addErr
+			}
+		} else {
+			keys, err := datastore.KeysInVersionedRange(ctx, db, dataID, versions, indexBeg, indexEnd)
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range keys {
+				if more, _ := addKey(key, nil); !more {
+					break
+				}
+			}
+		}
+		if list.Next != nil || hi == MaxLabel {
+			break
+		}
+		lo = hi + 1
+		if window < MaxLabel/2 {
+			window *= 2
+		}
+	}
+	if sizes {
+		list.Sizes = numVoxels
+	}
+	return list, nil
+}
+
+// GetLabels returns a JSON page of labels, starting at a label, present in the version
+// specified by a UUID.
+func (d *Data) GetLabels(ctx context.Context, uuid dvid.UUID, start uint64, limit int, sizes bool) (string, error) {
+	service := server.DatastoreService()
+	versions, err := service.DataVersions(uuid, d.DataName())
+	if err != nil {
+		err = fmt.Errorf("Error in getting versions from UUID '%s': %s\n", uuid, err.Error())
+		return "{}", err
+	}
+
+	db, err := server.KeyValueGetter()
+	if err != nil {
+		return "{}", err
+	}
+
+	list, err := ListLabels(ctx, db, d.DataID(), versions, func(label uint64, block dvid.IndexZYX) *datastore.DataKey {
+		return d.NewLabelSpatialMapKey(versions[0], label, block)
+	}, start, limit, sizes)
+	if err != nil {
+		return "{}", err
+	}
+	m, err := json.Marshal(list)
+	if err != nil {
+		return "{}", err
+	}
+	return string(m), nil
+}
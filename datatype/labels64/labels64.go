@@ -7,6 +7,7 @@ package labels64
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
@@ -60,7 +61,8 @@ $ dvid dataset <UUID> new labels64 <data name> <settings...>
 
     LabelType      "standard" (default) or "raveler" 
     Versioned      "true" or "false" (default)
-    BlockSize      Size in pixels  (default: %s)
+    BlockSize      Size of blocks in voxels: a single value for cubic blocks, or a size per
+                     axis for anisotropic blocks, e.g., "64,64,8".  (default: 32)
     VoxelSize      Resolution of voxels (default: 10.0, 10.0, 10.0)
     VoxelUnits     Resolution units (default: "nanometers")
 
@@ -91,6 +93,10 @@ $ dvid node <UUID> <data name> load <offset> <image glob> <settings...>
     				 volumes and size query responses using the loaded labels.  This is not necessary 
     				 for data that will evaluated using labelmap data, e.g., Raveler superpixels,
     				 and is automatically set if LabelType is "Raveler".
+    Workers       Maximum number of blocks concurrently denormalized (default: all CPUs).
+    IORate        Maximum MB per second read while denormalizing (default: unlimited).
+    				 Denormalization runs as a job whose limits can be changed while running
+    				 with "dvid job <id> limits workers=<#> iorate=<MB/s>".
 
 $ dvid node <UUID> <data name> composite <grayscale8 data name> <new rgba8 data name>
 
@@ -140,6 +146,31 @@ GET  <api URL>/node/<UUID>/<data name>/schema
 	of bytes returned for n-d images.
 
 
+GET  <api URL>/node/<UUID>/<data name>/estimate/<dims>/<size>/<offset>
+
+    Returns JSON with the predicted cost of a request for the given voxels without
+    retrieving them.  The estimate includes the number of intersecting blocks, the
+    uncompressed bytes to be processed, and the predicted seconds based on block
+    throughput recently observed by this server.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/superpixels/estimate/0_1_2/512_512_256/0_0_100
+
+    Returns {"Blocks":2048,"Bytes":536870912,"Seconds":1.02}.
+
+    GETs and POSTs of voxels by <dims>/<size>/<offset> also accept budget query strings
+    and will be aborted without processing, with HTTP status 503 (Service Unavailable),
+    if their estimate exceeds the budget:
+
+    maxblocks     Maximum number of blocks.
+    maxbytes      Maximum uncompressed bytes.
+    maxseconds    Maximum predicted seconds.
+
+    Budgets only apply to these reads and writes of voxels, not to stats, exports, or
+    other computations derived from the data.
+
+
 GET  <api URL>/node/<UUID>/<data name>/<dims>/<size>/<offset>[/<format>]
 POST <api URL>/node/<UUID>/<data name>/<dims>/<size>/<offset>[/<format>]
 
@@ -164,6 +195,80 @@ POST <api URL>/node/<UUID>/<data name>/<dims>/<size>/<offset>[/<format>]
     size          Size in voxels along each dimension specified in <dims>.
     offset        Gives coordinate of first voxel using dimensionality of data.
 
+    Query-string Options:
+
+    resample      If "isotropic", a 2D slice image covering the requested voxels is resized
+                    without interpolation so pixels have the finer of the slice's two voxel
+                    resolutions, e.g., an XZ slice with 4x coarser Z is 4x taller.
+
+GET  <api URL>/node/<UUID>/<data name>/checkpoints
+POST <api URL>/node/<UUID>/<data name>/checkpoint/<name>
+POST <api URL>/node/<UUID>/<data name>/rollback/<name>
+
+    Manages named checkpoints, i.e., save points, within an unlocked version node.
+    While a node has checkpoints, each POST of label voxels is logged with a mutation
+    sequence number along with the previous contents of the blocks it modifies.
+
+    GET "checkpoints" returns a JSON list of checkpoints with their name, the sequence
+    number of the last mutation before each, and creation time.  POST "checkpoint" creates
+    a checkpoint at the current state.  POST "rollback" restores all label blocks modified
+    since the named checkpoint and removes any later checkpoints.  Denormalizations like
+    sparse volumes are not updated by rollbacks, as with other label POSTs.  POST
+    "rollback" without a checkpoint name discards all changes at the node, including
+    checkpoints and denormalizations.
+
+    Example: 
+
+    POST <api URL>/node/3f8c/superpixels/checkpoint/before-merge
+    POST <api URL>/node/3f8c/superpixels/rollback/before-merge
+
+GET  <api URL>/node/<UUID>/<data name>/colors[/<label1>_<label2>...]
+POST <api URL>/node/<UUID>/<data name>/colors
+
+    Retrieves or sets the colors used for labels by overlays.  Each label has a
+    deterministic color hashed from the label unless overridden by a user-assigned
+    color, which is stored with this data.  Colors are JSON objects mapping label
+    strings to [R,G,B,A] values from 0 to 255.
+
+    GET with labels returns the color used for each label.  GET without labels returns
+    all user-assigned colors.  POST assigns colors given as [R,G,B] or [R,G,B,A] and
+    removes the assignment for any label given an empty array.
+
+    Example: 
+
+    POST <api URL>/node/3f8c/superpixels/colors    {"23": [255,0,0], "17": []}
+    GET  <api URL>/node/3f8c/superpixels/colors/23_17
+
+    Returns {"17":[110,42,201,255],"23":[255,0,0,255]}.
+
+GET  <api URL>/node/<UUID>/<data name>/overlay/<dims>/<size>/<offset>/<grayscale name>[/<format>]
+
+    Renders a slice of grayscale8 data with these labels colorized and blended over it.
+    Each label's color is given by the "colors" endpoint above: a user-assigned color or
+    a deterministic hash of the label, the same used by the "composite" command.  Label 0
+    is left uncolored unless assigned a color.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/superpixels/overlay/xy/512_256/0_0_100/grayscale/jpg:80?alpha=0.3
+
+    Returns a JPEG XY slice of size 512 x 256 at offset (0,0,100) of "grayscale" data
+    with "superpixels" colors at 30% opacity.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels data.
+    dims          The axes of a 2d slice, e.g., "0_1" or "xy".
+    size          Size in voxels along each dimension specified in <dims>.
+    offset        Gives coordinate of first voxel using dimensionality of data.
+    grayscale name  Name of grayscale8 data in the same version node.
+    format        "png" (default) or "jpg" with optional quality, e.g., "jpg:80".
+
+    Query-string Options:
+
+    alpha         Opacity of label colors from 0 to 1 (default 0.5).
+
 (Assumes labels were loaded using without "proc=noindex")
 
 GET <api URL>/node/<UUID>/<data name>/sparsevol/<label>
@@ -203,6 +308,21 @@ GET <api URL>/node/<UUID>/<data name>/sparsevol-by-point/<coord>
     coord     	  Coordinate of voxel with underscore as separator, e.g., 10_20_30
 
 
+GET <api URL>/node/<UUID>/<data name>/sparsevol-<op>/<labels>
+
+	Returns the union, intersection, or difference of the sparse volumes of labels as a
+	single sparse volume encoded as described in the "sparsevol" request above.  Runs are
+	ordered by z, y, and then x, and the header gives the number of voxels.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels data.
+    op            "union", "intersection", or "difference".  A difference returns voxels
+                    of the first label that are in none of the other labels.
+    labels        Up to 100 labels with underscore as separator, e.g., 23_51_7
+
+
 GET <api URL>/node/<UUID>/<data name>/surface/<label>
 
 	Returns array of vertices and normals of surface voxels of given label.
@@ -238,6 +358,25 @@ GET <api URL>/node/<UUID>/<data name>/sizerange/<min size>/<max size>
     min size      Minimum # of voxels.
     max size      Maximum # of voxels.
 
+
+GET <api URL>/node/<UUID>/<data name>/labels[?start=<label>&limit=<n>&sizes=true]
+
+    Returns a JSON page of the labels present in the version, in increasing order:
+
+    { "Labels": [23, 51, ...], "Sizes": [1022, 73, ...], "Next": 6120 }
+
+    Sizes holds the # of voxels of each label and is only returned if "sizes=true".
+    Next is the start label of the next page and is omitted from the last page.
+    Labels are read from the label index, so the sparse volumes must be computed.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels data.
+    start         First label of the page.  Default is 0.
+    limit         Maximum # of labels in the page.  Default is 1000, maximum is 100000.
+    sizes         If "true", the # of voxels of each label is returned.
+
 `
 
 var (
@@ -350,6 +489,9 @@ func NewData(id *datastore.DataID, config dvid.Config) (*Data, error) {
 	if err != nil {
 		return nil, err
 	}
+	if voxelData.IndexScheme != dvid.ZYXScheme {
+		return nil, fmt.Errorf("labels64 only supports zyx indexing, not %s", voxelData.IndexScheme)
+	}
 	var labelType LabelType = Standard64bit
 	s, found, err := config.GetString("LabelType")
 	if found {
@@ -384,6 +526,9 @@ type Data struct {
 	voxels.Data
 	Labeling LabelType
 	Ready    bool
+
+	// Colors holds user overrides of the deterministic label colors.
+	Colors ColorMap
 }
 
 // JSONString returns the JSON for this Data's configuration
@@ -435,6 +580,13 @@ func (d *Data) NewExtHandler(geom dvid.Geometry, img interface{}) (voxels.ExtHan
 					return nil, fmt.Errorf("unexpected label type in labels64: %s", d.Labeling)
 				}
 			}
+		case []byte:
+			data = t
+			expectedLen := int64(bytesPerVoxel) * geom.NumVoxels()
+			if int64(len(data)) != expectedLen {
+				return nil, fmt.Errorf("PUT data was %d bytes, expected %d bytes for %s",
+					len(data), expectedLen, geom)
+			}
 		default:
 			return nil, fmt.Errorf("unexpected image type given to NewExtHandler(): %T", t)
 		}
@@ -558,7 +710,7 @@ func RavelerSuperpixelBytes(slice, superpixel32 uint32) []byte {
 // --- datastore.DataService interface ---------
 
 // DoRPC acts as a switchboard for RPC commands.
-func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error {
+func (d *Data) DoRPC(ctx context.Context, request datastore.Request, reply *datastore.Response) error {
 	switch request.TypeCommand() {
 	case "load":
 		if len(request.Command) < 5 {
@@ -604,8 +756,12 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 		if err != nil {
 			return err
 		}
+		limits, err := datastore.JobLimitsFromConfig(request.Command.Settings())
+		if err != nil {
+			return err
+		}
 		if d.Labeling != RavelerLabel && processing != "noindex" {
-			go d.ProcessSpatially(uuid)
+			go d.ProcessSpatially(uuid, limits)
 		}
 		return nil
 
@@ -622,7 +778,7 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 }
 
 // DoHTTP handles all incoming HTTP requests for this data.
-func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+func (d *Data) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
 
 	// Allow cross-origin resource sharing.
@@ -690,6 +846,25 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, jsonStr)
 		return nil
+	case "estimate":
+		if len(parts) < 7 {
+			err := fmt.Errorf("'estimate' must be followed by shape/size/offset")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		cost, err := voxels.EstimateFromStrings(d, parts[4], parts[5], parts[6])
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		m, err := json.Marshal(cost)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+		return nil
 	case "raw", "isotropic":
 		if len(parts) < 7 {
 			return fmt.Errorf("'%s' must be followed by shape/size/offset", parts[3])
@@ -711,6 +886,10 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 				if isotropic {
 					return fmt.Errorf("can only PUT 'raw' not 'isotropic' images")
 				}
+				if err := voxels.CheckRequestBudget(d, slice, r); err != nil {
+					voxels.BudgetFailed(w, r, err)
+					return nil
+				}
 				// TODO -- Put in format checks for POSTed image.
 				postedImg, _, err := dvid.ImageFromPOST(r)
 				if err != nil {
@@ -720,18 +899,31 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 				if err != nil {
 					return err
 				}
-				err = voxels.PutVoxels(uuid, d, e)
+				err = d.PutLabels(ctx, uuid, e)
 				if err != nil {
 					return err
 				}
 			} else {
 				rawSlice, err := d.HandleIsotropy2D(slice, isotropic)
+				if err != nil {
+					server.BadRequest(w, r, err.Error())
+					return err
+				}
+				if err := voxels.CheckRequestBudget(d, rawSlice, r); err != nil {
+					voxels.BudgetFailed(w, r, err)
+					return nil
+				}
+				release, ok := voxels.ReserveMemory(w, r, voxels.EstimateCost(d, rawSlice))
+				if !ok {
+					return nil
+				}
+				defer release()
 				e, err := d.NewExtHandler(rawSlice, nil)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				img, err := voxels.GetImage(uuid, d, e)
+				img, err := voxels.GetImage(ctx, uuid, d, e)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -744,6 +936,12 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 						server.BadRequest(w, r, err.Error())
 						return err
 					}
+				} else {
+					img, err = d.ResampleFromRequest(img, slice, r)
+					if err != nil {
+						server.BadRequest(w, r, err.Error())
+						return err
+					}
 				}
 				var formatStr string
 				if len(parts) >= 8 {
@@ -763,12 +961,21 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 				return err
 			}
 			if op == voxels.GetOp {
+				if err := voxels.CheckRequestBudget(d, subvol, r); err != nil {
+					voxels.BudgetFailed(w, r, err)
+					return nil
+				}
+				release, ok := voxels.ReserveMemory(w, r, voxels.EstimateCost(d, subvol))
+				if !ok {
+					return nil
+				}
+				defer release()
 				e, err := d.NewExtHandler(subvol, nil)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				data, err := voxels.GetVolume(uuid, d, e)
+				data, err := voxels.GetVolume(ctx, uuid, d, e)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -782,6 +989,15 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 				if isotropic {
 					return fmt.Errorf("can only PUT 'raw' not 'isotropic' images")
 				}
+				if err := voxels.CheckRequestBudget(d, subvol, r); err != nil {
+					voxels.BudgetFailed(w, r, err)
+					return nil
+				}
+				release, ok := voxels.ReserveMemory(w, r, voxels.EstimateCost(d, subvol))
+				if !ok {
+					return nil
+				}
+				defer release()
 				data, err := ioutil.ReadAll(r.Body)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
@@ -792,7 +1008,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				err = voxels.PutVoxels(uuid, d, e)
+				err = d.PutLabels(ctx, uuid, e)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -802,6 +1018,26 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		default:
 			return fmt.Errorf("DVID currently supports shapes of only 2 and 3 dimensions")
 		}
+	case "checkpoints", "checkpoint", "rollback":
+		if err := d.checkpointHTTP(uuid, w, r, parts); err != nil {
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: %s (%s)", r.Method, parts[3], r.URL)
+	case "colors":
+		if err := d.colorsHTTP(uuid, w, r, parts); err != nil {
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: colors (%s)", r.Method, r.URL)
+	case "overlay":
+		if op != voxels.GetOp {
+			err := fmt.Errorf("Can only GET overlays")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if err := d.overlayHTTP(ctx, uuid, w, r, parts); err != nil {
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: overlay (%s)", r.Method, r.URL)
 	case "sparsevol":
 		// GET <api URL>/node/<UUID>/<data name>/sparsevol/<label>
 		if len(parts) < 5 {
@@ -859,6 +1095,33 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: sparsevol-by-point at %s (%s)",
 			r.Method, coord, r.URL)
 
+	case "sparsevol-union", "sparsevol-intersection", "sparsevol-difference":
+		// GET <api URL>/node/<UUID>/<data name>/sparsevol-<op>/<labels>
+		if len(parts) < 5 {
+			err := fmt.Errorf("ERROR: DVID requires labels to follow '%s' command", parts[3])
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		labels, err := ParseLabelList(parts[4], "_")
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		op := SparseVolOp(strings.TrimPrefix(parts[3], "sparsevol-"))
+		data, err := d.GetSparseVolOp(uuid, op, labels)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-type", "application/octet-stream")
+		_, err = w.Write(data)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: sparsevol %s of labels %v (%s)",
+			r.Method, op, labels, r.URL)
+
 	case "surface":
 		// GET <api URL>/node/<UUID>/<data name>/surface/<label>
 		if len(parts) < 5 {
@@ -952,6 +1215,23 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		fmt.Fprintf(w, jsonStr)
 		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: get labels with volume > %d and < %d (%s)",
 			r.Method, minSize, maxSize, r.URL)
+
+	case "labels":
+		// GET <api URL>/node/<UUID>/<data name>/labels[?start=<label>&limit=<n>&sizes=true]
+		start, limit, sizes, err := ParseLabelListQuery(r.URL.Query())
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		jsonStr, err := d.GetLabels(ctx, uuid, start, limit, sizes)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-type", "application/json")
+		fmt.Fprintf(w, jsonStr)
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: get %d labels starting at %d (%s)",
+			r.Method, limit, start, r.URL)
 	default:
 		return fmt.Errorf("Unrecognized API call '%s' for labels64 data '%s'.  See API help.", parts[3], d.DataName())
 	}
@@ -1028,7 +1308,7 @@ func (d *Data) CreateComposite(request datastore.Request, reply *datastore.Respo
 	endKey := d.DataKey(versionID, extents.MaxIndex)
 
 	chunkOp := &storage.ChunkOp{op, wg}
-	err = db.ProcessRange(startKey, endKey, chunkOp, d.CreateCompositeChunk)
+	err = db.ProcessRange(context.Background(), startKey, endKey, chunkOp, d.CreateCompositeChunk)
 	wg.Wait()
 
 	dvid.ElapsedTime(dvid.Debug, startTime, "Created composite of %s and %s",
@@ -1036,6 +1316,7 @@ func (d *Data) CreateComposite(request datastore.Request, reply *datastore.Respo
 
 	// Set new mapped data to same extents.
 	composite.Properties.Extents = grayscale.Properties.Extents
+	server.DatastoreService().Invalidate(composite, uuid, nil)
 	if err := server.DatastoreService().SaveDataset(uuid); err != nil {
 		dvid.Log(dvid.Normal, "Could not save new data '%s': %s\n", destName, err.Error())
 	}
@@ -1129,7 +1410,7 @@ func (d *Data) createCompositeChunk(chunk *storage.Chunk) {
 
 	// Store the composite block into the rgba8 data.
 	compositeKey := op.composite.DataKey(op.versionID, labelKey.Index)
-	serialization, err := dvid.SerializeData(compositeData, d.Compression, d.Checksum)
+	serialization, err := dvid.SerializeData(compositeData, d.UseCompression(), d.Checksum)
 	if err != nil {
 		dvid.Log(dvid.Normal, "Unable to serialize composite block at %s: %s\n",
 			labelKey.Index, err.Error())
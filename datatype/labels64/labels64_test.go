@@ -0,0 +1,378 @@
+package labels64
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	. "github.com/janelia-flyem/go/gocheck"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type DataSuite struct {
+	dir     string
+	service *server.Service
+}
+
+var _ = Suite(&DataSuite{})
+
+// This will setup a new datastore and open it up, keeping the service pointer
+// in the DataSuite.
+func (suite *DataSuite) SetUpSuite(c *C) {
+	// Make a temporary testing directory that will be auto-deleted after testing.
+	suite.dir = c.MkDir()
+
+	// Create a new datastore.
+	err := datastore.Init(suite.dir, true, dvid.Config{})
+	c.Assert(err, IsNil)
+
+	// Open the datastore
+	suite.service, err = server.OpenDatastore(suite.dir)
+	c.Assert(err, IsNil)
+}
+
+func (suite *DataSuite) TearDownSuite(c *C) {
+	suite.service.Shutdown()
+}
+
+// newData adds data of the given type to a dataset and returns its data service.
+func (suite *DataSuite) newData(c *C, root dvid.UUID, typename string, name dvid.DataString) datastore.DataService {
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+	c.Assert(suite.service.NewData(root, dvid.TypeString(typename), name, config), IsNil)
+	dataservice, err := suite.service.DataServiceByUUID(root, name)
+	c.Assert(err, IsNil)
+	return dataservice
+}
+
+// putLabels stores a 4x4 xy slice at the origin whose left half is label 0 and right
+// half is the given label.
+func putLabels(c *C, root dvid.UUID, labels *Data, label uint64) {
+	subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{4, 4, 1})
+	data := make([]byte, 4*4*8)
+	for y := 0; y < 4; y++ {
+		for x := 2; x < 4; x++ {
+			labels.ByteOrder.PutUint64(data[(y*4+x)*8:], label)
+		}
+	}
+	ext, err := labels.NewExtHandler(subvol, data)
+	c.Assert(err, IsNil)
+	c.Assert(labels.PutLabels(context.Background(), root, ext), IsNil)
+}
+
+// getLabel returns the label stored at the right half of the slice written by putLabels.
+func getLabel(c *C, root dvid.UUID, labels *Data) uint64 {
+	subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{4, 4, 1})
+	ext, err := labels.NewExtHandler(subvol, nil)
+	c.Assert(err, IsNil)
+	c.Assert(voxels.GetVoxels(context.Background(), root, labels, ext), IsNil)
+	return labels.ByteOrder.Uint64(ext.Data()[3*8:])
+}
+
+func (suite *DataSuite) TestRenderOverlay(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	labels, ok := suite.newData(c, root, "labels64", "overlaylabels").(*Data)
+	c.Assert(ok, Equals, true)
+	grayscale, ok := suite.newData(c, root, "grayscale8", "overlaygray").(*voxels.Data)
+	c.Assert(ok, Equals, true)
+
+	putLabels(c, root, labels, 7)
+	subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{4, 4, 1})
+	grayExt, err := grayscale.NewExtHandler(subvol, bytes.Repeat([]byte{100}, 16))
+	c.Assert(err, IsNil)
+	c.Assert(voxels.PutVoxels(context.Background(), root, grayscale, grayExt), IsNil)
+
+	slice, err := dvid.NewSliceFromStrings("xy", "0_0_0", "4_4", "_")
+	c.Assert(err, IsNil)
+	img, err := labels.RenderOverlay(context.Background(), root, slice, grayscale, 0.5)
+	c.Assert(err, IsNil)
+	c.Assert(img.Bounds().Dx(), Equals, 4)
+	c.Assert(img.Bounds().Dy(), Equals, 4)
+
+	// The background label is transparent and other labels are blended over grayscale.
+	gray := color.NRGBA{100, 100, 100, 255}
+	c.Assert(img.NRGBAAt(0, 0), Equals, gray)
+	c.Assert(img.NRGBAAt(1, 3), Equals, gray)
+	blended := blendOverlay(100, labels.LabelColor(7), 0.5)
+	c.Assert(img.NRGBAAt(2, 0), Equals, blended)
+	c.Assert(img.NRGBAAt(3, 3), Equals, blended)
+
+	// Label colors are deterministic and opaque.
+	c.Assert(labels.LabelColor(7), Equals, labels.LabelColor(7))
+	c.Assert(labels.LabelColor(7).A, Equals, uint8(255))
+	c.Assert(labels.LabelColor(0), Equals, color.NRGBA{})
+
+	_, err = labels.RenderOverlay(context.Background(), root, slice, grayscale, 1.5)
+	c.Assert(err, ErrorMatches, "Overlay alpha must be between 0 and 1.*")
+	_, err = labels.RenderOverlay(context.Background(), root, subvol, grayscale, 0.5)
+	c.Assert(err, ErrorMatches, "Overlays can only be rendered for 2d slices.*")
+}
+
+func (suite *DataSuite) TestBlendOverlay(c *C) {
+	red := color.NRGBA{255, 0, 0, 255}
+	c.Assert(blendOverlay(100, red, 0), Equals, color.NRGBA{100, 100, 100, 255})
+	c.Assert(blendOverlay(100, red, 1), Equals, red)
+	c.Assert(blendOverlay(100, red, 0.5), Equals, color.NRGBA{178, 50, 50, 255})
+
+	// The label color's own alpha scales the overlay alpha.
+	c.Assert(blendOverlay(100, color.NRGBA{255, 0, 0, 0}, 1), Equals, color.NRGBA{100, 100, 100, 255})
+}
+
+func (suite *DataSuite) TestColorMap(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	labels, ok := suite.newData(c, root, "labels64", "colorlabels").(*Data)
+	c.Assert(ok, Equals, true)
+	hashed := labels.LabelColor(23)
+
+	colorsRequest := func(method, endpoint, body string) (int, string) {
+		url := fmt.Sprintf("node/%s/colorlabels/%s", root, endpoint)
+		r := httptest.NewRequest(method, server.WebAPIPath+url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		labels.colorsHTTP(root, w, r, strings.Split(url, "/"))
+		return w.Code, w.Body.String()
+	}
+	_, body := colorsRequest("POST", "colors", `{"23": [255, 0, 0], "5": [0, 0, 255, 128]}`)
+	c.Assert(body, Matches, "Set 2 and removed 0 label colors.*")
+	c.Assert(labels.LabelColor(23), Equals, color.NRGBA{255, 0, 0, 255})
+	c.Assert(labels.LabelColor(5), Equals, color.NRGBA{0, 0, 255, 128})
+
+	code, body := colorsRequest("GET", "colors", "")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, `{"23":[255,0,0,255],"5":[0,0,255,128]}`)
+	code, body = colorsRequest("GET", "colors/5_6", "")
+	c.Assert(code, Equals, http.StatusOK)
+	sixth := labels.LabelColor(6)
+	c.Assert(body, Equals, fmt.Sprintf(`{"5":[0,0,255,128],"6":[%d,%d,%d,255]}`, sixth.R, sixth.G, sixth.B))
+
+	// An empty color removes the override, restoring the hashed color.
+	_, body = colorsRequest("POST", "colors", `{"23": []}`)
+	c.Assert(body, Matches, "Set 0 and removed 1 label colors.*")
+	c.Assert(labels.LabelColor(23), Equals, hashed)
+
+	for _, bad := range []string{`{"23": [256, 0, 0]}`, `{"23": [1, 2]}`, `{"x": [1, 2, 3]}`, `not json`} {
+		code, _ = colorsRequest("POST", "colors", bad)
+		c.Assert(code, Equals, http.StatusBadRequest, Commentf("posted %s", bad))
+	}
+	c.Assert(labels.LabelColor(5), Equals, color.NRGBA{0, 0, 255, 128})
+}
+
+func (suite *DataSuite) TestCheckpoints(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	labels, ok := suite.newData(c, root, "labels64", "checkpointlabels").(*Data)
+	c.Assert(ok, Equals, true)
+	_, versionID, err := suite.service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+
+	// Writes before any checkpoint are not logged.
+	putLabels(c, root, labels, 1)
+	db, err := suite.service.KeyValueGetter()
+	c.Assert(err, IsNil)
+	seq, err := labels.lastSequence(db, versionID)
+	c.Assert(err, IsNil)
+	c.Assert(seq, Equals, uint64(0))
+
+	_, err = labels.CreateCheckpoint(root, "first")
+	c.Assert(err, IsNil)
+	_, err = labels.CreateCheckpoint(root, "first")
+	c.Assert(err, ErrorMatches, "Checkpoint 'first' already exists.*")
+	putLabels(c, root, labels, 2)
+	_, err = labels.CreateCheckpoint(root, "second")
+	c.Assert(err, IsNil)
+	putLabels(c, root, labels, 3)
+	putLabels(c, root, labels, 4)
+	c.Assert(getLabel(c, root, labels), Equals, uint64(4))
+
+	mutations, err := labels.Rollback(root, "second")
+	c.Assert(err, IsNil)
+	c.Assert(mutations, Equals, 2)
+	c.Assert(getLabel(c, root, labels), Equals, uint64(2))
+
+	// Rolling back removes later checkpoints.
+	mutations, err = labels.Rollback(root, "first")
+	c.Assert(err, IsNil)
+	c.Assert(mutations, Equals, 1)
+	c.Assert(getLabel(c, root, labels), Equals, uint64(1))
+	checkpoints, err := labels.GetCheckpoints(versionID)
+	c.Assert(err, IsNil)
+	c.Assert(checkpoints, HasLen, 1)
+	c.Assert(checkpoints[0].Name, Equals, "first")
+	_, err = labels.Rollback(root, "second")
+	c.Assert(err, ErrorMatches, "No checkpoint 'second'.*")
+
+	// Writes concurrent with creating the first checkpoint are either done before it or
+	// logged, so rolling back restores a label written before the checkpoint.
+	concurrent, ok := suite.newData(c, root, "labels64", "concurrentlabels").(*Data)
+	c.Assert(ok, Equals, true)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(label uint64) {
+			defer wg.Done()
+			putLabels(c, root, concurrent, label)
+		}(uint64(10 + i))
+	}
+	_, err = concurrent.CreateCheckpoint(root, "concurrent")
+	c.Assert(err, IsNil)
+	wg.Wait()
+	_, err = concurrent.Rollback(root, "concurrent")
+	c.Assert(err, IsNil)
+	seq, err = concurrent.lastSequence(db, versionID)
+	c.Assert(err, IsNil)
+	c.Assert(seq, Equals, uint64(0))
+	label := getLabel(c, root, concurrent)
+	c.Assert(label == 0 || (label >= 10 && label < 14), Equals, true, Commentf("label %d", label))
+
+	// Checkpoints are only available in unlocked nodes.
+	c.Assert(suite.service.Lock(root), IsNil)
+	_, err = labels.CreateCheckpoint(root, "locked")
+	c.Assert(err, ErrorMatches, "Checkpoints are only available in unlocked nodes.*")
+}
+
+// testSparseVol returns the encoding of a sparse volume with the given runs of x, y, z, and
+// length.
+func testSparseVol(runs ...[4]int32) []byte {
+	rows := make(sparseRows)
+	for _, run := range runs {
+		row := sparseRow{run[1], run[2]}
+		rows[row] = append(rows[row], sparseSpan{run[0], run[0] + run[3]})
+	}
+	return rows.encode()
+}
+
+func (suite *DataSuite) TestCombineSparseVols(c *C) {
+	a := testSparseVol([4]int32{0, 0, 0, 10}, [4]int32{5, 1, 0, 5})
+	b := testSparseVol([4]int32{5, 0, 0, 10}, [4]int32{0, 2, 0, 3})
+
+	union, err := CombineSparseVols(SparseVolUnion, a, b)
+	c.Assert(err, IsNil)
+	c.Assert(union, DeepEquals, testSparseVol([4]int32{0, 0, 0, 15}, [4]int32{5, 1, 0, 5}, [4]int32{0, 2, 0, 3}))
+	c.Assert(binary.LittleEndian.Uint32(union[4:8]), Equals, uint32(23))
+
+	intersection, err := CombineSparseVols(SparseVolIntersection, a, b)
+	c.Assert(err, IsNil)
+	c.Assert(intersection, DeepEquals, testSparseVol([4]int32{5, 0, 0, 5}))
+
+	difference, err := CombineSparseVols(SparseVolDifference, a, b)
+	c.Assert(err, IsNil)
+	c.Assert(difference, DeepEquals, testSparseVol([4]int32{0, 0, 0, 5}, [4]int32{5, 1, 0, 5}))
+
+	_, err = CombineSparseVols("xor", a, b)
+	c.Assert(err, ErrorMatches, "Unknown sparse volume operation 'xor'.*")
+	_, err = CombineSparseVols(SparseVolUnion)
+	c.Assert(err, ErrorMatches, ".*requires at least one sparse volume.*")
+	_, err = CombineSparseVols(SparseVolUnion, a, b[:20])
+	c.Assert(err, ErrorMatches, "RLE encoding doesn't have correct # bytes.*")
+}
+
+func (suite *DataSuite) TestCombineLabelSparseVols(c *C) {
+	vols := map[uint64][]byte{
+		1: testSparseVol([4]int32{0, 0, 0, 10}),
+		2: testSparseVol([4]int32{20, 0, 0, 10}),
+		3: testSparseVol([4]int32{0, 1, 0, 10}),
+	}
+	var got []uint64
+	getSparseVol := func(label uint64) ([]byte, error) {
+		got = append(got, label)
+		return vols[label], nil
+	}
+
+	// Once an intersection is empty, no more sparse volumes are read.
+	intersection, err := CombineLabelSparseVols(SparseVolIntersection, []uint64{1, 2, 3}, getSparseVol)
+	c.Assert(err, IsNil)
+	c.Assert(intersection, DeepEquals, testSparseVol())
+	c.Assert(got, DeepEquals, []uint64{1, 2})
+
+	labels := make([]uint64, MaxSparseVolOpLabels+1)
+	_, err = CombineLabelSparseVols(SparseVolUnion, labels, getSparseVol)
+	c.Assert(err, ErrorMatches, ".*exceeds the limit of 100 labels.*")
+
+	// Results are limited to the server's bytes per request.
+	oldMax := voxels.MaxRequestBytes
+	defer func() { voxels.MaxRequestBytes = oldMax }()
+	voxels.MaxRequestBytes = sparseVolHeaderSize + 2*16
+	_, err = CombineLabelSparseVols(SparseVolUnion, []uint64{1, 2}, getSparseVol)
+	c.Assert(err, IsNil)
+	_, err = CombineLabelSparseVols(SparseVolUnion, []uint64{1, 2, 3}, getSparseVol)
+	c.Assert(err, ErrorMatches, ".*more than the server's limit of 44 bytes.*")
+}
+
+// runsOf returns the encoding of runs with the given lengths, without a header.
+func runsOf(lengths ...int32) []byte {
+	runs := make([]byte, 16*len(lengths))
+	for i, length := range lengths {
+		binary.LittleEndian.PutUint32(runs[16*i+12:], uint32(length))
+	}
+	return runs
+}
+
+func (suite *DataSuite) TestListLabels(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	labels, ok := suite.newData(c, root, "labels64", "listlabels").(*Data)
+	c.Assert(ok, Equals, true)
+	_, rootID, err := suite.service.LocalIDFromUUID(root)
+	c.Assert(err, IsNil)
+	db, err := server.KeyValueSetter()
+	c.Assert(err, IsNil)
+
+	block := dvid.IndexZYX{0, 0, 0}
+	c.Assert(db.Put(labels.NewLabelSpatialMapKey(rootID, 3, block), runsOf(4, 2)), IsNil)
+	c.Assert(db.Put(labels.NewLabelSpatialMapKey(rootID, 3, dvid.IndexZYX{1, 0, 0}), runsOf(10)), IsNil)
+	c.Assert(db.Put(labels.NewLabelSpatialMapKey(rootID, 7, block), runsOf(1)), IsNil)
+	c.Assert(db.Put(labels.NewLabelSpatialMapKey(rootID, 100000, block), runsOf(5)), IsNil)
+
+	// Labels stored in an ancestor are listed in its descendants.
+	c.Assert(suite.service.Lock(root), IsNil)
+	child, err := suite.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	_, childID, err := suite.service.LocalIDFromUUID(child)
+	c.Assert(err, IsNil)
+	c.Assert(db.Put(labels.NewLabelSpatialMapKey(childID, 5, block), runsOf(3)), IsNil)
+
+	getLabels := func(uuid dvid.UUID, start uint64, limit int, sizes bool) LabelList {
+		jsonStr, err := labels.GetLabels(context.Background(), uuid, start, limit, sizes)
+		c.Assert(err, IsNil)
+		var list LabelList
+		c.Assert(json.Unmarshal([]byte(jsonStr), &list), IsNil)
+		return list
+	}
+	list := getLabels(root, 0, 10, true)
+	c.Assert(list.Labels, DeepEquals, []uint64{3, 7, 100000})
+	c.Assert(list.Sizes, DeepEquals, []uint64{16, 1, 5})
+	c.Assert(list.Next, IsNil)
+
+	list = getLabels(child, 0, 2, false)
+	c.Assert(list.Labels, DeepEquals, []uint64{3, 5})
+	c.Assert(list.Sizes, IsNil)
+	c.Assert(*list.Next, Equals, uint64(7))
+
+	list = getLabels(child, *list.Next, 2, true)
+	c.Assert(list.Labels, DeepEquals, []uint64{7, 100000})
+	c.Assert(list.Sizes, DeepEquals, []uint64{1, 5})
+	c.Assert(list.Next, IsNil)
+
+	list = getLabels(child, 100001, 2, false)
+	c.Assert(list.Labels, HasLen, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = labels.GetLabels(ctx, child, 0, 2, false)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,168 @@
+/*
+	This file supports resolution of conflicts when merging version nodes: label blocks
+	changed in more than one merged node are combined voxel by voxel, and sparse volumes
+	of a label within a block are the union of their runs.  Other label denormalizations
+	are dropped from the merged node where they conflict.
+*/
+
+package labels64
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// ResolveConflict merges a label block or a label's sparse volume in a block that
+// were changed in more than one merged version node.  Label sizes and surfaces cannot
+// be merged, so they are dropped and the data is no longer ready until its label
+// denormalizations are recomputed.  Mutation logs and checkpoints only roll back
+// mutations within a node, so the merged node does not keep conflicting ones.
+func (d *Data) ResolveConflict(conflict *datastore.MergeConflict) ([]byte, error) {
+	index := conflict.Index
+	switch {
+	case len(index) == dvid.IndexZYXSize:
+		return d.mergeBlocks(conflict.Base, conflict.Values)
+	case len(index) == 8:
+		d.dropDenormalization(conflict)
+		return nil, nil
+	case len(index) == 0:
+		return nil, fmt.Errorf("Cannot merge key with empty index")
+	}
+	switch KeyType(index[0]) {
+	case KeyLabelSpatialMap:
+		return unionRuns(conflict.Values)
+	case KeyLabelSizes:
+		d.dropDenormalization(conflict)
+		return nil, nil
+	case KeyMutationLog, KeyCheckpoint:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Cannot merge keys of type %s", KeyType(index[0]))
+	}
+}
+
+// dropDenormalization marks the data as not ready when a conflicting label size or
+// surface is dropped from a merge.
+func (d *Data) dropDenormalization(conflict *datastore.MergeConflict) {
+	if d.Ready {
+		dvid.Log(dvid.Normal, "Merge of nodes %v dropped conflicting label denormalizations of '%s'; "+
+			"recompute them to make the data ready\n", conflict.Parents, d.DataName())
+	}
+	d.Ready = false
+}
+
+// mergeBlocks returns a block whose voxels have the label changed from the base block
+// by any merged node.  Returns an error if merged nodes changed a voxel to different
+// labels.  A nil base is a block of background.
+func (d *Data) mergeBlocks(base []byte, values [][]byte) ([]byte, error) {
+	// A deleted block is a block of background.
+	blockSize := -1
+	blocks := make([][]byte, len(values))
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		block, _, err := dvid.DeserializeData(value, true)
+		if err != nil {
+			return nil, err
+		}
+		if blockSize >= 0 && len(block) != blockSize {
+			return nil, fmt.Errorf("Cannot merge label blocks of %d and %d bytes", blockSize, len(block))
+		}
+		blockSize = len(block)
+		blocks[i] = block
+	}
+	if blockSize < 0 {
+		return nil, nil
+	}
+	for i := range blocks {
+		if blocks[i] == nil {
+			blocks[i] = make([]byte, blockSize)
+		}
+	}
+	baseBlock := make([]byte, blockSize)
+	if base != nil {
+		block, _, err := dvid.DeserializeData(base, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(block) != len(baseBlock) {
+			return nil, fmt.Errorf("Cannot merge label blocks of %d and %d bytes", len(block), len(baseBlock))
+		}
+		copy(baseBlock, block)
+	}
+	merged := make([]byte, len(baseBlock))
+	copy(merged, baseBlock)
+	for start := 0; start+8 <= len(merged); start += 8 {
+		changed := false
+		for _, block := range blocks {
+			label := block[start : start+8]
+			if bytes.Equal(label, baseBlock[start:start+8]) {
+				continue
+			}
+			if changed && !bytes.Equal(label, merged[start:start+8]) {
+				return nil, fmt.Errorf("Merged nodes changed voxel %d of block to different labels %d and %d",
+					start/8, d.Properties.ByteOrder.Uint64(merged[start:start+8]),
+					d.Properties.ByteOrder.Uint64(label))
+			}
+			copy(merged[start:start+8], label)
+			changed = true
+		}
+	}
+	return dvid.SerializeData(merged, d.UseCompression(), d.Checksum)
+}
+
+type runsByStart []rle
+
+func (r runsByStart) Len() int      { return len(r) }
+func (r runsByStart) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r runsByStart) Less(i, j int) bool {
+	a, b := r[i].start, r[j].start
+	if a[2] != b[2] {
+		return a[2] < b[2]
+	}
+	if a[1] != b[1] {
+		return a[1] < b[1]
+	}
+	return a[0] < b[0]
+}
+
+// unionRuns returns the encoding of runs covering the voxels of any of the given
+// run encodings.  Nil encodings are of deleted sparse volumes.
+func unionRuns(encodings [][]byte) ([]byte, error) {
+	var runs []rle
+	for _, encoding := range encodings {
+		if encoding == nil {
+			continue
+		}
+		vol := new(sparseVol)
+		if err := vol.AddRLEs(encoding); err != nil {
+			return nil, err
+		}
+		runs = append(runs, vol.rles[:vol.pos]...)
+	}
+	sort.Sort(runsByStart(runs))
+
+	var starts []dvid.Point3d
+	var lengths []int32
+	for _, run := range runs {
+		last := len(starts) - 1
+		if last >= 0 && starts[last][1] == run.start[1] && starts[last][2] == run.start[2] &&
+			starts[last][0]+lengths[last] >= run.start[0] {
+			if end := run.start[0] + run.length; end > starts[last][0]+lengths[last] {
+				lengths[last] = end - starts[last][0]
+			}
+			continue
+		}
+		starts = append(starts, run.start)
+		lengths = append(lengths, run.length)
+	}
+	if len(starts) == 0 {
+		return []byte{}, nil
+	}
+	return encodeRuns(starts, lengths)
+}
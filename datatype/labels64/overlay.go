@@ -0,0 +1,141 @@
+/*
+	This file supports server-side rendering of label overlays on grayscale slices.
+*/
+
+package labels64
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// DefaultOverlayAlpha is the opacity of label colors over grayscale if not specified.
+const DefaultOverlayAlpha = 0.5
+
+// RenderOverlay returns a 2d slice of 8-bit grayscale with this data's labels colorized
+// and blended over it using the given alpha in [0,1].
+func (d *Data) RenderOverlay(ctx context.Context, uuid dvid.UUID, slice dvid.Geometry, grayscale *voxels.Data,
+	alpha float64) (*image.NRGBA, error) {
+
+	if slice.DataShape().ShapeDimensions() != 2 {
+		return nil, fmt.Errorf("Overlays can only be rendered for 2d slices, not %s", slice.DataShape())
+	}
+	if alpha < 0 || alpha > 1 {
+		return nil, fmt.Errorf("Overlay alpha must be between 0 and 1, got %f", alpha)
+	}
+	values := grayscale.Values()
+	if len(values) != 1 || values[0].T != dvid.T_uint8 {
+		return nil, fmt.Errorf("Overlay requires 8-bit grayscale data, which '%s' is not",
+			grayscale.DataName())
+	}
+
+	labelExt, err := d.NewExtHandler(slice, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = voxels.GetVoxels(ctx, uuid, d, labelExt); err != nil {
+		return nil, err
+	}
+	grayExt, err := grayscale.NewExtHandler(slice, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = voxels.GetVoxels(ctx, uuid, grayscale, grayExt); err != nil {
+		return nil, err
+	}
+
+	nx := int(slice.Size().Value(0))
+	ny := int(slice.Size().Value(1))
+	img := image.NewNRGBA(image.Rect(0, 0, nx, ny))
+	labelData, grayData := labelExt.Data(), grayExt.Data()
+	labelStride, grayStride := int(labelExt.Stride()), int(grayExt.Stride())
+
+	// Cache colors since slices usually have few distinct labels.
+	colors := make(map[uint64]color.NRGBA)
+	for y := 0; y < ny; y++ {
+		labelI := y * labelStride
+		grayI := y * grayStride
+		for x := 0; x < nx; x++ {
+			label := d.ByteOrder.Uint64(labelData[labelI : labelI+8])
+			labelColor, found := colors[label]
+			if !found {
+				labelColor = d.LabelColor(label)
+				colors[label] = labelColor
+			}
+			img.SetNRGBA(x, y, blendOverlay(grayData[grayI], labelColor, alpha))
+			labelI += 8
+			grayI++
+		}
+	}
+	return img, nil
+}
+
+// blendOverlay returns the opaque color of a grayscale value under a label color,
+// where the label color's own alpha scales the overlay alpha.
+func blendOverlay(gray uint8, c color.NRGBA, alpha float64) color.NRGBA {
+	a := alpha * float64(c.A) / 255.0
+	mix := func(v uint8) uint8 {
+		return uint8((1-a)*float64(gray) + a*float64(v) + 0.5)
+	}
+	return color.NRGBA{mix(c.R), mix(c.G), mix(c.B), 255}
+}
+
+// overlayHTTP handles the "overlay" endpoint:
+// GET <api URL>/node/<UUID>/<data name>/overlay/<dims>/<size>/<offset>/<grayscale name>[/<format>]
+func (d *Data) overlayHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request, parts []string) error {
+	if len(parts) < 8 {
+		err := fmt.Errorf("'overlay' must be followed by shape/size/offset/grayscale name")
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	shapeStr, sizeStr, offsetStr, grayscaleName := parts[4], parts[5], parts[6], parts[7]
+	slice, err := dvid.NewSliceFromStrings(dvid.DataShapeString(shapeStr), offsetStr, sizeStr, "_")
+	if err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	if err := voxels.CheckRequestBudget(d, slice, r); err != nil {
+		voxels.BudgetFailed(w, r, err)
+		return nil
+	}
+	dataservice, err := server.DatastoreService().DataServiceByUUID(uuid, dvid.DataString(grayscaleName))
+	if err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	grayscale, ok := dataservice.(*voxels.Data)
+	if !ok {
+		err := fmt.Errorf("%s is not the name of grayscale8 data", grayscaleName)
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	alpha := DefaultOverlayAlpha
+	if alphaStr := r.URL.Query().Get("alpha"); alphaStr != "" {
+		if alpha, err = strconv.ParseFloat(alphaStr, 64); err != nil {
+			server.BadRequest(w, r, fmt.Sprintf("Illegal alpha '%s': %s", alphaStr, err.Error()))
+			return err
+		}
+	}
+	img, err := d.RenderOverlay(ctx, uuid, slice, grayscale, alpha)
+	if err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	var formatStr string
+	if len(parts) >= 9 {
+		formatStr = parts[8]
+	}
+	if err = dvid.WriteImageHttp(w, img, formatStr); err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+/*
+	This file supports set operations on sparse volumes, so the union, intersection, or
+	difference of the sparse volumes of several labels can be computed server-side and
+	returned as a single RLE encoding.  Sparse volumes are combined one at a time, so
+	only the running result and the sparse volume being combined are held in memory.
+*/
+
+package labels64
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// SparseVolOp is a set operation on sparse volumes.
+type SparseVolOp string
+
+const (
+	// SparseVolUnion includes voxels in any of the sparse volumes.
+	SparseVolUnion SparseVolOp = "union"
+
+	// SparseVolIntersection includes voxels in all of the sparse volumes.
+	SparseVolIntersection SparseVolOp = "intersection"
+
+	// SparseVolDifference includes voxels of the first sparse volume that are in none of
+	// the others.
+	SparseVolDifference SparseVolOp = "difference"
+)
+
+// sparseVolHeaderSize is the number of bytes before the runs of a sparse volume.
+const sparseVolHeaderSize = 12
+
+// MaxSparseVolOpLabels is the most labels whose sparse volumes can be combined in one
+// request.
+const MaxSparseVolOpLabels = 100
+
+// sparseRow is a row of voxels along x.
+type sparseRow struct {
+	y, z int32
+}
+
+// sparseSpan is a half-open interval [beg, end) of x coordinates.
+type sparseSpan struct {
+	beg, end int32
+}
+
+// sparseRows holds the sorted, non-overlapping spans of each row of a sparse volume.
+type sparseRows map[sparseRow][]sparseSpan
+
+// decodeSparseRows returns the rows of an encoded sparse volume with a header.
+func decodeSparseRows(encoding []byte) (sparseRows, error) {
+	if len(encoding) < sparseVolHeaderSize {
+		return nil, fmt.Errorf("Sparse volume has only %d bytes", len(encoding))
+	}
+	runs := encoding[sparseVolHeaderSize:]
+	if len(runs)%16 != 0 {
+		return nil, fmt.Errorf("RLE encoding doesn't have correct # bytes: %d", len(runs))
+	}
+	rows := make(sparseRows)
+	for i := 0; i < len(runs); i += 16 {
+		x := int32(binary.LittleEndian.Uint32(runs[i : i+4]))
+		y := int32(binary.LittleEndian.Uint32(runs[i+4 : i+8]))
+		z := int32(binary.LittleEndian.Uint32(runs[i+8 : i+12]))
+		length := int32(binary.LittleEndian.Uint32(runs[i+12 : i+16]))
+		if length <= 0 {
+			continue
+		}
+		row := sparseRow{y, z}
+		rows[row] = append(rows[row], sparseSpan{x, x + length})
+	}
+	for row, spans := range rows {
+		rows[row] = normalizeSpans(spans)
+	}
+	return rows, nil
+}
+
+type sparseSpans []sparseSpan
+
+func (s sparseSpans) Len() int           { return len(s) }
+func (s sparseSpans) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sparseSpans) Less(i, j int) bool { return s[i].beg < s[j].beg }
+
+// normalizeSpans sorts spans and merges those that overlap or touch.
+func normalizeSpans(spans []sparseSpan) []sparseSpan {
+	sort.Sort(sparseSpans(spans))
+	merged := spans[:0]
+	for _, span := range spans {
+		last := len(merged) - 1
+		if last >= 0 && span.beg <= merged[last].end {
+			if span.end > merged[last].end {
+				merged[last].end = span.end
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
+
+// intersectSpans returns the x coordinates in both normalized spans.
+func intersectSpans(a, b []sparseSpan) []sparseSpan {
+	var result []sparseSpan
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		beg, end := a[i].beg, a[i].end
+		if b[j].beg > beg {
+			beg = b[j].beg
+		}
+		if b[j].end < end {
+			end = b[j].end
+		}
+		if beg < end {
+			result = append(result, sparseSpan{beg, end})
+		}
+		if a[i].end < b[j].end {
+			i++
+		} else {
+			j++
+		}
+	}
+	return result
+}
+
+// subtractSpans returns the x coordinates in normalized spans a but not in b.
+func subtractSpans(a, b []sparseSpan) []sparseSpan {
+	var result []sparseSpan
+	j := 0
+	for _, span := range a {
+		beg := span.beg
+		for j < len(b) && b[j].end <= beg {
+			j++
+		}
+		for k := j; k < len(b) && b[k].beg < span.end; k++ {
+			if b[k].beg > beg {
+				result = append(result, sparseSpan{beg, b[k].beg})
+			}
+			if b[k].end > beg {
+				beg = b[k].end
+			}
+		}
+		if beg < span.end {
+			result = append(result, sparseSpan{beg, span.end})
+		}
+	}
+	return result
+}
+
+// check returns an error if the operation is unknown.
+func (op SparseVolOp) check() error {
+	switch op {
+	case SparseVolUnion, SparseVolIntersection, SparseVolDifference:
+		return nil
+	}
+	return fmt.Errorf("Unknown sparse volume operation '%s': use %s, %s, or %s", op,
+		SparseVolUnion, SparseVolIntersection, SparseVolDifference)
+}
+
+// combine applies the set operation to the rows of a running result and another sparse
+// volume, returning the new result.
+func (op SparseVolOp) combine(result, vol sparseRows) sparseRows {
+	switch op {
+	case SparseVolUnion:
+		for row, spans := range vol {
+			result[row] = normalizeSpans(append(result[row], spans...))
+		}
+	case SparseVolIntersection:
+		for row, spans := range result {
+			if intersection := intersectSpans(spans, vol[row]); len(intersection) != 0 {
+				result[row] = intersection
+			} else {
+				delete(result, row)
+			}
+		}
+	case SparseVolDifference:
+		for row, spans := range result {
+			if difference := subtractSpans(spans, vol[row]); len(difference) != 0 {
+				result[row] = difference
+			} else {
+				delete(result, row)
+			}
+		}
+	}
+	return result
+}
+
+// encodedSize returns the number of bytes of the sparse volume encoding of rows.
+func (rows sparseRows) encodedSize() int64 {
+	size := int64(sparseVolHeaderSize)
+	for _, spans := range rows {
+		size += 16 * int64(len(spans))
+	}
+	return size
+}
+
+type sparseRowList []sparseRow
+
+func (r sparseRowList) Len() int      { return len(r) }
+func (r sparseRowList) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r sparseRowList) Less(i, j int) bool {
+	return r[i].z < r[j].z || (r[i].z == r[j].z && r[i].y < r[j].y)
+}
+
+// encode returns the sparse volume encoding of rows, ordered by z, y, and then x.
+func (rows sparseRows) encode() []byte {
+	ordered := make(sparseRowList, 0, len(rows))
+	for row := range rows {
+		ordered = append(ordered, row)
+	}
+	sort.Sort(ordered)
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(PayloadBinary)
+	binary.Write(buf, binary.LittleEndian, uint8(3))
+	binary.Write(buf, binary.LittleEndian, byte(0))
+	buf.WriteByte(byte(0))
+	binary.Write(buf, binary.LittleEndian, uint32(0)) // Placeholder for # voxels
+	binary.Write(buf, binary.LittleEndian, uint32(0)) // Placeholder for # spans
+	var numVoxels, numRuns uint32
+	for _, row := range ordered {
+		for _, span := range rows[row] {
+			binary.Write(buf, binary.LittleEndian, span.beg)
+			binary.Write(buf, binary.LittleEndian, row.y)
+			binary.Write(buf, binary.LittleEndian, row.z)
+			binary.Write(buf, binary.LittleEndian, span.end-span.beg)
+			numVoxels += uint32(span.end - span.beg)
+			numRuns++
+		}
+	}
+	encoding := buf.Bytes()
+	binary.LittleEndian.PutUint32(encoding[4:8], numVoxels)
+	binary.LittleEndian.PutUint32(encoding[8:12], numRuns)
+	return encoding
+}
+
+// CombineSparseVols applies a set operation to encoded sparse volumes, as returned by
+// GetSparseVol, and returns the encoded result.  Runs of the result are ordered by z,
+// y, and then x, and the header includes the number of voxels.
+func CombineSparseVols(op SparseVolOp, encodings ...[]byte) ([]byte, error) {
+	return combineSparseVols(op, len(encodings), func(i int) ([]byte, error) {
+		return encodings[i], nil
+	})
+}
+
+// CombineLabelSparseVols applies a set operation to the sparse volumes of labels, getting
+// each label's encoded sparse volume only when it is combined.  At most
+// MaxSparseVolOpLabels labels may be given, and an error is returned if the result would
+// exceed the server's limit of bytes per voxel request.
+func CombineLabelSparseVols(op SparseVolOp, labels []uint64,
+	getSparseVol func(label uint64) ([]byte, error)) ([]byte, error) {
+
+	if len(labels) > MaxSparseVolOpLabels {
+		return nil, fmt.Errorf("Sparse volume %s of %d labels exceeds the limit of %d labels",
+			op, len(labels), MaxSparseVolOpLabels)
+	}
+	return combineSparseVols(op, len(labels), func(i int) ([]byte, error) {
+		return getSparseVol(labels[i])
+	})
+}
+
+// combineSparseVols folds n encoded sparse volumes, returned in turn by get, into the
+// result of a set operation.
+func combineSparseVols(op SparseVolOp, n int, get func(i int) ([]byte, error)) ([]byte, error) {
+	if err := op.check(); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("Sparse volume %s requires at least one sparse volume", op)
+	}
+	var result sparseRows
+	for i := 0; i < n; i++ {
+		encoding, err := get(i)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := decodeSparseRows(encoding)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			result = rows
+		} else {
+			result = op.combine(result, rows)
+		}
+		if voxels.MaxRequestBytes > 0 && result.encodedSize() > voxels.MaxRequestBytes {
+			return nil, fmt.Errorf("Sparse volume %s requires more than the server's limit of %d bytes per request",
+				op, voxels.MaxRequestBytes)
+		}
+		// Further sparse volumes can't add to an empty intersection or difference.
+		if len(result) == 0 && op != SparseVolUnion {
+			break
+		}
+	}
+	return result.encode(), nil
+}
+
+// ParseLabelList returns the labels of a string of labels separated by a separator,
+// e.g., "23_51_7".
+func ParseLabelList(s, separator string) ([]uint64, error) {
+	var labels []uint64
+	for _, labelStr := range strings.Split(s, separator) {
+		if labelStr == "" {
+			continue
+		}
+		label, err := strconv.ParseUint(labelStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad label '%s' in label list '%s'", labelStr, s)
+		}
+		labels = append(labels, label)
+	}
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("No labels given in label list '%s'", s)
+	}
+	return labels, nil
+}
+
+// GetSparseVolOp returns the encoded result of a set operation on the sparse volumes of
+// labels.  For a difference, voxels of the first label that are in none of the other
+// labels are returned.
+func (d *Data) GetSparseVolOp(uuid dvid.UUID, op SparseVolOp, labels []uint64) ([]byte, error) {
+	return CombineLabelSparseVols(op, labels, func(label uint64) ([]byte, error) {
+		return d.GetSparseVol(uuid, label)
+	})
+}
@@ -0,0 +1,183 @@
+/*
+	This file supports reading a contiguous range of channels of multichannel data in one
+	traversal of the stored blocks instead of one voxel request per channel.
+*/
+
+package multichan16
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// GetChannels returns the voxels within a geometry of each channel from begChannel to
+// endChannel, inclusive.  Versions are resolved once and the blocks of all channels are
+// read in key order, with one range query for each row of blocks of a channel.
+func (d *Data) GetChannels(ctx context.Context, uuid dvid.UUID, geom dvid.Geometry,
+	begChannel, endChannel int32) ([]*Channel, error) {
+
+	if begChannel < 1 || begChannel > endChannel || int(endChannel) > d.NumChannels {
+		return nil, fmt.Errorf("Channels %d to %d are not within channels 1 to %d of data '%s'",
+			begChannel, endChannel, d.NumChannels, d.DataName())
+	}
+	values := d.Data.Values()
+	if len(values) < int(endChannel) {
+		return nil, fmt.Errorf("Cannot retrieve absent data '%s'.  Please load data.", d.DataName())
+	}
+	begVoxel, ok := geom.StartPoint().(dvid.Chunkable)
+	if !ok {
+		return nil, fmt.Errorf("Geometry StartPoint() cannot handle Chunkable points.")
+	}
+	endVoxel, ok := geom.EndPoint().(dvid.Chunkable)
+	if !ok {
+		return nil, fmt.Errorf("Geometry EndPoint() cannot handle Chunkable points.")
+	}
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	if !ok {
+		return nil, fmt.Errorf("Data '%s' does not have 3d blocks", d.DataName())
+	}
+	begBlock := begVoxel.Chunk(blockSize).(dvid.ChunkPoint3d)
+	endBlock := endVoxel.Chunk(blockSize).(dvid.ChunkPoint3d)
+
+	db, err := server.KeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	dataID := d.DataID()
+	versions, err := server.DatastoreService().DataVersions(uuid, dataID.DataName())
+	if err != nil {
+		return nil, err
+	}
+
+	// Each channel receives its own blocks through its own chunk operation.
+	wg := new(sync.WaitGroup)
+	channels := make([]*Channel, endChannel-begChannel+1)
+	chunkOps := make([]*storage.ChunkOp, len(channels))
+	for i := range channels {
+		dataValues := dvid.DataValues{values[int(begChannel)+i-1]}
+		bytesPerVoxel := dataValues.BytesPerElement()
+		data := make([]uint8, int(geom.NumVoxels())*int(bytesPerVoxel))
+		stride := geom.Size().Value(0) * bytesPerVoxel
+		channels[i] = &Channel{
+			Voxels:     voxels.NewVoxels(geom, dataValues, data, stride, d.ByteOrder),
+			channelNum: begChannel + int32(i),
+		}
+		chunkOps[i] = &storage.ChunkOp{&voxels.Operation{ExtHandler: channels[i], OpType: voxels.GetOp}, wg}
+	}
+
+	server.SpawnGoroutineMutex.Lock()
+	it := dvid.NewIndexCZYXChannelIterator(begChannel, endChannel, geom, begBlock, endBlock)
+	for ; it.Valid(); it.NextSpan() {
+		indexBeg, indexEnd, err := it.IndexSpan()
+		if err == nil {
+			chunkOp := chunkOps[it.Channel()-begChannel]
+			err = datastore.ProcessVersionedRange(ctx, db, dataID, versions, indexBeg, indexEnd, chunkOp,
+				d.ProcessChunk)
+		}
+		if err != nil {
+			server.SpawnGoroutineMutex.Unlock()
+			wg.Wait()
+			return nil, fmt.Errorf("Unable to GET channels of data %s: %s", dataID.DataName(), err.Error())
+		}
+	}
+	server.SpawnGoroutineMutex.Unlock()
+
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+// parseChannelRange parses a channel range of the form "<first>_<last>".
+func parseChannelRange(s string) (begChannel, endChannel int32, err error) {
+	parts := strings.Split(s, "_")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Channel range '%s' must be in the form '<first>_<last>'", s)
+	}
+	beg, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Bad first channel in range '%s': %s", s, err.Error())
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Bad last channel in range '%s': %s", s, err.Error())
+	}
+	return int32(beg), int32(end), nil
+}
+
+// serveChannels handles GET of a range of channels, whose voxels are returned one channel
+// after another in the byte order of the data.
+//
+//	GET <api URL>/node/<UUID>/<data name>/channels/<first>_<last>/<dims>/<size>/<offset>
+func (d *Data) serveChannels(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request,
+	parts []string) error {
+
+	if strings.ToLower(r.Method) != "get" {
+		err := fmt.Errorf("Channels of data '%s' can only be read with GET", d.DataName())
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	if len(parts) < 8 {
+		err := fmt.Errorf("Channels GET must be followed by <first>_<last>/<dims>/<size>/<offset>")
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	begChannel, endChannel, err := parseChannelRange(parts[4])
+	if err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	shapeStr, sizeStr, offsetStr := dvid.DataShapeString(parts[5]), parts[6], parts[7]
+	dataShape, err := shapeStr.DataShape()
+	if err != nil {
+		server.BadRequest(w, r, fmt.Sprintf("Bad data shape given '%s'", shapeStr))
+		return err
+	}
+	var geom dvid.Geometry
+	switch dataShape.ShapeDimensions() {
+	case 2:
+		geom, err = dvid.NewSliceFromStrings(shapeStr, offsetStr, sizeStr, "_")
+	case 3:
+		geom, err = dvid.NewSubvolumeFromStrings(offsetStr, sizeStr, "_")
+	default:
+		err = fmt.Errorf("DVID does not yet support nD volumes")
+	}
+	if err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	if err := voxels.CheckRequestBudget(d, geom, r); err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	cost := voxels.EstimateCost(d, geom)
+	release, ok := voxels.ReserveMemory(w, r, cost)
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	channels, err := d.GetChannels(ctx, uuid, geom, begChannel, endChannel)
+	if err != nil {
+		server.BadRequest(w, r, err.Error())
+		return err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	for _, channel := range channels {
+		if _, err := w.Write(channel.Data()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
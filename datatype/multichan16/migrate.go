@@ -0,0 +1,100 @@
+/*
+	This file migrates stored blocks written when the channel of a block index was stored
+	as a raw big-endian int32 to the current encoding that offsets the channel like the
+	block coordinates, so keys sort correctly for negative values.
+*/
+
+package multichan16
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// migrateBatchSize is the number of keys rewritten in each storage batch.
+const migrateBatchSize = 1000
+
+// MigrateChannelKeys rewrites the keys of all blocks, across all versions, that use the
+// legacy channel encoding and returns the number of keys rewritten.  Keys are rewritten
+// in batches as the range is scanned, so memory use doesn't grow with the data.  Each key
+// is put under its new index and deleted in the same batch, so the migration can be rerun
+// after an interruption.
+func (d *Data) MigrateChannelKeys() (int, error) {
+	db, err := server.KeyValueGetter()
+	if err != nil {
+		return 0, err
+	}
+	batcher, err := server.Batcher()
+	if err != nil {
+		return 0, err
+	}
+	dataID := d.DataID()
+	minKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID, Index: dvid.IndexBytes{}}
+	maxKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID + 1}
+	batch := batcher.NewBatch()
+	var numMigrated, numBatched int
+	var migrateErr error
+	err = db.ProcessRange(context.Background(), minKey, maxKey, &storage.ChunkOp{}, func(chunk *storage.Chunk) {
+		if migrateErr != nil {
+			return
+		}
+		oldKey, ok := chunk.K.(*datastore.DataKey)
+		if !ok || oldKey.Data != dataID.ID || oldKey.Index == nil ||
+			!dvid.IsLegacyIndexCZYX(oldKey.Index.Bytes()) {
+			return
+		}
+		migrated, err := dvid.MigrateIndexCZYX(oldKey.Index.Bytes())
+		if err != nil {
+			migrateErr = err
+			return
+		}
+		newKey := &datastore.DataKey{
+			Dataset: oldKey.Dataset,
+			Data:    oldKey.Data,
+			Version: oldKey.Version,
+			Index:   dvid.IndexBytes(migrated),
+		}
+		batch.Put(newKey, chunk.V)
+		batch.Delete(oldKey)
+		numBatched++
+		if numBatched >= migrateBatchSize {
+			if migrateErr = batch.Commit(); migrateErr != nil {
+				return
+			}
+			batch = batcher.NewBatch()
+			numMigrated += numBatched
+			numBatched = 0
+		}
+	})
+	if err == nil {
+		err = migrateErr
+	}
+	if err == nil && numBatched > 0 {
+		if err = batch.Commit(); err == nil {
+			numMigrated += numBatched
+		}
+	}
+	if err != nil {
+		return numMigrated, fmt.Errorf("Unable to migrate keys of '%s': %s", d.DataName(), err.Error())
+	}
+	return numMigrated, nil
+}
+
+// Migrate handles the "migrate" command.
+func (d *Data) Migrate(request datastore.Request, reply *datastore.Response) error {
+	startTime := time.Now()
+	numKeys, err := d.MigrateChannelKeys()
+	if err != nil {
+		return err
+	}
+	reply.Text = fmt.Sprintf("Migrated %d block keys of '%s' to the current channel encoding\n",
+		numKeys, d.DataName())
+	dvid.ElapsedTime(dvid.Normal, startTime, "Migrated %d keys of %s", numKeys, d.DataName())
+	return nil
+}
@@ -15,6 +15,7 @@
 package multichan16
 
 import (
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
@@ -57,6 +58,21 @@ $ dvid node <UUID> <data name> load <V3D raw filename>
     data name     Name of data to add.
     filename      Filename of a V3D Raw format file.
 	
+$ dvid node <UUID> <data name> migrate
+
+    Rewrites blocks stored by earlier DVID versions, which encoded the channel of a
+    block key without an offset, so they are found using the current key encoding.
+    All versions of the data are migrated and the command can safely be rerun.
+
+    Example: 
+
+    $ dvid node 3f8c mydata migrate
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data to migrate.
+	
     ------------------
 
 HTTP API (Level 2 REST):
@@ -105,6 +121,27 @@ POST <api URL>/node/<UUID>/<data name>/<dims>/<size>/<offset>[/<format>]
                   2D: "png", "jpg" (default: "png")
                     jpg allows lossy quality setting, e.g., "jpg:80"
 
+
+GET  <api URL>/node/<UUID>/<data name>/channels/<first>_<last>/<dims>/<size>/<offset>
+
+    Retrieves a contiguous range of channels of an orthogonal plane or subvolume in one
+    request.  The 16-bit voxels of each channel are returned one channel after another
+    in the byte order of the data, with x varying fastest within a channel.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/mydata/channels/1_3/xy/200,200/0,0,100
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data without a channel suffix.
+    first, last   First and last channel numbers, inclusive, starting with channel 1.
+    dims          The axes of data extraction in form "i_j_k,..."  Example: "0_2" can be XZ.
+                    Slice strings ("xy", "xz", or "yz") are also accepted.
+    size          Size in voxels in the format "dx_dy" or "dx_dy_dz".
+    offset        3d coordinate in the format "x_y_z".  Gives coordinate of top upper left voxel.
+
 `
 
 // DefaultBlockMax specifies the default size for each block of this data type.
@@ -239,18 +276,22 @@ func (d *Data) JSONString() (string, error) {
 // --- DataService interface ---
 
 // Do acts as a switchboard for RPC commands.
-func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error {
-	if request.TypeCommand() != "load" {
+func (d *Data) DoRPC(ctx context.Context, request datastore.Request, reply *datastore.Response) error {
+	switch request.TypeCommand() {
+	case "load":
+		if len(request.Command) < 5 {
+			return fmt.Errorf("Poorly formatted load command.  See command-line help.")
+		}
+		return d.LoadLocal(ctx, request, reply)
+	case "migrate":
+		return d.Migrate(request, reply)
+	default:
 		return d.UnknownCommand(request)
 	}
-	if len(request.Command) < 5 {
-		return fmt.Errorf("Poorly formatted load command.  See command-line help.")
-	}
-	return d.LoadLocal(request, reply)
 }
 
 // DoHTTP handles all incoming HTTP requests for this dataset.
-func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+func (d *Data) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
 
 	// Allow cross-origin resource sharing.
@@ -292,6 +333,8 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, jsonStr)
 		return nil
+	case "channels":
+		return d.serveChannels(ctx, uuid, w, r, parts)
 	default:
 	}
 
@@ -347,7 +390,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 				Voxels:     v,
 				channelNum: channelNum,
 			}
-			img, err := voxels.GetImage(uuid, d, channel)
+			img, err := voxels.GetImage(ctx, uuid, d, channel)
 			var formatStr string
 			if len(parts) >= 7 {
 				formatStr = parts[6]
@@ -387,7 +430,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 
 // LoadLocal adds image data to a version node.  See HelpMessage for example of
 // command-line use of "load local".
-func (d *Data) LoadLocal(request datastore.Request, reply *datastore.Response) error {
+func (d *Data) LoadLocal(ctx context.Context, request datastore.Request, reply *datastore.Response) error {
 	startTime := time.Now()
 
 	// Get the running datastore service from this DVID instance.
@@ -442,7 +485,7 @@ func (d *Data) LoadLocal(request datastore.Request, reply *datastore.Response) e
 	// PUT each channel of the file into the datastore using a separate data name.
 	for _, channel := range channels {
 		dvid.Fmt(dvid.Debug, "Processing channel %d... \n", channel.channelNum)
-		err = voxels.PutVoxels(uuid, d, channel)
+		err = voxels.PutVoxels(ctx, uuid, d, channel)
 		if err != nil {
 			return err
 		}
@@ -451,7 +494,7 @@ func (d *Data) LoadLocal(request datastore.Request, reply *datastore.Response) e
 	// Create a RGB composite from the first 3 channels.  This is considered to be channel 0
 	// or can be accessed with the base data name.
 	dvid.Fmt(dvid.Debug, "Creating composite image from channels...\n")
-	err = d.storeComposite(uuid, channels)
+	err = d.storeComposite(ctx, uuid, channels)
 	if err != nil {
 		return err
 	}
@@ -461,7 +504,7 @@ func (d *Data) LoadLocal(request datastore.Request, reply *datastore.Response) e
 }
 
 // Create a RGB interleaved volume.
-func (d *Data) storeComposite(uuid dvid.UUID, channels []*Channel) error {
+func (d *Data) storeComposite(ctx context.Context, uuid dvid.UUID, channels []*Channel) error {
 	// Setup the composite Channel
 	geom := channels[0].Geometry
 	pixels := int(geom.NumVoxels())
@@ -527,5 +570,5 @@ func (d *Data) storeComposite(uuid dvid.UUID, channels []*Channel) error {
 	}
 
 	// Store the result
-	return voxels.PutVoxels(uuid, d, composite)
+	return voxels.PutVoxels(ctx, uuid, d, composite)
 }
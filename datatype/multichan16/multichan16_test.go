@@ -1,10 +1,13 @@
 package multichan16
 
 import (
+	"context"
+	"fmt"
 	"testing"
 	. "github.com/janelia-flyem/go/gocheck"
 
 	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
 	"github.com/janelia-flyem/dvid/dvid"
 	"github.com/janelia-flyem/dvid/server"
 )
@@ -97,3 +100,89 @@ func (s *DataSuite) TestDatasetPersistence(c *C) {
 
 	c.Assert(newJSON, DeepEquals, oldJSON)
 }
+
+func (s *DataSuite) TestMigrateChannelKeys(c *C) {
+	root, _, err := s.service.NewDataset()
+	c.Assert(err, IsNil)
+
+	err = s.service.NewData(root, "multichan16", "legacy", dvid.NewConfig())
+	c.Assert(err, IsNil)
+	dataservice, err := s.service.DataServiceByUUID(root, "legacy")
+	c.Assert(err, IsNil)
+	mchan := dataservice.(*Data)
+
+	versionID, err := server.VersionLocalID(root)
+	c.Assert(err, IsNil)
+	db, err := server.KeyValueDB()
+	c.Assert(err, IsNil)
+
+	// Store a block with the legacy channel encoding.
+	index := dvid.IndexCZYX{Channel: 1, IndexZYX: dvid.IndexZYX{-2, 3, 0}}
+	legacyIndex := append([]byte{0, 0, 0, 1}, index.IndexZYX.Bytes()...)
+	legacyKey := mchan.DataKey(versionID, dvid.IndexBytes(legacyIndex))
+	value := []byte("some block data")
+	c.Assert(db.Put(legacyKey, value), IsNil)
+
+	numKeys, err := mchan.MigrateChannelKeys()
+	c.Assert(err, IsNil)
+	c.Assert(numKeys, Equals, 1)
+
+	migrated, err := db.Get(mchan.DataKey(versionID, index))
+	c.Assert(err, IsNil)
+	c.Assert(migrated, DeepEquals, value)
+	old, err := db.Get(legacyKey)
+	c.Assert(err, IsNil)
+	c.Assert(old, IsNil)
+
+	numKeys, err = mchan.MigrateChannelKeys()
+	c.Assert(err, IsNil)
+	c.Assert(numKeys, Equals, 0)
+}
+
+func (s *DataSuite) TestGetChannels(c *C) {
+	root, _, err := s.service.NewDataset()
+	c.Assert(err, IsNil)
+
+	err = s.service.NewData(root, "multichan16", "channels", dvid.NewConfig())
+	c.Assert(err, IsNil)
+	dataservice, err := s.service.DataServiceByUUID(root, "channels")
+	c.Assert(err, IsNil)
+	mchan := dataservice.(*Data)
+
+	// Store three 16-bit channels spanning several blocks, each with distinct voxels.
+	offset := dvid.Point3d{-5, 10, 20}
+	size := dvid.Point3d{40, 3, 2}
+	subvol := dvid.NewSubvolume(offset, size)
+	numVoxels := int(subvol.NumVoxels())
+	mchan.NumChannels = 3
+	mchan.Properties.Values = make(dvid.DataValues, mchan.NumChannels)
+	stored := make([][]byte, mchan.NumChannels)
+	for i := range stored {
+		values := dvid.DataValues{{T: dvid.T_uint16, Label: fmt.Sprintf("channel%d", i)}}
+		mchan.Properties.Values[i] = values[0]
+		stored[i] = make([]byte, 2*numVoxels)
+		for v := 0; v < numVoxels; v++ {
+			mchan.ByteOrder.PutUint16(stored[i][2*v:], uint16(1000*(i+1)+v))
+		}
+		data := make([]byte, len(stored[i]))
+		copy(data, stored[i])
+		channel := &Channel{
+			Voxels:     voxels.NewVoxels(subvol, values, data, 2*size[0], mchan.ByteOrder),
+			channelNum: int32(i + 1),
+		}
+		c.Assert(voxels.PutVoxels(context.Background(), root, mchan, channel), IsNil)
+	}
+
+	channels, err := mchan.GetChannels(context.Background(), root, subvol, 2, 3)
+	c.Assert(err, IsNil)
+	c.Assert(channels, HasLen, 2)
+	for i, channel := range channels {
+		c.Assert(channel.channelNum, Equals, int32(i+2))
+		c.Assert(channel.Data(), DeepEquals, stored[i+1])
+	}
+
+	_, err = mchan.GetChannels(context.Background(), root, subvol, 0, 1)
+	c.Assert(err, NotNil)
+	_, err = mchan.GetChannels(context.Background(), root, subvol, 3, 4)
+	c.Assert(err, NotNil)
+}
@@ -8,12 +8,14 @@ package multiscale2d
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"image"
 	"image/draw"
 	"image/png"
+	"io/ioutil"
 	"math"
 	"net/http"
 	"strconv"
@@ -85,6 +87,13 @@ $ dvid -stdin node <UUID> <data name> generate <settings...> < config.json
     planes          List of one or more planes separated by semicolon.  Each plane can be
                        designated using either axis number ("0,1") or xyz nomenclature ("xy").
                        Example:  planes="0,1;yz"
+    workers         Maximum number of slices tiled concurrently (default: all CPUs).  Fewer
+                       slices are tiled at once if their voxels would exceed the server's
+                       memory budget (-memorymb), or 1 GB if there is no budget.
+    iorate          Maximum MB per second of voxels read and tiles written (default: unlimited).
+
+    Tile generation runs as a job that can be listed with "dvid jobs" and whose limits
+    can be changed while running with "dvid job <id> limits workers=<#> iorate=<MB/s>".
 
     ------------------
 
@@ -109,6 +118,19 @@ GET  <api URL>/node/<UUID>/<data name>/info
     data name     Name of multiscale2d data.
 
 
+POST <api URL>/node/<UUID>/<data name>/generate[?planes=<planes>&workers=<#>&iorate=<MB/s>]
+
+    Starts generating tiles as a background job using the tile configuration JSON in the
+    request body, which is the same as for the "generate" command.  The optional query
+    strings are the command's settings.  Returns 202 with the job ID as JSON, e.g., {"ID": 3}.
+    The job's progress can be followed as server-sent events at
+    GET <api URL>/job/<id>/events.
+
+    Example: 
+
+    POST <api URL>/node/3f8c/mymultiscale2d/generate?planes=xy
+
+
 GET  <api URL>/node/<UUID>/<data name>/tile/<dims>/<scaling>/<tile coord>
 (TODO) POST
     Retrieves PNG tile of named data within a version node.  This GET call should be the fastest
@@ -190,7 +212,6 @@ func init() {
 	// Need to register types that will be used to fulfill interfaces.
 	gob.Register(&Datatype{})
 	gob.Register(&Data{})
-	gob.Register(&IndexTile{})
 }
 
 // Scaling describes the scale level where 0 = original data resolution and
@@ -411,7 +432,7 @@ func (d *Data) JSONString() (jsonStr string, err error) {
 // --- DataService interface ---
 
 // DoRPC handles the 'generate' command.
-func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error {
+func (d *Data) DoRPC(ctx context.Context, request datastore.Request, reply *datastore.Response) error {
 	if request.TypeCommand() != "generate" {
 		return d.UnknownCommand(request)
 	}
@@ -440,7 +461,7 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 }
 
 // DoHTTP handles all incoming HTTP requests for this data.
-func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+func (d *Data) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
 
 	// Allow cross-origin resource sharing.
@@ -522,7 +543,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			server.BadRequest(w, r, err.Error())
 			return err
 		}
-		img, err := d.GetImage(uuid, slice, parts[3] == "isotropic")
+		img, err := d.GetImage(ctx, uuid, slice, parts[3] == "isotropic")
 		if err != nil {
 			server.BadRequest(w, r, err.Error())
 			return err
@@ -538,6 +559,35 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		}
 		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: tile-accelerated %s %s (%s)",
 			r.Method, planeStr, parts[3], r.URL)
+	case "generate":
+		if action != "post" {
+			err := fmt.Errorf("Tile generation must be started with POST")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		configData, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		tileSpec, err := LoadTileSpec(configData)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		config := dvid.NewConfig()
+		query := r.URL.Query()
+		for _, key := range []string{"planes", "workers", "iorate"} {
+			if value := query.Get(key); value != "" {
+				config.Set(key, value)
+			}
+		}
+		job, err := d.StartTiles(string(uuid), tileSpec, config)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		server.JobStarted(w, r, job)
 	default:
 		err := fmt.Errorf("Illegal request for multiscale2d data.  See 'help' for REST API")
 		server.BadRequest(w, r, err.Error())
@@ -549,7 +599,7 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 // GetImage returns an image given a 2d orthogonal image description.  Since multiscale2ds
 // have precomputed XY, XZ, and YZ orientations, reconstruction of the desired image should
 // be much faster than computing the image from voxel blocks.
-func (d *Data) GetImage(uuid dvid.UUID, geom dvid.Geometry, isotropic bool) (*dvid.Image, error) {
+func (d *Data) GetImage(ctx context.Context, uuid dvid.UUID, geom dvid.Geometry, isotropic bool) (*dvid.Image, error) {
 	// Iterate through tiles that intersect our geometry.
 	levelSpec, found := d.Levels[0]
 	if !found {
@@ -560,7 +610,7 @@ func (d *Data) GetImage(uuid dvid.UUID, geom dvid.Geometry, isotropic bool) (*dv
 	if err != nil {
 		return nil, err
 	}
-	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+	versions, err := server.DatastoreService().DataVersions(uuid, d.DataName())
 	if err != nil {
 		return nil, err
 	}
@@ -603,9 +653,9 @@ func (d *Data) GetImage(uuid dvid.UUID, geom dvid.Geometry, isotropic bool) (*dv
 			go func(x0, y0, x1, y1 int32) {
 				// Get this tile from datastore
 				tileCoord, err := slice.PlaneToChunkPoint3d(x0, y0, minSlice.StartPoint(), levelSpec.TileSize)
-				tileIndex := NewIndexTile(dvid.IndexZYX(tileCoord), slice, Scaling(0))
+				tileIndex := dvid.NewIndexTile(dvid.IndexZYX(tileCoord), slice, 0)
 				// Get the PNG
-				data, err := d.getTile(versionID, tileIndex)
+				data, err := d.getTile(versions, tileIndex)
 				if err != nil {
 					return
 				}
@@ -645,7 +695,7 @@ func (d *Data) GetImage(uuid dvid.UUID, geom dvid.Geometry, isotropic bool) (*dv
 
 // GetTile retrieves a tile in PNG format.
 func (d *Data) GetTile(uuid dvid.UUID, planeStr, scalingStr, coordStr string) ([]byte, error) {
-	_, versionID, err := server.DatastoreService().LocalIDFromUUID(uuid)
+	versions, err := server.DatastoreService().DataVersions(uuid, d.DataName())
 	if err != nil {
 		return nil, err
 	}
@@ -665,13 +715,13 @@ func (d *Data) GetTile(uuid dvid.UUID, planeStr, scalingStr, coordStr string) ([
 		return nil, fmt.Errorf("Illegal tile coordinate: %s (%s)", coordStr, err.Error())
 	}
 	indexZYX := dvid.IndexZYX{tileCoord.Value(0), tileCoord.Value(1), tileCoord.Value(2)}
-	index := &IndexTile{indexZYX, shape, Scaling(scaling)}
+	index := dvid.NewIndexTile(indexZYX, shape, uint8(scaling))
 
-	return d.getTile(versionID, index)
+	return d.getTile(versions, index)
 }
 
 // Returns PNG data for tile without decompression.
-func (d *Data) getTile(versionID dvid.VersionLocalID, index *IndexTile) ([]byte, error) {
+func (d *Data) getTile(versions []dvid.VersionLocalID, index *dvid.IndexTile) ([]byte, error) {
 	if d.Levels == nil {
 		return nil, fmt.Errorf("Tiles have not been generated.")
 	}
@@ -680,9 +730,8 @@ func (d *Data) getTile(versionID dvid.VersionLocalID, index *IndexTile) ([]byte,
 		return nil, err
 	}
 
-	// Retrieve the tile from datastore
-	key := &datastore.DataKey{d.DatasetID(), d.ID, versionID, index}
-	data, err := db.Get(key)
+	// Retrieve the tile from datastore, including tiles inherited from ancestor versions.
+	data, err := datastore.GetVersionedValue(db, *d.DataID, versions, index)
 	if err != nil {
 		return nil, fmt.Errorf("Error trying to GET from datastore: %s", err.Error())
 	}
@@ -690,14 +739,14 @@ func (d *Data) getTile(versionID dvid.VersionLocalID, index *IndexTile) ([]byte,
 }
 
 // Return an image or a placeholder image.
-func (d *Data) getTileImage(pngData []byte, src *voxels.Data, plane dvid.DataShape, index *IndexTile) (image.Image, error) {
+func (d *Data) getTileImage(pngData []byte, src *voxels.Data, plane dvid.DataShape, index *dvid.IndexTile) (image.Image, error) {
 	if pngData == nil {
 		if d.Placeholder {
-			scaleSpec, ok := d.Levels[index.scaling]
+			scaleSpec, ok := d.Levels[Scaling(index.Scale)]
 			if !ok {
-				return nil, fmt.Errorf("Could not find tile specification at given scale %d", index.scaling)
+				return nil, fmt.Errorf("Could not find tile specification at given scale %d", index.Scale)
 			}
-			message := fmt.Sprintf("%s Tile coord %s @ scale %d", plane, index, index.scaling)
+			message := fmt.Sprintf("%s Tile coord %s @ scale %d", plane, index, index.Scale)
 			return dvid.PlaceholderImage(plane, scaleSpec.TileSize, message)
 		}
 		return nil, nil // Not found
@@ -730,7 +779,7 @@ func log2(value int32) uint8 {
 	}
 }
 
-type outFunc func(index *IndexTile, img *dvid.Image) error
+type outFunc func(index *dvid.IndexTile, img *dvid.Image) error
 
 // Construct all tiles for an image with offset and send to out function.  extractTiles assumes
 // the image and offset are in the XY plane.
@@ -765,7 +814,7 @@ func (d *Data) extractTiles(v voxels.ExtHandler, offset dvid.Point, scaling Scal
 			}
 			tileCoord, err := v.DataShape().PlaneToChunkPoint3d(x0, y0, offset, levelSpec.TileSize)
 			// fmt.Printf("Tile Coord: %s > %s\n", tileCoord, tileRect)
-			tileIndex := NewIndexTile(dvid.IndexZYX(tileCoord), v.DataShape(), scaling)
+			tileIndex := dvid.NewIndexTile(dvid.IndexZYX(tileCoord), v.DataShape(), uint8(scaling))
 			if err = outF(tileIndex, tile); err != nil {
 				return err
 			}
@@ -776,37 +825,113 @@ func (d *Data) extractTiles(v voxels.ExtHandler, offset dvid.Point, scaling Scal
 	return nil
 }
 
-// Returns function that stores a tile as an optionally compressed PNG image.
-func (d *Data) putTileFunc(versionID dvid.VersionLocalID) (outFunc, error) {
+// Returns function that stores a tile as an optionally compressed PNG image.  Writes are
+// throttled by the job.
+func (d *Data) putTileFunc(versionID dvid.VersionLocalID, job *datastore.Job) (outFunc, error) {
 	db, err := server.KeyValueSetter()
 	if err != nil {
 		return nil, err
 	}
-	return func(index *IndexTile, tile *dvid.Image) error {
+	return func(index *dvid.IndexTile, tile *dvid.Image) error {
 		pngData, err := tile.GetPNG()
 		if err != nil {
 			return err
 		}
+		job.Throttle(len(pngData))
 		key := &datastore.DataKey{d.DatasetID(), d.ID, versionID, index}
 		return db.Put(key, pngData)
 	}, nil
 }
 
+// tileSlice generates tiles at all scales for one slice of the source voxels.
+func (d *Data) tileSlice(uuid dvid.UUID, versionID dvid.VersionLocalID, src *voxels.Data, tileSpec TileSpec,
+	plane dvid.DataShape, offset dvid.Point, size dvid.Point2d, job *datastore.Job) error {
+
+	sliceTime := time.Now()
+	slice, err := dvid.NewOrthogSlice(plane, offset, size)
+	if err != nil {
+		return err
+	}
+	v, err := src.NewExtHandler(slice, nil)
+	if err != nil {
+		return err
+	}
+	if err = voxels.GetVoxels(job.Context(), uuid, src, v); err != nil {
+		return err
+	}
+	job.Throttle(len(v.Data()))
+
+	// Iterate through the different scales, extracting tiles at each resolution.
+	for scaling, levelSpec := range tileSpec {
+		outF, err := d.putTileFunc(versionID, job)
+		if err != nil {
+			return err
+		}
+		if err := d.extractTiles(v, offset, scaling, outF); err != nil {
+			return err
+		}
+		if int(scaling) < len(tileSpec)-1 {
+			if err := v.DownRes(levelSpec.levelMag); err != nil {
+				return err
+			}
+		}
+	}
+	dvid.ElapsedTime(dvid.Debug, sliceTime, "Tiled %s @ %s", plane, offset)
+	return nil
+}
+
+// DefaultTilingMemory is the most voxel memory used at once by slices being tiled if the
+// server has no memory budget for voxel requests.
+const DefaultTilingMemory = 1 << 30
+
+// maxTilingSlices returns the number of slices with the given bytes of voxels that can
+// be tiled at once within the server's memory budget.  Each slice is counted twice
+// since downsampling copies it, and at least one slice can always be tiled.
+func maxTilingSlices(sliceBytes int64) int {
+	budget := voxels.MemoryBudget
+	if budget <= 0 {
+		budget = DefaultTilingMemory
+	}
+	if sliceBytes <= 0 || 2*sliceBytes >= budget {
+		return 1
+	}
+	return int(budget / (2 * sliceBytes))
+}
+
+// ConstructTiles generates tiles for the planes given in the config as a background job
+// and waits for it to finish.  The job's workers, each tiling a slice, and I/O rate can
+// be limited with the "workers" and "iorate" settings.
 func (d *Data) ConstructTiles(uuidStr string, tileSpec TileSpec, config dvid.Config) error {
+	job, err := d.StartTiles(uuidStr, tileSpec, config)
+	if err != nil {
+		return err
+	}
+	<-job.Done()
+	_, err = job.Result()
+	return err
+}
+
+// StartTiles starts a background job generating tiles for the planes given in the
+// config and returns the job, which reports the fraction of slices tiled.
+func (d *Data) StartTiles(uuidStr string, tileSpec TileSpec, config dvid.Config) (*datastore.Job, error) {
+	limits, err := datastore.JobLimitsFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
 
 	// Save the current tile specification
 	service := server.DatastoreService()
 	uuid, _, versionID, err := service.NodeIDFromString(uuidStr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	d.Levels = tileSpec
 	if err := service.SaveDataset(uuid); err != nil {
-		return err
+		return nil, err
 	}
 	src, err := getSourceVoxels(uuid, d.Source)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Expand min and max points to coincide with full tile boundaries of highest resolution.
@@ -823,133 +948,59 @@ func (d *Data) ConstructTiles(uuidStr string, tileSpec TileSpec, config dvid.Con
 		// If no planes are specified, construct multiscale2d for 3 orthogonal planes.
 		planes = []dvid.DataShape{dvid.XY, dvid.XZ, dvid.YZ}
 	}
-
+	// Get the axis along which each plane's slices are stacked.
+	var tiled []dvid.DataShape
+	var axes []uint8
+	var numSlices int64
 	for _, plane := range planes {
-		startTime := time.Now()
-		offset := minPt.Duplicate()
-
+		var axis uint8
 		switch {
-
 		case plane.Equals(dvid.XY):
-			width, height, err := plane.GetSize2D(sizeVolume)
-			if err != nil {
-				return err
-			}
-			dvid.Log(dvid.Debug, "Tiling XY image %d x %d pixels\n", width, height)
-			for z := src.MinPoint.Value(2); z <= src.MaxPoint.Value(2); z++ {
-				sliceTime := time.Now()
-				offset = offset.Modify(map[uint8]int32{2: z})
-				slice, err := dvid.NewOrthogSlice(dvid.XY, offset, dvid.Point2d{width, height})
-				if err != nil {
-					return err
-				}
-				v, err := src.NewExtHandler(slice, nil)
-				if err != nil {
-					return err
-				}
-				if err = voxels.GetVoxels(uuid, src, v); err != nil {
-					return err
-				}
-				// Iterate through the different scales, extracting tiles at each resolution.
-				for scaling, levelSpec := range tileSpec {
-					outF, err := d.putTileFunc(versionID)
-					if err != nil {
-						return err
-					}
-					if err := d.extractTiles(v, offset, scaling, outF); err != nil {
-						return err
-					}
-					if int(scaling) < len(tileSpec)-1 {
-						if err := v.DownRes(levelSpec.levelMag); err != nil {
-							return err
-						}
-					}
-				}
-				dvid.ElapsedTime(dvid.Debug, sliceTime, "XY Tile @ Z = %d", z)
-			}
-			dvid.ElapsedTime(dvid.Normal, startTime, "Total time to generate XY Tiles")
-
+			axis = 2
 		case plane.Equals(dvid.XZ):
+			axis = 1
+		case plane.Equals(dvid.YZ):
+			axis = 0
+		default:
+			dvid.Log(dvid.Normal, "Skipping request to tile '%s'.  Unsupported.", plane)
+			continue
+		}
+		tiled = append(tiled, plane)
+		axes = append(axes, axis)
+		numSlices += int64(src.MaxPoint.Value(axis) - src.MinPoint.Value(axis) + 1)
+	}
+
+	name := fmt.Sprintf("tiles of '%s' at %s", d.DataName(), uuid)
+	job := datastore.RunJob("pyramid", name, limits, func(job *datastore.Job) (interface{}, error) {
+		job.SetTotal(numSlices)
+		for n, plane := range tiled {
+			startTime := time.Now()
+			axis := axes[n]
 			width, height, err := plane.GetSize2D(sizeVolume)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			dvid.Log(dvid.Debug, "Tiling XZ image %d x %d pixels\n", width, height)
-			for y := src.MinPoint.Value(1); y <= src.MaxPoint.Value(1); y++ {
-				sliceTime := time.Now()
-				offset = offset.Modify(map[uint8]int32{1: y})
-				slice, err := dvid.NewOrthogSlice(dvid.XZ, offset, dvid.Point2d{width, height})
-				if err != nil {
-					return err
-				}
-				v, err := src.NewExtHandler(slice, nil)
-				if err != nil {
-					return err
-				}
-				if err = voxels.GetVoxels(uuid, src, v); err != nil {
-					return err
-				}
-				// Iterate through the different scales, extracting tiles at each resolution.
-				for scaling, levelSpec := range tileSpec {
-					outF, err := d.putTileFunc(versionID)
-					if err != nil {
-						return err
-					}
-					if err := d.extractTiles(v, offset, scaling, outF); err != nil {
-						return err
-					}
-					if int(scaling) < len(tileSpec)-1 {
-						if err := v.DownRes(levelSpec.levelMag); err != nil {
-							return err
-						}
-					}
-				}
-				dvid.ElapsedTime(dvid.Debug, sliceTime, "XZ Tile @ Y = %d", y)
+			dvid.Log(dvid.Debug, "Tiling %s of %d x %d pixels\n", plane, width, height)
+			sliceBytes := int64(width) * int64(height) * int64(src.Values().BytesPerElement())
+			slices := make(chan struct{}, maxTilingSlices(sliceBytes))
+			for pos := src.MinPoint.Value(axis); pos <= src.MaxPoint.Value(axis); pos++ {
+				offset := minPt.Modify(map[uint8]int32{axis: pos})
+				job.Go(func() error {
+					defer job.Advance(1)
+					slices <- struct{}{}
+					defer func() { <-slices }()
+					return d.tileSlice(uuid, versionID, src, tileSpec, plane, offset, dvid.Point2d{width, height}, job)
+				})
 			}
-			dvid.ElapsedTime(dvid.Normal, startTime, "Total time to generate XZ Tiles")
-
-		case plane.Equals(dvid.YZ):
-			width, height, err := plane.GetSize2D(sizeVolume)
+			err = job.Wait()
+			service.Invalidate(d, uuid, nil)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			dvid.Log(dvid.Debug, "Tiling YZ image %d x %d pixels\n", width, height)
-			for x := src.MinPoint.Value(0); x <= src.MaxPoint.Value(0); x++ {
-				sliceTime := time.Now()
-				offset = offset.Modify(map[uint8]int32{0: x})
-				slice, err := dvid.NewOrthogSlice(dvid.YZ, offset, dvid.Point2d{width, height})
-				if err != nil {
-					return err
-				}
-				v, err := src.NewExtHandler(slice, nil)
-				if err != nil {
-					return err
-				}
-				if err = voxels.GetVoxels(uuid, src, v); err != nil {
-					return err
-				}
-				// Iterate through the different scales, extracting tiles at each resolution.
-				for scaling, levelSpec := range tileSpec {
-					outF, err := d.putTileFunc(versionID)
-					if err != nil {
-						return err
-					}
-					if err := d.extractTiles(v, offset, scaling, outF); err != nil {
-						return err
-					}
-					if int(scaling) < len(tileSpec)-1 {
-						if err := v.DownRes(levelSpec.levelMag); err != nil {
-							return err
-						}
-					}
-				}
-				dvid.ElapsedTime(dvid.Debug, sliceTime, "YZ Tile @ X = %d", x)
-			}
-			dvid.ElapsedTime(dvid.Normal, startTime, "Total time to generate YZ Tiles")
-
-		default:
-			dvid.Log(dvid.Normal, "Skipping request to tile '%s'.  Unsupported.", plane)
+			job.Logf("Generated tiles for %s", plane)
+			dvid.ElapsedTime(dvid.Normal, startTime, "Total time to generate tiles for %s", plane)
 		}
-	}
-	return nil
+		return nil, nil
+	})
+	return job, nil
 }
@@ -0,0 +1,252 @@
+/*
+	This file supports estimation of the cost of voxel requests and budgets that
+	abort requests predicted to exceed caller-specified limits.  Costs are estimated
+	only for reads and writes of voxels within a geometry, e.g., slices and subvolumes,
+	and not for stats, exports, or other computations derived from stored data.  The
+	server can also limit the memory of each request and of all requests handled at
+	once, so a burst of large subvolume requests cannot exhaust memory.
+*/
+
+package voxels
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+var (
+	// MaxRequestBytes is the most uncompressed block memory one voxel request may use.
+	// If 0, the memory of a request is not limited.
+	MaxRequestBytes int64
+
+	// MemoryBudget is the total uncompressed block memory of voxel requests handled at
+	// once.  Requests wait briefly for memory to be released.  If 0, it is not limited.
+	MemoryBudget int64
+)
+
+// DefaultBlocksPerSecond is the assumed block processing rate before any voxel
+// requests have been timed by this server.
+const DefaultBlocksPerSecond = 2000.0
+
+// Cost is an estimate of the resources required to process a voxel request.
+type Cost struct {
+	// Blocks is the number of blocks that intersect the requested geometry.
+	Blocks int
+
+	// Bytes is the number of uncompressed block bytes that will be processed.
+	Bytes int64
+
+	// Seconds is the predicted processing time based on recently observed throughput.
+	Seconds float64
+}
+
+// Budget sets limits on the cost of a request.  Zero values mean no limit.
+type Budget struct {
+	MaxBlocks  int
+	MaxBytes   int64
+	MaxSeconds float64
+}
+
+// BudgetError is returned when the cost of a request exceeds its budget.
+type BudgetError struct {
+	message string
+}
+
+func (e *BudgetError) Error() string {
+	return e.message
+}
+
+// Check returns a *BudgetError if the given cost exceeds the budget.
+func (b Budget) Check(c Cost) error {
+	if b.MaxBlocks > 0 && c.Blocks > b.MaxBlocks {
+		return &BudgetError{fmt.Sprintf("Request requires %d blocks, exceeding budget of %d blocks",
+			c.Blocks, b.MaxBlocks)}
+	}
+	if b.MaxBytes > 0 && c.Bytes > b.MaxBytes {
+		return &BudgetError{fmt.Sprintf("Request requires %d bytes, exceeding budget of %d bytes",
+			c.Bytes, b.MaxBytes)}
+	}
+	if b.MaxSeconds > 0 && c.Seconds > b.MaxSeconds {
+		return &BudgetError{fmt.Sprintf("Request predicted to take %.2f seconds, exceeding budget of %.2f seconds",
+			c.Seconds, b.MaxSeconds)}
+	}
+	return nil
+}
+
+// BudgetFailed replies to a request that failed a budget check.  A request exceeding
+// its budget gets a 503 (Service Unavailable) since its predicted time depends on the
+// load of the server, while a malformed budget gets a 400 (Bad Request).
+func BudgetFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if _, exceeded := err.(*BudgetError); exceeded {
+		server.Unavailable(w, r, err.Error(), server.ShedWait)
+		return
+	}
+	server.BadRequest(w, r, err.Error())
+}
+
+// BudgetFromRequest returns a Budget from the optional "maxblocks", "maxbytes", and
+// "maxseconds" query strings of an HTTP request.
+func BudgetFromRequest(r *http.Request) (budget Budget, err error) {
+	query := r.URL.Query()
+	if s := query.Get("maxblocks"); s != "" {
+		if budget.MaxBlocks, err = strconv.Atoi(s); err != nil {
+			return budget, fmt.Errorf("Illegal maxblocks '%s': %s", s, err.Error())
+		}
+	}
+	if s := query.Get("maxbytes"); s != "" {
+		if budget.MaxBytes, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return budget, fmt.Errorf("Illegal maxbytes '%s': %s", s, err.Error())
+		}
+	}
+	if s := query.Get("maxseconds"); s != "" {
+		if budget.MaxSeconds, err = strconv.ParseFloat(s, 64); err != nil {
+			return budget, fmt.Errorf("Illegal maxseconds '%s': %s", s, err.Error())
+		}
+	}
+	return budget, nil
+}
+
+// EstimateCost returns the predicted cost of reading or writing the given geometry.
+func EstimateCost(i IntHandler, geom dvid.Geometry) Cost {
+	blockSize := i.BlockSize()
+	numBlocks := dvid.GetNumBlocks(geom, blockSize)
+	blockBytes := int64(i.Values().BytesPerElement())
+	for dim := uint8(0); dim < blockSize.NumDims(); dim++ {
+		blockBytes *= int64(blockSize.Value(dim))
+	}
+	return Cost{
+		Blocks:  numBlocks,
+		Bytes:   int64(numBlocks) * blockBytes,
+		Seconds: float64(numBlocks) / BlocksPerSecond(),
+	}
+}
+
+// CheckRequestBudget returns an error if the predicted cost of reading or writing the
+// voxels of the geometry exceeds any budget given in the HTTP request's query strings.
+// Handlers of voxel requests call it before processing; other requests are not budgeted.
+func CheckRequestBudget(i IntHandler, geom dvid.Geometry, r *http.Request) error {
+	budget, err := BudgetFromRequest(r)
+	if err != nil {
+		return err
+	}
+	return budget.Check(EstimateCost(i, geom))
+}
+
+// memory tracks the block memory reserved by requests in progress.  The released
+// channel is closed and replaced whenever memory is released.
+var memory struct {
+	sync.Mutex
+	reserved int64
+	released chan struct{}
+}
+
+// ReserveMemory reserves the predicted memory of a request against MaxRequestBytes and
+// MemoryBudget, waiting up to the server's shed wait for other requests to release
+// memory.  If the memory cannot be reserved, a 503 reply is sent and ok is false.
+// Otherwise the returned function must be called to release the memory.
+func ReserveMemory(w http.ResponseWriter, r *http.Request, cost Cost) (release func(), ok bool) {
+	if MaxRequestBytes > 0 && cost.Bytes > MaxRequestBytes {
+		server.Unavailable(w, r, fmt.Sprintf("request requires %d bytes, more than the server's limit "+
+			"of %d bytes per request; use smaller or tiled requests", cost.Bytes, MaxRequestBytes), server.ShedWait)
+		return nil, false
+	}
+	if MemoryBudget <= 0 {
+		return func() {}, true
+	}
+	timer := time.NewTimer(server.ShedWait)
+	defer timer.Stop()
+	for {
+		memory.Lock()
+		// A request larger than the budget can still run alone.
+		if memory.reserved == 0 || memory.reserved+cost.Bytes <= MemoryBudget {
+			memory.reserved += cost.Bytes
+			memory.Unlock()
+			return func() { releaseMemory(cost.Bytes) }, true
+		}
+		if memory.released == nil {
+			memory.released = make(chan struct{})
+		}
+		released := memory.released
+		memory.Unlock()
+
+		select {
+		case <-released:
+		case <-r.Context().Done():
+			return nil, false
+		case <-timer.C:
+			server.Unavailable(w, r, fmt.Sprintf("server is at its limit of %d bytes for requests in progress",
+				MemoryBudget), server.ShedWait)
+			return nil, false
+		}
+	}
+}
+
+func releaseMemory(bytes int64) {
+	memory.Lock()
+	memory.reserved -= bytes
+	if memory.released != nil {
+		close(memory.released)
+		memory.released = nil
+	}
+	memory.Unlock()
+}
+
+// EstimateFromStrings returns the predicted cost of a request given URL strings for
+// the shape, size, and offset of the requested voxels.
+func EstimateFromStrings(i IntHandler, shapeStr, sizeStr, offsetStr string) (Cost, error) {
+	planeStr := dvid.DataShapeString(shapeStr)
+	plane, err := planeStr.DataShape()
+	if err != nil {
+		return Cost{}, err
+	}
+	var geom dvid.Geometry
+	switch plane.ShapeDimensions() {
+	case 2:
+		geom, err = dvid.NewSliceFromStrings(planeStr, offsetStr, sizeStr, "_")
+	case 3:
+		geom, err = dvid.NewSubvolumeFromStrings(offsetStr, sizeStr, "_")
+	default:
+		err = fmt.Errorf("DVID currently supports shapes of only 2 and 3 dimensions")
+	}
+	if err != nil {
+		return Cost{}, err
+	}
+	return EstimateCost(i, geom), nil
+}
+
+var throughput struct {
+	sync.Mutex
+	blocksPerSec float64
+}
+
+// BlocksPerSecond returns a moving average of block processing throughput observed
+// by voxel GETs, or DefaultBlocksPerSecond if no requests have been timed.
+func BlocksPerSecond() float64 {
+	throughput.Lock()
+	defer throughput.Unlock()
+	if throughput.blocksPerSec == 0 {
+		return DefaultBlocksPerSecond
+	}
+	return throughput.blocksPerSec
+}
+
+// recordThroughput adds a timed request to the moving average of block throughput.
+func recordThroughput(numBlocks int, elapsed time.Duration) {
+	if numBlocks == 0 || elapsed <= 0 {
+		return
+	}
+	rate := float64(numBlocks) / elapsed.Seconds()
+	throughput.Lock()
+	if throughput.blocksPerSec == 0 {
+		throughput.blocksPerSec = rate
+	} else {
+		throughput.blocksPerSec = 0.8*throughput.blocksPerSec + 0.2*rate
+	}
+	throughput.Unlock()
+}
@@ -0,0 +1,210 @@
+/*
+	This file supports coverage maps that describe which blocks of voxels data are stored,
+	so clients can avoid requesting empty regions and ingest tools can verify completeness.
+*/
+
+package voxels
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// MaxCoverageBits is the largest number of bits returned in coverage bitmasks.
+const MaxCoverageBits = 64 * dvid.Mega
+
+// CoverageSlab describes the stored blocks at one block Z coordinate.  Exactly one of
+// Runs or Bitmask is set depending on the requested format.
+type CoverageSlab struct {
+	Z         int32
+	NumBlocks int
+
+	// Runs are the stored blocks as [y, first x, last x] runs along the x axis.
+	Runs [][3]int32 `json:",omitempty"`
+
+	// Bitmask has a bit for each block within the coverage's x and y block extents
+	// with x changing fastest and the first block in the least significant bit.
+	Bitmask []byte `json:",omitempty"`
+}
+
+// Coverage describes the blocks stored for voxels data at a time point, with extents
+// coalesced from the stored blocks.
+type Coverage struct {
+	Format    string
+	BlockSize dvid.Point
+	NumBlocks int
+	MinBlock  dvid.ChunkPoint3d
+	MaxBlock  dvid.ChunkPoint3d
+	MinPoint  dvid.Point
+	MaxPoint  dvid.Point
+	Slabs     []CoverageSlab
+}
+
+type coverageBlocks []dvid.ChunkPoint3d
+
+func (c coverageBlocks) Len() int      { return len(c) }
+func (c coverageBlocks) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c coverageBlocks) Less(i, j int) bool {
+	if c[i][2] != c[j][2] {
+		return c[i][2] < c[j][2]
+	}
+	if c[i][1] != c[j][1] {
+		return c[i][1] < c[j][1]
+	}
+	return c[i][0] < c[j][0]
+}
+
+// StoredBlocks returns the coordinates of all blocks stored for a version at a time
+// point, including blocks inherited from ancestor versions, sorted by z, then y, then x.
+func (d *Data) StoredBlocks(uuid dvid.UUID, t int32) ([]dvid.ChunkPoint3d, error) {
+	db, err := server.KeyValueGetter()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := server.DatastoreService().DataVersions(uuid, d.DataName())
+	if err != nil {
+		return nil, err
+	}
+	dataID := d.DataID()
+	decoder := d.IndexScheme.ChunkIndex(dvid.ChunkPoint3d{})
+	var blocks coverageBlocks
+	found := make(map[string]bool)
+	for _, versionID := range versions {
+		minKey := &datastore.DataKey{
+			Dataset: dataID.DsetID,
+			Data:    dataID.ID,
+			Version: versionID,
+			Index:   dvid.IndexBytes{},
+		}
+		maxKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID, Version: versionID + 1}
+		keys, err := db.KeysInRange(context.Background(), minKey, maxKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			dataKey, ok := key.(*datastore.DataKey)
+			if !ok || dataKey.Version != versionID || dataKey.Index == nil {
+				continue
+			}
+			if found[string(dataKey.Index.Bytes())] {
+				continue
+			}
+			found[string(dataKey.Index.Bytes())] = true
+			index, err := decoder.IndexFromBytes(dataKey.Index.Bytes())
+			if err != nil {
+				return nil, fmt.Errorf("Unable to decode block index of '%s': %s", d.DataName(), err.Error())
+			}
+			if timed, ok := index.(*dvid.IndexTZYX); ok && timed.Time != t {
+				continue
+			}
+			indexer, ok := index.(dvid.ChunkIndexer)
+			if !ok {
+				return nil, fmt.Errorf("Block index of '%s' is not a ChunkIndexer", d.DataName())
+			}
+			blocks = append(blocks, dvid.ChunkPoint3d{indexer.Value(0), indexer.Value(1), indexer.Value(2)})
+		}
+	}
+	sort.Sort(blocks)
+	return blocks, nil
+}
+
+// GetCoverage returns the coverage of the blocks stored for a version at a time point.
+// The format is "rle" for runs of blocks along x or "bitmask" for a bitmask per slab.
+func (d *Data) GetCoverage(uuid dvid.UUID, t int32, format string) (*Coverage, error) {
+	if format != "rle" && format != "bitmask" {
+		return nil, fmt.Errorf("Coverage format must be 'rle' or 'bitmask', not '%s'", format)
+	}
+	blocks, err := d.StoredBlocks(uuid, t)
+	if err != nil {
+		return nil, err
+	}
+	coverage := &Coverage{Format: format, BlockSize: d.BlockSize(), NumBlocks: len(blocks)}
+	if len(blocks) == 0 {
+		return coverage, nil
+	}
+	coverage.MinBlock = dvid.ChunkPoint3d{math.MaxInt32, math.MaxInt32, math.MaxInt32}
+	coverage.MaxBlock = dvid.ChunkPoint3d{math.MinInt32, math.MinInt32, math.MinInt32}
+	for _, block := range blocks {
+		for dim := 0; dim < 3; dim++ {
+			if block[dim] < coverage.MinBlock[dim] {
+				coverage.MinBlock[dim] = block[dim]
+			}
+			if block[dim] > coverage.MaxBlock[dim] {
+				coverage.MaxBlock[dim] = block[dim]
+			}
+		}
+	}
+	coverage.MinPoint = coverage.MinBlock.MinPoint(coverage.BlockSize)
+	coverage.MaxPoint = coverage.MaxBlock.MaxPoint(coverage.BlockSize)
+
+	width := int64(coverage.MaxBlock[0] - coverage.MinBlock[0] + 1)
+	height := int64(coverage.MaxBlock[1] - coverage.MinBlock[1] + 1)
+	if format == "bitmask" {
+		numSlabs := int64(coverage.MaxBlock[2] - coverage.MinBlock[2] + 1)
+		if width*height*numSlabs > MaxCoverageBits {
+			return nil, fmt.Errorf("Coverage bitmask of %d x %d x %d blocks is too large: use 'rle' format",
+				width, height, numSlabs)
+		}
+	}
+
+	var slab *CoverageSlab
+	for _, block := range blocks {
+		if slab == nil || slab.Z != block[2] {
+			coverage.Slabs = append(coverage.Slabs, CoverageSlab{Z: block[2]})
+			slab = &coverage.Slabs[len(coverage.Slabs)-1]
+			if format == "bitmask" {
+				slab.Bitmask = make([]byte, (width*height+7)/8)
+			}
+		}
+		slab.NumBlocks++
+		if format == "bitmask" {
+			bit := int64(block[1]-coverage.MinBlock[1])*width + int64(block[0]-coverage.MinBlock[0])
+			slab.Bitmask[bit/8] |= 1 << uint(bit%8)
+			continue
+		}
+		last := len(slab.Runs) - 1
+		if last >= 0 && slab.Runs[last][0] == block[1] && slab.Runs[last][2]+1 == block[0] {
+			slab.Runs[last][2] = block[0]
+		} else {
+			slab.Runs = append(slab.Runs, [3]int32{block[1], block[0], block[0]})
+		}
+	}
+	return coverage, nil
+}
+
+// DecodeIndex returns the block index of a stored index so stats of voxels data can
+// count blocks and their extents.
+func (d *Data) DecodeIndex(index []byte) (dvid.Index, error) {
+	return d.IndexScheme.ChunkIndex(dvid.ChunkPoint3d{}).IndexFromBytes(index)
+}
+
+// SerializedIndex returns true if a stored index is a block index, whose value is a
+// serialized block, so migrations can upgrade the envelopes of blocks.
+func (d *Data) SerializedIndex(index []byte) bool {
+	decoded, err := d.DecodeIndex(index)
+	return err == nil && decoded != nil && bytes.Equal(decoded.Bytes(), index)
+}
+
+// IndexRange returns the z-slab of blocks, and the time point for timed data, holding a
+// stored block index so key profiles of voxels data are grouped by slab.
+func (d *Data) IndexRange(index []byte) (string, error) {
+	decoded, err := d.DecodeIndex(index)
+	if err != nil {
+		return "", err
+	}
+	indexer, ok := decoded.(dvid.ChunkIndexer)
+	if !ok {
+		return "", fmt.Errorf("Block index of '%s' is not a ChunkIndexer", d.DataName())
+	}
+	if timed, ok := decoded.(*dvid.IndexTZYX); ok {
+		return fmt.Sprintf("t %d, block z %d", timed.Time, indexer.Value(2)), nil
+	}
+	return fmt.Sprintf("block z %d", indexer.Value(2)), nil
+}
@@ -1,7 +1,16 @@
 package voxels
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"testing"
+	"time"
+
 	. "github.com/janelia-flyem/go/gocheck"
 
 	"github.com/janelia-flyem/dvid/datastore"
@@ -149,14 +158,14 @@ func (suite *TestSuite) TestSubvolGrayscale8(c *C) {
 	v, err := grayscale.NewExtHandler(subvol, data)
 	c.Assert(err, IsNil)
 
-	err = PutVoxels(root, grayscale, v)
+	err = PutVoxels(context.Background(), root, grayscale, v)
 	c.Assert(err, IsNil)
 	c.Assert(v.NumVoxels(), Equals, int64(len(origData)))
 
 	// Read the stored image
 	v2, err := grayscale.NewExtHandler(subvol, nil)
 	c.Assert(err, IsNil)
-	err = GetVoxels(root, grayscale, v2)
+	err = GetVoxels(context.Background(), root, grayscale, v2)
 	c.Assert(err, IsNil)
 
 	// Make sure the retrieved image matches the original
@@ -175,6 +184,397 @@ func (suite *TestSuite) TestSubvolGrayscale8(c *C) {
 	}
 }
 
+func (suite *TestSuite) TestSubvolHilbert(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+
+	config := dvid.NewConfig()
+	config.Set("IndexScheme", "hilbert")
+	err = suite.service.NewData(root, "grayscale8", "hilbert", config)
+	c.Assert(err, IsNil)
+	dataservice, err := suite.service.DataServiceByUUID(root, "hilbert")
+	c.Assert(err, IsNil)
+	grayscale := dataservice.(*Data)
+	c.Assert(grayscale.IndexScheme, Equals, dvid.HilbertScheme)
+
+	// Write overlapping subvolumes so the second PUT merges with stored blocks.
+	offset := dvid.Point3d{5, 35, 61}
+	size := dvid.Point3d{100, 100, 100}
+	subvol := dvid.NewSubvolume(offset, size)
+	expected := MakeVolume(offset, size)
+	v, err := grayscale.NewExtHandler(subvol, MakeVolume(offset, size))
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	offset2 := dvid.Point3d{50, 60, 70}
+	size2 := dvid.Point3d{40, 40, 40}
+	data2 := make([]byte, size2[0]*size2[1]*size2[2])
+	for i := range data2 {
+		data2[i] = 0xFF
+	}
+	v, err = grayscale.NewExtHandler(dvid.NewSubvolume(offset2, size2), data2)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+	for z := offset2[2]; z < offset2[2]+size2[2]; z++ {
+		for y := offset2[1]; y < offset2[1]+size2[1]; y++ {
+			for x := offset2[0]; x < offset2[0]+size2[0]; x++ {
+				i := ((z-offset[2])*size[1]+(y-offset[1]))*size[0] + x - offset[0]
+				expected[i] = 0xFF
+			}
+		}
+	}
+
+	v2, err := grayscale.NewExtHandler(subvol, nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(context.Background(), root, grayscale, v2), IsNil)
+	data := v2.Data()
+	for i := range expected {
+		if data[i] != expected[i] {
+			c.Fatalf("GET subvol != PUT subvols @ index %d", i)
+		}
+	}
+
+	err = grayscale.ModifyConfig(config)
+	c.Assert(err, NotNil)
+}
+
+func (suite *TestSuite) TestSubvolTimes(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+
+	config := dvid.NewConfig()
+	config.Set("IndexScheme", "tzyx")
+	err = suite.service.NewData(root, "grayscale8", "timelapse", config)
+	c.Assert(err, IsNil)
+	dataservice, err := suite.service.DataServiceByUUID(root, "timelapse")
+	c.Assert(err, IsNil)
+	grayscale := dataservice.(*Data)
+
+	// Write a different constant subvolume for each of three time points.
+	subvol := dvid.NewSubvolume(dvid.Point3d{10, 20, 30}, dvid.Point3d{40, 40, 40})
+	numVoxels := int(subvol.NumVoxels())
+	for t := int32(0); t < 3; t++ {
+		data := make([]byte, numVoxels)
+		for i := range data {
+			data[i] = byte(t + 1)
+		}
+		v, err := grayscale.NewTimedExtHandler(subvol, data, t)
+		c.Assert(err, IsNil)
+		c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+	}
+
+	data, err := grayscale.GetTimeVolumes(context.Background(), root, subvol, TimeRange{1, 3})
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 3*numVoxels)
+	for n, expected := range []byte{2, 3, 0} {
+		volume := data[n*numVoxels : (n+1)*numVoxels]
+		for i := range volume {
+			if volume[i] != expected {
+				c.Fatalf("Time %d has value %d @ index %d, expected %d", n+1, volume[i], i, expected)
+			}
+		}
+	}
+
+	times, err := TimeRangeFromString("-2:5")
+	c.Assert(err, IsNil)
+	c.Assert(times, Equals, TimeRange{-2, 5})
+	_, err = TimeRangeFromString("5:2")
+	c.Assert(err, NotNil)
+}
+
+func (suite *TestSuite) TestCoverage(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "coverage")
+	blockSize := grayscale.BlockSize().Value(0)
+
+	put := func(offset, size dvid.Point3d) {
+		v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), MakeVolume(offset, size))
+		c.Assert(err, IsNil)
+		c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+	}
+	put(dvid.Point3d{0, 0, 0}, dvid.Point3d{2 * blockSize, blockSize, blockSize})
+	put(dvid.Point3d{0, 2 * blockSize, blockSize}, dvid.Point3d{blockSize, blockSize, blockSize})
+
+	coverage, err := grayscale.GetCoverage(root, 0, "rle")
+	c.Assert(err, IsNil)
+	c.Assert(coverage.NumBlocks, Equals, 3)
+	c.Assert(coverage.MinBlock, Equals, dvid.ChunkPoint3d{0, 0, 0})
+	c.Assert(coverage.MaxBlock, Equals, dvid.ChunkPoint3d{1, 2, 1})
+	c.Assert(coverage.Slabs, HasLen, 2)
+	c.Assert(coverage.Slabs[0].Runs, DeepEquals, [][3]int32{{0, 0, 1}})
+	c.Assert(coverage.Slabs[1].Runs, DeepEquals, [][3]int32{{2, 0, 0}})
+
+	coverage, err = grayscale.GetCoverage(root, 0, "bitmask")
+	c.Assert(err, IsNil)
+	c.Assert(coverage.Slabs[0].Bitmask, DeepEquals, []byte{0x03})
+	c.Assert(coverage.Slabs[1].Bitmask, DeepEquals, []byte{0x10})
+
+	_, err = grayscale.GetCoverage(root, 0, "png")
+	c.Assert(err, NotNil)
+}
+
+func (suite *TestSuite) TestDeltaVersions(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "delta")
+	blockSize := grayscale.BlockSize().Value(0)
+
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{2 * blockSize, blockSize, blockSize}
+	subvol := dvid.NewSubvolume(offset, size)
+	v, err := grayscale.NewExtHandler(subvol, MakeVolume(offset, size))
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	c.Assert(suite.service.Lock(root), IsNil)
+	child, err := suite.service.NewVersion(root)
+	c.Assert(err, IsNil)
+
+	// Modify a few voxels of the first block in the child.
+	modOffset := dvid.Point3d{1, 1, 1}
+	modSize := dvid.Point3d{2, 2, 2}
+	modData := make([]byte, 8)
+	for i := range modData {
+		modData[i] = 255
+	}
+	v, err = grayscale.NewExtHandler(dvid.NewSubvolume(modOffset, modSize), modData)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), child, grayscale, v), IsNil)
+
+	get := func(uuid dvid.UUID) []byte {
+		v, err := grayscale.NewExtHandler(subvol, nil)
+		c.Assert(err, IsNil)
+		c.Assert(GetVoxels(context.Background(), uuid, grayscale, v), IsNil)
+		return v.Data()
+	}
+	expected := MakeVolume(offset, size)
+	c.Assert(get(root), DeepEquals, expected)
+	for z := int32(1); z < 3; z++ {
+		for y := int32(1); y < 3; y++ {
+			for x := int32(1); x < 3; x++ {
+				expected[(z*size[1]+y)*size[0]+x] = 255
+			}
+		}
+	}
+	c.Assert(get(child), DeepEquals, expected)
+
+	// Only the modified block is stored in the child.
+	_, childVersion, err := suite.service.LocalIDFromUUID(child)
+	c.Assert(err, IsNil)
+	dataID := grayscale.DataID()
+	db, err := server.KeyValueGetter()
+	c.Assert(err, IsNil)
+	minKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID, Version: childVersion, Index: dvid.IndexBytes{}}
+	maxKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID, Version: childVersion + 1}
+	keys, err := db.KeysInRange(context.Background(), minKey, maxKey)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+
+	coverage, err := grayscale.GetCoverage(child, 0, "rle")
+	c.Assert(err, IsNil)
+	c.Assert(coverage.NumBlocks, Equals, 2)
+
+	// Flattening copies the inherited block into the child.
+	numCopied, err := suite.service.FlattenVersion(child, "delta")
+	c.Assert(err, IsNil)
+	c.Assert(numCopied, Equals, 1)
+	versions, err := suite.service.DataVersions(child, "delta")
+	c.Assert(err, IsNil)
+	c.Assert(versions, DeepEquals, []dvid.VersionLocalID{childVersion})
+	c.Assert(get(child), DeepEquals, expected)
+}
+
+func (suite *TestSuite) TestRollbackExtents(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "rollback")
+	blockSize := grayscale.BlockSize().Value(0)
+
+	put := func(uuid dvid.UUID, offset, size dvid.Point3d) {
+		v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), MakeVolume(offset, size))
+		c.Assert(err, IsNil)
+		c.Assert(PutVoxels(context.Background(), uuid, grayscale, v), IsNil)
+	}
+	put(root, dvid.Point3d{2, 0, 0}, dvid.Point3d{blockSize, blockSize, blockSize})
+	c.Assert(suite.service.Lock(root), IsNil)
+	child, err := suite.service.NewVersion(root)
+	c.Assert(err, IsNil)
+	put(child, dvid.Point3d{3 * blockSize, 0, 0}, dvid.Point3d{blockSize, blockSize, blockSize})
+	extents := grayscale.Extents()
+	c.Assert(extents.MaxPoint.Value(0), Equals, 4*blockSize-1)
+	c.Assert(extents.MaxIndex.Value(0), Equals, int32(3))
+
+	// Rolling back the child shrinks the extents to the root's blocks, clipped by the
+	// voxels written.
+	numDeleted, err := suite.service.RollbackVersion(child, "rollback")
+	c.Assert(err, IsNil)
+	c.Assert(numDeleted, Equals, 1)
+	c.Assert(extents.MinIndex.Value(0), Equals, int32(0))
+	c.Assert(extents.MaxIndex.Value(0), Equals, int32(1))
+	c.Assert(extents.MinPoint.Value(0), Equals, int32(2))
+	c.Assert(extents.MaxPoint.Value(0), Equals, 2*blockSize-1)
+	c.Assert(extents.MaxPoint.Value(1), Equals, blockSize-1)
+}
+
+func (suite *TestSuite) TestCloneSubset(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "subset")
+	blockSize := grayscale.BlockSize().Value(0)
+	c.Assert(grayscale.MaximumExtents().Empty(), Equals, true)
+
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{2 * blockSize, blockSize, blockSize}
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), MakeVolume(offset, size))
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	block0 := dvid.IndexZYX{0, 0, 0}
+	block1 := dvid.IndexZYX{1, 0, 0}
+	c.Assert(grayscale.MaximumExtents().Contains(block1), Equals, true)
+	c.Assert(grayscale.AvailableExtents().Contains(block1), Equals, true)
+
+	minPt := dvid.Point3d{1, 1, 1}
+	maxPt := dvid.Point3d{blockSize - 1, blockSize - 1, blockSize - 1}
+	ranges, err := grayscale.SubsetIndices(minPt, maxPt)
+	c.Assert(err, IsNil)
+	c.Assert(ranges.Contains(block0), Equals, true)
+	c.Assert(ranges.Contains(block1), Equals, false)
+	_, err = grayscale.SubsetIndices(maxPt, minPt)
+	c.Assert(err, NotNil)
+
+	path := filepath.Join(c.MkDir(), "subset")
+	cloneRoot, err := suite.service.CloneSubset(root, path, "subset", minPt, maxPt)
+	c.Assert(err, IsNil)
+	clone, openErr := datastore.Open(path)
+	c.Assert(openErr, IsNil)
+	defer clone.Shutdown()
+	dataservice, err := clone.DataServiceByUUID(cloneRoot, "subset")
+	c.Assert(err, IsNil)
+	cloned := dataservice.(*Data)
+	c.Assert(cloned.MaximumExtents().Contains(block1), Equals, true)
+	c.Assert(cloned.AvailableExtents().Contains(block0), Equals, true)
+	c.Assert(cloned.AvailableExtents().Contains(block1), Equals, false)
+
+	db, err := clone.KeyValueGetter()
+	c.Assert(err, IsNil)
+	dataID := cloned.DataID()
+	minKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID, Version: 0, Index: dvid.IndexBytes{}}
+	maxKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID, Version: 1}
+	keys, err := db.KeysInRange(context.Background(), minKey, maxKey)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+}
+
+func (suite *TestSuite) TestCloneData(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "source")
+	blockSize := grayscale.BlockSize().Value(0)
+
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{2 * blockSize, blockSize, blockSize}
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), MakeVolume(offset, size))
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	block0 := dvid.IndexZYX{0, 0, 0}
+	block1 := dvid.IndexZYX{1, 0, 0}
+	roi, err := dvid.NewROI([]dvid.BlockSpan{{Z: 0, Y: 0, X0: 1, X1: 3}})
+	c.Assert(err, IsNil)
+	ranges, err := grayscale.ROIIndices(roi)
+	c.Assert(err, IsNil)
+	c.Assert(ranges.Contains(block0), Equals, false)
+	c.Assert(ranges.Contains(block1), Equals, true)
+
+	countKeys := func(data *Data, versionID dvid.VersionLocalID) int {
+		db, err := suite.service.KeyValueGetter()
+		c.Assert(err, IsNil)
+		dataID := data.DataID()
+		minKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID, Version: versionID, Index: dvid.IndexBytes{}}
+		maxKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID, Version: versionID + 1}
+		keys, err := db.KeysInRange(context.Background(), minKey, maxKey)
+		c.Assert(err, IsNil)
+		return len(keys)
+	}
+
+	numKeys, err := suite.service.CloneData(root, "source", root, "roiclone", datastore.CloneOptions{ROI: roi}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(numKeys, Equals, 1)
+	dataservice, err := suite.service.DataServiceByUUID(root, "roiclone")
+	c.Assert(err, IsNil)
+	cloned := dataservice.(*Data)
+	c.Assert(cloned.BlockSize(), DeepEquals, grayscale.BlockSize())
+	c.Assert(cloned.DataID().ID, Not(Equals), grayscale.DataID().ID)
+	c.Assert(cloned.AvailableExtents().Contains(block0), Equals, false)
+	c.Assert(cloned.AvailableExtents().Contains(block1), Equals, true)
+	c.Assert(countKeys(cloned, 0), Equals, 1)
+	c.Assert(countKeys(grayscale, 0), Equals, 2)
+
+	_, err = suite.service.CloneData(root, "source", root, "roiclone", datastore.CloneOptions{}, nil)
+	c.Assert(err, NotNil)
+	_, err = suite.service.CloneData(root, "source", root, "both", datastore.CloneOptions{
+		MinPt: dvid.Point3d{0, 0, 0}, MaxPt: dvid.Point3d{1, 1, 1}, ROI: roi}, nil)
+	c.Assert(err, NotNil)
+
+	other, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	numKeys, err = suite.service.CloneData(root, "source", other, "copy", datastore.CloneOptions{}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(numKeys, Equals, 2)
+	dataservice, err = suite.service.DataServiceByUUID(other, "copy")
+	c.Assert(err, IsNil)
+	c.Assert(countKeys(dataservice.(*Data), 0), Equals, 2)
+}
+
+func (suite *TestSuite) TestInvalidation(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "invalidated")
+	blockSize := grayscale.BlockSize().Value(0)
+
+	var received []*datastore.Invalidation
+	id := suite.service.SubscribeInvalidations(func(inv *datastore.Invalidation) {
+		received = append(received, inv)
+	})
+	offset := dvid.Point3d{0, 0, 0}
+	size := dvid.Point3d{2 * blockSize, blockSize, blockSize}
+	v, err := grayscale.NewExtHandler(dvid.NewSubvolume(offset, size), MakeVolume(offset, size))
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+	suite.service.UnsubscribeInvalidations(id)
+	c.Assert(PutVoxels(context.Background(), root, grayscale, v), IsNil)
+
+	c.Assert(received, HasLen, 1)
+	c.Assert(received[0].Name, Equals, dvid.DataString("invalidated"))
+	c.Assert(received[0].Version, Equals, root)
+	c.Assert(received[0].Indices, DeepEquals, []dvid.Index{dvid.IndexZYX{0, 0, 0}, dvid.IndexZYX{1, 0, 0}})
+}
+
+func (suite *TestSuite) TestSubvolNrrd(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "nrrd")
+
+	offset := dvid.Point3d{5, 35, 61}
+	size := dvid.Point3d{10, 20, 30}
+	subvol := dvid.NewSubvolume(offset, size)
+	data := MakeVolume(offset, size)
+
+	var buf bytes.Buffer
+	c.Assert(grayscale.WriteNrrd(&buf, subvol, TimeRange{}, data), IsNil)
+	c.Assert(bytes.HasPrefix(buf.Bytes(), []byte(dvid.NrrdMagic)), Equals, true)
+	read, err := grayscale.ReadNrrd(&buf, subvol)
+	c.Assert(err, IsNil)
+	c.Assert(read, DeepEquals, data)
+
+	buf.Reset()
+	c.Assert(grayscale.WriteNrrd(&buf, subvol, TimeRange{}, data), IsNil)
+	_, err = grayscale.ReadNrrd(&buf, dvid.NewSubvolume(offset, dvid.Point3d{10, 20, 31}))
+	c.Assert(err, NotNil)
+}
+
 func (suite *TestSuite) sliceTest(c *C, slice dvid.Geometry) {
 	// Create a new dataset
 	root, _, err := suite.service.NewDataset()
@@ -194,11 +594,11 @@ func (suite *TestSuite) sliceTest(c *C, slice dvid.Geometry) {
 	v, err := grayscale.NewExtHandler(slice, img)
 	c.Assert(err, IsNil)
 
-	err = PutVoxels(root, grayscale, v)
+	err = PutVoxels(context.Background(), root, grayscale, v)
 	c.Assert(err, IsNil)
 
 	// Read the stored image
-	retrieved, err := GetImage(root, grayscale, v)
+	retrieved, err := GetImage(context.Background(), root, grayscale, v)
 	c.Assert(err, IsNil)
 
 	// Make sure the retrieved image matches the original
@@ -233,3 +633,380 @@ func (suite *TestSuite) TestYZSliceGrayscale8(c *C) {
 	c.Assert(err, IsNil)
 	suite.sliceTest(c, slice)
 }
+
+func (suite *TestSuite) TestSamplePatches(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+
+	grayscale := suite.makeGrayscale(c, root, "grayscale")
+	labels := suite.makeGrayscale(c, root, "labels")
+
+	offset := dvid.Point3d{10, 20, 30}
+	size := dvid.Point3d{40, 40, 40}
+	subvol := dvid.NewSubvolume(offset, size)
+	for _, data := range []*Data{grayscale, labels} {
+		v, err := data.NewExtHandler(subvol, MakeVolume(offset, size))
+		c.Assert(err, IsNil)
+		err = PutVoxels(context.Background(), root, data, v)
+		c.Assert(err, IsNil)
+	}
+
+	spec := PatchSpec{
+		Size:      dvid.Point3d{8, 8, 4},
+		ROIOffset: offset,
+		ROISize:   size,
+		Num:       5,
+		Augment:   true,
+		Seed:      42,
+	}
+	sample, err := SamplePatches(context.Background(), root, grayscale, labels, spec)
+	c.Assert(err, IsNil)
+	c.Assert(sample.Patches, HasLen, 5)
+	for _, patch := range sample.Patches {
+		c.Assert(patch.Raw, HasLen, 8*8*4)
+		c.Assert(patch.Labels, DeepEquals, patch.Raw)
+
+		// Undo augmentation by comparing against directly augmented source data.
+		expected := augmentVolume(MakeVolume(patch.Offset, spec.Size), spec.Size, 1,
+			patch.Flip, patch.Rotate)
+		c.Assert(patch.Raw, DeepEquals, expected)
+	}
+
+	// Same seed should produce same sample.
+	sample2, err := SamplePatches(context.Background(), root, grayscale, nil, spec)
+	c.Assert(err, IsNil)
+	for i, patch := range sample2.Patches {
+		c.Assert(patch.Offset, Equals, sample.Patches[i].Offset)
+		c.Assert(patch.Labels, IsNil)
+	}
+
+	// Patches larger than the ROI are rejected.
+	spec.Size = dvid.Point3d{8, 8, 41}
+	_, err = SamplePatches(context.Background(), root, grayscale, nil, spec)
+	c.Assert(err, NotNil)
+
+	// Requests of more than MaxPatchVoxels are rejected with a bad request status.
+	spec.Size = dvid.Point3d{512, 512, 512}
+	spec.ROISize = spec.Size
+	_, err = SamplePatches(context.Background(), root, grayscale, nil, spec)
+	c.Assert(err, ErrorMatches, ".*exceed the maximum of .* voxels per request")
+	r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/grayscale/patches/256_256_256/0_0_0/512_512_512/3", nil)
+	w := httptest.NewRecorder()
+	c.Assert(grayscale.DoHTTP(context.Background(), root, w, r), NotNil)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
+
+func (suite *TestSuite) TestAugmentVolume(c *C) {
+	// 2 x 2 x 1 volume: rotating 90 degrees twice equals flipping in both X and Y.
+	data := []byte{1, 2, 3, 4}
+	size := dvid.Point3d{2, 2, 1}
+	rotated := augmentVolume(data, size, 1, [3]bool{}, 2)
+	flipped := augmentVolume(data, size, 1, [3]bool{true, true, false}, 0)
+	c.Assert(rotated, DeepEquals, []byte{4, 3, 2, 1})
+	c.Assert(flipped, DeepEquals, rotated)
+	c.Assert(augmentVolume(data, size, 1, [3]bool{true, false, false}, 0), DeepEquals,
+		[]byte{2, 1, 4, 3})
+}
+
+func (suite *TestSuite) TestInferenceCrop(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "grayscale")
+
+	// Chunk of 12 x 12 x 12 with halo of 2 around an 8 x 8 x 8 interior.
+	offset := dvid.Point3d{18, 28, 38}
+	size := dvid.Point3d{12, 12, 12}
+	halo := dvid.Point3d{2, 2, 2}
+	chunk := MakeVolume(offset, size)
+	err = PutInference(context.Background(), root, grayscale, dvid.NewSubvolume(offset, size), chunk, halo, CropHalo)
+	c.Assert(err, IsNil)
+
+	// Interior should match and halo should not have been written.
+	subvol := dvid.NewSubvolume(offset, size)
+	v, err := grayscale.NewExtHandler(subvol, nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(context.Background(), root, grayscale, v), IsNil)
+	data := v.Data()
+	i := 0
+	for z := int32(0); z < size[2]; z++ {
+		for y := int32(0); y < size[1]; y++ {
+			for x := int32(0); x < size[0]; x++ {
+				interior := x >= 2 && x < 10 && y >= 2 && y < 10 && z >= 2 && z < 10
+				if interior && data[i] != chunk[i] {
+					c.Fatalf("Interior voxel (%d,%d,%d) not written", x, y, z)
+				}
+				if !interior && data[i] != 0 {
+					c.Fatalf("Halo voxel (%d,%d,%d) was written", x, y, z)
+				}
+				i++
+			}
+		}
+	}
+}
+
+func (suite *TestSuite) TestInferenceBlend(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "grayscale")
+
+	// Two chunks with halo 2 along x whose 4 x 4 x 4 interiors are adjacent.
+	size := dvid.Point3d{8, 4, 4}
+	halo := dvid.Point3d{2, 0, 0}
+	chunks := make([][]byte, 2)
+	for n, value := range []byte{100, 200} {
+		chunks[n] = make([]byte, size.Prod())
+		for i := range chunks[n] {
+			chunks[n][i] = value
+		}
+	}
+	blend := func(n int, x int32) error {
+		subvol := dvid.NewSubvolume(dvid.Point3d{x, 0, 0}, size)
+		return PutInference(context.Background(), root, grayscale, subvol, chunks[n], halo, BlendHalo)
+	}
+	c.Assert(blend(0, -2), IsNil)
+	c.Assert(blend(1, 2), IsNil)
+
+	// Overlapping bands (x = 2 to 5) cross-fade while bands without a neighboring
+	// chunk keep their values.
+	expected := []uint8{100, 100, 113, 138, 163, 188, 200, 200}
+	check := func() {
+		subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{8, 4, 4})
+		v, err := grayscale.NewExtHandler(subvol, nil)
+		c.Assert(err, IsNil)
+		c.Assert(GetVoxels(context.Background(), root, grayscale, v), IsNil)
+		c.Assert(v.Data()[:8], DeepEquals, expected)
+	}
+	check()
+
+	// Replayed chunks are not blended twice, and a chunk can't be blended again with
+	// different contents.
+	c.Assert(blend(1, 2), IsNil)
+	c.Assert(blend(0, -2), IsNil)
+	check()
+	c.Assert(blend(0, 2), ErrorMatches, "A different chunk .* was already blended")
+	check()
+	c.Assert(grayscale.Blended, HasLen, 2)
+}
+
+func (suite *TestSuite) TestEstimateCost(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "grayscale")
+
+	// A 64^3 subvolume starting at a block boundary covers 8 blocks of 32^3 voxels,
+	// while an offset of 1 voxel along x covers 12 blocks.
+	subvol := dvid.NewSubvolume(dvid.Point3d{0, 0, 0}, dvid.Point3d{64, 64, 64})
+	cost := EstimateCost(grayscale, subvol)
+	c.Assert(cost.Blocks, Equals, 8)
+	c.Assert(cost.Bytes, Equals, int64(8*32*32*32))
+	c.Assert(cost.Seconds > 0, Equals, true)
+
+	cost, err = EstimateFromStrings(grayscale, "0_1_2", "64_64_64", "1_0_0")
+	c.Assert(err, IsNil)
+	c.Assert(cost.Blocks, Equals, 12)
+
+	c.Assert(Budget{}.Check(cost), IsNil)
+	c.Assert(Budget{MaxBlocks: 12}.Check(cost), IsNil)
+	c.Assert(Budget{MaxBlocks: 11}.Check(cost), NotNil)
+	c.Assert(Budget{MaxBytes: 1000}.Check(cost), NotNil)
+
+	// Requests exceeding their budget are unavailable, while malformed budgets are bad.
+	for query, status := range map[string]int{
+		"maxblocks=11": http.StatusServiceUnavailable,
+		"maxblocks=x":  http.StatusBadRequest,
+	} {
+		r := httptest.NewRequest("POST", "/api/node/abc/grayscale/raw/0_1_2/64_64_64/1_0_0?"+query, nil)
+		w := httptest.NewRecorder()
+		err := CheckRequestBudget(grayscale, dvid.NewSubvolume(dvid.Point3d{1, 0, 0}, dvid.Point3d{64, 64, 64}), r)
+		c.Assert(err, NotNil)
+		BudgetFailed(w, r, err)
+		c.Assert(w.Code, Equals, status, Commentf("query %s", query))
+	}
+}
+
+func (suite *TestSuite) TestReserveMemory(c *C) {
+	oldMax, oldBudget, oldWait := MaxRequestBytes, MemoryBudget, server.ShedWait
+	defer func() { MaxRequestBytes, MemoryBudget, server.ShedWait = oldMax, oldBudget, oldWait }()
+	MaxRequestBytes, MemoryBudget, server.ShedWait = 1000, 1500, 10*time.Millisecond
+
+	r, err := http.NewRequest("GET", "/api/node/1234/grayscale/raw/0_1_2/64_64_64/0_0_0", nil)
+	c.Assert(err, IsNil)
+
+	w := httptest.NewRecorder()
+	_, ok := ReserveMemory(w, r, Cost{Bytes: 2000})
+	c.Assert(ok, Equals, false)
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(w.Header().Get("Retry-After"), Not(Equals), "")
+
+	release, ok := ReserveMemory(httptest.NewRecorder(), r, Cost{Bytes: 1000})
+	c.Assert(ok, Equals, true)
+	w = httptest.NewRecorder()
+	_, ok = ReserveMemory(w, r, Cost{Bytes: 1000})
+	c.Assert(ok, Equals, false)
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+
+	// Released memory lets a waiting request proceed.
+	go func() {
+		time.Sleep(time.Millisecond)
+		release()
+	}()
+	server.ShedWait = time.Second
+	release, ok = ReserveMemory(httptest.NewRecorder(), r, Cost{Bytes: 1000})
+	c.Assert(ok, Equals, true)
+	release()
+}
+
+func (suite *TestSuite) TestIsotropicOutputSize(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "grayscale")
+	grayscale.Properties.VoxelSize = dvid.NdFloat32{10.0, 10.0, 40.0}
+
+	xz, err := dvid.NewSliceFromStrings("xz", "0_0_0", "64_16", "_")
+	c.Assert(err, IsNil)
+	w, h, err := grayscale.IsotropicOutputSize(xz)
+	c.Assert(err, IsNil)
+	c.Assert(w, Equals, 64)
+	c.Assert(h, Equals, 64)
+
+	xy, err := dvid.NewSliceFromStrings("xy", "0_0_0", "64_16", "_")
+	c.Assert(err, IsNil)
+	w, h, err = grayscale.IsotropicOutputSize(xy)
+	c.Assert(err, IsNil)
+	c.Assert(w, Equals, 64)
+	c.Assert(h, Equals, 16)
+
+	r, err := http.NewRequest("GET", "/api/node/1/grayscale/raw/xz/64_16/0_0_0?resample=bogus", nil)
+	c.Assert(err, IsNil)
+	_, err = grayscale.ResampleFromRequest(nil, xz, r)
+	c.Assert(err, NotNil)
+}
+
+func (suite *TestSuite) TestTilingManifest(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "grayscale")
+
+	// Any 64^3 tile covers at most 27 blocks of 32^3 voxels.
+	tile, err := grayscale.TileSize(dvid.Point3d{100, 128, 256}, TimeRange{}, Budget{MaxBlocks: 27})
+	c.Assert(err, IsNil)
+	c.Assert(tile, Equals, dvid.Point3d{64, 64, 64})
+
+	_, err = grayscale.TileSize(dvid.Point3d{100, 128, 256}, TimeRange{}, Budget{MaxBlocks: 7})
+	c.Assert(err, NotNil)
+
+	tile, err = grayscale.TileSize(dvid.Point3d{10, 10, 10}, TimeRange{0, 3}, Budget{})
+	c.Assert(err, IsNil)
+	c.Assert(tile, Equals, dvid.Point3d{10, 10, 10})
+
+	subvol := dvid.NewSubvolume(dvid.Point3d{-10, 0, 5}, dvid.Point3d{100, 128, 256})
+	parts := []string{"node", string(root), "grayscale", "raw", "0_1_2", "100_128_256", "-10_0_5", "nrrd"}
+	query := url.Values{"tile": {"true"}, "maxblocks": {"27"}}
+	manifest, err := grayscale.NewTilingManifest(root, parts, query, subvol, TimeRange{},
+		Budget{MaxBlocks: 27}, "too big")
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Tiles, HasLen, 3*2*5)
+	first := manifest.Tiles[0]
+	c.Assert(first.Offset, Equals, dvid.Point3d{-10, 0, 5})
+	c.Assert(first.Size, Equals, dvid.Point3d{10, 64, 59})
+	c.Assert(first.URL, Equals, "/api/node/"+string(root)+"/grayscale/raw/0_1_2/10_64_59/-10_0_5/nrrd?maxblocks=27")
+
+	// Tiles break on the block grid so interior tiles cover whole blocks.
+	second := manifest.Tiles[1]
+	c.Assert(second.Offset, Equals, dvid.Point3d{0, 0, 5})
+	c.Assert(second.Size, Equals, dvid.Point3d{64, 64, 59})
+	third := manifest.Tiles[2]
+	c.Assert(third.Offset, Equals, dvid.Point3d{64, 0, 5})
+	c.Assert(third.Size, Equals, dvid.Point3d{26, 64, 59})
+	last := manifest.Tiles[len(manifest.Tiles)-1]
+	c.Assert(last.Offset, Equals, dvid.Point3d{64, 64, 256})
+	c.Assert(last.Size, Equals, dvid.Point3d{26, 64, 5})
+	for _, tile := range manifest.Tiles {
+		for dim := 0; dim < 3; dim++ {
+			if tile.Offset[dim] != subvol.StartPoint().Value(uint8(dim)) {
+				c.Assert(tile.Offset[dim]%32, Equals, int32(0))
+			}
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/node/"+string(root)+"/grayscale/raw/0_1_2/100_128_256/-10_0_5?tile=true&maxblocks=27", nil)
+	w := httptest.NewRecorder()
+	c.Assert(grayscale.writeTilingManifest(w, r, root, parts, subvol, TimeRange{}, fmt.Errorf("too big")), IsNil)
+	c.Assert(w.Code, Equals, http.StatusSeeOther)
+
+	var numVoxels int64
+	for _, tile := range manifest.Tiles {
+		numVoxels += tile.Size.Prod()
+	}
+	c.Assert(numVoxels, Equals, subvol.NumVoxels())
+}
+
+func (suite *TestSuite) TestAnisotropicBlocks(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+
+	config := dvid.NewConfig()
+	config.Set("BlockSize", "0,16,4")
+	c.Assert(suite.service.NewData(root, "grayscale8", "badblocks", config), NotNil)
+	config.Set("BlockSize", "16,4")
+	c.Assert(suite.service.NewData(root, "grayscale8", "badblocks", config), NotNil)
+
+	config.Set("BlockSize", "16")
+	c.Assert(suite.service.NewData(root, "grayscale8", "cubic", config), IsNil)
+	dataservice, err := suite.service.DataServiceByUUID(root, "cubic")
+	c.Assert(err, IsNil)
+	c.Assert(dataservice.(*Data).BlockSize(), DeepEquals, dvid.Point3d{16, 16, 16})
+
+	config.Set("BlockSize", "16,8,4")
+	c.Assert(suite.service.NewData(root, "grayscale8", "aniso", config), IsNil)
+	dataservice, err = suite.service.DataServiceByUUID(root, "aniso")
+	c.Assert(err, IsNil)
+	aniso := dataservice.(*Data)
+	c.Assert(aniso.BlockSize(), DeepEquals, dvid.Point3d{16, 8, 4})
+	c.Assert(aniso.ModifyConfig(config), NotNil)
+
+	// Round trip a subvolume that is unaligned with the anisotropic blocks.
+	offset := dvid.Point3d{5, 3, 7}
+	size := dvid.Point3d{37, 21, 13}
+	subvol := dvid.NewSubvolume(offset, size)
+	data := MakeVolume(offset, size)
+	origData := make([]byte, len(data))
+	copy(origData, data)
+	v, err := aniso.NewExtHandler(subvol, data)
+	c.Assert(err, IsNil)
+	c.Assert(PutVoxels(context.Background(), root, aniso, v), IsNil)
+
+	v2, err := aniso.NewExtHandler(subvol, nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(context.Background(), root, aniso, v2), IsNil)
+	c.Assert(v2.Data(), DeepEquals, origData)
+
+	// An XZ slice spans several blocks along z.
+	slice, err := dvid.NewOrthogSlice(dvid.XZ, dvid.Point3d{5, 10, 7}, dvid.Point2d{20, 13})
+	c.Assert(err, IsNil)
+	v3, err := aniso.NewExtHandler(slice, nil)
+	c.Assert(err, IsNil)
+	c.Assert(GetVoxels(context.Background(), root, aniso, v3), IsNil)
+	sliceData := v3.Data()
+	for z := int32(0); z < 13; z++ {
+		expected := MakeSlice(dvid.Point3d{5, 10, 7 + z}, dvid.Point2d{20, 1})
+		c.Assert(sliceData[z*20:(z+1)*20], DeepEquals, expected)
+	}
+
+	metadata, err := aniso.NdDataMetadata()
+	c.Assert(err, IsNil)
+	c.Assert(metadata, Matches, `.*"Label":"Z".*"BlockSize":4.*`)
+}
+
+func (suite *TestSuite) TestIndexRange(c *C) {
+	root, _, err := suite.service.NewDataset()
+	c.Assert(err, IsNil)
+	grayscale := suite.makeGrayscale(c, root, "grayscale")
+
+	index := dvid.IndexZYX{1, -2, 3}
+	name, err := grayscale.IndexRange(index.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "block z 3")
+	_, err = grayscale.IndexRange([]byte{1, 2})
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,289 @@
+/*
+	This file supports ingestion of chunks produced by sliding-window inference, where
+	each chunk carries a halo of context voxels that overlaps adjacent chunks.
+*/
+
+package voxels
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// HaloMode describes how the halo of an inference chunk is integrated into stored data.
+type HaloMode uint8
+
+const (
+	// CropHalo discards the halo and writes only the chunk interior.  This is appropriate
+	// for segmentation and any other data that cannot be averaged.
+	CropHalo HaloMode = iota
+
+	// BlendHalo writes the entire chunk, linearly weighting voxels within twice the halo
+	// width of each chunk face.  Each voxel becomes the weighted average of all chunks
+	// blended into it, so adjacent chunks overlapping by twice the halo produce a smooth
+	// cross-fade, faces without a neighboring chunk keep their values, and data not
+	// written by blending is replaced.  Blended chunks are recorded with the data, so a
+	// replayed chunk with the same contents is not blended twice.
+	BlendHalo
+)
+
+// BlendedChunk records an inference chunk blended into a version of data.
+type BlendedChunk struct {
+	Version dvid.VersionLocalID
+	Offset  dvid.Point3d
+	Size    dvid.Point3d
+	Halo    dvid.Point3d
+
+	// Checksum is the CRC32 of the chunk's data.
+	Checksum uint32
+}
+
+// blendLock serializes changes to the blended chunks of all data.
+var blendLock sync.Mutex
+
+// blendRecorder is implemented by data that records blended inference chunks.
+type blendRecorder interface {
+	blendedChunks() *[]BlendedChunk
+}
+
+func (d *Data) blendedChunks() *[]BlendedChunk {
+	return &d.Blended
+}
+
+func (mode HaloMode) String() string {
+	switch mode {
+	case CropHalo:
+		return "crop"
+	case BlendHalo:
+		return "blend"
+	default:
+		return "unknown halo mode"
+	}
+}
+
+// HaloModeFromString returns the halo mode for a string ("crop" or "blend").
+func HaloModeFromString(s string) (HaloMode, error) {
+	switch s {
+	case "", "crop":
+		return CropHalo, nil
+	case "blend":
+		return BlendHalo, nil
+	default:
+		return CropHalo, fmt.Errorf("Unknown halo mode '%s': use 'crop' or 'blend'", s)
+	}
+}
+
+// PutInference integrates a chunk of packed voxel data, including a halo of the given
+// width along each axis, into the data at a version node.  The subvolume describes
+// the full chunk including the halo.  Blending holds the PUT lock of the version from
+// reading the stored voxels until the blended voxels are written.
+func PutInference(ctx context.Context, uuid dvid.UUID, i IntHandler, subvol *dvid.Subvolume, data []byte,
+	halo dvid.Point3d, mode HaloMode) error {
+
+	offset, ok := subvol.StartPoint().(dvid.Point3d)
+	if !ok {
+		return fmt.Errorf("Inference chunk must be 3d, got offset %s", subvol.StartPoint())
+	}
+	size, ok := subvol.Size().(dvid.Point3d)
+	if !ok {
+		return fmt.Errorf("Inference chunk must be 3d, got size %s", subvol.Size())
+	}
+	for dim := 0; dim < 3; dim++ {
+		if halo[dim] < 0 || 2*halo[dim] >= size[dim] {
+			return fmt.Errorf("Halo %s is too large for chunk of size %s", halo, size)
+		}
+	}
+	bytesPerVoxel := i.Values().BytesPerElement()
+	if int64(len(data)) != subvol.NumVoxels()*int64(bytesPerVoxel) {
+		return fmt.Errorf("Inference chunk has %d bytes, expected %d bytes for %s",
+			len(data), subvol.NumVoxels()*int64(bytesPerVoxel), subvol)
+	}
+
+	switch mode {
+	case CropHalo:
+		interiorOffset := offset.Add(halo).(dvid.Point3d)
+		interiorSize := size.Sub(halo).Sub(halo).(dvid.Point3d)
+		interior := cropVolume(data, size, bytesPerVoxel, halo, interiorSize)
+		e, err := i.NewExtHandler(dvid.NewSubvolume(interiorOffset, interiorSize), interior)
+		if err != nil {
+			return err
+		}
+		return PutVoxels(ctx, uuid, i, e)
+
+	case BlendHalo:
+		for _, value := range i.Values() {
+			if value.T != dvid.T_uint8 {
+				return fmt.Errorf("Can only blend 8-bit values, use 'crop' for data '%s'",
+					i.DataID().DataName())
+			}
+		}
+		recorder, ok := i.(blendRecorder)
+		if !ok {
+			return fmt.Errorf("Data '%s' cannot record blended chunks", i.DataID().DataName())
+		}
+		service := server.DatastoreService()
+		versions, err := service.DataVersions(uuid, i.DataID().DataName())
+		if err != nil {
+			return err
+		}
+		versionMutex := i.VersionMutex(versions[0])
+		versionMutex.Lock()
+		defer versionMutex.Unlock()
+
+		chunk := BlendedChunk{versions[0], offset, size, halo, crc32.ChecksumIEEE(data)}
+		prior, replayed, err := priorChunks(recorder, versions, chunk)
+		if err != nil || replayed {
+			return err
+		}
+		stored, err := i.NewExtHandler(subvol, nil)
+		if err != nil {
+			return err
+		}
+		if err = GetVoxels(ctx, uuid, i, stored); err != nil {
+			return err
+		}
+		blended := blendVolume(stored.Data(), data, offset, size, bytesPerVoxel, halo, prior)
+		e, err := i.NewExtHandler(subvol, blended)
+		if err != nil {
+			return err
+		}
+		if err = putVoxels(ctx, uuid, i, e, false); err != nil {
+			return err
+		}
+		blendLock.Lock()
+		record := recorder.blendedChunks()
+		*record = append(*record, chunk)
+		blendLock.Unlock()
+		return service.SaveDataset(uuid)
+
+	default:
+		return fmt.Errorf("Illegal halo mode: %d", mode)
+	}
+}
+
+// cropVolume returns the interior of packed 3d voxel data after removing a halo.
+func cropVolume(data []byte, size dvid.Point3d, bytesPerVoxel int32, halo, interiorSize dvid.Point3d) []byte {
+	rowBytes := interiorSize[0] * bytesPerVoxel
+	out := make([]byte, int64(interiorSize.Prod())*int64(bytesPerVoxel))
+	var dst int32
+	for z := halo[2]; z < halo[2]+interiorSize[2]; z++ {
+		for y := halo[1]; y < halo[1]+interiorSize[1]; y++ {
+			src := ((z*size[1]+y)*size[0] + halo[0]) * bytesPerVoxel
+			copy(out[dst:dst+rowBytes], data[src:src+rowBytes])
+			dst += rowBytes
+		}
+	}
+	return out
+}
+
+// haloWeight returns the blending weight for a voxel at position pos along an axis of
+// n voxels with the given halo.  Weights ramp linearly over twice the halo width at each
+// end so that the weights of two chunks overlapping by twice the halo sum to one.
+func haloWeight(pos, n, halo int32) float64 {
+	if halo == 0 {
+		return 1.0
+	}
+	dist := pos
+	if n-1-pos < dist {
+		dist = n - 1 - pos
+	}
+	band := 2 * halo
+	if dist >= band {
+		return 1.0
+	}
+	return (float64(dist) + 0.5) / float64(band)
+}
+
+// priorChunks returns the chunks blended into the given versions that overlap a chunk.
+// If the chunk itself was already blended, it returns true if the contents match and an
+// error otherwise, since the earlier contribution cannot be taken back.
+func priorChunks(recorder blendRecorder, versions []dvid.VersionLocalID, chunk BlendedChunk) (
+	prior []BlendedChunk, replayed bool, err error) {
+
+	inVersions := make(map[dvid.VersionLocalID]bool, len(versions))
+	for _, v := range versions {
+		inVersions[v] = true
+	}
+	blendLock.Lock()
+	defer blendLock.Unlock()
+	for _, b := range *recorder.blendedChunks() {
+		if !inVersions[b.Version] {
+			continue
+		}
+		if b.Offset == chunk.Offset && b.Size == chunk.Size && b.Halo == chunk.Halo {
+			if b.Checksum != chunk.Checksum {
+				return nil, false, fmt.Errorf("A different chunk of size %s at %s was already blended",
+					chunk.Size, chunk.Offset)
+			}
+			return nil, true, nil
+		}
+		overlaps := true
+		for dim := 0; dim < 3; dim++ {
+			if b.Offset[dim] >= chunk.Offset[dim]+chunk.Size[dim] || chunk.Offset[dim] >= b.Offset[dim]+b.Size[dim] {
+				overlaps = false
+			}
+		}
+		if overlaps {
+			prior = append(prior, b)
+		}
+	}
+	return prior, false, nil
+}
+
+// axisWeights returns the halo weights of a blended chunk along one axis for each
+// position of a chunk, with zero weight outside the blended chunk.
+func axisWeights(b BlendedChunk, offset, size dvid.Point3d, dim int) []float64 {
+	weights := make([]float64, size[dim])
+	for pos := range weights {
+		local := offset[dim] + int32(pos) - b.Offset[dim]
+		if local >= 0 && local < b.Size[dim] {
+			weights[pos] = haloWeight(local, b.Size[dim], b.Halo[dim])
+		}
+	}
+	return weights
+}
+
+// blendVolume returns the weighted average of halo-weighted chunk values and stored 8-bit
+// values, where the stored values have the weight accumulated from prior blended chunks.
+// Voxels without prior weight are replaced by the chunk values.
+func blendVolume(stored, chunk []byte, offset, size dvid.Point3d, bytesPerVoxel int32, halo dvid.Point3d,
+	prior []BlendedChunk) []byte {
+
+	var priorWeights [][3][]float64
+	for _, b := range prior {
+		priorWeights = append(priorWeights, [3][]float64{
+			axisWeights(b, offset, size, 0), axisWeights(b, offset, size, 1), axisWeights(b, offset, size, 2),
+		})
+	}
+	out := make([]byte, len(chunk))
+	var i int32
+	for z := int32(0); z < size[2]; z++ {
+		wz := haloWeight(z, size[2], halo[2])
+		for y := int32(0); y < size[1]; y++ {
+			wy := wz * haloWeight(y, size[1], halo[1])
+			for x := int32(0); x < size[0]; x++ {
+				w := wy * haloWeight(x, size[0], halo[0])
+				var accumulated float64
+				for _, pw := range priorWeights {
+					accumulated += pw[0][x] * pw[1][y] * pw[2][z]
+				}
+				for b := int32(0); b < bytesPerVoxel; b++ {
+					if accumulated == 0 {
+						out[i] = chunk[i]
+					} else {
+						value := (accumulated*float64(stored[i]) + w*float64(chunk[i])) / (accumulated + w)
+						out[i] = uint8(math.Min(math.Floor(value+0.5), 255))
+					}
+					i++
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+/*
+	This file supports NRRD as a format for subvolume requests so volumes can be exchanged
+	with ITK, 3D Slicer, and other tools that read this simple self-describing format.
+*/
+
+package voxels
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// NrrdHeader returns a NRRD header describing voxels of this data within a subvolume
+// over a range of time points.  Spacings and units of the spatial axes are given by
+// the data's voxel resolution.  A range of more than one time point adds a slowest
+// changing time axis.
+func (d *Data) NrrdHeader(geom dvid.Geometry, times TimeRange) (*dvid.NrrdHeader, error) {
+	header, err := dvid.NewNrrdHeader(d.Values(), geom.Size(), geom.StartPoint(),
+		d.VoxelSize, d.VoxelUnits, d.ByteOrder)
+	if err != nil {
+		return nil, err
+	}
+	if times.NumTimes() > 1 {
+		header.Axes = append(header.Axes, dvid.NrrdAxis{
+			Size:    int32(times.NumTimes()),
+			Spacing: math.NaN(),
+			Min:     float64(times.Beg),
+			Kind:    dvid.NrrdTime,
+		})
+	}
+	return header, nil
+}
+
+// WriteNrrd writes a NRRD header for the subvolume followed by its voxel data.
+func (d *Data) WriteNrrd(w io.Writer, geom dvid.Geometry, times TimeRange, data []byte) error {
+	header, err := d.NrrdHeader(geom, times)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != header.NumBytes() {
+		return fmt.Errorf("Expected %d bytes of voxel data for NRRD, got %d bytes",
+			header.NumBytes(), len(data))
+	}
+	if err = header.Write(w); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadNrrd reads a NRRD stream and returns its voxel data in the data's byte order.
+// The NRRD value type, number of values per voxel, and sizes must match the data
+// and the given subvolume.
+func (d *Data) ReadNrrd(r io.Reader, geom dvid.Geometry) ([]byte, error) {
+	reader := bufio.NewReader(r)
+	header, err := dvid.ReadNrrdHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := d.NrrdHeader(geom, TimeRange{})
+	if err != nil {
+		return nil, err
+	}
+	if header.Type != expected.Type {
+		return nil, fmt.Errorf("NRRD value type does not match values of data '%s'", d.DataName())
+	}
+	if len(header.Axes) != len(expected.Axes) {
+		return nil, fmt.Errorf("NRRD has %d axes, expected %d for data '%s'",
+			len(header.Axes), len(expected.Axes), d.DataName())
+	}
+	for n, axis := range header.Axes {
+		if axis.Size != expected.Axes[n].Size {
+			return nil, fmt.Errorf("NRRD axis %d has size %d, expected %d for %s",
+				n, axis.Size, expected.Axes[n].Size, geom)
+		}
+	}
+	return dvid.ReadNrrdData(reader, header, d.ByteOrder)
+}
@@ -0,0 +1,245 @@
+/*
+	This file supports random sampling of raw and label patch pairs for machine
+	learning workflows, so training code can stream data directly from DVID.
+*/
+
+package voxels
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// MaxPatchesRequest is the maximum number of patches that can be sampled in one request.
+const MaxPatchesRequest = 1024
+
+// MaxPatchVoxels is the maximum number of voxels, summed over all patches, that can be
+// sampled in one request.
+const MaxPatchVoxels = 1 << 25
+
+// PatchSpec describes how patches should be sampled within a region of interest.
+type PatchSpec struct {
+	// Size of each patch in voxels.
+	Size dvid.Point3d
+
+	// ROIOffset and ROISize describe the box from which patches are sampled.
+	// Each patch lies entirely within this box.
+	ROIOffset dvid.Point3d
+	ROISize   dvid.Point3d
+
+	// Num is the number of patches to sample.
+	Num int
+
+	// If Augment is true, each patch is randomly flipped along each axis and,
+	// if the patch is square in XY, randomly rotated by multiples of 90 degrees in XY.
+	Augment bool
+
+	// Seed for the random number generator.  Use a fixed seed for reproducible samples.
+	Seed int64
+}
+
+// Patch is a sampled raw patch and, if requested, the corresponding label patch.
+// The augmentation applied to both is recorded so clients can reverse it.
+type Patch struct {
+	Offset dvid.Point3d
+	Flip   [3]bool
+	Rotate int // number of 90 degree counter-clockwise rotations in XY
+	Raw    []byte
+	Labels []byte `json:",omitempty"`
+}
+
+// PatchSample is a batch of patches sampled from a version node.
+type PatchSample struct {
+	Size    dvid.Point3d
+	Patches []Patch
+}
+
+// SamplePatches returns a batch of randomly positioned patches from raw data and, if labels
+// is non-nil, the label patches at identical positions and with identical augmentation.
+func SamplePatches(ctx context.Context, uuid dvid.UUID, raw, labels IntHandler, spec PatchSpec) (*PatchSample, error) {
+	if spec.Num <= 0 || spec.Num > MaxPatchesRequest {
+		return nil, fmt.Errorf("Number of patches (%d) must be between 1 and %d",
+			spec.Num, MaxPatchesRequest)
+	}
+	var freedom [3]int32
+	for dim := 0; dim < 3; dim++ {
+		if spec.Size[dim] <= 0 {
+			return nil, fmt.Errorf("Illegal patch size: %s", spec.Size)
+		}
+		freedom[dim] = spec.ROISize[dim] - spec.Size[dim] + 1
+		if freedom[dim] <= 0 {
+			return nil, fmt.Errorf("Patch size %s does not fit within ROI size %s",
+				spec.Size, spec.ROISize)
+		}
+	}
+	numVoxels := float64(spec.Num) * float64(spec.Size[0]) * float64(spec.Size[1]) * float64(spec.Size[2])
+	if numVoxels > MaxPatchVoxels {
+		return nil, fmt.Errorf("%d patches of size %s exceed the maximum of %d voxels per request",
+			spec.Num, spec.Size, MaxPatchVoxels)
+	}
+	rotatable := spec.Size[0] == spec.Size[1]
+
+	sample := &PatchSample{
+		Size:    spec.Size,
+		Patches: make([]Patch, spec.Num),
+	}
+	random := rand.New(rand.NewSource(spec.Seed))
+	for n := 0; n < spec.Num; n++ {
+		patch := &(sample.Patches[n])
+		for dim := 0; dim < 3; dim++ {
+			patch.Offset[dim] = spec.ROIOffset[dim] + random.Int31n(freedom[dim])
+		}
+		if spec.Augment {
+			for dim := 0; dim < 3; dim++ {
+				patch.Flip[dim] = random.Intn(2) == 1
+			}
+			if rotatable {
+				patch.Rotate = random.Intn(4)
+			}
+		}
+
+		subvol := dvid.NewSubvolume(patch.Offset, spec.Size)
+		var err error
+		patch.Raw, err = getPatch(ctx, uuid, raw, subvol, patch)
+		if err != nil {
+			return nil, err
+		}
+		if labels != nil {
+			patch.Labels, err = getPatch(ctx, uuid, labels, subvol, patch)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sample, nil
+}
+
+// getPatch reads a subvolume from the given data and applies the patch's augmentation.
+func getPatch(ctx context.Context, uuid dvid.UUID, i IntHandler, subvol *dvid.Subvolume, patch *Patch) ([]byte, error) {
+	e, err := i.NewExtHandler(subvol, nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := GetVolume(ctx, uuid, i, e)
+	if err != nil {
+		return nil, err
+	}
+	bytesPerVoxel := i.Values().BytesPerElement()
+	size := subvol.Size().(dvid.Point3d)
+	return augmentVolume(data, size, bytesPerVoxel, patch.Flip, patch.Rotate), nil
+}
+
+// augmentVolume returns a copy of packed 3d voxel data flipped along the requested axes
+// and then rotated by multiples of 90 degrees counter-clockwise in XY.  Rotation requires
+// equal X and Y sizes.
+func augmentVolume(data []byte, size dvid.Point3d, bytesPerVoxel int32, flip [3]bool, rotate int) []byte {
+	nx, ny, nz := size[0], size[1], size[2]
+	out := make([]byte, len(data))
+	var srcX, srcY, srcZ int32
+	var dst int32
+	for z := int32(0); z < nz; z++ {
+		for y := int32(0); y < ny; y++ {
+			for x := int32(0); x < nx; x++ {
+				// Find the source voxel for this destination voxel by undoing the rotation.
+				switch rotate % 4 {
+				case 0:
+					srcX, srcY = x, y
+				case 1:
+					srcX, srcY = ny-1-y, x
+				case 2:
+					srcX, srcY = nx-1-x, ny-1-y
+				case 3:
+					srcX, srcY = y, nx-1-x
+				}
+				srcZ = z
+				if flip[0] {
+					srcX = nx - 1 - srcX
+				}
+				if flip[1] {
+					srcY = ny - 1 - srcY
+				}
+				if flip[2] {
+					srcZ = nz - 1 - srcZ
+				}
+				src := ((srcZ*ny+srcY)*nx + srcX) * bytesPerVoxel
+				copy(out[dst:dst+bytesPerVoxel], data[src:src+bytesPerVoxel])
+				dst += bytesPerVoxel
+			}
+		}
+	}
+	return out
+}
+
+// parsePatchRequest returns a patch specification given the URL strings for patch size,
+// ROI offset, ROI size and number of patches.  The optional "labels", "augment", and
+// "seed" query strings set the labels source, augmentation and random seed.
+func parsePatchRequest(sizeStr, offsetStr, roiSizeStr, numStr string, r *http.Request) (
+	spec PatchSpec, labelsName dvid.DataString, err error) {
+
+	var size, offset, roiSize dvid.Point
+	if size, err = dvid.StringToPoint(sizeStr, "_"); err != nil {
+		return
+	}
+	if offset, err = dvid.StringToPoint(offsetStr, "_"); err != nil {
+		return
+	}
+	if roiSize, err = dvid.StringToPoint(roiSizeStr, "_"); err != nil {
+		return
+	}
+	var ok bool
+	if spec.Size, ok = size.(dvid.Point3d); !ok {
+		err = fmt.Errorf("Patch size must be 3d: %s", sizeStr)
+		return
+	}
+	if spec.ROIOffset, ok = offset.(dvid.Point3d); !ok {
+		err = fmt.Errorf("ROI offset must be 3d: %s", offsetStr)
+		return
+	}
+	if spec.ROISize, ok = roiSize.(dvid.Point3d); !ok {
+		err = fmt.Errorf("ROI size must be 3d: %s", roiSizeStr)
+		return
+	}
+	if spec.Num, err = strconv.Atoi(numStr); err != nil {
+		err = fmt.Errorf("Illegal number of patches '%s': %s", numStr, err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	labelsName = dvid.DataString(query.Get("labels"))
+	if augmentStr := query.Get("augment"); augmentStr != "" {
+		if spec.Augment, err = strconv.ParseBool(augmentStr); err != nil {
+			err = fmt.Errorf("Illegal augment setting '%s': %s", augmentStr, err.Error())
+			return
+		}
+	}
+	if seedStr := query.Get("seed"); seedStr != "" {
+		if spec.Seed, err = strconv.ParseInt(seedStr, 10, 64); err != nil {
+			err = fmt.Errorf("Illegal seed '%s': %s", seedStr, err.Error())
+			return
+		}
+	} else {
+		spec.Seed = time.Now().UnixNano()
+	}
+	return
+}
+
+// GetLabelsHandler returns the IntHandler for the named data, which is usually a labels64
+// instance, so it can be used as the label source when sampling patches.
+func GetLabelsHandler(uuid dvid.UUID, name dvid.DataString) (IntHandler, error) {
+	dataservice, err := server.DatastoreService().DataServiceByUUID(uuid, name)
+	if err != nil {
+		return nil, err
+	}
+	labels, ok := dataservice.(IntHandler)
+	if !ok {
+		return nil, fmt.Errorf("Data '%s' is not a voxels-based datatype", name)
+	}
+	return labels, nil
+}
@@ -0,0 +1,34 @@
+/*
+	This file supports provenance queries of blocks: which version node last wrote the
+	block read at a version.
+*/
+
+package voxels
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// BlockProvenance returns JSON giving the version node that last wrote the block at a
+// coordinate string, e.g., "10_20_3", as read at a version.  For data with "tzyx"
+// IndexScheme, the time point is given by the request's query string.
+func (d *Data) BlockProvenance(uuid dvid.UUID, r *http.Request, coordStr string) (string, error) {
+	pt, err := dvid.StringToPoint(coordStr, "_")
+	if err != nil {
+		return "", err
+	}
+	if pt.NumDims() != 3 {
+		return "", fmt.Errorf("Block coordinate must be 3d, got %q", coordStr)
+	}
+	times, err := d.TimeRangeFromRequest(r)
+	if err != nil {
+		return "", err
+	}
+	block := dvid.ChunkPoint3d{pt.Value(0), pt.Value(1), pt.Value(2)}
+	index := d.IndexScheme.ChunkIndexAt(times.Beg, block)
+	return server.DatastoreService().ProvenanceJSON(uuid, d.DataName(), index)
+}
@@ -0,0 +1,86 @@
+/*
+	This file restores the extents of voxels data when its blocks at a version are rolled
+	back.  Extents are shared by all versions, so they are recomputed from the blocks
+	still stored at any version.  It also keeps PUTs out of a version while its inherited
+	blocks are flattened into it.
+*/
+
+package voxels
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// RollbackVersion calls rollback to discard the blocks of the data at a version and then
+// shrinks the extents to the blocks that remain.
+func (d *Data) RollbackVersion(u dvid.UUID, rollback func() (int, error)) (int, error) {
+	numDeleted, err := rollback()
+	if err != nil || numDeleted == 0 {
+		return numDeleted, err
+	}
+	return numDeleted, d.RecomputeExtents()
+}
+
+// FlattenVersion calls flatten to copy inherited blocks into a version while holding the
+// PUT lock of the version, so no PUT is overwritten by an inherited block.
+func (d *Data) FlattenVersion(u dvid.UUID, flatten func() (int, error)) (int, error) {
+	versionID, err := server.VersionLocalID(u)
+	if err != nil {
+		return 0, err
+	}
+	versionMutex := d.VersionMutex(versionID)
+	versionMutex.Lock()
+	defer versionMutex.Unlock()
+	return flatten()
+}
+
+// RecomputeExtents sets the extents to the blocks stored at any version.  Stored indices
+// that aren't block indices, like the label indices of labels data, are skipped.
+func (d *Data) RecomputeExtents() error {
+	db, err := server.KeyValueGetter()
+	if err != nil {
+		return err
+	}
+	dataID := d.DataID()
+	minKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID, Index: dvid.IndexBytes{}}
+	maxKey := &datastore.DataKey{Dataset: dataID.DsetID, Data: dataID.ID + 1}
+	keys, err := db.KeysInRange(context.Background(), minKey, maxKey)
+	if err != nil {
+		return err
+	}
+	decoder := d.IndexScheme.ChunkIndex(dvid.ChunkPoint3d{})
+	blockIndexSize := len(decoder.Bytes())
+	var minIndex, maxIndex dvid.ChunkIndexer
+	for _, key := range keys {
+		dataKey, ok := key.(*datastore.DataKey)
+		if !ok || dataKey.Data != dataID.ID || dataKey.Index == nil {
+			continue
+		}
+		indexBytes := dataKey.Index.Bytes()
+		if len(indexBytes) != blockIndexSize {
+			continue
+		}
+		index, err := decoder.IndexFromBytes(indexBytes)
+		if err != nil || !bytes.Equal(index.Bytes(), indexBytes) {
+			continue
+		}
+		indexer, ok := index.(dvid.ChunkIndexer)
+		if !ok {
+			return fmt.Errorf("Block index of '%s' is not a ChunkIndexer", d.DataName())
+		}
+		if minIndex == nil {
+			minIndex, maxIndex = indexer, indexer
+			continue
+		}
+		minIndex, _ = minIndex.Min(indexer)
+		maxIndex, _ = maxIndex.Max(indexer)
+	}
+	d.Extents().ShrinkTo(minIndex, maxIndex, d.BlockSize())
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+	This file implements the datastore SubsetCloner interface for voxels data, so a box
+	or ROI of a volume can be cloned into a new datastore, e.g., for laptops that can't
+	hold the whole volume, or into a new data instance.
+*/
+
+package voxels
+
+import (
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// MaximumExtents returns the range of block indices written to this data at any server.
+func (d *Data) MaximumExtents() dvid.IndexRange {
+	extents := d.Extents()
+	if extents.MinIndex == nil || extents.MaxIndex == nil {
+		return dvid.IndexRange{}
+	}
+	return dvid.IndexRange{Minimum: extents.MinIndex, Maximum: extents.MaxIndex}
+}
+
+// AvailableExtents returns the range of block indices stored at this server, which is
+// less than the maximum extents if only part of the data was cloned.
+func (d *Data) AvailableExtents() dvid.IndexRange {
+	if !d.Properties.Available.Empty() {
+		return d.Properties.Available
+	}
+	return d.MaximumExtents()
+}
+
+// SetAvailableExtents records the range of block indices stored at this server after a
+// partial clone.
+func (d *Data) SetAvailableExtents(extents dvid.IndexRange) {
+	d.Properties.Available = extents
+}
+
+// SubsetIndices returns the index ranges of the blocks intersecting the box from minPt
+// to maxPt, inclusive, in voxel coordinates.  For data with "tzyx" IndexScheme, blocks
+// at all time points within the maximum extents are included.
+func (d *Data) SubsetIndices(minPt, maxPt dvid.Point) (dvid.IndexRanges, error) {
+	if minPt.NumDims() != 3 || maxPt.NumDims() != 3 {
+		return nil, fmt.Errorf("Subsets of '%s' must be 3d boxes, got %s to %s", d.DataName(), minPt, maxPt)
+	}
+	begVoxel := dvid.Point3d{minPt.Value(0), minPt.Value(1), minPt.Value(2)}
+	endVoxel := dvid.Point3d{maxPt.Value(0), maxPt.Value(1), maxPt.Value(2)}
+	for dim := uint8(0); dim < 3; dim++ {
+		if begVoxel.Value(dim) > endVoxel.Value(dim) {
+			return nil, fmt.Errorf("Subset box of '%s' has minimum %s after maximum %s",
+				d.DataName(), begVoxel, endVoxel)
+		}
+	}
+	begBlock := begVoxel.Chunk(d.BlockSize()).(dvid.ChunkPoint3d)
+	endBlock := endVoxel.Chunk(d.BlockSize()).(dvid.ChunkPoint3d)
+	ranges, err := d.blockIndexRanges(begBlock, endBlock)
+	if err != nil {
+		return nil, err
+	}
+	return dvid.NewIndexRanges(ranges...), nil
+}
+
+// ROIIndices returns the index ranges of the blocks within an ROI.  For data with
+// "tzyx" IndexScheme, blocks at all time points within the maximum extents are included.
+func (d *Data) ROIIndices(roi *dvid.ROI) (dvid.IndexRanges, error) {
+	var ranges []dvid.IndexRange
+	for _, span := range roi.Spans() {
+		spanRanges, err := d.blockIndexRanges(dvid.ChunkPoint3d{span.X0, span.Y, span.Z},
+			dvid.ChunkPoint3d{span.X1, span.Y, span.Z})
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, spanRanges...)
+	}
+	return dvid.NewIndexRanges(ranges...), nil
+}
+
+// blockIndexRanges returns the index ranges of the blocks from begBlock to endBlock,
+// inclusive, at all time points within the maximum extents of timed data.
+func (d *Data) blockIndexRanges(begBlock, endBlock dvid.ChunkPoint3d) ([]dvid.IndexRange, error) {
+	var it dvid.IndexIterator
+	if d.IndexScheme.Timed() {
+		begTime, endTime, found := d.timeExtents()
+		if !found {
+			return nil, nil
+		}
+		it = dvid.NewIndexTZYXIterator(begTime, endTime, nil, begBlock, endBlock)
+	} else {
+		it = d.IndexScheme.NewIterator(nil, begBlock, endBlock)
+	}
+	var ranges []dvid.IndexRange
+	for ; it.Valid(); it.NextSpan() {
+		beg, end, err := it.IndexSpan()
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, dvid.IndexRange{Minimum: beg, Maximum: end})
+	}
+	return ranges, nil
+}
+
+// timeExtents returns the first and last time points within the maximum extents.
+func (d *Data) timeExtents() (begTime, endTime int32, found bool) {
+	extents := d.MaximumExtents()
+	if extents.Empty() {
+		return
+	}
+	timeOf := func(index dvid.Index) (int32, bool) {
+		switch i := index.(type) {
+		case dvid.IndexTZYX:
+			return i.Time, true
+		case *dvid.IndexTZYX:
+			return i.Time, true
+		}
+		return 0, false
+	}
+	var ok bool
+	if begTime, ok = timeOf(extents.Minimum); !ok {
+		return
+	}
+	if endTime, ok = timeOf(extents.Maximum); !ok {
+		return
+	}
+	return begTime, endTime, true
+}
@@ -0,0 +1,211 @@
+/*
+	This file supports tiling of subvolume GETs that exceed the server's request limit or
+	a caller's budget.  Instead of rejecting such a request, the server can return a
+	manifest of smaller requests that together cover the subvolume and can be fetched in
+	parallel.
+*/
+
+package voxels
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// Tile is one request within a tiling of a subvolume.
+type Tile struct {
+	Offset dvid.Point3d
+	Size   dvid.Point3d
+	URL    string
+}
+
+// TilingManifest describes the tiles covering a subvolume that was too large to get in
+// one request.  Tiles are ordered by z, then y, then x.
+type TilingManifest struct {
+	Offset   dvid.Point3d
+	Size     dvid.Point3d
+	TileSize dvid.Point3d
+	Reason   string
+	Tiles    []Tile
+}
+
+// TilingRequested returns true if the HTTP request allows a tiling manifest in place of
+// rejecting a request that is too large, signaled by a "tile=true" query string.
+func TilingRequested(r *http.Request) bool {
+	return r.URL.Query().Get("tile") == "true"
+}
+
+// checkSubvolumeRequest returns an error if a GET of the subvolume at the time points
+// exceeds the server's request limit or any budget given in the HTTP request.
+func (d *Data) checkSubvolumeRequest(subvol *dvid.Subvolume, times TimeRange, r *http.Request) error {
+	numVoxels := subvol.NumVoxels() * int64(times.NumTimes())
+	if numVoxels > MaxVoxelsRequest {
+		return fmt.Errorf("Requested # voxels (%d) exceeds this DVID server's set limit (%d)",
+			numVoxels, MaxVoxelsRequest)
+	}
+	return CheckTimeRequestBudget(d, subvol, times, r)
+}
+
+// writeTilingManifest responds to a subvolume GET that exceeded limits with a tiling
+// manifest and HTTP status 303 (See Other).
+func (d *Data) writeTilingManifest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string,
+	subvol *dvid.Subvolume, times TimeRange, reason error) error {
+
+	budget, err := BudgetFromRequest(r)
+	if err != nil {
+		return err
+	}
+	manifest, err := d.NewTilingManifest(uuid, parts, r.URL.Query(), subvol, times, budget, reason.Error())
+	if err != nil {
+		return err
+	}
+	m, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusSeeOther)
+	_, err = w.Write(m)
+	return err
+}
+
+// maxTileCost returns the cost of a tile of the given size at worst-case alignment with
+// the block grid over a range of time points.
+func (d *Data) maxTileCost(size dvid.Point3d, times TimeRange) Cost {
+	blockSize := d.BlockSize()
+	numBlocks := 1
+	blockBytes := int64(d.Values().BytesPerElement())
+	for dim := uint8(0); dim < 3; dim++ {
+		b := blockSize.Value(dim)
+		numBlocks *= int((size[dim]+b-2)/b + 1)
+		blockBytes *= int64(b)
+	}
+	numBlocks *= times.NumTimes()
+	return Cost{
+		Blocks:  numBlocks,
+		Bytes:   int64(numBlocks) * blockBytes,
+		Seconds: float64(numBlocks) / BlocksPerSecond(),
+	}
+}
+
+// TileSize returns the largest block-multiple tile size, found by repeatedly halving
+// the longest dimension, for which a GET of any tile at the given time points is within
+// the server's request limit and the budget.
+func (d *Data) TileSize(size dvid.Point3d, times TimeRange, budget Budget) (dvid.Point3d, error) {
+	blockSize := d.BlockSize()
+	tile := size
+	for {
+		numVoxels := tile.Prod() * int64(times.NumTimes())
+		if numVoxels <= MaxVoxelsRequest && budget.Check(d.maxTileCost(tile, times)) == nil {
+			return tile, nil
+		}
+		var longest uint8
+		var maxBlocks int32
+		for dim := uint8(0); dim < 3; dim++ {
+			b := blockSize.Value(dim)
+			if n := (tile[dim] + b - 1) / b; n > maxBlocks {
+				maxBlocks, longest = n, dim
+			}
+		}
+		if maxBlocks <= 1 {
+			return tile, fmt.Errorf("Cannot tile %s at %s: a single block exceeds the request limits",
+				size, times)
+		}
+		b := blockSize.Value(longest)
+		tile[longest] = (maxBlocks + 1) / 2 * b
+	}
+}
+
+// NewTilingManifest returns a manifest of tiles covering a subvolume GET request, whose
+// URL is given by the URL path parts and query string, such that each tile's GET is
+// within limits.  The reason describes why the original request was not fulfilled.
+func (d *Data) NewTilingManifest(uuid dvid.UUID, parts []string, query url.Values, subvol *dvid.Subvolume,
+	times TimeRange, budget Budget, reason string) (*TilingManifest, error) {
+
+	offset, ok := subvol.StartPoint().(dvid.Point3d)
+	if !ok {
+		return nil, fmt.Errorf("Can only tile 3d subvolumes, not %s", subvol)
+	}
+	size := subvol.Size().(dvid.Point3d)
+	tileSize, err := d.TileSize(size, times, budget)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &TilingManifest{Offset: offset, Size: size, TileSize: tileSize, Reason: reason}
+
+	query.Del("tile")
+	var queryStr string
+	if encoded := query.Encode(); encoded != "" {
+		queryStr = "?" + encoded
+	}
+	var formatStr string
+	if len(parts) >= 8 && parts[7] != "" {
+		formatStr = "/" + parts[7]
+	}
+	var spans [3][]span
+	for dim := 0; dim < 3; dim++ {
+		spans[dim] = alignedSpans(offset[dim], size[dim], tileSize[dim])
+	}
+	for _, z := range spans[2] {
+		for _, y := range spans[1] {
+			for _, x := range spans[0] {
+				tile := Tile{
+					Offset: dvid.Point3d{x.start, y.start, z.start},
+					Size:   dvid.Point3d{x.size, y.size, z.size},
+				}
+				tile.URL = fmt.Sprintf("%snode/%s/%s/%s/%s/%s/%s%s%s", server.WebAPIPath, uuid,
+					d.DataName(), parts[3], parts[4], pointString(tile.Size), pointString(tile.Offset),
+					formatStr, queryStr)
+				manifest.Tiles = append(manifest.Tiles, tile)
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// span is a range of voxel coordinates along one dimension.
+type span struct {
+	start, size int32
+}
+
+// alignedSpans splits a range of voxel coordinates along one dimension into spans no
+// larger than the tile size.  If the range is larger than a tile, spans break on
+// multiples of the tile size, which TileSize makes a multiple of the block size, so
+// every tile but those at the edges of the range covers whole blocks.
+func alignedSpans(start, size, tileSize int32) []span {
+	if size <= tileSize {
+		return []span{{start, size}}
+	}
+	end := start + size
+	boundary := start / tileSize * tileSize
+	if boundary > start {
+		boundary -= tileSize
+	}
+	var spans []span
+	for boundary < end {
+		next := boundary + tileSize
+		s := span{boundary, tileSize}
+		if boundary < start {
+			s = span{start, next - start}
+		}
+		if next > end {
+			s.size -= next - end
+		}
+		spans = append(spans, s)
+		boundary = next
+	}
+	return spans
+}
+
+// pointString returns a point in the underscore-separated form used in URLs.
+func pointString(p dvid.Point3d) string {
+	return strings.Join([]string{
+		fmt.Sprintf("%d", p[0]), fmt.Sprintf("%d", p[1]), fmt.Sprintf("%d", p[2]),
+	}, "_")
+}
@@ -0,0 +1,124 @@
+/*
+	This file supports time-lapse voxels, where data created with the "tzyx" index scheme
+	stores a 3d volume for each time point and requests select time points by query string.
+*/
+
+package voxels
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// TimeRange is an inclusive range of time points.
+type TimeRange struct {
+	Beg, End int32
+}
+
+// NumTimes returns the number of time points in the range.
+func (tr TimeRange) NumTimes() int {
+	return int(tr.End-tr.Beg) + 1
+}
+
+func (tr TimeRange) String() string {
+	if tr.Beg == tr.End {
+		return fmt.Sprintf("time %d", tr.Beg)
+	}
+	return fmt.Sprintf("times %d to %d", tr.Beg, tr.End)
+}
+
+// TimeRangeFromString parses a single time point, e.g., "3", or an inclusive range of
+// time points separated by a colon, e.g., "2:5".
+func TimeRangeFromString(s string) (TimeRange, error) {
+	var tr TimeRange
+	parts := strings.Split(s, ":")
+	if len(parts) > 2 {
+		return tr, fmt.Errorf("Illegal time range '%s': expected <time> or <begin>:<end>", s)
+	}
+	beg, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return tr, fmt.Errorf("Illegal time '%s': %s", parts[0], err.Error())
+	}
+	tr.Beg = int32(beg)
+	tr.End = tr.Beg
+	if len(parts) == 2 {
+		end, err := strconv.ParseInt(parts[1], 10, 32)
+		if err != nil {
+			return tr, fmt.Errorf("Illegal time '%s': %s", parts[1], err.Error())
+		}
+		tr.End = int32(end)
+	}
+	if tr.End < tr.Beg {
+		return tr, fmt.Errorf("Illegal time range '%s': end precedes beginning", s)
+	}
+	return tr, nil
+}
+
+// TimeRangeFromRequest returns the time points selected by the optional "time" query
+// string of an HTTP request.  Without a query string, time point 0 is selected.  Only
+// data with a timed index scheme accepts a time selection.
+func (d *Data) TimeRangeFromRequest(r *http.Request) (TimeRange, error) {
+	s := r.URL.Query().Get("time")
+	if s == "" {
+		return TimeRange{}, nil
+	}
+	if !d.IndexScheme.Timed() {
+		return TimeRange{}, fmt.Errorf("Data '%s' uses %s indexing and has no time points",
+			d.DataName(), d.IndexScheme)
+	}
+	return TimeRangeFromString(s)
+}
+
+// NewTimedExtHandler returns an ExtHandler like NewExtHandler for voxels at a time point.
+func (d *Data) NewTimedExtHandler(geom dvid.Geometry, img interface{}, t int32) (ExtHandler, error) {
+	e, err := d.NewExtHandler(geom, img)
+	if err != nil {
+		return nil, err
+	}
+	e.(*Voxels).SetTime(t)
+	return e, nil
+}
+
+// GetTimeVolumes retrieves the subvolume given by a geometry for each time point in the
+// range.  The returned data holds the subvolumes in time order, so time is the slowest
+// changing dimension.
+func (d *Data) GetTimeVolumes(ctx context.Context, uuid dvid.UUID, geom dvid.Geometry, times TimeRange) ([]byte, error) {
+	numVoxels := geom.NumVoxels() * int64(times.NumTimes())
+	if numVoxels > MaxVoxelsRequest {
+		return nil, fmt.Errorf("Requested # voxels (%d) exceeds this DVID server's set limit (%d)",
+			numVoxels, MaxVoxelsRequest)
+	}
+	data := make([]byte, 0, numVoxels*int64(d.Values().BytesPerElement()))
+	for t := times.Beg; t <= times.End; t++ {
+		e, err := d.NewTimedExtHandler(geom, nil, t)
+		if err != nil {
+			return nil, err
+		}
+		volume, err := GetVolume(ctx, uuid, d, e)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, volume...)
+	}
+	return data, nil
+}
+
+// CheckTimeRequestBudget returns an error if the predicted cost of processing the
+// geometry at every time point exceeds any budget given in the HTTP request.
+func CheckTimeRequestBudget(i IntHandler, geom dvid.Geometry, times TimeRange, r *http.Request) error {
+	budget, err := BudgetFromRequest(r)
+	if err != nil {
+		return err
+	}
+	cost := EstimateCost(i, geom)
+	n := times.NumTimes()
+	cost.Blocks *= n
+	cost.Bytes *= int64(n)
+	cost.Seconds *= float64(n)
+	return budget.Check(cost)
+}
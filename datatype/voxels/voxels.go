@@ -4,6 +4,8 @@
 package voxels
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
@@ -56,9 +58,19 @@ $ dvid dataset <UUID> new <type name> <data name> <settings...>
     Configuration Settings (case-insensitive keys)
 
     Versioned      "true" or "false" (default)
-    BlockSize      Size in pixels  (default: %s)
+    BlockSize      Size of blocks in voxels: a single value for cubic blocks, or a size per
+                     axis for anisotropic blocks, e.g., "64,64,8".  It can only be set at
+                     creation.  (default: %d)
     VoxelSize      Resolution of voxels (default: 10.0, 10.0, 10.0)
     VoxelUnits     Resolution units (default: "nanometers")
+    IndexScheme    Ordering of blocks in keys: "zyx" (default), "hilbert", or "tzyx".  Hilbert
+                     ordering keeps nearby blocks together so subvolume requests read fewer key
+                     ranges, while zyx is better for XY slices.  The "tzyx" scheme stores a
+                     time-lapse volume for each time point selected by the "time" query string
+                     of raw and isotropic requests.  It can only be set at creation.
+    Changelog      "true" or "false" (default).  If true, each PUT of voxels is logged as a
+                     "put" event with an {"Offset": [x,y,z], "Size": [nx,ny,nz]} payload that
+                     can be read from the changelog endpoint of the node API.
 
 $ dvid node <UUID> <data name> load <offset> <image glob>
 
@@ -129,6 +141,80 @@ GET  <api URL>/node/<UUID>/<data name>/metadata
 	of bytes returned for n-d images.
 
 
+GET  <api URL>/node/<UUID>/<data name>/estimate/<dims>/<size>/<offset>
+
+    Returns JSON with the predicted cost of a request for the given voxels without
+    retrieving them.  The estimate includes the number of intersecting blocks, the
+    uncompressed bytes to be processed, and the predicted seconds based on block
+    throughput recently observed by this server.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/grayscale/estimate/0_1_2/512_512_256/0_0_100
+
+    Returns {"Blocks":2048,"Bytes":67108864,"Seconds":1.02}.
+
+    GETs and POSTs of voxels by <dims>/<size>/<offset> also accept budget query strings
+    and will be aborted without processing, with HTTP status 503 (Service Unavailable),
+    if their estimate exceeds the budget:
+
+    maxblocks     Maximum number of blocks.
+    maxbytes      Maximum uncompressed bytes.
+    maxseconds    Maximum predicted seconds.
+
+    Budgets only apply to these reads and writes of voxels, not to stats, exports, or
+    other computations derived from the data.
+
+    A GET of a 3d subvolume that exceeds a budget or this server's limit on voxels per
+    request is normally rejected.  If the query string includes "tile=true", the server
+    instead responds with HTTP status 303 (See Other) and a JSON manifest of
+    block-aligned tiles, each with the URL of a GET within the limits, that together
+    cover the requested subvolume.  Tiles at the edges of the subvolume are clipped to
+    it and may cover partial blocks:
+
+    {"Offset":[0,0,0],"Size":[4096,4096,2048],"TileSize":[2048,2048,1024],
+     "Reason":"...","Tiles":[{"Offset":[0,0,0],"Size":[2048,2048,1024],"URL":"..."},...]}
+
+
+GET  <api URL>/node/<UUID>/<data name>/coverage[?<options>]
+
+    Returns JSON describing which blocks are stored in the version node, grouped into
+    slabs of blocks with the same Z block coordinate.  The response also gives the
+    extents in blocks and voxels coalesced from the stored blocks.
+
+    Example:
+
+    GET <api URL>/node/3f8c/grayscale/coverage?format=bitmask
+
+    Query-string Options:
+
+    format        "rle" (default) lists each slab's blocks as [y, first x, last x] runs
+                    along x in block coordinates.  "bitmask" gives each slab a base64
+                    bitmask with a bit per block within the x and y block extents, x
+                    changing fastest and the first block in the least significant bit.
+    time          For data with "tzyx" IndexScheme, the time point (default 0).
+
+
+GET  <api URL>/node/<UUID>/<data name>/provenance/<block coord>[?time=<t>]
+
+    Returns JSON giving the version node that last wrote a block as read at the given
+    node, which is the node itself or the ancestor whose stored block it inherits.
+    "Owner" is omitted if the block is not stored.
+
+    Example:
+
+    GET <api URL>/node/3f8c/grayscale/provenance/10_20_3
+
+    Returns {"Name":"grayscale","Index":"...","Node":"3f8c...","Owner":"a2b1...",
+    "Inherited":true,"Bytes":18302} if block (10,20,3) was last written at node a2b1.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of voxels data.
+    block coord   Block coordinate with "_" as separator, e.g., "10_20_3".
+
+
 GET  <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>]
 POST <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>]
 
@@ -159,7 +245,21 @@ POST <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>]
                     available in server implementation.
                   2D: "png", "jpg" (default: "png")
                     jpg allows lossy quality setting, e.g., "jpg:80"
-                  nD: uses default "octet-stream".
+                  nD: "octet-stream" (default) or "nrrd".  NRRD data is preceded by a header
+                    giving the value type, sizes, and spacings from the voxel resolution.
+                    POSTed NRRD must match the data's value type and the requested size, and
+                    may use raw or gzip encoding in either byte order.
+
+    Query-string Options:
+
+    resample      If "isotropic", a 2D slice covering the requested voxels is resampled so
+                    pixels have the finer of the slice's two voxel resolutions.  For example,
+                    GET <api URL>/node/3f8c/grayscale/raw/xz/512_100/0_0_100?resample=isotropic
+                    with X resolution 10 nm and Z resolution 40 nm returns a 512 x 400 image.
+    time          For data with "tzyx" IndexScheme, the time point (default 0), e.g., "time=3".
+                    GETs of 3d subvolumes also accept an inclusive range of time points, e.g.,
+                    "time=2:5", and return the subvolumes in time order so time is the slowest
+                    changing dimension.
 
 GET  <api URL>/node/<UUID>/<data name>/isotropic/<dims>/<size>/<offset>[/<format>]
 
@@ -194,6 +294,63 @@ GET  <api URL>/node/<UUID>/<data name>/isotropic/<dims>/<size>/<offset>[/<format
                     jpg allows lossy quality setting, e.g., "jpg:80"
                   nD: uses default "octet-stream".
 
+GET  <api URL>/node/<UUID>/<data name>/patches/<size>/<roi offset>/<roi size>/<number>[?<options>]
+
+    Retrieves a batch of randomly positioned 3d patches within a region of interest,
+    optionally paired with label patches at the same positions.  This allows machine
+    learning workflows to stream training data directly from DVID.
+
+    Example:
+
+    GET <api URL>/node/3f8c/grayscale/patches/64_64_32/0_0_100/1000_1000_500/16?labels=bodies&augment=true
+
+    Returns JSON with 16 patches of size 64 x 64 x 32 voxels fully contained within
+    the 1000 x 1000 x 500 box with offset (0,0,100).  Each patch includes its offset,
+    any augmentation applied, and base64-encoded "Raw" and "Labels" voxel data packed
+    in x, y, then z order.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of raw voxels data.
+    size          Size of each patch in voxels in the format "dx_dy_dz".
+    roi offset    Offset of the sampled region in the format "x_y_z".
+    roi size      Size of the sampled region in the format "dx_dy_dz".
+    number        Number of patches to return (maximum 1024).  All patches together can hold
+                    at most 33554432 voxels.
+
+    Query-string Options:
+
+    labels        Name of voxels-based data, e.g., labels64, from which label patches are read.
+    augment       If "true", each patch pair is identically flipped along random axes and,
+                    if the patch is square in XY, rotated by a random multiple of 90 degrees.
+    seed          Integer seed for the random number generator to allow reproducible batches.
+
+POST <api URL>/node/<UUID>/<data name>/inference/<size>/<offset>/<halo>[/<mode>]
+
+    Ingests a chunk of packed voxels produced by sliding-window inference, where the chunk
+    includes a halo of context voxels that overlaps adjacent chunks.
+
+    Example:
+
+    POST <api URL>/node/3f8c/probabilities/inference/80_80_80/-8_-8_-8/8_8_8/blend
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of voxels data.
+    size          Size of the full chunk including halo in the format "dx_dy_dz".
+    offset        Offset of the full chunk including halo in the format "x_y_z".
+    halo          Width of the halo along each axis in the format "hx_hy_hz".
+    mode          "crop" (default) discards the halo and writes only the chunk interior.
+                  "blend" linearly weights voxels within twice the halo width of each face
+                    and averages them with the weights of chunks already blended, so adjacent
+                    chunks overlapping by twice the halo cross-fade.  Resending a blended chunk
+                    has no effect, while sending different contents for it is an error.
+                    Only 8-bit values, e.g., probability maps, can be blended.
+
+    The body must be the packed voxels of the chunk and cannot be larger.
+
 (TO DO)
 
 GET  <api URL>/node/<UUID>/<data name>/arb/<center>/<normal>/<size>[/<format>]
@@ -237,6 +394,22 @@ func init() {
 type Operation struct {
 	ExtHandler
 	OpType
+
+	// blocks, if not nil, receives the blocks written by a PUT so they are committed
+	// together with the PUT's changelog event.
+	blocks *blockBatch
+}
+
+// blockBatch is a storage batch shared by concurrent chunk handlers.
+type blockBatch struct {
+	sync.Mutex
+	storage.Batch
+}
+
+func (b *blockBatch) put(k storage.Key, v []byte) {
+	b.Lock()
+	b.Batch.Put(k, v)
+	b.Unlock()
 }
 
 type OpType int
@@ -348,50 +521,51 @@ type VoxelSetter interface {
 }
 
 // GetImage retrieves a 2d image from a version node given a geometry of voxels.
-func GetImage(uuid dvid.UUID, i IntHandler, e ExtHandler) (*dvid.Image, error) {
-	if err := GetVoxels(uuid, i, e); err != nil {
+func GetImage(ctx context.Context, uuid dvid.UUID, i IntHandler, e ExtHandler) (*dvid.Image, error) {
+	if err := GetVoxels(ctx, uuid, i, e); err != nil {
 		return nil, err
 	}
 	return e.GetImage2d()
 }
 
 // GetVolume retrieves a n-d volume from a version node given a geometry of voxels.
-func GetVolume(uuid dvid.UUID, i IntHandler, e ExtHandler) ([]byte, error) {
-	if err := GetVoxels(uuid, i, e); err != nil {
+func GetVolume(ctx context.Context, uuid dvid.UUID, i IntHandler, e ExtHandler) ([]byte, error) {
+	if err := GetVoxels(ctx, uuid, i, e); err != nil {
 		return nil, err
 	}
 	return e.Data(), nil
 }
 
 // GetVoxels copies voxels from an IntHandler for a version to an ExtHandler, e.g.,
-// a requested subvolume or 2d image.
-func GetVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
+// a requested subvolume or 2d image.  If the context is canceled, e.g., because the
+// client disconnected, no more blocks are read and the context's error is returned.
+func GetVoxels(ctx context.Context, uuid dvid.UUID, i IntHandler, e ExtHandler) error {
+	startTime := time.Now()
 	db, err := server.KeyValueGetter()
 	if err != nil {
 		return err
 	}
 
 	service := server.DatastoreService()
-	_, versionID, err := service.LocalIDFromUUID(uuid)
+	dataID := i.DataID()
+	versions, err := service.DataVersions(uuid, dataID.DataName())
 	if err != nil {
 		return err
 	}
 
 	wg := new(sync.WaitGroup)
-	chunkOp := &storage.ChunkOp{&Operation{e, GetOp}, wg}
-	dataID := i.DataID()
+	chunkOp := &storage.ChunkOp{&Operation{ExtHandler: e, OpType: GetOp}, wg}
 	server.SpawnGoroutineMutex.Lock()
-	for it, err := e.IndexIterator(i.BlockSize()); err == nil && it.Valid(); it.NextSpan() {
+	for it, err := mergedIndexIterator(i, e); err == nil && it.Valid(); it.NextSpan() {
 		indexBeg, indexEnd, err := it.IndexSpan()
 		if err != nil {
 			server.SpawnGoroutineMutex.Unlock()
 			return err
 		}
-		startKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, indexBeg}
-		endKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, indexEnd}
 
-		// Send the entire range of key/value pairs to ProcessChunk()
-		err = db.ProcessRange(startKey, endKey, chunkOp, i.ProcessChunk)
+		// Send the entire range of key/value pairs, including those inherited from
+		// ancestor versions, to ProcessChunk()
+		err = datastore.ProcessVersionedRange(ctx, db, dataID, versions, indexBeg, indexEnd, chunkOp, i.ProcessChunk)
 		if err != nil {
 			server.SpawnGoroutineMutex.Unlock()
 			return fmt.Errorf("Unable to GET data %s: %s", dataID.DataName(), err.Error())
@@ -403,35 +577,75 @@ func GetVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
 	}
 
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	recordThroughput(dvid.GetNumBlocks(e, i.BlockSize()), time.Since(startTime))
 	return nil
 }
 
+// mergedIndexIterator returns an iterator for the ExtHandler whose spans are merged
+// wherever the stored block extents allow, so whole rows of stored blocks are read
+// with fewer range queries.
+func mergedIndexIterator(i IntHandler, e ExtHandler) (dvid.IndexIterator, error) {
+	it, err := e.IndexIterator(i.BlockSize())
+	if err != nil {
+		return nil, err
+	}
+	extents := i.Extents()
+	extents.indexMu.Lock()
+	minIndex, maxIndex := extents.MinIndex, extents.MaxIndex
+	extents.indexMu.Unlock()
+	if minIndex == nil || maxIndex == nil || minIndex.NumDims() != 3 || maxIndex.NumDims() != 3 {
+		return it, nil
+	}
+	minBlock := dvid.ChunkPoint3d{minIndex.Value(0), minIndex.Value(1), minIndex.Value(2)}
+	maxBlock := dvid.ChunkPoint3d{maxIndex.Value(0), maxIndex.Value(1), maxIndex.Value(2)}
+	return dvid.NewSpanMergingIterator(it, minBlock, maxBlock), nil
+}
+
 // PutVoxels copies voxels from an ExtHander (e.g., subvolume or 2d image) into an IntHandler
 // for a version.   Since chunk sizes can be larger than the PUT data, this also requires
 // integrating the PUT data into current chunks before writing the result.  There are two passes:
 //   Pass one: Retrieve all available key/values within the PUT space.
 //   Pass two: Merge PUT data into those key/values and store them.
-func PutVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
+// The blocks are committed with the PUT's changelog event once all are written, so if
+// the context is canceled, none of the PUT data is stored.
+func PutVoxels(ctx context.Context, uuid dvid.UUID, i IntHandler, e ExtHandler) error {
+	return putVoxels(ctx, uuid, i, e, true)
+}
+
+// putVoxels does a PutVoxels, taking the PUT lock of the version unless the caller
+// already holds it.
+func putVoxels(ctx context.Context, uuid dvid.UUID, i IntHandler, e ExtHandler, lock bool) error {
 	db, err := server.KeyValueGetter()
 	if err != nil {
 		return err
 	}
 
 	service := server.DatastoreService()
-	_, versionID, err := service.LocalIDFromUUID(uuid)
+	dataID := i.DataID()
+	versions, err := service.DataVersions(uuid, dataID.DataName())
 	if err != nil {
 		return err
 	}
+	versionID := versions[0]
 
+	batcher, err := server.Batcher()
+	if err != nil {
+		return err
+	}
+	blocks := &blockBatch{Batch: batcher.NewBatch()}
 	wg := new(sync.WaitGroup)
-	chunkOp := &storage.ChunkOp{&Operation{e, PutOp}, wg}
-	dataID := i.DataID()
+	chunkOp := &storage.ChunkOp{&Operation{ExtHandler: e, OpType: PutOp, blocks: blocks}, wg}
 
 	// We only want one PUT on given version for given data to prevent interleaved
 	// chunk PUTs that could potentially overwrite slice modifications.
-	versionMutex := i.VersionMutex(versionID)
-	versionMutex.Lock()
-	defer versionMutex.Unlock()
+	if lock {
+		versionMutex := i.VersionMutex(versionID)
+		versionMutex.Lock()
+		defer versionMutex.Unlock()
+	}
 
 	// Keep track of changing extents and mark dataset as dirty if changed.
 	var extentChanged bool
@@ -451,26 +665,22 @@ func PutVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
 	}
 
 	// Iterate through index space for this data.
+	var written []dvid.Index
 	for it, err := e.IndexIterator(i.BlockSize()); err == nil && it.Valid(); it.NextSpan() {
-		i0, i1, err := it.IndexSpan()
+		indices, err := spanIndices(e, it)
 		if err != nil {
 			return err
 		}
-		ptBeg := i0.Duplicate().(dvid.ChunkIndexer)
-		ptEnd := i1.Duplicate().(dvid.ChunkIndexer)
-
-		begX := ptBeg.Value(0)
-		endX := ptEnd.Value(0)
-
-		if extents.AdjustIndices(ptBeg, ptEnd) {
-			extentChanged = true
+		for _, index := range indices {
+			written = append(written, index)
+			if extents.AdjustIndices(index, index) {
+				extentChanged = true
+			}
 		}
 
-		startKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, ptBeg}
-		endKey := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, ptEnd}
-
-		// GET all the key/value pairs for this range.
-		keyvalues, err := db.GetRange(startKey, endKey)
+		// GET all the key/value pairs for this range, including those inherited from
+		// ancestor versions.
+		keyvalues, err := datastore.GetVersionedRange(ctx, db, dataID, versions, indices[0], indices[len(indices)-1])
 		if err != nil {
 			return fmt.Errorf("Error in reading data during PUT %s: %s", dataID.DataName(), err.Error())
 		}
@@ -482,11 +692,9 @@ func PutVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
 		if numOldkv > 0 {
 			oldkv = keyvalues[oldI]
 		}
-		wg.Add(int(endX-begX) + 1)
-		c := dvid.ChunkPoint3d{begX, ptBeg.Value(1), ptBeg.Value(2)}
-		for x := begX; x <= endX; x++ {
-			c[0] = x
-			key := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, e.Index(c)}
+		wg.Add(len(indices))
+		for _, index := range indices {
+			key := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, index}
 			// Check for this key among old key-value pairs and if so,
 			// send the old value into chunk handler.
 			if oldkv.K != nil {
@@ -494,7 +702,7 @@ func PutVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
 				if err != nil {
 					return err
 				}
-				if indexer.Value(0) == x {
+				if bytes.Equal(indexer.Bytes(), index.Bytes()) {
 					kv = oldkv
 					oldI++
 					if oldI < numOldkv {
@@ -508,22 +716,99 @@ func PutVoxels(uuid dvid.UUID, i IntHandler, e ExtHandler) error {
 			} else {
 				kv = storage.KeyValue{K: key}
 			}
-			// TODO -- Pass batch write via chunkOp and group all PUTs
-			// together at once.  Should increase write speed, particularly
-			// since the PUTs are using mostly sequential keys.
 			i.ProcessChunk(&storage.Chunk{chunkOp, kv})
 		}
 	}
 
+	// Commit all written blocks at once with the changelog event of the PUT.
 	wg.Wait()
+	dataservice, ok := i.(datastore.DataService)
+	if !ok {
+		return blocks.Commit()
+	}
+	event := datastore.MutationEvent{Type: "put", Payload: VoxelsEvent{e.StartPoint(), e.Size()}}
+	if err := service.CommitEvents(blocks.Batch, dataservice, uuid, event); err != nil {
+		return err
+	}
+	service.Invalidate(dataservice, uuid, written)
+	return nil
+}
+
+// VoxelsEvent is the changelog payload of a PUT of voxels within a box.
+type VoxelsEvent struct {
+	Offset dvid.Point
+	Size   dvid.Point
+}
+
+// PutStoredValue stores a serialized block, e.g., one read through GetValue on another
+// server, at a version of voxels data.  Like a PUT of voxels, it holds the version's PUT
+// lock, adjusts the extents, and logs the block's box in the changelog.
+func (d *Data) PutStoredValue(uuid dvid.UUID, versionID dvid.VersionLocalID, index dvid.Index,
+	value []byte) error {
+
+	decoded, err := d.DecodeIndex(index.Bytes())
+	if err != nil {
+		return fmt.Errorf("Bad block index for data '%s': %s", d.DataName(), err.Error())
+	}
+	indexer, ok := decoded.(dvid.ChunkIndexer)
+	if !ok {
+		return fmt.Errorf("Block index of '%s' is not a ChunkIndexer", d.DataName())
+	}
+	batcher, err := server.Batcher()
+	if err != nil {
+		return err
+	}
+
+	versionMutex := d.VersionMutex(versionID)
+	versionMutex.Lock()
+	defer versionMutex.Unlock()
+
+	batch := batcher.NewBatch()
+	batch.Put(d.DataKey(versionID, indexer), value)
+	event := datastore.MutationEvent{Type: "put",
+		Payload: VoxelsEvent{indexer.MinPoint(d.BlockSize()), d.BlockSize()}}
+	service := server.DatastoreService()
+	if err := service.CommitEvents(batch, d, uuid, event); err != nil {
+		return err
+	}
+	if d.Extents().AdjustIndices(indexer, indexer) {
+		if err := service.SaveDataset(uuid); err != nil {
+			dvid.Log(dvid.Normal, "Error in trying to save dataset on change: %s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+// Replicated extends the extents of this data to those of the same data replicated from
+// another server, which may hold blocks outside this server's extents.
+func (d *Data) Replicated(source datastore.DataService) error {
+	replica, ok := source.(IntHandler)
+	if !ok {
+		return fmt.Errorf("Data '%s' replicated from another server is not voxels data", d.DataName())
+	}
+	extents := replica.Extents()
+	if extents.MinPoint != nil && extents.MaxPoint != nil {
+		d.Extents().AdjustPoints(extents.MinPoint, extents.MaxPoint)
+	}
+	if extents.MinIndex != nil && extents.MaxIndex != nil {
+		d.Extents().AdjustIndices(extents.MinIndex, extents.MaxIndex)
+	}
 	return nil
 }
 
+// LoadEvent is the changelog payload of a bulk load of image files.  Blocks are written
+// in many batches, so the event is logged once all are written.
+type LoadEvent struct {
+	Filenames []string
+}
+
 type bulkLoadInfo struct {
 	filenames     []string
 	versionID     dvid.VersionLocalID
+	versions      []dvid.VersionLocalID
 	offset        dvid.Point
 	extentChanged dvid.Bool
+	job           *datastore.Job
 }
 
 func loadHDF(i IntHandler, load *bulkLoadInfo) error {
@@ -631,7 +916,7 @@ func loadXYImages(i IntHandler, load *bulkLoadInfo) error {
 					blocks[curBlocks][i].V = make([]byte, blockBytes, blockBytes)
 				}
 			}
-			err = loadOldBlocks(i, e, blocks[curBlocks], load.versionID)
+			err = loadOldBlocks(i, e, blocks[curBlocks], load.versions)
 			if err != nil {
 				return err
 			}
@@ -679,6 +964,7 @@ func loadXYImages(i IntHandler, load *bulkLoadInfo) error {
 			dvid.Log(dvid.Debug, "Using layer %d...\n", curBlocks)
 		}
 
+		load.job.Progress(int64(fileNum), int64(len(load.filenames)))
 		fileNum++
 		load.offset = load.offset.Add(dvid.Point3d{0, 0, 1})
 		dvid.ElapsedTime(dvid.Debug, sliceTime, "Loaded %s slice %s", i, e)
@@ -788,10 +1074,11 @@ func LoadImages(i IntHandler, uuid dvid.UUID, offset dvid.Point, filenames []str
 	startTime := time.Now()
 
 	service := server.DatastoreService()
-	_, versionID, err := service.LocalIDFromUUID(uuid)
+	versions, err := service.DataVersions(uuid, i.DataID().DataName())
 	if err != nil {
 		return err
 	}
+	versionID := versions[0]
 
 	// We only want one PUT on given version for given data to prevent interleaved
 	// chunk PUTs that could potentially overwrite slice modifications.
@@ -799,8 +1086,11 @@ func LoadImages(i IntHandler, uuid dvid.UUID, offset dvid.Point, filenames []str
 	versionMutex.Lock()
 
 	// Handle cleanup given multiple goroutines still writing data.
-	load := &bulkLoadInfo{filenames: filenames, versionID: versionID, offset: offset}
+	name := fmt.Sprintf("load %d files into '%s' at %s", len(filenames), i.DataID().DataName(), uuid)
+	job := datastore.StartJob("load", name, datastore.JobLimits{})
+	load := &bulkLoadInfo{filenames: filenames, versionID: versionID, versions: versions, offset: offset, job: job}
 	defer func() {
+		job.Finish()
 		versionMutex.Unlock()
 
 		if load.extentChanged.Value() {
@@ -814,17 +1104,25 @@ func LoadImages(i IntHandler, uuid dvid.UUID, offset dvid.Point, filenames []str
 	// Use different loading techniques if we have a potentially multidimensional HDF5 file
 	// or many 2d images.
 	if dvid.Filename(filenames[0]).HasExtensionPrefix("hdf", "h5") {
-		loadHDF(i, load)
+		err = loadHDF(i, load)
 	} else {
-		loadXYImages(i, load)
+		err = loadXYImages(i, load)
+	}
+	job.SetResult(nil, err)
+	if dataservice, ok := i.(datastore.DataService); ok {
+		service.Invalidate(dataservice, uuid, nil)
+		if _, err := service.AppendEvent(dataservice, uuid, "load", LoadEvent{filenames}); err != nil {
+			dvid.Error("Unable to log load into '%s': %s", i.DataID().DataName(), err.Error())
+		}
 	}
 
 	dvid.ElapsedTime(dvid.Debug, startTime, "RPC load of %d files completed", len(filenames))
 	return nil
 }
 
-// Loads blocks with old data if they exist.
-func loadOldBlocks(i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.VersionLocalID) error {
+// Loads blocks with old data if they exist, including blocks inherited from ancestor
+// versions.  The first version is the one being loaded.
+func loadOldBlocks(i IntHandler, e ExtHandler, blocks Blocks, versions []dvid.VersionLocalID) error {
 	db, err := server.KeyValueGetter()
 	if err != nil {
 		return err
@@ -844,9 +1142,7 @@ func loadOldBlocks(i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.Ver
 		}
 
 		// Get previous data.
-		keyBeg := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, indexBeg}
-		keyEnd := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, indexEnd}
-		keyvalues, err := db.GetRange(keyBeg, keyEnd)
+		keyvalues, err := datastore.GetVersionedRange(context.Background(), db, dataID, versions, indexBeg, indexEnd)
 		if err != nil {
 			return err
 		}
@@ -864,14 +1160,12 @@ func loadOldBlocks(i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.Ver
 			}
 		}
 
-		ptBeg := indexBeg.Duplicate().(dvid.ChunkIndexer)
-		ptEnd := indexEnd.Duplicate().(dvid.ChunkIndexer)
-		begX := ptBeg.Value(0)
-		endX := ptEnd.Value(0)
-		c := dvid.ChunkPoint3d{begX, ptBeg.Value(1), ptBeg.Value(2)}
-		for x := begX; x <= endX; x++ {
-			c[0] = x
-			key := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, e.Index(c)}
+		indices, err := spanIndices(e, it)
+		if err != nil {
+			return err
+		}
+		for _, index := range indices {
+			key := &datastore.DataKey{dataID.DsetID, dataID.ID, versions[0], index}
 			blocks[blockNum].K = key
 			block, ok := oldBlocks[key.Index.String()]
 			if ok {
@@ -883,6 +1177,33 @@ func loadOldBlocks(i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.Ver
 	return nil
 }
 
+// spanIndices returns the chunk indices within the current span of an iterator.
+// Unless the iterator lists them, a span is a run of chunks along the x axis.
+func spanIndices(e ExtHandler, it dvid.IndexIterator) ([]dvid.ChunkIndexer, error) {
+	if lister, ok := it.(dvid.IndexSpanLister); ok {
+		return lister.SpanIndices(), nil
+	}
+	indexBeg, indexEnd, err := it.IndexSpan()
+	if err != nil {
+		return nil, err
+	}
+	ptBeg := indexBeg.(dvid.ChunkIndexer)
+	ptEnd := indexEnd.(dvid.ChunkIndexer)
+	begX := ptBeg.Value(0)
+	endX := ptEnd.Value(0)
+	indices := make([]dvid.ChunkIndexer, 0, endX-begX+1)
+	c := dvid.ChunkPoint3d{begX, ptBeg.Value(1), ptBeg.Value(2)}
+	for x := begX; x <= endX; x++ {
+		c[0] = x
+		index, ok := e.Index(c).(dvid.ChunkIndexer)
+		if !ok {
+			return nil, fmt.Errorf("Index for chunk %s is not a ChunkIndexer", c)
+		}
+		indices = append(indices, index)
+	}
+	return indices, nil
+}
+
 // Writes a XY image (the ExtHandler) into the blocks that intersect it.
 // This function assumes the blocks have been allocated and if necessary, filled
 // with old data.
@@ -900,30 +1221,24 @@ func writeXYImage(i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.Vers
 	var startingBlock int32
 
 	for it, err := e.IndexIterator(blockSize); err == nil && it.Valid(); it.NextSpan() {
-		indexBeg, indexEnd, err := it.IndexSpan()
+		indices, err := spanIndices(e, it)
 		if err != nil {
 			return extentChanged, err
 		}
 
-		ptBeg := indexBeg.Duplicate().(dvid.ChunkIndexer)
-		ptEnd := indexEnd.Duplicate().(dvid.ChunkIndexer)
-
 		// Track point extents
-		if i.Extents().AdjustIndices(ptBeg, ptEnd) {
-			extentChanged = true
+		for _, index := range indices {
+			if i.Extents().AdjustIndices(index, index) {
+				extentChanged = true
+			}
 		}
 
 		// Do image -> block transfers in concurrent goroutines.
-		begX := ptBeg.Value(0)
-		endX := ptEnd.Value(0)
-
 		<-server.HandlerToken
 		wg.Add(1)
 		go func(blockNum int32) {
-			c := dvid.ChunkPoint3d{begX, ptBeg.Value(1), ptBeg.Value(2)}
-			for x := begX; x <= endX; x++ {
-				c[0] = x
-				key := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, e.Index(c)}
+			for _, index := range indices {
+				key := &datastore.DataKey{dataID.DsetID, dataID.ID, versionID, index}
 				blocks[blockNum].K = key
 
 				// Write this slice data into the block.
@@ -934,7 +1249,7 @@ func writeXYImage(i IntHandler, e ExtHandler, blocks Blocks, versionID dvid.Vers
 			wg.Done()
 		}(startingBlock)
 
-		startingBlock += (endX - begX + 1)
+		startingBlock += int32(len(indices))
 	}
 	return
 }
@@ -1000,6 +1315,13 @@ func transferBlock(op OpType, v ExtHandler, block *Block, blockSize dvid.Point)
 	dataBeg := opBounds.dataBeg
 	dataEnd := opBounds.dataEnd
 
+	// Blocks read through merged spans may not intersect the external voxels.
+	for dim := uint8(0); dim < dataBeg.NumDims(); dim++ {
+		if dataBeg.Value(dim) > dataEnd.Value(dim) {
+			return nil
+		}
+	}
+
 	// Compute the strides (in bytes)
 	bX := blockSize.Value(0) * bytesPerVoxel
 	bY := blockSize.Value(1) * bX
@@ -1130,12 +1452,18 @@ type Voxels struct {
 	stride int32
 
 	byteOrder binary.ByteOrder
+
+	// The indexing scheme of the data these voxels are read from or written to.
+	scheme dvid.IndexScheme
+
+	// The time point of these voxels if the indexing scheme is timed.
+	time int32
 }
 
 func NewVoxels(geom dvid.Geometry, values dvid.DataValues, data []byte, stride int32,
 	byteOrder binary.ByteOrder) *Voxels {
 
-	return &Voxels{geom, values, data, stride, byteOrder}
+	return &Voxels{geom, values, data, stride, byteOrder, dvid.ZYXScheme, 0}
 }
 
 func (v *Voxels) String() string {
@@ -1187,6 +1515,16 @@ func (v *Voxels) SetData(data []byte) {
 	v.data = data
 }
 
+// Time returns the time point of these voxels for data with a timed index scheme.
+func (v *Voxels) Time() int32 {
+	return v.time
+}
+
+// SetTime sets the time point of these voxels for data with a timed index scheme.
+func (v *Voxels) SetTime(t int32) {
+	v.time = t
+}
+
 // -------  ExtHandler interface implementation -------------
 
 func (v *Voxels) Interpolable() bool {
@@ -1234,7 +1572,7 @@ func (v *Voxels) DownRes(magnification dvid.Point) error {
 }
 
 func (v *Voxels) Index(c dvid.ChunkPoint) dvid.Index {
-	return dvid.IndexZYX(c.(dvid.ChunkPoint3d))
+	return v.scheme.ChunkIndexAt(v.time, c.(dvid.ChunkPoint3d))
 }
 
 // IndexIterator returns an iterator that can move across the voxel geometry,
@@ -1252,7 +1590,7 @@ func (v *Voxels) IndexIterator(chunkSize dvid.Point) (dvid.IndexIterator, error)
 	begBlock := begVoxel.Chunk(chunkSize).(dvid.ChunkPoint3d)
 	endBlock := endVoxel.Chunk(chunkSize).(dvid.ChunkPoint3d)
 
-	return dvid.NewIndexZYXIterator(v.Geometry, begBlock, endBlock), nil
+	return v.scheme.NewIteratorAt(v.time, v.Geometry, begBlock, endBlock), nil
 }
 
 // GetImage2d returns a 2d image suitable for use external to DVID.
@@ -1370,6 +1708,15 @@ func (dtype *Datatype) NewData(id *datastore.DataID, config dvid.Config) (*Data,
 	if err := props.SetByConfig(config); err != nil {
 		return nil, err
 	}
+	s, found, err := config.GetString("IndexScheme")
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		if props.IndexScheme, err = dvid.IndexSchemeFromString(s); err != nil {
+			return nil, err
+		}
+	}
 	data := &Data{
 		Data:       *basedata,
 		Properties: *props,
@@ -1443,6 +1790,29 @@ func (ext *Extents) AdjustIndices(indexBeg, indexEnd dvid.ChunkIndexer) bool {
 	return changed
 }
 
+// ShrinkTo sets the index extents to the given block indices, e.g., after blocks were
+// deleted, and clips the point extents to those blocks.  Nil indices clear the extents.
+func (ext *Extents) ShrinkTo(minIndex, maxIndex dvid.ChunkIndexer, blockSize dvid.Point) {
+	ext.indexMu.Lock()
+	ext.MinIndex, ext.MaxIndex = minIndex, maxIndex
+	ext.indexMu.Unlock()
+
+	ext.pointMu.Lock()
+	defer ext.pointMu.Unlock()
+	if minIndex == nil || maxIndex == nil {
+		ext.MinPoint, ext.MaxPoint = nil, nil
+		return
+	}
+	minPoint, maxPoint := minIndex.MinPoint(blockSize), maxIndex.MaxPoint(blockSize)
+	if ext.MinPoint != nil {
+		minPoint, _ = minPoint.Max(ext.MinPoint)
+	}
+	if ext.MaxPoint != nil {
+		maxPoint, _ = maxPoint.Min(ext.MaxPoint)
+	}
+	ext.MinPoint, ext.MaxPoint = minPoint, maxPoint
+}
+
 type Resolution struct {
 	// Resolution of voxels in volume
 	VoxelSize dvid.NdFloat32
@@ -1464,8 +1834,15 @@ type Properties struct {
 	// The endianness of this loaded data.
 	ByteOrder binary.ByteOrder
 
+	// IndexScheme orders blocks into keys and can only be set at instance creation.
+	IndexScheme dvid.IndexScheme
+
 	Resolution
 	Extents
+
+	// Available is the range of block indices stored at this server if only part of
+	// the data was cloned, or empty if all data is available.
+	Available dvid.IndexRange
 }
 
 type Metadata struct {
@@ -1479,6 +1856,7 @@ type Axis struct {
 	Units      string
 	Size       int32
 	Offset     int32
+	BlockSize  int32
 }
 
 // TODO -- Allow explicit setting of axes labels.
@@ -1513,6 +1891,34 @@ func (props *Properties) SetDefault(values dvid.DataValues, interpolable bool) e
 	return nil
 }
 
+// blockSizeFromString returns a block size from either a single value, which gives cubic
+// blocks with the dimensionality of the current block size, or a comma-separated size
+// per axis.  Each size must be positive.
+func blockSizeFromString(s string, current dvid.Point) (dvid.Point, error) {
+	dims := 3
+	if current != nil {
+		dims = int(current.NumDims())
+	}
+	elems := strings.Split(s, ",")
+	if len(elems) == 1 {
+		for len(elems) < dims {
+			elems = append(elems, elems[0])
+		}
+	} else if len(elems) != dims {
+		return nil, fmt.Errorf("Block size '%s' must give 1 or %d sizes", s, dims)
+	}
+	size, err := dvid.StringToPoint(strings.Join(elems, ","), ",")
+	if err != nil {
+		return nil, err
+	}
+	for dim := uint8(0); dim < size.NumDims(); dim++ {
+		if size.Value(dim) <= 0 {
+			return nil, fmt.Errorf("Block size '%s' must be positive along each axis", s)
+		}
+	}
+	return size, nil
+}
+
 // SetByConfig sets Voxels properties based on type-specific keywords in the configuration.
 // Any property not described in the config is left as is.  See the Voxels help for listing
 // of configurations.
@@ -1522,7 +1928,7 @@ func (props *Properties) SetByConfig(config dvid.Config) error {
 		return err
 	}
 	if found {
-		props.BlockSize, err = dvid.StringToPoint(s, ",")
+		props.BlockSize, err = blockSizeFromString(s, props.BlockSize)
 		if err != nil {
 			return err
 		}
@@ -1578,6 +1984,7 @@ func (props *Properties) NdDataMetadata() (string, error) {
 			Units:      props.Resolution.VoxelUnits[dim],
 			Size:       size.Value(uint8(dim)),
 			Offset:     offset.Value(uint8(dim)),
+			BlockSize:  props.BlockSize.Value(uint8(dim)),
 		})
 	}
 	metadata.Values = props.Values
@@ -1593,6 +2000,10 @@ func (props *Properties) NdDataMetadata() (string, error) {
 type Data struct {
 	datastore.Data
 	Properties
+
+	// Blended are the inference chunks blended into each version, which determine the
+	// weight already accumulated at each voxel.
+	Blended []BlendedChunk `json:"-"`
 }
 
 // BlankImage initializes a blank image of appropriate size and depth for the
@@ -1713,13 +2124,54 @@ func (d *Data) HandleIsotropy2D(geom dvid.Geometry, isotropic bool) (dvid.Geomet
 	return dstSlice, nil
 }
 
+// IsotropicOutputSize returns the pixel dimensions of a 2d slice resampled to isotropic
+// spacing at the finer of its two voxel resolutions.  Unlike HandleIsotropy2D, which
+// reduces the voxels read so the output keeps the requested size, this keeps the
+// requested voxels and enlarges the output along the coarser axis.
+func (d *Data) IsotropicOutputSize(geom dvid.Geometry) (dstW, dstH int, err error) {
+	resX, resY, err := geom.DataShape().GetFloat2D(d.Properties.VoxelSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	if resX <= 0 || resY <= 0 {
+		return 0, 0, fmt.Errorf("Cannot resample using non-positive voxel size %v", d.Properties.VoxelSize)
+	}
+	dstW = int(geom.Size().Value(0))
+	dstH = int(geom.Size().Value(1))
+	if resX < resY {
+		dstH = int(float32(dstH)*resY/resX + 0.5)
+	} else if resY < resX {
+		dstW = int(float32(dstW)*resX/resY + 0.5)
+	}
+	return dstW, dstH, nil
+}
+
+// ResampleFromRequest returns a 2d slice image resampled to isotropic pixel spacing
+// if the HTTP request has the query string "resample=isotropic".  Otherwise the
+// image is returned unchanged.
+func (d *Data) ResampleFromRequest(img *dvid.Image, geom dvid.Geometry, r *http.Request) (*dvid.Image, error) {
+	switch r.URL.Query().Get("resample") {
+	case "":
+		return img, nil
+	case "isotropic":
+		dstW, dstH, err := d.IsotropicOutputSize(geom)
+		if err != nil {
+			return nil, err
+		}
+		return img.ScaleImage(dstW, dstH)
+	default:
+		return nil, fmt.Errorf("Unknown resample option '%s': only 'isotropic' is supported",
+			r.URL.Query().Get("resample"))
+	}
+}
+
 // PutLocal adds image data to a version node, altering underlying blocks if the image
 // intersects the block.
 //
 // The image filename glob MUST BE absolute file paths that are visible to the server.
 // This function is meant for mass ingestion of large data files, and it is inappropriate
 // to read gigabytes of data just to send it over the network to a local DVID.
-func (d *Data) PutLocal(request datastore.Request, reply *datastore.Response) error {
+func (d *Data) PutLocal(ctx context.Context, request datastore.Request, reply *datastore.Response) error {
 	startTime := time.Now()
 
 	// Parse the request
@@ -1775,7 +2227,7 @@ func (d *Data) PutLocal(request datastore.Request, reply *datastore.Response) er
 			return err
 		}
 		storage.FileBytesRead <- len(e.Data())
-		err = PutVoxels(uuid, d, e)
+		err = PutVoxels(ctx, uuid, d, e)
 		if err != nil {
 			return err
 		}
@@ -1801,6 +2253,7 @@ func (d *Data) NewExtHandler(geom dvid.Geometry, img interface{}) (ExtHandler, e
 		values:    d.Properties.Values,
 		stride:    stride,
 		byteOrder: d.ByteOrder,
+		scheme:    d.IndexScheme,
 	}
 
 	if img == nil {
@@ -1873,6 +2326,12 @@ func (d *Data) JSONString() (jsonStr string, err error) {
 // --- DataService interface ---
 
 func (d *Data) ModifyConfig(config dvid.Config) error {
+	if _, found, _ := config.GetString("IndexScheme"); found {
+		return fmt.Errorf("IndexScheme of '%s' can only be set when the data is created", d.DataName())
+	}
+	if _, found, _ := config.GetString("BlockSize"); found {
+		return fmt.Errorf("BlockSize of '%s' can only be set when the data is created", d.DataName())
+	}
 	props := &(d.Properties)
 	if err := props.SetByConfig(config); err != nil {
 		return err
@@ -1881,7 +2340,7 @@ func (d *Data) ModifyConfig(config dvid.Config) error {
 }
 
 // DoRPC acts as a switchboard for RPC commands.
-func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error {
+func (d *Data) DoRPC(ctx context.Context, request datastore.Request, reply *datastore.Response) error {
 	switch request.TypeCommand() {
 	case "load":
 		if len(request.Command) < 5 {
@@ -1929,7 +2388,7 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 		source := request.Command[4]
 		switch source {
 		case "local":
-			return d.PutLocal(request, reply)
+			return d.PutLocal(ctx, request, reply)
 		case "remote":
 			return fmt.Errorf("put remote not yet implemented")
 		default:
@@ -1957,7 +2416,7 @@ func debugData(img image.Image, message string) {
 }
 
 // DoHTTP handles all incoming HTTP requests for this data.
-func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
+func (d *Data) DoHTTP(ctx context.Context, uuid dvid.UUID, w http.ResponseWriter, r *http.Request) error {
 	startTime := time.Now()
 
 	// Allow cross-origin resource sharing.
@@ -2026,6 +2485,72 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, jsonStr)
 		return nil
+	case "estimate":
+		if len(parts) < 7 {
+			err := fmt.Errorf("'estimate' must be followed by shape/size/offset")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		cost, err := EstimateFromStrings(d, parts[4], parts[5], parts[6])
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		m, err := json.Marshal(cost)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+		return nil
+	case "coverage":
+		if op != GetOp {
+			err := fmt.Errorf("Coverage can only be retrieved with GET")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		times, err := d.TimeRangeFromRequest(r)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if times.NumTimes() > 1 {
+			err := fmt.Errorf("Coverage can only be retrieved for a single time point")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "rle"
+		}
+		coverage, err := d.GetCoverage(uuid, times.Beg, format)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		m, err := json.Marshal(coverage)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: coverage of %d blocks (%s)",
+			r.Method, coverage.NumBlocks, r.URL)
+	case "provenance":
+		if op != GetOp || len(parts) < 5 {
+			err := fmt.Errorf("Provenance must be retrieved with GET of a block coordinate")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		jsonStr, err := d.BlockProvenance(uuid, r, parts[4])
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, jsonStr)
 	case "raw", "isotropic":
 		if len(parts) < 7 {
 			return fmt.Errorf("'%s' must be followed by shape/size/offset", parts[3])
@@ -2037,6 +2562,16 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		if err != nil {
 			return err
 		}
+		times, err := d.TimeRangeFromRequest(r)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if times.NumTimes() > 1 && (op == PutOp || plane.ShapeDimensions() != 3) {
+			err := fmt.Errorf("A range of time points can only be requested for GET of 3d subvolumes")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
 		switch plane.ShapeDimensions() {
 		case 2:
 			slice, err := dvid.NewSliceFromStrings(planeStr, offsetStr, sizeStr, "_")
@@ -2049,18 +2584,27 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
+				if err := CheckRequestBudget(d, slice, r); err != nil {
+					BudgetFailed(w, r, err)
+					return nil
+				}
 				// TODO -- Put in format checks for POSTed image.
 				postedImg, _, err := dvid.ImageFromPOST(r)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				e, err := d.NewExtHandler(slice, postedImg)
+				e, err := d.NewTimedExtHandler(slice, postedImg, times.Beg)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				err = PutVoxels(uuid, d, e)
+				release, ok := ReserveMemory(w, r, EstimateCost(d, slice))
+				if !ok {
+					return nil
+				}
+				defer release()
+				err = PutVoxels(ctx, uuid, d, e)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -2071,12 +2615,21 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				e, err := d.NewExtHandler(rawSlice, nil)
+				if err := CheckRequestBudget(d, rawSlice, r); err != nil {
+					BudgetFailed(w, r, err)
+					return nil
+				}
+				release, ok := ReserveMemory(w, r, EstimateCost(d, rawSlice))
+				if !ok {
+					return nil
+				}
+				defer release()
+				e, err := d.NewTimedExtHandler(rawSlice, nil, times.Beg)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				img, err := GetImage(uuid, d, e)
+				img, err := GetImage(ctx, uuid, d, e)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -2088,6 +2641,12 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 					if err != nil {
 						return err
 					}
+				} else {
+					img, err = d.ResampleFromRequest(img, slice, r)
+					if err != nil {
+						server.BadRequest(w, r, err.Error())
+						return err
+					}
 				}
 				var formatStr string
 				if len(parts) >= 8 {
@@ -2105,19 +2664,39 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 			if err != nil {
 				return err
 			}
+			var formatStr string
+			if len(parts) >= 8 {
+				formatStr = parts[7]
+			}
 			if op == GetOp {
-				e, err := d.NewExtHandler(subvol, nil)
-				if err != nil {
-					server.BadRequest(w, r, err.Error())
-					return err
+				if err := d.checkSubvolumeRequest(subvol, times, r); err != nil {
+					if TilingRequested(r) {
+						if err = d.writeTilingManifest(w, r, uuid, parts, subvol, times, err); err == nil {
+							dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: tiled %s (%s)", r.Method, subvol, r.URL)
+							return nil
+						}
+					}
+					BudgetFailed(w, r, err)
+					return nil
 				}
-				data, err := GetVolume(uuid, d, e)
+				cost := EstimateCost(d, subvol)
+				cost.Bytes *= int64(times.NumTimes())
+				release, ok := ReserveMemory(w, r, cost)
+				if !ok {
+					return nil
+				}
+				defer release()
+				data, err := d.GetTimeVolumes(ctx, uuid, subvol, times)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
 				w.Header().Set("Content-type", "application/octet-stream")
-				_, err = w.Write(data)
+				if formatStr == "nrrd" {
+					err = d.WriteNrrd(w, subvol, times, data)
+				} else {
+					_, err = w.Write(data)
+				}
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -2128,17 +2707,31 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				data, err := ioutil.ReadAll(r.Body)
+				if err := CheckTimeRequestBudget(d, subvol, times, r); err != nil {
+					BudgetFailed(w, r, err)
+					return nil
+				}
+				release, ok := ReserveMemory(w, r, EstimateCost(d, subvol))
+				if !ok {
+					return nil
+				}
+				defer release()
+				var data []byte
+				if formatStr == "nrrd" {
+					data, err = d.ReadNrrd(r.Body, subvol)
+				} else {
+					data, err = ioutil.ReadAll(r.Body)
+				}
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				e, err := d.NewExtHandler(subvol, data)
+				e, err := d.NewTimedExtHandler(subvol, data, times.Beg)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
 				}
-				err = PutVoxels(uuid, d, e)
+				err = PutVoxels(ctx, uuid, d, e)
 				if err != nil {
 					server.BadRequest(w, r, err.Error())
 					return err
@@ -2148,6 +2741,93 @@ func (d *Data) DoHTTP(uuid dvid.UUID, w http.ResponseWriter, r *http.Request) er
 		default:
 			return fmt.Errorf("DVID currently supports shapes of only 2 and 3 dimensions")
 		}
+	case "patches":
+		if op != GetOp {
+			err := fmt.Errorf("Can only GET patches")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if len(parts) < 8 {
+			err := fmt.Errorf("'patches' must be followed by size/roi offset/roi size/number")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		spec, labelsName, err := parsePatchRequest(parts[4], parts[5], parts[6], parts[7], r)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		var labels IntHandler
+		if labelsName != "" {
+			labels, err = GetLabelsHandler(uuid, labelsName)
+			if err != nil {
+				server.BadRequest(w, r, err.Error())
+				return err
+			}
+		}
+		sample, err := SamplePatches(ctx, uuid, d, labels, spec)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		m, err := json.Marshal(sample)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: %d patches of size %s (%s)",
+			r.Method, spec.Num, spec.Size, r.URL)
+	case "inference":
+		if op != PutOp {
+			err := fmt.Errorf("Can only POST inference chunks")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if len(parts) < 7 {
+			err := fmt.Errorf("'inference' must be followed by size/offset/halo")
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		subvol, err := dvid.NewSubvolumeFromStrings(parts[5], parts[4], "_")
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		haloPt, err := dvid.StringToPoint(parts[6], "_")
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		halo, ok := haloPt.(dvid.Point3d)
+		if !ok {
+			err := fmt.Errorf("Halo must be 3d: %s", parts[6])
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		var modeStr string
+		if len(parts) >= 8 {
+			modeStr = parts[7]
+		}
+		mode, err := HaloModeFromString(modeStr)
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		// The body can be no larger than the chunk.
+		maxBytes := subvol.NumVoxels() * int64(d.Values().BytesPerElement())
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+		if err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		if err := PutInference(ctx, uuid, d, subvol, data, halo, mode); err != nil {
+			server.BadRequest(w, r, err.Error())
+			return err
+		}
+		dvid.ElapsedTime(dvid.Debug, startTime, "HTTP %s: inference %s with halo %s, %s (%s)",
+			r.Method, subvol, halo, mode, r.URL)
 	default:
 		return fmt.Errorf("Unrecognized API call for data '%s'.  See API help.", d.DataName())
 	}
@@ -2221,7 +2901,11 @@ func (d *Data) processChunk(chunk *storage.Chunk) {
 				d.DataID().DataName(), err.Error())
 			return
 		}
-		db.Put(chunk.K, serialization)
+		if op.blocks != nil {
+			op.blocks.put(chunk.K, serialization)
+		} else {
+			db.Put(chunk.K, serialization)
+		}
 	}
 }
 
@@ -14,6 +14,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -29,13 +30,16 @@ import (
 	_ "github.com/janelia-flyem/dvid/datatype/labels64"
 	_ "github.com/janelia-flyem/dvid/datatype/multichan16"
 	_ "github.com/janelia-flyem/dvid/datatype/multiscale2d"
-	_ "github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
 )
 
 var (
 	// Path to datastore.
 	datastorePath string
 
+	// TOML configuration file whose values are overridden by flags.
+	configFile = flag.String("config", "", "")
+
 	// Display usage if true.
 	showHelp = flag.Bool("help", false, "")
 
@@ -68,6 +72,41 @@ var (
 	// Address for http communication
 	httpAddress = flag.String("http", server.DefaultWebAddress, "")
 
+	// Certificate and key for serving HTTP over TLS.
+	tlsCert = flag.String("tlscert", "", "")
+	tlsKey  = flag.String("tlskey", "", "")
+
+	// Per-client rate limits and the cap on concurrent HTTP requests.
+	rateLimit   = flag.Float64("ratelimit", 0, "")
+	byteLimit   = flag.Float64("bytelimit", 0, "")
+	maxRequests = flag.Int("maxrequests", 0, "")
+
+	// Caps on HTTP connections, concurrent requests per data instance, and the memory of
+	// voxel requests, each one and all in progress.
+	maxConns            = flag.Int("maxconns", 0, "")
+	maxInstanceRequests = flag.Int("maxinstancerequests", 0, "")
+	requestMB           = flag.Int("requestmb", 0, "")
+	memoryMB            = flag.Int("memorymb", 0, "")
+
+	// Size at which the error, audit, and access logs rotate and the number of old logs kept.
+	logMaxMB   = flag.Int("logmaxmb", 100, "")
+	logBackups = flag.Int("logbackups", 5, "")
+
+	// Disable compression of HTTP responses.
+	noCompress = flag.Bool("nocompress", false, "")
+
+	// Seconds to wait for in-flight requests when shutting down.
+	shutdownWait = flag.Int("shutdownwait", 30, "")
+
+	// File receiving the server's process ID once it is ready.
+	pidFile = flag.String("pidfile", "", "")
+
+	// Seconds an HTTP API request may run before it is canceled.
+	reqTimeout = flag.Int("reqtimeout", 0, "")
+
+	// Address for gRPC communication.  The gRPC API is not served if empty.
+	grpcAddress = flag.String("grpc", "", "")
+
 	// Number of logical CPUs to use for DVID.
 	useCPU = flag.Int("numcpu", 0, "")
 
@@ -76,6 +115,43 @@ var (
 
 	// Accept and send stdin to server for use in commands if true.
 	useStdin = flag.Bool("stdin", false, "")
+
+	// Strategy for generating UUIDs of new versions.
+	uuidStrategy = flag.String("uuid", "v1", "")
+
+	// Number of days deleted data can be restored before it is reclaimed.
+	trashDays = flag.Int("trashdays", 7, "")
+
+	// Allow webhooks at loopback, private, and link-local addresses if true.
+	privateHooks = flag.Bool("privatehooks", false, "")
+
+	// Sizes and directory of the storage cache tiers.
+	cacheMB    = flag.Int("cachemb", 0, "")
+	ssdCache   = flag.String("ssdcache", "", "")
+	ssdCacheMB = flag.Int("ssdcachemb", 0, "")
+
+	// Key shared by servers that authenticates push and pull replication.
+	replKey = flag.String("replkey", "", "")
+
+	// Upstream DVID server for unknown nodes and data, the data always proxied to it,
+	// and the size of the cache of its responses.
+	upstream     = flag.String("upstream", "", "")
+	proxyData    = flag.String("proxydata", "", "")
+	proxyCacheMB = flag.Int("proxycachemb", 512, "")
+	upstreamTok  = flag.String("upstreamtoken", "", "")
+
+	// Peer DVID servers whose datasets are listed with this server's.
+	remotes    = flag.String("remotes", "", "")
+	remotesTok = flag.String("remotestoken", "", "")
+
+	// Require a token for every HTTP API and RPC request if true.
+	requireAuth = flag.Bool("auth", false, "")
+
+	// OpenID Connect provider and registered client for signing in users.
+	oidcIssuer   = flag.String("oidc", "", "")
+	oidcClient   = flag.String("oidcclient", "", "")
+	oidcSecret   = flag.String("oidcsecret", "", "")
+	oidcRedirect = flag.String("oidcredirect", "", "")
 )
 
 const helpMessage = `
@@ -83,14 +159,89 @@ dvid is a distributed, versioned image-oriented datastore
 
 Usage: dvid [options] <command>
 
-      -webclient  =string   Path to web client directory.  Leave unset for default pages.
+      -config     =string   TOML configuration file with tables [server], [store], [limits],
+                              [cache], [auth], [logging], and [proxy] whose keys are the
+                              names of flags below, which override the file.  [store] sets
+                              the datastore "path" served when none is given and a table
+                              "engine" of storage engine settings, e.g., CacheSize.
+
+      Any flag can also be set by an environment variable named DVID_ and the flag in
+      upper case, e.g., DVID_REPLKEY for -replkey, which flags and the config file
+      override.  DVID_DATASTORE sets the datastore path served when none is given.
+      -webclient  =string   Path to web client directory.  Leave unset for the built-in console.
       -rpc        =string   Address for RPC communication.
       -http       =string   Address for HTTP communication.
+      -tlscert    =string   Certificate file for serving HTTP and HTTP/2 over TLS.  HTTP/2 is
+                              served over cleartext (h2c) to clients with prior knowledge
+                              if unset.
+      -tlskey     =string   Key file for the -tlscert certificate.
+      -grpc       =string   Address for gRPC communication.  Not served if unset.
+      -ratelimit  =number   Maximum HTTP and RPC requests per second of each client, identified
+                              by its user with -auth or else by its IP (default 0, unlimited).
+                              Clients over their limit get HTTP 429 replies.
+      -bytelimit  =number   Maximum MB per second of HTTP bodies of each client (default 0,
+                              unlimited).
+      -maxrequests =number  Maximum concurrent HTTP API requests (default 0, unlimited).
+      -maxconns   =number   Maximum simultaneous HTTP connections (default 0, unlimited).
+      -maxinstancerequests =number
+                            Maximum concurrent HTTP requests for each data instance
+                              (default 0, unlimited).
+      -requestmb  =number   Maximum MB of block memory for one voxel request (default 0,
+                              unlimited).
+      -memorymb   =number   Maximum MB of block memory for all voxel requests in progress
+                              (default 0, unlimited).
+                              Excess requests get HTTP 503 replies after a short wait.
+      -logmaxmb   =number   MB at which the error, audit, and access logs rotate (default 100,
+                              0 for no rotation).
+      -logbackups =number   Number of rotated files kept for each log (default 5).
+      -nocompress (flag)    Do not compress HTTP responses for clients accepting gzip or zstd.
+      -shutdownwait =number Seconds to wait for in-flight requests to finish when shutting
+                              down (default 30).
+      -reqtimeout =number   Seconds an HTTP API request may run before it is canceled
+                              (default 0 for no limit).
+      -pidfile    =string   File receiving the process ID once the server is ready, removed at
+                              shutdown.  Readiness is also sent by sd_notify if NOTIFY_SOCKET
+                              is set, e.g., for systemd units of Type=notify.  A SIGHUP
+                              reopens the error, audit, and access logs.
       -cpuprofile =string   Write CPU profile to this file.
       -memprofile =string   Write memory profile to this file on ctrl-C.
       -numcpu     =number   Number of logical CPUs to use for DVID.
       -timeout    =number   Seconds to wait trying to get exclusive access to datastore.
       -stdin      (flag)    Accept and send stdin to server for use in commands.
+      -uuid       =string   UUID generation: "v1" (default), "v4" (random), "v7" (time-ordered),
+                              or "site:<hex>" (time-ordered after a 1 to 4 byte site prefix).
+      -trashdays  =number   Days deleted data can be restored before it is reclaimed (default 7).
+      -privatehooks (flag)  Allow webhooks at loopback, private, and link-local addresses.
+      -cachemb    =number   MB of RAM for caching values read from storage (default 0, no cache).
+      -ssdcache   =string   Directory on local SSD for values evicted from the RAM cache.
+                              Its contents are removed when the datastore is opened.
+      -ssdcachemb =number   MB of the SSD cache directory.
+      -auth       (flag)    Require a token for every HTTP API and RPC request.  The dvid client
+                              sends the token in the DVID_TOKEN environment variable.  Tokens
+                              can only be issued with -auth; the first admin token is written to
+                              dvid-admin-token beside the datastore.
+      -oidc       =string   Issuer URL of an OpenID Connect provider, e.g., Google or Keycloak,
+                              for signing in users at /api/login.  Requires -auth.
+      -oidcclient =string   Client ID registered with the OIDC provider.
+      -oidcsecret =string   Client secret registered with the OIDC provider.  It can instead
+                              be given in the DVID_OIDC_SECRET environment variable.
+      -oidcredirect =string URL of /api/login/callback registered with the OIDC provider.
+                              Leave unset to use the host of each sign-in request.
+      -replkey    =string   Key shared by servers that authenticates push and pull replication.
+                              Replication is disabled if not set.  The key is only sent to
+                              servers over https.
+      -upstream   =string   Web address of a DVID server to which requests for nodes and data
+                              not held by this server are forwarded.
+      -proxydata  =string   Comma-separated names of data always forwarded to the upstream server.
+      -proxycachemb =number MB of RAM for caching upstream responses (default 512).
+      -upstreamtoken =string DVID token sent with requests forwarded to the upstream server;
+                              credentials of this server's clients are never forwarded.  It
+                              can instead be given in the DVID_UPSTREAM_TOKEN environment variable.
+      -remotes    =string   Comma-separated web addresses of peer DVID servers whose datasets
+                              are listed with this server's by "dvid remotes" and /api/remotes.
+                              Addresses without a scheme use https.
+      -remotestoken =string DVID token sent to peer servers when listing their datasets, only
+                              over https; credentials of this server's clients are never sent.
       -crc32      (flag)    Use CRC32 checksum to detect corruption.
       -types      (flag)    Show compiled DVID data types
       -debug      (flag)    Run in debug mode.  Verbose.
@@ -105,8 +256,51 @@ Commands that can be performed without a running server:
 	about
 	help
 	init   <datastore path>
-	serve  <datastore path>
+	serve  [<datastore path>]     (path can be set by -config or DVID_DATASTORE)
 	repair <datastore path>
+	migrate <datastore path> [to=<new path>] [dryrun=true] [iorate=<MB/s>]
+
+	Upgrades a datastore created by an older DVID to the key encodings, metadata
+	formats, and serialization envelopes of this DVID.  The datastore is copied and the
+	copy migrated and validated, then it replaces the original or, if "to" is given, is
+	left at the new path.  On failure the copy is removed and the original is untouched.
+	Needs free space for a copy of the datastore.  A dry run lists the needed migrations.
+
+Commands that send commands to a running server via its RPC address:
+
+	shell [<rpc address>]
+
+	Runs an interactive shell with command history and tab completion of commands,
+	node UUIDs, and data names.  JSON responses are indented.
+
+	run <script> [continue=true] [<variable>=<value>...]
+
+	Sends the commands of a script file, one per line, in order.  "#" starts a comment
+	line.  "$name = <command>" captures the last UUID of the command's reply, e.g., of
+	"datasets new", and later $name or ${name} is replaced by it.  The script stops at
+	the first failing command unless continue=true.
+
+Commands that benchmark a running server via its HTTP address:
+
+	bench <profile> <UUID> <data name> [<setting>=<value>...]
+	bench compare <baseline JSON> <results JSON> [threshold=<percent>]
+
+	Use "dvid bench help" for profiles and settings.
+
+Commands that move data between running servers via their HTTP addresses:
+
+	transfer <source> <destination> <UUID> <data name> [iorate=<MB/s>] [batchmb=<MB>]
+
+	Copies the data as resolved at the node to the same node on the destination, which
+	must already hold the node, e.g., through push or pull.  Both servers and this client
+	need the same -replkey.  An interrupted transfer resumes where it stopped when rerun.
+
+Commands that benchmark chunk index schemes without a server:
+
+	benchmark-index [size=<blocks per side>] [runs=<number>]
+
+	Reports key spans, keys scanned, and iteration time of XY slices, XZ slices,
+	and cubes of blocks under ZYX, Morton, and Hilbert indexing (default size %d, runs %d).
 
 `
 
@@ -117,7 +311,7 @@ a web browser to visit the DVID web server (%q by default).
 
 var usage = func() {
 	// Print local DVID help
-	fmt.Printf(helpMessage)
+	fmt.Printf(helpMessage, dvid.DefaultIndexBenchSize, dvid.DefaultIndexBenchRuns)
 
 	// Print server DVID help if available
 	err := DoCommand(dvid.Command([]string{"help"}))
@@ -138,6 +332,10 @@ func main() {
 	flag.BoolVar(showHelp, "h", false, "Show help message")
 	flag.Usage = usage
 	flag.Parse()
+	if err := applySettings(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
 
 	if flag.NArg() >= 1 && strings.ToLower(flag.Args()[0]) == "help" {
 		*showHelp = true
@@ -155,6 +353,113 @@ func main() {
 	if *useCRC32 {
 		dvid.DefaultChecksum = dvid.CRC32
 	}
+	if *trashDays < 0 {
+		fmt.Fprintln(os.Stderr, "-trashdays must not be negative")
+		os.Exit(1)
+	}
+	datastore.TrashRetention = time.Duration(*trashDays) * 24 * time.Hour
+	datastore.PrivateWebHooks = *privateHooks
+	server.ReplicationKey = *replKey
+	if *proxyData != "" && *upstream == "" {
+		fmt.Fprintln(os.Stderr, "-proxydata requires -upstream")
+		os.Exit(1)
+	}
+	if *proxyCacheMB < 0 {
+		fmt.Fprintln(os.Stderr, "-proxycachemb must not be negative")
+		os.Exit(1)
+	}
+	server.Upstream = *upstream
+	for _, name := range strings.Split(*proxyData, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			server.ProxiedData[dvid.DataString(name)] = true
+		}
+	}
+	server.ProxyCacheBytes = int64(*proxyCacheMB) * dvid.Mega
+	server.UpstreamToken = *upstreamTok
+	if server.UpstreamToken == "" {
+		server.UpstreamToken = os.Getenv(server.UpstreamTokenEnv)
+	}
+	server.RemotesToken = *remotesTok
+	for _, remote := range strings.Split(*remotes, ",") {
+		if remote = strings.TrimSpace(remote); remote != "" {
+			server.Remotes = append(server.Remotes, remote)
+		}
+	}
+	server.GRPCAddress = *grpcAddress
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintln(os.Stderr, "-tlscert and -tlskey must be given together")
+		os.Exit(1)
+	}
+	server.TLSCertFile, server.TLSKeyFile = *tlsCert, *tlsKey
+	if *rateLimit < 0 || *byteLimit < 0 || *maxRequests < 0 {
+		fmt.Fprintln(os.Stderr, "-ratelimit, -bytelimit, and -maxrequests must not be negative")
+		os.Exit(1)
+	}
+	server.RequestRate = *rateLimit
+	server.ByteRate = *byteLimit * dvid.Mega
+	server.MaxConcurrentRequests = *maxRequests
+	if *maxConns < 0 || *maxInstanceRequests < 0 || *requestMB < 0 || *memoryMB < 0 {
+		fmt.Fprintln(os.Stderr, "-maxconns, -maxinstancerequests, -requestmb, and -memorymb must not be negative")
+		os.Exit(1)
+	}
+	server.MaxConnections = *maxConns
+	server.MaxInstanceRequests = *maxInstanceRequests
+	voxels.MaxRequestBytes = int64(*requestMB) * dvid.Mega
+	voxels.MemoryBudget = int64(*memoryMB) * dvid.Mega
+	if *logMaxMB < 0 || *logBackups < 0 {
+		fmt.Fprintln(os.Stderr, "-logmaxmb and -logbackups must not be negative")
+		os.Exit(1)
+	}
+	server.LogMaxBytes = int64(*logMaxMB) * dvid.Mega
+	server.LogBackups = *logBackups
+	if *shutdownWait < 0 {
+		fmt.Fprintln(os.Stderr, "-shutdownwait must not be negative")
+		os.Exit(1)
+	}
+	server.ShutdownTimeout = time.Duration(*shutdownWait) * time.Second
+	server.PIDFile = *pidFile
+	if *reqTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "-reqtimeout must not be negative")
+		os.Exit(1)
+	}
+	server.RequestTimeout = time.Duration(*reqTimeout) * time.Second
+	server.CompressResponses = !*noCompress
+	server.AuthRequired = *requireAuth
+	if *oidcIssuer != "" {
+		if !*requireAuth {
+			fmt.Fprintln(os.Stderr, "-oidc requires -auth")
+			os.Exit(1)
+		}
+		secret := *oidcSecret
+		if secret == "" {
+			secret = os.Getenv(server.OIDCSecretEnv)
+		}
+		provider, err := server.NewOIDCProvider(*oidcIssuer, *oidcClient, secret, *oidcRedirect)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		server.OIDC = provider
+	}
+	if *cacheMB < 0 || *ssdCacheMB < 0 {
+		fmt.Fprintln(os.Stderr, "-cachemb and -ssdcachemb must not be negative")
+		os.Exit(1)
+	}
+	if *ssdCache != "" && *cacheMB == 0 {
+		fmt.Fprintln(os.Stderr, "-ssdcache requires a RAM cache set by -cachemb")
+		os.Exit(1)
+	}
+	storage.DefaultCache = storage.CacheConfig{
+		MemoryBytes: int64(*cacheMB) * dvid.Mega,
+		DiskDir:     *ssdCache,
+		DiskBytes:   int64(*ssdCacheMB) * dvid.Mega,
+	}
+	if gen, err := dvid.UUIDGeneratorFromString(*uuidStrategy); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	} else {
+		dvid.SetUUIDGenerator(gen)
+	}
 
 	if *showHelp || flag.NArg() == 0 {
 		flag.Usage()
@@ -205,7 +510,6 @@ func main() {
 				pprof.StopCPUProfile()
 			}
 			server.Shutdown()
-			time.Sleep(1 * time.Second)
 			os.Exit(0)
 		}
 	}()
@@ -218,6 +522,61 @@ func main() {
 	}
 }
 
+// settingEnvPrefix begins the names of environment variables setting flags, e.g.,
+// DVID_REPLKEY sets -replkey.
+const settingEnvPrefix = "DVID_"
+
+// datastoreEnv names the environment variable giving the datastore path served when
+// none is given.
+const datastoreEnv = "DVID_DATASTORE"
+
+// applySettings sets the flags not given on the command line from the configuration
+// file, if any, and then from DVID_* environment variables, so flags override the file
+// and the file overrides the environment.  The datastore path and storage engine
+// settings are set the same way.
+func applySettings() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	if !given["config"] {
+		*configFile = os.Getenv(settingEnvPrefix + "CONFIG")
+	}
+	if *configFile != "" {
+		config, err := server.ReadConfigFile(*configFile)
+		if err != nil {
+			return err
+		}
+		for name, value := range config.Flags {
+			if given[name] {
+				continue
+			}
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("Illegal %s in config file %s: %s", name, *configFile, err.Error())
+			}
+			given[name] = true
+		}
+		datastorePath = config.StorePath
+		datastore.StoreSettings = config.StoreSettings
+	}
+	if datastorePath == "" {
+		datastorePath = os.Getenv(datastoreEnv)
+	}
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] || f.Name == "h" || f.Name == "help" {
+			return
+		}
+		env := settingEnvPrefix + strings.ToUpper(f.Name)
+		if value, found := os.LookupEnv(env); found {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("Illegal %s in environment variable %s: %s", f.Name, env, setErr.Error())
+			}
+		}
+	})
+	return err
+}
+
 // DoCommand serves as a switchboard for commands, handling local ones and
 // sending via rpc those commands that need a running server.
 func DoCommand(cmd dvid.Command) error {
@@ -233,24 +592,41 @@ func DoCommand(cmd dvid.Command) error {
 		return DoServe(cmd)
 	case "repair":
 		return DoRepair(cmd)
+	case "bench":
+		return DoBench(cmd)
+	case "benchmark-index":
+		return DoBenchmarkIndex(cmd)
+	case "transfer":
+		return DoTransfer(cmd)
+	case "shell":
+		return DoShell(cmd)
+	case "run":
+		return DoRun(cmd)
+	case "migrate":
+		return DoMigrate(cmd)
 	case "about":
 		fmt.Println(datastore.Versions())
 	// Send everything else to server via DVID terminal
 	default:
-		client := server.NewClient(*rpcAddress)
-		request := datastore.Request{Command: cmd}
-		if *useStdin {
-			var err error
-			request.Input, err = ioutil.ReadAll(os.Stdin)
-			if err != nil {
-				return fmt.Errorf("Error in reading from standard input: %s", err.Error())
-			}
-		}
-		return client.Send(request)
+		return SendCommand(cmd)
 	}
 	return nil
 }
 
+// SendCommand sends a command to the server at the -rpc address.
+func SendCommand(cmd dvid.Command) error {
+	client := server.NewClient(*rpcAddress)
+	request := datastore.Request{Command: cmd, Token: os.Getenv(server.TokenEnv)}
+	if *useStdin {
+		var err error
+		request.Input, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("Error in reading from standard input: %s", err.Error())
+		}
+	}
+	return client.Send(request)
+}
+
 // DoInit performs the "init" command, creating a new DVID datastore.
 func DoInit(cmd dvid.Command) error {
 	datastorePath := cmd.Argument(1)
@@ -274,13 +650,200 @@ func DoRepair(cmd dvid.Command) error {
 	return nil
 }
 
+// DoMigrate performs the "migrate" command, upgrading the on-disk formats of a datastore
+// that is not being served.  The "keys" and "status" subcommands are instead sent to the
+// running server, which migrates keys in the background.
+func DoMigrate(cmd dvid.Command) error {
+	datastorePath := cmd.Argument(1)
+	switch datastorePath {
+	case "keys", "status":
+		return SendCommand(cmd)
+	case "":
+		return fmt.Errorf("migrate command must be followed by the path to the datastore")
+	}
+	config := cmd.Settings()
+	newPath, _, err := config.GetString("to")
+	if err != nil {
+		return err
+	}
+	dryRun, _, err := config.GetBool("dryrun")
+	if err != nil {
+		return err
+	}
+	limits, err := datastore.JobLimitsFromConfig(config)
+	if err != nil {
+		return err
+	}
+	report, err := datastore.MigrateDatastore(datastorePath, newPath, dryRun, limits)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	return nil
+}
+
+// DoBench performs the "bench" command, running a benchmark profile against a running
+// server or comparing the results of two runs.
+func DoBench(cmd dvid.Command) error {
+	profile := cmd.Argument(1)
+	switch profile {
+	case "", "help":
+		fmt.Printf(server.BenchHelpMessage, server.BenchProfilesHelp(), server.DefaultBenchRequests,
+			server.DefaultBenchConcurrency, server.DefaultBenchThreshold)
+		return nil
+	case "compare":
+		baselineFile, resultsFile := cmd.Argument(2), cmd.Argument(3)
+		if resultsFile == "" {
+			return fmt.Errorf("bench compare must be followed by baseline and results JSON files")
+		}
+		threshold := server.DefaultBenchThreshold
+		if thresholdStr, found := cmd.Setting("threshold"); found {
+			var err error
+			if threshold, err = strconv.ParseFloat(thresholdStr, 64); err != nil {
+				return fmt.Errorf("Illegal threshold '%s': %s", thresholdStr, err.Error())
+			}
+		}
+		baseline, err := server.ReadBenchResult(baselineFile)
+		if err != nil {
+			return err
+		}
+		results, err := server.ReadBenchResult(resultsFile)
+		if err != nil {
+			return err
+		}
+		report, regressed := server.CompareBenchResults(baseline, results, threshold)
+		fmt.Print(report)
+		if regressed {
+			return fmt.Errorf("Performance regressed more than %g%% from baseline", threshold)
+		}
+		return nil
+	}
+	uuid, dataname := cmd.Argument(2), cmd.Argument(3)
+	if dataname == "" {
+		return fmt.Errorf("bench %s must be followed by a UUID and data name", profile)
+	}
+	config := cmd.Settings()
+	result, err := server.RunBenchmark(*httpAddress, profile, uuid, dataname, config)
+	if err != nil {
+		return err
+	}
+	output, _, err := config.GetString("output")
+	if err != nil {
+		return err
+	}
+	return server.WriteBenchResult(result, output)
+}
+
+// DoShell performs the "shell" command, running an interactive shell sending commands
+// to the server at the given RPC address or the -rpc address.
+func DoShell(cmd dvid.Command) error {
+	address := cmd.Argument(1)
+	if address == "" {
+		address = *rpcAddress
+	}
+	return server.Shell(address, os.Getenv(server.TokenEnv))
+}
+
+// DoRun performs the "run" command, sending the commands of a script file to the
+// server at the -rpc address.  Settings other than "continue" set script variables.
+func DoRun(cmd dvid.Command) error {
+	path := cmd.Argument(1)
+	if path == "" {
+		return fmt.Errorf("run must be followed by the path to a script of commands")
+	}
+	continueOnError, _, err := cmd.Settings().GetBool("continue")
+	if err != nil {
+		return err
+	}
+	vars := make(map[string]string)
+	for _, arg := range cmd[2:] {
+		elems := strings.Split(arg, "=")
+		if len(elems) == 2 && elems[0] != "continue" {
+			vars[elems[0]] = elems[1]
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return server.RunScript(*rpcAddress, os.Getenv(server.TokenEnv), f, vars, continueOnError, os.Stdout)
+}
+
+// DoTransfer performs the "transfer" command, streaming data from one running server
+// to another.
+func DoTransfer(cmd dvid.Command) error {
+	var src, dst, uuidStr, dataname string
+	cmd.CommandArgs(1, &src, &dst, &uuidStr, &dataname)
+	if dataname == "" {
+		return fmt.Errorf("transfer must be followed by source and destination servers, a UUID, and a data name")
+	}
+	config := cmd.Settings()
+	limits, err := datastore.JobLimitsFromConfig(config)
+	if err != nil {
+		return err
+	}
+	batchBytes := datastore.DefaultTransferBatchBytes
+	batchMB, found, err := config.GetInt("batchmb")
+	if err != nil {
+		return err
+	}
+	if found {
+		if batchMB < 1 {
+			return fmt.Errorf("Illegal batchmb setting %d: must be at least 1", batchMB)
+		}
+		batchBytes = batchMB * dvid.Mega
+	}
+	transfer, err := server.Transfer(src, dst, uuidStr, dvid.DataString(dataname), batchBytes, limits)
+	if err != nil {
+		if transfer != nil {
+			return fmt.Errorf("Transfer stopped after %d key/value pairs and can be resumed: %s",
+				transfer.Keys, err.Error())
+		}
+		return err
+	}
+	fmt.Printf("Transferred data '%s' at node %s from %s to %s: %d key/value pairs, %d bytes\n",
+		dataname, transfer.Node, src, dst, transfer.Keys, transfer.Bytes)
+	return nil
+}
+
+// DoBenchmarkIndex performs the "benchmark-index" command, comparing the key locality of
+// index schemes for typical access patterns.
+func DoBenchmarkIndex(cmd dvid.Command) error {
+	config := cmd.Settings()
+	size, found, err := config.GetInt("size")
+	if err != nil {
+		return err
+	}
+	if !found {
+		size = dvid.DefaultIndexBenchSize
+	}
+	runs, found, err := config.GetInt("runs")
+	if err != nil {
+		return err
+	}
+	if !found {
+		runs = dvid.DefaultIndexBenchRuns
+	}
+	results, err := dvid.BenchmarkIndexSchemes(int32(size), runs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Index schemes for a volume of %d x %d x %d blocks:\n\n", size, size, size)
+	fmt.Print(dvid.IndexBenchTable(results))
+	return nil
+}
+
 // DoServe opens a datastore then creates both web and rpc servers for the datastore
 func DoServe(cmd dvid.Command) error {
-	datastorePath := cmd.Argument(1)
-	if datastorePath == "" {
-		return fmt.Errorf("serve command must be followed by the path to the datastore")
+	path := cmd.Argument(1)
+	if path == "" {
+		path = datastorePath
+	}
+	if path == "" {
+		return fmt.Errorf("serve command must be followed by the path to the datastore unless set by -config or DVID_DATASTORE")
 	}
-	if service, err := server.OpenDatastore(datastorePath); err != nil {
+	if service, err := server.OpenDatastore(path); err != nil {
 		return err
 	} else {
 		if err := service.Serve(*httpAddress, *clientDir, *rpcAddress); err != nil {
@@ -9,8 +9,6 @@ import (
 	"math"
 	"strconv"
 	"strings"
-
-	"github.com/janelia-flyem/go/go-uuid/uuid"
 )
 
 // Note: TypeString and DataString are types to add static checks and prevent conflation
@@ -39,13 +37,12 @@ type VersionLocalID LocalID
 // http://en.wikipedia.org/wiki/Universally_unique_identifier
 type UUID string
 
-// NewUUID returns a UUID
+// NewUUID returns a UUID using the strategy set by SetUUIDGenerator.
 func NewUUID() UUID {
-	u := uuid.NewUUID()
-	if u == nil || len(u) != 16 {
-		return UUID("")
-	}
-	return UUID(fmt.Sprintf("%032x", []byte(u)))
+	uuidGenerator.RLock()
+	gen := uuidGenerator.gen
+	uuidGenerator.RUnlock()
+	return gen()
 }
 
 func init() {
@@ -961,7 +958,7 @@ func (c ChunkPointNd) MinPoint(size Point) Point {
 func (c ChunkPointNd) MaxPoint(size Point) Point {
 	max := make(PointNd, len(c))
 	for i, _ := range c {
-		max[i] = c[i] * size.Value(uint8(i))
+		max[i] = (c[i]+1)*size.Value(uint8(i)) - 1
 	}
 	return max
 }
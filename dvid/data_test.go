@@ -2,6 +2,7 @@ package dvid
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/janelia-flyem/go/gocheck"
 )
@@ -171,3 +172,34 @@ func (s *DataSuite) TestChunk(c *C) {
 	result := d.PointInChunk(blockSize)
 	c.Assert(result, Equals, Point3d{11, 3, 0})
 }
+
+func (s *DataSuite) TestUUIDGenerators(c *C) {
+	for _, strategy := range []string{"v1", "v4", "v7", "site:0a1b"} {
+		gen, err := UUIDGeneratorFromString(strategy)
+		c.Assert(err, IsNil)
+		u1, u2 := gen(), gen()
+		c.Assert(u1, HasLen, 32)
+		c.Assert(u1, Not(Equals), u2)
+	}
+	c.Assert(string(NewUUIDv4()[12]), Equals, "4")
+	c.Assert(string(NewUUIDv7()[12]), Equals, "7")
+
+	// Time-ordered UUIDs should sort chronologically.
+	gen, _ := UUIDGeneratorFromString("site:0a1b")
+	first := gen()
+	c.Assert(string(first[:4]), Equals, "0a1b")
+	time.Sleep(2 * time.Millisecond)
+	c.Assert(string(first) < string(gen()), Equals, true)
+	first = NewUUIDv7()
+	time.Sleep(2 * time.Millisecond)
+	c.Assert(string(first) < string(NewUUIDv7()), Equals, true)
+
+	for _, bad := range []string{"v9", "site:", "site:xyz", "site:0102030405"} {
+		_, err := UUIDGeneratorFromString(bad)
+		c.Assert(err, NotNil)
+	}
+
+	SetUUIDGenerator(NewUUIDv4)
+	c.Assert(string(NewUUID()[12]), Equals, "4")
+	SetUUIDGenerator(NewUUIDv1)
+}
@@ -0,0 +1,220 @@
+/*
+	This file supports shared compression dictionaries that improve compression of the
+	many small blocks of a data instance.
+*/
+
+package dvid
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+const (
+	// MaxDictionarySize is the largest useful dictionary, limited by the DEFLATE window.
+	MaxDictionarySize = 32 * 1024
+
+	// Length of byte segments that are considered when training a dictionary.
+	dictSegmentSize = 32
+)
+
+// Dictionary is a preset compression dictionary shared by all serializations of a
+// data instance.  Each serialization identifies its dictionary by a 32-bit ID so the
+// dictionary must be registered, which is done by NewDictionary, before any data
+// compressed with it can be deserialized.
+type Dictionary struct {
+	id   uint32
+	data []byte
+}
+
+// ID returns the identifier stored with each serialization using this dictionary.
+func (d *Dictionary) ID() uint32 {
+	return d.id
+}
+
+// Bytes returns the dictionary contents.
+func (d *Dictionary) Bytes() []byte {
+	return d.data
+}
+
+// MarshalBinary fulfills the encoding.BinaryMarshaler interface so a dictionary can be
+// stored with the metadata of the data that used it.
+func (d *Dictionary) MarshalBinary() ([]byte, error) {
+	return d.data, nil
+}
+
+// UnmarshalBinary fulfills the encoding.BinaryUnmarshaler interface.  The dictionary is
+// registered so data compressed with it can be deserialized.
+func (d *Dictionary) UnmarshalBinary(data []byte) error {
+	dictData := make([]byte, len(data))
+	copy(dictData, data)
+	dict, err := NewDictionary(dictData)
+	if err != nil {
+		return err
+	}
+	*d = *dict
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d *Dictionary) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.data)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.  The dictionary is registered
+// so data compressed with it can be deserialized.
+func (d *Dictionary) UnmarshalJSON(b []byte) error {
+	var data []byte
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	return d.UnmarshalBinary(data)
+}
+
+func (d *Dictionary) String() string {
+	return fmt.Sprintf("dictionary %08x (%d bytes)", d.id, len(d.data))
+}
+
+// Registry of all dictionaries used by this server, indexed by dictionary ID.
+var dictionaries struct {
+	sync.RWMutex
+	m map[uint32]*Dictionary
+}
+
+// NewDictionary returns a registered Dictionary with the given contents.
+func NewDictionary(data []byte) (*Dictionary, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Cannot use empty compression dictionary")
+	}
+	if len(data) > MaxDictionarySize {
+		return nil, fmt.Errorf("Compression dictionary of %d bytes exceeds maximum of %d bytes",
+			len(data), MaxDictionarySize)
+	}
+	id := crc32.ChecksumIEEE(data)
+	dictionaries.Lock()
+	defer dictionaries.Unlock()
+	if dictionaries.m == nil {
+		dictionaries.m = make(map[uint32]*Dictionary)
+	}
+	if dict, found := dictionaries.m[id]; found {
+		if !bytes.Equal(dict.data, data) {
+			return nil, fmt.Errorf("Compression dictionary ID %08x collides with existing dictionary", id)
+		}
+		return dict, nil
+	}
+	dict := &Dictionary{id, data}
+	dictionaries.m[id] = dict
+	return dict, nil
+}
+
+// GetDictionary returns a registered dictionary by its ID.
+func GetDictionary(id uint32) (dict *Dictionary, found bool) {
+	dictionaries.RLock()
+	dict, found = dictionaries.m[id]
+	dictionaries.RUnlock()
+	return
+}
+
+// TrainDictionary builds a dictionary of at most maxSize bytes from sample data, e.g.,
+// uncompressed blocks.  Fixed-length segments of the samples are ranked by how often
+// they occur, and segments that occur more than once are concatenated with the most
+// frequent ones last since DEFLATE encodes nearer matches more cheaply.  Returns nil
+// if the samples share no repeated segments.
+func TrainDictionary(samples [][]byte, maxSize int) []byte {
+	if maxSize <= 0 || maxSize > MaxDictionarySize {
+		maxSize = MaxDictionarySize
+	}
+	counts := make(map[string]int)
+	for _, sample := range samples {
+		for pos := 0; pos+dictSegmentSize <= len(sample); pos += dictSegmentSize {
+			counts[string(sample[pos:pos+dictSegmentSize])]++
+		}
+	}
+	segments := make([]string, 0, len(counts))
+	for segment, count := range counts {
+		if count > 1 {
+			segments = append(segments, segment)
+		}
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	sort.Sort(bySegmentCount{segments, counts})
+
+	numSegments := maxSize / dictSegmentSize
+	if numSegments > len(segments) {
+		numSegments = len(segments)
+	}
+	dict := make([]byte, 0, numSegments*dictSegmentSize)
+	for i := numSegments - 1; i >= 0; i-- {
+		dict = append(dict, segments[i]...)
+	}
+	return dict
+}
+
+// bySegmentCount sorts segments from most to least frequent, breaking ties by
+// content so training is deterministic.
+type bySegmentCount struct {
+	segments []string
+	counts   map[string]int
+}
+
+func (s bySegmentCount) Len() int      { return len(s.segments) }
+func (s bySegmentCount) Swap(i, j int) { s.segments[i], s.segments[j] = s.segments[j], s.segments[i] }
+func (s bySegmentCount) Less(i, j int) bool {
+	ci, cj := s.counts[s.segments[i]], s.counts[s.segments[j]]
+	if ci != cj {
+		return ci > cj
+	}
+	return s.segments[i] < s.segments[j]
+}
+
+// compressWithDictionary returns the dictionary ID followed by the DEFLATE stream of data.
+func compressWithDictionary(data []byte, compress Compression) ([]byte, error) {
+	if compress.dict == nil {
+		return nil, fmt.Errorf("No dictionary available for %s", compress)
+	}
+	var buffer bytes.Buffer
+	if err := binary.Write(&buffer, binary.LittleEndian, compress.dict.id); err != nil {
+		return nil, err
+	}
+	w, err := flate.NewWriterDict(&buffer, int(compress.level), compress.dict.data)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// uncompressWithDictionary reverses compressWithDictionary using a registered dictionary.
+func uncompressWithDictionary(cdata []byte) ([]byte, error) {
+	if len(cdata) < 4 {
+		return nil, fmt.Errorf("Dictionary-compressed data too short to hold dictionary ID")
+	}
+	id := binary.LittleEndian.Uint32(cdata[0:4])
+	dict, found := GetDictionary(id)
+	if !found {
+		return nil, fmt.Errorf("Compression dictionary %08x has not been registered", id)
+	}
+	r := flate.NewReaderDict(bytes.NewReader(cdata[4:]), dict.data)
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.Close(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
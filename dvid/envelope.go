@@ -0,0 +1,206 @@
+/*
+	This file supports versioning of the serialization envelope, the header that precedes
+	any checksum and serialized data and describes their compression and checksum.
+
+	Tools outside of Go can read a serialization as follows:
+
+		byte 0      Format: compression in bits 7-5, checksum in bits 4-3, and the
+		              envelope flag in bit 0.
+		byte 1      If the envelope flag is set, the envelope version.
+		byte 2      For envelope version 2, the object encoding, e.g., 2 for JSON.
+		checksum    4 byte little-endian CRC32 or 32 byte SHA-256, if any, of the
+		              possibly compressed data.
+		data        The possibly compressed data until the end of the value.
+*/
+
+package dvid
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// EnvelopeVersion identifies the layout of a serialization envelope.
+type EnvelopeVersion uint8
+
+const (
+	// LegacyEnvelope is a single format byte with compression in bits 7-5, checksum in
+	// bits 4-3, and bits 2-0 zero.  All data written before envelope versioning uses it.
+	LegacyEnvelope EnvelopeVersion = 0
+
+	// EnvelopeV1 is the legacy format byte with the envelope flag (bit 0) set, followed
+	// by a byte holding the envelope version.
+	EnvelopeV1 EnvelopeVersion = 1
+
+	// EnvelopeV2 adds a third byte giving the ObjectEncoding of a serialized object.
+	// It is only used for objects serialized with an encoding other than Gob.
+	EnvelopeV2 EnvelopeVersion = 2
+
+	// CurrentEnvelope is the envelope version used for all new serializations.
+	CurrentEnvelope = EnvelopeV1
+)
+
+// Bit of the format byte that signals an explicit envelope version byte follows.
+// It is never set in legacy envelopes.
+const envelopeFlag = 0x01
+
+// Envelope is the decoded header of a serialization.
+type Envelope struct {
+	Version     EnvelopeVersion
+	Compression CompressionFormat
+	Checksum    Checksum
+
+	// Encoding of a serialized object or UnspecifiedEncoding for earlier envelopes.
+	Encoding ObjectEncoding
+
+	// Size is the number of header bytes preceding any checksum.
+	Size int
+}
+
+// EnvelopeDecoder decodes a versioned envelope header of a registered size, which
+// includes the leading format and version bytes.  The returned Envelope's Version
+// and Size are set by the caller.
+type EnvelopeDecoder func(header []byte) (Envelope, error)
+
+type envelopeCodec struct {
+	size   int
+	decode EnvelopeDecoder
+}
+
+// Registry of decoders for versioned envelopes.  Any future change to the envelope
+// should add a version and register its decoder so previously stored data can
+// still be read.
+var envelopes = struct {
+	sync.RWMutex
+	codecs map[EnvelopeVersion]envelopeCodec
+}{
+	codecs: map[EnvelopeVersion]envelopeCodec{
+		EnvelopeV1: {2, decodeEnvelopeV1},
+		EnvelopeV2: {3, decodeEnvelopeV2},
+	},
+}
+
+// RegisterEnvelope adds a decoder for an envelope version whose header has the given
+// size in bytes, including the leading format and version bytes.
+func RegisterEnvelope(version EnvelopeVersion, size int, decode EnvelopeDecoder) error {
+	if version == LegacyEnvelope {
+		return fmt.Errorf("Cannot register a decoder for the legacy envelope")
+	}
+	if size < 2 {
+		return fmt.Errorf("Envelope version %d must have at least 2 header bytes, not %d", version, size)
+	}
+	envelopes.Lock()
+	defer envelopes.Unlock()
+	if _, found := envelopes.codecs[version]; found {
+		return fmt.Errorf("Envelope version %d already has a registered decoder", version)
+	}
+	envelopes.codecs[version] = envelopeCodec{size, decode}
+	return nil
+}
+
+func getEnvelopeCodec(version EnvelopeVersion) (envelopeCodec, error) {
+	envelopes.RLock()
+	codec, found := envelopes.codecs[version]
+	envelopes.RUnlock()
+	if !found {
+		return codec, fmt.Errorf("Unknown serialization envelope version %d", version)
+	}
+	return codec, nil
+}
+
+func decodeEnvelopeV1(header []byte) (Envelope, error) {
+	compression, checksum := DecodeSerializationFormat(SerializationFormat(header[0]))
+	return Envelope{Compression: compression, Checksum: checksum}, nil
+}
+
+func decodeEnvelopeV2(header []byte) (Envelope, error) {
+	env, _ := decodeEnvelopeV1(header)
+	env.Encoding = ObjectEncoding(header[2])
+	return env, nil
+}
+
+// EncodeEnvelope returns the current envelope header for the compression and checksum.
+func EncodeEnvelope(compress Compression, checksum Checksum) []byte {
+	format := EncodeSerializationFormat(compress, checksum)
+	return []byte{byte(format) | envelopeFlag, byte(CurrentEnvelope)}
+}
+
+// encodeObjectEnvelope returns an envelope header that records an object encoding.
+func encodeObjectEnvelope(compress Compression, checksum Checksum, encoding ObjectEncoding) []byte {
+	format := EncodeSerializationFormat(compress, checksum)
+	return []byte{byte(format) | envelopeFlag, byte(EnvelopeV2), byte(encoding)}
+}
+
+// DecodeEnvelope decodes the envelope at the start of a serialization.
+func DecodeEnvelope(s []byte) (Envelope, error) {
+	if len(s) < 1 {
+		return Envelope{}, fmt.Errorf("Could not read serialization format info: no data")
+	}
+	if s[0]&envelopeFlag == 0 {
+		compression, checksum := DecodeSerializationFormat(SerializationFormat(s[0]))
+		return Envelope{LegacyEnvelope, compression, checksum, UnspecifiedEncoding, 1}, nil
+	}
+	if len(s) < 2 {
+		return Envelope{}, fmt.Errorf("Could not read serialization envelope version: no data")
+	}
+	version := EnvelopeVersion(s[1])
+	codec, err := getEnvelopeCodec(version)
+	if err != nil {
+		return Envelope{}, err
+	}
+	if len(s) < codec.size {
+		return Envelope{}, fmt.Errorf("Serialization too short for envelope version %d", version)
+	}
+	env, err := codec.decode(s[:codec.size])
+	if err != nil {
+		return Envelope{}, err
+	}
+	env.Version = version
+	env.Size = codec.size
+	return env, nil
+}
+
+// readEnvelope reads and decodes an envelope from the start of a stream.
+func readEnvelope(r io.Reader) (Envelope, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header[:1]); err != nil {
+		return Envelope{}, fmt.Errorf("Could not read serialization format info: %s", err.Error())
+	}
+	if header[0]&envelopeFlag == 0 {
+		return DecodeEnvelope(header[:1])
+	}
+	if _, err := io.ReadFull(r, header[1:2]); err != nil {
+		return Envelope{}, fmt.Errorf("Could not read serialization envelope version: %s", err.Error())
+	}
+	codec, err := getEnvelopeCodec(EnvelopeVersion(header[1]))
+	if err != nil {
+		return Envelope{}, err
+	}
+	if codec.size > 2 {
+		header = append(header, make([]byte, codec.size-2)...)
+		if _, err := io.ReadFull(r, header[2:]); err != nil {
+			return Envelope{}, fmt.Errorf("Could not read serialization envelope: %s", err.Error())
+		}
+	}
+	return DecodeEnvelope(header)
+}
+
+// MigrateEnvelope returns a serialization rewritten with the current envelope.  The
+// checksum and possibly compressed data are unchanged.  If the serialization already
+// uses the current envelope or records an object encoding, it is returned as is.
+func MigrateEnvelope(s []byte) ([]byte, error) {
+	env, err := DecodeEnvelope(s)
+	if err != nil {
+		return nil, err
+	}
+	if env.Version == CurrentEnvelope || env.Encoding != UnspecifiedEncoding {
+		return s, nil
+	}
+	compress := Compression{format: env.Compression}
+	header := EncodeEnvelope(compress, env.Checksum)
+	migrated := make([]byte, len(header)+len(s)-env.Size)
+	copy(migrated, header)
+	copy(migrated[len(header):], s[env.Size:])
+	return migrated, nil
+}
@@ -0,0 +1,176 @@
+/*
+	This file supports parallel compression of large payloads, e.g., whole subvolumes,
+	by compressing fixed-size chunks independently across goroutines.
+
+	The Framed compression format stores:
+
+		byte 0      Compression format of every chunk.
+		uint32      Uncompressed size of every chunk except possibly the last.
+		uint64      Total uncompressed size.
+		uint32      Number of chunks, N.
+		N x uint32  Compressed size of each chunk.
+		chunks      The compressed chunks in order.
+
+	All integers are little-endian.
+*/
+
+package dvid
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ParallelCompressionSize is the minimum number of bytes for which serializations
+	// are compressed in parallel chunks.
+	ParallelCompressionSize = 4 << 20
+
+	// ParallelChunkSize is the number of uncompressed bytes in each chunk compressed
+	// in parallel.
+	ParallelChunkSize = 1 << 20
+)
+
+const frameHeaderSize = 1 + 4 + 8 + 4
+
+// useFraming returns true if the data should be compressed in parallel chunks.
+func useFraming(data []byte, compress Compression) bool {
+	if compress.format == Uncompressed || compress.format == Framed || ParallelChunkSize <= 0 {
+		return false
+	}
+	return len(data) >= ParallelCompressionSize && len(data) > ParallelChunkSize
+}
+
+// runParallel calls fn for indices 0 to n-1 using at most NumCPU goroutines and
+// returns the first error encountered.
+func runParallel(n int, fn func(i int) error) error {
+	numWorkers := NumCPU
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	if numWorkers > n {
+		numWorkers = n
+	}
+	errs := make([]error, n)
+	next := make(chan int, n)
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for w := 0; w < numWorkers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compressFramed compresses chunks of data in parallel and returns the Framed data.
+func compressFramed(data []byte, compress Compression) ([]byte, error) {
+	chunkSize := ParallelChunkSize
+	numChunks := (len(data) + chunkSize - 1) / chunkSize
+	chunks := make([][]byte, numChunks)
+	err := runParallel(numChunks, func(i int) error {
+		end := (i + 1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		byteData, release, err := compressBytes(data[i*chunkSize:end], compress)
+		if err != nil {
+			return err
+		}
+		chunks[i] = make([]byte, len(byteData))
+		copy(chunks[i], byteData)
+		release()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	size := frameHeaderSize + 4*numChunks
+	for _, chunk := range chunks {
+		size += len(chunk)
+	}
+	framed := make([]byte, size)
+	framed[0] = byte(compress.format)
+	binary.LittleEndian.PutUint32(framed[1:5], uint32(chunkSize))
+	binary.LittleEndian.PutUint64(framed[5:13], uint64(len(data)))
+	binary.LittleEndian.PutUint32(framed[13:17], uint32(numChunks))
+	pos := frameHeaderSize + 4*numChunks
+	for i, chunk := range chunks {
+		binary.LittleEndian.PutUint32(framed[frameHeaderSize+4*i:], uint32(len(chunk)))
+		copy(framed[pos:], chunk)
+		pos += len(chunk)
+	}
+	return framed, nil
+}
+
+// uncompressFramed uncompresses the chunks of Framed data in parallel.
+func uncompressFramed(framed []byte) ([]byte, error) {
+	if len(framed) < frameHeaderSize {
+		return nil, fmt.Errorf("Framed data too short to hold frame header")
+	}
+	compression := CompressionFormat(framed[0])
+	if compression == Framed {
+		return nil, fmt.Errorf("Framed data cannot hold framed chunks")
+	}
+	chunkSize := int(binary.LittleEndian.Uint32(framed[1:5]))
+	totalSize := binary.LittleEndian.Uint64(framed[5:13])
+	numChunks := int(binary.LittleEndian.Uint32(framed[13:17]))
+	if chunkSize <= 0 || uint64(numChunks) != (totalSize+uint64(chunkSize)-1)/uint64(chunkSize) {
+		return nil, fmt.Errorf("Framed data has %d chunks, inconsistent with %d bytes in %d byte chunks",
+			numChunks, totalSize, chunkSize)
+	}
+	if len(framed) < frameHeaderSize+4*numChunks {
+		return nil, fmt.Errorf("Framed data too short to hold %d chunk sizes", numChunks)
+	}
+	if err := checkOriginalSize(totalSize, len(framed)); err != nil {
+		return nil, err
+	}
+
+	// Locate each compressed chunk.
+	offsets := make([]int, numChunks+1)
+	offsets[0] = frameHeaderSize + 4*numChunks
+	for i := 0; i < numChunks; i++ {
+		cSize := int(binary.LittleEndian.Uint32(framed[frameHeaderSize+4*i:]))
+		offsets[i+1] = offsets[i] + cSize
+		if offsets[i+1] > len(framed) {
+			return nil, fmt.Errorf("Framed data too short to hold chunk %d", i)
+		}
+	}
+
+	data := make([]byte, int(totalSize))
+	err := runParallel(numChunks, func(i int) error {
+		chunk, err := uncompressBytes(framed[offsets[i]:offsets[i+1]], compression)
+		if err != nil {
+			return fmt.Errorf("Error in framed chunk %d: %s", i, err.Error())
+		}
+		start := i * chunkSize
+		end := start + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if len(chunk) != end-start {
+			return fmt.Errorf("Framed chunk %d has %d bytes, expected %d", i, len(chunk), end-start)
+		}
+		copy(data[start:end], chunk)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -1170,16 +1170,19 @@ func WriteImageHttp(w http.ResponseWriter, img image.Image, formatStr string) er
 	switch format[0] {
 	case "", "png":
 		w.Header().Set("Content-type", "image/png")
+		MarkCompressed(w)
 		if err = png.Encode(w, img); err != nil {
 			return err
 		}
 	case "jpg", "jpeg":
 		w.Header().Set("Content-type", "image/jpeg")
+		MarkCompressed(w)
 		if err = jpeg.Encode(w, img, &jpeg.Options{Quality: compression}); err != nil {
 			return err
 		}
 	case "tiff", "tif":
 		w.Header().Set("Content-type", "image/tiff")
+		MarkCompressed(w)
 		if err = tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate}); err != nil {
 			return err
 		}
@@ -12,6 +12,8 @@ import (
 	"fmt"
 	"hash/fnv"
 	"math"
+	"sort"
+	"strings"
 )
 
 func init() {
@@ -19,6 +21,11 @@ func init() {
 	gob.Register(IndexUint8(0))
 	gob.Register(IndexZYX{})
 	gob.Register(IndexCZYX{})
+	gob.Register(IndexTZYX{})
+	gob.Register(IndexND{})
+	gob.Register(IndexHilbert{})
+	gob.Register(IndexZYX64{})
+	gob.Register(IndexTile{})
 }
 
 // LocalID is a unique id for some data in a DVID instance.  This unique id is a much
@@ -100,6 +107,15 @@ type ChunkIndexer interface {
 	Max(ChunkIndexer) (max ChunkIndexer, changed bool)
 }
 
+// PointIndexer is an Index that can make indices for arbitrary chunk points of its
+// dimensionality, so generic code can index chunks without a bespoke Index type.
+type PointIndexer interface {
+	ChunkIndexer
+
+	// IndexFromPoint returns an index for the given chunk point.
+	IndexFromPoint(ChunkPoint) (ChunkIndexer, error)
+}
+
 // IndexIterator is a function that returns a sequence of indices and ends with nil.
 type IndexIterator interface {
 	Valid() bool
@@ -107,11 +123,143 @@ type IndexIterator interface {
 	NextSpan()
 }
 
-// IndexRange defines the extent of data via minimum and maximum indices.
+// IndexSpanLister is implemented by IndexIterators whose spans are not runs along
+// the x axis and so must list the chunk indices within the current span.
+type IndexSpanLister interface {
+	SpanIndices() []ChunkIndexer
+}
+
+// IndexRange defines the extent of data via minimum and maximum indices.  Both are
+// inclusive and indices are ordered by their byte representation.  A range with a nil
+// Minimum or Maximum, or a Minimum after its Maximum, is empty.
 type IndexRange struct {
 	Minimum, Maximum Index
 }
 
+// CompareIndices returns -1, 0, or 1 if index a is before, equal to, or after index b
+// in lexicographic order of their byte representations.
+func CompareIndices(a, b Index) int {
+	return bytes.Compare(a.Bytes(), b.Bytes())
+}
+
+// Empty returns true if the range holds no indices.
+func (r IndexRange) Empty() bool {
+	return r.Minimum == nil || r.Maximum == nil || CompareIndices(r.Minimum, r.Maximum) > 0
+}
+
+// Contains returns true if the index is within the range.
+func (r IndexRange) Contains(i Index) bool {
+	if r.Empty() {
+		return false
+	}
+	return CompareIndices(r.Minimum, i) <= 0 && CompareIndices(i, r.Maximum) <= 0
+}
+
+// Intersect returns the range of indices within both ranges, which may be empty.
+func (r IndexRange) Intersect(r2 IndexRange) IndexRange {
+	if r.Empty() || r2.Empty() {
+		return IndexRange{}
+	}
+	intersection := r
+	if CompareIndices(r2.Minimum, r.Minimum) > 0 {
+		intersection.Minimum = r2.Minimum
+	}
+	if CompareIndices(r2.Maximum, r.Maximum) < 0 {
+		intersection.Maximum = r2.Maximum
+	}
+	if intersection.Empty() {
+		return IndexRange{}
+	}
+	return intersection
+}
+
+// Union returns the indices within either range.  Overlapping ranges are merged
+// into one range.
+func (r IndexRange) Union(r2 IndexRange) IndexRanges {
+	return NewIndexRanges(r, r2)
+}
+
+func (r IndexRange) String() string {
+	if r.Empty() {
+		return "[]"
+	}
+	return fmt.Sprintf("[%s, %s]", r.Minimum, r.Maximum)
+}
+
+// IndexRanges is a sorted set of disjoint, non-empty index ranges.  It can describe
+// the portions of a requested region that are actually present.
+type IndexRanges []IndexRange
+
+// NewIndexRanges returns the set of indices within any of the given ranges.
+func NewIndexRanges(ranges ...IndexRange) IndexRanges {
+	var sorted IndexRanges
+	for _, r := range ranges {
+		if !r.Empty() {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Sort(sorted)
+	var merged IndexRanges
+	for _, r := range sorted {
+		last := len(merged) - 1
+		if last >= 0 && CompareIndices(r.Minimum, merged[last].Maximum) <= 0 {
+			if CompareIndices(r.Maximum, merged[last].Maximum) > 0 {
+				merged[last].Maximum = r.Maximum
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func (rs IndexRanges) Len() int      { return len(rs) }
+func (rs IndexRanges) Swap(i, j int) { rs[i], rs[j] = rs[j], rs[i] }
+func (rs IndexRanges) Less(i, j int) bool {
+	return CompareIndices(rs[i].Minimum, rs[j].Minimum) < 0
+}
+
+// Contains returns true if the index is within any of the ranges.
+func (rs IndexRanges) Contains(i Index) bool {
+	n := sort.Search(len(rs), func(k int) bool {
+		return CompareIndices(rs[k].Maximum, i) >= 0
+	})
+	return n < len(rs) && rs[n].Contains(i)
+}
+
+// Intersect returns the indices within both sets of ranges.
+func (rs IndexRanges) Intersect(rs2 IndexRanges) IndexRanges {
+	var intersection IndexRanges
+	i, j := 0, 0
+	for i < len(rs) && j < len(rs2) {
+		if overlap := rs[i].Intersect(rs2[j]); !overlap.Empty() {
+			intersection = append(intersection, overlap)
+		}
+		if CompareIndices(rs[i].Maximum, rs2[j].Maximum) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+	return intersection
+}
+
+// Union returns the indices within either set of ranges.
+func (rs IndexRanges) Union(rs2 IndexRanges) IndexRanges {
+	all := make([]IndexRange, 0, len(rs)+len(rs2))
+	all = append(all, rs...)
+	all = append(all, rs2...)
+	return NewIndexRanges(all...)
+}
+
+// Span returns the smallest single range holding all indices in the set.
+func (rs IndexRanges) Span() IndexRange {
+	if len(rs) == 0 {
+		return IndexRange{}
+	}
+	return IndexRange{rs[0].Minimum, rs[len(rs)-1].Maximum}
+}
+
 // ---- Index Implementations --------
 
 // IndexBytes satisfies an Index interface with a slice of bytes.
@@ -253,8 +401,9 @@ func (i IndexZYX) Bytes() []byte {
 // Hash returns an integer [0, n) where the returned values should be reasonably
 // spread among the range of returned values.  This implementation makes sure
 // that any range query along x, y, or z direction will map to different handlers.
+// The sum is taken as unsigned so negative coordinates still yield a value in [0, n).
 func (i IndexZYX) Hash(n int) int {
-	return int(i[0]+i[1]+i[2]) % n
+	return int(uint32(i[0]+i[1]+i[2]) % uint32(n))
 }
 
 func (i IndexZYX) Scheme() string {
@@ -264,6 +413,9 @@ func (i IndexZYX) Scheme() string {
 // IndexFromBytes returns an index from bytes.  The passed Index is used just
 // to choose the appropriate byte decoding scheme.
 func (i IndexZYX) IndexFromBytes(b []byte) (Index, error) {
+	if len(b) < IndexZYXSize {
+		return nil, fmt.Errorf("Cannot decode ZYX index from %d bytes", len(b))
+	}
 	z := int32(int64(binary.BigEndian.Uint32(b[0:4])) + math.MinInt32)
 	y := int32(int64(binary.BigEndian.Uint32(b[4:8])) + math.MinInt32)
 	x := int32(int64(binary.BigEndian.Uint32(b[8:12])) + math.MinInt32)
@@ -329,6 +481,16 @@ func (i IndexZYX) Max(idx ChunkIndexer) (ChunkIndexer, bool) {
 	return max, changed
 }
 
+// ------- PointIndexer interface ----------
+
+// IndexFromPoint returns an index for a 3d chunk point.
+func (i IndexZYX) IndexFromPoint(c ChunkPoint) (ChunkIndexer, error) {
+	if c.NumDims() != 3 {
+		return nil, fmt.Errorf("Cannot make ZYX index from %d-d chunk point %s", c.NumDims(), c)
+	}
+	return IndexZYX{c.Value(0), c.Value(1), c.Value(2)}, nil
+}
+
 // ----- IndexIterator implementation ------------
 type IndexZYXIterator struct {
 	geom     Geometry
@@ -390,12 +552,16 @@ func (i IndexCZYX) String() string {
 	return hex.EncodeToString(i.Bytes())
 }
 
-// Bytes returns a byte representation of the Index.
+// IndexCZYXSize is the number of bytes in an IndexCZYX representation.
+const IndexCZYXSize = 16
+
+// Bytes returns a byte representation of the Index.  Like the coordinates, the channel
+// is offset so that negative channels sort before positive ones.
 func (i IndexCZYX) Bytes() []byte {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, i.Channel)
-	buf.Write(i.IndexZYX.Bytes())
-	return buf.Bytes()
+	buf := make([]byte, IndexCZYXSize)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(int64(i.Channel)-math.MinInt32))
+	copy(buf[4:], i.IndexZYX.Bytes())
+	return buf
 }
 
 func (i IndexCZYX) Scheme() string {
@@ -405,12 +571,44 @@ func (i IndexCZYX) Scheme() string {
 // IndexFromBytes returns an index from bytes.  The passed Index is used just
 // to choose the appropriate byte decoding scheme.
 func (i IndexCZYX) IndexFromBytes(b []byte) (Index, error) {
-	c := int32(binary.BigEndian.Uint16(b[0:4]))
-	index, err := i.IndexFromBytes(b[4:])
+	if len(b) != IndexCZYXSize {
+		return nil, fmt.Errorf("Cannot convert %d bytes to IndexCZYX", len(b))
+	}
+	c := int32(int64(binary.BigEndian.Uint32(b[0:4])) + math.MinInt32)
+	index, err := i.IndexZYX.IndexFromBytes(b[4:])
 	if err != nil {
 		return nil, err
 	}
-	return &IndexCZYX{c, index.(IndexZYX)}, nil
+	return &IndexCZYX{c, *(index.(*IndexZYX))}, nil
+}
+
+// IsLegacyIndexCZYX returns true if the bytes are an IndexCZYX written before channels
+// were offset, when a channel was stored as a raw big-endian int32.  Since channels are
+// non-negative in practice, legacy indices have a clear high bit while current indices
+// have it set.
+func IsLegacyIndexCZYX(b []byte) bool {
+	return len(b) == IndexCZYXSize && b[0]&0x80 == 0
+}
+
+// MigrateIndexCZYX converts the bytes of a legacy IndexCZYX into the current encoding.
+func MigrateIndexCZYX(b []byte) ([]byte, error) {
+	if !IsLegacyIndexCZYX(b) {
+		return nil, fmt.Errorf("Bytes %x are not a legacy IndexCZYX", b)
+	}
+	migrated := make([]byte, IndexCZYXSize)
+	copy(migrated, b)
+	channel := int32(binary.BigEndian.Uint32(b[0:4]))
+	binary.BigEndian.PutUint32(migrated[0:4], uint32(int64(channel)-math.MinInt32))
+	return migrated, nil
+}
+
+// IndexFromPoint returns an index for a 3d chunk point in this index's channel.
+func (i IndexCZYX) IndexFromPoint(c ChunkPoint) (ChunkIndexer, error) {
+	index, err := i.IndexZYX.IndexFromPoint(c)
+	if err != nil {
+		return nil, err
+	}
+	return IndexCZYX{i.Channel, index.(IndexZYX)}, nil
 }
 
 // ----- IndexIterator implementation ------------
@@ -461,6 +659,382 @@ func (it *IndexCZYXIterator) NextSpan() {
 	}
 }
 
+// IndexCZYXChannelIterator is an IndexIterator over XYZ space for each channel of a
+// contiguous range of channels.  Since the channel is the most significant part of an
+// IndexCZYX, spans are visited in key order: all rows of blocks of one channel before
+// those of the next channel.
+type IndexCZYXChannelIterator struct {
+	geom       Geometry
+	c, y, z    int32
+	begChannel int32
+	endChannel int32
+	begBlock   ChunkPoint3d
+	endBlock   ChunkPoint3d
+	endBytes   []byte
+}
+
+// NewIndexCZYXChannelIterator returns an IndexIterator that iterates over XYZ space for
+// each channel from begChannel to endChannel inclusive.
+func NewIndexCZYXChannelIterator(begChannel, endChannel int32, geom Geometry, start, end ChunkPoint3d) *IndexCZYXChannelIterator {
+	return &IndexCZYXChannelIterator{
+		geom:       geom,
+		c:          begChannel,
+		y:          start[1],
+		z:          start[2],
+		begChannel: begChannel,
+		endChannel: endChannel,
+		begBlock:   start,
+		endBlock:   end,
+		endBytes:   IndexCZYX{endChannel, IndexZYX(end)}.Bytes(),
+	}
+}
+
+func (it *IndexCZYXChannelIterator) Valid() bool {
+	if it.begBlock[1] > it.endBlock[1] || it.begBlock[2] > it.endBlock[2] {
+		return false
+	}
+	cursorBytes := IndexCZYX{it.c, IndexZYX{it.begBlock[0], it.y, it.z}}.Bytes()
+	if bytes.Compare(cursorBytes, it.endBytes) > 0 {
+		return false
+	}
+	return true
+}
+
+func (it *IndexCZYXChannelIterator) IndexSpan() (beg, end Index, err error) {
+	beg = IndexCZYX{it.c, IndexZYX{it.begBlock[0], it.y, it.z}}
+	end = IndexCZYX{it.c, IndexZYX{it.endBlock[0], it.y, it.z}}
+	return
+}
+
+// Channel returns the channel of the current span.
+func (it *IndexCZYXChannelIterator) Channel() int32 {
+	return it.c
+}
+
+func (it *IndexCZYXChannelIterator) NextSpan() {
+	it.y += 1
+	if it.y > it.endBlock[1] {
+		it.y = it.begBlock[1]
+		it.z += 1
+		if it.z > it.endBlock[2] {
+			it.z = it.begBlock[2]
+			it.c += 1
+		}
+	}
+}
+
+// IndexTZYX implements the Index interface and provides simple indexing on time T,
+// then Z, then Y, then X.  It allows time-lapse volumes to be stored as 4d data where
+// all chunks of a time point are contiguous in key space.  Since IndexZYX is embedded,
+// we get the ChunkIndexer interface for the spatial coordinates.
+type IndexTZYX struct {
+	Time int32
+	IndexZYX
+}
+
+const IndexTZYXSize = 4 + IndexZYXSize
+
+func (i IndexTZYX) Duplicate() Index {
+	dup := i
+	return dup
+}
+
+func (i IndexTZYX) String() string {
+	return hex.EncodeToString(i.Bytes())
+}
+
+// Bytes returns a byte representation of the Index.  Like the spatial coordinates,
+// time is shifted to unsigned integer space so negative time points sort first.
+func (i IndexTZYX) Bytes() []byte {
+	buf := make([]byte, IndexTZYXSize)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(int64(i.Time)-math.MinInt32))
+	copy(buf[4:], i.IndexZYX.Bytes())
+	return buf
+}
+
+// Hash returns an integer [0, n) that spreads consecutive time points of a chunk
+// among handlers, even for negative times or coordinates.
+func (i IndexTZYX) Hash(n int) int {
+	return int(uint32(i.Time+i.IndexZYX[0]+i.IndexZYX[1]+i.IndexZYX[2]) % uint32(n))
+}
+
+func (i IndexTZYX) Scheme() string {
+	return "TZYX Indexing"
+}
+
+// IndexFromBytes returns an index from bytes.  The passed Index is used just
+// to choose the appropriate byte decoding scheme.
+func (i IndexTZYX) IndexFromBytes(b []byte) (Index, error) {
+	if len(b) < IndexTZYXSize {
+		return nil, fmt.Errorf("Cannot decode TZYX index from %d bytes", len(b))
+	}
+	t := int32(int64(binary.BigEndian.Uint32(b[0:4])) + math.MinInt32)
+	index, err := i.IndexZYX.IndexFromBytes(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	return &IndexTZYX{t, *(index.(*IndexZYX))}, nil
+}
+
+// IndexFromPoint returns an index for a 3d chunk point at this index's time point.
+func (i IndexTZYX) IndexFromPoint(c ChunkPoint) (ChunkIndexer, error) {
+	index, err := i.IndexZYX.IndexFromPoint(c)
+	if err != nil {
+		return nil, err
+	}
+	return IndexTZYX{i.Time, index.(IndexZYX)}, nil
+}
+
+// ----- IndexIterator implementation ------------
+type IndexTZYXIterator struct {
+	geom     Geometry
+	t, y, z  int32
+	begTime  int32
+	endTime  int32
+	begBlock ChunkPoint3d
+	endBlock ChunkPoint3d
+	endBytes []byte
+}
+
+// NewIndexTZYXIterator returns an IndexIterator that iterates over XYZ space for each
+// time point from begTime to endTime inclusive.
+func NewIndexTZYXIterator(begTime, endTime int32, geom Geometry, start, end ChunkPoint3d) *IndexTZYXIterator {
+	return &IndexTZYXIterator{
+		geom:     geom,
+		t:        begTime,
+		y:        start[1],
+		z:        start[2],
+		begTime:  begTime,
+		endTime:  endTime,
+		begBlock: start,
+		endBlock: end,
+		endBytes: IndexTZYX{endTime, IndexZYX(end)}.Bytes(),
+	}
+}
+
+func (it *IndexTZYXIterator) Valid() bool {
+	if it.begBlock[1] > it.endBlock[1] || it.begBlock[2] > it.endBlock[2] {
+		return false
+	}
+	cursorBytes := IndexTZYX{it.t, IndexZYX{it.begBlock[0], it.y, it.z}}.Bytes()
+	if bytes.Compare(cursorBytes, it.endBytes) > 0 {
+		return false
+	}
+	return true
+}
+
+func (it *IndexTZYXIterator) IndexSpan() (beg, end Index, err error) {
+	beg = IndexTZYX{it.t, IndexZYX{it.begBlock[0], it.y, it.z}}
+	end = IndexTZYX{it.t, IndexZYX{it.endBlock[0], it.y, it.z}}
+	return
+}
+
+// Time returns the time point of the current span.
+func (it *IndexTZYXIterator) Time() int32 {
+	return it.t
+}
+
+func (it *IndexTZYXIterator) NextSpan() {
+	it.y += 1
+	if it.y > it.endBlock[1] {
+		it.y = it.begBlock[1]
+		it.z += 1
+		if it.z > it.endBlock[2] {
+			it.z = it.begBlock[2]
+			it.t += 1
+		}
+	}
+}
+
+// IndexND implements the Index interface for chunks of any dimensionality.  Like IndexZYX,
+// each coordinate is shifted to unsigned integer space and written big-endian with the
+// last dimension first, so the lexicographic order of the byte representation is the
+// order of chunks with the first dimension changing fastest.  The number of dimensions
+// is the length of the index.
+type IndexND ChunkPointNd
+
+// NewIndexND returns an IndexND for a chunk point of any dimensionality.
+func NewIndexND(c ChunkPoint) IndexND {
+	index := make(IndexND, c.NumDims())
+	for dim := range index {
+		index[dim] = c.Value(uint8(dim))
+	}
+	return index
+}
+
+func (i IndexND) Duplicate() Index {
+	dup := make(IndexND, len(i))
+	copy(dup, i)
+	return dup
+}
+
+func (i IndexND) String() string {
+	return hex.EncodeToString(i.Bytes())
+}
+
+// Bytes returns a byte representation of the Index with 4 bytes per dimension.
+func (i IndexND) Bytes() []byte {
+	buf := make([]byte, 4*len(i))
+	for dim := range i {
+		pos := 4 * (len(i) - 1 - dim)
+		binary.BigEndian.PutUint32(buf[pos:pos+4], uint32(int64(i[dim])-math.MinInt32))
+	}
+	return buf
+}
+
+// Hash returns an integer [0, n) where indices differing along any dimension map
+// to different handlers.
+func (i IndexND) Hash(n int) int {
+	var sum uint32
+	for _, value := range i {
+		sum += uint32(value)
+	}
+	return int(sum % uint32(n))
+}
+
+func (i IndexND) Scheme() string {
+	return fmt.Sprintf("%dD Indexing", len(i))
+}
+
+// IndexFromBytes returns an index from bytes.  If the passed Index has dimensions,
+// exactly that many are decoded.  Otherwise, the number of dimensions is determined
+// by the length of the byte slice.
+func (i IndexND) IndexFromBytes(b []byte) (Index, error) {
+	numDims := len(i)
+	if numDims == 0 {
+		if len(b) == 0 || len(b)%4 != 0 {
+			return nil, fmt.Errorf("Cannot decode N-d index from %d bytes", len(b))
+		}
+		numDims = len(b) / 4
+	} else if len(b) < 4*numDims {
+		return nil, fmt.Errorf("Cannot decode %d-d index from %d bytes", numDims, len(b))
+	}
+	index := make(IndexND, numDims)
+	for dim := range index {
+		pos := 4 * (numDims - 1 - dim)
+		index[dim] = int32(int64(binary.BigEndian.Uint32(b[pos:pos+4])) + math.MinInt32)
+	}
+	return &index, nil
+}
+
+// ------- ChunkIndexer interface ----------
+
+func (i IndexND) NumDims() uint8 {
+	return uint8(len(i))
+}
+
+// Value returns the value at the specified dimension for this index.
+func (i IndexND) Value(dim uint8) int32 {
+	return i[dim]
+}
+
+// MinPoint returns the minimum voxel coordinate for a chunk.
+func (i IndexND) MinPoint(size Point) Point {
+	return ChunkPointNd(i).MinPoint(size)
+}
+
+// MaxPoint returns the maximum voxel coordinate for a chunk.
+func (i IndexND) MaxPoint(size Point) Point {
+	return ChunkPointNd(i).MaxPoint(size)
+}
+
+// Min returns a ChunkIndexer that is the minimum of its value and the passed one.
+func (i IndexND) Min(idx ChunkIndexer) (ChunkIndexer, bool) {
+	var changed bool
+	min := i.Duplicate().(IndexND)
+	for dim := range min {
+		if min[dim] > idx.Value(uint8(dim)) {
+			min[dim] = idx.Value(uint8(dim))
+			changed = true
+		}
+	}
+	return min, changed
+}
+
+// Max returns a ChunkIndexer that is the maximum of its value and the passed one.
+func (i IndexND) Max(idx ChunkIndexer) (ChunkIndexer, bool) {
+	var changed bool
+	max := i.Duplicate().(IndexND)
+	for dim := range max {
+		if max[dim] < idx.Value(uint8(dim)) {
+			max[dim] = idx.Value(uint8(dim))
+			changed = true
+		}
+	}
+	return max, changed
+}
+
+// ------- PointIndexer interface ----------
+
+// IndexFromPoint returns an index for a chunk point.  If the receiver has dimensions,
+// the point must have the same number of dimensions.
+func (i IndexND) IndexFromPoint(c ChunkPoint) (ChunkIndexer, error) {
+	if len(i) != 0 && int(c.NumDims()) != len(i) {
+		return nil, fmt.Errorf("Cannot make %d-d index from %d-d chunk point %s",
+			len(i), c.NumDims(), c)
+	}
+	return NewIndexND(c), nil
+}
+
+// ----- IndexIterator implementation ------------
+type IndexNDIterator struct {
+	geom     Geometry
+	cursor   ChunkPointNd
+	begBlock ChunkPointNd
+	endBlock ChunkPointNd
+	valid    bool
+}
+
+// NewIndexNDIterator returns an IndexIterator that iterates over the chunks between
+// start and end, which must have the same number of dimensions.  Each span is a run
+// of chunks along the first dimension.
+func NewIndexNDIterator(geom Geometry, start, end ChunkPoint) (*IndexNDIterator, error) {
+	if start.NumDims() != end.NumDims() {
+		return nil, fmt.Errorf("Cannot iterate between %d-d and %d-d chunk points",
+			start.NumDims(), end.NumDims())
+	}
+	begBlock := ChunkPointNd(NewIndexND(start))
+	endBlock := ChunkPointNd(NewIndexND(end))
+	valid := len(begBlock) > 0
+	for dim := range begBlock {
+		if begBlock[dim] > endBlock[dim] {
+			valid = false
+		}
+	}
+	cursor := make(ChunkPointNd, len(begBlock))
+	copy(cursor, begBlock)
+	return &IndexNDIterator{
+		geom:     geom,
+		cursor:   cursor,
+		begBlock: begBlock,
+		endBlock: endBlock,
+		valid:    valid,
+	}, nil
+}
+
+func (it *IndexNDIterator) Valid() bool {
+	return it.valid
+}
+
+func (it *IndexNDIterator) IndexSpan() (beg, end Index, err error) {
+	begIndex := IndexND(it.cursor).Duplicate().(IndexND)
+	endIndex := IndexND(it.cursor).Duplicate().(IndexND)
+	begIndex[0] = it.begBlock[0]
+	endIndex[0] = it.endBlock[0]
+	return begIndex, endIndex, nil
+}
+
+func (it *IndexNDIterator) NextSpan() {
+	for dim := 1; dim < len(it.cursor); dim++ {
+		if it.cursor[dim] < it.endBlock[dim] {
+			it.cursor[dim]++
+			return
+		}
+		it.cursor[dim] = it.begBlock[dim]
+	}
+	it.valid = false
+}
+
 // TODO -- Morton (Z-order) curve
 type IndexMorton []byte
 
@@ -468,9 +1042,348 @@ func (i IndexMorton) Scheme() string {
 	return "Morton/Z-order Indexing"
 }
 
-// TODO -- Hilbert curve
-type IndexHilbert []byte
+// IndexHilbert implements the Index interface and orders 3d chunks along a Hilbert
+// curve.  Chunks that are consecutive along the curve are always adjacent in space,
+// so box queries break into fewer disjoint key ranges than with ZYX indexing.  As with
+// IndexZYX, coordinates are shifted into unsigned integer space before encoding.
+type IndexHilbert ChunkPoint3d
+
+const IndexHilbertSize = 12
+
+// Number of bits per dimension in a Hilbert index.
+const hilbertBits = 32
+
+func (i IndexHilbert) Duplicate() Index {
+	dup := i
+	return dup
+}
+
+func (i IndexHilbert) String() string {
+	return hex.EncodeToString(i.Bytes())
+}
+
+// Bytes returns the 96-bit position along the Hilbert curve in big endian so
+// lexicographic ordering of keys follows the curve.
+func (i IndexHilbert) Bytes() []byte {
+	var coord [3]uint32
+	for dim := 0; dim < 3; dim++ {
+		coord[dim] = uint32(int64(i[dim]) - math.MinInt32)
+	}
+	hilbertFromAxes(&coord)
+
+	// Interleave the transposed index from the most significant bit down.
+	buf := make([]byte, IndexHilbertSize)
+	pos := 0
+	for bit := hilbertBits - 1; bit >= 0; bit-- {
+		for dim := 0; dim < 3; dim++ {
+			if coord[dim]&(1<<uint(bit)) != 0 {
+				buf[pos/8] |= 0x80 >> uint(pos%8)
+			}
+			pos++
+		}
+	}
+	return buf
+}
+
+// Hash returns an integer [0, n) where the returned values should be reasonably
+// spread among the range of returned values.
+func (i IndexHilbert) Hash(n int) int {
+	return IndexZYX(i).Hash(n)
+}
 
 func (i IndexHilbert) Scheme() string {
 	return "Hilbert Indexing"
 }
+
+// IndexFromBytes returns an index from bytes.  The passed Index is used just
+// to choose the appropriate byte decoding scheme.
+func (i IndexHilbert) IndexFromBytes(b []byte) (Index, error) {
+	if len(b) < IndexHilbertSize {
+		return nil, fmt.Errorf("Hilbert index requires %d bytes, got %d", IndexHilbertSize, len(b))
+	}
+	var coord [3]uint32
+	pos := 0
+	for bit := hilbertBits - 1; bit >= 0; bit-- {
+		for dim := 0; dim < 3; dim++ {
+			if b[pos/8]&(0x80>>uint(pos%8)) != 0 {
+				coord[dim] |= 1 << uint(bit)
+			}
+			pos++
+		}
+	}
+	hilbertToAxes(&coord)
+	var index IndexHilbert
+	for dim := 0; dim < 3; dim++ {
+		index[dim] = int32(int64(coord[dim]) + math.MinInt32)
+	}
+	return &index, nil
+}
+
+// IndexFromPoint returns an index for a 3d chunk point.
+func (i IndexHilbert) IndexFromPoint(c ChunkPoint) (ChunkIndexer, error) {
+	if c.NumDims() != 3 {
+		return nil, fmt.Errorf("Cannot make Hilbert index from %d-d chunk point %s", c.NumDims(), c)
+	}
+	return IndexHilbert{c.Value(0), c.Value(1), c.Value(2)}, nil
+}
+
+// hilbertFromAxes converts coordinates in place to the transposed form of their
+// Hilbert index using Skilling's algorithm ("Programming the Hilbert curve", 2004).
+func hilbertFromAxes(x *[3]uint32) {
+	// Inverse undo excess work
+	for q := uint32(1) << (hilbertBits - 1); q > 1; q >>= 1 {
+		p := q - 1
+		for i := 0; i < 3; i++ {
+			if x[i]&q != 0 {
+				x[0] ^= p
+			} else {
+				t := (x[0] ^ x[i]) & p
+				x[0] ^= t
+				x[i] ^= t
+			}
+		}
+	}
+	// Gray encode
+	for i := 1; i < 3; i++ {
+		x[i] ^= x[i-1]
+	}
+	var t uint32
+	for q := uint32(1) << (hilbertBits - 1); q > 1; q >>= 1 {
+		if x[2]&q != 0 {
+			t ^= q - 1
+		}
+	}
+	for i := 0; i < 3; i++ {
+		x[i] ^= t
+	}
+}
+
+// hilbertToAxes converts the transposed form of a Hilbert index in place back to
+// coordinates.  It is the inverse of hilbertFromAxes.
+func hilbertToAxes(x *[3]uint32) {
+	// Gray decode
+	t := x[2] >> 1
+	for i := 2; i > 0; i-- {
+		x[i] ^= x[i-1]
+	}
+	x[0] ^= t
+	// Undo excess work
+	for q := uint64(2); q != 1<<hilbertBits; q <<= 1 {
+		p := uint32(q - 1)
+		for i := 2; i >= 0; i-- {
+			if x[i]&uint32(q) != 0 {
+				x[0] ^= p
+			} else {
+				t := (x[0] ^ x[i]) & p
+				x[0] ^= t
+				x[i] ^= t
+			}
+		}
+	}
+}
+
+// ------- ChunkIndexer interface ----------
+
+func (i IndexHilbert) NumDims() uint8 {
+	return 3
+}
+
+// Value returns the value at the specified dimension for this index.
+func (i IndexHilbert) Value(dim uint8) int32 {
+	return i[dim]
+}
+
+// MinPoint returns the minimum voxel coordinate for a chunk.
+func (i IndexHilbert) MinPoint(size Point) Point {
+	return ChunkPoint3d(i).MinPoint(size)
+}
+
+// MaxPoint returns the maximum voxel coordinate for a chunk.
+func (i IndexHilbert) MaxPoint(size Point) Point {
+	return ChunkPoint3d(i).MaxPoint(size)
+}
+
+// Min returns a ChunkIndexer that is the minimum of its value and the passed one.
+func (i IndexHilbert) Min(idx ChunkIndexer) (ChunkIndexer, bool) {
+	min, changed := IndexZYX(i).Min(idx)
+	return IndexHilbert(min.(IndexZYX)), changed
+}
+
+// Max returns a ChunkIndexer that is the maximum of its value and the passed one.
+func (i IndexHilbert) Max(idx ChunkIndexer) (ChunkIndexer, bool) {
+	max, changed := IndexZYX(i).Max(idx)
+	return IndexHilbert(max.(IndexZYX)), changed
+}
+
+// ----- IndexIterator implementation ------------
+
+// IndexHilbertIterator iterates over the chunks within a box in Hilbert order.  Each
+// span is a maximal run of chunks with consecutive Hilbert indices, so every key
+// within a span's range lies within the box.
+type IndexHilbertIterator struct {
+	geom  Geometry
+	spans [][]IndexHilbert
+	cur   int
+}
+
+type hilbertChunk struct {
+	code  []byte
+	index IndexHilbert
+}
+
+type hilbertChunks []hilbertChunk
+
+func (h hilbertChunks) Len() int           { return len(h) }
+func (h hilbertChunks) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h hilbertChunks) Less(i, j int) bool { return bytes.Compare(h[i].code, h[j].code) < 0 }
+
+// NewIndexHilbertIterator returns an IndexIterator that iterates over the chunks
+// between start and end in Hilbert order.
+func NewIndexHilbertIterator(geom Geometry, start, end ChunkPoint3d) *IndexHilbertIterator {
+	var chunks hilbertChunks
+	for z := start[2]; z <= end[2]; z++ {
+		for y := start[1]; y <= end[1]; y++ {
+			for x := start[0]; x <= end[0]; x++ {
+				index := IndexHilbert{x, y, z}
+				chunks = append(chunks, hilbertChunk{index.Bytes(), index})
+			}
+		}
+	}
+	sort.Sort(chunks)
+
+	it := &IndexHilbertIterator{geom: geom}
+	var span []IndexHilbert
+	for n, chunk := range chunks {
+		if n > 0 && !isSuccessor(chunks[n-1].code, chunk.code) {
+			it.spans = append(it.spans, span)
+			span = nil
+		}
+		span = append(span, chunk.index)
+	}
+	if len(span) != 0 {
+		it.spans = append(it.spans, span)
+	}
+	return it
+}
+
+// isSuccessor returns true if the big endian integer b is one more than a.
+func isSuccessor(a, b []byte) bool {
+	next := make([]byte, len(a))
+	copy(next, a)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return bytes.Equal(next, b)
+}
+
+func (it *IndexHilbertIterator) Valid() bool {
+	return it.cur < len(it.spans)
+}
+
+func (it *IndexHilbertIterator) IndexSpan() (beg, end Index, err error) {
+	span := it.spans[it.cur]
+	beg = span[0]
+	end = span[len(span)-1]
+	return
+}
+
+func (it *IndexHilbertIterator) NextSpan() {
+	it.cur++
+}
+
+// SpanIndices returns the chunk indices of the current span in index order.
+func (it *IndexHilbertIterator) SpanIndices() []ChunkIndexer {
+	span := it.spans[it.cur]
+	indices := make([]ChunkIndexer, len(span))
+	for n, index := range span {
+		indices[n] = index
+	}
+	return indices
+}
+
+// IndexScheme selects how 3d chunk coordinates are ordered into keys.
+type IndexScheme uint8
+
+const (
+	// ZYXScheme orders chunks by z, then y, then x and is the default.
+	ZYXScheme IndexScheme = iota
+
+	// HilbertScheme orders chunks along a 3d Hilbert curve.
+	HilbertScheme
+
+	// TZYXScheme orders chunks by time point, then z, y, and x.
+	TZYXScheme
+)
+
+func (s IndexScheme) String() string {
+	switch s {
+	case ZYXScheme:
+		return "zyx"
+	case HilbertScheme:
+		return "hilbert"
+	case TZYXScheme:
+		return "tzyx"
+	default:
+		return fmt.Sprintf("unknown index scheme %d", s)
+	}
+}
+
+// IndexSchemeFromString returns the IndexScheme named "zyx", "hilbert", or "tzyx".
+func IndexSchemeFromString(s string) (IndexScheme, error) {
+	switch strings.ToLower(s) {
+	case "zyx":
+		return ZYXScheme, nil
+	case "hilbert":
+		return HilbertScheme, nil
+	case "tzyx":
+		return TZYXScheme, nil
+	default:
+		return ZYXScheme, fmt.Errorf("Unknown index scheme '%s': must be 'zyx', 'hilbert', or 'tzyx'", s)
+	}
+}
+
+// Timed returns true if the scheme indexes chunks by time point.
+func (s IndexScheme) Timed() bool {
+	return s == TZYXScheme
+}
+
+// ChunkIndex returns the index of a 3d chunk under this scheme.  Timed schemes use
+// time point 0.
+func (s IndexScheme) ChunkIndex(c ChunkPoint3d) ChunkIndexer {
+	return s.ChunkIndexAt(0, c)
+}
+
+// ChunkIndexAt returns the index of a 3d chunk at a time point under this scheme.
+// The time point is ignored by schemes that aren't timed.
+func (s IndexScheme) ChunkIndexAt(t int32, c ChunkPoint3d) ChunkIndexer {
+	switch s {
+	case HilbertScheme:
+		return IndexHilbert(c)
+	case TZYXScheme:
+		return IndexTZYX{t, IndexZYX(c)}
+	default:
+		return IndexZYX(c)
+	}
+}
+
+// NewIterator returns an IndexIterator over the chunks between start and end.
+// Timed schemes use time point 0.
+func (s IndexScheme) NewIterator(geom Geometry, start, end ChunkPoint3d) IndexIterator {
+	return s.NewIteratorAt(0, geom, start, end)
+}
+
+// NewIteratorAt returns an IndexIterator over the chunks between start and end at a
+// time point.  The time point is ignored by schemes that aren't timed.
+func (s IndexScheme) NewIteratorAt(t int32, geom Geometry, start, end ChunkPoint3d) IndexIterator {
+	switch s {
+	case HilbertScheme:
+		return NewIndexHilbertIterator(geom, start, end)
+	case TZYXScheme:
+		return NewIndexTZYXIterator(t, t, geom, start, end)
+	default:
+		return NewIndexZYXIterator(geom, start, end)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+	This file implements a ZYX index with 64-bit block coordinates for volumes whose
+	block coordinates can exceed the range of 32-bit integers.
+*/
+
+package dvid
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+)
+
+// IndexZYX64 implements the Index interface and orders blocks by z, then y, then x
+// using 64-bit block coordinates in x, y, z order.
+type IndexZYX64 [3]int64
+
+const IndexZYX64Size = 24
+
+var (
+	MaxIndexZYX64 = IndexZYX64{math.MaxInt64, math.MaxInt64, math.MaxInt64}
+	MinIndexZYX64 = IndexZYX64{math.MinInt64, math.MinInt64, math.MinInt64}
+)
+
+// IndexZYX64FromIndex returns the 64-bit index of the block with a 32-bit index.
+func IndexZYX64FromIndex(i IndexZYX) IndexZYX64 {
+	return IndexZYX64{int64(i[0]), int64(i[1]), int64(i[2])}
+}
+
+func (i IndexZYX64) Duplicate() Index {
+	dup := i
+	return dup
+}
+
+func (i IndexZYX64) String() string {
+	return hex.EncodeToString(i.Bytes())
+}
+
+// Bytes returns a byte representation of the Index.  Like IndexZYX, coordinates are
+// offset so negative coordinates sort before positive ones.
+func (i IndexZYX64) Bytes() []byte {
+	buf := make([]byte, IndexZYX64Size)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(i[2])^(1<<63))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(i[1])^(1<<63))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(i[0])^(1<<63))
+	return buf
+}
+
+// Hash returns an integer [0, n) that maps blocks along any axis to different handlers.
+func (i IndexZYX64) Hash(n int) int {
+	return int(uint64(i[0]+i[1]+i[2]) % uint64(n))
+}
+
+func (i IndexZYX64) Scheme() string {
+	return "ZYX 64-bit Indexing"
+}
+
+// IndexFromBytes returns an index from bytes.  The passed Index is used just
+// to choose the appropriate byte decoding scheme.
+func (i IndexZYX64) IndexFromBytes(b []byte) (Index, error) {
+	if len(b) != IndexZYX64Size {
+		return nil, fmt.Errorf("Cannot convert %d bytes to IndexZYX64", len(b))
+	}
+	z := int64(binary.BigEndian.Uint64(b[0:8]) ^ (1 << 63))
+	y := int64(binary.BigEndian.Uint64(b[8:16]) ^ (1 << 63))
+	x := int64(binary.BigEndian.Uint64(b[16:24]) ^ (1 << 63))
+	return &IndexZYX64{x, y, z}, nil
+}
+
+// NumDims returns the number of dimensions of the index.
+func (i IndexZYX64) NumDims() uint8 {
+	return 3
+}
+
+// Value returns the block coordinate at the specified dimension.
+func (i IndexZYX64) Value(dim uint8) int64 {
+	return i[dim]
+}
+
+// IndexZYX returns the 32-bit index of the block or an error if any coordinate is
+// outside the range of 32-bit integers.
+func (i IndexZYX64) IndexZYX() (IndexZYX, error) {
+	var index IndexZYX
+	for dim, value := range i {
+		if value < math.MinInt32 || value > math.MaxInt32 {
+			return index, fmt.Errorf("Block coordinate %d of %v exceeds 32-bit index range", value, [3]int64(i))
+		}
+		index[dim] = int32(value)
+	}
+	return index, nil
+}
+
+// MinVoxel returns the minimum voxel coordinate of the block given a block size.
+func (i IndexZYX64) MinVoxel(size Point3d) [3]int64 {
+	return [3]int64{i[0] * int64(size[0]), i[1] * int64(size[1]), i[2] * int64(size[2])}
+}
+
+// MaxVoxel returns the maximum voxel coordinate of the block given a block size.
+func (i IndexZYX64) MaxVoxel(size Point3d) [3]int64 {
+	return [3]int64{
+		(i[0]+1)*int64(size[0]) - 1,
+		(i[1]+1)*int64(size[1]) - 1,
+		(i[2]+1)*int64(size[2]) - 1,
+	}
+}
+
+// Min returns the index that is the minimum of its value and the passed one in each
+// dimension.
+func (i IndexZYX64) Min(idx IndexZYX64) (IndexZYX64, bool) {
+	var changed bool
+	min := i
+	for dim := range min {
+		if min[dim] > idx[dim] {
+			min[dim] = idx[dim]
+			changed = true
+		}
+	}
+	return min, changed
+}
+
+// Max returns the index that is the maximum of its value and the passed one in each
+// dimension.
+func (i IndexZYX64) Max(idx IndexZYX64) (IndexZYX64, bool) {
+	var changed bool
+	max := i
+	for dim := range max {
+		if max[dim] < idx[dim] {
+			max[dim] = idx[dim]
+			changed = true
+		}
+	}
+	return max, changed
+}
+
+// ----- IndexIterator implementation ------------
+
+// IndexZYX64Iterator iterates over the blocks within a box of 64-bit block coordinates,
+// where each span is a run of blocks along x.
+type IndexZYX64Iterator struct {
+	y, z     int64
+	begBlock IndexZYX64
+	endBlock IndexZYX64
+	done     bool
+}
+
+// NewIndexZYX64Iterator returns an IndexIterator over the blocks between start and end
+// inclusive.
+func NewIndexZYX64Iterator(start, end IndexZYX64) *IndexZYX64Iterator {
+	it := &IndexZYX64Iterator{y: start[1], z: start[2], begBlock: start, endBlock: end}
+	for dim := range start {
+		if start[dim] > end[dim] {
+			it.done = true
+		}
+	}
+	return it
+}
+
+func (it *IndexZYX64Iterator) Valid() bool {
+	return !it.done
+}
+
+func (it *IndexZYX64Iterator) IndexSpan() (beg, end Index, err error) {
+	beg = IndexZYX64{it.begBlock[0], it.y, it.z}
+	end = IndexZYX64{it.endBlock[0], it.y, it.z}
+	return
+}
+
+// NextSpan moves to the next row of blocks.  Coordinates are compared before being
+// incremented so iteration ends properly at the maximum 64-bit coordinate.
+func (it *IndexZYX64Iterator) NextSpan() {
+	if it.y < it.endBlock[1] {
+		it.y++
+		return
+	}
+	if it.z < it.endBlock[2] {
+		it.y = it.begBlock[1]
+		it.z++
+		return
+	}
+	it.done = true
+}
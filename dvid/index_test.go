@@ -3,6 +3,7 @@ package dvid
 import (
 	"bytes"
 	. "github.com/janelia-flyem/go/gocheck"
+	"math"
 	_ "testing"
 )
 
@@ -26,3 +27,314 @@ func (suite *DataSuite) TestNegIndicesSequential(c *C) {
 		copy(lastBytes, ibytes)
 	}
 }
+
+// Make sure Hilbert indices decode to their chunk and consecutive indices are adjacent chunks.
+func (suite *DataSuite) TestIndexHilbert(c *C) {
+	it := NewIndexHilbertIterator(nil, ChunkPoint3d{0, 0, 0}, ChunkPoint3d{7, 7, 7})
+	c.Assert(it.Valid(), Equals, true)
+	indices := it.SpanIndices()
+	it.NextSpan()
+	c.Assert(it.Valid(), Equals, false)
+	c.Assert(indices, HasLen, 512)
+
+	for n, index := range indices {
+		decoded, err := IndexHilbert{}.IndexFromBytes(index.Bytes())
+		c.Assert(err, IsNil)
+		c.Assert(*(decoded.(*IndexHilbert)), Equals, index)
+		if n == 0 {
+			continue
+		}
+		var dist int32
+		for dim := uint8(0); dim < 3; dim++ {
+			delta := index.Value(dim) - indices[n-1].Value(dim)
+			if delta < 0 {
+				delta = -delta
+			}
+			dist += delta
+		}
+		if dist != 1 {
+			c.Errorf("Hilbert indices %d and %d are not adjacent: %v, %v", n-1, n, indices[n-1], index)
+		}
+	}
+
+	// Chunks with negative coordinates still map to one of the handlers.
+	for _, hash := range []int{IndexZYX{-5, -9, 1}.Hash(4), IndexHilbert{-5, -9, 1}.Hash(4)} {
+		c.Assert(hash >= 0 && hash < 4, Equals, true)
+	}
+}
+
+// Make sure Hilbert ordering needs fewer key ranges than ZYX ordering for a cubic box query.
+func (suite *DataSuite) TestIndexHilbertSpans(c *C) {
+	countSpans := func(it IndexIterator) (spans, chunks int) {
+		for ; it.Valid(); it.NextSpan() {
+			beg, end, err := it.IndexSpan()
+			c.Assert(err, IsNil)
+			c.Assert(bytes.Compare(beg.Bytes(), end.Bytes()) <= 0, Equals, true)
+			if lister, ok := it.(IndexSpanLister); ok {
+				chunks += len(lister.SpanIndices())
+			} else {
+				chunks += int(end.(ChunkIndexer).Value(0)-beg.(ChunkIndexer).Value(0)) + 1
+			}
+			spans++
+		}
+		return
+	}
+	start := ChunkPoint3d{100, 200, 300}
+	end := ChunkPoint3d{131, 231, 331}
+	zyxSpans, zyxChunks := countSpans(ZYXScheme.NewIterator(nil, start, end))
+	hilbertSpans, hilbertChunks := countSpans(HilbertScheme.NewIterator(nil, start, end))
+	c.Assert(zyxChunks, Equals, 32768)
+	c.Assert(hilbertChunks, Equals, 32768)
+	c.Assert(zyxSpans, Equals, 1024)
+	if hilbertSpans >= zyxSpans {
+		c.Errorf("Hilbert box query needs %d spans, ZYX only %d", hilbertSpans, zyxSpans)
+	}
+
+	scheme, err := IndexSchemeFromString("Hilbert")
+	c.Assert(err, IsNil)
+	c.Assert(scheme, Equals, HilbertScheme)
+	_, err = IndexSchemeFromString("morton")
+	c.Assert(err, NotNil)
+}
+
+// Make sure TZYX indices decode, sort by time first, and iterate over all time points.
+func (suite *DataSuite) TestIndexTZYX(c *C) {
+	index := IndexTZYX{-3, IndexZYX{1, -2, 3}}
+	decoded, err := IndexTZYX{}.IndexFromBytes(index.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(*(decoded.(*IndexTZYX)), Equals, index)
+
+	later := IndexTZYX{-2, IndexZYX{-100, -100, -100}}
+	c.Assert(bytes.Compare(index.Bytes(), later.Bytes()) < 0, Equals, true)
+
+	it := NewIndexTZYXIterator(2, 4, nil, ChunkPoint3d{0, 0, 0}, ChunkPoint3d{3, 1, 2})
+	var spans int
+	for ; it.Valid(); it.NextSpan() {
+		beg, end, err := it.IndexSpan()
+		c.Assert(err, IsNil)
+		c.Assert(beg.(IndexTZYX).Time, Equals, int32(2+spans/6))
+		c.Assert(end.(IndexTZYX).Value(0), Equals, int32(3))
+		spans++
+	}
+	c.Assert(spans, Equals, 3*2*3)
+
+	for time := int32(-3); time < 1; time++ {
+		hash := IndexTZYX{time, IndexZYX{-5, -9, 1}}.Hash(4)
+		c.Assert(hash >= 0 && hash < 4, Equals, true)
+	}
+}
+
+// Make sure channel indices round trip, sort negative values first, and legacy
+// encodings migrate to the current one.
+func (suite *DataSuite) TestIndexCZYX(c *C) {
+	index := IndexCZYX{2, IndexZYX{-1, 5, -7}}
+	decoded, err := IndexCZYX{}.IndexFromBytes(index.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(*(decoded.(*IndexCZYX)), Equals, index)
+	_, err = IndexCZYX{}.IndexFromBytes(index.Bytes()[:12])
+	c.Assert(err, NotNil)
+
+	lastBytes := IndexCZYX{-3, IndexZYX{0, 0, 0}}.Bytes()
+	for _, channel := range []int32{-2, 0, 1} {
+		curBytes := IndexCZYX{channel, IndexZYX{-10, -10, -10}}.Bytes()
+		c.Assert(bytes.Compare(lastBytes, curBytes) < 0, Equals, true)
+		lastBytes = curBytes
+	}
+
+	legacy := append([]byte{0, 0, 0, 2}, index.IndexZYX.Bytes()...)
+	c.Assert(IsLegacyIndexCZYX(legacy), Equals, true)
+	c.Assert(IsLegacyIndexCZYX(index.Bytes()), Equals, false)
+	migrated, err := MigrateIndexCZYX(legacy)
+	c.Assert(err, IsNil)
+	c.Assert(migrated, DeepEquals, index.Bytes())
+	_, err = MigrateIndexCZYX(migrated)
+	c.Assert(err, NotNil)
+}
+
+// Make sure channel-range iteration visits spans of each channel in key order.
+func (suite *DataSuite) TestIndexCZYXChannelIterator(c *C) {
+	it := NewIndexCZYXChannelIterator(1, 3, nil, ChunkPoint3d{-1, 0, 0}, ChunkPoint3d{2, 1, 2})
+	var spans int
+	var lastBytes []byte
+	for ; it.Valid(); it.NextSpan() {
+		beg, end, err := it.IndexSpan()
+		c.Assert(err, IsNil)
+		c.Assert(beg.(IndexCZYX).Channel, Equals, int32(1+spans/6))
+		c.Assert(it.Channel(), Equals, beg.(IndexCZYX).Channel)
+		c.Assert(beg.(IndexCZYX).Value(0), Equals, int32(-1))
+		c.Assert(end.(IndexCZYX).Value(0), Equals, int32(2))
+		c.Assert(bytes.Compare(lastBytes, beg.Bytes()) < 0, Equals, true)
+		lastBytes = end.Bytes()
+		spans++
+	}
+	c.Assert(spans, Equals, 3*2*3)
+
+	empty := NewIndexCZYXChannelIterator(2, 1, nil, ChunkPoint3d{0, 0, 0}, ChunkPoint3d{1, 1, 1})
+	c.Assert(empty.Valid(), Equals, false)
+}
+
+// Make sure N-d indices round trip, sort like ZYX indices, and iterate over all chunks.
+func (suite *DataSuite) TestIndexND(c *C) {
+	var indexer PointIndexer = IndexND{}
+	index, err := indexer.IndexFromPoint(ChunkPointNd{1, -2, 3})
+	c.Assert(err, IsNil)
+	c.Assert(index.Bytes(), DeepEquals, IndexZYX{1, -2, 3}.Bytes())
+
+	index4d := IndexND{1, -2, 3, -4}
+	decoded, err := IndexND{}.IndexFromBytes(index4d.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(*(decoded.(*IndexND)), DeepEquals, index4d)
+	_, err = IndexND{0, 0, 0}.IndexFromBytes(index4d.Bytes()[:8])
+	c.Assert(err, NotNil)
+
+	min, changed := index4d.Min(IndexND{0, 0, 0, 0})
+	c.Assert(changed, Equals, true)
+	c.Assert(min, DeepEquals, IndexND{0, -2, 0, -4})
+
+	it, err := NewIndexNDIterator(nil, ChunkPointNd{0, 0, 0, 0}, ChunkPointNd{2, 1, 2, 3})
+	c.Assert(err, IsNil)
+	var spans int
+	var lastBytes []byte
+	for ; it.Valid(); it.NextSpan() {
+		beg, end, err := it.IndexSpan()
+		c.Assert(err, IsNil)
+		c.Assert(beg.(IndexND).Value(0), Equals, int32(0))
+		c.Assert(end.(IndexND).Value(0), Equals, int32(2))
+		if lastBytes != nil && bytes.Compare(lastBytes, beg.Bytes()) >= 0 {
+			c.Errorf("Span %d at %v does not follow previous span", spans, beg)
+		}
+		lastBytes = end.Bytes()
+		spans++
+	}
+	c.Assert(spans, Equals, 2*3*4)
+
+	_, err = NewIndexNDIterator(nil, ChunkPointNd{0, 0, 0, 0}, ChunkPoint3d{1, 1, 1})
+	c.Assert(err, NotNil)
+}
+
+func (suite *DataSuite) TestIndexRangeSets(c *C) {
+	idx := func(x int32) Index { return IndexZYX{x, 0, 0} }
+	r1 := IndexRange{idx(0), idx(10)}
+	r2 := IndexRange{idx(5), idx(20)}
+	r3 := IndexRange{idx(30), idx(40)}
+
+	c.Assert(r1.Contains(idx(10)), Equals, true)
+	c.Assert(r1.Contains(idx(11)), Equals, false)
+	c.Assert(IndexRange{}.Contains(idx(0)), Equals, false)
+
+	overlap := r1.Intersect(r2)
+	c.Assert(CompareIndices(overlap.Minimum, idx(5)), Equals, 0)
+	c.Assert(CompareIndices(overlap.Maximum, idx(10)), Equals, 0)
+	c.Assert(r1.Intersect(r3).Empty(), Equals, true)
+
+	union := r1.Union(r2)
+	c.Assert(union, HasLen, 1)
+	c.Assert(CompareIndices(union[0].Maximum, idx(20)), Equals, 0)
+	c.Assert(r3.Union(r1), HasLen, 2)
+
+	ranges := NewIndexRanges(r3, r1)
+	c.Assert(ranges.Contains(idx(35)), Equals, true)
+	c.Assert(ranges.Contains(idx(25)), Equals, false)
+
+	requested := NewIndexRanges(IndexRange{idx(8), idx(32)})
+	present := ranges.Intersect(requested)
+	c.Assert(present, HasLen, 2)
+	c.Assert(CompareIndices(present[0].Minimum, idx(8)), Equals, 0)
+	c.Assert(CompareIndices(present[1].Maximum, idx(32)), Equals, 0)
+
+	all := ranges.Union(requested)
+	c.Assert(all, HasLen, 1)
+	c.Assert(CompareIndices(all.Span().Maximum, idx(40)), Equals, 0)
+}
+
+// Make sure 64-bit indices round trip, sort negative coordinates first, and iterate
+// through the largest coordinates without overflow.
+func (suite *DataSuite) TestIndexZYX64(c *C) {
+	index := IndexZYX64{-5, 1 << 40, math.MaxInt64}
+	decoded, err := IndexZYX64{}.IndexFromBytes(index.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(*(decoded.(*IndexZYX64)), Equals, index)
+	_, err = IndexZYX64{}.IndexFromBytes(index.Bytes()[:12])
+	c.Assert(err, NotNil)
+
+	lastBytes := MinIndexZYX64.Bytes()
+	for _, z := range []int64{-1 << 40, -1, 0, 1 << 40, math.MaxInt64} {
+		curBytes := IndexZYX64{0, 0, z}.Bytes()
+		c.Assert(bytes.Compare(lastBytes, curBytes) < 0, Equals, true)
+		lastBytes = curBytes
+	}
+
+	_, err = index.IndexZYX()
+	c.Assert(err, NotNil)
+	small, err := IndexZYX64{-5, 6, 7}.IndexZYX()
+	c.Assert(err, IsNil)
+	c.Assert(small, Equals, IndexZYX{-5, 6, 7})
+	c.Assert(IndexZYX64FromIndex(small), Equals, IndexZYX64{-5, 6, 7})
+
+	c.Assert(index.MinVoxel(Point3d{32, 32, 1}), Equals, [3]int64{-160, 1 << 45, math.MaxInt64})
+
+	start := IndexZYX64{0, math.MaxInt64 - 1, math.MaxInt64 - 2}
+	end := IndexZYX64{3, math.MaxInt64, math.MaxInt64}
+	var spans int
+	for it := NewIndexZYX64Iterator(start, end); it.Valid(); it.NextSpan() {
+		beg, last, err := it.IndexSpan()
+		c.Assert(err, IsNil)
+		c.Assert(beg.(IndexZYX64)[0], Equals, int64(0))
+		c.Assert(last.(IndexZYX64)[0], Equals, int64(3))
+		spans++
+	}
+	c.Assert(spans, Equals, 6)
+	c.Assert(NewIndexZYX64Iterator(end, start).Valid(), Equals, false)
+}
+
+// Make sure tile indices round trip, keep their plane and scale, and work with ROIs.
+func (suite *DataSuite) TestIndexTile(c *C) {
+	index := NewIndexTile(IndexZYX{3, -2, 100}, XY, 2)
+	b := index.Bytes()
+	c.Assert(b, HasLen, IndexTileSize)
+	c.Assert(b[:DataShapeBytes], DeepEquals, XY.Bytes())
+	c.Assert(b[DataShapeBytes], Equals, uint8(2))
+	decoded, err := IndexTile{}.IndexFromBytes(b)
+	c.Assert(err, IsNil)
+	c.Assert(decoded.Bytes(), DeepEquals, b)
+	c.Assert(decoded.(*IndexTile).Plane.Equals(XY), Equals, true)
+	_, err = IndexTile{}.IndexFromBytes(b[:IndexTileSize-1])
+	c.Assert(err, NotNil)
+
+	// Lower scales sort first within a plane.
+	coarser := NewIndexTile(IndexZYX{0, 0, 0}, XY, 3)
+	c.Assert(bytes.Compare(b, coarser.Bytes()) < 0, Equals, true)
+
+	var indexer PointIndexer = *index
+	fromPoint, err := indexer.IndexFromPoint(ChunkPoint3d{7, 8, 100})
+	c.Assert(err, IsNil)
+	c.Assert(fromPoint.(IndexTile).Scale, Equals, uint8(2))
+	c.Assert(fromPoint.Value(0), Equals, int32(7))
+	min, changed := index.Min(fromPoint)
+	c.Assert(changed, Equals, false)
+	c.Assert(min.(IndexTile).Plane.Equals(XY), Equals, true)
+	max, changed := index.Max(fromPoint)
+	c.Assert(changed, Equals, true)
+	c.Assert(max.Value(0), Equals, int32(7))
+
+	it := NewIndexTileIterator(XZ, 1, ChunkPoint3d{0, 5, 0}, ChunkPoint3d{3, 5, 2})
+	var spans int
+	for ; it.Valid(); it.NextSpan() {
+		beg, end, err := it.IndexSpan()
+		c.Assert(err, IsNil)
+		c.Assert(beg.(IndexTile).Scale, Equals, uint8(1))
+		c.Assert(end.(IndexTile).Value(0), Equals, int32(3))
+		spans++
+	}
+	c.Assert(spans, Equals, 3)
+
+	roi, err := NewROI([]BlockSpan{{Z: 1, Y: 5, X0: 1, X1: 2}})
+	c.Assert(err, IsNil)
+	roiIt := NewROIIterator(NewIndexTileIterator(XZ, 1, ChunkPoint3d{0, 5, 0}, ChunkPoint3d{3, 5, 2}), roi)
+	c.Assert(roiIt.Valid(), Equals, true)
+	beg, end, err := roiIt.IndexSpan()
+	c.Assert(err, IsNil)
+	c.Assert(beg.(IndexTile).Value(0), Equals, int32(1))
+	c.Assert(end.(IndexTile).Value(0), Equals, int32(2))
+	c.Assert(end.(IndexTile).Scale, Equals, uint8(1))
+}
@@ -0,0 +1,232 @@
+/*
+	This file benchmarks the key locality of chunk indexing schemes for typical access
+	patterns, so operators can choose an index scheme for their data empirically.
+*/
+
+package dvid
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultIndexBenchSize is the default number of blocks along each axis of the
+	// benchmarked volume.
+	DefaultIndexBenchSize = 32
+
+	// DefaultIndexBenchRuns is the default number of timed runs of each access pattern.
+	DefaultIndexBenchRuns = 10
+)
+
+// IndexBenchSchemes are the names of the benchmarked index schemes.
+var IndexBenchSchemes = []string{"zyx", "morton", "hilbert"}
+
+// IndexBenchPatterns are the names of the benchmarked access patterns.
+var IndexBenchPatterns = []string{"xy", "xz", "cube"}
+
+// IndexBenchResult measures an access pattern under an index scheme within a volume
+// where every block is stored.
+type IndexBenchResult struct {
+	Scheme  string
+	Pattern string
+
+	// Blocks is the number of blocks read by the access pattern.
+	Blocks int
+
+	// Spans is the number of disjoint key ranges holding only the blocks read.
+	Spans int
+
+	// ScannedKeys is the number of keys between the first and last key read, i.e.,
+	// the keys traversed by a single range query covering the access pattern.
+	ScannedKeys int
+
+	// IterationTime is the mean time to compute, order, and group the keys read.
+	IterationTime time.Duration
+}
+
+// MeanSpan returns the mean number of blocks per key range.
+func (r IndexBenchResult) MeanSpan() float64 {
+	if r.Spans == 0 {
+		return 0
+	}
+	return float64(r.Blocks) / float64(r.Spans)
+}
+
+// ScanAmplification returns the ratio of keys traversed by a single range query to
+// the blocks actually read.
+func (r IndexBenchResult) ScanAmplification() float64 {
+	if r.Blocks == 0 {
+		return 0
+	}
+	return float64(r.ScannedKeys) / float64(r.Blocks)
+}
+
+// mortonBytes returns the 96-bit position of a chunk along a Morton (Z-order) curve in
+// big endian.  Coordinates are shifted into unsigned integer space as with IndexHilbert.
+func mortonBytes(c ChunkPoint3d) []byte {
+	var coord [3]uint32
+	for dim := 0; dim < 3; dim++ {
+		coord[dim] = uint32(int64(c[dim]) - math.MinInt32)
+	}
+	buf := make([]byte, IndexHilbertSize)
+	pos := 0
+	for bit := 31; bit >= 0; bit-- {
+		for dim := 2; dim >= 0; dim-- {
+			if coord[dim]&(1<<uint(bit)) != 0 {
+				buf[pos/8] |= 0x80 >> uint(pos%8)
+			}
+			pos++
+		}
+	}
+	return buf
+}
+
+// indexBenchKey returns the key of a chunk under a benchmarked index scheme.
+func indexBenchKey(scheme string, c ChunkPoint3d) ([]byte, error) {
+	switch scheme {
+	case "zyx":
+		return IndexZYX(c).Bytes(), nil
+	case "morton":
+		return mortonBytes(c), nil
+	case "hilbert":
+		return IndexHilbert(c).Bytes(), nil
+	default:
+		return nil, fmt.Errorf("Unknown index scheme '%s' for benchmark: must be one of %s",
+			scheme, strings.Join(IndexBenchSchemes, ", "))
+	}
+}
+
+// indexBenchBox returns the box of blocks read by an access pattern within a volume of
+// size blocks along each axis.  Slices pass through the middle of the volume, and the
+// cube is a quarter of the volume's size and not aligned to the volume's center.
+func indexBenchBox(pattern string, size int32) (begBlock, endBlock ChunkPoint3d, err error) {
+	mid := size / 2
+	switch pattern {
+	case "xy":
+		return ChunkPoint3d{0, 0, mid}, ChunkPoint3d{size - 1, size - 1, mid}, nil
+	case "xz":
+		return ChunkPoint3d{0, mid, 0}, ChunkPoint3d{size - 1, mid, size - 1}, nil
+	case "cube":
+		side := size / 4
+		if side < 1 {
+			side = 1
+		}
+		beg := size / 3
+		return ChunkPoint3d{beg, beg, beg}, ChunkPoint3d{beg + side - 1, beg + side - 1, beg + side - 1}, nil
+	default:
+		err = fmt.Errorf("Unknown access pattern '%s' for benchmark: must be one of %s",
+			pattern, strings.Join(IndexBenchPatterns, ", "))
+		return
+	}
+}
+
+// indexBenchSpans computes, orders, and groups the keys of a box of blocks into spans
+// of consecutively stored keys.  The ranks give the position of each stored key.
+func indexBenchSpans(scheme string, begBlock, endBlock ChunkPoint3d, ranks map[string]int) (
+	spans, first, last int, err error) {
+
+	var keyRanks []int
+	for z := begBlock[2]; z <= endBlock[2]; z++ {
+		for y := begBlock[1]; y <= endBlock[1]; y++ {
+			for x := begBlock[0]; x <= endBlock[0]; x++ {
+				key, err := indexBenchKey(scheme, ChunkPoint3d{x, y, z})
+				if err != nil {
+					return 0, 0, 0, err
+				}
+				keyRanks = append(keyRanks, ranks[string(key)])
+			}
+		}
+	}
+	sort.Ints(keyRanks)
+	for i, rank := range keyRanks {
+		if i == 0 || rank != keyRanks[i-1]+1 {
+			spans++
+		}
+	}
+	if len(keyRanks) != 0 {
+		first, last = keyRanks[0], keyRanks[len(keyRanks)-1]
+	}
+	return
+}
+
+// BenchmarkIndexSchemes measures each access pattern under each index scheme within a
+// cubic volume of size blocks along each axis, timing the given number of runs.
+func BenchmarkIndexSchemes(size int32, runs int) ([]IndexBenchResult, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("Benchmark volume must be at least one block in size, not %d", size)
+	}
+	if int64(size)*int64(size)*int64(size) > MaxRegionBlocks {
+		return nil, fmt.Errorf("Benchmark volume of %d blocks per side is too large", size)
+	}
+	if runs < 1 {
+		runs = 1
+	}
+	var results []IndexBenchResult
+	for _, scheme := range IndexBenchSchemes {
+		// Rank every stored key of the volume in key order.
+		keys := make([][]byte, 0, int(size)*int(size)*int(size))
+		for z := int32(0); z < size; z++ {
+			for y := int32(0); y < size; y++ {
+				for x := int32(0); x < size; x++ {
+					key, err := indexBenchKey(scheme, ChunkPoint3d{x, y, z})
+					if err != nil {
+						return nil, err
+					}
+					keys = append(keys, key)
+				}
+			}
+		}
+		sort.Sort(byteSlices(keys))
+		ranks := make(map[string]int, len(keys))
+		for rank, key := range keys {
+			ranks[string(key)] = rank
+		}
+
+		for _, pattern := range IndexBenchPatterns {
+			begBlock, endBlock, err := indexBenchBox(pattern, size)
+			if err != nil {
+				return nil, err
+			}
+			result := IndexBenchResult{
+				Scheme:  scheme,
+				Pattern: pattern,
+				Blocks: int(endBlock[0]-begBlock[0]+1) * int(endBlock[1]-begBlock[1]+1) *
+					int(endBlock[2]-begBlock[2]+1),
+			}
+			startTime := time.Now()
+			for run := 0; run < runs; run++ {
+				spans, first, last, err := indexBenchSpans(scheme, begBlock, endBlock, ranks)
+				if err != nil {
+					return nil, err
+				}
+				result.Spans = spans
+				result.ScannedKeys = last - first + 1
+			}
+			result.IterationTime = time.Since(startTime) / time.Duration(runs)
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+type byteSlices [][]byte
+
+func (b byteSlices) Len() int           { return len(b) }
+func (b byteSlices) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byteSlices) Less(i, j int) bool { return bytes.Compare(b[i], b[j]) < 0 }
+
+// IndexBenchTable returns a table of benchmark results for printing.
+func IndexBenchTable(results []IndexBenchResult) string {
+	table := fmt.Sprintf("%-8s %-8s %8s %8s %10s %12s %10s %14s\n", "scheme", "pattern", "blocks",
+		"spans", "mean span", "scanned keys", "scan amp", "iteration")
+	for _, r := range results {
+		table += fmt.Sprintf("%-8s %-8s %8d %8d %10.1f %12d %10.2f %14s\n", r.Scheme, r.Pattern, r.Blocks,
+			r.Spans, r.MeanSpan(), r.ScannedKeys, r.ScanAmplification(), r.IterationTime)
+	}
+	return table
+}
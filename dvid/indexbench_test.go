@@ -0,0 +1,48 @@
+package dvid
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+	_ "testing"
+)
+
+func (suite *DataSuite) TestMortonBytes(c *C) {
+	// Morton order visits the 8 chunks of a 2x2x2 cube in x, then y, then z order.
+	var prev []byte
+	for i := int32(0); i < 8; i++ {
+		key := mortonBytes(ChunkPoint3d{i & 1, (i >> 1) & 1, (i >> 2) & 1})
+		c.Assert(key, HasLen, IndexHilbertSize)
+		if prev != nil {
+			c.Assert(isSuccessor(prev, key), Equals, true)
+		}
+		prev = key
+	}
+	c.Assert(string(mortonBytes(ChunkPoint3d{-1, 0, 0})) < string(mortonBytes(ChunkPoint3d{0, 0, 0})), Equals, true)
+}
+
+func (suite *DataSuite) TestBenchmarkIndexSchemes(c *C) {
+	_, err := BenchmarkIndexSchemes(0, 1)
+	c.Assert(err, NotNil)
+
+	results, err := BenchmarkIndexSchemes(8, 1)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, len(IndexBenchSchemes)*len(IndexBenchPatterns))
+	byName := make(map[string]IndexBenchResult)
+	for _, result := range results {
+		c.Assert(result.Spans >= 1, Equals, true)
+		c.Assert(result.ScannedKeys >= result.Blocks, Equals, true)
+		byName[result.Scheme+" "+result.Pattern] = result
+	}
+
+	// ZYX reads an XY slice of blocks in one span but an XZ slice in one span per z.
+	c.Assert(byName["zyx xy"].Blocks, Equals, 64)
+	c.Assert(byName["zyx xy"].Spans, Equals, 1)
+	c.Assert(byName["zyx xy"].ScanAmplification(), Equals, 1.0)
+	c.Assert(byName["zyx xz"].Spans, Equals, 8)
+	c.Assert(byName["zyx xz"].ScannedKeys, Equals, 7*64+8)
+
+	// Space-filling curves need fewer spans for cubes than ZYX.
+	c.Assert(byName["zyx cube"].Blocks, Equals, 8)
+	c.Assert(byName["zyx cube"].Spans, Equals, 4)
+	c.Assert(byName["hilbert cube"].Spans < byName["zyx cube"].Spans, Equals, true)
+	c.Assert(byName["morton cube"].Spans <= byName["zyx cube"].Spans, Equals, true)
+}
@@ -0,0 +1,140 @@
+/*
+	This file supports indexing of 2d tiles by scale level, plane, and tile coordinates,
+	so tiled data can use the generic index iterators and ROI filtering.
+*/
+
+package dvid
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// IndexTile implements the PointIndexer interface for tiles of a plane at a scale level,
+// where scale 0 is the original resolution.  The tile coordinates are 3d: the two axes
+// of the plane give tile positions and the remaining axis gives the voxel coordinate of
+// the plane.  Tiles are ordered by plane, then scale, then Z, Y, and X.
+type IndexTile struct {
+	Plane DataShape
+	Scale uint8
+	IndexZYX
+}
+
+// IndexTileSize is the number of bytes in an IndexTile representation.
+const IndexTileSize = DataShapeBytes + 2 + IndexZYXSize
+
+// NewIndexTile returns the index of a tile in a plane at a scale level.
+func NewIndexTile(i IndexZYX, plane DataShape, scale uint8) *IndexTile {
+	return &IndexTile{plane, scale, i}
+}
+
+func (i IndexTile) Duplicate() Index {
+	return IndexTile{i.Plane.Duplicate(), i.Scale, i.IndexZYX}
+}
+
+func (i IndexTile) String() string {
+	return hex.EncodeToString(i.Bytes())
+}
+
+func (i IndexTile) Scheme() string {
+	return "Tile Indexing"
+}
+
+// Bytes returns a byte representation of the Index: the plane, the scale, the number
+// of tile coordinates, and the tile coordinates.
+func (i IndexTile) Bytes() []byte {
+	buf := bytes.NewBuffer(i.Plane.Bytes())
+	buf.WriteByte(i.Scale)
+	buf.WriteByte(byte(i.IndexZYX.NumDims()))
+	buf.Write(i.IndexZYX.Bytes())
+	return buf.Bytes()
+}
+
+// IndexFromBytes returns an index from bytes.  The passed Index is used just
+// to choose the appropriate byte decoding scheme.
+func (i IndexTile) IndexFromBytes(b []byte) (Index, error) {
+	if len(b) < IndexTileSize {
+		return nil, fmt.Errorf("Illegal IndexTile: too few bytes (%d)", len(b))
+	}
+	plane, err := BytesToDataShape(b[0:DataShapeBytes])
+	if err != nil {
+		return nil, err
+	}
+	index, err := i.IndexZYX.IndexFromBytes(b[DataShapeBytes+2:])
+	if err != nil {
+		return nil, err
+	}
+	return &IndexTile{plane, b[DataShapeBytes], *(index.(*IndexZYX))}, nil
+}
+
+// ------- ChunkIndexer interface ----------
+
+// Min returns a ChunkIndexer that is the minimum of its value and the passed one.
+func (i IndexTile) Min(idx ChunkIndexer) (ChunkIndexer, bool) {
+	min, changed := i.IndexZYX.Min(idx)
+	return IndexTile{i.Plane, i.Scale, min.(IndexZYX)}, changed
+}
+
+// Max returns a ChunkIndexer that is the maximum of its value and the passed one.
+func (i IndexTile) Max(idx ChunkIndexer) (ChunkIndexer, bool) {
+	max, changed := i.IndexZYX.Max(idx)
+	return IndexTile{i.Plane, i.Scale, max.(IndexZYX)}, changed
+}
+
+// ------- PointIndexer interface ----------
+
+// IndexFromPoint returns an index for tile coordinates in this index's plane and scale.
+func (i IndexTile) IndexFromPoint(c ChunkPoint) (ChunkIndexer, error) {
+	index, err := i.IndexZYX.IndexFromPoint(c)
+	if err != nil {
+		return nil, err
+	}
+	return IndexTile{i.Plane, i.Scale, index.(IndexZYX)}, nil
+}
+
+// ----- IndexIterator implementation ------------
+type IndexTileIterator struct {
+	plane    DataShape
+	scale    uint8
+	y, z     int32
+	begTile  ChunkPoint3d
+	endTile  ChunkPoint3d
+	endBytes []byte
+}
+
+// NewIndexTileIterator returns an IndexIterator that iterates over tile coordinates
+// from start to end inclusive in a plane at a scale level.
+func NewIndexTileIterator(plane DataShape, scale uint8, start, end ChunkPoint3d) *IndexTileIterator {
+	return &IndexTileIterator{
+		plane:    plane,
+		scale:    scale,
+		y:        start[1],
+		z:        start[2],
+		begTile:  start,
+		endTile:  end,
+		endBytes: IndexTile{plane, scale, IndexZYX(end)}.Bytes(),
+	}
+}
+
+func (it *IndexTileIterator) Valid() bool {
+	if it.begTile[0] > it.endTile[0] || it.begTile[1] > it.endTile[1] {
+		return false
+	}
+	cursorBytes := IndexTile{it.plane, it.scale, IndexZYX{it.begTile[0], it.y, it.z}}.Bytes()
+	return bytes.Compare(cursorBytes, it.endBytes) <= 0
+}
+
+func (it *IndexTileIterator) IndexSpan() (beg, end Index, err error) {
+	beg = IndexTile{it.plane, it.scale, IndexZYX{it.begTile[0], it.y, it.z}}
+	end = IndexTile{it.plane, it.scale, IndexZYX{it.endTile[0], it.y, it.z}}
+	return
+}
+
+func (it *IndexTileIterator) NextSpan() {
+	it.y += 1
+	if it.y > it.endTile[1] {
+		it.y = it.begTile[1]
+		it.z += 1
+	}
+}
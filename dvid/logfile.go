@@ -0,0 +1,109 @@
+package dvid
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file opened for appending that is rotated when it would grow
+// past a maximum size: the file is renamed with the suffix ".1", older files shift to
+// ".2", ".3", and so on, and files beyond the number of backups are removed.
+type RotatingFile struct {
+	sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+// OpenRotatingFile opens a log file for appending that rotates when it reaches maxBytes,
+// keeping the given number of older files.  If maxBytes is 0, the file never rotates.
+func OpenRotatingFile(path string, maxBytes int64, backups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file at the path, which must not already be open.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// rotate renames the current file and its backups, then opens a new file.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.backups <= 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.backups))
+	for n := f.backups - 1; n >= 1; n-- {
+		older := fmt.Sprintf("%s.%d", f.path, n)
+		if err := os.Rename(older, fmt.Sprintf("%s.%d", f.path, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Write appends to the file, first rotating it if the write would pass the maximum size.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.file == nil {
+		return 0, fmt.Errorf("Log file %s is closed", f.path)
+	}
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Reopen closes and reopens the file at its path, e.g., after it was moved by an
+// external log rotation tool.
+func (f *RotatingFile) Reopen() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+// Close closes the file.
+func (f *RotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
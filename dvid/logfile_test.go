@@ -0,0 +1,38 @@
+package dvid
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *DataSuite) TestRotatingFile(c *C) {
+	path := filepath.Join(c.MkDir(), "test.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	c.Assert(err, IsNil)
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err = f.Write([]byte(line))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(f.Close(), IsNil)
+
+	expected := map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"}
+	for suffix, contents := range expected {
+		data, err := ioutil.ReadFile(path + suffix)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, contents)
+	}
+	_, err = ioutil.ReadFile(path + ".3")
+	c.Assert(err, NotNil)
+
+	// Reopened files append to the existing file.
+	f, err = OpenRotatingFile(path, 0, 0)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte("fifth\n"))
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "fourth\nfifth\n")
+}
@@ -0,0 +1,306 @@
+/*
+	This file supports the NRRD (Nearly Raw Raster Data) format, a simple self-describing
+	format for n-d arrays read by ITK, 3D Slicer, and other image analysis tools.  A NRRD
+	stream is a plain text header ending with a blank line followed by the raw data.
+	See http://teem.sourceforge.net/nrrd/format.html for the complete specification.
+*/
+
+package dvid
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// NrrdMagic begins the header of NRRD streams written by DVID.
+const NrrdMagic = "NRRD0004"
+
+// Axis kinds used in NRRD headers.
+const (
+	NrrdDomain = "domain"
+	NrrdVector = "vector"
+	NrrdTime   = "time"
+)
+
+// nrrdTypes maps the NRRD type names and their aliases to DVID data types.
+var nrrdTypes = map[string]DataType{
+	"uint8": T_uint8, "uchar": T_uint8, "unsigned char": T_uint8, "uint8_t": T_uint8,
+	"int8": T_int8, "signed char": T_int8, "int8_t": T_int8,
+	"uint16": T_uint16, "ushort": T_uint16, "unsigned short": T_uint16,
+	"unsigned short int": T_uint16, "uint16_t": T_uint16,
+	"int16": T_int16, "short": T_int16, "short int": T_int16, "signed short": T_int16,
+	"signed short int": T_int16, "int16_t": T_int16,
+	"uint32": T_uint32, "uint": T_uint32, "unsigned int": T_uint32, "uint32_t": T_uint32,
+	"int32": T_int32, "int": T_int32, "signed int": T_int32, "int32_t": T_int32,
+	"uint64": T_uint64, "ulonglong": T_uint64, "unsigned long long": T_uint64,
+	"unsigned long long int": T_uint64, "uint64_t": T_uint64,
+	"int64": T_int64, "longlong": T_int64, "long long": T_int64, "long long int": T_int64,
+	"signed long long": T_int64, "signed long long int": T_int64, "int64_t": T_int64,
+	"float":  T_float32,
+	"double": T_float64,
+}
+
+// nrrdTypeName returns the canonical NRRD type name for a DVID data type.
+func nrrdTypeName(t DataType) string {
+	switch t {
+	case T_uint8:
+		return "uint8"
+	case T_int8:
+		return "int8"
+	case T_uint16:
+		return "uint16"
+	case T_int16:
+		return "int16"
+	case T_uint32:
+		return "uint32"
+	case T_int32:
+		return "int32"
+	case T_uint64:
+		return "uint64"
+	case T_int64:
+		return "int64"
+	case T_float32:
+		return "float"
+	case T_float64:
+		return "double"
+	default:
+		return "???"
+	}
+}
+
+// NrrdAxis describes one axis of a NRRD array.
+type NrrdAxis struct {
+	Size    int32
+	Spacing float64 // NaN if not applicable
+	Min     float64 // NaN if not applicable
+	Units   string
+	Kind    string
+}
+
+// NrrdHeader holds the NRRD header fields used by DVID.  Axes are ordered from fastest
+// to slowest changing in the data.
+type NrrdHeader struct {
+	Type      DataType
+	Axes      []NrrdAxis
+	ByteOrder binary.ByteOrder
+
+	// Encoding is "raw" or "gzip".
+	Encoding string
+}
+
+// NewNrrdHeader returns a header for voxels with the given values in a 3d subvolume of
+// given size and offset.  Elements with more than one value are described by a leading
+// vector axis, and resolution gives the spacing and units of the spatial axes.
+func NewNrrdHeader(values DataValues, size, offset Point, voxelSize NdFloat32, voxelUnits NdString,
+	byteOrder binary.ByteOrder) (*NrrdHeader, error) {
+
+	dataType, err := values.ValueDataType()
+	if err != nil {
+		return nil, err
+	}
+	header := &NrrdHeader{Type: dataType, ByteOrder: byteOrder, Encoding: "raw"}
+	if len(values) > 1 {
+		header.Axes = append(header.Axes, NrrdAxis{int32(len(values)), math.NaN(), math.NaN(), "", NrrdVector})
+	}
+	for dim := uint8(0); dim < size.NumDims(); dim++ {
+		axis := NrrdAxis{size.Value(dim), math.NaN(), math.NaN(), "", NrrdDomain}
+		if int(dim) < len(voxelSize) {
+			axis.Spacing = float64(voxelSize[dim])
+			if offset != nil && dim < offset.NumDims() {
+				axis.Min = float64(offset.Value(dim)) * axis.Spacing
+			}
+		}
+		if int(dim) < len(voxelUnits) {
+			axis.Units = voxelUnits[dim]
+		}
+		header.Axes = append(header.Axes, axis)
+	}
+	return header, nil
+}
+
+// NumBytes returns the number of bytes of raw data described by the header.
+func (h *NrrdHeader) NumBytes() int64 {
+	numBytes := int64(DataTypeBytes(h.Type))
+	for _, axis := range h.Axes {
+		numBytes *= int64(axis.Size)
+	}
+	return numBytes
+}
+
+func nrrdFloat(f float64) string {
+	if math.IsNaN(f) {
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Write writes the header including its terminating blank line.
+func (h *NrrdHeader) Write(w io.Writer) error {
+	sizes := make([]string, len(h.Axes))
+	spacings := make([]string, len(h.Axes))
+	mins := make([]string, len(h.Axes))
+	units := make([]string, len(h.Axes))
+	kinds := make([]string, len(h.Axes))
+	for n, axis := range h.Axes {
+		sizes[n] = strconv.Itoa(int(axis.Size))
+		spacings[n] = nrrdFloat(axis.Spacing)
+		mins[n] = nrrdFloat(axis.Min)
+		units[n] = strconv.Quote(axis.Units)
+		kinds[n] = axis.Kind
+	}
+	lines := []string{
+		NrrdMagic,
+		"# Complete NRRD file format specification at:",
+		"# http://teem.sourceforge.net/nrrd/format.html",
+		"type: " + nrrdTypeName(h.Type),
+		"dimension: " + strconv.Itoa(len(h.Axes)),
+		"sizes: " + strings.Join(sizes, " "),
+		"spacings: " + strings.Join(spacings, " "),
+		"axis mins: " + strings.Join(mins, " "),
+		"units: " + strings.Join(units, " "),
+		"kinds: " + strings.Join(kinds, " "),
+		"encoding: " + h.Encoding,
+	}
+	if DataTypeBytes(h.Type) > 1 {
+		if h.ByteOrder == binary.BigEndian {
+			lines = append(lines, "endian: big")
+		} else {
+			lines = append(lines, "endian: little")
+		}
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n\n")
+	return err
+}
+
+// ReadNrrdHeader reads a NRRD header through its terminating blank line, leaving the
+// reader at the start of the data.  Fields not used by DVID are ignored.
+func ReadNrrdHeader(r *bufio.Reader) (*NrrdHeader, error) {
+	magic, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("Could not read NRRD magic: %s", err.Error())
+	}
+	if !strings.HasPrefix(magic, "NRRD000") {
+		return nil, fmt.Errorf("Data does not begin with NRRD magic")
+	}
+	header := &NrrdHeader{ByteOrder: binary.LittleEndian, Encoding: "raw"}
+	var typeFound bool
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("Could not read NRRD header: %s", err.Error())
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "#") || strings.Contains(line, ":=") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Illegal NRRD header line '%s'", line)
+		}
+		field, value := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+		switch field {
+		case "type":
+			if header.Type, typeFound = nrrdTypes[strings.ToLower(value)]; !typeFound {
+				return nil, fmt.Errorf("Unsupported NRRD type '%s'", value)
+			}
+		case "dimension":
+			dims, err := strconv.Atoi(value)
+			if err != nil || dims < 1 {
+				return nil, fmt.Errorf("Illegal NRRD dimension '%s'", value)
+			}
+			header.Axes = make([]NrrdAxis, dims)
+			for n := range header.Axes {
+				header.Axes[n] = NrrdAxis{0, math.NaN(), math.NaN(), "", NrrdDomain}
+			}
+		case "sizes", "spacings", "axis mins", "kinds":
+			fields := strings.Fields(value)
+			if len(header.Axes) == 0 || len(fields) != len(header.Axes) {
+				return nil, fmt.Errorf("NRRD field '%s' must follow dimension and give a value per axis", field)
+			}
+			for n, s := range fields {
+				switch field {
+				case "sizes":
+					size, err := strconv.ParseInt(s, 10, 32)
+					if err != nil || size < 1 {
+						return nil, fmt.Errorf("Illegal NRRD size '%s'", s)
+					}
+					header.Axes[n].Size = int32(size)
+				case "spacings", "axis mins":
+					f, err := strconv.ParseFloat(s, 64)
+					if err != nil {
+						return nil, fmt.Errorf("Illegal NRRD %s '%s'", field, s)
+					}
+					if field == "spacings" {
+						header.Axes[n].Spacing = f
+					} else {
+						header.Axes[n].Min = f
+					}
+				case "kinds":
+					header.Axes[n].Kind = strings.ToLower(s)
+				}
+			}
+		case "encoding":
+			header.Encoding = strings.ToLower(value)
+			if header.Encoding == "gz" {
+				header.Encoding = "gzip"
+			}
+			if header.Encoding != "raw" && header.Encoding != "gzip" {
+				return nil, fmt.Errorf("Unsupported NRRD encoding '%s': must be raw or gzip", value)
+			}
+		case "endian":
+			switch strings.ToLower(value) {
+			case "little":
+				header.ByteOrder = binary.LittleEndian
+			case "big":
+				header.ByteOrder = binary.BigEndian
+			default:
+				return nil, fmt.Errorf("Illegal NRRD endian '%s'", value)
+			}
+		case "data file", "datafile":
+			return nil, fmt.Errorf("Detached NRRD headers are not supported")
+		}
+	}
+	if !typeFound {
+		return nil, fmt.Errorf("NRRD header has no type")
+	}
+	if len(header.Axes) == 0 || header.Axes[0].Size == 0 {
+		return nil, fmt.Errorf("NRRD header must give dimension and sizes")
+	}
+	return header, nil
+}
+
+// ReadNrrdData reads the data following a NRRD header, decoding it if necessary and
+// converting it to the given byte order.
+func ReadNrrdData(r io.Reader, header *NrrdHeader, byteOrder binary.ByteOrder) ([]byte, error) {
+	if header.Encoding == "gzip" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read gzip NRRD data: %s", err.Error())
+		}
+		defer zr.Close()
+		r = zr
+	}
+	data := make([]byte, header.NumBytes())
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("Expected %d bytes of NRRD data: %s", len(data), err.Error())
+	}
+	valueBytes := int(DataTypeBytes(header.Type))
+	if valueBytes > 1 && header.ByteOrder != byteOrder {
+		for i := 0; i < len(data); i += valueBytes {
+			value := data[i : i+valueBytes]
+			for j, k := 0, valueBytes-1; j < k; j, k = j+1, k-1 {
+				value[j], value[k] = value[k], value[j]
+			}
+		}
+	}
+	return data, nil
+}
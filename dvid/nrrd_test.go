@@ -0,0 +1,52 @@
+package dvid
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *DataSuite) TestNrrdHeader(c *C) {
+	values := DataValues{{T_uint16, "intensity"}}
+	header, err := NewNrrdHeader(values, Point3d{4, 3, 2}, Point3d{10, 20, 30},
+		NdFloat32{8, 8, 40}, NdString{"nanometers", "nanometers", "nanometers"}, binary.BigEndian)
+	c.Assert(err, IsNil)
+	c.Assert(header.NumBytes(), Equals, int64(4*3*2*2))
+
+	data := make([]byte, header.NumBytes())
+	for i := range data {
+		data[i] = byte(i)
+	}
+	var buf bytes.Buffer
+	c.Assert(header.Write(&buf), IsNil)
+	buf.Write(data)
+	c.Assert(bytes.Contains(buf.Bytes(), []byte("spacings: 8 8 40\n")), Equals, true)
+
+	reader := bufio.NewReader(&buf)
+	read, err := ReadNrrdHeader(reader)
+	c.Assert(err, IsNil)
+	c.Assert(read.Type, Equals, T_uint16)
+	c.Assert(read.ByteOrder, Equals, binary.ByteOrder(binary.BigEndian))
+	c.Assert(read.Axes, HasLen, 3)
+	c.Assert(read.Axes[2].Size, Equals, int32(2))
+	c.Assert(read.Axes[2].Spacing, Equals, 40.0)
+	c.Assert(read.Axes[2].Min, Equals, 1200.0)
+
+	// Big-endian NRRD data should be swapped into little-endian values.
+	swapped, err := ReadNrrdData(reader, read, binary.LittleEndian)
+	c.Assert(err, IsNil)
+	c.Assert(swapped[0:4], DeepEquals, []byte{1, 0, 3, 2})
+
+	rgba := DataValues{{T_uint8, "red"}, {T_uint8, "green"}, {T_uint8, "blue"}, {T_uint8, "alpha"}}
+	header, err = NewNrrdHeader(rgba, Point3d{4, 3, 2}, nil, nil, nil, binary.LittleEndian)
+	c.Assert(err, IsNil)
+	c.Assert(header.Axes, HasLen, 4)
+	c.Assert(header.Axes[0].Kind, Equals, NrrdVector)
+	c.Assert(math.IsNaN(header.Axes[1].Spacing), Equals, true)
+
+	_, err = ReadNrrdHeader(bufio.NewReader(bytes.NewBufferString("P5\n")))
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,401 @@
+/*
+	This file supports arbitrary 3d regions, e.g., spheres, oriented boxes, and convex
+	polytopes, and finds the spans of blocks intersecting them so datatypes can serve
+	voxels within a region without duplicating geometry code.
+*/
+
+package dvid
+
+import (
+	"fmt"
+	"math"
+)
+
+// MaxRegionBlocks is the largest number of blocks within the bounds of a region that
+// will be examined for intersection.
+const MaxRegionBlocks = 1 << 30
+
+// regionEpsilon is the tolerance used when testing floating point geometry.
+const regionEpsilon = 1e-9
+
+// Vector3d is a point or direction in 3d voxel space.
+type Vector3d [3]float64
+
+// Add returns the sum of two vectors.
+func (v Vector3d) Add(v2 Vector3d) Vector3d {
+	return Vector3d{v[0] + v2[0], v[1] + v2[1], v[2] + v2[2]}
+}
+
+// Sub returns the difference of two vectors.
+func (v Vector3d) Sub(v2 Vector3d) Vector3d {
+	return Vector3d{v[0] - v2[0], v[1] - v2[1], v[2] - v2[2]}
+}
+
+// Scale returns the vector multiplied by a scalar.
+func (v Vector3d) Scale(s float64) Vector3d {
+	return Vector3d{v[0] * s, v[1] * s, v[2] * s}
+}
+
+// Dot returns the dot product of two vectors.
+func (v Vector3d) Dot(v2 Vector3d) float64 {
+	return v[0]*v2[0] + v[1]*v2[1] + v[2]*v2[2]
+}
+
+// Cross returns the cross product of two vectors.
+func (v Vector3d) Cross(v2 Vector3d) Vector3d {
+	return Vector3d{
+		v[1]*v2[2] - v[2]*v2[1],
+		v[2]*v2[0] - v[0]*v2[2],
+		v[0]*v2[1] - v[1]*v2[0],
+	}
+}
+
+// Length returns the Euclidean length of the vector.
+func (v Vector3d) Length() float64 {
+	return math.Sqrt(v.Dot(v))
+}
+
+// Region is a bounded region of 3d voxel space, where each voxel is at the integer
+// coordinates of its center.
+type Region interface {
+	// Bounds returns the minimum and maximum corners of a box enclosing the region.
+	Bounds() (min, max Vector3d)
+
+	// Contains returns true if a point is within the region.
+	Contains(p Vector3d) bool
+
+	// IntersectsBox returns true if an axis-aligned box given by its minimum and
+	// maximum corners could intersect the region.  It must never return false for
+	// an intersecting box but may return true for a box that is only near the region.
+	IntersectsBox(min, max Vector3d) bool
+}
+
+// Sphere is a Region of points within a radius of a center.
+type Sphere struct {
+	Center Vector3d
+	Radius float64
+}
+
+// NewSphere returns a sphere, which must have a non-negative radius.
+func NewSphere(center Vector3d, radius float64) (*Sphere, error) {
+	if radius < 0 || math.IsNaN(radius) {
+		return nil, fmt.Errorf("Illegal sphere radius %g", radius)
+	}
+	return &Sphere{center, radius}, nil
+}
+
+func (s *Sphere) Bounds() (min, max Vector3d) {
+	r := Vector3d{s.Radius, s.Radius, s.Radius}
+	return s.Center.Sub(r), s.Center.Add(r)
+}
+
+func (s *Sphere) Contains(p Vector3d) bool {
+	d := p.Sub(s.Center)
+	return d.Dot(d) <= s.Radius*s.Radius+regionEpsilon
+}
+
+// IntersectsBox is exact for a sphere: it checks the box point closest to the center.
+func (s *Sphere) IntersectsBox(min, max Vector3d) bool {
+	var closest Vector3d
+	for dim := 0; dim < 3; dim++ {
+		closest[dim] = math.Max(min[dim], math.Min(s.Center[dim], max[dim]))
+	}
+	return s.Contains(closest)
+}
+
+// OrientedBox is a Region within a box that can be rotated, given by its center, three
+// orthonormal axes, and the half sizes of the box along each axis.
+type OrientedBox struct {
+	Center    Vector3d
+	Axes      [3]Vector3d
+	HalfSizes Vector3d
+}
+
+// NewOrientedBox returns an oriented box.  The axes are normalized and must be
+// mutually orthogonal, and the half sizes must be non-negative.
+func NewOrientedBox(center Vector3d, axes [3]Vector3d, halfSizes Vector3d) (*OrientedBox, error) {
+	box := &OrientedBox{Center: center, HalfSizes: halfSizes}
+	for i, axis := range axes {
+		length := axis.Length()
+		if length < regionEpsilon {
+			return nil, fmt.Errorf("Oriented box axis %d has zero length", i)
+		}
+		box.Axes[i] = axis.Scale(1 / length)
+		if halfSizes[i] < 0 || math.IsNaN(halfSizes[i]) {
+			return nil, fmt.Errorf("Illegal oriented box half size %g along axis %d", halfSizes[i], i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		for j := i + 1; j < 3; j++ {
+			if math.Abs(box.Axes[i].Dot(box.Axes[j])) > 1e-6 {
+				return nil, fmt.Errorf("Oriented box axes %d and %d are not orthogonal", i, j)
+			}
+		}
+	}
+	return box, nil
+}
+
+func (b *OrientedBox) Bounds() (min, max Vector3d) {
+	for dim := 0; dim < 3; dim++ {
+		var extent float64
+		for i, axis := range b.Axes {
+			extent += math.Abs(axis[dim]) * b.HalfSizes[i]
+		}
+		min[dim] = b.Center[dim] - extent
+		max[dim] = b.Center[dim] + extent
+	}
+	return
+}
+
+func (b *OrientedBox) Contains(p Vector3d) bool {
+	d := p.Sub(b.Center)
+	for i, axis := range b.Axes {
+		if math.Abs(d.Dot(axis)) > b.HalfSizes[i]+regionEpsilon {
+			return false
+		}
+	}
+	return true
+}
+
+// IntersectsBox is exact for an oriented box: it uses the separating axis test over the
+// face normals of both boxes and the cross products of their edges.
+func (b *OrientedBox) IntersectsBox(min, max Vector3d) bool {
+	center := min.Add(max).Scale(0.5)
+	halfSizes := max.Sub(min).Scale(0.5)
+	d := center.Sub(b.Center)
+	worldAxes := [3]Vector3d{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	testAxes := make([]Vector3d, 0, 15)
+	testAxes = append(testAxes, worldAxes[:]...)
+	testAxes = append(testAxes, b.Axes[:]...)
+	for _, worldAxis := range worldAxes {
+		for _, axis := range b.Axes {
+			cross := worldAxis.Cross(axis)
+			if cross.Length() > regionEpsilon {
+				testAxes = append(testAxes, cross)
+			}
+		}
+	}
+	for _, l := range testAxes {
+		var radius float64
+		for i := 0; i < 3; i++ {
+			radius += math.Abs(worldAxes[i].Dot(l)) * halfSizes[i]
+			radius += math.Abs(b.Axes[i].Dot(l)) * b.HalfSizes[i]
+		}
+		if math.Abs(d.Dot(l)) > radius+regionEpsilon {
+			return false
+		}
+	}
+	return true
+}
+
+// HalfSpace is the set of points p where Normal . p <= Offset.
+type HalfSpace struct {
+	Normal Vector3d
+	Offset float64
+}
+
+// Polytope is a Region given by the intersection of half spaces, i.e., a bounded
+// convex polyhedron.
+type Polytope struct {
+	HalfSpaces []HalfSpace
+
+	min, max Vector3d
+}
+
+// NewPolytope returns a polytope from half spaces, which must enclose a bounded,
+// non-empty region.
+func NewPolytope(halfSpaces []HalfSpace) (*Polytope, error) {
+	if len(halfSpaces) < 4 {
+		return nil, fmt.Errorf("Polytope requires at least 4 half spaces, got %d", len(halfSpaces))
+	}
+	for i, h := range halfSpaces {
+		if h.Normal.Length() < regionEpsilon {
+			return nil, fmt.Errorf("Polytope half space %d has a zero normal", i)
+		}
+	}
+
+	// The polytope is unbounded if there is a direction along which no half space
+	// limits it.  Such a direction, if any, lies along the cross product of two normals.
+	var spanning bool
+	for i := range halfSpaces {
+		for j := i + 1; j < len(halfSpaces); j++ {
+			dir := halfSpaces[i].Normal.Cross(halfSpaces[j].Normal)
+			if dir.Length() < regionEpsilon {
+				continue
+			}
+			for _, d := range []Vector3d{dir, dir.Scale(-1)} {
+				limited := false
+				for _, h := range halfSpaces {
+					if h.Normal.Dot(d) > regionEpsilon {
+						limited = true
+						break
+					}
+				}
+				if !limited {
+					return nil, fmt.Errorf("Polytope is unbounded")
+				}
+			}
+			for _, h := range halfSpaces {
+				if math.Abs(h.Normal.Dot(dir)) > regionEpsilon {
+					spanning = true
+				}
+			}
+		}
+	}
+	if !spanning {
+		return nil, fmt.Errorf("Polytope is unbounded: half space normals do not span 3d")
+	}
+
+	// The bounds are those of the vertices, each at the intersection of three planes.
+	p := &Polytope{HalfSpaces: halfSpaces}
+	var numVertices int
+	for i := range halfSpaces {
+		for j := i + 1; j < len(halfSpaces); j++ {
+			for k := j + 1; k < len(halfSpaces); k++ {
+				vertex, ok := planesIntersection(halfSpaces[i], halfSpaces[j], halfSpaces[k])
+				if !ok || !p.Contains(vertex) {
+					continue
+				}
+				if numVertices == 0 {
+					p.min, p.max = vertex, vertex
+				}
+				for dim := 0; dim < 3; dim++ {
+					p.min[dim] = math.Min(p.min[dim], vertex[dim])
+					p.max[dim] = math.Max(p.max[dim], vertex[dim])
+				}
+				numVertices++
+			}
+		}
+	}
+	if numVertices == 0 {
+		return nil, fmt.Errorf("Polytope is empty")
+	}
+	return p, nil
+}
+
+// planesIntersection returns the point on the boundary planes of three half spaces.
+func planesIntersection(h1, h2, h3 HalfSpace) (Vector3d, bool) {
+	n23 := h2.Normal.Cross(h3.Normal)
+	det := h1.Normal.Dot(n23)
+	if math.Abs(det) < regionEpsilon {
+		return Vector3d{}, false
+	}
+	n31 := h3.Normal.Cross(h1.Normal)
+	n12 := h1.Normal.Cross(h2.Normal)
+	p := n23.Scale(h1.Offset).Add(n31.Scale(h2.Offset)).Add(n12.Scale(h3.Offset))
+	return p.Scale(1 / det), true
+}
+
+func (p *Polytope) Bounds() (min, max Vector3d) {
+	return p.min, p.max
+}
+
+func (p *Polytope) Contains(pt Vector3d) bool {
+	for _, h := range p.HalfSpaces {
+		if h.Normal.Dot(pt) > h.Offset+regionEpsilon*(1+math.Abs(h.Offset)) {
+			return false
+		}
+	}
+	return true
+}
+
+// IntersectsBox is conservative for a polytope: it returns true unless the box is
+// outside the polytope's bounds or entirely outside one of its half spaces.
+func (p *Polytope) IntersectsBox(min, max Vector3d) bool {
+	for dim := 0; dim < 3; dim++ {
+		if max[dim] < p.min[dim]-regionEpsilon || min[dim] > p.max[dim]+regionEpsilon {
+			return false
+		}
+	}
+	for _, h := range p.HalfSpaces {
+		// The box corner that minimizes the dot product with the normal.
+		var corner Vector3d
+		for dim := 0; dim < 3; dim++ {
+			if h.Normal[dim] >= 0 {
+				corner[dim] = min[dim]
+			} else {
+				corner[dim] = max[dim]
+			}
+		}
+		if h.Normal.Dot(corner) > h.Offset+regionEpsilon*(1+math.Abs(h.Offset)) {
+			return false
+		}
+	}
+	return true
+}
+
+// blockVoxelBounds returns the voxel coordinates of the first and last voxels of blocks
+// from block coordinate c0 to c1 along one dimension.
+func blockVoxelBounds(c0, c1, size int32) (float64, float64) {
+	return float64(int64(c0) * int64(size)), float64(int64(c1)*int64(size) + int64(size) - 1)
+}
+
+// RegionBlockSpans returns the spans of blocks of the given size that intersect a region,
+// sorted by block z, then y, then x.  The spans can be used to create an ROI for
+// iterating over the blocks.  The spans may include blocks near but not within regions
+// whose intersection tests are conservative, so datatypes should use Contains to select
+// voxels.
+func RegionBlockSpans(region Region, blockSize Point3d) ([]BlockSpan, error) {
+	for dim := 0; dim < 3; dim++ {
+		if blockSize[dim] <= 0 {
+			return nil, fmt.Errorf("Illegal block size %s for region", blockSize)
+		}
+	}
+	min, max := region.Bounds()
+	var minBlock, maxBlock [3]int32
+	numBlocks := int64(1)
+	for dim := 0; dim < 3; dim++ {
+		if math.IsNaN(min[dim]) || math.IsNaN(max[dim]) || max[dim] < min[dim] {
+			return nil, fmt.Errorf("Region has illegal bounds %v to %v", min, max)
+		}
+		lo := math.Floor(math.Ceil(min[dim]-regionEpsilon) / float64(blockSize[dim]))
+		hi := math.Floor(math.Floor(max[dim]+regionEpsilon) / float64(blockSize[dim]))
+		if lo < math.MinInt32 || hi > math.MaxInt32 {
+			return nil, fmt.Errorf("Region bounds %v to %v exceed block coordinates", min, max)
+		}
+		if hi < lo {
+			return []BlockSpan{}, nil
+		}
+		minBlock[dim], maxBlock[dim] = int32(lo), int32(hi)
+		numBlocks *= int64(hi-lo) + 1
+		if numBlocks > MaxRegionBlocks {
+			return nil, fmt.Errorf("Region bounds %v to %v include more than %d blocks", min, max, MaxRegionBlocks)
+		}
+	}
+
+	spans := []BlockSpan{}
+	for z := minBlock[2]; z <= maxBlock[2]; z++ {
+		z0, z1 := blockVoxelBounds(z, z, blockSize[2])
+		for y := minBlock[1]; y <= maxBlock[1]; y++ {
+			y0, y1 := blockVoxelBounds(y, y, blockSize[1])
+			x0, x1 := blockVoxelBounds(minBlock[0], maxBlock[0], blockSize[0])
+			if !region.IntersectsBox(Vector3d{x0, y0, z0}, Vector3d{x1, y1, z1}) {
+				continue
+			}
+			inSpan := false
+			for x := minBlock[0]; x <= maxBlock[0]; x++ {
+				x0, x1 = blockVoxelBounds(x, x, blockSize[0])
+				if region.IntersectsBox(Vector3d{x0, y0, z0}, Vector3d{x1, y1, z1}) {
+					if inSpan {
+						spans[len(spans)-1].X1 = x
+					} else {
+						spans = append(spans, BlockSpan{z, y, x, x})
+						inSpan = true
+					}
+				} else {
+					inSpan = false
+				}
+				if x == math.MaxInt32 {
+					break
+				}
+			}
+			if y == math.MaxInt32 {
+				break
+			}
+		}
+		if z == math.MaxInt32 {
+			break
+		}
+	}
+	return spans, nil
+}
@@ -0,0 +1,132 @@
+package dvid
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+	"math"
+	_ "testing"
+)
+
+// regionBlocks returns the blocks covered by spans.
+func regionBlocks(spans []BlockSpan) map[ChunkPoint3d]bool {
+	blocks := make(map[ChunkPoint3d]bool)
+	for _, span := range spans {
+		for x := span.X0; x <= span.X1; x++ {
+			blocks[ChunkPoint3d{x, span.Y, span.Z}] = true
+		}
+	}
+	return blocks
+}
+
+// checkRegionSpans verifies that the spans of a region cover every block holding a voxel
+// within the region.
+func checkRegionSpans(c *C, region Region, blockSize Point3d) map[ChunkPoint3d]bool {
+	spans, err := RegionBlockSpans(region, blockSize)
+	c.Assert(err, IsNil)
+	for i := 1; i < len(spans); i++ {
+		c.Assert(blockSpans(spans).Less(i-1, i), Equals, true)
+	}
+	blocks := regionBlocks(spans)
+	min, max := region.Bounds()
+	for z := math.Ceil(min[2]); z <= max[2]; z++ {
+		for y := math.Ceil(min[1]); y <= max[1]; y++ {
+			for x := math.Ceil(min[0]); x <= max[0]; x++ {
+				if !region.Contains(Vector3d{x, y, z}) {
+					continue
+				}
+				block := ChunkPoint3d{
+					int32(math.Floor(x / float64(blockSize[0]))),
+					int32(math.Floor(y / float64(blockSize[1]))),
+					int32(math.Floor(z / float64(blockSize[2]))),
+				}
+				c.Assert(blocks[block], Equals, true, Commentf("voxel (%g,%g,%g)", x, y, z))
+			}
+		}
+	}
+	return blocks
+}
+
+func (suite *DataSuite) TestRegionSphere(c *C) {
+	_, err := NewSphere(Vector3d{0, 0, 0}, -1)
+	c.Assert(err, NotNil)
+
+	sphere, err := NewSphere(Vector3d{16, 16, 16}, 0.5)
+	c.Assert(err, IsNil)
+	spans, err := RegionBlockSpans(sphere, Point3d{8, 8, 8})
+	c.Assert(err, IsNil)
+	c.Assert(spans, DeepEquals, []BlockSpan{{2, 2, 2, 2}})
+
+	sphere, err = NewSphere(Vector3d{16, 16, 16}, 4)
+	c.Assert(err, IsNil)
+	spans, err = RegionBlockSpans(sphere, Point3d{8, 8, 8})
+	c.Assert(err, IsNil)
+	c.Assert(spans, DeepEquals, []BlockSpan{{1, 1, 1, 2}, {1, 2, 1, 2}, {2, 1, 1, 2}, {2, 2, 1, 2}})
+
+	// Corner blocks of the bounding box of a large sphere are excluded.
+	sphere, err = NewSphere(Vector3d{-3, 5, 7}, 30)
+	c.Assert(err, IsNil)
+	blocks := checkRegionSpans(c, sphere, Point3d{8, 8, 4})
+	c.Assert(blocks[ChunkPoint3d{-5, -4, -6}], Equals, false)
+	c.Assert(blocks[ChunkPoint3d{0, 0, 1}], Equals, true)
+
+	_, err = RegionBlockSpans(sphere, Point3d{8, 0, 8})
+	c.Assert(err, NotNil)
+	sphere, err = NewSphere(Vector3d{0, 0, 0}, 1e9)
+	c.Assert(err, IsNil)
+	_, err = RegionBlockSpans(sphere, Point3d{8, 8, 8})
+	c.Assert(err, NotNil)
+}
+
+func (suite *DataSuite) TestRegionOrientedBox(c *C) {
+	_, err := NewOrientedBox(Vector3d{}, [3]Vector3d{{1, 0, 0}, {1, 1, 0}, {0, 0, 1}}, Vector3d{1, 1, 1})
+	c.Assert(err, NotNil)
+	_, err = NewOrientedBox(Vector3d{}, [3]Vector3d{{1, 0, 0}, {0, 1, 0}, {0, 0, 0}}, Vector3d{1, 1, 1})
+	c.Assert(err, NotNil)
+
+	// A thin box along the xy diagonal only intersects blocks near the diagonal.
+	box, err := NewOrientedBox(Vector3d{32, 32, 4}, [3]Vector3d{{1, 1, 0}, {-1, 1, 0}, {0, 0, 1}},
+		Vector3d{40, 1, 2})
+	c.Assert(err, IsNil)
+	c.Assert(box.Contains(Vector3d{50, 50, 4}), Equals, true)
+	c.Assert(box.Contains(Vector3d{50, 40, 4}), Equals, false)
+	blocks := checkRegionSpans(c, box, Point3d{8, 8, 8})
+	c.Assert(blocks[ChunkPoint3d{6, 6, 0}], Equals, true)
+	c.Assert(blocks[ChunkPoint3d{6, 1, 0}], Equals, false)
+	c.Assert(len(blocks) < 12*12, Equals, true)
+}
+
+func (suite *DataSuite) TestRegionPolytope(c *C) {
+	// Unbounded along z.
+	_, err := NewPolytope([]HalfSpace{
+		{Vector3d{1, 0, 0}, 10}, {Vector3d{-1, 0, 0}, 10}, {Vector3d{0, 1, 0}, 10}, {Vector3d{0, -1, 0}, 10},
+	})
+	c.Assert(err, NotNil)
+
+	// Empty since x <= -1 and x >= 1.
+	_, err = NewPolytope([]HalfSpace{
+		{Vector3d{1, 0, 0}, -1}, {Vector3d{-1, 0, 0}, -1}, {Vector3d{0, 1, 0}, 10}, {Vector3d{0, -1, 0}, 10},
+		{Vector3d{0, 0, 1}, 10}, {Vector3d{0, 0, -1}, 10},
+	})
+	c.Assert(err, NotNil)
+
+	// Tetrahedron with vertices (0,0,0), (40,0,0), (0,40,0), and (0,0,40).
+	tetra, err := NewPolytope([]HalfSpace{
+		{Vector3d{-1, 0, 0}, 0}, {Vector3d{0, -1, 0}, 0}, {Vector3d{0, 0, -1}, 0}, {Vector3d{1, 1, 1}, 40},
+	})
+	c.Assert(err, IsNil)
+	min, max := tetra.Bounds()
+	c.Assert(min, DeepEquals, Vector3d{0, 0, 0})
+	c.Assert(max, DeepEquals, Vector3d{40, 40, 40})
+	c.Assert(tetra.Contains(Vector3d{10, 10, 10}), Equals, true)
+	c.Assert(tetra.Contains(Vector3d{20, 20, 1}), Equals, false)
+	blocks := checkRegionSpans(c, tetra, Point3d{8, 8, 8})
+	c.Assert(blocks[ChunkPoint3d{0, 0, 0}], Equals, true)
+	c.Assert(blocks[ChunkPoint3d{4, 4, 4}], Equals, false)
+
+	// The spans can restrict iteration via an ROI.
+	spans, err := RegionBlockSpans(tetra, Point3d{8, 8, 8})
+	c.Assert(err, IsNil)
+	roi, err := NewROI(spans)
+	c.Assert(err, IsNil)
+	c.Assert(roi.Contains(ChunkPoint3d{1, 1, 1}), Equals, true)
+	c.Assert(roi.Contains(ChunkPoint3d{5, 5, 5}), Equals, false)
+}
@@ -0,0 +1,200 @@
+/*
+	This file supports regions of interest (ROI) described by runs of blocks and
+	iteration restricted to the blocks within an ROI.
+*/
+
+package dvid
+
+import (
+	"fmt"
+	"sort"
+)
+
+// BlockSpan is a run of blocks along x at a given block z and y, where X0 and X1 are
+// the inclusive block x bounds.
+type BlockSpan struct {
+	Z, Y, X0, X1 int32
+}
+
+type blockSpans []BlockSpan
+
+func (s blockSpans) Len() int      { return len(s) }
+func (s blockSpans) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s blockSpans) Less(i, j int) bool {
+	if s[i].Z != s[j].Z {
+		return s[i].Z < s[j].Z
+	}
+	if s[i].Y != s[j].Y {
+		return s[i].Y < s[j].Y
+	}
+	return s[i].X0 < s[j].X0
+}
+
+// ROI is a region of interest given by a set of block spans.
+type ROI struct {
+	// Sorted, disjoint x runs for each block (z, y).
+	runs map[[2]int32][][2]int32
+}
+
+// NewROI returns an ROI from block spans, which can be in any order and may overlap.
+func NewROI(spans []BlockSpan) (*ROI, error) {
+	sorted := make(blockSpans, len(spans))
+	copy(sorted, spans)
+	sort.Sort(sorted)
+	roi := &ROI{make(map[[2]int32][][2]int32)}
+	for _, span := range sorted {
+		if span.X1 < span.X0 {
+			return nil, fmt.Errorf("Illegal block span at z %d, y %d: x %d after %d",
+				span.Z, span.Y, span.X0, span.X1)
+		}
+		zy := [2]int32{span.Z, span.Y}
+		runs := roi.runs[zy]
+		last := len(runs) - 1
+		if last >= 0 && int64(span.X0) <= int64(runs[last][1])+1 {
+			if span.X1 > runs[last][1] {
+				runs[last][1] = span.X1
+			}
+			continue
+		}
+		roi.runs[zy] = append(runs, [2]int32{span.X0, span.X1})
+	}
+	return roi, nil
+}
+
+// Spans returns the disjoint block spans of the ROI sorted by block z, then y, then x.
+func (roi *ROI) Spans() []BlockSpan {
+	spans := make(blockSpans, 0, len(roi.runs))
+	for zy, runs := range roi.runs {
+		for _, run := range runs {
+			spans = append(spans, BlockSpan{zy[0], zy[1], run[0], run[1]})
+		}
+	}
+	sort.Sort(spans)
+	return []BlockSpan(spans)
+}
+
+// Contains returns true if the block is within the ROI.
+func (roi *ROI) Contains(c ChunkPoint3d) bool {
+	return len(roi.Intersect(c[2], c[1], c[0], c[0])) != 0
+}
+
+// Intersect returns the runs of blocks within the ROI for the given x run of blocks.
+func (roi *ROI) Intersect(z, y, x0, x1 int32) [][2]int32 {
+	runs := roi.runs[[2]int32{z, y}]
+	n := sort.Search(len(runs), func(i int) bool { return runs[i][1] >= x0 })
+	var overlaps [][2]int32
+	for ; n < len(runs) && runs[n][0] <= x1; n++ {
+		overlap := runs[n]
+		if overlap[0] < x0 {
+			overlap[0] = x0
+		}
+		if overlap[1] > x1 {
+			overlap[1] = x1
+		}
+		overlaps = append(overlaps, overlap)
+	}
+	return overlaps
+}
+
+// ROIIterator is an IndexIterator that restricts the spans of another iterator to the
+// blocks within an ROI.  Each span of the wrapped iterator may yield any number of
+// spans, each a contiguous range of keys holding only blocks within the ROI.
+type ROIIterator struct {
+	it      IndexIterator
+	roi     *ROI
+	pending [][]ChunkIndexer
+	err     error
+}
+
+// NewROIIterator returns an iterator over the spans of the given iterator within the
+// ROI.  The wrapped iterator's indices must be PointIndexers unless it lists the chunk
+// indices of its spans.
+func NewROIIterator(it IndexIterator, roi *ROI) *ROIIterator {
+	roiIt := &ROIIterator{it: it, roi: roi}
+	roiIt.fill()
+	return roiIt
+}
+
+// fill advances the wrapped iterator until there is a pending span within the ROI.
+func (it *ROIIterator) fill() {
+	for len(it.pending) == 0 && it.err == nil && it.it.Valid() {
+		it.pending, it.err = it.restrict()
+		it.it.NextSpan()
+	}
+}
+
+// restrict returns the chunk indices of the wrapped iterator's current span that are
+// within the ROI, grouped into runs that are contiguous in the wrapped span.
+func (it *ROIIterator) restrict() ([][]ChunkIndexer, error) {
+	if lister, ok := it.it.(IndexSpanLister); ok {
+		var groups [][]ChunkIndexer
+		var group []ChunkIndexer
+		for _, index := range lister.SpanIndices() {
+			c := ChunkPoint3d{index.Value(0), index.Value(1), index.Value(2)}
+			if it.roi.Contains(c) {
+				group = append(group, index)
+			} else if len(group) != 0 {
+				groups = append(groups, group)
+				group = nil
+			}
+		}
+		if len(group) != 0 {
+			groups = append(groups, group)
+		}
+		return groups, nil
+	}
+	beg, end, err := it.it.IndexSpan()
+	if err != nil {
+		return nil, err
+	}
+	indexer, ok := beg.(PointIndexer)
+	if !ok {
+		return nil, fmt.Errorf("Cannot restrict spans of %s to an ROI", beg.Scheme())
+	}
+	z, y := indexer.Value(2), indexer.Value(1)
+	var groups [][]ChunkIndexer
+	for _, run := range it.roi.Intersect(z, y, indexer.Value(0), end.(ChunkIndexer).Value(0)) {
+		group := make([]ChunkIndexer, 0, run[1]-run[0]+1)
+		for x := run[0]; x <= run[1]; x++ {
+			index, err := indexer.IndexFromPoint(ChunkPoint3d{x, y, z})
+			if err != nil {
+				return nil, err
+			}
+			group = append(group, index)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (it *ROIIterator) Valid() bool {
+	return len(it.pending) != 0 || it.err != nil
+}
+
+// IndexSpan returns the first and last index of the current span or any error in
+// restricting the wrapped iterator's spans.
+func (it *ROIIterator) IndexSpan() (beg, end Index, err error) {
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+	span := it.pending[0]
+	return span[0], span[len(span)-1], nil
+}
+
+// SpanIndices returns the chunk indices within the current span.
+func (it *ROIIterator) SpanIndices() []ChunkIndexer {
+	if it.err != nil {
+		return nil
+	}
+	return it.pending[0]
+}
+
+func (it *ROIIterator) NextSpan() {
+	if it.err != nil {
+		it.err = nil
+		it.pending = nil
+		return
+	}
+	it.pending = it.pending[1:]
+	it.fill()
+}
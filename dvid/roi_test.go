@@ -0,0 +1,70 @@
+package dvid
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+	_ "testing"
+)
+
+// roiChunks returns the chunks covered by the spans of an iterator.
+func roiChunks(c *C, it *ROIIterator) (spans int, chunks map[ChunkPoint3d]bool) {
+	chunks = make(map[ChunkPoint3d]bool)
+	for ; it.Valid(); it.NextSpan() {
+		beg, end, err := it.IndexSpan()
+		c.Assert(err, IsNil)
+		indices := it.SpanIndices()
+		c.Assert(indices[0], DeepEquals, beg)
+		c.Assert(indices[len(indices)-1], DeepEquals, end)
+		for _, index := range indices {
+			chunk := ChunkPoint3d{index.Value(0), index.Value(1), index.Value(2)}
+			c.Assert(chunks[chunk], Equals, false)
+			chunks[chunk] = true
+		}
+		spans++
+	}
+	return
+}
+
+func (suite *DataSuite) TestROIIterator(c *C) {
+	_, err := NewROI([]BlockSpan{{0, 0, 3, 2}})
+	c.Assert(err, NotNil)
+
+	roi, err := NewROI([]BlockSpan{
+		{2, 1, 5, 9},
+		{1, 1, -2, 1},
+		{1, 1, 2, 3}, // adjoins previous span
+		{1, 2, 0, 0},
+		{1, 2, 2, 4},
+		{1, 2, 3, 6}, // overlaps previous span
+	})
+	c.Assert(err, IsNil)
+	c.Assert(roi.Contains(ChunkPoint3d{3, 1, 1}), Equals, true)
+	c.Assert(roi.Contains(ChunkPoint3d{4, 1, 1}), Equals, false)
+	c.Assert(roi.Contains(ChunkPoint3d{1, 2, 1}), Equals, false)
+	c.Assert(roi.Intersect(1, 2, -5, 10), DeepEquals, [][2]int32{{0, 0}, {2, 6}})
+	c.Assert(roi.Spans(), DeepEquals, []BlockSpan{{1, 1, -2, 3}, {1, 2, 0, 0}, {1, 2, 2, 6}, {2, 1, 5, 9}})
+
+	expected := map[ChunkPoint3d]bool{}
+	for x := int32(0); x <= 3; x++ {
+		expected[ChunkPoint3d{x, 1, 1}] = true
+	}
+	for _, x := range []int32{0, 2, 3, 4, 5, 6} {
+		expected[ChunkPoint3d{x, 2, 1}] = true
+	}
+	for x := int32(5); x <= 7; x++ {
+		expected[ChunkPoint3d{x, 1, 2}] = true
+	}
+	start, end := ChunkPoint3d{0, 0, 0}, ChunkPoint3d{7, 7, 7}
+
+	spans, chunks := roiChunks(c, NewROIIterator(NewIndexZYXIterator(nil, start, end), roi))
+	c.Assert(spans, Equals, 4)
+	c.Assert(chunks, DeepEquals, expected)
+
+	_, chunks = roiChunks(c, NewROIIterator(NewIndexHilbertIterator(nil, start, end), roi))
+	c.Assert(chunks, DeepEquals, expected)
+
+	it := NewROIIterator(NewIndexTZYXIterator(3, 3, nil, start, end), roi)
+	c.Assert(it.Valid(), Equals, true)
+	beg, _, err := it.IndexSpan()
+	c.Assert(err, IsNil)
+	c.Assert(beg, DeepEquals, IndexTZYX{3, IndexZYX{0, 1, 1}})
+}
@@ -7,13 +7,17 @@ package dvid
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
 	_ "log"
+	"sync"
 
 	lz4 "github.com/janelia-flyem/go/golz4"
 	"github.com/janelia-flyem/go/snappy-go/snappy"
@@ -24,6 +28,7 @@ import (
 type Compression struct {
 	format CompressionFormat
 	level  CompressionLevel
+	dict   *Dictionary
 }
 
 func (c Compression) Format() CompressionFormat {
@@ -34,41 +39,84 @@ func (c Compression) Level() CompressionLevel {
 	return c.level
 }
 
-// MarshalJSON implements the json.Marshaler interface.
+// Dictionary returns the shared dictionary used by DeflateDict compression or nil.
+func (c Compression) Dictionary() *Dictionary {
+	return c.dict
+}
+
+// MarshalJSON implements the json.Marshaler interface.  Any dictionary is included so
+// the compression round-trips.
 func (c Compression) MarshalJSON() ([]byte, error) {
-	return []byte(fmt.Sprintf(`{"Format":%d,"Level":%d}`, c.format, c.level)), nil
+	var m struct {
+		Format     CompressionFormat
+		Level      CompressionLevel
+		Dictionary []byte `json:",omitempty"`
+	}
+	m.Format, m.Level = c.format, c.level
+	if c.dict != nil {
+		m.Dictionary = c.dict.data
+	}
+	return json.Marshal(m)
 }
 
-// UnmarshalJSON implements the json.Unmarshaler interface.
+// UnmarshalJSON implements the json.Unmarshaler interface.  Any included dictionary is
+// registered so data compressed with it can be deserialized.
 func (c *Compression) UnmarshalJSON(b []byte) error {
 	var m struct {
-		Format CompressionFormat
-		Level  CompressionLevel
+		Format     CompressionFormat
+		Level      CompressionLevel
+		Dictionary []byte
 	}
 	if err := json.Unmarshal(b, &m); err != nil {
 		return err
 	}
 	c.format = m.Format
 	c.level = m.Level
+	c.dict = nil
+	if len(m.Dictionary) != 0 {
+		dict, err := NewDictionary(m.Dictionary)
+		if err != nil {
+			return err
+		}
+		c.dict = dict
+	}
 	return nil
 }
 
-// MarshalBinary fulfills the encoding.BinaryMarshaler interface.
+// MarshalBinary fulfills the encoding.BinaryMarshaler interface.  Any dictionary is
+// appended so it is stored with the metadata of the data using this compression.
 func (c Compression) MarshalBinary() ([]byte, error) {
+	if c.dict != nil {
+		return append([]byte{byte(c.format), byte(c.level)}, c.dict.data...), nil
+	}
 	return []byte{byte(c.format), byte(c.level)}, nil
 }
 
-// UnmarshalBinary fulfills the encoding.BinaryUnmarshaler interface.
+// UnmarshalBinary fulfills the encoding.BinaryUnmarshaler interface.  Any stored dictionary
+// is registered so data compressed with it can be deserialized.
 func (c *Compression) UnmarshalBinary(data []byte) error {
-	if len(data) != 2 {
+	if len(data) < 2 {
 		return fmt.Errorf("Cannot unmarshal %d bytes into Compression", len(data))
 	}
 	c.format = CompressionFormat(data[0])
 	c.level = CompressionLevel(data[1])
+	c.dict = nil
+	if len(data) > 2 {
+		dictData := make([]byte, len(data)-2)
+		copy(dictData, data[2:])
+		dict, err := NewDictionary(dictData)
+		if err != nil {
+			return err
+		}
+		c.dict = dict
+	}
 	return nil
 }
 
 func (c Compression) String() string {
+	if c.dict != nil {
+		return fmt.Sprintf("%s, level %d, %s", c.format, c.level, c.dict)
+	}
 	return fmt.Sprintf("%s, level %d", c.format, c.level)
 }
 
@@ -80,21 +128,34 @@ func NewCompression(format CompressionFormat, level CompressionLevel) (Compressi
 	}
 	switch format {
 	case Uncompressed:
-		return Compression{format, DefaultCompression}, nil
+		return Compression{format, DefaultCompression, nil}, nil
 	case Snappy:
-		return Compression{format, DefaultCompression}, nil
+		return Compression{format, DefaultCompression, nil}, nil
 	case LZ4:
-		return Compression{format, DefaultCompression}, nil
+		return Compression{format, DefaultCompression, nil}, nil
 	case Gzip:
 		if level != DefaultCompression && (level < 1 || level > 9) {
 			return Compression{}, fmt.Errorf("Gzip compression level must be between 1 and 9")
 		}
-		return Compression{format, level}, nil
+		return Compression{format, level, nil}, nil
+	case DeflateDict:
+		return Compression{}, fmt.Errorf("Dictionary compression must be created with NewDictCompression")
 	default:
 		return Compression{}, fmt.Errorf("Unrecognized compression format requested: %d", format)
 	}
 }
 
+// NewDictCompression returns a DeflateDict Compression using a shared dictionary.
+func NewDictCompression(dict *Dictionary, level CompressionLevel) (Compression, error) {
+	if dict == nil {
+		return Compression{}, fmt.Errorf("Dictionary compression requires a dictionary")
+	}
+	if level != DefaultCompression && (level < 1 || level > 9) {
+		return Compression{}, fmt.Errorf("Dictionary compression level must be between 1 and 9")
+	}
+	return Compression{DeflateDict, level, dict}, nil
+}
+
 // CompressionLevel goes from 1 (fastest) to 9 (highest compression)
 // as in deflate.  Default compression is -1 so need signed int8.
 type CompressionLevel int8
@@ -114,6 +175,15 @@ const (
 	Snappy                         = 1 << (iota - 1)
 	Gzip                           // Gzip stores length and checksum automatically.
 	LZ4
+
+	// DeflateDict is DEFLATE using a dictionary shared by all blocks of a data instance.
+	// Since compression formats are stored in 3 bits, it uses an unused value below 8.
+	DeflateDict CompressionFormat = 3
+
+	// Framed data are chunks compressed independently, possibly in parallel, using the
+	// compression format recorded in the frame.  See framed.go.  It is never requested
+	// directly but used by SerializeData for large payloads.
+	Framed CompressionFormat = 5
 )
 
 func (format CompressionFormat) String() string {
@@ -126,6 +196,10 @@ func (format CompressionFormat) String() string {
 		return "LZ4 compression"
 	case Gzip:
 		return "gzip compression"
+	case DeflateDict:
+		return "DEFLATE compression with shared dictionary"
+	case Framed:
+		return "Framed compression"
 	default:
 		return "Unknown compression"
 	}
@@ -138,6 +212,7 @@ type Checksum uint8
 const (
 	NoChecksum Checksum = 0
 	CRC32               = 1 << (iota - 1)
+	SHA256              // Cryptographic checksum suitable for archival data.
 )
 
 // DefaultChecksum is the type of checksum employed for all data operations.
@@ -151,12 +226,15 @@ func (checksum Checksum) String() string {
 		return "No checksum"
 	case CRC32:
 		return "CRC32 checksum"
+	case SHA256:
+		return "SHA-256 checksum"
 	default:
 		return "Unknown checksum"
 	}
 }
 
-// SerializationFormat combines both compression and checksum methods.
+// SerializationFormat combines both compression and checksum methods.  It is the first
+// byte of every serialization envelope.  See EncodeEnvelope for the full envelope.
 type SerializationFormat uint8
 
 func EncodeSerializationFormat(compress Compression, checksum Checksum) SerializationFormat {
@@ -171,79 +249,315 @@ func DecodeSerializationFormat(s SerializationFormat) (CompressionFormat, Checks
 	return format, checksum
 }
 
+// Pools of scratch buffers and gzip codecs reused across serializations.  Block-level
+// reads and writes serialize many small values, so reusing these reduces GC pressure.
+var (
+	scratchPool = sync.Pool{
+		New: func() interface{} { return new([]byte) },
+	}
+	bufferPool = sync.Pool{
+		New: func() interface{} { return new(bytes.Buffer) },
+	}
+	gzipReaderPool sync.Pool
+
+	// Gzip writers are pooled per compression level, indexed by level+1 so
+	// DefaultCompression (-1) through BestCompression (9) are covered.
+	gzipWriterPools [BestCompression + 2]sync.Pool
+)
+
+// getScratch returns a pooled byte slice of the given length.
+func getScratch(size int) *[]byte {
+	scratch := scratchPool.Get().(*[]byte)
+	if cap(*scratch) < size {
+		*scratch = make([]byte, size)
+	}
+	*scratch = (*scratch)[:size]
+	return scratch
+}
+
+func putScratch(scratch *[]byte) {
+	scratchPool.Put(scratch)
+}
+
+// getBuffer returns an empty, pooled bytes.Buffer.
+func getBuffer() *bytes.Buffer {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	return buffer
+}
+
+func putBuffer(buffer *bytes.Buffer) {
+	bufferPool.Put(buffer)
+}
+
+func getGzipWriter(w io.Writer, level CompressionLevel) (*gzip.Writer, error) {
+	if level < DefaultCompression || level > BestCompression {
+		return gzip.NewWriterLevel(w, int(level))
+	}
+	if zw, ok := gzipWriterPools[level+1].Get().(*gzip.Writer); ok {
+		zw.Reset(w)
+		return zw, nil
+	}
+	return gzip.NewWriterLevel(w, int(level))
+}
+
+func putGzipWriter(zw *gzip.Writer, level CompressionLevel) {
+	if level >= DefaultCompression && level <= BestCompression {
+		gzipWriterPools[level+1].Put(zw)
+	}
+}
+
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	if zr, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+		if err := zr.Reset(r); err != nil {
+			return nil, err
+		}
+		return zr, nil
+	}
+	return gzip.NewReader(r)
+}
+
+func putGzipReader(zr *gzip.Reader) {
+	gzipReaderPool.Put(zr)
+}
+
+// checksumSize returns the number of bytes used to store a checksum.
+func checksumSize(checksum Checksum) (int, error) {
+	switch checksum {
+	case NoChecksum:
+		return 0, nil
+	case CRC32:
+		return crc32.Size, nil
+	case SHA256:
+		return sha256.Size, nil
+	default:
+		return 0, fmt.Errorf("Illegal checksum (%s)", checksum)
+	}
+}
+
+// readAllSized reads until EOF into a slice preallocated for an expected size.  Unlike
+// ioutil.ReadAll, a correct size requires only one allocation.
+func readAllSized(r io.Reader, size int) ([]byte, error) {
+	// The extra byte allows detection of EOF without growing the slice.
+	data := make([]byte, 0, size+1)
+	for {
+		if len(data) == cap(data) {
+			data = append(data, 0)[:len(data)]
+		}
+		n, err := r.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
 // Serialize a slice of bytes using optional compression, checksum.
-// Checksum will be ignored if the underlying compression already employs
-// checksums, e.g., Gzip.
+// A CRC32 checksum will be ignored if the underlying compression already employs
+// one, e.g., Gzip.  Data of at least ParallelCompressionSize bytes are
+// compressed in parallel chunks and stored in the Framed format.
 func SerializeData(data []byte, compress Compression, checksum Checksum) ([]byte, error) {
-	var buffer bytes.Buffer
+	return serializeData(data, compress, checksum, UnspecifiedEncoding)
+}
 
-	// Don't duplicate checksum if using Gzip, which already has checksum & length checks.
-	if compress.format == Gzip {
+// serializeData serializes a slice of bytes, recording any object encoding in the envelope.
+func serializeData(data []byte, compress Compression, checksum Checksum, encoding ObjectEncoding) ([]byte, error) {
+	// Don't duplicate a CRC32 checksum if using Gzip, which already has CRC32 & length
+	// checks.  A SHA-256 checksum is stronger and kept.
+	if compress.format == Gzip && checksum == CRC32 {
 		checksum = NoChecksum
 	}
-
-	// Store the requested compression and checksum
-	format := EncodeSerializationFormat(compress, checksum)
-	if err := binary.Write(&buffer, binary.LittleEndian, format); err != nil {
+	csumSize, err := checksumSize(checksum)
+	if err != nil {
 		return nil, err
 	}
 
-	// Handle compression if requested
-	var err error
+	// Handle compression if requested.  Large payloads are compressed in parallel chunks.
 	var byteData []byte
+	if useFraming(data, compress) {
+		if byteData, err = compressFramed(data, compress); err != nil {
+			return nil, err
+		}
+		compress = Compression{format: Framed}
+	} else {
+		var release func()
+		if byteData, release, err = compressBytes(data, compress); err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	// Store the envelope with requested compression and checksum, then any checksum,
+	// then the data.  Note the actual data is written last, after any checksum so we
+	// don't have to worry about length when deserializing.
+	var header []byte
+	if encoding == UnspecifiedEncoding {
+		header = EncodeEnvelope(compress, checksum)
+	} else {
+		header = encodeObjectEnvelope(compress, checksum, encoding)
+	}
+	hdrSize := len(header)
+	s := make([]byte, hdrSize+csumSize+len(byteData))
+	copy(s, header)
+	switch checksum {
+	case CRC32:
+		binary.LittleEndian.PutUint32(s[hdrSize:hdrSize+csumSize], crc32.ChecksumIEEE(byteData))
+	case SHA256:
+		digest := sha256.Sum256(byteData)
+		copy(s[hdrSize:hdrSize+csumSize], digest[:])
+	}
+	copy(s[hdrSize+csumSize:], byteData)
+	return s, nil
+}
+
+// compressBytes compresses data using pooled scratch space where possible.  The returned
+// release function must be called once the compressed data is no longer needed.
+func compressBytes(data []byte, compress Compression) (byteData []byte, release func(), err error) {
+	release = func() {}
 	switch compress.format {
 	case Uncompressed:
 		byteData = data
 	case Snappy:
-		byteData, err = snappy.Encode(nil, data)
-		if err != nil {
-			return nil, err
-		}
+		scratch := getScratch(snappy.MaxEncodedLen(len(data)))
+		release = func() { putScratch(scratch) }
+		byteData, err = snappy.Encode(*scratch, data)
 	case LZ4:
-		origSize := uint32(len(data))
-		byteData = make([]byte, lz4.CompressBound(data)+4)
-		binary.LittleEndian.PutUint32(byteData[0:4], origSize)
+		scratch := getScratch(lz4.CompressBound(data) + 4)
+		release = func() { putScratch(scratch) }
+		byteData = *scratch
+		binary.LittleEndian.PutUint32(byteData[0:4], uint32(len(data)))
 		var outSize int
 		outSize, err = lz4.Compress(data, byteData[4:])
-		if err != nil {
-			return nil, err
-		}
 		byteData = byteData[:4+outSize]
 	case Gzip:
-		var b bytes.Buffer
-		w, err := gzip.NewWriterLevel(&b, int(compress.level))
-		if err != nil {
-			return nil, err
+		buffer := getBuffer()
+		release = func() { putBuffer(buffer) }
+		var w *gzip.Writer
+		if w, err = getGzipWriter(buffer, compress.level); err != nil {
+			break
 		}
 		if _, err = w.Write(data); err != nil {
-			return nil, err
+			break
 		}
 		if err = w.Close(); err != nil {
-			return nil, err
+			break
 		}
-		byteData = b.Bytes()
+		putGzipWriter(w, compress.level)
+		byteData = buffer.Bytes()
+	case DeflateDict:
+		byteData, err = compressWithDictionary(data, compress)
 	default:
-		return nil, fmt.Errorf("Illegal compression (%s) during serialization", compress)
+		err = fmt.Errorf("Illegal compression (%s) during serialization", compress)
+	}
+	if err != nil {
+		release()
+		return nil, func() {}, err
 	}
+	return byteData, release, nil
+}
 
-	// Handle checksum if requested
-	switch checksum {
-	case NoChecksum:
-	case CRC32:
-		crcChecksum := crc32.ChecksumIEEE(byteData)
-		if err := binary.Write(&buffer, binary.LittleEndian, crcChecksum); err != nil {
+// maxCompressionRatio bounds the original size given in the header of compressed data
+// relative to the compressed size, so corrupt headers cannot force huge allocations.
+// Deflate, the most compressible format used, expands at most 1032 times.
+const maxCompressionRatio = 1032
+
+// checkOriginalSize returns an error if compressed data cannot expand to the original
+// size given in its header.
+func checkOriginalSize(origSize uint64, compressedSize int) error {
+	if origSize > maxCompressionRatio*uint64(compressedSize) {
+		return fmt.Errorf("Compressed data of %d bytes cannot expand to the %d bytes given in its header",
+			compressedSize, origSize)
+	}
+	return nil
+}
+
+// uncompressBytes returns the uncompressed data.  Output is allocated once using the
+// original length stored with the compressed data.
+func uncompressBytes(cdata []byte, compression CompressionFormat) ([]byte, error) {
+	switch compression {
+	case Uncompressed:
+		return cdata, nil
+	case Snappy:
+		size, err := snappy.DecodedLen(cdata)
+		if err != nil {
+			return nil, err
+		}
+		return snappy.Decode(make([]byte, size), cdata)
+	case LZ4:
+		if len(cdata) < 4 {
+			return nil, fmt.Errorf("LZ4 data too short to hold original size")
+		}
+		origSize := binary.LittleEndian.Uint32(cdata[0:4])
+		if err := checkOriginalSize(uint64(origSize), len(cdata)); err != nil {
 			return nil, err
 		}
+		data := make([]byte, int(origSize))
+		if err := lz4.Uncompress(cdata[4:], data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	case Gzip:
+		// The gzip trailer ends with the original size modulo 2^32, which is only used
+		// as a hint if the compressed data could expand to it.
+		var origSize int
+		if len(cdata) >= 4 {
+			size := binary.LittleEndian.Uint32(cdata[len(cdata)-4:])
+			if checkOriginalSize(uint64(size), len(cdata)) == nil {
+				origSize = int(size)
+			}
+		}
+		r, err := getGzipReader(bytes.NewReader(cdata))
+		if err != nil {
+			return nil, err
+		}
+		data, err := readAllSized(r, origSize)
+		if err != nil {
+			return nil, err
+		}
+		if err = r.Close(); err != nil {
+			return nil, err
+		}
+		putGzipReader(r)
+		return data, nil
+	case DeflateDict:
+		return uncompressWithDictionary(cdata)
+	case Framed:
+		return uncompressFramed(cdata)
 	default:
-		return nil, fmt.Errorf("Illegal checksum (%s) in serialize.SerializeData()", checksum)
+		return nil, fmt.Errorf("Illegal compression format (%d) in deserialization", compression)
 	}
+}
 
-	// Note the actual data is written last, after any checksum so we don't have to
-	// worry about length when deserializing.
-	if _, err := buffer.Write(byteData); err != nil {
-		return nil, err
+// ObjectEncoding is the encoding used to serialize a Go object.
+type ObjectEncoding uint8
+
+const (
+	// UnspecifiedEncoding is used for raw data and for Gob-encoded objects stored
+	// before object encodings were recorded.
+	UnspecifiedEncoding ObjectEncoding = iota
+
+	// GobEncoding is Go-specific and can encode interface values of registered types.
+	GobEncoding
+
+	// JSONEncoding can be decoded by tools outside of Go but cannot restore interface
+	// values.  It is suitable for simple metadata structures.
+	JSONEncoding
+)
+
+func (encoding ObjectEncoding) String() string {
+	switch encoding {
+	case UnspecifiedEncoding:
+		return "unspecified encoding"
+	case GobEncoding:
+		return "Gob encoding"
+	case JSONEncoding:
+		return "JSON encoding"
+	default:
+		return "unknown encoding"
 	}
-	return buffer.Bytes(), nil
 }
 
 // Serializes an arbitrary Go object using Gob encoding and optional compression, checksum.
@@ -251,8 +565,9 @@ func SerializeData(data []byte, compress Compression, checksum Checksum) ([]byte
 // process adds some overhead in performance as well as size of wire format to describe the
 // transmitted types.
 func Serialize(object interface{}, compress Compression, checksum Checksum) ([]byte, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	enc := gob.NewEncoder(buffer)
 	err := enc.Encode(object)
 	if err != nil {
 		return nil, err
@@ -260,94 +575,232 @@ func Serialize(object interface{}, compress Compression, checksum Checksum) ([]b
 	return SerializeData(buffer.Bytes(), compress, checksum)
 }
 
+// SerializeWith serializes a Go object using the given encoding and optional compression,
+// checksum.  The encoding is recorded in the serialization, so Deserialize can decode it.
+// Use JSONEncoding for metadata that should be readable by non-Go tools directly from
+// the storage engine; such tools should also avoid compression formats specific to DVID.
+func SerializeWith(object interface{}, encoding ObjectEncoding, compress Compression,
+	checksum Checksum) ([]byte, error) {
+
+	switch encoding {
+	case UnspecifiedEncoding, GobEncoding:
+		return Serialize(object, compress, checksum)
+	case JSONEncoding:
+		data, err := json.Marshal(object)
+		if err != nil {
+			return nil, err
+		}
+		return serializeData(data, compress, checksum, JSONEncoding)
+	default:
+		return nil, fmt.Errorf("Illegal object encoding (%d) during serialization", encoding)
+	}
+}
+
 // DeserializeData deserializes a slice of bytes using stored compression, checksum.
-// If uncompress parameter is false, the data is not uncompressed.
+// If uncompress parameter is false, the data is not uncompressed.  Uncompressed output
+// is allocated once using the original length stored with the compressed data.
 func DeserializeData(s []byte, uncompress bool) ([]byte, CompressionFormat, error) {
-	buffer := bytes.NewBuffer(s)
-
 	// Get the stored compression and checksum
-	var format SerializationFormat
-	if err := binary.Read(buffer, binary.LittleEndian, &format); err != nil {
-		return nil, 0, fmt.Errorf("Could not read serialization format info: %s", err.Error())
+	env, err := DecodeEnvelope(s)
+	if err != nil {
+		return nil, 0, err
 	}
-	compression, checksum := DecodeSerializationFormat(format)
-
-	// Get any checksum.
-	var storedCrc32 uint32
-	switch checksum {
-	case NoChecksum:
-	case CRC32:
-		if err := binary.Read(buffer, binary.LittleEndian, &storedCrc32); err != nil {
-			return nil, 0, fmt.Errorf("Error reading checksum: %s", err.Error())
-		}
-	default:
+	compression, checksum, hdrSize := env.Compression, env.Checksum, env.Size
+	csumSize, err := checksumSize(checksum)
+	if err != nil {
 		return nil, 0, fmt.Errorf("Illegal checksum in deserializing data")
 	}
+	if len(s) < hdrSize+csumSize {
+		return nil, 0, fmt.Errorf("Error reading %s: data too short", checksum)
+	}
 
 	// Get the possibly compressed data.
-	cdata := buffer.Bytes()
+	cdata := s[hdrSize+csumSize:]
 
 	// Perform any requested checksum
 	switch checksum {
 	case CRC32:
+		storedCrc32 := binary.LittleEndian.Uint32(s[hdrSize : hdrSize+csumSize])
 		crcChecksum := crc32.ChecksumIEEE(cdata)
 		if crcChecksum != storedCrc32 {
 			return nil, 0, fmt.Errorf("Bad checksum.  Stored %x got %x", storedCrc32, crcChecksum)
 		}
+	case SHA256:
+		storedSha256 := s[hdrSize : hdrSize+csumSize]
+		digest := sha256.Sum256(cdata)
+		if !bytes.Equal(digest[:], storedSha256) {
+			return nil, 0, fmt.Errorf("Bad SHA-256 checksum.  Stored %x got %x", storedSha256, digest)
+		}
 	}
 
 	// Return data with optional compression
 	if !uncompress || compression == Uncompressed {
 		return cdata, compression, nil
-	} else {
-		switch compression {
-		case Snappy:
-			if data, err := snappy.Decode(nil, cdata); err != nil {
-				return nil, 0, err
-			} else {
-				return data, compression, nil
-			}
-		case LZ4:
-			origSize := binary.LittleEndian.Uint32(cdata[0:4])
-			data := make([]byte, int(origSize))
-			if err := lz4.Uncompress(cdata[4:], data); err != nil {
-				return nil, 0, err
-			} else {
-				return data, compression, nil
-			}
-		case Gzip:
-			b := bytes.NewBuffer(cdata)
-			var err error
-			r, err := gzip.NewReader(b)
-			if err != nil {
-				return nil, 0, err
-			}
-			var buffer bytes.Buffer
-			_, err = io.Copy(&buffer, r)
-			if err != nil {
-				return nil, 0, err
-			}
-			err = r.Close()
-			if err != nil {
-				return nil, 0, err
-			}
-			return buffer.Bytes(), compression, nil
-		default:
-			return nil, 0, fmt.Errorf("Illegal compression format (%d) in deserialization", compression)
+	}
+	data, err := uncompressBytes(cdata, compression)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, compression, nil
+}
+
+// SerializeToWriter writes the serialization of data to a writer using optional compression
+// and checksum.  The output is identical to SerializeData but avoids holding a second copy
+// of the serialization in memory.  Since the checksum precedes the data, checksummed
+// or block-compressed (Snappy, LZ4, DeflateDict) data must still be compressed in memory
+// before writing, as must large payloads compressed in parallel chunks.
+func SerializeToWriter(w io.Writer, data []byte, compress Compression, checksum Checksum) error {
+	// Don't duplicate a CRC32 checksum if using Gzip, which already has CRC32 & length
+	// checks.  A SHA-256 checksum is stronger and kept.
+	if compress.format == Gzip && checksum == CRC32 {
+		checksum = NoChecksum
+	}
+
+	// Large payloads are compressed in parallel chunks.
+	var byteData []byte
+	if useFraming(data, compress) {
+		var err error
+		if byteData, err = compressFramed(data, compress); err != nil {
+			return err
+		}
+		compress = Compression{format: Framed}
+	}
+	if _, err := w.Write(EncodeEnvelope(compress, checksum)); err != nil {
+		return err
+	}
+
+	// Gzip can stream directly to the writer unless it needs a checksum.
+	if compress.format == Gzip && checksum == NoChecksum {
+		zw, err := gzip.NewWriterLevel(w, int(compress.level))
+		if err != nil {
+			return err
+		}
+		if _, err = zw.Write(data); err != nil {
+			return err
 		}
+		return zw.Close()
 	}
+
+	if byteData == nil {
+		var release func()
+		var err error
+		if byteData, release, err = compressBytes(data, compress); err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	switch checksum {
+	case NoChecksum:
+	case CRC32:
+		if err := binary.Write(w, binary.LittleEndian, crc32.ChecksumIEEE(byteData)); err != nil {
+			return err
+		}
+	case SHA256:
+		digest := sha256.Sum256(byteData)
+		if _, err := w.Write(digest[:]); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Illegal checksum (%s) in serialize.SerializeToWriter()", checksum)
+	}
+	_, err := w.Write(byteData)
+	return err
 }
 
-// Deserializes a Go object using Gob encoding
+// DeserializeFromReader reads a serialization produced by SerializeData or SerializeToWriter
+// and writes the uncompressed data to a writer.  Uncompressed and gzip data are streamed
+// without being held in memory.  Since streamed data is written before the checksum can be
+// verified, a checksum error may be returned after some or all data has been written.
+func DeserializeFromReader(r io.Reader, w io.Writer) (CompressionFormat, error) {
+	env, err := readEnvelope(r)
+	if err != nil {
+		return 0, err
+	}
+	compression, checksum := env.Compression, env.Checksum
+
+	// Setup checksum computation on the stored (possibly compressed) data as it is read.
+	var stored []byte
+	var h hash.Hash
+	switch checksum {
+	case NoChecksum:
+	case CRC32:
+		stored = make([]byte, crc32.Size)
+		h = crc32.NewIEEE()
+	case SHA256:
+		stored = make([]byte, sha256.Size)
+		h = sha256.New()
+	default:
+		return 0, fmt.Errorf("Illegal checksum in deserializing data")
+	}
+	if h != nil {
+		if _, err := io.ReadFull(r, stored); err != nil {
+			return 0, fmt.Errorf("Error reading checksum: %s", err.Error())
+		}
+		if checksum == CRC32 {
+			// CRC32 is stored little endian while hash sums are big endian.
+			stored[0], stored[1], stored[2], stored[3] = stored[3], stored[2], stored[1], stored[0]
+		}
+		r = io.TeeReader(r, h)
+	}
+
+	switch compression {
+	case Uncompressed:
+		_, err = io.Copy(w, r)
+	case Snappy, LZ4, DeflateDict, Framed:
+		var cdata, data []byte
+		if cdata, err = ioutil.ReadAll(r); err != nil {
+			break
+		}
+		if data, err = uncompressBytes(cdata, compression); err == nil {
+			_, err = w.Write(data)
+		}
+	case Gzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(r); err != nil {
+			break
+		}
+		if _, err = io.Copy(w, zr); err == nil {
+			err = zr.Close()
+		}
+	default:
+		err = fmt.Errorf("Illegal compression format (%d) in deserialization", compression)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if h != nil {
+		if computed := h.Sum(nil); !bytes.Equal(computed, stored) {
+			return 0, fmt.Errorf("Bad checksum.  Stored %x got %x", stored, computed)
+		}
+	}
+	return compression, nil
+}
+
+// Deserializes a Go object using the encoding recorded in the serialization, which is
+// Gob unless the object was serialized by SerializeWith using another encoding.
 func Deserialize(s []byte, object interface{}) error {
-	// Get the bytes for the Gob-encoded object
+	env, err := DecodeEnvelope(s)
+	if err != nil {
+		return err
+	}
+
+	// Get the bytes for the encoded object
 	data, _, err := DeserializeData(s, true)
 	if err != nil {
 		return err
 	}
 
 	// Decode the bytes
-	buffer := bytes.NewBuffer(data)
-	dec := gob.NewDecoder(buffer)
-	return dec.Decode(object)
+	switch env.Encoding {
+	case UnspecifiedEncoding, GobEncoding:
+		buffer := bytes.NewBuffer(data)
+		dec := gob.NewDecoder(buffer)
+		return dec.Decode(object)
+	case JSONEncoding:
+		return json.Unmarshal(data, object)
+	default:
+		return fmt.Errorf("Illegal object encoding (%d) in deserialization", env.Encoding)
+	}
 }
@@ -1,7 +1,11 @@
 package dvid
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"testing"
+
 	. "github.com/janelia-flyem/go/gocheck"
 )
 
@@ -32,13 +36,13 @@ func (suite *DataSuite) TestSerialization(c *C) {
 	}
 
 	for _, format := range []CompressionFormat{Uncompressed, Snappy, LZ4, Gzip} {
-		for _, checksum := range []Checksum{NoChecksum, CRC32} {
+		for _, checksum := range []Checksum{NoChecksum, CRC32, SHA256} {
 			compression, err := NewCompression(format, DefaultCompression)
 			c.Assert(err, IsNil)
 
 			// Check simple object
 			var csum Checksum
-			if format == Gzip {
+			if format == Gzip && checksum == CRC32 {
 				csum = NoChecksum
 			} else {
 				csum = checksum
@@ -75,6 +79,175 @@ func (suite *DataSuite) TestSerialization(c *C) {
 	}
 }
 
+func (suite *DataSuite) TestStreamingSerialization(c *C) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i % 7)
+	}
+	for _, format := range []CompressionFormat{Uncompressed, Snappy, LZ4, Gzip} {
+		for _, checksum := range []Checksum{NoChecksum, CRC32, SHA256} {
+			compression, err := NewCompression(format, DefaultCompression)
+			c.Assert(err, IsNil)
+
+			// Streamed serialization should be readable by DeserializeData.
+			var buf bytes.Buffer
+			err = SerializeToWriter(&buf, data, compression, checksum)
+			c.Assert(err, IsNil)
+			s := buf.Bytes()
+			out, gotFormat, err := DeserializeData(s, true)
+			c.Assert(err, IsNil)
+			c.Assert(gotFormat, Equals, format)
+			c.Assert(bytes.Equal(out, data), Equals, true)
+
+			// Non-streamed serialization should be readable by DeserializeFromReader.
+			s, err = SerializeData(data, compression, checksum)
+			c.Assert(err, IsNil)
+			c.Assert(buf.Bytes(), DeepEquals, s)
+
+			// Only a CRC32 checksum is left to the gzip format.
+			env, err := DecodeEnvelope(s)
+			c.Assert(err, IsNil)
+			if format == Gzip && checksum == CRC32 {
+				c.Assert(env.Checksum, Equals, Checksum(NoChecksum))
+			} else {
+				c.Assert(env.Checksum, Equals, checksum)
+			}
+			var outBuf bytes.Buffer
+			gotFormat, err = DeserializeFromReader(bytes.NewReader(s), &outBuf)
+			c.Assert(err, IsNil)
+			c.Assert(gotFormat, Equals, format)
+			c.Assert(bytes.Equal(outBuf.Bytes(), data), Equals, true)
+
+			if checksum != NoChecksum || format == Gzip {
+				for i := 1; i < len(s); i++ {
+					s[i] = s[i] ^ 0x04
+				}
+				outBuf.Reset()
+				_, err = DeserializeFromReader(bytes.NewReader(s), &outBuf)
+				c.Assert(err, NotNil, Commentf("format %s did not catch checksum error", format))
+			}
+		}
+	}
+}
+
+func (suite *DataSuite) TestDictionaryCompression(c *C) {
+	// Samples share content that is poorly compressible within any one sample.
+	common := make([]byte, 1024)
+	seed := uint32(17)
+	for j := range common {
+		seed = seed*1103515245 + 12345
+		common[j] = byte(seed >> 16)
+	}
+	samples := make([][]byte, 20)
+	for i := range samples {
+		samples[i] = make([]byte, len(common))
+		copy(samples[i], common)
+		samples[i][1000] = byte(i)
+	}
+	dictData := TrainDictionary(samples, 1024)
+	c.Assert(dictData, NotNil)
+	c.Assert(len(dictData) <= 1024, Equals, true)
+	c.Assert(TrainDictionary([][]byte{[]byte("no repeats")}, 1024), IsNil)
+
+	dict, err := NewDictionary(dictData)
+	c.Assert(err, IsNil)
+	found, ok := GetDictionary(dict.ID())
+	c.Assert(ok, Equals, true)
+	c.Assert(found, Equals, dict)
+
+	compression, err := NewDictCompression(dict, DefaultCompression)
+	c.Assert(err, IsNil)
+	gzipCompression, _ := NewCompression(Gzip, DefaultCompression)
+	for _, checksum := range []Checksum{NoChecksum, CRC32, SHA256} {
+		s, err := SerializeData(samples[3], compression, checksum)
+		c.Assert(err, IsNil)
+		data, format, err := DeserializeData(s, true)
+		c.Assert(err, IsNil)
+		c.Assert(format, Equals, CompressionFormat(DeflateDict))
+		c.Assert(bytes.Equal(data, samples[3]), Equals, true)
+
+		gz, err := SerializeData(samples[3], gzipCompression, checksum)
+		c.Assert(err, IsNil)
+		c.Assert(len(s) < len(gz), Equals, true, Commentf("dict %d bytes, gzip %d bytes", len(s), len(gz)))
+	}
+
+	// Dictionary should persist with the marshaled compression.
+	b, err := compression.MarshalBinary()
+	c.Assert(err, IsNil)
+	var compression2 Compression
+	c.Assert(compression2.UnmarshalBinary(b), IsNil)
+	c.Assert(compression2.Format(), Equals, CompressionFormat(DeflateDict))
+	c.Assert(compression2.Dictionary().ID(), Equals, dict.ID())
+
+	// ... and with its JSON.
+	b, err = json.Marshal(compression)
+	c.Assert(err, IsNil)
+	var compression3 Compression
+	c.Assert(json.Unmarshal(b, &compression3), IsNil)
+	c.Assert(compression3.Format(), Equals, CompressionFormat(DeflateDict))
+	c.Assert(compression3.Level(), Equals, compression.Level())
+	c.Assert(compression3.Dictionary().ID(), Equals, dict.ID())
+
+	b, err = json.Marshal(gzipCompression)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, `{"Format":2,"Level":-1}`)
+	c.Assert(json.Unmarshal(b, &compression3), IsNil)
+	c.Assert(compression3, DeepEquals, gzipCompression)
+
+	// A dictionary restored from metadata after a restart should be registered again.
+	s, err := SerializeData(samples[5], compression, CRC32)
+	c.Assert(err, IsNil)
+	dictionaries.Lock()
+	delete(dictionaries.m, dict.ID())
+	dictionaries.Unlock()
+	_, _, err = DeserializeData(s, true)
+	c.Assert(err, NotNil)
+
+	b, err = dict.MarshalBinary()
+	c.Assert(err, IsNil)
+	var restored Dictionary
+	c.Assert(restored.UnmarshalBinary(b), IsNil)
+	c.Assert(restored.ID(), Equals, dict.ID())
+	data, _, err := DeserializeData(s, true)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(data, samples[5]), Equals, true)
+
+	dictionaries.Lock()
+	delete(dictionaries.m, dict.ID())
+	dictionaries.Unlock()
+	b, err = json.Marshal(dict)
+	c.Assert(err, IsNil)
+	var restoredJSON Dictionary
+	c.Assert(json.Unmarshal(b, &restoredJSON), IsNil)
+	c.Assert(restoredJSON.ID(), Equals, dict.ID())
+	_, _, err = DeserializeData(s, true)
+	c.Assert(err, IsNil)
+}
+
+func (suite *DataSuite) TestReadAllSized(c *C) {
+	data := []byte("some data to be read with a size hint")
+	for _, size := range []int{0, 5, len(data), len(data) + 10} {
+		out, err := readAllSized(bytes.NewReader(data), size)
+		c.Assert(err, IsNil)
+		c.Assert(string(out), Equals, string(data))
+	}
+
+	// Gzip data larger than its pooled buffers should still round trip repeatedly.
+	compression, _ := NewCompression(Gzip, BestSpeed)
+	big := make([]byte, 300000)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	for i := 0; i < 3; i++ {
+		s, err := SerializeData(big, compression, NoChecksum)
+		c.Assert(err, IsNil)
+		out, _, err := DeserializeData(s, true)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(out, big), Equals, true)
+		c.Assert(cap(out), Equals, len(big)+1)
+	}
+}
+
 func (suite *DataSuite) testUncompressed(b *testing.B, checksum Checksum) {
 	stringObj := "Hi there!"
 	var returnObj string
@@ -107,3 +280,149 @@ func (suite *DataSuite) BenchmarkUncompressedNoChecksum(b *testing.B) {
 		suite.testUncompressed(b, NoChecksum)
 	}
 }
+
+func (suite *DataSuite) TestEnvelope(c *C) {
+	data := []byte("data stored before envelope versioning")
+	compression, _ := NewCompression(Uncompressed, DefaultCompression)
+
+	s, err := SerializeData(data, compression, CRC32)
+	c.Assert(err, IsNil)
+	env, err := DecodeEnvelope(s)
+	c.Assert(err, IsNil)
+	c.Assert(env.Version, Equals, CurrentEnvelope)
+	c.Assert(env.Checksum, Equals, Checksum(CRC32))
+	c.Assert(env.Size, Equals, 2)
+
+	// Legacy serializations have a single format byte.
+	legacy := append([]byte{byte(EncodeSerializationFormat(compression, NoChecksum))}, data...)
+	env, err = DecodeEnvelope(legacy)
+	c.Assert(err, IsNil)
+	c.Assert(env.Version, Equals, LegacyEnvelope)
+	c.Assert(env.Size, Equals, 1)
+	out, _, err := DeserializeData(legacy, true)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, string(data))
+
+	var buf bytes.Buffer
+	_, err = DeserializeFromReader(bytes.NewReader(legacy), &buf)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, string(data))
+
+	migrated, err := MigrateEnvelope(legacy)
+	c.Assert(err, IsNil)
+	env, err = DecodeEnvelope(migrated)
+	c.Assert(err, IsNil)
+	c.Assert(env.Version, Equals, CurrentEnvelope)
+	out, _, err = DeserializeData(migrated, true)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, string(data))
+
+	// Unregistered envelope versions can't be read until a decoder is registered.
+	unknown := []byte{byte(EncodeSerializationFormat(compression, NoChecksum)) | envelopeFlag, 200, 0xFF}
+	_, err = DecodeEnvelope(unknown)
+	c.Assert(err, NotNil)
+	c.Assert(RegisterEnvelope(EnvelopeV1, 2, decodeEnvelopeV1), NotNil)
+	err = RegisterEnvelope(200, 3, func(header []byte) (Envelope, error) {
+		return Envelope{Compression: Uncompressed, Checksum: NoChecksum}, nil
+	})
+	c.Assert(err, IsNil)
+	out, _, err = DeserializeData(append(unknown, data...), true)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, string(data))
+}
+
+func (suite *DataSuite) TestSerializeWith(c *C) {
+	type Metadata struct {
+		Name  string
+		Sizes []int
+	}
+	obj := Metadata{"grayscale", []int{32, 32, 32}}
+	compression, _ := NewCompression(Uncompressed, DefaultCompression)
+	for _, encoding := range []ObjectEncoding{GobEncoding, JSONEncoding} {
+		s, err := SerializeWith(obj, encoding, compression, CRC32)
+		c.Assert(err, IsNil)
+		var obj2 Metadata
+		c.Assert(Deserialize(s, &obj2), IsNil)
+		c.Assert(obj2, DeepEquals, obj)
+	}
+
+	// JSON serializations should hold plain JSON after the envelope and checksum.
+	s, err := SerializeWith(obj, JSONEncoding, compression, NoChecksum)
+	c.Assert(err, IsNil)
+	env, err := DecodeEnvelope(s)
+	c.Assert(err, IsNil)
+	c.Assert(env.Encoding, Equals, JSONEncoding)
+	c.Assert(string(s[env.Size:]), Equals, `{"Name":"grayscale","Sizes":[32,32,32]}`)
+}
+
+func (suite *DataSuite) TestFramedCompression(c *C) {
+	oldSize, oldChunkSize := ParallelCompressionSize, ParallelChunkSize
+	ParallelCompressionSize, ParallelChunkSize = 10000, 3000
+	defer func() {
+		ParallelCompressionSize, ParallelChunkSize = oldSize, oldChunkSize
+	}()
+
+	data := make([]byte, 10001)
+	for i := range data {
+		data[i] = byte(i % 13)
+	}
+	for _, format := range []CompressionFormat{Snappy, LZ4, Gzip} {
+		compression, err := NewCompression(format, DefaultCompression)
+		c.Assert(err, IsNil)
+		s, err := SerializeData(data, compression, CRC32)
+		c.Assert(err, IsNil)
+		out, gotFormat, err := DeserializeData(s, true)
+		c.Assert(err, IsNil)
+		c.Assert(gotFormat, Equals, CompressionFormat(Framed))
+		c.Assert(bytes.Equal(out, data), Equals, true)
+
+		var buf bytes.Buffer
+		c.Assert(SerializeToWriter(&buf, data, compression, CRC32), IsNil)
+		c.Assert(buf.Bytes(), DeepEquals, s)
+		var outBuf bytes.Buffer
+		_, err = DeserializeFromReader(bytes.NewReader(s), &outBuf)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(outBuf.Bytes(), data), Equals, true)
+	}
+
+	// Data smaller than ParallelCompressionSize should not be framed.
+	compression, _ := NewCompression(Gzip, DefaultCompression)
+	s, err := SerializeData(data[:9999], compression, NoChecksum)
+	c.Assert(err, IsNil)
+	_, gotFormat, err := DeserializeData(s, true)
+	c.Assert(err, IsNil)
+	c.Assert(gotFormat, Equals, CompressionFormat(Gzip))
+}
+
+func (suite *DataSuite) TestFramedHeaderSize(c *C) {
+	// A header claiming far more data than its chunks can hold is refused before
+	// anything is allocated for it.
+	numChunks := 1024
+	framed := make([]byte, frameHeaderSize+4*numChunks)
+	framed[0] = byte(Gzip)
+	binary.LittleEndian.PutUint32(framed[1:5], 1<<30)
+	binary.LittleEndian.PutUint64(framed[5:13], 1<<40)
+	binary.LittleEndian.PutUint32(framed[13:17], uint32(numChunks))
+	_, err := uncompressFramed(framed)
+	c.Assert(err, ErrorMatches, "Compressed data of .* bytes cannot expand to .*")
+}
+
+func (suite *DataSuite) TestCompressedSizeHints(c *C) {
+	data := bytes.Repeat([]byte("size hints "), 100)
+
+	// A corrupt gzip trailer is not trusted for the allocation and fails the size check.
+	compression, _ := NewCompression(Gzip, DefaultCompression)
+	cdata, release, err := compressBytes(data, compression)
+	c.Assert(err, IsNil)
+	cdata = append([]byte{}, cdata...)
+	release()
+	binary.LittleEndian.PutUint32(cdata[len(cdata)-4:], 0xFFFFFFFF)
+	_, err = uncompressBytes(cdata, Gzip)
+	c.Assert(err, NotNil)
+
+	// An LZ4 header claiming more than the data can hold is refused.
+	lz4data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(lz4data[0:4], 0xFFFFFFFF)
+	_, err = uncompressBytes(lz4data, LZ4)
+	c.Assert(err, ErrorMatches, "Compressed data of 8 bytes cannot expand to .*")
+}
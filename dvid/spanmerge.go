@@ -0,0 +1,124 @@
+/*
+	This file supports merging the spans of index iterators into fewer, larger key
+	ranges, which reduces the number of range queries sent to storage engines.
+*/
+
+package dvid
+
+import (
+	"bytes"
+)
+
+// SpanMergingIterator is an IndexIterator that merges consecutive spans of another
+// iterator into one span whenever no chunk within given bounds, e.g., the extents of
+// stored chunks, can have a key between them.  A request that covers whole rows of the
+// bounds then needs a single range query per contiguous block of rows rather than one
+// per row.  The merged spans may include keys of chunks outside the original spans'
+// region but only for chunks outside the bounds.
+type SpanMergingIterator struct {
+	it       IndexIterator
+	min, max ChunkPoint3d
+	beg, end Index
+	err      error
+	valid    bool
+}
+
+// NewSpanMergingIterator returns an iterator that merges the spans of an iterator
+// given inclusive chunk bounds.  Iterators whose spans are not runs along x, e.g.,
+// Hilbert iterators, are returned unchanged.
+func NewSpanMergingIterator(it IndexIterator, min, max ChunkPoint3d) IndexIterator {
+	if _, ok := it.(IndexSpanLister); ok {
+		return it
+	}
+	merger := &SpanMergingIterator{it: it, min: min, max: max}
+	merger.merge()
+	return merger
+}
+
+// merge reads the next span and then absorbs following spans while they adjoin it.
+func (m *SpanMergingIterator) merge() {
+	m.valid = m.it.Valid()
+	if !m.valid {
+		return
+	}
+	m.beg, m.end, m.err = m.it.IndexSpan()
+	m.it.NextSpan()
+	if m.err != nil {
+		return
+	}
+	for m.it.Valid() {
+		beg, end, err := m.it.IndexSpan()
+		if err != nil || !m.adjoins(m.end, beg) {
+			return
+		}
+		m.end = end
+		m.it.NextSpan()
+	}
+}
+
+// emptyBetween returns true if no integer strictly between a and b is within [min, max].
+func emptyBetween(a, b, min, max int32) bool {
+	lo, hi := int64(a)+1, int64(b)-1
+	return lo > hi || hi < int64(min) || lo > int64(max)
+}
+
+func (m *SpanMergingIterator) rowInBounds(y, z int32) bool {
+	return y >= m.min[1] && y <= m.max[1] && z >= m.min[2] && z <= m.max[2]
+}
+
+// adjoins returns true if no chunk within the bounds has a key between the end of one
+// span and the beginning of the next.
+func (m *SpanMergingIterator) adjoins(end, beg Index) bool {
+	endIndexer, ok := end.(ChunkIndexer)
+	if !ok || endIndexer.NumDims() < 3 {
+		return false
+	}
+	begIndexer, ok := beg.(ChunkIndexer)
+	if !ok || begIndexer.NumDims() < 3 {
+		return false
+	}
+
+	// Spans must share any key prefix, e.g., a channel or time, before the ZYX bytes.
+	endBytes, begBytes := end.Bytes(), beg.Bytes()
+	if len(endBytes) != len(begBytes) || len(endBytes) < IndexZYXSize {
+		return false
+	}
+	prefix := len(endBytes) - IndexZYXSize
+	if !bytes.Equal(endBytes[:prefix], begBytes[:prefix]) {
+		return false
+	}
+
+	x1, y1, z1 := endIndexer.Value(0), endIndexer.Value(1), endIndexer.Value(2)
+	x2, y2, z2 := begIndexer.Value(0), begIndexer.Value(1), begIndexer.Value(2)
+	if z2 < z1 || (z2 == z1 && y2 <= y1) {
+		return false
+	}
+	if m.rowInBounds(y1, z1) && x1 < m.max[0] {
+		return false
+	}
+	if m.rowInBounds(y2, z2) && x2 > m.min[0] {
+		return false
+	}
+	if z1 == z2 {
+		return z1 < m.min[2] || z1 > m.max[2] || emptyBetween(y1, y2, m.min[1], m.max[1])
+	}
+	if z1 >= m.min[2] && z1 <= m.max[2] && y1 < m.max[1] {
+		return false
+	}
+	if z2 >= m.min[2] && z2 <= m.max[2] && y2 > m.min[1] {
+		return false
+	}
+	return emptyBetween(z1, z2, m.min[2], m.max[2])
+}
+
+func (m *SpanMergingIterator) Valid() bool {
+	return m.valid
+}
+
+func (m *SpanMergingIterator) IndexSpan() (beg, end Index, err error) {
+	return m.beg, m.end, m.err
+}
+
+func (m *SpanMergingIterator) NextSpan() {
+	m.merge()
+}
@@ -0,0 +1,54 @@
+package dvid
+
+import (
+	. "github.com/janelia-flyem/go/gocheck"
+	_ "testing"
+)
+
+func mergedSpans(c *C, it IndexIterator) (spans [][2]IndexZYX) {
+	for ; it.Valid(); it.NextSpan() {
+		beg, end, err := it.IndexSpan()
+		c.Assert(err, IsNil)
+		spans = append(spans, [2]IndexZYX{beg.(IndexZYX), end.(IndexZYX)})
+	}
+	return
+}
+
+func (suite *DataSuite) TestSpanMergingIterator(c *C) {
+	// Request covers whole rows of the stored bounds, so all spans merge into one.
+	minBound, maxBound := ChunkPoint3d{0, 0, 0}, ChunkPoint3d{9, 9, 9}
+	it := NewIndexZYXIterator(nil, ChunkPoint3d{-1, 0, 2}, ChunkPoint3d{9, 9, 4})
+	spans := mergedSpans(c, NewSpanMergingIterator(it, minBound, maxBound))
+	c.Assert(spans, DeepEquals, [][2]IndexZYX{{{-1, 0, 2}, {9, 9, 4}}})
+
+	// Whole rows but only part of each slab merge within slabs.
+	it = NewIndexZYXIterator(nil, ChunkPoint3d{0, 2, 2}, ChunkPoint3d{9, 4, 3})
+	spans = mergedSpans(c, NewSpanMergingIterator(it, minBound, maxBound))
+	c.Assert(spans, DeepEquals, [][2]IndexZYX{{{0, 2, 2}, {9, 4, 2}}, {{0, 2, 3}, {9, 4, 3}}})
+
+	// Partial rows cannot be merged.
+	it = NewIndexZYXIterator(nil, ChunkPoint3d{1, 0, 0}, ChunkPoint3d{9, 2, 0})
+	spans = mergedSpans(c, NewSpanMergingIterator(it, minBound, maxBound))
+	c.Assert(spans, HasLen, 3)
+
+	// Rows outside the bounds merge regardless of their x extent.
+	it = NewIndexZYXIterator(nil, ChunkPoint3d{3, 8, 9}, ChunkPoint3d{4, 12, 10})
+	spans = mergedSpans(c, NewSpanMergingIterator(it, minBound, maxBound))
+	c.Assert(spans, DeepEquals, [][2]IndexZYX{
+		{{3, 8, 9}, {4, 8, 9}},
+		{{3, 9, 9}, {4, 9, 9}},
+		{{3, 10, 9}, {4, 12, 10}},
+	})
+
+	// Spans at different time points never merge.
+	timed := NewIndexTZYXIterator(0, 1, nil, ChunkPoint3d{0, 0, 0}, ChunkPoint3d{9, 9, 9})
+	var numSpans int
+	for merged := NewSpanMergingIterator(timed, minBound, maxBound); merged.Valid(); merged.NextSpan() {
+		numSpans++
+	}
+	c.Assert(numSpans, Equals, 2)
+
+	// Hilbert iterators are not merged.
+	hilbert := NewIndexHilbertIterator(nil, ChunkPoint3d{0, 0, 0}, ChunkPoint3d{1, 1, 1})
+	c.Assert(NewSpanMergingIterator(hilbert, minBound, maxBound), Equals, IndexIterator(hilbert))
+}
@@ -233,6 +233,16 @@ func SendHTTP(w http.ResponseWriter, r *http.Request, name string, data []byte)
 	}
 }
 
+// PrecompressedHeader marks a response whose payload is already compressed, e.g., a JPEG
+// tile, so the server does not compress it again.  The header is not sent to clients.
+const PrecompressedHeader = "X-Dvid-Precompressed"
+
+// MarkCompressed marks the response as already compressed.  It must be called before
+// the response header is written.
+func MarkCompressed(w http.ResponseWriter) {
+	w.Header().Set(PrecompressedHeader, "true")
+}
+
 // SupportsGzipEncoding returns true if the http requestor can accept gzip encoding.
 func SupportsGzipEncoding(r *http.Request) bool {
 	for _, v1 := range r.Header["Accept-Encoding"] {
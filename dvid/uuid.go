@@ -0,0 +1,120 @@
+/*
+	This file supports configurable strategies for generating the UUIDs of version nodes.
+*/
+
+package dvid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/go/go-uuid/uuid"
+)
+
+// UUIDGenerator returns a new UUID or an empty UUID on failure.
+type UUIDGenerator func() UUID
+
+// MaxSitePrefixBytes is the maximum number of bytes in a site prefix.
+const MaxSitePrefixBytes = 4
+
+var uuidGenerator = struct {
+	sync.RWMutex
+	gen UUIDGenerator
+}{gen: NewUUIDv1}
+
+// SetUUIDGenerator sets the strategy used by NewUUID.
+func SetUUIDGenerator(gen UUIDGenerator) {
+	uuidGenerator.Lock()
+	uuidGenerator.gen = gen
+	uuidGenerator.Unlock()
+}
+
+// UUIDGeneratorFromString returns a UUID generation strategy given its description:
+//
+//	v1            Time and node-based (RFC 4122 version 1).  The default.
+//	v4            Random (RFC 4122 version 4).
+//	v7            Time-ordered with millisecond Unix time then random bits (version 7),
+//	                so UUIDs sort chronologically.
+//	site:<hex>    Site-prefixed, where the given 1 to 4 byte hex prefix is followed by
+//	                the millisecond Unix time and random bits.  Sites of a federation
+//	                with unique prefixes cannot collide, and each site's UUIDs sort
+//	                chronologically.
+func UUIDGeneratorFromString(s string) (UUIDGenerator, error) {
+	strategy := strings.ToLower(s)
+	switch {
+	case strategy == "" || strategy == "v1":
+		return NewUUIDv1, nil
+	case strategy == "v4":
+		return NewUUIDv4, nil
+	case strategy == "v7":
+		return NewUUIDv7, nil
+	case strings.HasPrefix(strategy, "site:"):
+		prefix, err := hex.DecodeString(strategy[5:])
+		if err != nil {
+			return nil, fmt.Errorf("Illegal site prefix '%s': %s", strategy[5:], err.Error())
+		}
+		if len(prefix) == 0 || len(prefix) > MaxSitePrefixBytes {
+			return nil, fmt.Errorf("Site prefix must be 1 to %d bytes, not %d", MaxSitePrefixBytes, len(prefix))
+		}
+		return func() UUID { return newSiteUUID(prefix) }, nil
+	default:
+		return nil, fmt.Errorf("Unknown UUID generation strategy '%s'", s)
+	}
+}
+
+func formatUUID(u []byte) UUID {
+	if len(u) != 16 {
+		return UUID("")
+	}
+	return UUID(fmt.Sprintf("%032x", u))
+}
+
+// NewUUIDv1 returns a time and node-based UUID.
+func NewUUIDv1() UUID {
+	return formatUUID(uuid.NewUUID())
+}
+
+// NewUUIDv4 returns a random UUID.
+func NewUUIDv4() UUID {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u); err != nil {
+		return UUID("")
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return formatUUID(u)
+}
+
+// NewUUIDv7 returns a time-ordered UUID.
+func NewUUIDv7() UUID {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u[6:]); err != nil {
+		return UUID("")
+	}
+	putMillis(u[0:6])
+	u[6] = (u[6] & 0x0f) | 0x70 // version 7
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return formatUUID(u)
+}
+
+func newSiteUUID(prefix []byte) UUID {
+	u := make([]byte, 16)
+	n := copy(u, prefix)
+	putMillis(u[n : n+6])
+	if _, err := rand.Read(u[n+6:]); err != nil {
+		return UUID("")
+	}
+	return formatUUID(u)
+}
+
+// putMillis writes the current Unix time in milliseconds as a 48-bit big-endian integer.
+func putMillis(b []byte) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(b, buf[2:])
+}
@@ -0,0 +1,178 @@
+/*
+	This file supports the access log, which records each HTTP and RPC request as one
+	JSON object per line with its user, dataset, data instance, operation, bytes,
+	duration, and outcome.  The log is stored in the datastore directory and rotated
+	like the error and audit logs.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// The name of the access log, stored in the datastore directory.
+const AccessLogFilename = "dvid-access.log"
+
+var (
+	// LogMaxBytes is the size at which the error, audit, and access logs are rotated.
+	// If 0, logs are not rotated.
+	LogMaxBytes int64 = 100 * dvid.Mega
+
+	// LogBackups is the number of rotated files kept for each log.
+	LogBackups = 5
+)
+
+// AccessRecord is the access log entry for a request.  Status is the HTTP status of
+// HTTP requests, and Error holds the error message of failed requests.
+type AccessRecord struct {
+	Time       time.Time
+	Protocol   string
+	User       string `json:",omitempty"`
+	Remote     string `json:",omitempty"`
+	Method     string `json:",omitempty"`
+	Path       string `json:",omitempty"`
+	Dataset    string `json:",omitempty"`
+	Instance   string `json:",omitempty"`
+	Operation  string `json:",omitempty"`
+	BytesIn    int64
+	BytesOut   int64
+	DurationMs float64
+	Status     int    `json:",omitempty"`
+	Error      string `json:",omitempty"`
+}
+
+// accessLog writes the access log or is nil if the log has not been opened.
+var (
+	accessLog     *dvid.RotatingFile
+	accessLogLock sync.Mutex
+)
+
+// openLog opens a rotating log file in the given directory.
+func openLog(dir, filename string) (*dvid.RotatingFile, error) {
+	return dvid.OpenRotatingFile(filepath.Join(dir, filename), LogMaxBytes, LogBackups)
+}
+
+// openAccessLog opens the access log in the given directory for appending.
+func openAccessLog(dir string) error {
+	f, err := openLog(dir, AccessLogFilename)
+	if err != nil {
+		return err
+	}
+	accessLogLock.Lock()
+	accessLog = f
+	accessLogLock.Unlock()
+	return nil
+}
+
+// logAccess appends a record to the access log.
+func logAccess(record *AccessRecord) {
+	accessLogLock.Lock()
+	f := accessLog
+	accessLogLock.Unlock()
+	if f == nil {
+		return
+	}
+	m, err := json.Marshal(record)
+	if err != nil {
+		dvid.Error("Unable to encode access log record: %s", err.Error())
+		return
+	}
+	if _, err := f.Write(append(m, '\n')); err != nil {
+		dvid.Error("Unable to write access log: %s", err.Error())
+	}
+}
+
+// describePath returns the dataset node, data instance, and operation of an API path.
+func describePath(path string) (dataset, instance, operation string) {
+	parts := strings.Split(strings.TrimPrefix(path, WebAPIPath), "/")
+	part := func(i int) string {
+		if i < len(parts) {
+			return parts[i]
+		}
+		return ""
+	}
+	switch parts[0] {
+	case "node":
+		if _, found := nodeCommands[part(2)]; found || part(2) == "" {
+			return part(1), "", part(2)
+		}
+		return part(1), part(2), part(3)
+	case "dataset":
+		if datasetCommands[part(2)] || part(2) == "acl" || part(2) == "" {
+			return part(1), "", part(2)
+		}
+		return part(1), part(2), part(3)
+	}
+	return "", "", parts[0]
+}
+
+// accessLogHandler wraps an HTTP handler so each request is recorded in the access log.
+func accessLogHandler(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		counter := &countingWriter{ResponseWriter: w}
+		handler(counter, r)
+		record := &AccessRecord{
+			Time:       start,
+			Protocol:   "http",
+			User:       r.Header.Get(UserHeader),
+			Remote:     r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			BytesOut:   counter.written,
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+			Status:     counter.status,
+		}
+		if r.ContentLength > 0 {
+			record.BytesIn = r.ContentLength
+		}
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		if record.Status >= 400 {
+			record.Error = strings.TrimSpace(string(counter.errorText))
+		}
+		record.Dataset, record.Instance, record.Operation = describePath(r.URL.Path)
+		logAccess(record)
+	}
+}
+
+// logRPCAccess records an RPC command in the access log.
+func logRPCAccess(cmd datastore.Request, reply *datastore.Response, start time.Time, err error) {
+	user, _ := cmd.Setting("user")
+	record := &AccessRecord{
+		Time:       start,
+		Protocol:   "rpc",
+		User:       user,
+		BytesIn:    int64(len(cmd.Input)),
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if reply != nil {
+		record.BytesOut = int64(len(reply.Text) + len(reply.Output))
+	}
+	switch cmd.Name() {
+	case "dataset", "node":
+		record.Dataset, record.Instance = cmd.Argument(1), cmd.Argument(2)
+		record.Operation = cmd.Name() + " " + cmd.Argument(3)
+		_, nodeCommand := nodeCommands[cmd.Argument(2)]
+		if (cmd.Name() == "node" && nodeCommand) || (cmd.Name() == "dataset" && datasetCommands[cmd.Argument(2)]) {
+			record.Instance = ""
+			record.Operation = cmd.Name() + " " + cmd.Argument(2)
+		}
+	default:
+		record.Operation = strings.TrimSpace(cmd.Name() + " " + cmd.Argument(1))
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	logAccess(record)
+}
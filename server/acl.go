@@ -0,0 +1,456 @@
+/*
+	This file enforces the ACLs of datasets and data for HTTP and RPC requests, and
+	supports their management.  If authentication is required, only admin tokens can
+	change ACLs and groups, and admin tokens are not limited by ACLs.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// adminKey is the context key marking requests authenticated by an admin token.
+type adminKey struct{}
+
+// withAdmin returns the request marked by whether it was authenticated by an admin token.
+func withAdmin(r *http.Request, admin bool) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminKey{}, admin))
+}
+
+// isAdmin returns true if the request was authenticated by an admin token.
+func isAdmin(r *http.Request) bool {
+	admin, _ := r.Context().Value(adminKey{}).(bool)
+	return admin
+}
+
+// readMethod returns true for HTTP methods that do not modify data.
+func readMethod(method string) bool {
+	switch strings.ToLower(method) {
+	case "get", "head", "options":
+		return true
+	}
+	return false
+}
+
+// datasetCommands are the dataset requests that are not addressed to data.
+var datasetCommands = map[string]bool{
+	"info":     true,
+	"webhooks": true,
+	"uuids":    true,
+	"dag":      true,
+	"new":      true,
+	"scratch":  true,
+	"profile":  true,
+	"trash":    true,
+	"restore":  true,
+}
+
+// nodeCommands are the node requests that are not addressed to data, mapped to true
+// if they modify the dataset whatever their HTTP method.
+var nodeCommands = map[string]bool{
+	"lock":        true,
+	"commit":      true,
+	"branch":      true,
+	"newversion":  true,
+	"merge":       true,
+	"fork":        true,
+	"parents":     false,
+	"children":    false,
+	"ancestors":   false,
+	"lca":         false,
+	"permissions": false,
+}
+
+// rpcDatasetWrites are the dataset commands that modify a dataset.
+var rpcDatasetWrites = map[string]bool{
+	"new":     true,
+	"delete":  true,
+	"restore": true,
+	"webhook": true,
+	"convert": true,
+}
+
+// rpcNodeWrites are the node commands that modify a dataset.
+var rpcNodeWrites = map[string]bool{
+	"lock":       true,
+	"commit":     true,
+	"abandon":    true,
+	"branch":     true,
+	"newversion": true,
+	"merge":      true,
+	"fork":       true,
+	"restrict":   true,
+	"unrestrict": true,
+}
+
+// rpcAdminCommands are the RPC commands that, like admin HTTP requests, need an admin
+// token if authentication is required.
+var rpcAdminCommands = map[string]bool{
+	"shutdown":   true,
+	"gc":         true,
+	"compact":    true,
+	"verify":     true,
+	"backup":     true,
+	"restore":    true,
+	"export":     true,
+	"import":     true,
+	"clone":      true,
+	"clone-data": true,
+	"checkout":   true,
+	"push":       true,
+	"pull":       true,
+	"migrate":    true,
+	"stats":      true,
+}
+
+// rpcDataReads are the data commands handled by the server that do not modify data.
+var rpcDataReads = map[string]bool{
+	"help":       true,
+	"verify":     true,
+	"changelog":  true,
+	"diff":       true,
+	"provenance": true,
+}
+
+// CheckAccess returns an error if the user may not read, or write if write is true,
+// the dataset with the node of the given UUID or, if dataname is not empty, the named
+// data.  Access errors are of type *datastore.AccessError.
+func CheckAccess(uuid dvid.UUID, dataname dvid.DataString, user string, write bool) error {
+	if runningService.Service == nil {
+		return fmt.Errorf("Datastore service has not been started on this server.")
+	}
+	return runningService.Service.CheckAccess(uuid, dataname, user, write)
+}
+
+// checkAccess replies with an error and returns false if the user of a request may not
+// access the dataset with the node of the given UUID or the named data.
+func checkAccess(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, dataname dvid.DataString, write bool) bool {
+	if isAdmin(r) {
+		return true
+	}
+	err := CheckAccess(uuid, dataname, r.Header.Get(UserHeader), write)
+	if _, denied := err.(*datastore.AccessError); denied {
+		errorMsg := fmt.Sprintf("ERROR using REST API: %s (%s).\n", err.Error(), r.URL.Path)
+		dvid.Log(dvid.Normal, errorMsg)
+		http.Error(w, errorMsg, http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return false
+	}
+	return true
+}
+
+// checkDatasetAccess checks the access of a dataset request given the URL parts after
+// "dataset".
+func checkDatasetAccess(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) bool {
+	var dataname dvid.DataString
+	if !datasetCommands[parts[1]] {
+		dataname = dvid.DataString(parts[1])
+	}
+	return checkAccess(w, r, uuid, dataname, !readMethod(r.Method))
+}
+
+// checkNodeAccess checks the access of a node request given the URL parts after "node".
+func checkNodeAccess(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) bool {
+	write, found := nodeCommands[parts[1]]
+	if found {
+		return checkAccess(w, r, uuid, "", write || !readMethod(r.Method))
+	}
+	return checkAccess(w, r, uuid, dvid.DataString(parts[1]), !readMethod(r.Method))
+}
+
+// checkRPCAccess returns an error if the user of an RPC command may not access the
+// dataset with the node of the given UUID or the named data.  Commands authenticated
+// by admin tokens are not limited.
+func checkRPCAccess(token *datastore.AuthToken, user string, uuid dvid.UUID, dataname dvid.DataString, write bool) error {
+	if token != nil && token.Admin {
+		return nil
+	}
+	return CheckAccess(uuid, dataname, user, write)
+}
+
+// checkRPCDatasetAccess checks the access of a dataset command.
+func checkRPCDatasetAccess(cmd datastore.Request, token *datastore.AuthToken, user string, uuid dvid.UUID) error {
+	subcommand := cmd.Argument(2)
+	switch {
+	case subcommand == "delete" || subcommand == "restore":
+		return checkRPCAccess(token, user, uuid, dvid.DataString(cmd.Argument(3)), true)
+	case subcommand == "scratch":
+		return checkRPCAccess(token, user, uuid, "", cmd.Argument(3) != "")
+	case subcommand == "acl":
+		// ACL commands check access themselves.
+		return nil
+	default:
+		return checkRPCAccess(token, user, uuid, "", rpcDatasetWrites[subcommand])
+	}
+}
+
+// checkRPCNodeAccess checks the access of a node command.
+func checkRPCNodeAccess(cmd datastore.Request, token *datastore.AuthToken, user string, uuid dvid.UUID) error {
+	descriptor := cmd.Argument(2)
+	switch descriptor {
+	case "lock", "commit", "abandon", "branch", "newversion", "merge", "fork", "restrict", "unrestrict",
+		"permissions":
+		return checkRPCAccess(token, user, uuid, "", rpcNodeWrites[descriptor])
+	}
+	subcommand := cmd.Argument(3)
+	write := !rpcDataReads[subcommand] && !readOnlyRPC[cmd.TypeCommand()]
+	return checkRPCAccess(token, user, uuid, dvid.DataString(descriptor), write)
+}
+
+// checkRPCAdmin returns an error if an RPC command needs an admin token and the command
+// was authenticated by a token without admin rights.
+func checkRPCAdmin(cmd datastore.Request, token *datastore.AuthToken) error {
+	if rpcAdminCommands[cmd.Name()] && token != nil && !token.Admin {
+		return fmt.Errorf("Command %q can only be run with an admin token", cmd.Name())
+	}
+	return nil
+}
+
+// rpcWrite returns true if an RPC command may modify data.
+func rpcWrite(cmd datastore.Request) bool {
+	switch cmd.Name() {
+	case "help", "about", "types", "remotes", "jobs", "job", "stats", "tokens", "groups", "migrate":
+		return false
+	case "datasets":
+		return cmd.Argument(1) == "new"
+	case "dataset":
+		subcommand := cmd.Argument(2)
+		if subcommand == "acl" {
+			return cmd.Argument(3) == "set" || cmd.Argument(3) == "clear"
+		}
+		return rpcDatasetWrites[subcommand] || (subcommand == "scratch" && cmd.Argument(3) != "")
+	case "node":
+		descriptor := cmd.Argument(2)
+		if write, found := rpcNodeWrites[descriptor]; found {
+			return write
+		}
+		if descriptor == "permissions" {
+			return false
+		}
+		return !rpcDataReads[cmd.Argument(3)] && !readOnlyRPC[cmd.TypeCommand()]
+	default:
+		return true
+	}
+}
+
+// checkReadOnly returns an error if an RPC command may modify data while a key
+// migration refuses modifications.
+func checkReadOnly(cmd datastore.Request) error {
+	if datastore.KeysReadOnly() && rpcWrite(cmd) {
+		return fmt.Errorf("Command %q cannot be run while data keys are migrated", cmd.Name())
+	}
+	return nil
+}
+
+// datasetsJSON returns the JSON of all datasets, if all is true, else the list of
+// datasets, limited to the datasets the user may read unless admin is true.
+func datasetsJSON(all, admin bool, user string) (string, error) {
+	switch {
+	case all && admin:
+		return runningService.DatasetsAllJSON()
+	case all:
+		return runningService.ReadableDatasetsAllJSON(user)
+	case admin:
+		return runningService.DatasetsListJSON()
+	default:
+		return runningService.ReadableDatasetsListJSON(user)
+	}
+}
+
+// newDataset creates a dataset and returns the UUID of its root node.  If authentication
+// is required and the creator is not an admin, only the creator may write the dataset
+// until its ACL is changed.
+func newDataset(admin bool, user string) (dvid.UUID, error) {
+	root, _, err := runningService.NewDataset()
+	if err != nil {
+		return root, err
+	}
+	if AuthRequired && !admin && user != "" {
+		if err := runningService.SetACL(root, "", &datastore.ACL{Writers: []string{user}}); err != nil {
+			return root, err
+		}
+	}
+	return root, nil
+}
+
+// requireAdmin replies with an error and returns false if authentication is required
+// and the request was not authenticated by an admin token.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !AuthRequired || isAdmin(r) {
+		return true
+	}
+	errorMsg := fmt.Sprintf("ERROR using REST API: only admin tokens can make this request (%s).\n", r.URL.Path)
+	dvid.Log(dvid.Normal, errorMsg)
+	http.Error(w, errorMsg, http.StatusForbidden)
+	return false
+}
+
+// aclRequest handles the ACL of a dataset or of data given the URL parts after "acl".
+// The ACL is given as JSON, e.g., {"Readers": ["@lab"], "Writers": ["alice"]}.
+//
+//	GET    <api URL>/dataset/<UUID>/acl[/<data name>]
+//	PUT    <api URL>/dataset/<UUID>/acl[/<data name>]
+//	DELETE <api URL>/dataset/<UUID>/acl[/<data name>]
+func aclRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) {
+	var dataname dvid.DataString
+	if len(parts) > 0 {
+		dataname = dvid.DataString(parts[0])
+	}
+	switch strings.ToLower(r.Method) {
+	case "get":
+		if !checkAccess(w, r, uuid, dataname, false) {
+			return
+		}
+		jsonStr, err := runningService.ACLJSON(uuid, dataname)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, jsonStr)
+
+	case "put", "post":
+		if !requireAdmin(w, r) {
+			return
+		}
+		acl := new(datastore.ACL)
+		if err := json.NewDecoder(r.Body).Decode(acl); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Error decoding ACL JSON: %s", err.Error()))
+			return
+		}
+		if err := runningService.SetACL(uuid, dataname, acl); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "Set ACL of %s\n", aclTarget(uuid, dataname))
+
+	case "delete":
+		if !requireAdmin(w, r) {
+			return
+		}
+		if err := runningService.SetACL(uuid, dataname, nil); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "Removed ACL of %s\n", aclTarget(uuid, dataname))
+
+	default:
+		BadRequest(w, r, "ACLs are read with GET, set with PUT, and removed with DELETE")
+	}
+}
+
+// aclTarget describes the dataset or data of an ACL.
+func aclTarget(uuid dvid.UUID, dataname dvid.DataString) string {
+	if dataname == "" {
+		return fmt.Sprintf("dataset with node %s", uuid)
+	}
+	return fmt.Sprintf("data '%s' at node %s", dataname, uuid)
+}
+
+// groupsRequest handles the user groups that can be given in ACLs.
+//
+//	GET    <api URL>/server/groups
+//	PUT    <api URL>/server/groups/<name>   (JSON list of members)
+//	DELETE <api URL>/server/groups/<name>
+func groupsRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	action := strings.ToLower(r.Method)
+	switch {
+	case len(parts) == 0 && action == "get":
+		jsonStr, err := runningService.GroupsJSON()
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, jsonStr)
+
+	case len(parts) == 1 && (action == "put" || action == "post"):
+		if !requireAdmin(w, r) {
+			return
+		}
+		var members []string
+		if err := json.NewDecoder(r.Body).Decode(&members); err != nil || len(members) == 0 {
+			BadRequest(w, r, "Groups must be given a JSON list of members")
+			return
+		}
+		if err := runningService.SetGroup(parts[0], members); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "Set members of group %s\n", parts[0])
+
+	case len(parts) == 1 && action == "delete":
+		if !requireAdmin(w, r) {
+			return
+		}
+		if err := runningService.SetGroup(parts[0], nil); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "Deleted group %s\n", parts[0])
+
+	default:
+		BadRequest(w, r, "Groups are listed with GET, set with PUT, and deleted with DELETE "+
+			WebAPIPath+"server/groups/<name>")
+	}
+}
+
+// aclCommand handles the RPC commands managing the ACL of a dataset or data:
+//
+//	dataset <UUID> acl show [<data name>]
+//	dataset <UUID> acl set [<data name>] [readers=<name>,...] [writers=<name>,...]
+//	dataset <UUID> acl clear [<data name>]
+func aclCommand(cmd datastore.Request, token *datastore.AuthToken, user string, uuid dvid.UUID, reply *datastore.Response) error {
+	var action, name string
+	cmd.CommandArgs(3, &action, &name)
+	dataname := dvid.DataString(name)
+	if action != "show" && token != nil && !token.Admin {
+		return fmt.Errorf("ACLs can only be changed with an admin token")
+	}
+	switch action {
+	case "show":
+		if err := checkRPCAccess(token, user, uuid, dataname, false); err != nil {
+			return err
+		}
+		jsonStr, err := runningService.ACLJSON(uuid, dataname)
+		if err != nil {
+			return err
+		}
+		reply.Text = jsonStr
+	case "set":
+		acl := new(datastore.ACL)
+		if readers, _ := cmd.Setting("readers"); readers != "" {
+			acl.Readers = strings.Split(readers, ",")
+		}
+		if writers, _ := cmd.Setting("writers"); writers != "" {
+			acl.Writers = strings.Split(writers, ",")
+		}
+		if err := runningService.SetACL(uuid, dataname, acl); err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Set ACL of %s\n", aclTarget(uuid, dataname))
+	case "clear":
+		if err := runningService.SetACL(uuid, dataname, nil); err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Removed ACL of %s\n", aclTarget(uuid, dataname))
+	default:
+		return fmt.Errorf("Unknown ACL command %q: use 'show', 'set', or 'clear'", action)
+	}
+	return nil
+}
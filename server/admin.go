@@ -0,0 +1,170 @@
+/*
+	This file supports the admin API, which manages datasets and data instances over
+	HTTP with JSON so dashboards and scripts can administer a server without the dvid
+	command.  It is only served if authentication is required, and then only to admin
+	tokens.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// adminType describes a data type compiled into this DVID.
+type adminType struct {
+	Name    dvid.TypeString
+	Url     datastore.UrlString
+	Version string
+}
+
+// newInstance is the JSON body of a request creating a data instance.
+type newInstance struct {
+	Type   dvid.TypeString
+	Name   dvid.DataString
+	Config json.RawMessage
+}
+
+// adminRequest handles the admin API given the URL parts after "admin".
+//
+//	GET    <api URL>/admin/types
+//	POST   <api URL>/admin/datasets
+//	POST   <api URL>/admin/dataset/<UUID>/instances   ({"Type": ..., "Name": ..., "Config": {...}})
+//	PUT    <api URL>/admin/dataset/<UUID>/instances/<data name>/config   (JSON settings)
+//	DELETE <api URL>/admin/dataset/<UUID>/instances/<data name>
+func adminRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	if !AuthRequired {
+		errorMsg := fmt.Sprintf("ERROR using REST API: the admin API needs a server started with -auth (%s).\n",
+			r.URL.Path)
+		dvid.Log(dvid.Normal, errorMsg)
+		http.Error(w, errorMsg, http.StatusForbidden)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if len(parts) > 0 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) == 0 {
+		BadRequest(w, r, WebAPIPath+"admin/ must be followed with 'types', 'datasets', or 'dataset'")
+		return
+	}
+	action := strings.ToLower(r.Method)
+	switch {
+	case len(parts) == 1 && parts[0] == "types" && action == "get":
+		var types []adminType
+		for _, t := range datastore.CompiledTypes {
+			types = append(types, adminType{t.DatatypeName(), t.DatatypeUrl(), t.DatatypeVersion()})
+		}
+		sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+		writeAdminJSON(w, r, types)
+
+	case len(parts) == 1 && parts[0] == "datasets" && action == "post":
+		root, _, err := runningService.NewDataset()
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		writeAdminJSON(w, r, struct{ Root dvid.UUID }{root})
+
+	case len(parts) >= 3 && parts[0] == "dataset" && parts[2] == "instances":
+		uuid, err := MatchingUUID(parts[1])
+		if err != nil {
+			BadUUID(w, r, err)
+			return
+		}
+		adminInstanceRequest(w, r, uuid, parts[3:])
+
+	default:
+		BadRequest(w, r, fmt.Sprintf("Unsupported %s request to the admin API", r.Method))
+	}
+}
+
+// adminInstanceRequest handles the creation, configuration, and deletion of data
+// instances in the dataset with the given UUID.
+func adminInstanceRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) {
+	action := strings.ToLower(r.Method)
+	switch {
+	case len(parts) == 0 && action == "post":
+		var instance newInstance
+		if err := json.NewDecoder(r.Body).Decode(&instance); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Error decoding POSTed JSON for new data instance: %s", err.Error()))
+			return
+		}
+		if instance.Type == "" || instance.Name == "" {
+			BadRequest(w, r, "New data instances must be given a Type and Name")
+			return
+		}
+		config := dvid.NewConfig()
+		if len(instance.Config) != 0 {
+			if err := config.SetByJSON(bytes.NewReader(instance.Config)); err != nil {
+				BadRequest(w, r, err.Error())
+				return
+			}
+		}
+		if err := runningService.NewData(uuid, instance.Type, instance.Name, config); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		writeAdminJSON(w, r, map[string]string{
+			"result": fmt.Sprintf("Added %s [%s] to node %s", instance.Name, instance.Type, uuid),
+		})
+
+	case len(parts) == 2 && parts[1] == "config" && (action == "put" || action == "post"):
+		dataname := dvid.DataString(parts[0])
+		dataservice, err := runningService.DataServiceByUUID(uuid, dataname)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		var config dvid.Config
+		if err := config.SetByJSON(r.Body); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		// Only given settings change, so keep the versioning unless it is given.
+		if _, found, _ := config.GetString("versioned"); !found {
+			config.SetVersioned(dataservice.IsVersioned())
+		}
+		if err := runningService.ModifyData(uuid, dataname, config); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		writeAdminJSON(w, r, map[string]string{
+			"result": fmt.Sprintf("Modified configuration of %s", dataname),
+		})
+
+	case len(parts) == 1 && action == "delete":
+		dataname := dvid.DataString(parts[0])
+		if err := runningService.DeleteData(uuid, dataname); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		writeAdminJSON(w, r, map[string]string{
+			"result": fmt.Sprintf("Moved %s to trash", dataname),
+		})
+
+	default:
+		BadRequest(w, r, fmt.Sprintf("Unsupported %s request for data instances of dataset %s", r.Method, uuid))
+	}
+}
+
+// writeAdminJSON replies with the JSON encoding of a value.
+func writeAdminJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	m, err := json.Marshal(v)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
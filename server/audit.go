@@ -0,0 +1,77 @@
+/*
+	This file supports the audit log, which records the user of each RPC command, each
+	HTTP request that can modify a datastore, and each sign-in.  The log is stored in the
+	datastore directory and rotated like the error and access logs.
+*/
+
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// The name of the audit log, stored in the datastore directory.
+const AuditLogFilename = "dvid-audit.log"
+
+// auditLogger writes the audit log to auditLogFile or is nil if the log has not been
+// opened.
+var (
+	auditLogger  *log.Logger
+	auditLogFile *dvid.RotatingFile
+)
+
+// openAuditLog opens the audit log in the given directory for appending.
+func openAuditLog(dir string) error {
+	file, err := openLog(dir, AuditLogFilename)
+	if err != nil {
+		return err
+	}
+	auditLogFile = file
+	auditLogger = log.New(file, "", log.LstdFlags|log.LUTC)
+	return nil
+}
+
+// closeAuditLog closes the audit log.  Later events are not recorded.
+func closeAuditLog() {
+	if auditLogFile == nil {
+		return
+	}
+	if err := auditLogFile.Close(); err != nil {
+		log.Printf("Closing audit log: %s\n", err.Error())
+	}
+}
+
+// auditUser returns the name recorded for a user who may be unknown.
+func auditUser(user string) string {
+	if user == "" {
+		return "anonymous"
+	}
+	return user
+}
+
+// audit records an event by a user in the audit log.
+func audit(user, format string, args ...interface{}) {
+	if auditLogger == nil {
+		return
+	}
+	auditLogger.Printf("user=%s "+format, append([]interface{}{auditUser(user)}, args...)...)
+}
+
+// auditHTTP records an HTTP request that can modify the datastore.  Requests that only
+// read are not recorded.
+func auditHTTP(r *http.Request) {
+	switch strings.ToUpper(r.Method) {
+	case "GET", "HEAD", "OPTIONS":
+		return
+	}
+	audit(r.Header.Get(UserHeader), "http %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+}
+
+// auditRPC records an RPC command.
+func auditRPC(cmd dvid.Command, user string) {
+	audit(user, "rpc %s", strings.Join(cmd, " "))
+}
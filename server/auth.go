@@ -0,0 +1,252 @@
+/*
+	This file supports authentication of HTTP and RPC requests by bearer tokens.  If
+	authentication is required, every API request must carry a token issued by an admin
+	or through sign-in with an OIDC provider, and the token's user replaces any user or
+	author given in the request, e.g., for checks of write restrictions and commit
+	metadata.  Without authentication, users given in requests can't be verified, so
+	requests are checked against ACLs and write restrictions as the anonymous user.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// TokenEnv is the environment variable holding the token the dvid client sends with
+// RPC requests.
+const TokenEnv = "DVID_TOKEN"
+
+// AdminTokenFilename is the file, in the directory of the logs, holding the admin token
+// issued at the first authenticated startup.
+const AdminTokenFilename = "dvid-admin-token"
+
+// AuthRequired requires every HTTP API and RPC request to carry a valid token.
+var AuthRequired bool
+
+// authenticate returns the issued token for a secret, or nil if authentication is not
+// required.
+func authenticate(secret string) (*datastore.AuthToken, error) {
+	if !AuthRequired {
+		return nil, nil
+	}
+	if runningService.Service == nil {
+		return nil, fmt.Errorf("Datastore service has not been started on this server.")
+	}
+	return runningService.Authenticate(secret)
+}
+
+// requestToken returns the bearer token of an HTTP request from its Authorization
+// header or, for browsers, its session cookie or "token" query string.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if cookie, err := r.Cookie(SessionCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	return r.URL.Query().Get("token")
+}
+
+// unauthenticatedPath returns true for API paths that do not need a token: replication
+// requests, which are authenticated by the replication key, and sign-in and sign-out.
+func unauthenticatedPath(path string) bool {
+	for _, prefix := range []string{"replicate/", "login", "logout"} {
+		if strings.HasPrefix(path, WebAPIPath+prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authHandler wraps an HTTP handler so requests are authenticated before they are
+// dispatched.  Requests that can modify the datastore are recorded in the audit log.
+// The user header of requests without a token is discarded.
+func authHandler(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !AuthRequired || unauthenticatedPath(r.URL.Path) {
+			r.Header.Del(UserHeader)
+			auditHTTP(r)
+			handler(w, r)
+			return
+		}
+		token, err := authenticate(requestToken(r))
+		if err != nil {
+			errorMsg := fmt.Sprintf("ERROR authenticating request: %s (%s).\n", err.Error(), r.URL.Path)
+			dvid.Log(dvid.Normal, errorMsg)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dvid"`)
+			http.Error(w, errorMsg, http.StatusUnauthorized)
+			return
+		}
+		r.Header.Set(UserHeader, token.User)
+		r = withAdmin(r, token.Admin)
+		auditHTTP(r)
+		handler(w, r)
+	}
+}
+
+// withUser returns a command whose "user" and "author" settings are replaced by the
+// given user.
+func withUser(cmd dvid.Command, user string) dvid.Command {
+	replaced := dvid.Command{}
+	for _, arg := range cmd {
+		if !strings.HasPrefix(arg, "user=") && !strings.HasPrefix(arg, "author=") {
+			replaced = append(replaced, arg)
+		}
+	}
+	return append(replaced, "user="+user, "author="+user)
+}
+
+// withoutUser returns a command without "user" settings, which can't be verified
+// without authentication.
+func withoutUser(cmd dvid.Command) dvid.Command {
+	replaced := dvid.Command{}
+	for _, arg := range cmd {
+		if !strings.HasPrefix(arg, "user=") {
+			replaced = append(replaced, arg)
+		}
+	}
+	return replaced
+}
+
+// requestCommitInfo returns the author and log message of a commit or branch given in
+// the query string of a request.  If authentication is required, the author is the
+// authenticated user.
+func requestCommitInfo(r *http.Request) datastore.CommitInfo {
+	query := r.URL.Query()
+	info := datastore.CommitInfo{Author: query.Get("author"), Message: query.Get("message")}
+	if AuthRequired {
+		info.Author = r.Header.Get(UserHeader)
+	}
+	return info
+}
+
+// issueFirstAdminToken issues an admin token if authentication is required but no
+// admin token exists, so the server can be administered.  The token is only written to
+// a file readable by the server's user, never to the console.
+func issueFirstAdminToken() error {
+	if !AuthRequired {
+		return nil
+	}
+	numAdmin, err := runningService.NumAdminTokens()
+	if err != nil || numAdmin != 0 {
+		return err
+	}
+	secret, token, err := runningService.IssueToken("admin", true, 0, "Issued at first authenticated startup")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(runningService.ErrorLogDir, AdminTokenFilename)
+	os.Remove(filename)
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		_, err = fmt.Fprintln(file, secret)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		if revokeErr := runningService.RevokeToken(token.ID); revokeErr != nil {
+			dvid.Error("Unable to revoke admin token %s: %s", token.ID, revokeErr.Error())
+		}
+		return fmt.Errorf("Unable to write admin token to %s: %s", filename, err.Error())
+	}
+	fmt.Printf("Authentication is required but no admin token existed.  Issued admin token %s into %s.\n"+
+		"Use it to issue other tokens, then revoke it and delete the file.\n", token.ID, filename)
+	return nil
+}
+
+// errTokensNeedAuth is returned when tokens are managed on a server that does not
+// require authentication, where anyone could issue admin tokens that stay valid once
+// authentication is required.
+var errTokensNeedAuth = fmt.Errorf("Tokens can only be managed on a server started with -auth")
+
+// tokensRequest handles the token admin API.  It needs authentication to be required,
+// and only admin tokens can use it.
+//
+//	GET    <api URL>/server/tokens    (lists issued tokens)
+//	POST   <api URL>/server/tokens?user=<name>[&admin=true][&ttl=<duration>][&note=<text>]
+//	DELETE <api URL>/server/tokens/<token ID>
+func tokensRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	var token *datastore.AuthToken
+	err := errTokensNeedAuth
+	if AuthRequired {
+		token, err = authenticate(requestToken(r))
+	}
+	if err == nil && !token.Admin {
+		err = fmt.Errorf("Tokens can only be managed with an admin token")
+	}
+	if err != nil {
+		errorMsg := fmt.Sprintf("ERROR using REST API: %s (%s).\n", err.Error(), r.URL.Path)
+		dvid.Log(dvid.Normal, errorMsg)
+		http.Error(w, errorMsg, http.StatusForbidden)
+		return
+	}
+	action := strings.ToLower(r.Method)
+	switch {
+	case len(parts) == 0 && action == "get":
+		jsonStr, err := runningService.TokensJSON()
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, jsonStr)
+
+	case len(parts) == 0 && action == "post":
+		query := r.URL.Query()
+		var admin bool
+		if adminStr := query.Get("admin"); adminStr != "" {
+			var err error
+			if admin, err = strconv.ParseBool(adminStr); err != nil {
+				BadRequest(w, r, fmt.Sprintf("Illegal admin setting '%s'", adminStr))
+				return
+			}
+		}
+		var ttl time.Duration
+		if ttlStr := query.Get("ttl"); ttlStr != "" {
+			var err error
+			if ttl, err = time.ParseDuration(ttlStr); err != nil {
+				BadRequest(w, r, fmt.Sprintf("Illegal token ttl '%s': %s", ttlStr, err.Error()))
+				return
+			}
+		}
+		secret, token, err := runningService.IssueToken(query.Get("user"), admin, ttl, query.Get("note"))
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		m, err := json.Marshal(struct {
+			Token string
+			*datastore.AuthToken
+		}{secret, token})
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+
+	case len(parts) == 1 && action == "delete":
+		if err := runningService.RevokeToken(parts[0]); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "Revoked token %s\n", parts[0])
+
+	default:
+		BadRequest(w, r, "Tokens are listed with GET, issued with POST, and revoked with DELETE "+
+			WebAPIPath+"server/tokens/<token ID>")
+	}
+}
@@ -0,0 +1,275 @@
+/*
+	This file supports backups of a running server into a tar archive written to a new
+	file on the server, sent to a remote URL, or streamed to an HTTP client, and restores
+	from those archives.  Backups and restores run as jobs whose progress and limits can
+	be followed and changed like other jobs.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// backupClient sends backup archives to remote targets, which may take hours.
+var backupClient = &http.Client{}
+
+// remoteBackup sends what is written to it as the body of a PUT request.
+type remoteBackup struct {
+	url  string
+	pipe *io.PipeWriter
+	done chan error
+}
+
+// newRemoteBackup starts a PUT request to a URL whose body is written to the returned
+// remoteBackup.
+func newRemoteBackup(url string) (*remoteBackup, error) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("PUT", url, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	rb := &remoteBackup{url: url, pipe: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := backupClient.Do(req)
+		if err != nil {
+			pr.CloseWithError(err)
+			rb.done <- err
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			err = fmt.Errorf("Backup target %s returned status %s: %s", url, resp.Status,
+				strings.TrimSpace(string(msg)))
+			pr.CloseWithError(err)
+		}
+		rb.done <- err
+	}()
+	return rb, nil
+}
+
+func (rb *remoteBackup) Write(p []byte) (int, error) {
+	return rb.pipe.Write(p)
+}
+
+// finish ends the request body, aborting the request if the backup failed, and returns
+// any error in sending the backup.
+func (rb *remoteBackup) finish(backupErr error) error {
+	if backupErr != nil {
+		rb.pipe.CloseWithError(backupErr)
+		<-rb.done
+		return backupErr
+	}
+	rb.pipe.Close()
+	return <-rb.done
+}
+
+// Backup writes a backup archive of the selected datasets and data to a target, which
+// is either the path of a new file on the server or an http:// or https:// URL that
+// accepts the archive with PUT.  The backup runs as a job with the given limits.
+func Backup(target string, selection datastore.BackupSelection,
+	limits datastore.JobLimits) (*datastore.BackupManifest, error) {
+
+	if runningService.Service == nil {
+		return nil, fmt.Errorf("Datastore service has not been started on this server.")
+	}
+	job := datastore.StartJob("backup", "backup to "+target, limits)
+	defer job.Finish()
+
+	var manifest *datastore.BackupManifest
+	var err error
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		var rb *remoteBackup
+		if rb, err = newRemoteBackup(target); err == nil {
+			manifest, err = runningService.WriteBackup(rb, selection, job)
+			err = rb.finish(err)
+		}
+	} else {
+		var f *os.File
+		if f, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+			manifest, err = runningService.WriteBackup(f, selection, job)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(target)
+			}
+		}
+	}
+	job.SetResult(nil, err)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// backupSummary returns a description of a backup.
+func backupSummary(manifest *datastore.BackupManifest, target string) string {
+	var numData int
+	var numKeys, numBytes int64
+	for _, dataset := range manifest.Datasets {
+		numData += len(dataset.Data)
+		for _, data := range dataset.Data {
+			numKeys += data.Keys
+			numBytes += data.Bytes
+		}
+	}
+	text := fmt.Sprintf("Backed up %d datasets with %d data instances, %d keys, and %d bytes to %s\n",
+		len(manifest.Datasets), numData, numKeys, numBytes, target)
+	if !manifest.Snapshot {
+		text += "Storage engine does not support snapshots, so unlocked nodes may have changed during backup.\n"
+	}
+	return text
+}
+
+// backupSelection returns the selection of a backup from a UUID of a dataset and the
+// names of its data.  If uuidStr is empty, all datasets are selected.
+func backupSelection(uuidStr string, datanames []dvid.DataString) (datastore.BackupSelection, error) {
+	if uuidStr == "" {
+		if len(datanames) != 0 {
+			return nil, fmt.Errorf("Data can only be selected for backup along with a UUID")
+		}
+		return nil, nil
+	}
+	uuid, err := MatchingUUID(uuidStr)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.BackupSelection{uuid: datanames}, nil
+}
+
+// backupRequest handles GET <api URL>/backup[?uuid=<UUID>[&data=<name>,...]], which
+// streams a backup archive of all datasets or the selected dataset and data.
+func backupRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Backups must be requested with GET "+WebAPIPath+"backup")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	var datanames []dvid.DataString
+	if dataStr := query.Get("data"); dataStr != "" {
+		for _, name := range strings.Split(dataStr, ",") {
+			datanames = append(datanames, dvid.DataString(name))
+		}
+	}
+	selection, err := backupSelection(query.Get("uuid"), datanames)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	limits, err := datastore.JobLimitsFromConfig(queryConfig(r, "workers", "iorate"))
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	job := datastore.StartJob("backup", "backup to "+r.RemoteAddr, limits)
+	defer job.Finish()
+
+	filename := fmt.Sprintf("dvid-backup-%s.tar", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	_, err = runningService.WriteBackup(w, selection, job)
+	job.SetResult(nil, err)
+	if err != nil {
+		// The archive lacks its manifest, so restores will reject it.
+		dvid.Log(dvid.Normal, "Backup streamed to %s failed: %s\n", r.RemoteAddr, err.Error())
+	}
+}
+
+// Restore restores the selected datasets, data, and versions from a backup archive at
+// a path on the server.  The restore runs as a job with the given limits.
+func Restore(path string, selection datastore.RestoreSelection,
+	limits datastore.JobLimits) ([]datastore.RestoredDataset, error) {
+
+	if runningService.Service == nil {
+		return nil, fmt.Errorf("Datastore service has not been started on this server.")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	job := datastore.StartJob("restore", "restore from "+path, limits)
+	defer job.Finish()
+	restored, err := runningService.RestoreBackup(f, selection, job)
+	job.SetResult(restored, err)
+	return restored, err
+}
+
+// restoreSummary returns a description of a restore.
+func restoreSummary(restored []datastore.RestoredDataset, path string) string {
+	text := fmt.Sprintf("Restored %d datasets from %s\n", len(restored), path)
+	for _, dataset := range restored {
+		text += fmt.Sprintf("  %s: %d new nodes, %d key/value pairs\n", dataset.Root, dataset.Nodes, dataset.Keys)
+	}
+	return text
+}
+
+// restoreRequest handles POST <api URL>/restore[?uuid=<UUID>[&data=<name>,...][&subtree=true]],
+// which restores from a backup archive in the request body.  The archive is saved to a
+// temporary file since its manifest is at its end.
+func restoreRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) != "post" {
+		BadRequest(w, r, "Restores must be requested with POST "+WebAPIPath+"restore")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	selection := datastore.RestoreSelection{
+		Node:    query.Get("uuid"),
+		Subtree: query.Get("subtree") == "true",
+	}
+	if dataStr := query.Get("data"); dataStr != "" {
+		for _, name := range strings.Split(dataStr, ",") {
+			selection.Data = append(selection.Data, dvid.DataString(name))
+		}
+	}
+	limits, err := datastore.JobLimitsFromConfig(queryConfig(r, "workers", "iorate"))
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	f, err := ioutil.TempFile("", "dvid-restore-")
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		BadRequest(w, r, fmt.Sprintf("Unable to receive backup archive: %s", err.Error()))
+		return
+	}
+	restored, err := Restore(f.Name(), selection, limits)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	m, err := json.Marshal(restored)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
@@ -0,0 +1,208 @@
+/*
+	This file supports batched HTTP requests: a JSON list of API requests executed by the
+	server and answered in one response, so clients making many small queries, e.g.,
+	label lookups at points or keyvalue gets, avoid the overhead of a round trip each.
+	Each request of a batch is subject to the rate limits, concurrency cap and deadline
+	of a separate request.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// MaxBatchRequests is the maximum number of requests in a batch.
+var MaxBatchRequests = 1000
+
+// MaxBatchBytes is the maximum total size of the response bodies of a batch, which are
+// held in memory until the batch is answered.
+var MaxBatchBytes int64 = 256 * dvid.Mega
+
+// batchRequest is one request of a batch.  The body is given either as text or, for
+// binary data, base64 encoded.  The method defaults to GET.
+type batchRequest struct {
+	Method     string
+	Path       string
+	Body       string `json:",omitempty"`
+	BodyBase64 string `json:",omitempty"`
+}
+
+// batchResponse is the reply to one request of a batch.  Bodies that are valid UTF-8
+// are given as text and others are base64 encoded.
+type batchResponse struct {
+	Status      int
+	ContentType string `json:",omitempty"`
+	Body        string `json:",omitempty"`
+	BodyBase64  string `json:",omitempty"`
+}
+
+// errBatchTooLarge is returned by writes that would exceed the MaxBatchBytes of a batch.
+var errBatchTooLarge = fmt.Errorf("Batch responses exceed the maximum size")
+
+// responseRecorder captures the reply to a request of a batch.  Writes take bytes from
+// the remaining budget shared by the requests of the batch.
+type responseRecorder struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	budget   *int64
+	exceeded bool
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if atomic.AddInt64(rec.budget, -int64(len(b))) < 0 {
+		rec.exceeded = true
+		return 0, errBatchTooLarge
+	}
+	return rec.body.Write(b)
+}
+
+// batchTooLarge is the reply to a request of a batch whose responses exceed MaxBatchBytes.
+func batchTooLarge() batchResponse {
+	return batchResponse{Status: http.StatusRequestEntityTooLarge,
+		Body: fmt.Sprintf("Batch responses exceed the maximum of %d bytes", MaxBatchBytes)}
+}
+
+// serveBatchRequest executes one request of a batch with the headers and context,
+// including authentication, of the batch request.  The response body is limited to the
+// remaining bytes of the batch's budget.
+func serveBatchRequest(batch *http.Request, sub batchRequest, budget *int64) (reply batchResponse) {
+	defer func() {
+		if err := recover(); err != nil {
+			dvid.Error("Caught panic on batched request %s %s: %s", sub.Method, sub.Path, err)
+			reply = batchResponse{Status: http.StatusInternalServerError, Body: fmt.Sprintf("%s", err)}
+		}
+	}()
+	method := strings.ToUpper(sub.Method)
+	if method == "" {
+		method = "GET"
+	}
+	if !strings.HasPrefix(sub.Path, WebAPIPath) || strings.HasPrefix(sub.Path, WebAPIPath+"batch") {
+		return batchResponse{Status: http.StatusBadRequest,
+			Body: fmt.Sprintf("Batched request path must be in %s and not a batch: %s", WebAPIPath, sub.Path)}
+	}
+	body := []byte(sub.Body)
+	if sub.BodyBase64 != "" {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(sub.BodyBase64); err != nil {
+			return batchResponse{Status: http.StatusBadRequest,
+				Body: fmt.Sprintf("Bad base64 body for %s: %s", sub.Path, err.Error())}
+		}
+	}
+	r, err := http.NewRequestWithContext(batch.Context(), method, sub.Path, bytes.NewReader(body))
+	if err != nil {
+		return batchResponse{Status: http.StatusBadRequest, Body: err.Error()}
+	}
+	r.RemoteAddr = batch.RemoteAddr
+	for key, values := range batch.Header {
+		switch http.CanonicalHeaderKey(key) {
+		case "Content-Length", "Content-Type", "Content-Encoding", "If-None-Match":
+			continue
+		}
+		r.Header[key] = values
+	}
+	auditHTTP(r)
+
+	if atomic.LoadInt64(budget) < 0 {
+		return batchTooLarge()
+	}
+	rec := &responseRecorder{header: make(http.Header), budget: budget}
+	limitHandler(timeoutHandler(apiHandler))(rec, r)
+	if rec.exceeded {
+		return batchTooLarge()
+	}
+	reply = batchResponse{Status: rec.status, ContentType: rec.header.Get("Content-Type")}
+	if reply.Status == 0 {
+		reply.Status = http.StatusOK
+	}
+	if utf8.Valid(rec.body.Bytes()) {
+		reply.Body = rec.body.String()
+	} else {
+		reply.BodyBase64 = base64.StdEncoding.EncodeToString(rec.body.Bytes())
+	}
+	return reply
+}
+
+// batchHandler executes a POSTed JSON list of requests and replies with a JSON list of
+// their responses in the same order.  A batch of only reads is executed concurrently,
+// and a batch with any writes is executed in order.  Requests are answered with 413
+// once the response bodies of the batch total more than MaxBatchBytes.
+//
+//	POST <api URL>/batch   ([{"Method": "GET", "Path": "/api/node/<UUID>/<data name>/..."}, ...])
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) != "post" {
+		BadRequest(w, r, "Batch requests must be made with HTTP POST method")
+		return
+	}
+	var subs []batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&subs); err != nil {
+		BadRequest(w, r, fmt.Sprintf("Batch must be a JSON list of requests: %s", err.Error()))
+		return
+	}
+	if len(subs) > MaxBatchRequests {
+		BadRequest(w, r, fmt.Sprintf("Batch has %d requests, more than the maximum of %d",
+			len(subs), MaxBatchRequests))
+		return
+	}
+
+	workers := dvid.NumCPU
+	for _, sub := range subs {
+		if sub.Method != "" && !readMethod(sub.Method) {
+			workers = 1
+			break
+		}
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	replies := make([]batchResponse, len(subs))
+	budget := MaxBatchBytes
+	next := make(chan int)
+	wg := new(sync.WaitGroup)
+	for n := 0; n < workers && n < len(subs); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				replies[i] = serveBatchRequest(r, subs[i], &budget)
+			}
+		}()
+	}
+	for i := range subs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	m, err := json.Marshal(replies)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
@@ -0,0 +1,430 @@
+/*
+	This file supports benchmarking a running DVID server with reproducible workload
+	profiles whose results can be saved and compared across runs.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+const BenchHelpMessage = `
+Benchmark profiles send a reproducible workload to the DVID server's HTTP API:
+
+	dvid bench <profile> <UUID> <data name> [<setting>=<value>...]
+	dvid bench compare <baseline JSON> <results JSON> [threshold=<percent>]
+
+Profiles:
+
+%s
+Settings for all profiles:
+
+	requests      Number of requests (default %d).
+	concurrency   Number of concurrent requests (default %d).
+	seed          Random seed so runs are reproducible (default 1).
+	extent        Size of the volume in voxels for random offsets (default 1024_1024_512).
+	output        File for results.  Files ending in ".csv" have a row appended for
+	                each run.  Otherwise, JSON is written.  Default is standard output.
+
+The "compare" command reports relative changes between two JSON results and fails if
+any throughput or latency measure regresses more than the threshold (default %g%%).
+`
+
+const (
+	DefaultBenchRequests    = 100
+	DefaultBenchConcurrency = 4
+	DefaultBenchThreshold   = 10.0
+)
+
+// BenchWorkload holds the settings for a benchmark run.
+type BenchWorkload struct {
+	Address  string
+	UUID     string
+	DataName string
+	Extent   dvid.Point3d
+	Config   dvid.Config
+}
+
+func (w *BenchWorkload) url(endpoint string) string {
+	return fmt.Sprintf("http://%s%snode/%s/%s/%s", w.Address, WebAPIPath, w.UUID, w.DataName, endpoint)
+}
+
+// randomOffset returns a random offset where a box of the given size fits in the extent.
+func (w *BenchWorkload) randomOffset(rng *rand.Rand, size dvid.Point3d) dvid.Point3d {
+	var offset dvid.Point3d
+	for dim := 0; dim < 3; dim++ {
+		if span := w.Extent[dim] - size[dim]; span > 0 {
+			offset[dim] = rng.Int31n(span + 1)
+		}
+	}
+	return offset
+}
+
+func (w *BenchWorkload) getInt(key string, defaultValue int) (int, error) {
+	value, found, err := w.Config.GetInt(key)
+	if err != nil {
+		return 0, fmt.Errorf("Illegal benchmark setting '%s': %s", key, err.Error())
+	}
+	if !found {
+		return defaultValue, nil
+	}
+	return value, nil
+}
+
+// BenchProfile is a named workload that generates a sequence of HTTP requests.
+type BenchProfile struct {
+	Name        string
+	Description string
+
+	// NewRequest returns the next request of the workload using the random source.
+	NewRequest func(w *BenchWorkload, rng *rand.Rand) (*http.Request, error)
+}
+
+var benchProfiles = map[string]*BenchProfile{
+	"tile-serving": {
+		Name:        "tile-serving",
+		Description: "GET PNG XY slices at random offsets (size: tile width, default 512)",
+		NewRequest: func(w *BenchWorkload, rng *rand.Rand) (*http.Request, error) {
+			size, err := w.getInt("size", 512)
+			if err != nil {
+				return nil, err
+			}
+			offset := w.randomOffset(rng, dvid.Point3d{int32(size), int32(size), 1})
+			endpoint := fmt.Sprintf("raw/xy/%d_%d/%d_%d_%d/png", size, size, offset[0], offset[1], offset[2])
+			return http.NewRequest("GET", w.url(endpoint), nil)
+		},
+	},
+	"bulk-ingest": {
+		Name: "bulk-ingest",
+		Description: "POST random subvolumes at random offsets (size: cube width, default 64; " +
+			"voxelbytes: bytes per voxel, default 1)",
+		NewRequest: func(w *BenchWorkload, rng *rand.Rand) (*http.Request, error) {
+			size, err := w.getInt("size", 64)
+			if err != nil {
+				return nil, err
+			}
+			voxelBytes, err := w.getInt("voxelbytes", 1)
+			if err != nil {
+				return nil, err
+			}
+			offset := w.randomOffset(rng, dvid.Point3d{int32(size), int32(size), int32(size)})
+			data := make([]byte, size*size*size*voxelBytes)
+			for i := range data {
+				data[i] = byte(rng.Intn(256))
+			}
+			endpoint := fmt.Sprintf("raw/0_1_2/%d_%d_%d/%d_%d_%d", size, size, size,
+				offset[0], offset[1], offset[2])
+			return http.NewRequest("POST", w.url(endpoint), bytes.NewReader(data))
+		},
+	},
+	"sparsevol": {
+		Name:        "sparsevol",
+		Description: "GET sparse volumes of random labels (labels: range, default 1_1000)",
+		NewRequest: func(w *BenchWorkload, rng *rand.Rand) (*http.Request, error) {
+			labelRange, found, err := w.Config.GetString("labels")
+			if err != nil {
+				return nil, err
+			}
+			minLabel, maxLabel := uint64(1), uint64(1000)
+			if found {
+				parts := strings.Split(labelRange, "_")
+				if len(parts) != 2 {
+					return nil, fmt.Errorf("Label range should be <min>_<max>, not '%s'", labelRange)
+				}
+				if minLabel, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+					return nil, err
+				}
+				if maxLabel, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+					return nil, err
+				}
+				if maxLabel < minLabel {
+					return nil, fmt.Errorf("Label range %s has maximum less than minimum", labelRange)
+				}
+			}
+			label := minLabel + uint64(rng.Int63n(int64(maxLabel-minLabel+1)))
+			return http.NewRequest("GET", w.url(fmt.Sprintf("sparsevol/%d", label)), nil)
+		},
+	},
+}
+
+// BenchProfilesHelp returns a description of each benchmark profile.
+func BenchProfilesHelp() string {
+	names := make([]string, 0, len(benchProfiles))
+	for name, _ := range benchProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var text string
+	for _, name := range names {
+		text += fmt.Sprintf("\t%-13s %s\n", name, benchProfiles[name].Description)
+	}
+	return text
+}
+
+// BenchLatency summarizes request latencies in milliseconds.
+type BenchLatency struct {
+	Min, Mean, P50, P95, P99, Max float64
+}
+
+// BenchResult holds the measurements of one benchmark run.
+type BenchResult struct {
+	Profile     string
+	Server      string
+	Started     time.Time
+	Requests    int
+	Concurrency int
+	Seed        int64
+	Errors      int
+	Bytes       int64
+	Seconds     float64
+
+	RequestsPerSec float64
+	MBPerSec       float64
+	LatencyMs      BenchLatency
+}
+
+// percentile returns the p-th percentile of sorted durations in milliseconds.
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p / 100.0 * float64(len(sorted)-1))
+	return sorted[i].Seconds() * 1000.0
+}
+
+// RunBenchmark runs a named profile against the DVID server at the given HTTP address.
+func RunBenchmark(address, profileName, uuid, dataName string, config dvid.Config) (*BenchResult, error) {
+	profile, found := benchProfiles[profileName]
+	if !found {
+		return nil, fmt.Errorf("Unknown benchmark profile '%s'.  Profiles:\n%s", profileName, BenchProfilesHelp())
+	}
+	workload := &BenchWorkload{
+		Address:  address,
+		UUID:     uuid,
+		DataName: dataName,
+		Extent:   dvid.Point3d{1024, 1024, 512},
+		Config:   config,
+	}
+	if extentStr, found, err := config.GetString("extent"); err != nil {
+		return nil, err
+	} else if found {
+		pt, err := dvid.StringToPoint(extentStr, "_")
+		if err != nil {
+			return nil, fmt.Errorf("Illegal extent '%s': %s", extentStr, err.Error())
+		}
+		extent, ok := pt.(dvid.Point3d)
+		if !ok {
+			return nil, fmt.Errorf("Extent must be 3d, not '%s'", extentStr)
+		}
+		workload.Extent = extent
+	}
+	numRequests, err := workload.getInt("requests", DefaultBenchRequests)
+	if err != nil {
+		return nil, err
+	}
+	concurrency, err := workload.getInt("concurrency", DefaultBenchConcurrency)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := workload.getInt("seed", 1)
+	if err != nil {
+		return nil, err
+	}
+	if numRequests < 1 || concurrency < 1 {
+		return nil, fmt.Errorf("Benchmark requires at least 1 request and 1 concurrent request")
+	}
+
+	// Generate all requests up front so the workload is independent of timing.
+	rng := rand.New(rand.NewSource(int64(seed)))
+	requests := make([]*http.Request, numRequests)
+	for i := range requests {
+		if requests[i], err = profile.NewRequest(workload, rng); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &BenchResult{
+		Profile:     profileName,
+		Server:      address,
+		Started:     time.Now(),
+		Requests:    numRequests,
+		Concurrency: concurrency,
+		Seed:        int64(seed),
+	}
+	latencies := make([]time.Duration, numRequests)
+	next := make(chan int, numRequests)
+	for i := 0; i < numRequests; i++ {
+		next <- i
+	}
+	close(next)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for c := 0; c < concurrency; c++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				req := requests[i]
+				start := time.Now()
+				var n int64
+				resp, err := http.DefaultClient.Do(req)
+				if err == nil {
+					n, err = io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+					if err == nil && resp.StatusCode != http.StatusOK {
+						err = fmt.Errorf("status %s", resp.Status)
+					}
+				}
+				latencies[i] = time.Since(start)
+				if req.ContentLength > 0 {
+					n += req.ContentLength
+				}
+				mu.Lock()
+				result.Bytes += n
+				if err != nil {
+					result.Errors++
+					dvid.Log(dvid.Debug, "Benchmark request %s %s failed: %s\n", req.Method, req.URL, err.Error())
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	result.Seconds = time.Since(result.Started).Seconds()
+	result.RequestsPerSec = float64(numRequests) / result.Seconds
+	result.MBPerSec = float64(result.Bytes) / dvid.Mega / result.Seconds
+	sort.Sort(durations(latencies))
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	result.LatencyMs = BenchLatency{
+		Min:  percentile(latencies, 0),
+		Mean: total.Seconds() * 1000.0 / float64(numRequests),
+		P50:  percentile(latencies, 50),
+		P95:  percentile(latencies, 95),
+		P99:  percentile(latencies, 99),
+		Max:  percentile(latencies, 100),
+	}
+	return result, nil
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+var benchCSVHeader = []string{"profile", "server", "started", "requests", "concurrency", "seed",
+	"errors", "bytes", "seconds", "requests/sec", "MB/sec", "min ms", "mean ms", "p50 ms",
+	"p95 ms", "p99 ms", "max ms"}
+
+func (r *BenchResult) csvRecord() []string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	return []string{r.Profile, r.Server, r.Started.Format(time.RFC3339),
+		strconv.Itoa(r.Requests), strconv.Itoa(r.Concurrency), strconv.FormatInt(r.Seed, 10),
+		strconv.Itoa(r.Errors), strconv.FormatInt(r.Bytes, 10), f(r.Seconds),
+		f(r.RequestsPerSec), f(r.MBPerSec), f(r.LatencyMs.Min), f(r.LatencyMs.Mean),
+		f(r.LatencyMs.P50), f(r.LatencyMs.P95), f(r.LatencyMs.P99), f(r.LatencyMs.Max)}
+}
+
+// WriteBenchResult writes a result as JSON or, if the filename ends in ".csv", appends
+// a row to a CSV file, adding a header row if the file is new.  An empty filename
+// writes JSON to standard output.
+func WriteBenchResult(r *BenchResult, filename string) error {
+	if strings.ToLower(filepath.Ext(filename)) == ".csv" {
+		_, err := os.Stat(filename)
+		isNew := os.IsNotExist(err)
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w := csv.NewWriter(f)
+		if isNew {
+			w.Write(benchCSVHeader)
+		}
+		w.Write(r.csvRecord())
+		w.Flush()
+		return w.Error()
+	}
+	m, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	m = append(m, '\n')
+	if filename == "" {
+		_, err = os.Stdout.Write(m)
+		return err
+	}
+	return ioutil.WriteFile(filename, m, 0644)
+}
+
+// ReadBenchResult reads a JSON result written by WriteBenchResult.
+func ReadBenchResult(filename string) (*BenchResult, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := new(BenchResult)
+	if err = json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("Could not read benchmark results in %s: %s", filename, err.Error())
+	}
+	return r, nil
+}
+
+// CompareBenchResults returns a report of relative changes from a baseline result and
+// whether any throughput or latency measure regressed more than the threshold percent.
+func CompareBenchResults(baseline, current *BenchResult, threshold float64) (report string, regressed bool) {
+	report = fmt.Sprintf("Comparing %s benchmark of %s to baseline of %s:\n",
+		current.Profile, current.Started.Format(time.RFC3339), baseline.Started.Format(time.RFC3339))
+	if baseline.Profile != current.Profile || baseline.Requests != current.Requests ||
+		baseline.Concurrency != current.Concurrency || baseline.Seed != current.Seed {
+		report += "WARNING: runs used different profiles or settings and may not be comparable.\n"
+	}
+	measure := func(name string, old, cur float64, higherIsBetter bool) {
+		var change float64
+		if old != 0 {
+			change = 100.0 * (cur - old) / old
+		}
+		worse := change > threshold
+		if higherIsBetter {
+			worse = change < -threshold
+		}
+		status := ""
+		if worse {
+			status = "  REGRESSION"
+			regressed = true
+		}
+		report += fmt.Sprintf("  %-14s %12.3f -> %12.3f  (%+.1f%%)%s\n", name, old, cur, change, status)
+	}
+	measure("requests/sec", baseline.RequestsPerSec, current.RequestsPerSec, true)
+	measure("MB/sec", baseline.MBPerSec, current.MBPerSec, true)
+	measure("mean ms", baseline.LatencyMs.Mean, current.LatencyMs.Mean, false)
+	measure("p50 ms", baseline.LatencyMs.P50, current.LatencyMs.P50, false)
+	measure("p95 ms", baseline.LatencyMs.P95, current.LatencyMs.P95, false)
+	measure("p99 ms", baseline.LatencyMs.P99, current.LatencyMs.P99, false)
+	if current.Errors > baseline.Errors {
+		report += fmt.Sprintf("  errors increased from %d to %d  REGRESSION\n", baseline.Errors, current.Errors)
+		regressed = true
+	}
+	return
+}
@@ -0,0 +1,112 @@
+/*
+	This file supports capability negotiation so clients can adapt to the features,
+	data types, and codecs of a particular DVID server.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// SupportedAPIVersions lists the versions of the HTTP API handled by this server,
+// where an empty string is the unversioned API at /api/.
+var SupportedAPIVersions = []string{WebAPIVersion}
+
+var features = struct {
+	sync.RWMutex
+	names map[string]bool
+}{
+	names: map[string]bool{
+		"dataset-fork":            true,
+		"version-merge":           true,
+		"version-diff":            true,
+		"data-trash":              true,
+		"data-purge":              true,
+		"data-verify":             true,
+		"remotes-listing":         true,
+		"compression-dictionary":  true,
+		"metadata-version-header": true,
+	},
+}
+
+// EnableFeature adds a named feature to those reported to clients.  Packages with
+// optional functionality should call it when the functionality is available.
+func EnableFeature(name string) {
+	features.Lock()
+	features.names[name] = true
+	features.Unlock()
+}
+
+// EnabledFeatures returns the sorted names of all enabled features.
+func EnabledFeatures() []string {
+	features.RLock()
+	names := make([]string, 0, len(features.names))
+	for name, _ := range features.names {
+		names = append(names, name)
+	}
+	features.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// DatatypeCapability identifies a compiled data type.
+type DatatypeCapability struct {
+	Url     datastore.UrlString
+	Version string
+}
+
+// Capabilities describes what this server supports.
+type Capabilities struct {
+	Server struct {
+		DatastoreVersion string
+		StorageBackend   string
+		StorageDriver    string
+	}
+	APIVersions []string
+	Features    []string
+
+	// Datatypes maps compiled data type names to their URL and version.
+	Datatypes map[dvid.TypeString]DatatypeCapability
+
+	// Compressions and Checksums are the settings accepted in data instance configs.
+	Compressions []string
+	Checksums    []string
+
+	// Versions of the serialization envelope and object encodings this server can read.
+	EnvelopeVersions []dvid.EnvelopeVersion
+	ObjectEncodings  []string
+}
+
+// ServerCapabilities returns the capabilities of this server.
+func ServerCapabilities() *Capabilities {
+	caps := new(Capabilities)
+	caps.Server.DatastoreVersion = datastore.Version
+	caps.Server.StorageBackend = storage.Version
+	caps.Server.StorageDriver = storage.Driver
+	caps.APIVersions = SupportedAPIVersions
+	caps.Features = EnabledFeatures()
+	caps.Datatypes = make(map[dvid.TypeString]DatatypeCapability)
+	for url, datatype := range datastore.CompiledTypes {
+		caps.Datatypes[datatype.DatatypeName()] = DatatypeCapability{url, datatype.DatatypeVersion()}
+	}
+	caps.Compressions = []string{"none", "snappy", "lz4", "gzip", "gzip:<level>"}
+	caps.Checksums = []string{"none", "crc32", "sha256"}
+	caps.EnvelopeVersions = []dvid.EnvelopeVersion{dvid.LegacyEnvelope, dvid.EnvelopeV1, dvid.EnvelopeV2}
+	caps.ObjectEncodings = []string{"gob", "json"}
+	return caps
+}
+
+func capabilitiesJSON() (string, error) {
+	m, err := json.Marshal(ServerCapabilities())
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
@@ -36,18 +36,33 @@ func NewClient(rpcAddress string) *Client {
 
 // Send transmits an RPC command if a server is available.
 func (c *Client) Send(request datastore.Request) error {
-	var reply datastore.Response
+	reply, err := c.Call(request)
+	if err != nil {
+		return err
+	}
+	return reply.Write(os.Stdout)
+}
+
+// Call transmits an RPC command and returns the server's reply, or a reply noting that
+// no server is available.
+func (c *Client) Call(request datastore.Request) (*datastore.Response, error) {
+	reply := new(datastore.Response)
 	if c.client != nil {
-		err := c.client.Call("RPCConnection.Do", request, &reply)
+		err := c.client.Call("RPCConnection.Do", request, reply)
 		if err != nil {
 			if dvid.Mode == dvid.Debug {
-				return fmt.Errorf("RPC error for '%s': %s", request.Command, err.Error())
+				return nil, fmt.Errorf("RPC error for '%s': %s", request.Command, err.Error())
 			} else {
-				return fmt.Errorf("RPC error: %s", err.Error())
+				return nil, fmt.Errorf("RPC error: %s", err.Error())
 			}
 		}
 	} else {
 		reply.Output = []byte(fmt.Sprintf("No DVID server is available: %s\n", request.Command))
 	}
-	return reply.Write(os.Stdout)
+	return reply, nil
+}
+
+// Connected returns true if the client found a server.
+func (c *Client) Connected() bool {
+	return c.client != nil
 }
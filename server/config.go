@@ -0,0 +1,180 @@
+/*
+	This file supports TOML configuration files for servers, so the many options of a
+	server can be kept in one file shared by its systemd unit and clients instead of
+	command-line flags.  Keys within each table are the names of the flags they set, and
+	flags given on the command line override the file.  For example:
+
+		[server]
+		http = ":8000"
+		rpc = ":8001"
+
+		[store]
+		path = "/data/dvid"
+
+		[store.engine]
+		CacheSize = 1024
+		WriteBufferSize = 64
+
+		[cache]
+		cachemb = 4096
+
+		[auth]
+		auth = true
+		replkey = "secret"
+
+		[logging]
+		logmaxmb = 200
+
+		[federation]
+		remotes = ["dvid.site2.org:8000", "https://dvid.site3.org"]
+*/
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// configTables gives the command-line flags set by each table of a configuration file.
+var configTables = map[string][]string{
+	"server": {"http", "rpc", "grpc", "webclient", "tlscert", "tlskey", "numcpu", "timeout",
+		"shutdownwait", "reqtimeout", "nocompress", "uuid", "trashdays", "crc32", "debug",
+		"benchmark", "pidfile", "privatehooks"},
+	"limits": {"ratelimit", "bytelimit", "maxrequests", "maxconns", "maxinstancerequests",
+		"requestmb", "memorymb"},
+	"cache":      {"cachemb", "ssdcache", "ssdcachemb"},
+	"auth":       {"auth", "oidc", "oidcclient", "oidcsecret", "oidcredirect", "replkey"},
+	"logging":    {"logmaxmb", "logbackups"},
+	"proxy":      {"upstream", "proxydata", "proxycachemb", "upstreamtoken"},
+	"federation": {"remotes", "remotestoken"},
+}
+
+// ConfigFile is a server configuration read from a TOML file.
+type ConfigFile struct {
+	// Flags maps the names of command-line flags to the values set by the file.
+	Flags map[string]string
+
+	// StorePath is the path of the datastore to serve, or empty if not set.
+	StorePath string
+
+	// StoreSettings are the storage engine settings, e.g., CacheSize.
+	StoreSettings dvid.Config
+}
+
+// ReadConfigFile reads a server configuration from a TOML file.
+func ReadConfigFile(path string) (*ConfigFile, error) {
+	var tables map[string]interface{}
+	if _, err := toml.DecodeFile(path, &tables); err != nil {
+		return nil, fmt.Errorf("Unable to read config file %s: %s", path, err.Error())
+	}
+	config := &ConfigFile{Flags: make(map[string]string)}
+	for name, value := range tables {
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Config file %s has key '%s' outside of a table", path, name)
+		}
+		if name == "store" {
+			if err := config.setStore(table); err != nil {
+				return nil, fmt.Errorf("Config file %s: %s", path, err.Error())
+			}
+			continue
+		}
+		flags, found := configTables[name]
+		if !found {
+			return nil, fmt.Errorf("Config file %s has unknown table [%s]; tables are %s", path, name,
+				configTableNames())
+		}
+		for key, value := range table {
+			if !containsString(flags, key) {
+				return nil, fmt.Errorf("Config file %s has unknown key '%s' in table [%s]; keys are %s",
+					path, key, name, strings.Join(flags, ", "))
+			}
+			s, err := configString(value)
+			if err != nil {
+				return nil, fmt.Errorf("Config file %s has illegal '%s': %s", path, key, err.Error())
+			}
+			config.Flags[key] = s
+		}
+	}
+	return config, nil
+}
+
+// setStore sets the datastore path and storage engine settings of a [store] table.
+func (config *ConfigFile) setStore(table map[string]interface{}) error {
+	for key, value := range table {
+		switch key {
+		case "path":
+			path, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("Store path must be a string, not %v", value)
+			}
+			config.StorePath = path
+		case "engine":
+			settings, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("Store engine settings must be a table")
+			}
+			for setting, value := range settings {
+				s, err := configString(value)
+				if err != nil {
+					return fmt.Errorf("Illegal store engine setting '%s': %s", setting, err.Error())
+				}
+				config.StoreSettings.Set(setting, s)
+			}
+		default:
+			return fmt.Errorf("Unknown key '%s' in table [store]; keys are path and engine", key)
+		}
+	}
+	return nil
+}
+
+// configString returns the flag value of a TOML value, where arrays are joined by commas.
+func configString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case []interface{}:
+		elems := make([]string, len(v))
+		for i, elem := range v {
+			s, err := configString(elem)
+			if err != nil {
+				return "", err
+			}
+			elems[i] = s
+		}
+		return strings.Join(elems, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+func configTableNames() string {
+	names := []string{"[store]"}
+	for name := range configTables {
+		names = append(names, "["+name+"]")
+	}
+	sort.Strings(names[1:])
+	return strings.Join(names, ", ")
+}
+
+func containsString(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
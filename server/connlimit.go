@@ -0,0 +1,127 @@
+/*
+	This file supports limits on simultaneous HTTP connections and on concurrent
+	requests for each data instance, so a burst of requests, e.g., for large subvolumes
+	of one instance, cannot exhaust the server.  Requests over a limit get 503 replies
+	with a Retry-After header.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	// MaxConnections is the maximum number of simultaneous HTTP connections.  Requests
+	// on connections over the limit are rejected and their connections closed.  If 0,
+	// connections are unlimited.
+	MaxConnections int
+
+	// MaxInstanceRequests is the maximum number of concurrent HTTP requests for each
+	// data instance.  If 0, requests per instance are unlimited.
+	MaxInstanceRequests int
+)
+
+// Unavailable replies to a request that cannot be handled now with a 503 and a
+// Retry-After header giving when the client should retry.
+func Unavailable(w http.ResponseWriter, r *http.Request, message string, wait time.Duration) {
+	errorMsg := fmt.Sprintf("ERROR: %s (%s).\n", message, r.URL.Path)
+	dvid.Log(dvid.Debug, errorMsg)
+	w.Header().Del("ETag")
+	w.Header().Del("Cache-Control")
+	retryAfter(w, wait)
+	http.Error(w, errorMsg, http.StatusServiceUnavailable)
+}
+
+// connKey is the context key of a request's connection.
+type connKey struct{}
+
+// connections tracks open HTTP connections and those opened over MaxConnections.
+var connections = struct {
+	sync.Mutex
+	open      int
+	overLimit map[net.Conn]bool
+}{overLimit: make(map[net.Conn]bool)}
+
+// trackConnection is the http.Server ConnState hook counting open connections.
+func trackConnection(conn net.Conn, state http.ConnState) {
+	connections.Lock()
+	defer connections.Unlock()
+	switch state {
+	case http.StateNew:
+		connections.open++
+		if connections.open > MaxConnections {
+			connections.overLimit[conn] = true
+		}
+	case http.StateHijacked, http.StateClosed:
+		connections.open--
+		delete(connections.overLimit, conn)
+	}
+}
+
+// connContext is the http.Server ConnContext hook adding the connection to the
+// context of its requests.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// connectionOverLimit returns true if a request arrived on a connection opened while
+// the server was at MaxConnections.
+func connectionOverLimit(r *http.Request) bool {
+	if MaxConnections <= 0 {
+		return false
+	}
+	conn, ok := r.Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return false
+	}
+	connections.Lock()
+	defer connections.Unlock()
+	return connections.overLimit[conn]
+}
+
+// instanceSlots limits the concurrent requests for each data instance, keyed by the
+// root UUID of its dataset and its name.
+var instanceSlots = struct {
+	sync.Mutex
+	slots map[string]chan struct{}
+}{slots: make(map[string]chan struct{})}
+
+// acquireInstanceSlot waits up to ShedWait for a slot to handle a request for the
+// named data in the dataset with the given root, returning a function that releases
+// the slot, or false if none became available.
+func acquireInstanceSlot(root dvid.UUID, dataname dvid.DataString) (func(), bool) {
+	if MaxInstanceRequests <= 0 {
+		return func() {}, true
+	}
+	key := string(root) + "/" + string(dataname)
+	instanceSlots.Lock()
+	slots, found := instanceSlots.slots[key]
+	if !found {
+		slots = make(chan struct{}, MaxInstanceRequests)
+		instanceSlots.slots[key] = slots
+	}
+	instanceSlots.Unlock()
+
+	release := func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	timer := time.NewTimer(ShedWait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	}
+}
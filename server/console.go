@@ -0,0 +1,51 @@
+/*
+	This file embeds a default web console, with a version DAG viewer, data instance
+	browser, and simple slice viewer, so a server started without -webclient and
+	without web client files appended to the executable still has a useful UI.
+*/
+
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+//go:embed console
+var consoleFiles embed.FS
+
+// ConsolePath is the URL path of the console's assets.
+const ConsolePath = "/console/"
+
+// consoleContent returns an embedded console file for a path relative to the web root,
+// where the index page is the console's.
+func consoleContent(path string) ([]byte, bool) {
+	switch {
+	case path == "index.html":
+		path = "console/index.html"
+	case strings.HasPrefix(path, ConsolePath[1:]):
+		path = "console/" + strings.TrimPrefix(path, ConsolePath[1:])
+	default:
+		return nil, false
+	}
+	data, err := fs.ReadFile(consoleFiles, path)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// sendConsole replies with an embedded console file or a 404 if there is none.
+func sendConsole(w http.ResponseWriter, r *http.Request, path string) {
+	data, found := consoleContent(path)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	dvid.Log(dvid.Debug, "[%s] Serving from embedded console: %s\n", r.Method, path)
+	dvid.SendHTTP(w, r, path, data)
+}
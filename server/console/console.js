@@ -0,0 +1,286 @@
+// Default DVID web console: lists datasets, draws the version DAG of the selected
+// dataset, browses its data instances, and views slices of voxel data.
+"use strict";
+
+const api = "/api/";
+
+const state = {
+  root: null,    // root UUID of the selected dataset
+  uuid: null,    // selected version node
+  dataset: null, // dataset info JSON
+  instance: null // selected data instance name
+};
+
+async function getJSON(path) {
+  const resp = await fetch(api + path, { credentials: "same-origin" });
+  if (!resp.ok) {
+    throw new Error(path + ": " + resp.status + " " + (await resp.text()));
+  }
+  return resp.json();
+}
+
+function el(tag, attrs, text) {
+  const node = document.createElement(tag);
+  for (const [key, value] of Object.entries(attrs || {})) {
+    node.setAttribute(key, value);
+  }
+  if (text !== undefined) {
+    node.textContent = text;
+  }
+  return node;
+}
+
+function svgEl(tag, attrs) {
+  const node = document.createElementNS("http://www.w3.org/2000/svg", tag);
+  for (const [key, value] of Object.entries(attrs || {})) {
+    node.setAttribute(key, value);
+  }
+  return node;
+}
+
+function shortUUID(uuid) {
+  return uuid.substring(0, 8);
+}
+
+function showError(where, err) {
+  document.getElementById(where).textContent = err.message;
+}
+
+async function loadServer() {
+  try {
+    const info = await getJSON("server/info");
+    const parts = [];
+    for (const key of ["DVID datastore", "Storage backend", "Server uptime"]) {
+      if (info[key]) {
+        parts.push(info[key]);
+      }
+    }
+    document.getElementById("server").textContent = parts.join(" | ");
+  } catch (err) {
+    document.getElementById("server").textContent = "";
+  }
+}
+
+async function loadDatasets() {
+  const list = document.getElementById("datasets");
+  list.textContent = "";
+  let datasets;
+  try {
+    datasets = await getJSON("datasets/list");
+  } catch (err) {
+    showError("datasets", err);
+    return;
+  }
+  for (const root of datasets.DatasetsUUID || []) {
+    const item = el("li", { "data-uuid": root }, shortUUID(root));
+    item.title = root;
+    item.onclick = () => selectDataset(root);
+    list.appendChild(item);
+  }
+  if (!list.firstChild) {
+    list.appendChild(el("li", {}, "No datasets"));
+  }
+}
+
+async function selectDataset(root) {
+  state.root = root;
+  for (const item of document.querySelectorAll("#datasets li")) {
+    item.classList.toggle("selected", item.dataset.uuid === root);
+  }
+  let dag;
+  try {
+    [dag, state.dataset] = await Promise.all([getJSON("dataset/" + root + "/dag"),
+                                              getJSON("dataset/" + root + "/info")]);
+  } catch (err) {
+    showError("node", err);
+    return;
+  }
+  document.getElementById("dataset-title").textContent = dag.Alias ? "of " + dag.Alias : "";
+  drawDAG(dag);
+  const leaf = dag.Nodes[dag.Nodes.length - 1];
+  selectNode(leaf);
+  showInstances();
+}
+
+// drawDAG lays out nodes in rows by their depth from the root.
+function drawDAG(dag) {
+  const svg = document.getElementById("dag");
+  svg.textContent = "";
+  const byUUID = new Map(dag.Nodes.map((n) => [n.UUID, n]));
+  const depth = new Map();
+  for (const node of dag.Nodes) {
+    let d = 0;
+    for (const parent of node.Parents || []) {
+      d = Math.max(d, (depth.get(parent) || 0) + 1);
+    }
+    depth.set(node.UUID, d);
+  }
+  const rows = [];
+  for (const node of dag.Nodes) {
+    const d = depth.get(node.UUID);
+    (rows[d] = rows[d] || []).push(node);
+  }
+  const position = new Map();
+  const dy = 50, dx = 110;
+  rows.forEach((row, d) => {
+    row.forEach((node, i) => position.set(node.UUID, { x: 60 + i * dx, y: 25 + d * dy }));
+  });
+  const width = Math.max(...rows.map((row) => row.length)) * dx + 60;
+  svg.setAttribute("viewBox", "0 0 " + width + " " + (rows.length * dy + 10));
+
+  for (const node of dag.Nodes) {
+    for (const parent of node.Parents || []) {
+      if (!byUUID.has(parent)) {
+        continue;
+      }
+      const a = position.get(parent), b = position.get(node.UUID);
+      svg.appendChild(svgEl("line", { x1: a.x, y1: a.y, x2: b.x, y2: b.y }));
+    }
+  }
+  for (const node of dag.Nodes) {
+    const p = position.get(node.UUID);
+    const circle = svgEl("circle", { cx: p.x, cy: p.y, r: 9, "data-uuid": node.UUID });
+    if (node.Locked) {
+      circle.classList.add("locked");
+    }
+    const title = svgEl("title");
+    title.textContent = node.UUID + (node.Message ? "\n" + node.Message : "");
+    circle.appendChild(title);
+    circle.onclick = () => selectNode(node);
+    svg.appendChild(circle);
+    const label = svgEl("text", { x: p.x + 13, y: p.y + 4 });
+    label.textContent = shortUUID(node.UUID);
+    svg.appendChild(label);
+  }
+}
+
+function selectNode(node) {
+  state.uuid = node.UUID;
+  for (const circle of document.querySelectorAll("#dag circle")) {
+    circle.classList.toggle("selected", circle.dataset.uuid === node.UUID);
+  }
+  const info = document.getElementById("node");
+  info.textContent = "";
+  const lines = [
+    "UUID: " + node.UUID,
+    (node.Locked ? "Committed " + node.Committed : "Open") + (node.Abandoned ? " (abandoned)" : ""),
+  ];
+  if (node.Author) {
+    lines.push("Author: " + node.Author);
+  }
+  if (node.Message) {
+    lines.push("Message: " + node.Message);
+  }
+  for (const line of lines) {
+    info.appendChild(el("div", {}, line));
+  }
+  if (state.instance) {
+    showSlice();
+  }
+}
+
+function instanceType(data) {
+  for (const candidate of [data.Base, data.TypeService, data.Extended, data]) {
+    if (candidate && (candidate.TypeName || candidate.Name)) {
+      return candidate.TypeName || candidate.Name;
+    }
+  }
+  return "";
+}
+
+function showInstances() {
+  const body = document.querySelector("#instances tbody");
+  body.textContent = "";
+  const dataMap = (state.dataset && state.dataset.DataMap) || {};
+  for (const name of Object.keys(dataMap).sort()) {
+    const data = dataMap[name];
+    const row = el("tr", { "data-name": name });
+    row.appendChild(el("td", {}, name));
+    row.appendChild(el("td", {}, instanceType(data)));
+    row.appendChild(el("td", {}, data.Unversioned ? "no" : "yes"));
+    row.onclick = () => selectInstance(name);
+    body.appendChild(row);
+  }
+}
+
+async function selectInstance(name) {
+  state.instance = name;
+  for (const row of document.querySelectorAll("#instances tbody tr")) {
+    row.classList.toggle("selected", row.dataset.name === name);
+  }
+  document.getElementById("viewer-title").textContent = "of " + name;
+  const pre = document.getElementById("instance-info");
+  try {
+    const info = await getJSON("node/" + state.uuid + "/" + name + "/info");
+    pre.textContent = JSON.stringify(info, null, 2);
+    centerViewer(info);
+  } catch (err) {
+    pre.textContent = err.message;
+  }
+  showSlice();
+}
+
+// centerViewer moves the viewer to the middle of the data's extents if known.
+function centerViewer(info) {
+  const ext = info.Extended || info;
+  const min = ext.MinPoint, max = ext.MaxPoint;
+  if (!Array.isArray(min) || !Array.isArray(max) || min.length < 3) {
+    return;
+  }
+  const form = document.getElementById("viewer-form");
+  const size = Number(form.size.value);
+  form.x.value = Math.round((min[0] + max[0] - size) / 2);
+  form.y.value = Math.round((min[1] + max[1] - size) / 2);
+  form.z.value = Math.round((min[2] + max[2]) / 2);
+}
+
+function showSlice() {
+  if (!state.uuid || !state.instance) {
+    return;
+  }
+  const form = document.getElementById("viewer-form");
+  const size = Number(form.size.value);
+  const offset = [form.x.value, form.y.value, form.z.value].join("_");
+  const path = "node/" + state.uuid + "/" + state.instance + "/raw/" + form.plane.value + "/" +
+    size + "_" + size + "/" + offset + "/png";
+  const img = document.getElementById("slice");
+  const status = document.getElementById("viewer-status");
+  status.textContent = "Loading " + offset + " ...";
+  img.onload = () => { status.textContent = form.plane.value + " slice at " + offset; };
+  img.onerror = () => { status.textContent = "No slice available for " + state.instance + " at " + offset; };
+  img.src = api + path;
+}
+
+// panViewer moves the viewer within the plane (di, dj) or through slices (dk).
+function panViewer(di, dj, dk) {
+  const form = document.getElementById("viewer-form");
+  const axes = { xy: ["x", "y", "z"], xz: ["x", "z", "y"], yz: ["y", "z", "x"] }[form.plane.value];
+  const step = Math.round(Number(form.size.value) / 4);
+  form[axes[0]].value = Number(form[axes[0]].value) + di * step;
+  form[axes[1]].value = Number(form[axes[1]].value) + dj * step;
+  form[axes[2]].value = Number(form[axes[2]].value) + dk;
+  showSlice();
+}
+
+document.getElementById("viewer-form").onsubmit = (event) => {
+  event.preventDefault();
+  showSlice();
+};
+
+document.addEventListener("keydown", (event) => {
+  if (event.target.tagName === "INPUT" || !state.instance) {
+    return;
+  }
+  const moves = {
+    ArrowLeft: [-1, 0, 0], ArrowRight: [1, 0, 0], ArrowUp: [0, -1, 0], ArrowDown: [0, 1, 0],
+    PageUp: [0, 0, -1], PageDown: [0, 0, 1],
+  };
+  const move = moves[event.key];
+  if (move) {
+    event.preventDefault();
+    panViewer(...move);
+  }
+});
+
+loadServer();
+loadDatasets();
@@ -0,0 +1,119 @@
+/*
+	This file supports running a server under process supervisors like systemd.  Once
+	the datastore is open and the servers are listening, readiness is signaled through
+	sd_notify if the server was started with NOTIFY_SOCKET set, e.g., by a unit with
+	Type=notify, and the process ID is written to PIDFile if set.  A hangup signal
+	reopens the log files, e.g., after they are moved by logrotate.
+*/
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// PIDFile is the path of a file receiving the process ID once the server is ready, or
+// empty if none is written.  The file is removed at shutdown.
+var PIDFile string
+
+// NotifySocketEnv names the environment variable giving the socket of the supervisor
+// receiving sd_notify messages.
+const NotifySocketEnv = "NOTIFY_SOCKET"
+
+var (
+	// serversListening counts the servers that have not started listening.
+	serversListening sync.WaitGroup
+
+	// The error log file, which is reopened with the audit and access logs.
+	errorLogFile *dvid.RotatingFile
+)
+
+// sdNotify sends a state, e.g., "READY=1", to the supervisor given by NOTIFY_SOCKET.
+// Nothing is sent if the variable is not set.
+func sdNotify(state string) error {
+	socket := os.Getenv(NotifySocketEnv)
+	if socket == "" {
+		return nil
+	}
+	// Abstract socket names begin with '@'.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// announceReady waits until the servers are listening, then writes the PID file and
+// notifies the supervisor that the server is ready.
+func announceReady() {
+	serversListening.Wait()
+	if PIDFile != "" {
+		pid := strconv.Itoa(os.Getpid()) + "\n"
+		if err := ioutil.WriteFile(PIDFile, []byte(pid), 0644); err != nil {
+			dvid.Error("Unable to write PID file %s: %s", PIDFile, err.Error())
+		}
+	}
+	status := fmt.Sprintf("READY=1\nMAINPID=%d\nSTATUS=Serving datastore at HTTP %s and RPC %s",
+		os.Getpid(), runningService.WebAddress, runningService.RPCAddress)
+	if err := sdNotify(status); err != nil {
+		dvid.Error("Unable to notify supervisor of readiness: %s", err.Error())
+	}
+	log.Printf("DVID server is ready.\n")
+}
+
+// announceStopping notifies the supervisor that the server is shutting down and removes
+// the PID file.
+func announceStopping() {
+	if err := sdNotify("STOPPING=1"); err != nil {
+		log.Printf("Unable to notify supervisor of shutdown: %s\n", err.Error())
+	}
+	if PIDFile != "" {
+		if err := os.Remove(PIDFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to remove PID file %s: %s\n", PIDFile, err.Error())
+		}
+	}
+}
+
+// reopenLogsOnHangup reopens the error, audit, and access logs at each hangup signal.
+func reopenLogsOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := ReopenLogs(); err != nil {
+			log.Printf("Error reopening log files: %s\n", err.Error())
+		} else {
+			dvid.Log(dvid.Normal, "Reopened log files after hangup signal.\n")
+		}
+	}
+}
+
+// ReopenLogs closes and reopens the error, audit, and access logs at their paths.
+func ReopenLogs() error {
+	accessLogLock.Lock()
+	files := []*dvid.RotatingFile{errorLogFile, auditLogFile, accessLog}
+	accessLogLock.Unlock()
+	for _, f := range files {
+		if f == nil {
+			continue
+		}
+		if err := f.Reopen(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+/*
+	This file supports compression of HTTP responses negotiated through the client's
+	Accept-Encoding header.  Payloads that are already compressed, either because the
+	handler set a Content-Encoding, marked the response with dvid.MarkCompressed, or
+	sent a compressed content type like JPEG, are passed through unchanged.
+*/
+
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	// CompressResponses enables compression of HTTP API responses for clients that
+	// accept it.
+	CompressResponses = true
+
+	// CompressMinBytes is the smallest response, by its Content-Length if given, that
+	// is compressed.
+	CompressMinBytes int64 = 1024
+)
+
+// compressedTypes are content types whose payloads are already compressed.
+var compressedTypes = map[string]bool{
+	"image/jpeg":       true,
+	"image/png":        true,
+	"image/gif":        true,
+	"image/webp":       true,
+	"application/gzip": true,
+	"application/zip":  true,
+	"application/zstd": true,
+}
+
+// responseEncodings are the supported encodings in order of preference.
+var responseEncodings = []string{"zstd", "gzip"}
+
+// acceptedEncoding returns the preferred supported encoding accepted by a request,
+// or "" if the response should not be encoded.
+func acceptedEncoding(r *http.Request) string {
+	accepted := make(map[string]float64)
+	for _, value := range r.Header["Accept-Encoding"] {
+		for _, item := range strings.Split(value, ",") {
+			params := strings.Split(item, ";")
+			coding := strings.ToLower(strings.TrimSpace(params[0]))
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = v
+					}
+				}
+			}
+			accepted[coding] = q
+		}
+	}
+	var best string
+	var bestQ float64
+	for _, encoding := range responseEncodings {
+		q, found := accepted[encoding]
+		if !found {
+			q, found = accepted["*"]
+		}
+		if found && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressingWriter compresses a response body with an encoding, if any, unless the
+// response turns out to be already compressed, which is decided when the header is
+// written.
+type compressingWriter struct {
+	http.ResponseWriter
+	encoding    string
+	encoder     io.WriteCloser
+	wroteHeader bool
+}
+
+// compressible returns true if a response with the given header and status should be
+// compressed.
+func compressible(header http.Header, status int) bool {
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || header.Get(dvid.PrecompressedHeader) != "" {
+		return false
+	}
+	ctype := strings.ToLower(strings.TrimSpace(strings.Split(header.Get("Content-Type"), ";")[0]))
+	if compressedTypes[ctype] {
+		return false
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < CompressMinBytes {
+		return false
+	}
+	return true
+}
+
+func (w *compressingWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+	if w.encoding != "" && compressible(header, status) {
+		var err error
+		switch w.encoding {
+		case "gzip":
+			w.encoder, err = gzip.NewWriterLevel(w.ResponseWriter, gzip.BestSpeed)
+		case "zstd":
+			w.encoder, err = zstd.NewWriter(w.ResponseWriter, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		}
+		if err != nil {
+			dvid.Error("Unable to create %s encoder: %s", w.encoding, err.Error())
+			w.encoder = nil
+		}
+	}
+	header.Del(dvid.PrecompressedHeader)
+	if w.encoder != nil {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// close finishes the compressed stream.
+func (w *compressingWriter) close() error {
+	if w.encoder == nil {
+		return nil
+	}
+	return w.encoder.Close()
+}
+
+// Flush supports streaming responses by flushing compressed data to the client.
+func (w *compressingWriter) Flush() {
+	if flusher, ok := w.encoder.(interface {
+		Flush() error
+	}); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// CloseNotify supports streaming responses that end when the client disconnects.
+func (w *compressingWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
+// Hijack supports upgrades to WebSockets.
+func (w *compressingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Connection cannot be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// compressHandler wraps an HTTP handler so its responses are compressed with the
+// encoding preferred by the client.
+func compressHandler(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		var encoding string
+		if CompressResponses && r.Method != "HEAD" && r.Header.Get("Range") == "" &&
+			!headerHas(r, "Connection", "upgrade") {
+			encoding = acceptedEncoding(r)
+		}
+		cw := &compressingWriter{ResponseWriter: w, encoding: encoding}
+		handler(cw, r)
+		if !cw.wroteHeader {
+			w.Header().Del(dvid.PrecompressedHeader)
+		}
+		if err := cw.close(); err != nil {
+			dvid.Log(dvid.Debug, "Error finishing %s response to %s: %s\n", encoding, r.URL.Path, err.Error())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+/*
+	This file supports conditional GET requests of data at version nodes, so clients
+	such as viewers can revalidate cached tiles and blocks instead of downloading them
+	again.  Data at committed nodes cannot change, so it is given a permanent ETag and
+	may be cached indefinitely.  Otherwise the ETag changes with every mutation of the
+	data, and clients must revalidate before reusing a cached copy.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// ImmutableMaxAge is the Cache-Control max-age, in seconds, of data at committed nodes.
+const ImmutableMaxAge = 365 * 24 * 60 * 60
+
+// dataETag returns the ETag of data at a node and whether the data is immutable.
+func dataETag(uuid dvid.UUID, dataservice datastore.DataService) (etag string, immutable bool, err error) {
+	locked, err := runningService.Locked(uuid)
+	if err != nil {
+		return
+	}
+	// Unversioned data has one copy shared by all nodes, so it can change even at
+	// committed nodes.
+	if locked && dataservice.IsVersioned() {
+		var localID dvid.DataLocalID
+		if data, ok := dataservice.(interface {
+			LocalID() dvid.DataLocalID
+		}); ok {
+			localID = data.LocalID()
+		}
+		return fmt.Sprintf(`"%s-%s-%d"`, uuid, dataservice.DataName(), localID), true, nil
+	}
+	// Mutation counts restart with the server, so tags are qualified by its start time.
+	return fmt.Sprintf(`"%s-%s-%x-%d"`, uuid, dataservice.DataName(), startupTime.UnixNano(),
+		runningService.MutationID(dataservice)), false, nil
+}
+
+// etagMatches returns true if an If-None-Match header value matches the ETag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified sets the ETag and Cache-Control headers of a GET or HEAD request
+// for data at a node.  If the client's cached copy given by If-None-Match is current,
+// a 304 reply is sent and true is returned.
+func checkNotModified(w http.ResponseWriter, r *http.Request, uuid dvid.UUID,
+	dataservice datastore.DataService) bool {
+
+	method := strings.ToLower(r.Method)
+	if method != "get" && method != "head" {
+		return false
+	}
+	etag, immutable, err := dataETag(uuid, dataservice)
+	if err != nil {
+		dvid.Log(dvid.Debug, "Unable to compute ETag for %s: %s\n", r.URL.Path, err.Error())
+		return false
+	}
+	visibility := "public"
+	if AuthRequired {
+		visibility = "private"
+	}
+	header := w.Header()
+	header.Set("ETag", etag)
+	if immutable {
+		header.Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", visibility, ImmutableMaxAge))
+	} else {
+		header.Set("Cache-Control", visibility+", no-cache")
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+/*
+	This file supports exports of data instances at one version into portable archives
+	written to new files on the server, and imports of those archives.  Exports and
+	imports run as jobs whose progress and limits can be followed and changed like
+	other jobs.
+*/
+
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Export writes an archive of the named data, or all data, as of the node with the
+// given UUID to a new file on the server.  The export runs as a job with the given
+// limits.
+func Export(uuidStr string, datanames []dvid.DataString, path string,
+	limits datastore.JobLimits) (*datastore.ExportManifest, error) {
+
+	if runningService.Service == nil {
+		return nil, fmt.Errorf("Datastore service has not been started on this server.")
+	}
+	uuid, err := MatchingUUID(uuidStr)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	job := datastore.StartJob("export", "export to "+path, limits)
+	defer job.Finish()
+	manifest, err := runningService.WriteExport(f, uuid, datanames, job)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	job.SetResult(nil, err)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// exportSummary returns a description of an export.
+func exportSummary(manifest *datastore.ExportManifest, path string) string {
+	text := fmt.Sprintf("Exported %d data instances at node %s to %s\n", len(manifest.Instances),
+		manifest.Node, path)
+	for _, instance := range manifest.Instances {
+		text += fmt.Sprintf("  %s (%s): %d keys, %d bytes\n", instance.Name, instance.TypeName,
+			instance.Keys, instance.Bytes)
+	}
+	if !manifest.Snapshot {
+		text += "Storage engine does not support snapshots, so an unlocked node may have changed during export.\n"
+	}
+	return text
+}
+
+// Import imports an export archive at a path on the server into a new dataset or, if
+// uuidStr is given, into that unlocked node.  The import runs as a job with the given
+// limits.
+func Import(path string, uuidStr string, limits datastore.JobLimits) (*datastore.ImportResult, error) {
+	if runningService.Service == nil {
+		return nil, fmt.Errorf("Datastore service has not been started on this server.")
+	}
+	var uuid dvid.UUID
+	if uuidStr != "" {
+		var err error
+		if uuid, err = MatchingUUID(uuidStr); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	job := datastore.StartJob("import", "import from "+path, limits)
+	defer job.Finish()
+	result, err := runningService.ImportExport(f, uuid, job)
+	job.SetResult(result, err)
+	return result, err
+}
+
+// importSummary returns a description of an import.
+func importSummary(result *datastore.ImportResult, path string) string {
+	return fmt.Sprintf("Imported %d data instances with %d keys from %s into node %s of dataset %s\n",
+		len(result.Data), result.Keys, path, result.Node, result.Root)
+}
@@ -0,0 +1,415 @@
+/*
+	This file serves the gRPC API defined in dvid.proto: dataset and version DAG
+	management, reads and writes of stored blocks with streaming for bulk transfer, and
+	reads and writes of keyvalue data.  Calls are authenticated and checked against
+	ACLs like HTTP and RPC requests.
+*/
+
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// GRPCAddress is the address of the gRPC server.  The gRPC API is not served if empty.
+var GRPCAddress string
+
+// GRPCMaxMessageBytes is the maximum size of a received gRPC message, e.g., a block.
+const GRPCMaxMessageBytes = 64 * dvid.Mega
+
+// keyValueData is fulfilled by data holding values under string keys, e.g., keyvalue data.
+type keyValueData interface {
+	GetData(uuid dvid.UUID, keyStr string) (value []byte, found bool, err error)
+	PutData(uuid dvid.UUID, keyStr string, value []byte) error
+}
+
+// grpcCaller is the authenticated user of a gRPC call.
+type grpcCaller struct {
+	user  string
+	admin bool
+}
+
+// grpcAuthenticate returns the user of a gRPC call from its "authorization" bearer
+// token or, if authentication is not required, the anonymous user since user metadata
+// can't be verified.  The call is recorded in the audit log.
+func grpcAuthenticate(ctx context.Context, method string) (*grpcCaller, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) != 0 {
+			return values[0]
+		}
+		return ""
+	}
+	caller := &grpcCaller{}
+	if AuthRequired {
+		token, err := authenticate(strings.TrimPrefix(first("authorization"), "Bearer "))
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "Request not authenticated: %s", err.Error())
+		}
+		caller.user, caller.admin = token.User, token.Admin
+	}
+	audit(caller.user, "grpc %s", method)
+	return caller, nil
+}
+
+// checkAccess returns an error if the caller may not read, or write if write is true,
+// the dataset with the node of the given UUID or the named data.  Writes of data also
+// need the node to be unlocked and writable by the caller.
+func (caller *grpcCaller) checkAccess(uuid dvid.UUID, dataname dvid.DataString, write bool) error {
+	if write {
+		if err := grpcCheckReadOnly(); err != nil {
+			return err
+		}
+	}
+	if !caller.admin {
+		if err := CheckAccess(uuid, dataname, caller.user, write); err != nil {
+			return err
+		}
+	}
+	if write && dataname != "" {
+		return CheckWriteAccess(uuid, dataname, caller.user)
+	}
+	return nil
+}
+
+// grpcCheckReadOnly returns an error if data cannot be modified while data keys are
+// migrated.
+func grpcCheckReadOnly() error {
+	if datastore.KeysReadOnly() {
+		return status.Error(codes.Unavailable, "Data cannot be modified while data keys are migrated")
+	}
+	return nil
+}
+
+// grpcError converts an error into a gRPC status error.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch err.(type) {
+	case *datastore.AccessError, *datastore.PermissionError:
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// grpcUnaryMethod is a gRPC method with a single request and reply.
+type grpcUnaryMethod struct {
+	name       string
+	newRequest func() grpcMessage
+	handle     func(caller *grpcCaller, req grpcMessage) (grpcMessage, error)
+}
+
+var grpcUnaryMethods = []grpcUnaryMethod{
+	{"ListDatasets", func() grpcMessage { return new(grpcEmpty) }, grpcListDatasets},
+	{"NewDataset", func() grpcMessage { return new(grpcEmpty) }, grpcNewDataset},
+	{"DAG", func() grpcMessage { return new(grpcNodeRequest) }, grpcDAG},
+	{"Commit", func() grpcMessage { return new(grpcCommitRequest) }, grpcCommit},
+	{"Branch", func() grpcMessage { return new(grpcCommitRequest) }, grpcBranch},
+	{"Merge", func() grpcMessage { return new(grpcMergeRequest) }, grpcMerge},
+	{"GetBlock", func() grpcMessage { return new(grpcBlockRequest) }, grpcGetBlock},
+	{"PutBlock", func() grpcMessage { return new(grpcBlock) }, grpcPutBlock},
+	{"GetKeyValue", func() grpcMessage { return new(grpcKeyValueRequest) }, grpcGetKeyValue},
+	{"PutKeyValue", func() grpcMessage { return new(grpcKeyValue) }, grpcPutKeyValue},
+}
+
+func (method grpcUnaryMethod) handler(srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	req := method.newRequest()
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	caller, err := grpcAuthenticate(ctx, method.name)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := method.handle(caller, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return reply, nil
+}
+
+// grpcService is registered with the service description of the gRPC API, whose
+// handlers use the running datastore service.
+type grpcService struct{}
+
+// grpcServiceDesc returns the service description of the gRPC API.
+func grpcServiceDesc() *grpc.ServiceDesc {
+	desc := &grpc.ServiceDesc{
+		ServiceName: "dvid.DVID",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{
+			{StreamName: "GetBlocks", Handler: grpcGetBlocks, ServerStreams: true},
+			{StreamName: "PutBlocks", Handler: grpcPutBlocks, ClientStreams: true},
+		},
+		Metadata: "dvid.proto",
+	}
+	for _, method := range grpcUnaryMethods {
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{MethodName: method.name, Handler: method.handler})
+	}
+	return desc
+}
+
+// Listen and serve gRPC requests using address.
+func (service *Service) ServeGRPC(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(grpcCodec{}), grpc.MaxRecvMsgSize(GRPCMaxMessageBytes))
+	server.RegisterService(grpcServiceDesc(), grpcService{})
+	serversLock.Lock()
+	grpcServer = server
+	serversLock.Unlock()
+	serversListening.Done()
+	dvid.Log(dvid.Debug, "gRPC server listening at %s ...\n", address)
+	return server.Serve(listener)
+}
+
+func grpcListDatasets(caller *grpcCaller, req grpcMessage) (grpcMessage, error) {
+	jsonStr, err := datasetsJSON(false, caller.admin, caller.user)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcJSONReply{jsonStr}, nil
+}
+
+func grpcNewDataset(caller *grpcCaller, req grpcMessage) (grpcMessage, error) {
+	if err := grpcCheckReadOnly(); err != nil {
+		return nil, err
+	}
+	root, err := newDataset(caller.admin, caller.user)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcNodeReply{string(root)}, nil
+}
+
+func grpcDAG(caller *grpcCaller, req grpcMessage) (grpcMessage, error) {
+	uuid, err := MatchingUUID(req.(*grpcNodeRequest).UUID)
+	if err != nil {
+		return nil, err
+	}
+	if err := caller.checkAccess(uuid, "", false); err != nil {
+		return nil, err
+	}
+	jsonStr, err := runningService.DAGJSON(uuid)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcJSONReply{jsonStr}, nil
+}
+
+// grpcCommitInfo returns the node and commit information of a commit or branch request.
+// If authentication is required, the author is the authenticated user.
+func grpcCommitInfo(caller *grpcCaller, commit *grpcCommitRequest) (dvid.UUID, datastore.CommitInfo, error) {
+	info := datastore.CommitInfo{Author: commit.Author, Message: commit.Message}
+	if AuthRequired {
+		info.Author = caller.user
+	}
+	uuid, err := MatchingUUID(commit.UUID)
+	if err != nil {
+		return uuid, info, err
+	}
+	return uuid, info, caller.checkAccess(uuid, "", true)
+}
+
+func grpcCommit(caller *grpcCaller, req grpcMessage) (grpcMessage, error) {
+	uuid, info, err := grpcCommitInfo(caller, req.(*grpcCommitRequest))
+	if err != nil {
+		return nil, err
+	}
+	if err := runningService.Commit(uuid, info); err != nil {
+		return nil, err
+	}
+	return &grpcNodeReply{string(uuid)}, nil
+}
+
+func grpcBranch(caller *grpcCaller, req grpcMessage) (grpcMessage, error) {
+	uuid, info, err := grpcCommitInfo(caller, req.(*grpcCommitRequest))
+	if err != nil {
+		return nil, err
+	}
+	newuuid, err := runningService.NewVersionWithInfo(uuid, info)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcNodeReply{string(newuuid)}, nil
+}
+
+func grpcMerge(caller *grpcCaller, req grpcMessage) (grpcMessage, error) {
+	var parents []dvid.UUID
+	for _, uuidStr := range req.(*grpcMergeRequest).Parents {
+		parent, err := MatchingUUID(uuidStr)
+		if err != nil {
+			return nil, err
+		}
+		if err := caller.checkAccess(parent, "", true); err != nil {
+			return nil, err
+		}
+		parents = append(parents, parent)
+	}
+	newuuid, err := runningService.MergeVersions(parents)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcNodeReply{string(newuuid)}, nil
+}
+
+func grpcGetBlock(caller *grpcCaller, req grpcMessage) (grpcMessage, error) {
+	request := req.(*grpcBlockRequest)
+	uuid, err := MatchingUUID(request.UUID)
+	if err != nil {
+		return nil, err
+	}
+	dataname := dvid.DataString(request.Data)
+	if err := caller.checkAccess(uuid, dataname, false); err != nil {
+		return nil, err
+	}
+	value, err := runningService.GetValue(uuid, dataname, dvid.IndexBytes(request.Index))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcBlock{string(uuid), request.Data, request.Index, value, value != nil}, nil
+}
+
+func grpcPutBlock(caller *grpcCaller, req grpcMessage) (grpcMessage, error) {
+	block := req.(*grpcBlock)
+	uuid, err := MatchingUUID(block.UUID)
+	if err != nil {
+		return nil, err
+	}
+	dataname := dvid.DataString(block.Data)
+	if err := caller.checkAccess(uuid, dataname, true); err != nil {
+		return nil, err
+	}
+	if err := runningService.PutValue(uuid, dataname, dvid.IndexBytes(block.Index), block.Value); err != nil {
+		return nil, err
+	}
+	return &grpcPutReply{1}, nil
+}
+
+// grpcGetBlocks streams the stored blocks with indices in a range, in index order.
+func grpcGetBlocks(srv interface{}, stream grpc.ServerStream) error {
+	request := new(grpcBlockRangeRequest)
+	if err := stream.RecvMsg(request); err != nil {
+		return err
+	}
+	caller, err := grpcAuthenticate(stream.Context(), "GetBlocks")
+	if err != nil {
+		return err
+	}
+	uuid, err := MatchingUUID(request.UUID)
+	if err != nil {
+		return grpcError(err)
+	}
+	dataname := dvid.DataString(request.Data)
+	if err := caller.checkAccess(uuid, dataname, false); err != nil {
+		return grpcError(err)
+	}
+	err = runningService.ProcessValues(stream.Context(), uuid, dataname, dvid.IndexBytes(request.IndexBegin),
+		dvid.IndexBytes(request.IndexEnd), func(index, value []byte) error {
+			return stream.SendMsg(&grpcBlock{string(uuid), request.Data, index, value, true})
+		})
+	return grpcError(err)
+}
+
+// grpcPutBlocks stores a stream of blocks, which may be of different nodes and data,
+// and replies with the number stored.  Blocks received before an error are stored.
+func grpcPutBlocks(srv interface{}, stream grpc.ServerStream) error {
+	caller, err := grpcAuthenticate(stream.Context(), "PutBlocks")
+	if err != nil {
+		return err
+	}
+	checked := make(map[string]dvid.UUID)
+	var count uint64
+	for {
+		block := new(grpcBlock)
+		err := stream.RecvMsg(block)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dataname := dvid.DataString(block.Data)
+		target := block.UUID + "/" + block.Data
+		uuid, found := checked[target]
+		if !found {
+			if uuid, err = MatchingUUID(block.UUID); err != nil {
+				return grpcError(err)
+			}
+			if err := caller.checkAccess(uuid, dataname, true); err != nil {
+				return grpcError(err)
+			}
+			checked[target] = uuid
+		}
+		if err := runningService.PutValue(uuid, dataname, dvid.IndexBytes(block.Index), block.Value); err != nil {
+			return grpcError(err)
+		}
+		count++
+	}
+	return stream.SendMsg(&grpcPutReply{count})
+}
+
+// grpcKeyValueData returns the keyvalue data of a request after checking access.
+func grpcKeyValueData(caller *grpcCaller, uuidStr, name string, write bool) (dvid.UUID, keyValueData, error) {
+	uuid, err := MatchingUUID(uuidStr)
+	if err != nil {
+		return uuid, nil, err
+	}
+	dataname := dvid.DataString(name)
+	if err := caller.checkAccess(uuid, dataname, write); err != nil {
+		return uuid, nil, err
+	}
+	dataservice, err := runningService.DataServiceByUUID(uuid, dataname)
+	if err != nil {
+		return uuid, nil, err
+	}
+	data, ok := dataservice.(keyValueData)
+	if !ok {
+		return uuid, nil, status.Errorf(codes.InvalidArgument, "Data '%s' does not hold values by key", dataname)
+	}
+	return uuid, data, nil
+}
+
+func grpcGetKeyValue(caller *grpcCaller, req grpcMessage) (grpcMessage, error) {
+	request := req.(*grpcKeyValueRequest)
+	uuid, data, err := grpcKeyValueData(caller, request.UUID, request.Data, false)
+	if err != nil {
+		return nil, err
+	}
+	value, found, err := data.GetData(uuid, request.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcKeyValue{string(uuid), request.Data, request.Key, value, found}, nil
+}
+
+func grpcPutKeyValue(caller *grpcCaller, req grpcMessage) (grpcMessage, error) {
+	kv := req.(*grpcKeyValue)
+	uuid, data, err := grpcKeyValueData(caller, kv.UUID, kv.Data, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := data.PutData(uuid, kv.Key, kv.Value); err != nil {
+		return nil, err
+	}
+	return &grpcPutReply{1}, nil
+}
@@ -0,0 +1,233 @@
+/*
+	This file holds the messages of the gRPC API defined in dvid.proto and a codec that
+	encodes them in the protocol buffer wire format, so clients can use stubs generated
+	from dvid.proto.
+*/
+
+package server
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// grpcField is a field of a gRPC message: a pointer to a string, []byte, uint64, bool,
+// or []string for repeated strings.
+type grpcField struct {
+	num   protowire.Number
+	value interface{}
+}
+
+// grpcMessage is a gRPC message that lists its fields for encoding.
+type grpcMessage interface {
+	fields() []grpcField
+}
+
+type grpcEmpty struct{}
+
+type grpcJSONReply struct {
+	JSON string
+}
+
+type grpcNodeRequest struct {
+	UUID string
+}
+
+type grpcNodeReply struct {
+	UUID string
+}
+
+type grpcCommitRequest struct {
+	UUID    string
+	Author  string
+	Message string
+}
+
+type grpcMergeRequest struct {
+	Parents []string
+}
+
+type grpcBlockRequest struct {
+	UUID  string
+	Data  string
+	Index []byte
+}
+
+type grpcBlockRangeRequest struct {
+	UUID       string
+	Data       string
+	IndexBegin []byte
+	IndexEnd   []byte
+}
+
+type grpcBlock struct {
+	UUID  string
+	Data  string
+	Index []byte
+	Value []byte
+	Found bool
+}
+
+type grpcKeyValueRequest struct {
+	UUID string
+	Data string
+	Key  string
+}
+
+type grpcKeyValue struct {
+	UUID  string
+	Data  string
+	Key   string
+	Value []byte
+	Found bool
+}
+
+type grpcPutReply struct {
+	Count uint64
+}
+
+func (m *grpcEmpty) fields() []grpcField { return nil }
+
+func (m *grpcJSONReply) fields() []grpcField { return []grpcField{{1, &m.JSON}} }
+
+func (m *grpcNodeRequest) fields() []grpcField { return []grpcField{{1, &m.UUID}} }
+
+func (m *grpcNodeReply) fields() []grpcField { return []grpcField{{1, &m.UUID}} }
+
+func (m *grpcCommitRequest) fields() []grpcField {
+	return []grpcField{{1, &m.UUID}, {2, &m.Author}, {3, &m.Message}}
+}
+
+func (m *grpcMergeRequest) fields() []grpcField { return []grpcField{{1, &m.Parents}} }
+
+func (m *grpcBlockRequest) fields() []grpcField {
+	return []grpcField{{1, &m.UUID}, {2, &m.Data}, {3, &m.Index}}
+}
+
+func (m *grpcBlockRangeRequest) fields() []grpcField {
+	return []grpcField{{1, &m.UUID}, {2, &m.Data}, {3, &m.IndexBegin}, {4, &m.IndexEnd}}
+}
+
+func (m *grpcBlock) fields() []grpcField {
+	return []grpcField{{1, &m.UUID}, {2, &m.Data}, {3, &m.Index}, {4, &m.Value}, {5, &m.Found}}
+}
+
+func (m *grpcKeyValueRequest) fields() []grpcField {
+	return []grpcField{{1, &m.UUID}, {2, &m.Data}, {3, &m.Key}}
+}
+
+func (m *grpcKeyValue) fields() []grpcField {
+	return []grpcField{{1, &m.UUID}, {2, &m.Data}, {3, &m.Key}, {4, &m.Value}, {5, &m.Found}}
+}
+
+func (m *grpcPutReply) fields() []grpcField { return []grpcField{{1, &m.Count}} }
+
+// grpcCodec encodes gRPC messages in the protocol buffer wire format.  Fields with
+// default values are omitted as in proto3.
+type grpcCodec struct{}
+
+func (grpcCodec) Name() string { return "proto" }
+
+func (grpcCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(grpcMessage)
+	if !ok {
+		return nil, fmt.Errorf("Cannot encode %T as a gRPC message", v)
+	}
+	var b []byte
+	for _, field := range msg.fields() {
+		switch value := field.value.(type) {
+		case *string:
+			if *value != "" {
+				b = protowire.AppendTag(b, field.num, protowire.BytesType)
+				b = protowire.AppendString(b, *value)
+			}
+		case *[]byte:
+			if len(*value) != 0 {
+				b = protowire.AppendTag(b, field.num, protowire.BytesType)
+				b = protowire.AppendBytes(b, *value)
+			}
+		case *uint64:
+			if *value != 0 {
+				b = protowire.AppendTag(b, field.num, protowire.VarintType)
+				b = protowire.AppendVarint(b, *value)
+			}
+		case *bool:
+			if *value {
+				b = protowire.AppendTag(b, field.num, protowire.VarintType)
+				b = protowire.AppendVarint(b, 1)
+			}
+		case *[]string:
+			for _, s := range *value {
+				b = protowire.AppendTag(b, field.num, protowire.BytesType)
+				b = protowire.AppendString(b, s)
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported field type %T in gRPC message %T", value, v)
+		}
+	}
+	return b, nil
+}
+
+func (grpcCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(grpcMessage)
+	if !ok {
+		return fmt.Errorf("Cannot decode %T as a gRPC message", v)
+	}
+	fields := make(map[protowire.Number]interface{})
+	for _, field := range msg.fields() {
+		fields[field.num] = field.value
+	}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		value, known := fields[num]
+		if !known {
+			// Skip fields added in later versions of the API.
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		switch value := value.(type) {
+		case *string, *[]byte, *[]string:
+			if typ != protowire.BytesType {
+				return fmt.Errorf("Field %d of gRPC message %T must be length-delimited", num, v)
+			}
+			b, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			switch value := value.(type) {
+			case *string:
+				*value = string(b)
+			case *[]byte:
+				*value = append([]byte(nil), b...)
+			case *[]string:
+				*value = append(*value, string(b))
+			}
+		case *uint64, *bool:
+			if typ != protowire.VarintType {
+				return fmt.Errorf("Field %d of gRPC message %T must be a varint", num, v)
+			}
+			x, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			switch value := value.(type) {
+			case *uint64:
+				*value = x
+			case *bool:
+				*value = x != 0
+			}
+		}
+	}
+	return nil
+}
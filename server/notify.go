@@ -0,0 +1,130 @@
+/*
+	This file supports WebSocket channels that notify clients, e.g., viewers refreshing
+	during proofreading, of changes to data at a version node: mutations of blocks,
+	commit of the node, and new child nodes created by branching or merging.
+*/
+
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// NotificationBuffer is the number of notifications buffered for a WebSocket
+// subscriber.  A subscriber that falls further behind is disconnected.
+const NotificationBuffer = 1000
+
+// notification is the JSON message sent to subscribers.  Mutations give the
+// hexadecimal indices of changed blocks, or All if every block may have changed.
+// Branches and merges give the new node and its parents.
+type notification struct {
+	Type    datastore.HookType
+	Node    dvid.UUID
+	Parents []dvid.UUID     `json:",omitempty"`
+	Name    dvid.DataString `json:",omitempty"`
+	Indices []string        `json:",omitempty"`
+	All     bool            `json:",omitempty"`
+	Author  string          `json:",omitempty"`
+	Message string          `json:",omitempty"`
+	Time    time.Time
+}
+
+// subscribeNotifications sends notifications of mutations of the named data at the
+// node with the given UUID, of the node's commit, and of its new children to a
+// channel.  The returned function ends the subscription.
+func subscribeNotifications(uuid dvid.UUID, dataname dvid.DataString, notifications chan<- *notification,
+	overflow func()) func() {
+
+	send := func(n *notification) {
+		select {
+		case notifications <- n:
+		default:
+			overflow()
+		}
+	}
+	invID := runningService.SubscribeInvalidations(func(inv *datastore.Invalidation) {
+		if inv.Name != dataname || inv.Version != uuid {
+			return
+		}
+		n := &notification{Type: datastore.HookMutation, Node: uuid, Name: dataname, Time: time.Now()}
+		if inv.Indices == nil {
+			n.All = true
+		}
+		for _, index := range inv.Indices {
+			n.Indices = append(n.Indices, hex.EncodeToString(index.Bytes()))
+		}
+		send(n)
+	})
+	hook := func(event *datastore.HookEvent) {
+		related := event.Node == uuid
+		for _, parent := range event.Parents {
+			related = related || parent == uuid
+		}
+		if !related {
+			return
+		}
+		send(&notification{Type: event.Type, Node: event.Node, Parents: event.Parents,
+			Author: event.Author, Message: event.Message, Time: event.Time})
+	}
+	var hookIDs []int
+	for _, hookType := range []datastore.HookType{datastore.HookCommit, datastore.HookBranch, datastore.HookMerge} {
+		hookIDs = append(hookIDs, runningService.AddHook(hookType, hook))
+	}
+	return func() {
+		runningService.UnsubscribeInvalidations(invID)
+		for _, id := range hookIDs {
+			runningService.RemoveHook(id)
+		}
+	}
+}
+
+// notificationsRequest upgrades a request to a WebSocket that receives JSON
+// notifications of changes to data at a node until the client disconnects.  If the
+// client falls behind, a final {"Overflow": true} message is sent and the socket is
+// closed.
+func notificationsRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, dataname dvid.DataString) {
+	if _, err := runningService.DataServiceByUUID(uuid, dataname); err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	notifications := make(chan *notification, NotificationBuffer)
+	overflow := make(chan struct{})
+	var overflowOnce sync.Once
+	unsubscribe := subscribeNotifications(uuid, dataname, notifications, func() {
+		overflowOnce.Do(func() { close(overflow) })
+	})
+	defer unsubscribe()
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	defer ws.Close()
+	closed := ws.discardReads()
+	for {
+		select {
+		case n := <-notifications:
+			m, err := json.Marshal(n)
+			if err != nil {
+				dvid.Error("Unable to encode notification: %s", err.Error())
+				return
+			}
+			if err := ws.WriteText(m); err != nil {
+				return
+			}
+		case <-overflow:
+			ws.WriteText([]byte(`{"Overflow": true}`))
+			return
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,543 @@
+/*
+	This file supports delegating authentication to an OpenID Connect provider like
+	Google or Keycloak.  Browsers sign in through the provider and get a session cookie
+	holding a DVID token, and API clients exchange ID tokens from the provider for DVID
+	tokens.  Either way, requests are authenticated by DVID tokens, so OIDC requires
+	the server to require authentication.
+*/
+
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+const (
+	// OIDCSecretEnv is the environment variable that can hold the OIDC client secret
+	// so it does not appear in the server's command line.
+	OIDCSecretEnv = "DVID_OIDC_SECRET"
+
+	// SessionCookie is the name of the cookie holding the DVID token of a browser session.
+	SessionCookie = "dvid_session"
+
+	// stateCookie binds a sign-in in progress to the browser that started it.
+	stateCookie = "dvid_oidc_state"
+
+	// loginTimeout is how long a browser has to complete a sign-in with the provider.
+	loginTimeout = 10 * time.Minute
+
+	// keyRefreshInterval limits how often the provider's keys are fetched when an ID
+	// token is signed by an unknown key.
+	keyRefreshInterval = time.Minute
+
+	// clockSkew is the allowed difference between the clocks of DVID and the provider.
+	clockSkew = time.Minute
+)
+
+var (
+	// OIDC is the provider authenticating users or nil if OIDC is not used.
+	OIDC *OIDCProvider
+
+	// OIDCTokenTTL is how long DVID tokens for browser sessions and exchanged ID tokens
+	// authenticate requests.
+	OIDCTokenTTL = 12 * time.Hour
+
+	// oidcClient sends requests to the provider.
+	oidcClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// OIDCProvider is an OpenID Connect provider with a client registered for DVID.
+type OIDCProvider struct {
+	// Issuer is the URL identifying the provider, e.g., https://accounts.google.com.
+	Issuer string
+
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the URL of this server's callback registered with the provider.
+	// If empty, it is formed from the host of each sign-in request.
+	RedirectURL string
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	keysTime  time.Time
+	logins    map[string]pendingLogin
+}
+
+// oidcDiscovery holds the endpoints given by a provider's discovery document.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// pendingLogin is a browser sign-in waiting for the provider's callback.
+type pendingLogin struct {
+	nonce    string
+	redirect string
+	started  time.Time
+}
+
+// IDClaims are the claims of a verified ID token used by DVID.
+type IDClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"`
+	Expires       int64           `json:"exp"`
+	IssuedAt      int64           `json:"iat"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified bool            `json:"email_verified"`
+}
+
+// User returns the DVID user of the claims: the verified email address if given, else
+// the provider's subject identifier namespaced by its issuer, e.g.,
+// "https://accounts.example.com#1234".  Unverified email addresses and preferred user
+// names are chosen by users, so they could claim the identity of others.
+func (claims *IDClaims) User() string {
+	if claims.Email != "" && claims.EmailVerified {
+		return claims.Email
+	}
+	return claims.Issuer + "#" + claims.Subject
+}
+
+// hasAudience returns true if the claims are intended for the given client.
+func (claims *IDClaims) hasAudience(clientID string) bool {
+	var single string
+	if err := json.Unmarshal(claims.Audience, &single); err == nil {
+		return single == clientID
+	}
+	var multiple []string
+	if err := json.Unmarshal(claims.Audience, &multiple); err == nil {
+		for _, aud := range multiple {
+			if aud == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewOIDCProvider returns a provider for the given issuer and registered client.
+func NewOIDCProvider(issuer, clientID, clientSecret, redirectURL string) (*OIDCProvider, error) {
+	if _, err := url.Parse(issuer); err != nil || !strings.HasPrefix(issuer, "http") {
+		return nil, fmt.Errorf("Illegal OIDC issuer URL %q", issuer)
+	}
+	if clientID == "" {
+		return nil, fmt.Errorf("OIDC requires the client ID registered with the provider")
+	}
+	return &OIDCProvider{
+		Issuer:       strings.TrimRight(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		logins:       make(map[string]pendingLogin),
+	}, nil
+}
+
+// getJSON decodes the JSON response of a GET request to the provider.
+func getJSON(address string, v interface{}) error {
+	resp, err := oidcClient.Get(address)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request %s returned status %s", address, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("Unable to decode response of %s: %s", address, err.Error())
+	}
+	return nil
+}
+
+// endpoints returns the provider's discovery document, which is fetched on first use.
+func (p *OIDCProvider) endpoints() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	discovery := new(oidcDiscovery)
+	if err := getJSON(p.Issuer+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(discovery.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("OIDC provider identifies itself as %q, not %q", discovery.Issuer, p.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC provider %s does not give its authorization, token, and key endpoints",
+			p.Issuer)
+	}
+	p.discovery = discovery
+	return discovery, nil
+}
+
+// signingKey returns the provider's RSA key with the given ID.  Keys are fetched again
+// if the ID is unknown, since providers rotate their keys.
+func (p *OIDCProvider) signingKey(kid string) (*rsa.PublicKey, error) {
+	discovery, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, found := p.keys[kid]; found {
+		return key, nil
+	}
+	if time.Since(p.keysTime) < keyRefreshInterval {
+		return nil, fmt.Errorf("ID token signed by unknown key %q", kid)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			dvid.Log(dvid.Normal, "Ignoring malformed key %q of OIDC provider %s\n", jwk.Kid, p.Issuer)
+			continue
+		}
+		var exponent int
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+	}
+	p.keys = keys
+	p.keysTime = time.Now()
+	if key, found := p.keys[kid]; found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("ID token signed by unknown key %q", kid)
+}
+
+// VerifyIDToken checks the signature, issuer, audience, and lifetime of an ID token
+// and returns its claims.  If nonce is not empty, the token must hold it.
+func (p *OIDCProvider) VerifyIDToken(rawToken, nonce string) (*IDClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("ID token is not a signed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, fmt.Errorf("ID token has malformed header")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("ID token signed with unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("ID token has malformed signature")
+	}
+	key, err := p.signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("ID token signature is not valid")
+	}
+
+	claims := new(IDClaims)
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, claims) != nil {
+		return nil, fmt.Errorf("ID token has malformed claims")
+	}
+	now := time.Now()
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.Issuer:
+		return nil, fmt.Errorf("ID token issued by %q, not %q", claims.Issuer, p.Issuer)
+	case !claims.hasAudience(p.ClientID):
+		return nil, fmt.Errorf("ID token is not intended for this server")
+	case !now.Before(time.Unix(claims.Expires, 0).Add(clockSkew)):
+		return nil, fmt.Errorf("ID token expired")
+	case claims.IssuedAt != 0 && now.Add(clockSkew).Before(time.Unix(claims.IssuedAt, 0)):
+		return nil, fmt.Errorf("ID token issued in the future")
+	case nonce != "" && subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("ID token was not issued for this sign-in")
+	case claims.User() == "":
+		return nil, fmt.Errorf("ID token does not identify a user")
+	}
+	return claims, nil
+}
+
+// randomString returns a random hexadecimal string for states and nonces.
+func randomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// redirectURL returns the URL the provider redirects browsers to after sign-in.
+func (p *OIDCProvider) redirectURL(r *http.Request) string {
+	if p.RedirectURL != "" {
+		return p.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + WebAPIPath + "login/callback"
+}
+
+// localPath returns a path on this server to return a browser to after sign-in,
+// which cannot redirect the browser to another site.
+func localPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+// startLogin records a sign-in and returns the URL of the provider's sign-in page.
+func (p *OIDCProvider) startLogin(r *http.Request, state string) (string, error) {
+	discovery, err := p.endpoints()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	now := time.Now()
+	for s, login := range p.logins {
+		if now.Sub(login.started) > loginTimeout {
+			delete(p.logins, s)
+		}
+	}
+	p.logins[state] = pendingLogin{nonce: nonce, redirect: localPath(r.URL.Query().Get("redirect")), started: now}
+	p.mu.Unlock()
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.redirectURL(r))
+	params.Set("scope", "openid email profile")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return discovery.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// finishLogin exchanges the authorization code given to the callback of a sign-in for
+// an ID token and returns its verified claims and where to send the browser.
+func (p *OIDCProvider) finishLogin(r *http.Request, state, code string) (*IDClaims, string, error) {
+	p.mu.Lock()
+	login, found := p.logins[state]
+	delete(p.logins, state)
+	p.mu.Unlock()
+	if !found || time.Since(login.started) > loginTimeout {
+		return nil, "", fmt.Errorf("Sign-in is unknown or took longer than %s", loginTimeout)
+	}
+	discovery, err := p.endpoints()
+	if err != nil {
+		return nil, "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL(r))
+	form.Set("client_id", p.ClientID)
+	form.Set("client_secret", p.ClientSecret)
+	resp, err := oidcClient.PostForm(discovery.TokenEndpoint, form)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.Unmarshal(body, &tokens); err != nil {
+		return nil, "", fmt.Errorf("Unable to decode token response of OIDC provider (status %s)", resp.Status)
+	}
+	if tokens.Error != "" || tokens.IDToken == "" {
+		return nil, "", fmt.Errorf("OIDC provider did not issue an ID token: %s %s", tokens.Error,
+			tokens.ErrorDescription)
+	}
+	claims, err := p.VerifyIDToken(tokens.IDToken, login.nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	return claims, login.redirect, nil
+}
+
+// setCookie sets or, with an empty value, clears a cookie readable only by this server.
+func setCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(maxAge.Seconds()),
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// issueOIDCToken issues a DVID token to the user of verified claims.
+func issueOIDCToken(claims *IDClaims, note string) (string, *datastore.AuthToken, error) {
+	if runningService.Service == nil {
+		return "", nil, fmt.Errorf("Datastore service has not been started on this server.")
+	}
+	return runningService.IssueToken(claims.User(), false, OIDCTokenTTL, note)
+}
+
+// loginRequest handles sign-in through the OIDC provider.
+//
+//	GET  <api URL>/login[?redirect=<path>]  (sends the browser to the provider's sign-in)
+//	GET  <api URL>/login/callback           (the provider's redirect after sign-in)
+//	POST <api URL>/login/token              (exchanges an ID token in the Authorization
+//	                                         header for a DVID token)
+func loginRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	if OIDC == nil {
+		BadRequest(w, r, "Sign-in through an OIDC provider is not configured on this server")
+		return
+	}
+	action := strings.ToLower(r.Method)
+	switch {
+	case (len(parts) == 0 || parts[0] == "") && action == "get":
+		state, err := randomString()
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		authURL, err := OIDC.startLogin(r, state)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		setCookie(w, r, stateCookie, state, loginTimeout)
+		http.Redirect(w, r, authURL, http.StatusFound)
+
+	case len(parts) == 1 && parts[0] == "callback" && action == "get":
+		query := r.URL.Query()
+		if errStr := query.Get("error"); errStr != "" {
+			BadRequest(w, r, fmt.Sprintf("Sign-in failed: %s %s", errStr, query.Get("error_description")))
+			return
+		}
+		state := query.Get("state")
+		cookie, err := r.Cookie(stateCookie)
+		if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+			BadRequest(w, r, "Sign-in was not started by this browser")
+			return
+		}
+		setCookie(w, r, stateCookie, "", 0)
+		claims, redirect, err := OIDC.finishLogin(r, state, query.Get("code"))
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		secret, token, err := issueOIDCToken(claims, "Browser session")
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		audit(token.User, "signed in with token %s from %s", token.ID, r.RemoteAddr)
+		setCookie(w, r, SessionCookie, secret, OIDCTokenTTL)
+		http.Redirect(w, r, redirect, http.StatusFound)
+
+	case len(parts) == 1 && parts[0] == "token" && action == "post":
+		claims, err := OIDC.VerifyIDToken(requestToken(r), "")
+		if err != nil {
+			errorMsg := fmt.Sprintf("ERROR exchanging ID token: %s (%s).\n", err.Error(), r.URL.Path)
+			dvid.Log(dvid.Normal, errorMsg)
+			http.Error(w, errorMsg, http.StatusUnauthorized)
+			return
+		}
+		secret, token, err := issueOIDCToken(claims, "Exchanged ID token")
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		audit(token.User, "exchanged ID token for token %s from %s", token.ID, r.RemoteAddr)
+		m, err := json.Marshal(struct {
+			Token string
+			*datastore.AuthToken
+		}{secret, token})
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		BadRequest(w, r, "Sign in with GET "+WebAPIPath+"login or exchange an ID token with POST "+
+			WebAPIPath+"login/token")
+	}
+}
+
+// logoutRequest ends a browser session by revoking its token and clearing its cookie.
+//
+//	POST <api URL>/logout
+func logoutRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) != "post" {
+		BadRequest(w, r, "Sign out with POST "+WebAPIPath+"logout")
+		return
+	}
+	if cookie, err := r.Cookie(SessionCookie); err == nil && runningService.Service != nil {
+		if token, err := runningService.Authenticate(cookie.Value); err == nil {
+			if err = runningService.RevokeToken(token.ID); err != nil {
+				BadRequest(w, r, err.Error())
+				return
+			}
+			audit(token.User, "signed out of token %s from %s", token.ID, r.RemoteAddr)
+		}
+	}
+	setCookie(w, r, SessionCookie, "", 0)
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "Signed out")
+}
@@ -0,0 +1,279 @@
+/*
+	This file supports a mirror mode where requests for data this server does not hold,
+	or for data configured to be proxied, are forwarded to an upstream DVID server.
+	Public GET responses are cached locally: data at committed nodes is served from the
+	cache without contacting the upstream, and other cached data is revalidated with its
+	ETag, so satellite sites get fast reads of central data without a full replica.
+*/
+
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	// Upstream is the web address of a DVID server to which requests for unknown nodes
+	// and data are forwarded.  If empty, nothing is proxied.
+	Upstream string
+
+	// ProxiedData names data instances whose requests are always forwarded to the
+	// upstream server, even if this server has data of the same name.
+	ProxiedData = make(map[dvid.DataString]bool)
+
+	// ProxyCacheBytes is the maximum size of cached upstream responses.
+	ProxyCacheBytes int64 = 512 * dvid.Mega
+
+	// UpstreamToken is the DVID token sent to the upstream server with every proxied
+	// request.  Credentials of the clients of this server are never forwarded.
+	UpstreamToken string
+)
+
+// UpstreamTokenEnv is the environment variable that can hold UpstreamToken so it does
+// not appear in the server's command line.
+const UpstreamTokenEnv = "DVID_UPSTREAM_TOKEN"
+
+// proxyClient sends requests to the upstream server.
+var proxyClient = &http.Client{}
+
+// hopHeaders are headers that apply to a single connection and are not forwarded.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te",
+	"Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// credentialHeaders are request headers with credentials of clients of this server,
+// which are not forwarded upstream, and response headers setting credentials for the
+// upstream server, which are not relayed to clients.
+var credentialHeaders = []string{"Authorization", "Cookie", "Set-Cookie", UserHeader}
+
+// removeHopHeaders deletes the hop-by-hop headers, including those named by the
+// Connection header, and the credential headers.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	for _, name := range credentialHeaders {
+		header.Del(name)
+	}
+}
+
+// proxyResponse is a cached upstream response.
+type proxyResponse struct {
+	key         string
+	contentType string
+	etag        string
+	immutable   bool
+	body        []byte
+}
+
+// proxyCache is a bounded LRU of upstream responses.
+type proxyCache struct {
+	sync.Mutex
+	bytes   int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+var upstreamCache = &proxyCache{order: list.New(), entries: make(map[string]*list.Element)}
+
+func (c *proxyCache) get(key string) *proxyResponse {
+	c.Lock()
+	defer c.Unlock()
+	elem, found := c.entries[key]
+	if !found {
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*proxyResponse)
+}
+
+func (c *proxyCache) put(resp *proxyResponse) {
+	size := int64(len(resp.body))
+	if size > ProxyCacheBytes {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if elem, found := c.entries[resp.key]; found {
+		c.remove(elem)
+	}
+	c.entries[resp.key] = c.order.PushFront(resp)
+	c.bytes += size
+	for c.bytes > ProxyCacheBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove deletes an entry.  The cache must be locked.
+func (c *proxyCache) remove(elem *list.Element) {
+	resp := elem.Value.(*proxyResponse)
+	c.order.Remove(elem)
+	delete(c.entries, resp.key)
+	c.bytes -= int64(len(resp.body))
+}
+
+// proxyUnknownNode returns true if a request for a node with the given UUID string,
+// which failed to match a local node, should be forwarded upstream.
+func proxyUnknownNode(err error) bool {
+	if Upstream == "" {
+		return false
+	}
+	_, ambiguous := err.(*datastore.AmbiguousUUIDError)
+	return !ambiguous
+}
+
+// proxyData returns true if a request for the named data, which may not exist
+// locally, should be forwarded upstream.
+func proxyData(uuid dvid.UUID, dataname dvid.DataString) bool {
+	if Upstream == "" {
+		return false
+	}
+	if ProxiedData[dataname] {
+		return true
+	}
+	_, err := runningService.DataServiceByUUID(uuid, dataname)
+	return err != nil
+}
+
+// upstreamURL returns the upstream URL of a request.
+func upstreamURL(r *http.Request) string {
+	remote := Upstream
+	if !strings.HasPrefix(remote, "http://") && !strings.HasPrefix(remote, "https://") {
+		remote = "http://" + remote
+	}
+	url := strings.TrimRight(remote, "/") + r.URL.Path
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
+	return url
+}
+
+// proxyRequest forwards a request to the upstream server and relays its response.
+// Public GET responses with an ETag are cached.
+func proxyRequest(w http.ResponseWriter, r *http.Request) {
+	method := strings.ToUpper(r.Method)
+	key := r.URL.RequestURI()
+	var cached *proxyResponse
+	if method == "GET" {
+		cached = upstreamCache.get(key)
+		if cached != nil && cached.immutable {
+			writeProxyResponse(w, r, cached, "hit")
+			return
+		}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), method, upstreamURL(r), r.Body)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	req.ContentLength = r.ContentLength
+	for header, values := range r.Header {
+		req.Header[header] = values
+	}
+	removeHopHeaders(req.Header)
+	if UpstreamToken != "" {
+		req.Header.Set("Authorization", "Bearer "+UpstreamToken)
+	}
+	// The transport negotiates its own compression and responses are compressed for
+	// the client by this server.
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("If-None-Match")
+	if cached != nil {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Add("X-Forwarded-For", host)
+	}
+
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		dvid.Error("Unable to proxy %s %s to %s: %s", method, r.URL.Path, Upstream, err.Error())
+		http.Error(w, fmt.Sprintf("Unable to reach upstream server %s (%s).\n", Upstream, r.URL.Path),
+			http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		writeProxyResponse(w, r, cached, "revalidated")
+		return
+	}
+	cacheControl := resp.Header.Get("Cache-Control")
+	etag := resp.Header.Get("ETag")
+	if method == "GET" && resp.StatusCode == http.StatusOK && etag != "" &&
+		strings.Contains(cacheControl, "public") && resp.ContentLength <= ProxyCacheBytes {
+
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, ProxyCacheBytes+1))
+		if err != nil {
+			dvid.Error("Error reading proxied response for %s: %s", r.URL.Path, err.Error())
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if int64(len(body)) <= ProxyCacheBytes {
+			response := &proxyResponse{
+				key:         key,
+				contentType: resp.Header.Get("Content-Type"),
+				etag:        etag,
+				immutable:   strings.Contains(cacheControl, "immutable"),
+				body:        body,
+			}
+			upstreamCache.put(response)
+			writeProxyResponse(w, r, response, "miss")
+			return
+		}
+		resp.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), resp.Body))
+	}
+
+	header := w.Header()
+	for name, values := range resp.Header {
+		header[name] = values
+	}
+	removeHopHeaders(header)
+	header.Del("Content-Length")
+	header.Set("X-Dvid-Proxy", "bypass")
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		dvid.Log(dvid.Debug, "Error relaying proxied response for %s: %s\n", r.URL.Path, err.Error())
+	}
+}
+
+// writeProxyResponse replies with a cached upstream response, or a 304 if the client's
+// copy is current.
+func writeProxyResponse(w http.ResponseWriter, r *http.Request, resp *proxyResponse, status string) {
+	header := w.Header()
+	header.Set("ETag", resp.etag)
+	if resp.immutable {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", ImmutableMaxAge))
+	} else {
+		header.Set("Cache-Control", "public, no-cache")
+	}
+	header.Set("X-Dvid-Proxy", status)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, resp.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if resp.contentType != "" {
+		header.Set("Content-Type", resp.contentType)
+	}
+	w.Write(resp.body)
+}
@@ -0,0 +1,327 @@
+/*
+	This file supports per-client rate limits and load shedding, so one runaway client
+	cannot starve everyone else.  Clients are identified by their authenticated user
+	or, without authentication, their IP address.  Each client has token buckets for
+	requests and bytes per second, and clients over their limits get 429 replies.
+	Independently, a global cap on concurrent HTTP requests sheds excess load with 503
+	replies after a short wait.
+*/
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	// RequestRate is the maximum HTTP and RPC requests per second of each client.  If 0,
+	// requests are unlimited.
+	RequestRate float64
+
+	// ByteRate is the maximum bytes per second of request and response bodies of each
+	// HTTP client.  If 0, bytes are unlimited.
+	ByteRate float64
+
+	// MaxConcurrentRequests is the maximum number of HTTP API requests handled at once.
+	// If 0, concurrency is unlimited.
+	MaxConcurrentRequests int
+
+	// ShedWait is how long a request waits for one of the MaxConcurrentRequests slots
+	// before it is rejected.
+	ShedWait = 2 * time.Second
+)
+
+// RateBurstSecs is the number of seconds of the rate limits a client can use in a burst.
+const RateBurstSecs = 2
+
+// clientIdleTime is how long a client's buckets are kept after its last request.
+const clientIdleTime = 10 * time.Minute
+
+// tokenBucket holds up to RateBurstSecs seconds of a rate.  The level can go negative
+// when a client uses more bytes than it has, so it must wait for the deficit to refill.
+type tokenBucket struct {
+	level float64
+	last  time.Time
+}
+
+// refill adds tokens accumulated since the last refill at the given rate.
+func (b *tokenBucket) refill(rate float64, now time.Time) {
+	if b.last.IsZero() {
+		b.level = rate * RateBurstSecs
+	} else {
+		b.level = math.Min(rate*RateBurstSecs, b.level+rate*now.Sub(b.last).Seconds())
+	}
+	b.last = now
+}
+
+// wait returns the time until the bucket holds at least the given tokens.
+func (b *tokenBucket) wait(tokens, rate float64) time.Duration {
+	if b.level >= tokens {
+		return 0
+	}
+	return time.Duration((tokens - b.level) / rate * float64(time.Second))
+}
+
+// clientLimits are the buckets of a client.
+type clientLimits struct {
+	requests tokenBucket
+	bytes    tokenBucket
+}
+
+// rateLimiter holds the buckets of recently active clients.
+type rateLimiter struct {
+	sync.Mutex
+	clients   map[string]*clientLimits
+	lastSweep time.Time
+}
+
+var limiter = rateLimiter{clients: make(map[string]*clientLimits)}
+
+// client returns the buckets of a client refilled to the given time, forgetting idle
+// clients.  The limiter must be locked.
+func (l *rateLimiter) client(key string, now time.Time) *clientLimits {
+	if now.Sub(l.lastSweep) > clientIdleTime {
+		for k, c := range l.clients {
+			if now.Sub(c.requests.last) > clientIdleTime && now.Sub(c.bytes.last) > clientIdleTime {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	c, found := l.clients[key]
+	if !found {
+		c = new(clientLimits)
+		l.clients[key] = c
+	}
+	if RequestRate > 0 {
+		c.requests.refill(RequestRate, now)
+	}
+	if ByteRate > 0 {
+		c.bytes.refill(ByteRate, now)
+	}
+	return c
+}
+
+// allow takes a request token for a client.  If the client is over its limits, it
+// returns false and the time until it may try again.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if RequestRate <= 0 && ByteRate <= 0 {
+		return true, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	c := l.client(key, time.Now())
+	var retry time.Duration
+	if RequestRate > 0 {
+		retry = c.requests.wait(1, RequestRate)
+	}
+	if ByteRate > 0 {
+		if wait := c.bytes.wait(0, ByteRate); wait > retry {
+			retry = wait
+		}
+	}
+	if retry > 0 {
+		return false, retry
+	}
+	if RequestRate > 0 {
+		c.requests.level--
+	}
+	return true, 0
+}
+
+// consume takes tokens for bytes transferred by a client.
+func (l *rateLimiter) consume(key string, numBytes int64) {
+	if ByteRate <= 0 || numBytes == 0 {
+		return
+	}
+	l.Lock()
+	c := l.client(key, time.Now())
+	c.bytes.level -= float64(numBytes)
+	l.Unlock()
+}
+
+// clientKey identifies the client of a request by its authenticated user or, without
+// authentication, its IP address.
+func clientKey(r *http.Request) string {
+	if AuthRequired {
+		return "user:" + r.Header.Get(UserHeader)
+	}
+	return "ip:" + remoteHost(r.RemoteAddr)
+}
+
+// remoteHost returns the host of a client's address.
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// maxErrorText is the number of bytes of an error reply kept by a countingWriter.
+const maxErrorText = 512
+
+// countingWriter counts the bytes of a response body and records its status and, for
+// errors, the start of its body.
+type countingWriter struct {
+	http.ResponseWriter
+	written   int64
+	status    int
+	errorText []byte
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && len(w.errorText) < maxErrorText {
+		keep := maxErrorText - len(w.errorText)
+		if keep > len(b) {
+			keep = len(b)
+		}
+		w.errorText = append(w.errorText, b[:keep]...)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush supports streaming responses.
+func (w *countingWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// CloseNotify supports streaming responses that end when the client disconnects.
+func (w *countingWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
+// Hijack supports upgrades to WebSockets.
+func (w *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Connection cannot be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// concurrencySlots limits the HTTP API requests handled at once.
+var (
+	concurrencySlots     chan struct{}
+	concurrencySlotsOnce sync.Once
+)
+
+// acquireSlot waits up to ShedWait for a concurrency slot and returns false if none
+// became available.
+func acquireSlot() bool {
+	if MaxConcurrentRequests <= 0 {
+		return true
+	}
+	concurrencySlotsOnce.Do(func() {
+		concurrencySlots = make(chan struct{}, MaxConcurrentRequests)
+	})
+	select {
+	case concurrencySlots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(ShedWait)
+	defer timer.Stop()
+	select {
+	case concurrencySlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func releaseSlot() {
+	if MaxConcurrentRequests > 0 {
+		<-concurrencySlots
+	}
+}
+
+// retryAfter sets the Retry-After header to whole seconds, at least one.
+func retryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(math.Max(1, wait.Seconds())))))
+}
+
+// limitHandler wraps an authenticated HTTP handler so requests are rejected if their
+// client is over its rate limits or if the server is at its concurrency cap.  Batch
+// requests take no concurrency slot and count no bytes, since each of their requests
+// is limited itself.
+func limitHandler(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if connectionOverLimit(r) {
+			w.Header().Set("Connection", "close")
+			Unavailable(w, r, fmt.Sprintf("server is at its limit of %d connections", MaxConnections), ShedWait)
+			return
+		}
+		key := clientKey(r)
+		if ok, wait := limiter.allow(key); !ok {
+			errorMsg := fmt.Sprintf("ERROR: rate limit exceeded by %s, retry in %s (%s).\n", key, wait, r.URL.Path)
+			dvid.Log(dvid.Debug, errorMsg)
+			retryAfter(w, wait)
+			http.Error(w, errorMsg, http.StatusTooManyRequests)
+			return
+		}
+		if r.URL.Path == WebAPIPath+"batch" {
+			handler(w, r)
+			return
+		}
+		if !acquireSlot() {
+			Unavailable(w, r, fmt.Sprintf("server is at its limit of %d concurrent requests",
+				MaxConcurrentRequests), ShedWait)
+			return
+		}
+		defer releaseSlot()
+
+		// Share the counts of an access-logged request.
+		counter, ok := w.(*countingWriter)
+		if !ok {
+			counter = &countingWriter{ResponseWriter: w}
+		}
+		before := counter.written
+		handler(counter, r)
+		received := r.ContentLength
+		if received < 0 {
+			received = 0
+		}
+		limiter.consume(key, received+counter.written-before)
+	}
+}
+
+// checkRPCRate returns an error if the client of an RPC command, identified by its
+// token's user or, without authentication, its address, is over the request rate.
+func checkRPCRate(token *datastore.AuthToken, remoteAddr string) error {
+	key := "ip:" + remoteHost(remoteAddr)
+	if token != nil {
+		key = "user:" + token.User
+	}
+	if ok, wait := limiter.allow(key); !ok {
+		return fmt.Errorf("Rate limit exceeded by %s, retry in %s", key, wait)
+	}
+	return nil
+}
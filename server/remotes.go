@@ -0,0 +1,191 @@
+/*
+	This file supports listing the datasets of peer DVID servers, e.g., at other sites of
+	a lab, alongside those of this server.  Peers are given by their web addresses, and
+	their datasets are read through the HTTP API each time a listing is requested.  Only
+	the datasets of this server readable by the requesting user are listed, and peers
+	list the datasets readable by the user of RemotesToken.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	// Remotes are the web addresses of peer DVID servers whose datasets are listed with
+	// this server's.  Addresses without a scheme use https.
+	Remotes []string
+
+	// RemotesToken is the DVID token sent to peer servers requiring authentication.  It
+	// is only sent over https.  Credentials of the clients of this server are never
+	// forwarded.
+	RemotesToken string
+)
+
+// maxRemoteListing is the maximum size of the datasets listing read from a peer server.
+const maxRemoteListing = 16 * dvid.Mega
+
+// remoteClient requests the datasets of peer servers.  Unreachable peers are reported
+// after the timeout so they do not hold up the listing.
+var remoteClient = &http.Client{Timeout: 10 * time.Second}
+
+// RemoteDataset describes a dataset held by a server.
+type RemoteDataset struct {
+	Root  dvid.UUID
+	Alias string
+	Data  []dvid.DataString
+}
+
+// RemoteListing gives the datasets of a server or the error reading them.
+type RemoteListing struct {
+	Server   string
+	Local    bool `json:",omitempty"`
+	Datasets []RemoteDataset
+	Error    string `json:",omitempty"`
+}
+
+// remoteURL returns the URL of an HTTP API endpoint on a server given by its web address.
+func remoteURL(remote, endpoint string) string {
+	if !strings.HasPrefix(remote, "http://") && !strings.HasPrefix(remote, "https://") {
+		remote = "https://" + remote
+	}
+	return strings.TrimRight(remote, "/") + WebAPIPath + endpoint
+}
+
+// parseDatasets returns the datasets described by the JSON of a datasets info request.
+func parseDatasets(data []byte) ([]RemoteDataset, error) {
+	var info struct {
+		Datasets []struct {
+			Root    dvid.UUID
+			Alias   string
+			DataMap map[dvid.DataString]json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("Unable to decode datasets: %s", err.Error())
+	}
+	datasets := []RemoteDataset{}
+	for _, dataset := range info.Datasets {
+		names := []dvid.DataString{}
+		for name := range dataset.DataMap {
+			names = append(names, name)
+		}
+		sort.Sort(dataNames(names))
+		datasets = append(datasets, RemoteDataset{dataset.Root, dataset.Alias, names})
+	}
+	return datasets, nil
+}
+
+type dataNames []dvid.DataString
+
+func (n dataNames) Len() int           { return len(n) }
+func (n dataNames) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n dataNames) Less(i, j int) bool { return n[i] < n[j] }
+
+// fetchRemoteDatasets reads the datasets of a peer server.
+func fetchRemoteDatasets(remote string) ([]RemoteDataset, error) {
+	url := remoteURL(remote, "datasets/info")
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if RemotesToken != "" && strings.HasPrefix(url, "https://") {
+		req.Header.Set("Authorization", "Bearer "+RemotesToken)
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteListing+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRemoteListing {
+		return nil, fmt.Errorf("Server replied with more than %d bytes", maxRemoteListing)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Server replied with status %d: %s", resp.StatusCode,
+			strings.TrimSpace(string(data)))
+	}
+	return parseDatasets(data)
+}
+
+// RemotesListing returns the datasets of this server readable by the given user, or all
+// of them for an admin, followed by those of each peer server in Remotes.
+func RemotesListing(admin bool, user string) ([]RemoteListing, error) {
+	jsonStr, err := datasetsJSON(true, admin, user)
+	if err != nil {
+		return nil, err
+	}
+	local, err := parseDatasets([]byte(jsonStr))
+	if err != nil {
+		return nil, err
+	}
+	listings := []RemoteListing{{Server: runningService.WebAddress, Local: true, Datasets: local}}
+	return append(listings, remoteListings(Remotes)...), nil
+}
+
+// remoteListings returns the datasets of the given peer servers, which are requested
+// concurrently.  Peers that can't be read are listed with their error.
+func remoteListings(remotes []string) []RemoteListing {
+	listings := make([]RemoteListing, len(remotes))
+	var wg sync.WaitGroup
+	for i, remote := range remotes {
+		wg.Add(1)
+		go func(listing *RemoteListing, remote string) {
+			defer wg.Done()
+			listing.Server = remote
+			datasets, err := fetchRemoteDatasets(remote)
+			if err != nil {
+				dvid.Log(dvid.Debug, "Unable to list datasets of remote %s: %s\n", remote, err.Error())
+				listing.Error = err.Error()
+				listing.Datasets = []RemoteDataset{}
+				return
+			}
+			listing.Datasets = datasets
+		}(&listings[i], remote)
+	}
+	wg.Wait()
+	return listings
+}
+
+// RemotesJSON returns JSON of the datasets of this server readable by the given user,
+// or all of them for an admin, and of its peer servers.
+func RemotesJSON(admin bool, user string) (string, error) {
+	listings, err := RemotesListing(admin, user)
+	if err != nil {
+		return "", err
+	}
+	m, err := json.Marshal(listings)
+	if err != nil {
+		return "", err
+	}
+	return string(m), nil
+}
+
+// remotesRequest handles GET of the datasets of this server and its peer servers.
+func remotesRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Remotes request must be made with HTTP GET method")
+		return
+	}
+	jsonStr, err := RemotesJSON(isAdmin(r), r.Header.Get(UserHeader))
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, jsonStr)
+}
@@ -0,0 +1,264 @@
+/*
+	This file supports push and pull replication of versions between DVID servers.  The
+	receiving server reports what it holds of a dataset, and the sending server streams
+	only the nodes and key/value pairs the receiver is missing.  Replication requests
+	between servers are authenticated by a key shared by the servers.
+*/
+
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// ReplicationKey is the key shared by servers that authenticates replication requests.
+// Replication is disabled if it is empty.
+var ReplicationKey string
+
+// replicationClient sends replication requests.  It has no timeout since replication
+// streams can take hours for large datasets.
+var replicationClient = &http.Client{}
+
+// ReplicationResult gives the number of nodes and key/value pairs transferred by a
+// push or pull.
+type ReplicationResult struct {
+	Nodes int
+	Keys  int
+}
+
+// pullRequest is the JSON body of a pull request, giving what the pulling server holds
+// of the dataset and the names of data to pull, or none for all data.
+type pullRequest struct {
+	State *datastore.ReplicaState
+	Data  []dvid.DataString
+}
+
+// replicationURL returns the URL of a replication endpoint on a remote server given
+// by its web address, which is served over https unless it gives another scheme.
+func replicationURL(remote, endpoint string) string {
+	if !strings.HasPrefix(remote, "http://") && !strings.HasPrefix(remote, "https://") {
+		remote = "https://" + remote
+	}
+	return strings.TrimRight(remote, "/") + WebAPIPath + "replicate/" + endpoint
+}
+
+// authorizeReplication returns an error unless a request holds the replication key.
+func authorizeReplication(r *http.Request) error {
+	if ReplicationKey == "" {
+		return fmt.Errorf("Replication is disabled on this server.  Start it with -replkey.")
+	}
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(ReplicationKey)) != 1 {
+		return fmt.Errorf("Replication request is not authorized")
+	}
+	return nil
+}
+
+// sendReplication sends a replication request holding the replication key to a remote
+// server and returns its response if successful.  Requests must use https so the key is
+// never sent in cleartext.
+func sendReplication(method, url string, body io.Reader) (*http.Response, error) {
+	if ReplicationKey == "" {
+		return nil, fmt.Errorf("Replication is disabled on this server.  Start it with -replkey.")
+	}
+	if !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("Replication requires https so the replication key is not sent in cleartext: %s", url)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+ReplicationKey)
+	resp, err := replicationClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("Replication request %s returned status %s: %s", url, resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// remoteReplicaState returns what a remote server holds of the dataset with a node of
+// the given UUID.
+func remoteReplicaState(remote string, uuid dvid.UUID) (*datastore.ReplicaState, error) {
+	resp, err := sendReplication("GET", replicationURL(remote, string(uuid)+"/state"), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	state := new(datastore.ReplicaState)
+	if err = json.NewDecoder(resp.Body).Decode(state); err != nil {
+		return nil, fmt.Errorf("Unable to decode replica state from %s: %s", remote, err.Error())
+	}
+	return state, nil
+}
+
+// Push sends a LOCKED node and its ancestors with the named data, or all data, to the
+// remote server with the given web address.  Only the nodes and key/value pairs the
+// remote is missing are sent.
+func Push(remote string, uuid dvid.UUID, datanames []dvid.DataString) (*ReplicationResult, error) {
+	if runningService.Service == nil {
+		return nil, fmt.Errorf("Datastore service has not been started on this server.")
+	}
+	local, err := runningService.ReplicaState(uuid)
+	if err != nil {
+		return nil, err
+	}
+	state, err := remoteReplicaState(remote, local.Root)
+	if err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		_, _, err := runningService.WriteReplication(writer, uuid, state, datanames)
+		writer.CloseWithError(err)
+	}()
+	resp, err := sendReplication("POST", replicationURL(remote, "push"), reader)
+	if err != nil {
+		reader.CloseWithError(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	reader.Close()
+	result := new(ReplicationResult)
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("Unable to decode push result from %s: %s", remote, err.Error())
+	}
+	return result, nil
+}
+
+// Pull fetches a LOCKED node and its ancestors with the named data, or all data, from
+// the remote server with the given web address.  Only the nodes and key/value pairs
+// this server is missing are sent.
+func Pull(remote string, uuid dvid.UUID, datanames []dvid.DataString) (*ReplicationResult, error) {
+	if runningService.Service == nil {
+		return nil, fmt.Errorf("Datastore service has not been started on this server.")
+	}
+	remoteState, err := remoteReplicaState(remote, uuid)
+	if err != nil {
+		return nil, err
+	}
+	if len(remoteState.Nodes) == 0 {
+		return nil, fmt.Errorf("Remote %s has no node %s", remote, uuid)
+	}
+	state, err := runningService.ReplicaState(remoteState.Root)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(pullRequest{State: state, Data: datanames})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sendReplication("POST", replicationURL(remote, string(uuid)+"/pull"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	numNodes, numKeys, err := runningService.ReadReplication(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplicationResult{Nodes: numNodes, Keys: numKeys}, nil
+}
+
+// replicationWriter records whether a replication stream has been started, after which
+// errors can no longer be sent as a response status.
+type replicationWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (rw *replicationWriter) Write(p []byte) (int, error) {
+	rw.written = true
+	return rw.w.Write(p)
+}
+
+// replicateRequest handles replication requests from other servers:
+//
+//	GET  <api URL>/replicate/<UUID>/state   (JSON state of the dataset with the node)
+//	POST <api URL>/replicate/push           (stores a replication stream)
+//	POST <api URL>/replicate/<UUID>/pull    (streams the node given a JSON pull request)
+//	     <api URL>/replicate/<UUID>/transfer/<data name>/...   (see transferRequest)
+func replicateRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	if err := authorizeReplication(r); err != nil {
+		dvid.Log(dvid.Normal, "Rejected replication request from %s: %s\n", r.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	action := strings.ToLower(r.Method)
+	switch {
+	case len(parts) == 1 && parts[0] == "push" && action == "post":
+		numNodes, numKeys, err := runningService.ReadReplication(r.Body)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		dvid.Log(dvid.Normal, "Received %d nodes and %d key/value pairs pushed from %s\n",
+			numNodes, numKeys, r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&ReplicationResult{Nodes: numNodes, Keys: numKeys})
+
+	case len(parts) == 2 && parts[1] == "state" && action == "get":
+		// Nodes this server does not hold are taken as the root of a missing dataset.
+		uuid, err := MatchingUUID(parts[0])
+		if _, ambiguous := err.(*datastore.AmbiguousUUIDError); ambiguous {
+			BadUUID(w, r, err)
+			return
+		} else if err != nil {
+			uuid = dvid.UUID(parts[0])
+		}
+		state, err := runningService.ReplicaState(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+
+	case len(parts) == 2 && parts[1] == "pull" && action == "post":
+		uuid, err := MatchingUUID(parts[0])
+		if err != nil {
+			BadUUID(w, r, err)
+			return
+		}
+		var pull pullRequest
+		if err = json.NewDecoder(r.Body).Decode(&pull); err != nil || pull.State == nil {
+			BadRequest(w, r, "Pull request must have a JSON body with the state of the replica")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		rw := &replicationWriter{w: w}
+		numNodes, numKeys, err := runningService.WriteReplication(rw, uuid, pull.State, pull.Data)
+		if err != nil {
+			if !rw.written {
+				BadRequest(w, r, err.Error())
+			} else {
+				dvid.Log(dvid.Normal, "Error streaming node %s pulled by %s: %s\n", uuid, r.RemoteAddr, err.Error())
+			}
+			return
+		}
+		dvid.Log(dvid.Normal, "Sent %d nodes and %d key/value pairs pulled by %s\n",
+			numNodes, numKeys, r.RemoteAddr)
+
+	case len(parts) == 4 && parts[1] == "transfer":
+		transferRequest(w, r, parts[0], parts[2], parts[3])
+
+	default:
+		BadRequest(w, r, "Replication requests are GET "+WebAPIPath+"replicate/<UUID>/state, POST "+
+			WebAPIPath+"replicate/push, or POST "+WebAPIPath+"replicate/<UUID>/pull")
+	}
+}
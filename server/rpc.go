@@ -5,9 +5,14 @@
 package server
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/janelia-flyem/dvid/datastore"
@@ -24,14 +29,169 @@ const RPCHelpMessage = `Commands executed on the server (rpc address = %s):
 	types <datatype name> help
 
 	datasets info
+	datasets all         (JSON of all datasets with their nodes and data)
 	datasets new         (returns UUID of dataset's root node)
 
+	remotes              (JSON of the datasets and their data of this server readable by the user
+	                      and of each peer server given by -remotes, with errors of unreachable peers)
+
+	jobs                 (lists running background jobs with their limits)
+	job <id>             (shows progress, log, and result of a running or recently finished
+	                      job; progress can be followed over HTTP at /api/job/<id>/events)
+	job <id> limits [workers=<number>] [iorate=<MB per second>]
+	                     (changes limits of a running job; omitted limits become unlimited.
+	                      Needs an admin token or the token of the user that started the job)
+
+	gc [dry-run] [workers=<number>] [iorate=<MB per second>]
+	                     (deletes data only reachable from abandoned nodes and reports reclaimed
+	                      bytes per data as JSON; dry-run only reports what would be reclaimed)
+
+	stats [<UUID>] [refresh=true]
+	                     (key counts, stored and estimated uncompressed bytes, blocks, extents,
+	                      and versions of all datasets, or the dataset with the UUID, and their
+	                      data as JSON; stats of locked nodes are kept so only unlocked nodes
+	                      are scanned again unless refresh=true)
+
+	compact [<UUID> [<data name>...]] [workers=<number>] [iorate=<MB per second>]
+	                     (compacts the storage engine to reclaim space of deleted and overwritten
+	                      values, e.g., after deleting data or gc; compacts the whole store, or the
+	                      given data, or all data, of the dataset with the UUID, and reports the
+	                      approximate stored bytes before and after)
+
+	verify <UUID> [<data name>...] [quarantine=true] [workers=<number>] [iorate=<MB per second>]
+	                     (checks the checksum, index, and version of every stored key/value pair
+	                      of the given data, or all data, of the dataset with the UUID and reports
+	                      corrupt and orphaned keys; quarantine=true moves them out of the data)
+
+	backup <path or URL> [<UUID> [<data name>...]] [workers=<number>] [iorate=<MB per second>]
+	                     (writes a tar archive of all versions of all datasets, or the dataset
+	                      with the UUID and its given data, with a manifest of versions, data,
+	                      and checksums to a new file on the server or with PUT to an http(s)
+	                      URL; the server keeps running and values come from a snapshot of the
+	                      store if the storage engine supports it)
+
+	restore <path> [<UUID> [<data name>...]] [subtree=true] [workers=<number>] [iorate=<MB per second>]
+	                     (restores datasets missing from this server from a backup archive on
+	                      the server, or only the dataset holding the node with the UUID and its
+	                      given data; subtree=true only restores the node, its descendants, and
+	                      their ancestors.  Nodes and data already on this server are kept.)
+
+	export <UUID> [<data name>...] <path> [workers=<number>] [iorate=<MB per second>]
+	                     (writes a portable tar archive of the given data, or all data, as
+	                      resolved at the node, with a manifest of their types, to a new file on
+	                      the server; another server can import it without this one's history)
+
+	import <path> [<UUID>] [workers=<number>] [iorate=<MB per second>]
+	                     (imports an export archive on the server as a new dataset, or adds its
+	                      data to the unlocked node with the UUID; data types must be compiled
+	                      into this server with compatible versions)
+
+	checkout <UUID> <path> [<data name>...]
+	                     (creates a new datastore at path with a single root node holding the
+	                      given data, or all data, as resolved at the node)
+
+	clone <UUID> <path> <data name> <min x,y,z> <max x,y,z>
+	                     (like checkout of one data but only copies the blocks within the box
+	                      of voxel coordinates, e.g., for laptops that can't hold the volume)
+
+	clone-data <UUID> <data name> <new data name> [dest=<UUID>] [min=<x,y,z> max=<x,y,z>] [roi=<path>]
+	                     (creates data with the new name and the same type and properties as the
+	                      given data, holding its values as resolved at the node, in the dataset
+	                      of the unlocked dest node, which defaults to the given node; min and
+	                      max limit the copy to a box of voxel coordinates, and roi to the blocks
+	                      listed as [[z, y, x0, x1], ...] in a JSON file on the server)
+
+	push <remote> <UUID> [<data name>...]
+	                     (sends locked node and its ancestors with the given data, or all data,
+	                      to the server at remote web address, e.g., host:8000; only nodes and
+	                      values the remote lacks are sent.  Both servers need the same -replkey,
+	                      and the remote must serve https, e.g., with -tlscert.)
+	pull <remote> <UUID> [<data name>...]
+	                     (like push but fetches the remote's locked node into this server)
+
+	tokens               (lists issued tokens as JSON)
+	token issue <user> [admin=true] [ttl=<duration, e.g., 720h>] [note=<text>]
+	                     (returns a new token for the user, which is shown only once)
+	token revoke <token ID>
+	                     (if the server was started with -auth, every request needs a token
+	                      set in the DVID_TOKEN environment variable; tokens can only be
+	                      managed with -auth and admin tokens, which are also needed for shutdown, gc,
+	                      compact, verify, backup, restore, export, import, checkout, push,
+	                      pull, clone, clone-data, migrate, and stats)
+
+	groups               (lists groups of users that can be given in ACLs as JSON)
+	group set <name> <user>...
+	group delete <name>  (groups are given in ACLs as @<name>; if the server was started with
+	                      -auth, groups can only be managed with admin tokens)
+
+	migrate keys [<key encoding>] [workers=<number>] [iorate=<MB per second>]
+	                     (rewrites data keys into the latest or given key encoding in the background;
+	                      refused while other jobs run, and data cannot be modified until keys
+	                      are copied)
+	migrate status       (shows the key encodings of the datastore and migration progress)
+
 	dataset <UUID> new <datatype name> <data name> <datatype-specific config>...
+	dataset <UUID> delete <data name>    (moves data to trash, restorable for %s)
+	dataset <UUID> delete <data name> purge=true [confirm=<nonce>] [async=true]
+	                     (permanently deletes data, even if in trash, and its key/value pairs;
+	                      without confirm, replies with a nonce to confirm the purge within
+	                      5 minutes; async=true deletes the key/value pairs in the background)
+	dataset <UUID> restore <data name>   (restores most recently deleted data of that name)
+	dataset <UUID> trash                 (lists deleted data)
+	dataset <UUID> uuids                 (lists UUIDs of all nodes in dataset as JSON)
+	dataset <UUID> webhook add <url> <event type>...
+	                                     (POSTs events of the given types as JSON to url in order,
+	                                      retrying failures; types are commit, branch, merge, and
+	                                      mutation.  url must be http or https and, unless the
+	                                      server runs with -privatehooks, not at a loopback,
+	                                      private, or link-local address)
+	dataset <UUID> webhook remove <url>
+	dataset <UUID> webhooks              (lists webhooks as JSON)
+	dataset <UUID> scratch <datatype name> <data name> <ttl> [<session>] <datatype-specific config>...
+	                                     (adds data only visible at node and reclaimed after ttl, e.g., 6h)
+	dataset <UUID> scratch               (lists scratch data)
+	dataset <UUID> profile [<stride>] [<prefix bytes>] [workers=<number>] [iorate=<MB per second>]
+	                                     (key count and size per data, version, and index range;
+	                                      a stride > 1 reads only every stride-th value)
+	dataset <UUID> convert <data name> <new data name> [workers=<#>] [iorate=<MB/s>] <datatype-specific config>...
+	                                     (converts data of a deprecated datatype into new data of
+	                                      its successor datatype in the background; the source data
+	                                      cannot be modified until the conversion is done)
+	dataset <UUID> conversions           (lists conversions and their progress)
+	dataset <UUID> acl show [<data name>]
+	dataset <UUID> acl set [<data name>] [readers=<name>,...] [writers=<name>,...]
+	                                     (limits reads and writes of dataset, or of data in place
+	                                      of the dataset's limits, to users and @groups; empty
+	                                      readers allows anyone to read, empty writers allows
+	                                      readers to write.  Admin tokens are not limited.)
+	dataset <UUID> acl clear [<data name>]
 	dataset <UUID> <data name> help
 
-	node <UUID> lock
-	node <UUID> branch   (returns UUID of new child node)
+	node <UUID> lock [author=<name>] [message=<log message>]
+	                     (makes node immutable; data of locked nodes cannot be modified)
+	node <UUID> commit [author=<name>] [message=<log message>]   (same as lock)
+	node <UUID> branch [author=<name>] [message=<log message>]
+	                     (returns UUID of new child node)
+	node <UUID> newversion [author=<name>] [message=<log message>]   (same as branch)
+	node <UUID> abandon  (marks node abandoned so 'gc' reclaims data only reachable from it)
+	node <UUID> merge <UUID>...   (returns UUID of new node whose parents are the given nodes)
+	node <UUID> fork     (returns root UUID of new dataset with a copy of the node's data)
+	node <UUID> restrict [branch=true] <user>...   (only given users may write data at node or branch)
+	node <UUID> unrestrict   (removes the node's write restriction)
+	node <UUID> permissions   (gives the write restriction that applies to node as JSON)
+	node <UUID> <data name> verify   (recomputes checksums for all versions of data)
+	node <UUID> <data name> changelog [<from offset>] [<max events>]   (reads logged events as JSON)
+	node <UUID> <data name> flatten   (copies data inherited from ancestors so node no longer depends on them)
+	node <UUID> <data name> diff <UUID> [values=true]   (lists indices changed between nodes as JSON)
+	node <UUID> <data name> rollback   (discards all changes of data at unlocked node, restoring its parent's state)
+	node <UUID> <data name> provenance <index>   (gives the node that last wrote a hexadecimal index as JSON)
+	node <UUID> <data name> changelog-truncate <before offset>   (deletes older logged events)
+	node <UUID> <data name> train-dictionary [<# samples>]   (compress with trained dictionary)
 	node <UUID> <data name> <type-specific commands>
+	                     (with -auth, the token's user is checked against write restrictions
+	                      of the node; otherwise requests are checked as the anonymous user)
+
+	A <UUID> can be any unique prefix of at least 3 characters of a node's UUID.
 
 %s
 
@@ -41,11 +201,22 @@ datastore:
 	http://%s
 `
 
-// RPCConnection will export all of its functions for rpc access.
-type RPCConnection struct{}
+// readOnlyRPC holds the type-specific RPC commands that do not modify data, so they
+// are allowed on locked nodes.
+var readOnlyRPC = map[string]bool{
+	"get":  true,
+	"help": true,
+	"info": true,
+}
+
+// RPCConnection will export all of its functions for rpc access.  Each client
+// connection has its own RPCConnection.
+type RPCConnection struct {
+	remoteAddr string
+}
 
 // Do acts as a switchboard for remote command execution
-func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) error {
+func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) (err error) {
 	if reply == nil {
 		dvid.Log(dvid.Debug, "reply is nil coming in!\n")
 		return nil
@@ -56,28 +227,50 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 	if runningService.Service == nil {
 		return fmt.Errorf("Datastore not open!  Cannot execute command.")
 	}
+	if !rpcRequests.begin() {
+		return errShuttingDown
+	}
+	defer rpcRequests.end()
+	start := time.Now()
+	defer func() {
+		logRPCAccess(cmd, reply, start, err)
+	}()
+	cmd.Command = withoutUser(cmd.Command)
+	token, err := authenticate(cmd.Token)
+	if err != nil {
+		return fmt.Errorf("Request not authenticated: %s", err.Error())
+	}
+	if token != nil {
+		cmd.Command = withUser(cmd.Command, token.User)
+	}
+	user, _, _ := cmd.Settings().GetString("user")
+	auditRPC(cmd.Command, user)
+	if err := checkRPCRate(token, c.remoteAddr); err != nil {
+		return err
+	}
+	if err := checkRPCAdmin(cmd, token); err != nil {
+		return err
+	}
+	if err := checkReadOnly(cmd); err != nil {
+		return err
+	}
 
 	switch cmd.Name() {
 
 	case "help":
 		reply.Text = fmt.Sprintf(RPCHelpMessage,
-			runningService.RPCAddress, runningService.SupportedDataChart(),
+			runningService.RPCAddress, datastore.TrashRetention, runningService.SupportedDataChart(),
 			runningService.WebAddress)
 
 	case "about":
 		reply.Text = fmt.Sprintf("%s\n", runningService.About())
 
 	case "shutdown":
-		Shutdown()
-		// Make this process shutdown in a second to allow time for RPC to finish.
-		// TODO -- Better way to do this?
-		log.Printf("DVID server halted due to 'shutdown' command.")
-		reply.Text = fmt.Sprintf("DVID server at %s has been halted.\n",
+		// Shut down after this command completes, since shutdown drains RPC commands.
+		log.Printf("DVID server halting due to 'shutdown' command.")
+		reply.Text = fmt.Sprintf("DVID server at %s is shutting down.\n",
 			runningService.RPCAddress)
-		go func() {
-			time.Sleep(1 * time.Second)
-			os.Exit(0)
-		}()
+		go Shutdown()
 
 	case "types":
 		if len(cmd.Command) == 1 {
@@ -99,14 +292,15 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 		var subcommand string
 		cmd.CommandArgs(1, &subcommand)
 		switch subcommand {
-		case "info":
-			jsonStr, err := runningService.DatasetsListJSON()
+		case "info", "all":
+			admin := token != nil && token.Admin
+			jsonStr, err := datasetsJSON(subcommand == "all", admin, user)
 			if err != nil {
 				return err
 			}
 			reply.Text = jsonStr
 		case "new":
-			uuid, _, err := runningService.NewDataset()
+			uuid, err := newDataset(token != nil && token.Admin, user)
 			if err != nil {
 				return err
 			}
@@ -115,6 +309,400 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 			return fmt.Errorf("Unknown datasets command: %q", subcommand)
 		}
 
+	case "remotes":
+		jsonStr, err := RemotesJSON(token != nil && token.Admin, user)
+		if err != nil {
+			return err
+		}
+		reply.Text = jsonStr
+
+	case "jobs":
+		jsonStr, err := datastore.JobsJSON()
+		if err != nil {
+			return err
+		}
+		reply.Text = jsonStr
+
+	case "job":
+		var idStr, subcommand string
+		cmd.CommandArgs(1, &idStr, &subcommand)
+		if subcommand == "" {
+			job, err := findJob(idStr)
+			if err != nil {
+				return err
+			}
+			m, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			reply.Text = string(m)
+			return nil
+		}
+		if subcommand != "limits" {
+			return fmt.Errorf("Unknown job command: %q", subcommand)
+		}
+		limits, err := setJobLimits(idStr, cmd.Settings(), user, token == nil || token.Admin)
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Job %s limited to %d workers (0 = all CPUs) and %g bytes/sec (0 = unlimited)\n",
+			idStr, limits.Workers, limits.IORate)
+
+	case "gc":
+		var mode string
+		cmd.CommandArgs(1, &mode)
+		if mode != "" && mode != "dry-run" {
+			return fmt.Errorf("Unknown gc mode %q: use 'dry-run' or no mode", mode)
+		}
+		limits, err := datastore.JobLimitsFromConfig(cmd.Settings())
+		if err != nil {
+			return err
+		}
+		reply.Text, err = runningService.CollectVersionsJSON(mode == "dry-run", limits)
+		return err
+
+	case "stats":
+		var uuidStr string
+		cmd.CommandArgs(1, &uuidStr)
+		var uuid dvid.UUID
+		if uuidStr != "" {
+			if uuid, err = MatchingUUID(uuidStr); err != nil {
+				return err
+			}
+		}
+		refresh, _ := cmd.Setting("refresh")
+		reply.Text, err = runningService.StatsJSON(uuid, refresh == "true")
+		return err
+
+	case "compact":
+		var uuidStr string
+		cmd.CommandArgs(1, &uuidStr)
+		var uuid dvid.UUID
+		var datanames []dvid.DataString
+		if uuidStr != "" {
+			if uuid, err = MatchingUUID(uuidStr); err != nil {
+				return err
+			}
+			for pos := 2; cmd.Argument(pos) != ""; pos++ {
+				datanames = append(datanames, dvid.DataString(cmd.Argument(pos)))
+			}
+		}
+		limits, err := datastore.JobLimitsFromConfig(cmd.Settings())
+		if err != nil {
+			return err
+		}
+		name := "compact store"
+		if uuid != "" {
+			name = "compact dataset of " + string(uuid)
+		}
+		job := datastore.StartJob("compact", name, limits)
+		report, err := runningService.Compact(uuid, datanames, job)
+		job.SetResult(report, err)
+		job.Finish()
+		if err != nil {
+			return err
+		}
+		reply.Text = report.String()
+
+	case "verify":
+		var uuidStr string
+		cmd.CommandArgs(1, &uuidStr)
+		uuid, err := MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		var datanames []dvid.DataString
+		for pos := 2; cmd.Argument(pos) != ""; pos++ {
+			datanames = append(datanames, dvid.DataString(cmd.Argument(pos)))
+		}
+		quarantine, _ := cmd.Setting("quarantine")
+		limits, err := datastore.JobLimitsFromConfig(cmd.Settings())
+		if err != nil {
+			return err
+		}
+		job := datastore.StartJob("verify", "verify dataset of "+string(uuid), limits)
+		report, err := runningService.VerifyDataset(uuid, datanames,
+			datastore.VerifyOptions{Quarantine: quarantine == "true"}, job)
+		job.SetResult(report, err)
+		job.Finish()
+		if err != nil {
+			return err
+		}
+		reply.Text = report.String()
+
+	case "backup":
+		var target, uuidStr string
+		cmd.CommandArgs(1, &target, &uuidStr)
+		if target == "" {
+			return fmt.Errorf("Backup requires a path or URL for the archive")
+		}
+		var datanames []dvid.DataString
+		for pos := 3; cmd.Argument(pos) != ""; pos++ {
+			datanames = append(datanames, dvid.DataString(cmd.Argument(pos)))
+		}
+		selection, err := backupSelection(uuidStr, datanames)
+		if err != nil {
+			return err
+		}
+		limits, err := datastore.JobLimitsFromConfig(cmd.Settings())
+		if err != nil {
+			return err
+		}
+		manifest, err := Backup(target, selection, limits)
+		if err != nil {
+			return err
+		}
+		reply.Text = backupSummary(manifest, target)
+
+	case "restore":
+		var path, uuidStr string
+		cmd.CommandArgs(1, &path, &uuidStr)
+		if path == "" {
+			return fmt.Errorf("Restore requires the path of a backup archive")
+		}
+		selection := datastore.RestoreSelection{Node: uuidStr}
+		for pos := 3; cmd.Argument(pos) != ""; pos++ {
+			selection.Data = append(selection.Data, dvid.DataString(cmd.Argument(pos)))
+		}
+		if subtree, found := cmd.Setting("subtree"); found {
+			selection.Subtree = subtree == "true"
+		}
+		limits, err := datastore.JobLimitsFromConfig(cmd.Settings())
+		if err != nil {
+			return err
+		}
+		restored, err := Restore(path, selection, limits)
+		if err != nil {
+			return err
+		}
+		reply.Text = restoreSummary(restored, path)
+
+	case "export":
+		var args []string
+		for pos := 1; cmd.Argument(pos) != ""; pos++ {
+			args = append(args, cmd.Argument(pos))
+		}
+		if len(args) < 2 {
+			return fmt.Errorf("Export requires a UUID and the path of the archive")
+		}
+		var datanames []dvid.DataString
+		for _, name := range args[1 : len(args)-1] {
+			datanames = append(datanames, dvid.DataString(name))
+		}
+		limits, err := datastore.JobLimitsFromConfig(cmd.Settings())
+		if err != nil {
+			return err
+		}
+		path := args[len(args)-1]
+		manifest, err := Export(args[0], datanames, path, limits)
+		if err != nil {
+			return err
+		}
+		reply.Text = exportSummary(manifest, path)
+
+	case "import":
+		var path, uuidStr string
+		cmd.CommandArgs(1, &path, &uuidStr)
+		if path == "" {
+			return fmt.Errorf("Import requires the path of an export archive")
+		}
+		limits, err := datastore.JobLimitsFromConfig(cmd.Settings())
+		if err != nil {
+			return err
+		}
+		result, err := Import(path, uuidStr, limits)
+		if err != nil {
+			return err
+		}
+		reply.Text = importSummary(result, path)
+
+	case "checkout":
+		var uuidStr, path string
+		cmd.CommandArgs(1, &uuidStr, &path)
+		if path == "" {
+			return fmt.Errorf("Checkout requires a UUID and a path for the new datastore")
+		}
+		uuid, err := MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		var datanames []dvid.DataString
+		for pos := 3; cmd.Argument(pos) != ""; pos++ {
+			datanames = append(datanames, dvid.DataString(cmd.Argument(pos)))
+		}
+		root, err := runningService.Checkout(uuid, path, datanames)
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Checked out node %s into new datastore at %s with root node %s\n",
+			uuid, path, root)
+
+	case "clone-data":
+		return cloneData(cmd, reply)
+
+	case "clone":
+		var uuidStr, path, dataname, minStr, maxStr string
+		cmd.CommandArgs(1, &uuidStr, &path, &dataname, &minStr, &maxStr)
+		if maxStr == "" {
+			return fmt.Errorf("Clone requires a UUID, a path, a data name, and minimum and maximum points")
+		}
+		uuid, err := MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		minPt, err := dvid.StringToPoint(minStr, ",")
+		if err != nil {
+			return err
+		}
+		maxPt, err := dvid.StringToPoint(maxStr, ",")
+		if err != nil {
+			return err
+		}
+		root, err := runningService.CloneSubset(uuid, path, dvid.DataString(dataname), minPt, maxPt)
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Cloned %s to %s of data '%s' at node %s into new datastore at %s with root node %s\n",
+			minPt, maxPt, dataname, uuid, path, root)
+
+	case "push", "pull":
+		var remote, uuidStr string
+		cmd.CommandArgs(1, &remote, &uuidStr)
+		if uuidStr == "" {
+			return fmt.Errorf("%s requires a remote server address and a UUID", cmd.Name())
+		}
+		var datanames []dvid.DataString
+		for pos := 3; cmd.Argument(pos) != ""; pos++ {
+			datanames = append(datanames, dvid.DataString(cmd.Argument(pos)))
+		}
+		if cmd.Name() == "push" {
+			uuid, err := MatchingUUID(uuidStr)
+			if err != nil {
+				return err
+			}
+			result, err := Push(remote, uuid, datanames)
+			if err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Pushed %d nodes and %d key/value pairs of node %s to %s\n",
+				result.Nodes, result.Keys, uuid, remote)
+		} else {
+			result, err := Pull(remote, dvid.UUID(uuidStr), datanames)
+			if err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Pulled %d nodes and %d key/value pairs of node %s from %s\n",
+				result.Nodes, result.Keys, uuidStr, remote)
+		}
+
+	case "tokens", "token":
+		if !AuthRequired {
+			return errTokensNeedAuth
+		}
+		if token != nil && !token.Admin {
+			return fmt.Errorf("Tokens can only be managed with an admin token")
+		}
+		if cmd.Name() == "tokens" {
+			reply.Text, err = runningService.TokensJSON()
+			return err
+		}
+		var subcommand, arg string
+		cmd.CommandArgs(1, &subcommand, &arg)
+		switch subcommand {
+		case "issue":
+			admin, _, err := cmd.Settings().GetBool("admin")
+			if err != nil {
+				return err
+			}
+			var ttl time.Duration
+			if ttlStr, found := cmd.Setting("ttl"); found {
+				if ttl, err = time.ParseDuration(ttlStr); err != nil {
+					return fmt.Errorf("Illegal token ttl '%s': %s", ttlStr, err.Error())
+				}
+			}
+			note, _ := cmd.Setting("note")
+			secret, issued, err := runningService.IssueToken(arg, admin, ttl, note)
+			if err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Issued token %s for user %s:\n%s\n", issued.ID, issued.User, secret)
+		case "revoke":
+			if err := runningService.RevokeToken(arg); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Revoked token %s\n", arg)
+		default:
+			return fmt.Errorf("Unknown token command %q: use 'issue' or 'revoke'", subcommand)
+		}
+
+	case "groups":
+		reply.Text, err = runningService.GroupsJSON()
+		return err
+
+	case "group":
+		if token != nil && !token.Admin {
+			return fmt.Errorf("Groups can only be managed with an admin token")
+		}
+		var subcommand, name string
+		members := cmd.CommandArgs(1, &subcommand, &name)
+		switch subcommand {
+		case "set":
+			if len(members) == 0 {
+				return fmt.Errorf("Groups must have at least one member")
+			}
+			if err := runningService.SetGroup(name, members); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Set members of group %s: %s\n", name, strings.Join(members, ", "))
+		case "delete":
+			if err := runningService.SetGroup(name, nil); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Deleted group %s\n", name)
+		default:
+			return fmt.Errorf("Unknown group command %q: use 'set' or 'delete'", subcommand)
+		}
+
+	case "migrate":
+		var subcommand, encodingStr string
+		cmd.CommandArgs(1, &subcommand, &encodingStr)
+		switch subcommand {
+		case "keys":
+			encoding := datastore.LatestKeyEncoding
+			if encodingStr != "" {
+				n, err := strconv.ParseUint(encodingStr, 10, 8)
+				if err != nil {
+					return fmt.Errorf("Illegal key encoding %q: %s", encodingStr, err.Error())
+				}
+				encoding = datastore.KeyEncoding(n)
+			}
+			limits, err := datastore.JobLimitsFromConfig(cmd.Settings())
+			if err != nil {
+				return err
+			}
+			if err := datastore.CheckKeyMigration(encoding); err != nil {
+				return err
+			}
+			goBackground(func() {
+				migrated, err := runningService.MigrateKeys(encoding, limits)
+				if err != nil {
+					dvid.Error("Error migrating keys to key encoding %d: %s", encoding, err.Error())
+				} else {
+					dvid.Log(dvid.Normal, "Migrated %d key/value pairs to key encoding %d\n", migrated, encoding)
+				}
+			})
+			reply.Text = fmt.Sprintf("Migrating data keys to key encoding %d in the background; "+
+				"requests modifying data are refused until keys are copied\n", encoding)
+		case "status":
+			jsonStr, err := runningService.KeyMigrationJSON()
+			if err != nil {
+				return err
+			}
+			reply.Text = jsonStr
+		default:
+			return fmt.Errorf("Unknown migrate command: %q", subcommand)
+		}
+
 	case "dataset":
 		var uuidStr, subcommand, typename, dataname string
 		cmd.CommandArgs(1, &uuidStr, &subcommand)
@@ -122,7 +710,12 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 		if err != nil {
 			return err
 		}
+		if err := checkRPCDatasetAccess(cmd, token, user, uuid); err != nil {
+			return err
+		}
 		switch subcommand {
+		case "acl":
+			return aclCommand(cmd, token, user, uuid, reply)
 		case "new":
 			cmd.CommandArgs(3, &typename, &dataname)
 			config := cmd.Settings()
@@ -131,6 +724,139 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 				return err
 			}
 			reply.Text = fmt.Sprintf("Data %q [%s] added to node %s\n", dataname, typename, uuidStr)
+		case "delete":
+			cmd.CommandArgs(3, &dataname)
+			config := cmd.Settings()
+			purge, _, err := config.GetBool("purge")
+			if err != nil {
+				return err
+			}
+			if purge {
+				return purgeCommand(uuid, dvid.DataString(dataname), config, reply)
+			}
+			if err = runningService.DeleteData(uuid, dvid.DataString(dataname)); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Data %q moved to trash of dataset with node %s\n", dataname, uuidStr)
+		case "restore":
+			cmd.CommandArgs(3, &dataname)
+			if err = runningService.RestoreData(uuid, dvid.DataString(dataname)); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Data %q restored to dataset with node %s\n", dataname, uuidStr)
+		case "webhook":
+			var action, url string
+			cmd.CommandArgs(3, &action, &url)
+			if url == "" {
+				return fmt.Errorf("Webhook commands require a URL.  See command-line help.")
+			}
+			switch action {
+			case "add":
+				var types []datastore.HookType
+				for pos := 5; cmd.Argument(pos) != ""; pos++ {
+					hookType, err := datastore.ParseHookType(cmd.Argument(pos))
+					if err != nil {
+						return err
+					}
+					types = append(types, hookType)
+				}
+				if err := runningService.AddWebHook(uuid, url, types); err != nil {
+					return err
+				}
+				reply.Text = fmt.Sprintf("Added webhook %s to dataset with node %s\n", url, uuid)
+			case "remove":
+				if err := runningService.RemoveWebHook(uuid, url); err != nil {
+					return err
+				}
+				reply.Text = fmt.Sprintf("Removed webhook %s from dataset with node %s\n", url, uuid)
+			default:
+				return fmt.Errorf("Unknown webhook command '%s': use 'add' or 'remove'", action)
+			}
+		case "webhooks":
+			jsonStr, err := runningService.WebHooksJSON(uuid)
+			if err != nil {
+				return err
+			}
+			reply.Text = jsonStr
+		case "uuids":
+			jsonStr, err := runningService.NodeUUIDsJSON(uuid)
+			if err != nil {
+				return err
+			}
+			reply.Text = jsonStr
+		case "trash":
+			jsonStr, err := runningService.TrashJSON(uuid)
+			if err != nil {
+				return err
+			}
+			reply.Text = jsonStr
+		case "scratch":
+			var ttlStr, session string
+			cmd.CommandArgs(3, &typename, &dataname, &ttlStr, &session)
+			if typename == "" {
+				jsonStr, err := runningService.ScratchJSON(uuid)
+				if err != nil {
+					return err
+				}
+				reply.Text = jsonStr
+				break
+			}
+			ttl, err := time.ParseDuration(ttlStr)
+			if err != nil {
+				return fmt.Errorf("Illegal scratch time-to-live '%s': %s", ttlStr, err.Error())
+			}
+			err = runningService.NewScratchData(uuid, dvid.TypeString(typename), dvid.DataString(dataname),
+				cmd.Settings(), session, ttl)
+			if err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Scratch data %q [%s] added to node %s for %s\n", dataname, typename, uuidStr, ttl)
+		case "profile":
+			var strideStr, prefixStr string
+			cmd.CommandArgs(3, &strideStr, &prefixStr)
+			opts, err := profileOptions(strideStr, prefixStr)
+			if err != nil {
+				return err
+			}
+			limits, err := datastore.JobLimitsFromConfig(cmd.Settings())
+			if err != nil {
+				return err
+			}
+			jsonStr, err := runningService.ProfileJSON(uuid, opts, limits)
+			if err != nil {
+				return err
+			}
+			reply.Text = jsonStr
+		case "convert":
+			var newname string
+			cmd.CommandArgs(3, &dataname, &newname)
+			if dataname == "" || newname == "" {
+				return fmt.Errorf("Conversion requires the name of deprecated data and a name for new data")
+			}
+			limits, err := datastore.JobLimitsFromConfig(cmd.Settings())
+			if err != nil {
+				return err
+			}
+			err = runningService.NewConversion(uuid, dvid.DataString(dataname), dvid.DataString(newname),
+				cmd.Settings())
+			if err != nil {
+				return err
+			}
+			goBackground(func() {
+				if err := runningService.RunConversion(uuid, dvid.DataString(newname), limits); err != nil {
+					dvid.Error("Error converting data %q into %q: %s", dataname, newname, err.Error())
+				} else {
+					dvid.Log(dvid.Normal, "Converted data %q into %q\n", dataname, newname)
+				}
+			})
+			reply.Text = fmt.Sprintf("Converting data %q into new data %q of node %s in the background\n",
+				dataname, newname, uuidStr)
+		case "conversions":
+			jsonStr, err := runningService.ConversionsJSON(uuid)
+			if err != nil {
+				return err
+			}
+			reply.Text = jsonStr
 		default:
 			dataname := dvid.DataString(subcommand)
 			dataservice, err := runningService.DataServiceByUUID(uuid, dataname)
@@ -153,18 +879,80 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 		if err != nil {
 			return err
 		}
+		if err := checkRPCNodeAccess(cmd, token, user, uuid); err != nil {
+			return err
+		}
 		switch descriptor {
-		case "lock":
-			err := runningService.Lock(uuid)
+		case "lock", "commit":
+			info, err := commitInfo(cmd.Settings())
 			if err != nil {
 				return err
 			}
-		case "branch":
-			newuuid, err := runningService.NewVersion(uuid)
+			if err = runningService.Commit(uuid, info); err != nil {
+				return err
+			}
+		case "abandon":
+			if err := runningService.AbandonVersion(uuid); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Abandoned node %s.  Use 'gc' to reclaim its data.\n", uuid)
+		case "branch", "newversion":
+			info, err := commitInfo(cmd.Settings())
+			if err != nil {
+				return err
+			}
+			newuuid, err := runningService.NewVersionWithInfo(uuid, info)
+			if err != nil {
+				return err
+			}
+			reply.Text = string(newuuid)
+		case "merge":
+			parents := []dvid.UUID{uuid}
+			for pos := 3; cmd.Argument(pos) != ""; pos++ {
+				parent, err := MatchingUUID(cmd.Argument(pos))
+				if err != nil {
+					return err
+				}
+				parents = append(parents, parent)
+			}
+			newuuid, err := runningService.MergeVersions(parents)
 			if err != nil {
 				return err
 			}
 			reply.Text = string(newuuid)
+		case "fork":
+			root, err := runningService.ForkDataset(uuid)
+			if err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Forked node %s into new dataset with root node %s\n", uuid, root)
+		case "restrict":
+			branch, _, err := cmd.Settings().GetBool("branch")
+			if err != nil {
+				return err
+			}
+			var users []string
+			for pos := 3; cmd.Argument(pos) != ""; pos++ {
+				users = append(users, cmd.Argument(pos))
+			}
+			if len(users) == 0 {
+				return fmt.Errorf("Must give at least one user permitted to write at node %s", uuid)
+			}
+			if err := runningService.SetWriteRule(uuid, branch, users); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Restricted writes at node %s to %s\n", uuid, strings.Join(users, ", "))
+		case "unrestrict":
+			if err := runningService.SetWriteRule(uuid, false, nil); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Removed write restriction of node %s\n", uuid)
+		case "permissions":
+			jsonStr, err := runningService.WriteRuleJSON(uuid)
+			if err != nil {
+				return err
+			}
+			reply.Text = jsonStr
 
 		default:
 			dataname := dvid.DataString(descriptor)
@@ -178,7 +966,95 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 				reply.Text = dataservice.Help()
 				return nil
 			}
-			return dataservice.DoRPC(cmd, reply)
+			if subcommand == "verify" {
+				return verifyData(dataservice, reply)
+			}
+			if subcommand == "changelog" {
+				var fromStr, maxStr string
+				cmd.CommandArgs(4, &fromStr, &maxStr)
+				from, max, err := changelogRange(fromStr, maxStr)
+				if err != nil {
+					return err
+				}
+				reply.Text, err = runningService.ChangelogJSON(uuid, dataname, from, max)
+				return err
+			}
+			if subcommand == "flatten" {
+				if err := CheckWriteAccess(uuid, dataname, user); err != nil {
+					return err
+				}
+				numCopied, err := runningService.FlattenVersion(uuid, dataname)
+				if err != nil {
+					return err
+				}
+				reply.Text = fmt.Sprintf("Flattened data '%s' at node %s: copied %d inherited key/value pairs\n",
+					dataname, uuid, numCopied)
+				return nil
+			}
+			if subcommand == "rollback" {
+				if err := CheckWriteAccess(uuid, dataname, user); err != nil {
+					return err
+				}
+				numDeleted, err := runningService.RollbackVersion(uuid, dataname)
+				if err != nil {
+					return err
+				}
+				reply.Text = fmt.Sprintf("Rolled back data '%s' at node %s: discarded %d key/value pairs\n",
+					dataname, uuid, numDeleted)
+				return nil
+			}
+			if subcommand == "provenance" {
+				var indexStr string
+				cmd.CommandArgs(4, &indexStr)
+				index, err := hex.DecodeString(indexStr)
+				if err != nil || len(index) == 0 {
+					return fmt.Errorf("Provenance requires an index in hexadecimal, got %q", indexStr)
+				}
+				reply.Text, err = runningService.ProvenanceJSON(uuid, dataname, dvid.IndexBytes(index))
+				return err
+			}
+			if subcommand == "diff" {
+				var toStr string
+				cmd.CommandArgs(4, &toStr)
+				to, err := MatchingUUID(toStr)
+				if err != nil {
+					return err
+				}
+				values, _ := cmd.Setting("values")
+				reply.Text, err = runningService.DiffJSON(uuid, to, dataname, values == "true")
+				return err
+			}
+			if subcommand == "changelog-truncate" {
+				var beforeStr string
+				cmd.CommandArgs(4, &beforeStr)
+				before, err := strconv.ParseUint(beforeStr, 10, 64)
+				if err != nil {
+					return fmt.Errorf("Illegal changelog offset '%s': %s", beforeStr, err.Error())
+				}
+				if err := CheckWriteAccess(uuid, dataname, user); err != nil {
+					return err
+				}
+				numDeleted, err := runningService.TruncateChangelog(uuid, dataname, before)
+				if err != nil {
+					return err
+				}
+				reply.Text = fmt.Sprintf("Deleted %d changelog events of data '%s'\n", numDeleted, dataname)
+				return nil
+			}
+			if subcommand == "train-dictionary" {
+				var samplesStr string
+				cmd.CommandArgs(4, &samplesStr)
+				if err := CheckWriteAccess(uuid, dataname, user); err != nil {
+					return err
+				}
+				return trainDictionary(uuid, dataservice, samplesStr, reply)
+			}
+			if !readOnlyRPC[cmd.TypeCommand()] {
+				if err := CheckWriteAccess(uuid, dataname, user); err != nil {
+					return err
+				}
+			}
+			return dataservice.DoRPC(context.Background(), cmd, reply)
 		}
 
 	default:
@@ -186,3 +1062,231 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 	}
 	return nil
 }
+
+// cloneData handles "clone-data <UUID> <data name> <new data name>", which clones data into a
+// new data instance of the same or another dataset.
+func cloneData(cmd datastore.Request, reply *datastore.Response) error {
+	var uuidStr, dataname, newName string
+	cmd.CommandArgs(1, &uuidStr, &dataname, &newName)
+	if newName == "" {
+		return fmt.Errorf("Clone requires a UUID, a data name, and a new data name")
+	}
+	uuid, err := MatchingUUID(uuidStr)
+	if err != nil {
+		return err
+	}
+	dest := uuid
+	if destStr, found := cmd.Setting("dest"); found {
+		if dest, err = MatchingUUID(destStr); err != nil {
+			return err
+		}
+	}
+	var opts datastore.CloneOptions
+	if minStr, found := cmd.Setting("min"); found {
+		if opts.MinPt, err = dvid.StringToPoint(minStr, ","); err != nil {
+			return err
+		}
+	}
+	if maxStr, found := cmd.Setting("max"); found {
+		if opts.MaxPt, err = dvid.StringToPoint(maxStr, ","); err != nil {
+			return err
+		}
+	}
+	if roiPath, found := cmd.Setting("roi"); found {
+		if opts.ROI, err = readROI(roiPath); err != nil {
+			return err
+		}
+	}
+	limits, err := datastore.JobLimitsFromConfig(cmd.Settings())
+	if err != nil {
+		return err
+	}
+	job := datastore.StartJob("clone", fmt.Sprintf("clone '%s' into '%s'", dataname, newName), limits)
+	numKeys, err := runningService.CloneData(uuid, dvid.DataString(dataname), dest, dvid.DataString(newName),
+		opts, job)
+	job.SetResult(numKeys, err)
+	job.Finish()
+	if err != nil {
+		return err
+	}
+	reply.Text = fmt.Sprintf("Cloned %d key/value pairs of data '%s' at node %s into new data '%s' at node %s\n",
+		numKeys, dataname, uuid, newName, dest)
+	return nil
+}
+
+// purgeCommand handles "dataset <UUID> delete <data name> purge=true", which replies
+// with a confirmation nonce unless one is given by the "confirm" setting, in which case
+// the data is permanently deleted.
+func purgeCommand(uuid dvid.UUID, dataname dvid.DataString, config dvid.Config, reply *datastore.Response) error {
+	nonce, found, err := config.GetString("confirm")
+	if err != nil {
+		return err
+	}
+	if !found {
+		nonce, err = runningService.PurgeNonce(uuid, dataname)
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Purging data %q permanently deletes all its key/value pairs.  To confirm, "+
+			"within %s run:\n\n  dvid dataset %s delete %s purge=true confirm=%s\n",
+			dataname, datastore.PurgeConfirmationTTL, uuid, dataname, nonce)
+		return nil
+	}
+	async, _, err := config.GetBool("async")
+	if err != nil {
+		return err
+	}
+	numKeys, err := runningService.PurgeData(uuid, dataname, nonce, async)
+	if err != nil {
+		return err
+	}
+	if async {
+		reply.Text = fmt.Sprintf("Purged data %q, whose key/value pairs are being deleted in the background\n",
+			dataname)
+	} else {
+		reply.Text = fmt.Sprintf("Purged data %q and deleted %d key/value pairs\n", dataname, numKeys)
+	}
+	return nil
+}
+
+// readROI returns the ROI whose block spans are listed as [[z, y, x0, x1], ...] in a
+// JSON file.
+func readROI(path string) (*dvid.ROI, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var runs [][4]int32
+	if err = json.Unmarshal(data, &runs); err != nil {
+		return nil, fmt.Errorf("ROI file %s must list block spans as [[z, y, x0, x1], ...]: %s",
+			path, err.Error())
+	}
+	spans := make([]dvid.BlockSpan, len(runs))
+	for i, run := range runs {
+		spans[i] = dvid.BlockSpan{Z: run[0], Y: run[1], X0: run[2], X1: run[3]}
+	}
+	return dvid.NewROI(spans)
+}
+
+// checkJobOwner returns an error unless a job can be changed by an admin or by the user
+// that started it.
+func checkJobOwner(job *datastore.Job, user string, admin bool) error {
+	if !admin && (job.Owner() == "" || job.Owner() != user) {
+		return fmt.Errorf("Job %d can only be changed by an admin or the user that started it", job.ID)
+	}
+	return nil
+}
+
+// setJobLimits changes the limits of the running job with the given id if allowed for
+// the user making the request.
+func setJobLimits(idStr string, config dvid.Config, user string, admin bool) (datastore.JobLimits, error) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return datastore.JobLimits{}, fmt.Errorf("Illegal job id '%s'", idStr)
+	}
+	job, err := datastore.JobByID(id)
+	if err != nil {
+		return datastore.JobLimits{}, err
+	}
+	if err := checkJobOwner(job, user, admin); err != nil {
+		return datastore.JobLimits{}, err
+	}
+	limits, err := datastore.JobLimitsFromConfig(config)
+	if err != nil {
+		return limits, err
+	}
+	job.SetLimits(limits)
+	return limits, nil
+}
+
+// verifyData recomputes checksums for all stored values of a data service.
+func verifyData(dataservice datastore.DataService, reply *datastore.Response) error {
+	verifier, ok := dataservice.(datastore.Verifier)
+	if !ok {
+		return fmt.Errorf("Data '%s' does not support verification", dataservice.DataName())
+	}
+	db, err := KeyValueGetter()
+	if err != nil {
+		return err
+	}
+	report, err := verifier.Verify(db)
+	if err != nil {
+		return err
+	}
+	reply.Text = report.String()
+	return nil
+}
+
+// trainDictionary trains a shared compression dictionary for a data service and
+// saves the dataset metadata holding the dictionary.
+func trainDictionary(uuid dvid.UUID, dataservice datastore.DataService, samplesStr string,
+	reply *datastore.Response) error {
+
+	trainer, ok := dataservice.(datastore.DictionaryTrainer)
+	if !ok {
+		return fmt.Errorf("Data '%s' does not support compression dictionaries", dataservice.DataName())
+	}
+	numSamples := datastore.DefaultDictionarySamples
+	if samplesStr != "" {
+		var err error
+		if numSamples, err = strconv.Atoi(samplesStr); err != nil {
+			return fmt.Errorf("Illegal number of samples '%s': %s", samplesStr, err.Error())
+		}
+	}
+	db, err := KeyValueGetter()
+	if err != nil {
+		return err
+	}
+	dict, err := trainer.TrainDictionary(db, numSamples)
+	if err != nil {
+		return err
+	}
+	if err = runningService.SaveDataset(uuid); err != nil {
+		return err
+	}
+	reply.Text = fmt.Sprintf("Data '%s' now compresses using %s\n", dataservice.DataName(), dict)
+	return nil
+}
+
+// profileOptions returns key profiling options from optional stride and prefix bytes
+// strings.
+func profileOptions(strideStr, prefixStr string) (datastore.ProfileOptions, error) {
+	var opts datastore.ProfileOptions
+	var err error
+	if strideStr != "" {
+		if opts.Stride, err = strconv.Atoi(strideStr); err != nil || opts.Stride < 1 {
+			return opts, fmt.Errorf("Illegal profile stride '%s': must be a positive integer", strideStr)
+		}
+	}
+	if prefixStr != "" {
+		if opts.PrefixBytes, err = strconv.Atoi(prefixStr); err != nil || opts.PrefixBytes < 1 {
+			return opts, fmt.Errorf("Illegal profile prefix bytes '%s': must be a positive integer", prefixStr)
+		}
+	}
+	return opts, nil
+}
+
+// changelogRange returns the starting offset and maximum number of changelog events to
+// read from optional strings.
+func changelogRange(fromStr, maxStr string) (from uint64, max int, err error) {
+	if fromStr != "" {
+		if from, err = strconv.ParseUint(fromStr, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("Illegal changelog offset '%s': %s", fromStr, err.Error())
+		}
+	}
+	if maxStr != "" {
+		if max, err = strconv.Atoi(maxStr); err != nil || max < 1 {
+			return 0, 0, fmt.Errorf("Illegal maximum number of changelog events '%s'", maxStr)
+		}
+	}
+	return from, max, nil
+}
+
+// commitInfo returns the author and log message given in the settings of a command.
+func commitInfo(config dvid.Config) (info datastore.CommitInfo, err error) {
+	if info.Author, _, err = config.GetString("author"); err != nil {
+		return
+	}
+	info.Message, _, err = config.GetString("message")
+	return
+}
@@ -0,0 +1,121 @@
+/*
+	This file supports scripts of RPC commands, so recipes like ingestion can be kept
+	and rerun as files.  Each line of a script is a command as given to the dvid client.
+	Blank lines and lines starting with "#" are skipped.  A line of the form
+
+		$name = <command>
+
+	runs the command and captures the last UUID in its reply, e.g., of "datasets new" or
+	"node <UUID> branch", into the variable, and $name or ${name} in later lines is
+	replaced by its value.
+*/
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+var (
+	scriptCapture  = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.*)$`)
+	scriptVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+	scriptUUID     = regexp.MustCompile(`[0-9a-fA-F]{32}`)
+)
+
+// RunScript sends the commands of a script, in order, to the server at the RPC address
+// and writes their replies to w.  Commands are sent with the token, if any, and vars
+// hold the initial values of script variables.  A failing command stops the script
+// unless continueOnError is true, in which case the remaining commands are run and an
+// error reports the number of failed commands.
+func RunScript(rpcAddress, token string, script io.Reader, vars map[string]string,
+	continueOnError bool, w io.Writer) error {
+
+	client := NewClient(rpcAddress)
+	if !client.Connected() {
+		return fmt.Errorf("Scripts require a running DVID server at %s", rpcAddress)
+	}
+	values := make(map[string]string, len(vars))
+	for name, value := range vars {
+		values[name] = value
+	}
+
+	var failed int
+	scanner := bufio.NewScanner(script)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err := runScriptLine(client, token, line, values, w)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("Line %d (%s): %s", lineNum, line, err.Error())
+		if !continueOnError {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		failed++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d script commands failed", failed)
+	}
+	return nil
+}
+
+// runScriptLine sends the command of a script line after replacing its variables and
+// captures the last UUID of the reply if the line assigns a variable.
+func runScriptLine(client *Client, token, line string, values map[string]string, w io.Writer) error {
+	var capture string
+	if match := scriptCapture.FindStringSubmatch(line); match != nil {
+		capture, line = match[1], match[2]
+	}
+	var undefined string
+	line = scriptVariable.ReplaceAllStringFunc(line, func(ref string) string {
+		match := scriptVariable.FindStringSubmatch(ref)
+		name := match[1] + match[2]
+		value, found := values[name]
+		if !found && undefined == "" {
+			undefined = name
+		}
+		return value
+	})
+	if undefined != "" {
+		return fmt.Errorf("Variable '%s' is not defined", undefined)
+	}
+	command := dvid.Command(strings.Fields(line))
+	if len(command) == 0 {
+		return fmt.Errorf("No command given")
+	}
+
+	reply, err := client.Call(datastore.Request{Command: command, Token: token})
+	if err != nil {
+		return err
+	}
+	if err = reply.Write(w); err != nil {
+		return err
+	}
+	if capture != "" {
+		text := reply.Text
+		if text == "" {
+			text = string(reply.Output)
+		}
+		uuids := scriptUUID.FindAllString(text, -1)
+		if len(uuids) == 0 {
+			return fmt.Errorf("Reply has no UUID to capture into '%s'", capture)
+		}
+		values[capture] = uuids[len(uuids)-1]
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,11 +8,9 @@ import (
 	"net"
 	"net/http"
 	"net/rpc"
-	"os"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
-	"strings"
 	"sync"
 	"time"
 
@@ -40,6 +37,10 @@ const (
 
 	// The name of the server error log, stored in the datastore directory.
 	ErrorLogFilename = "dvid-errors.log"
+
+	// UserHeader is the HTTP header giving the authenticated user making a request, which
+	// is checked against ACLs and the write rules of version nodes.
+	UserHeader = "X-DVID-User"
 )
 
 var (
@@ -73,6 +74,15 @@ var (
 	// Timeout in seconds for waiting to open a datastore for exclusive access.
 	TimeoutSecs int
 
+	// TrashCollectionInterval is how often deleted data older than the trash
+	// retention period is permanently reclaimed.
+	TrashCollectionInterval = time.Hour
+
+	// TLSCertFile and TLSKeyFile are the certificate and key for serving HTTP over TLS.
+	// HTTP is served in cleartext if they are not set.
+	TLSCertFile string
+	TLSKeyFile  string
+
 	// Keep track of the startup time for uptime.
 	startupTime time.Time = time.Now()
 )
@@ -124,6 +134,35 @@ func VersionLocalID(uuid dvid.UUID) (dvid.VersionLocalID, error) {
 	return versionID, nil
 }
 
+// CheckWritable returns an error if the node with the given UUID is locked, since data
+// of locked nodes cannot be modified.
+func CheckWritable(uuid dvid.UUID) error {
+	if runningService.Service == nil {
+		return fmt.Errorf("Datastore service has not been started on this server.")
+	}
+	locked, err := runningService.Service.Locked(uuid)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return fmt.Errorf("Node %s is locked and cannot be modified.  Create a child node to make changes.", uuid)
+	}
+	return nil
+}
+
+// CheckWriteAccess returns an error if the node with the given UUID is locked, if the
+// user is not permitted to write data at the node, or if the named data is being
+// converted.  Permission errors are of type *datastore.PermissionError.
+func CheckWriteAccess(uuid dvid.UUID, dataname dvid.DataString, user string) error {
+	if err := CheckWritable(uuid); err != nil {
+		return err
+	}
+	if err := runningService.Service.CheckWritePermission(uuid, user); err != nil {
+		return err
+	}
+	return runningService.Service.CheckConverting(uuid, dataname)
+}
+
 // --- Return datastore.Service and various database interfaces to support polyglot persistence --
 
 // DatastoreService returns the current datastore service.  One DVID process
@@ -157,38 +196,20 @@ func KeyValueSetter() (storage.KeyValueSetter, error) {
 	return runningService.KeyValueSetter()
 }
 
-// StorageEngine returns the default storage engine or nil if it's not available.
-func StorageEngine() (storage.Engine, error) {
+// Batcher returns the default service for atomic batch writes.
+func Batcher() (storage.Batcher, error) {
 	if runningService.Service == nil {
 		return nil, fmt.Errorf("No running datastore service is available.")
 	}
-	return runningService.StorageEngine(), nil
+	return runningService.Batcher()
 }
 
-// Shutdown handles graceful cleanup of server functions before exiting DVID.
-// This may not be so graceful if the chunk handler uses cgo since the interrupt
-// may be caught during cgo execution.
-func Shutdown() {
-	if runningService.Service != nil {
-		runningService.Service.Shutdown()
-	}
-	waits := 0
-	for {
-		active := MaxChunkHandlers - len(HandlerToken)
-		if waits >= 20 {
-			log.Printf("Already waited for 20 seconds.  Continuing with shutdown...")
-			break
-		} else if active > 0 {
-			log.Printf("Waiting for %d chunk handlers to finish...\n", active)
-			waits++
-		} else {
-			log.Println("No chunk handlers active...")
-			break
-		}
-		time.Sleep(1 * time.Second)
+// StorageEngine returns the default storage engine or nil if it's not available.
+func StorageEngine() (storage.Engine, error) {
+	if runningService.Service == nil {
+		return nil, fmt.Errorf("No running datastore service is available.")
 	}
-	storage.Shutdown()
-	dvid.BlockOnActiveCgo()
+	return runningService.StorageEngine(), nil
 }
 
 // OpenDatastore returns a Server service.  Only one datastore can be opened
@@ -244,13 +265,13 @@ func (service *Service) sendContent(path string, w http.ResponseWriter, r *http.
 		if len(path) > 0 && path[0:1] == "/" {
 			path = path[1:]
 		}
-		dvid.Log(dvid.Debug, "[%s] Serving from embedded files: %s\n", r.Method, path)
-
+		// Files appended to the executable take precedence over the default console.
 		resource := nrsc.Get(path)
 		if resource == nil {
-			http.NotFound(w, r)
+			sendConsole(w, r, path)
 			return
 		}
+		dvid.Log(dvid.Debug, "[%s] Serving from embedded files: %s\n", r.Method, path)
 		rsrc, err := resource.Open()
 		if err != nil {
 			BadRequest(w, r, err.Error())
@@ -276,25 +297,110 @@ func (service *Service) Serve(webAddress, webClientDir, rpcAddress string) error
 	log.Printf("Using %d of %d logical CPUs for DVID.\n", dvid.NumCPU, runtime.NumCPU())
 
 	// Register an error logger that appends to a file in this datastore directory.
-	errorLog := filepath.Join(service.ErrorLogDir, ErrorLogFilename)
-	file, err := os.OpenFile(errorLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	file, err := openLog(service.ErrorLogDir, ErrorLogFilename)
 	if err != nil {
-		log.Fatalf("Unable to open error logging file (%s): %s\n", errorLog, err.Error())
+		log.Fatalf("Unable to open error logging file in %s: %s\n", service.ErrorLogDir, err.Error())
 	}
+	errorLogFile = file
 	dvid.SetErrorLoggingFile(file)
 
+	// Record who makes requests in an audit log in the same directory.
+	if err := openAuditLog(service.ErrorLogDir); err != nil {
+		log.Fatalf("Unable to open audit log in %s: %s\n", service.ErrorLogDir, err.Error())
+	}
+
+	// Record each request with its user, data, bytes, duration, and status in an access log.
+	if err := openAccessLog(service.ErrorLogDir); err != nil {
+		log.Fatalf("Unable to open access log in %s: %s\n", service.ErrorLogDir, err.Error())
+	}
+
+	// Periodically reclaim deleted data whose retention has expired.
+	goBackground(collectTrash)
+
+	// Warn of deprecated data and finish any interrupted conversions.
+	for _, deprecated := range runningService.DeprecatedData() {
+		dvid.Log(dvid.Normal, "%s\n", deprecated)
+	}
+	goBackground(resumeConversions)
+
+	// Delete keys left in old key encodings by an interrupted key migration.
+	goBackground(func() {
+		if err := runningService.ResumeKeyMigration(); err != nil {
+			dvid.Error("Error resuming key migration: %s", err.Error())
+		}
+	})
+
+	// Make sure a server requiring authentication can be administered.
+	if err := issueFirstAdminToken(); err != nil {
+		return fmt.Errorf("Unable to issue admin token: %s", err.Error())
+	}
+
+	// Announce readiness to supervisors once the servers are listening, and reopen
+	// logs on hangup signals.
+	serversListening.Add(2)
+	if GRPCAddress != "" {
+		serversListening.Add(1)
+	}
+	go announceReady()
+	go reopenLogsOnHangup()
+
 	// Launch the web server
 	go runningService.ServeHttp(webAddress, webClientDir)
 
-	// Launch the rpc server
+	// Launch the gRPC server if requested
+	if GRPCAddress != "" {
+		go func() {
+			if err := runningService.ServeGRPC(GRPCAddress); err != nil {
+				log.Fatalln(err.Error())
+			}
+		}()
+	}
+
+	// Launch the rpc server, which stops when shutdown begins.
 	err = runningService.ServeRpc(rpcAddress)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
+	<-shutdownComplete
 
 	return nil
 }
 
+// collectTrash reclaims expired deleted and scratch data at startup and every
+// TrashCollectionInterval until shutdown.
+func collectTrash() {
+	for {
+		reclaimed, err := runningService.CollectTrash(datastore.TrashRetention)
+		if err != nil {
+			dvid.Error("Error reclaiming deleted data: %s", err.Error())
+		} else if reclaimed > 0 {
+			dvid.Log(dvid.Normal, "Reclaimed %d deleted data instances\n", reclaimed)
+		}
+		reclaimed, err = runningService.CollectScratch(time.Now())
+		if err != nil {
+			dvid.Error("Error reclaiming scratch data: %s", err.Error())
+		} else if reclaimed > 0 {
+			dvid.Log(dvid.Normal, "Reclaimed %d expired scratch data instances\n", reclaimed)
+		}
+		select {
+		case <-time.After(TrashCollectionInterval):
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// resumeConversions finishes conversions of deprecated data interrupted by a shutdown.
+func resumeConversions() {
+	completed, err := runningService.ResumeConversions()
+	if completed > 0 {
+		dvid.Log(dvid.Normal, "Completed %d interrupted data conversions\n", completed)
+	}
+	if err != nil {
+		dvid.Error("Unable to finish all interrupted data conversions: %s", err.Error())
+	}
+}
+
 // Wrapper function so that http handlers recover from panics gracefully
 // without crashing the entire program.  The error message is written to
 // the log.
@@ -323,9 +429,22 @@ func (service *Service) ServeHttp(address, clientDir string) {
 	service.WebClientPath = clientDir
 	fmt.Printf("Web server listening at %s ...\n", address)
 
+	// Serve HTTP/2 so viewers can multiplex many tile requests over one connection
+	// instead of being limited by browsers' connections per host: over TLS (h2) if a
+	// certificate is given, and otherwise over cleartext (h2c) with prior knowledge
+	// for non-browser clients.  HTTP/1.1 is still served, e.g., for WebSockets.
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
 	src := &http.Server{
 		Addr:        address,
 		ReadTimeout: 1 * time.Hour,
+		Protocols:   protocols,
+	}
+	if MaxConnections > 0 {
+		src.ConnState = trackConnection
+		src.ConnContext = connContext
 	}
 
 	// Handle RAML interface
@@ -334,21 +453,16 @@ func (service *Service) ServeHttp(address, clientDir string) {
 	http.HandleFunc("/interface", logHttpPanics(service.apiHelpHandler))
 
 	// Handle Level 2 REST API.
-	http.HandleFunc(WebAPIPath, logHttpPanics(apiHandler))
-
-	// http.HandleFunc(WebAPIPath, logHttpPanics(makeGzipHandler(apiHandler)))
-	//
-	// Could wrap HTTP handler with Gzip handler at this level, but it's too
-	// broad a brush.  Individual data types might already store gzipped or
-	// PNG-encoded (deflate) data, then the gzip wrapping is extra work for
-	// possibly worse data size.
+	// Responses are compressed if the client accepts it, except for payloads data types
+	// mark as already compressed, e.g., PNG or JPEG images.
+	http.HandleFunc(WebAPIPath, logHttpPanics(accessLogHandler(authHandler(limitHandler(timeoutHandler(compressHandler(apiHandler)))))))
 
 	// Handle static files through serving embedded files
 	// via nrsc or loading files from a specified web client directory.
 	if clientDir == "" {
 		dvid.Log(dvid.Normal, "Serving web client from embedded files...")
 		if err := nrsc.Initialize(); err != nil {
-			dvid.Log(dvid.Normal, "Error initializing embedded data access: %s\n", err.Error())
+			dvid.Log(dvid.Normal, "No web client files appended, so serving default console: %s\n", err.Error())
 		}
 	} else {
 		dvid.Log(dvid.Normal, "Serving web pages from %s\n", clientDir)
@@ -356,7 +470,49 @@ func (service *Service) ServeHttp(address, clientDir string) {
 	http.HandleFunc("/", logHttpPanics(service.mainHandler))
 
 	// Serve it up!
-	src.ListenAndServe()
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	setServer(&webServer, src)
+	serversListening.Done()
+	if TLSCertFile != "" {
+		err = src.ServeTLS(listener, TLSCertFile, TLSKeyFile)
+	} else {
+		err = src.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalln(err.Error())
+	}
+}
+
+// rpcHandler serves RPC connections made with HTTP CONNECT, as rpc.HandleHTTP does,
+// but with an RPCConnection for each client so commands know the client's address.
+func rpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "RPC connections cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		dvid.Error("Unable to hijack RPC connection from %s: %s", r.RemoteAddr, err.Error())
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+	server := rpc.NewServer()
+	if err := server.Register(&RPCConnection{remoteAddr: r.RemoteAddr}); err != nil {
+		dvid.Error("Unable to serve RPC connection from %s: %s", r.RemoteAddr, err.Error())
+		conn.Close()
+		return
+	}
+	server.ServeConn(conn)
 }
 
 // Listen and serve RPC requests using address.
@@ -367,37 +523,16 @@ func (service *Service) ServeRpc(address string) error {
 	service.RPCAddress = address
 	dvid.Log(dvid.Debug, "Rpc server listening at %s ...\n", address)
 
-	c := new(RPCConnection)
-	rpc.Register(c)
-	rpc.HandleHTTP()
+	http.HandleFunc(rpc.DefaultRPCPath, rpcHandler)
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
-	http.Serve(listener, nil)
-	return nil
-}
-
-// Nod to Andrew Gerrand for simple gzip solution:
-// See https://groups.google.com/forum/m/?fromgroups#!topic/golang-nuts/eVnTcMwNVjM
-type gzipResponseWriter struct {
-	io.Writer
-	http.ResponseWriter
-}
-
-func (w gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
-}
-
-func makeGzipHandler(fn http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			fn(w, r)
-			return
-		}
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-		fn(gzipResponseWriter{Writer: gz, ResponseWriter: w}, r)
+	src := &http.Server{Addr: address}
+	setServer(&rpcServer, src)
+	serversListening.Done()
+	if err := src.Serve(listener); err != http.ErrServerClosed {
+		return err
 	}
+	return nil
 }
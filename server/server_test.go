@@ -0,0 +1,288 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/janelia-flyem/go/gocheck"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type ServerSuite struct{}
+
+var _ = Suite(&ServerSuite{})
+
+// postBatch sends a batch of requests to the batch handler and returns its replies.
+func postBatch(c *C, subs []batchRequest) []batchResponse {
+	body, err := json.Marshal(subs)
+	c.Assert(err, IsNil)
+	r := httptest.NewRequest("POST", WebAPIPath+"batch", strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+	limitHandler(batchHandler)(w, r)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var replies []batchResponse
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &replies), IsNil)
+	c.Assert(replies, HasLen, len(subs))
+	return replies
+}
+
+// statusCounts returns the number of replies with each status.
+func statusCounts(replies []batchResponse) map[int]int {
+	counts := make(map[int]int)
+	for _, reply := range replies {
+		counts[reply.Status]++
+	}
+	return counts
+}
+
+func (s *ServerSuite) TestBatchLimits(c *C) {
+	help := batchRequest{Method: "GET", Path: WebAPIPath + "help"}
+	replies := postBatch(c, []batchRequest{help, {Path: "/elsewhere"}})
+	c.Assert(replies[0].Status, Equals, http.StatusOK)
+	c.Assert(replies[0].Body, Not(Equals), "")
+	c.Assert(replies[1].Status, Equals, http.StatusBadRequest)
+
+	// Responses past the byte budget of a batch are refused.
+	oldBytes := MaxBatchBytes
+	MaxBatchBytes = int64(len(replies[0].Body)) + 1
+	defer func() { MaxBatchBytes = oldBytes }()
+	replies = postBatch(c, []batchRequest{help, help, help})
+	c.Assert(statusCounts(replies), DeepEquals, map[int]int{
+		http.StatusOK:                    1,
+		http.StatusRequestEntityTooLarge: 2,
+	})
+	MaxBatchBytes = oldBytes
+
+	// Each request of a batch is rate limited.  The batch and its first request use
+	// the burst of a client.
+	oldRate := RequestRate
+	RequestRate = 1
+	defer func() { RequestRate = oldRate }()
+	replies = postBatch(c, []batchRequest{help, help, help, help})
+	c.Assert(statusCounts(replies)[http.StatusOK], Equals, 1)
+	c.Assert(statusCounts(replies)[http.StatusTooManyRequests], Equals, 3)
+}
+
+func (s *ServerSuite) TestRPCRate(c *C) {
+	oldRate := RequestRate
+	RequestRate = 1
+	defer func() { RequestRate = oldRate }()
+
+	// Without authentication, clients are limited by their address.
+	c.Assert(checkRPCRate(nil, "192.0.2.10:5000"), IsNil)
+	c.Assert(checkRPCRate(nil, "192.0.2.10:5001"), IsNil)
+	c.Assert(checkRPCRate(nil, "192.0.2.10:5002"), ErrorMatches, "Rate limit exceeded by ip:192.0.2.10.*")
+	c.Assert(checkRPCRate(nil, "192.0.2.11:5000"), IsNil)
+
+	// Authenticated clients are limited by their user wherever they connect from.
+	token := &datastore.AuthToken{User: "rpcuser"}
+	c.Assert(checkRPCRate(token, "192.0.2.10:5000"), IsNil)
+	c.Assert(checkRPCRate(token, "192.0.2.12:5000"), IsNil)
+	c.Assert(checkRPCRate(token, "192.0.2.13:5000"), ErrorMatches, "Rate limit exceeded by user:rpcuser.*")
+}
+
+func (s *ServerSuite) TestParseDatasets(c *C) {
+	datasets, err := parseDatasets([]byte(`{"Datasets": [
+		{"Root": "abc", "Alias": "first", "DataMap": {"gray": {}, "bodies": {}}},
+		{"Root": "def", "DataMap": {}}]}`))
+	c.Assert(err, IsNil)
+	c.Assert(datasets, DeepEquals, []RemoteDataset{
+		{Root: "abc", Alias: "first", Data: []dvid.DataString{"bodies", "gray"}},
+		{Root: "def", Data: []dvid.DataString{}},
+	})
+	_, err = parseDatasets([]byte(`not json`))
+	c.Assert(err, ErrorMatches, "Unable to decode datasets.*")
+}
+
+func (s *ServerSuite) TestRemoteListings(c *C) {
+	var authorization string
+	peer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		fmt.Fprint(w, `{"Datasets": [{"Root": "abc", "DataMap": {"gray": {}}}]}`)
+	}))
+	defer peer.Close()
+	failing := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	huge := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, maxRemoteListing+1))
+	}))
+	defer huge.Close()
+
+	oldClient, oldToken := remoteClient, RemotesToken
+	remoteClient, RemotesToken = peer.Client(), "secret"
+	defer func() { remoteClient, RemotesToken = oldClient, oldToken }()
+
+	// Peers that fail are reported without holding back the others.
+	remotes := []string{peer.URL, failing.URL, strings.TrimPrefix(huge.URL, "https://")}
+	listings := remoteListings(remotes)
+	c.Assert(listings, HasLen, 3)
+	c.Assert(listings[0].Error, Equals, "")
+	c.Assert(listings[0].Datasets, DeepEquals, []RemoteDataset{{Root: "abc", Data: []dvid.DataString{"gray"}}})
+	c.Assert(authorization, Equals, "Bearer secret")
+	c.Assert(listings[1].Error, Matches, "Server replied with status 503.*")
+	c.Assert(listings[1].Datasets, HasLen, 0)
+	c.Assert(listings[2].Server, Equals, remotes[2])
+	c.Assert(listings[2].Error, Matches, "Server replied with more than .* bytes")
+
+	// The token is not sent in cleartext.
+	plain := httptest.NewServer(peer.Config.Handler)
+	defer plain.Close()
+	listings = remoteListings([]string{plain.URL})
+	c.Assert(listings[0].Error, Equals, "")
+	c.Assert(authorization, Equals, "")
+}
+
+func (s *ServerSuite) TestRunBenchmark(c *C) {
+	var mu sync.Mutex
+	var paths []string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/sparsevol/1") {
+			http.Error(w, "no label", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "0123456789")
+	}))
+	defer peer.Close()
+	address := strings.TrimPrefix(peer.URL, "http://")
+	takePaths := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		taken := paths
+		paths = nil
+		sort.Strings(taken)
+		return taken
+	}
+
+	config := dvid.NewConfig()
+	config.Set("requests", "20")
+	config.Set("concurrency", "3")
+	config.Set("labels", "1_2")
+	result, err := RunBenchmark(address, "sparsevol", "abc", "bodies", config)
+	c.Assert(err, IsNil)
+	c.Assert(result.Requests, Equals, 20)
+	c.Assert(result.Concurrency, Equals, 3)
+	first := takePaths()
+	c.Assert(first, HasLen, 20)
+	c.Assert(first[0], Equals, WebAPIPath+"node/abc/bodies/sparsevol/1")
+	c.Assert(result.Errors > 0 && result.Errors < 20, Equals, true)
+	c.Assert(result.LatencyMs.Min <= result.LatencyMs.P50, Equals, true)
+	c.Assert(result.LatencyMs.P50 <= result.LatencyMs.Max, Equals, true)
+
+	// Runs with the same seed send the same requests.
+	_, err = RunBenchmark(address, "sparsevol", "abc", "bodies", config)
+	c.Assert(err, IsNil)
+	c.Assert(takePaths(), DeepEquals, first)
+
+	_, err = RunBenchmark(address, "unknown", "abc", "bodies", config)
+	c.Assert(err, ErrorMatches, "(?s)Unknown benchmark profile 'unknown'.*")
+	config.Set("requests", "0")
+	_, err = RunBenchmark(address, "sparsevol", "abc", "bodies", config)
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestBenchResults(c *C) {
+	dir := c.MkDir()
+	baseline := &BenchResult{Profile: "tile-serving", Requests: 10, Concurrency: 2, Seed: 1,
+		RequestsPerSec: 100, MBPerSec: 10, LatencyMs: BenchLatency{Mean: 10, P50: 10, P95: 20, P99: 30}}
+
+	filename := filepath.Join(dir, "baseline.json")
+	c.Assert(WriteBenchResult(baseline, filename), IsNil)
+	read, err := ReadBenchResult(filename)
+	c.Assert(err, IsNil)
+	c.Assert(read.RequestsPerSec, Equals, baseline.RequestsPerSec)
+	c.Assert(read.LatencyMs, DeepEquals, baseline.LatencyMs)
+
+	// CSV results get a header row once and a row for each run.
+	csvname := filepath.Join(dir, "results.csv")
+	c.Assert(WriteBenchResult(baseline, csvname), IsNil)
+	c.Assert(WriteBenchResult(baseline, csvname), IsNil)
+	data, err := ioutil.ReadFile(csvname)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(lines, HasLen, 3)
+	c.Assert(lines[0], Matches, "profile,server,started,.*")
+
+	// Changes within the threshold are not regressions.
+	current := *baseline
+	current.RequestsPerSec = 95
+	current.LatencyMs.P95 = 21
+	report, regressed := CompareBenchResults(baseline, &current, 10)
+	c.Assert(regressed, Equals, false, Commentf("report:\n%s", report))
+
+	current.LatencyMs.P99 = 40
+	report, regressed = CompareBenchResults(baseline, &current, 10)
+	c.Assert(regressed, Equals, true)
+	c.Assert(report, Matches, "(?s).*p99 ms.*REGRESSION.*")
+
+	current = *baseline
+	current.Errors = 1
+	_, regressed = CompareBenchResults(baseline, &current, 10)
+	c.Assert(regressed, Equals, true)
+}
+
+func (s *ServerSuite) TestRPCAdminCommands(c *C) {
+	user := &datastore.AuthToken{User: "rpcuser"}
+	admin := &datastore.AuthToken{User: "rpcadmin", Admin: true}
+	commands := []dvid.Command{
+		{"checkout", "abc", "/tmp/checkout"},
+		{"push", "abc", "remote:8000"},
+		{"pull", "abc", "remote:8000"},
+		{"backup", "/tmp/backup.tar"},
+		{"stats"},
+	}
+	for _, command := range commands {
+		cmd := datastore.Request{Command: command}
+		c.Assert(checkRPCAdmin(cmd, user), ErrorMatches, ".*can only be run with an admin token",
+			Commentf("command %q", command.Name()))
+		c.Assert(checkRPCAdmin(cmd, admin), IsNil)
+		c.Assert(checkRPCAdmin(cmd, nil), IsNil) // authentication is not required
+	}
+	cmd := datastore.Request{Command: dvid.Command{"datasets", "info"}}
+	c.Assert(checkRPCAdmin(cmd, user), IsNil)
+}
+
+func (s *ServerSuite) TestJobLimitsOwner(c *C) {
+	job := datastore.StartJob("test", "job limits owner", datastore.JobLimits{})
+	defer job.Finish()
+	r := httptest.NewRequest("POST", WebAPIPath+"jobs/gc", nil)
+	r.Header.Set(UserHeader, "jobowner")
+	JobStarted(httptest.NewRecorder(), r, job)
+	c.Assert(job.Owner(), Equals, "jobowner")
+
+	idStr := fmt.Sprintf("%d", job.ID)
+	config := dvid.NewConfig()
+	config.Set("workers", "2")
+	_, err := setJobLimits(idStr, config, "someone", false)
+	c.Assert(err, ErrorMatches, ".*can only be changed by an admin or the user that started it")
+	c.Assert(job.Limits().Workers, Equals, 0)
+
+	limits, err := setJobLimits(idStr, config, "jobowner", false)
+	c.Assert(err, IsNil)
+	c.Assert(limits.Workers, Equals, 2)
+	config.Set("workers", "3")
+	_, err = setJobLimits(idStr, config, "someone", true)
+	c.Assert(err, IsNil)
+	c.Assert(job.Limits().Workers, Equals, 3)
+
+	// Jobs without an owner can only be changed by admins.
+	job.SetOwner("")
+	c.Assert(checkJobOwner(job, "", false), NotNil)
+	c.Assert(checkJobOwner(job, "", true), IsNil)
+}
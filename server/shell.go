@@ -0,0 +1,197 @@
+/*
+	This file supports an interactive shell sending commands to a DVID server over RPC,
+	with command history and tab completion of commands, node UUIDs, and data names
+	fetched from the server.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/peterh/liner"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// ShellHistoryFile is the file in the user's home directory holding shell history.
+const ShellHistoryFile = ".dvid_history"
+
+// shellCommands are the commands completed as the first word of a shell line, including
+// the shell's own "refresh" and "exit".
+var shellCommands = []string{"about", "backup", "checkout", "clone", "clone-data", "compact",
+	"dataset", "datasets", "exit", "export", "gc", "group", "groups", "help", "import", "job", "jobs",
+	"migrate", "node", "pull", "push", "quit", "refresh", "remotes", "restore", "shutdown",
+	"stats", "token", "tokens", "types", "verify"}
+
+// shell sends the lines entered by a user to a server.
+type shell struct {
+	client *Client
+	token  string
+
+	// Node UUIDs and data names of all datasets for completion.
+	uuids []string
+	names []string
+}
+
+// Shell runs an interactive shell sending commands to the server at the RPC address
+// until the user enters "exit" or end of file.  Commands are sent with the token, if
+// any, and history is kept across shells in ShellHistoryFile.
+func Shell(rpcAddress, token string) error {
+	client := NewClient(rpcAddress)
+	if !client.Connected() {
+		return fmt.Errorf("Shell requires a running DVID server at %s", rpcAddress)
+	}
+	sh := &shell{client: client, token: token}
+	sh.refresh()
+
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	line.SetCompleter(sh.complete)
+	var historyPath string
+	if home := os.Getenv("HOME"); home != "" {
+		historyPath = filepath.Join(home, ShellHistoryFile)
+		if f, err := os.Open(historyPath); err == nil {
+			line.ReadHistory(f)
+			f.Close()
+		}
+	}
+
+	fmt.Printf("Connected to DVID server at %s.  Enter \"help\" for commands, \"refresh\" to update\n", rpcAddress)
+	fmt.Printf("tab completion of UUIDs and data names, and \"exit\" to quit.\n")
+	for done := false; !done; {
+		input, err := line.Prompt("dvid> ")
+		switch {
+		case err == liner.ErrPromptAborted:
+			continue
+		case err == io.EOF:
+			fmt.Println()
+			done = true
+			continue
+		case err != nil:
+			return err
+		}
+		input = strings.TrimSpace(input)
+		if input == "" {
+			continue
+		}
+		line.AppendHistory(input)
+		switch input {
+		case "exit", "quit":
+			done = true
+		case "refresh":
+			sh.refresh()
+		default:
+			sh.run(input)
+		}
+	}
+
+	if historyPath != "" {
+		if f, err := os.Create(historyPath); err == nil {
+			line.WriteHistory(f)
+			f.Close()
+		}
+	}
+	return nil
+}
+
+// run sends a command to the server and prints its response.
+func (sh *shell) run(input string) {
+	request := datastore.Request{Command: dvid.Command(strings.Fields(input)), Token: sh.token}
+	reply, err := sh.client.Call(request)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	text := reply.Text
+	if text == "" {
+		text = string(reply.Output)
+	}
+	fmt.Print(prettyResponse(text))
+
+	// Commands that add nodes or data change what can be completed.
+	switch request.Name() {
+	case "datasets", "dataset", "node", "clone-data", "import", "restore", "pull":
+		sh.refresh()
+	}
+}
+
+// refresh fetches the node UUIDs and data names of all datasets for completion.
+func (sh *shell) refresh() {
+	request := datastore.Request{Command: dvid.Command{"datasets", "all"}, Token: sh.token}
+	reply, err := sh.client.Call(request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to fetch datasets for completion: %s\n", err.Error())
+		return
+	}
+	var all struct {
+		Datasets []struct {
+			Nodes   map[string]json.RawMessage
+			DataMap map[string]json.RawMessage
+		}
+	}
+	if err = json.Unmarshal([]byte(reply.Text), &all); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to decode datasets for completion: %s\n", err.Error())
+		return
+	}
+	sh.uuids, sh.names = nil, nil
+	seen := make(map[string]bool)
+	for _, dataset := range all.Datasets {
+		for uuid := range dataset.Nodes {
+			sh.uuids = append(sh.uuids, uuid)
+		}
+		for name := range dataset.DataMap {
+			if !seen[name] {
+				seen[name] = true
+				sh.names = append(sh.names, name)
+			}
+		}
+	}
+	sort.Strings(sh.uuids)
+	sort.Strings(sh.names)
+}
+
+// complete returns the completions of the last word of a line, which are commands for
+// the first word and otherwise node UUIDs and data names.
+func (sh *shell) complete(line string) []string {
+	start := strings.LastIndex(line, " ") + 1
+	head, word := line[:start], line[start:]
+	var candidates []string
+	if strings.TrimSpace(head) == "" {
+		candidates = shellCommands
+	} else {
+		candidates = append(append(candidates, sh.uuids...), sh.names...)
+	}
+	var completions []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			completions = append(completions, head+candidate)
+		}
+	}
+	return completions
+}
+
+// prettyResponse returns a response with JSON indented and a final newline.
+func prettyResponse(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, []byte(trimmed), "", "  "); err == nil {
+			buf.WriteString("\n")
+			return buf.String()
+		}
+	}
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text
+}
@@ -0,0 +1,248 @@
+/*
+	This file supports graceful shutdown.  New connections and RPC commands are refused,
+	in-flight HTTP, RPC, and gRPC requests and chunk handlers are given time to finish,
+	background jobs are cancelled and given time to stop, and pending writes are flushed
+	before the storage engine is closed.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// ShutdownTimeout is how long shutdown waits for in-flight requests and chunk handlers
+// before closing the datastore anyway.
+var ShutdownTimeout = 30 * time.Second
+
+var (
+	// The servers to stop at shutdown, set once they are listening.
+	serversLock sync.Mutex
+	webServer   *http.Server
+	rpcServer   *http.Server
+	grpcServer  *grpc.Server
+
+	// rpcRequests tracks RPC commands, whose connections are hijacked from the HTTP
+	// server and so are not drained by it.
+	rpcRequests requestTracker
+
+	// background tracks goroutines started by the server, e.g., trash collection and
+	// conversions, so shutdown can wait for them.  stopping is closed when shutdown
+	// begins so their loops can end.
+	backgroundLock sync.Mutex
+	background     sync.WaitGroup
+	stopping       = make(chan struct{})
+
+	shutdownOnce sync.Once
+
+	// shutdownComplete is closed when the datastore has been closed.
+	shutdownComplete = make(chan struct{})
+)
+
+// requestTracker counts in-flight requests so they can be drained.
+type requestTracker struct {
+	sync.Mutex
+	active  int
+	closed  bool
+	drained chan struct{}
+}
+
+// begin counts a new request and returns true, or returns false if requests are
+// being drained.
+func (t *requestTracker) begin() bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed {
+		return false
+	}
+	t.active++
+	return true
+}
+
+// end marks the completion of a request counted by begin.
+func (t *requestTracker) end() {
+	t.Lock()
+	defer t.Unlock()
+	t.active--
+	if t.closed && t.active == 0 {
+		close(t.drained)
+	}
+}
+
+// drain refuses new requests and returns a channel that is closed once the in-flight
+// requests have ended.
+func (t *requestTracker) drain() <-chan struct{} {
+	t.Lock()
+	defer t.Unlock()
+	if !t.closed {
+		t.closed = true
+		t.drained = make(chan struct{})
+		if t.active == 0 {
+			close(t.drained)
+		}
+	}
+	return t.drained
+}
+
+// setServer records a server listening for requests so it can be stopped at shutdown.
+func setServer(server **http.Server, s *http.Server) {
+	serversLock.Lock()
+	*server = s
+	serversLock.Unlock()
+}
+
+// stopServers stops the servers from accepting connections and waits until their
+// in-flight requests end or the context is done.
+func stopServers(ctx context.Context) {
+	serversLock.Lock()
+	servers := []*http.Server{webServer, rpcServer}
+	grpcSrv := grpcServer
+	serversLock.Unlock()
+
+	wg := new(sync.WaitGroup)
+	for _, s := range servers {
+		if s == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Printf("Closing connections of server at %s: %s\n", s.Addr, err.Error())
+				s.Close()
+			}
+		}(s)
+	}
+	if grpcSrv != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				grpcSrv.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				log.Printf("Closing gRPC connections: %s\n", ctx.Err())
+				grpcSrv.Stop()
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-rpcRequests.drain():
+	case <-ctx.Done():
+		log.Printf("Abandoning in-flight RPC commands: %s\n", ctx.Err())
+	}
+}
+
+// goBackground runs f in a goroutine that shutdown waits for.  Once shutdown has begun,
+// f is not run.
+func goBackground(f func()) {
+	backgroundLock.Lock()
+	defer backgroundLock.Unlock()
+	select {
+	case <-stopping:
+		return
+	default:
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+}
+
+// stopBackground cancels running jobs and waits until they and the goroutines started
+// by goBackground end or the context is done.
+func stopBackground(ctx context.Context) {
+	backgroundLock.Lock()
+	close(stopping)
+	backgroundLock.Unlock()
+
+	if running := datastore.CancelJobs(ctx); len(running) != 0 {
+		log.Printf("Continuing shutdown with %d jobs running: %s\n", len(running), ctx.Err())
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Printf("Continuing shutdown with background work running: %s\n", ctx.Err())
+	}
+}
+
+// waitForChunkHandlers waits until no chunk handlers are active or the context is done.
+func waitForChunkHandlers(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var lastReport time.Time
+	for {
+		active := MaxChunkHandlers - len(HandlerToken)
+		if active <= 0 {
+			log.Println("No chunk handlers active...")
+			return
+		}
+		if time.Since(lastReport) >= time.Second {
+			log.Printf("Waiting for %d chunk handlers to finish...\n", active)
+			lastReport = time.Now()
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("Continuing shutdown with %d chunk handlers active: %s\n", active, ctx.Err())
+			return
+		}
+	}
+}
+
+// Shutdown handles graceful cleanup of server functions before exiting DVID.  New
+// connections and RPC commands are refused, in-flight requests, chunk handlers, and
+// cancelled background jobs are given up to ShutdownTimeout to finish, and the
+// datastore is then flushed and closed.  Only the first call has effect, and later calls wait for it to complete.
+// This may not be so graceful if the chunk handler uses cgo since the interrupt
+// may be caught during cgo execution.
+func Shutdown() {
+	shutdownOnce.Do(func() {
+		defer close(shutdownComplete)
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+
+		announceStopping()
+		log.Printf("Draining requests for up to %s...\n", ShutdownTimeout)
+		stopServers(ctx)
+		waitForChunkHandlers(ctx)
+		stopBackground(ctx)
+
+		if runningService.Service != nil {
+			runningService.Service.Shutdown()
+		}
+		storage.Shutdown()
+		closeAuditLog()
+		dvid.BlockOnActiveCgo()
+		log.Printf("Shutdown completed in %s.\n", time.Since(start))
+	})
+	<-shutdownComplete
+}
+
+// errShuttingDown is returned for RPC commands received during shutdown.
+var errShuttingDown = fmt.Errorf("Server is shutting down")
@@ -0,0 +1,54 @@
+/*
+	This file supports deadlines and cancellation of HTTP API requests.  Each request's
+	context is passed to the data service handling it, so a client disconnect or an
+	expired deadline stops in-progress block reads instead of finishing work no one
+	will receive.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// RequestTimeout is the longest an HTTP API request may run before its context is
+// canceled.  If 0, requests have no deadline.  Upgraded connections, e.g., WebSockets,
+// and server-sent event streams are not subject to it.
+var RequestTimeout time.Duration
+
+// timeoutHandler wraps an HTTP handler so its request context expires after
+// RequestTimeout.
+func timeoutHandler(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RequestTimeout > 0 && !headerHas(r, "Connection", "upgrade") &&
+			!headerHas(r, "Accept", "text/event-stream") {
+			ctx, cancel := context.WithTimeout(r.Context(), RequestTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		handler(w, r)
+	}
+}
+
+// dataServiceError replies to a request whose data service returned an error.  If
+// the request was canceled, the client has gone and only a log entry is made, and if
+// its deadline passed, the reply is a 503 so clients may retry.
+func dataServiceError(w http.ResponseWriter, r *http.Request, err error) {
+	switch r.Context().Err() {
+	case context.Canceled:
+		dvid.Log(dvid.Debug, "Request canceled by client: %s %s\n", r.Method, r.URL.Path)
+	case context.DeadlineExceeded:
+		dvid.Log(dvid.Normal, "Request exceeded %s time limit: %s %s\n", RequestTimeout, r.Method, r.URL.Path)
+		w.Header().Del("ETag")
+		w.Header().Del("Cache-Control")
+		http.Error(w, fmt.Sprintf("Request exceeded the server's %s time limit (%s).\n",
+			RequestTimeout, r.URL.Path), http.StatusServiceUnavailable)
+	default:
+		BadRequest(w, r, err.Error())
+	}
+}
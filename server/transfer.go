@@ -0,0 +1,203 @@
+/*
+	This file supports transfers of data between running DVID servers, e.g., to move data
+	off an overloaded server without downtime.  A client reads batches of key/value pairs
+	from the source server and sends each to the destination server, which saves its
+	progress so a transfer interrupted for any reason resumes where it stopped when the
+	client is run again.  Like replication, transfer requests are authenticated by the key
+	shared by the servers.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// transferURL returns the URL of a transfer endpoint for data at a node on a remote server.
+func transferURL(remote string, uuid dvid.UUID, name dvid.DataString, endpoint string) string {
+	return replicationURL(remote, fmt.Sprintf("%s/transfer/%s/%s", uuid, url.PathEscape(string(name)), endpoint))
+}
+
+// sendTransfer sends a transfer request with an optional gob-encoded body to a remote
+// server and decodes its response into reply, which is gob-encoded from source servers
+// and JSON from destination servers.
+func sendTransfer(method, url string, body, reply interface{}, isJSON bool) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	resp, err := sendReplication(method, url, &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if isJSON {
+		err = json.NewDecoder(resp.Body).Decode(reply)
+	} else {
+		err = gob.NewDecoder(resp.Body).Decode(reply)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to decode response of %s: %s", url, err.Error())
+	}
+	return nil
+}
+
+// Transfer copies the named data as resolved at a node from the source server to the
+// same node of the destination server, where each is given by its web address.  The
+// destination server must already hold the node, e.g., through replication.  If a
+// transfer of the data was interrupted, it resumes after the last batch the destination
+// stored.  Batches hold about batchBytes of key/value pairs, and reads are throttled to
+// the I/O rate of the limits.
+func Transfer(src, dst, uuidStr string, name dvid.DataString, batchBytes int,
+	limits datastore.JobLimits) (*datastore.Transfer, error) {
+
+	source := new(datastore.TransferSource)
+	if err := sendTransfer("GET", transferURL(src, dvid.UUID(uuidStr), name, "source"), nil, source, false); err != nil {
+		return nil, err
+	}
+	uuid := source.Node
+	transfer := new(datastore.Transfer)
+	if err := sendTransfer("POST", transferURL(dst, uuid, name, "begin"), source, transfer, true); err != nil {
+		return nil, err
+	}
+	job := datastore.StartJob("transfer", fmt.Sprintf("transfer '%s' at node %s from %s to %s",
+		name, uuid, src, dst), limits)
+	defer job.Finish()
+
+	for !transfer.Done {
+		query := url.Values{}
+		query.Set("version", strconv.Itoa(transfer.Next.Version))
+		query.Set("index", hex.EncodeToString(transfer.Next.Index))
+		query.Set("maxbytes", strconv.Itoa(batchBytes))
+		batch := new(datastore.TransferBatch)
+		err := sendTransfer("GET", transferURL(src, uuid, name, "batch")+"?"+query.Encode(), nil, batch, false)
+		if err != nil {
+			return transfer, err
+		}
+		var numBytes int
+		for _, pair := range batch.Pairs {
+			numBytes += len(pair.Index) + len(pair.Value)
+		}
+		job.Throttle(numBytes)
+		if err = sendTransfer("POST", transferURL(dst, uuid, name, "batch"), batch, transfer, true); err != nil {
+			return transfer, err
+		}
+	}
+	return transfer, nil
+}
+
+// transferRequest handles transfer requests for data at a node from other servers:
+//
+//	GET  <api URL>/replicate/<UUID>/transfer/<data name>/source   (gob description of the data)
+//	GET  <api URL>/replicate/<UUID>/transfer/<data name>/batch    (gob batch after a cursor)
+//	POST <api URL>/replicate/<UUID>/transfer/<data name>/begin    (begins or resumes a transfer)
+//	POST <api URL>/replicate/<UUID>/transfer/<data name>/batch    (stores a gob batch)
+//
+// A batch is read after the cursor given by the "version" and hex "index" query strings
+// and holds about "maxbytes" of key/value pairs.  Destination endpoints return the JSON
+// progress of the transfer.
+func transferRequest(w http.ResponseWriter, r *http.Request, uuidStr, name, op string) {
+	uuid, err := MatchingUUID(uuidStr)
+	if err != nil {
+		if op != "begin" {
+			BadUUID(w, r, err)
+			return
+		}
+		// The node of a new transfer is given in full by the source description.
+		uuid = dvid.UUID(uuidStr)
+	}
+	dataname := dvid.DataString(name)
+	action := strings.ToLower(r.Method)
+
+	var reply interface{}
+	switch {
+	case op == "source" && action == "get":
+		reply, err = runningService.TransferSource(uuid, dataname)
+
+	case op == "batch" && action == "get":
+		query := r.URL.Query()
+		var cursor datastore.TransferCursor
+		if cursor.Version, err = strconv.Atoi(query.Get("version")); err != nil {
+			BadRequest(w, r, "Transfer batches require an integer 'version' query string")
+			return
+		}
+		if cursor.Index, err = hex.DecodeString(query.Get("index")); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Illegal 'index' query string: %s", err.Error()))
+			return
+		}
+		if len(cursor.Index) == 0 {
+			cursor.Index = nil
+		}
+		maxBytes := datastore.DefaultTransferBatchBytes
+		if maxStr := query.Get("maxbytes"); maxStr != "" {
+			if maxBytes, err = strconv.Atoi(maxStr); err != nil {
+				BadRequest(w, r, fmt.Sprintf("Illegal 'maxbytes' query string: %s", err.Error()))
+				return
+			}
+		}
+		reply, err = runningService.ReadTransferBatch(uuid, dataname, cursor, maxBytes)
+
+	case op == "begin" && action == "post":
+		source := new(datastore.TransferSource)
+		if err = gob.NewDecoder(r.Body).Decode(source); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Transfer begin requires a gob-encoded source description: %s", err.Error()))
+			return
+		}
+		if source.Node != uuid || source.Data != dataname {
+			BadRequest(w, r, fmt.Sprintf("Transfer source describes data '%s' at node %s, not '%s' at %s",
+				source.Data, source.Node, dataname, uuid))
+			return
+		}
+		var transfer *datastore.Transfer
+		if transfer, err = runningService.BeginTransfer(source); err == nil {
+			dvid.Log(dvid.Normal, "Transfer of data '%s' at node %s from %s at %d key/value pairs\n",
+				dataname, uuid, r.RemoteAddr, transfer.Keys)
+		}
+		reply = transfer
+
+	case op == "batch" && action == "post":
+		batch := new(datastore.TransferBatch)
+		if err = gob.NewDecoder(r.Body).Decode(batch); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Transfer batches must be gob-encoded: %s", err.Error()))
+			return
+		}
+		var transfer *datastore.Transfer
+		if transfer, err = runningService.StoreTransferBatch(uuid, dataname, batch); err == nil && batch.Done {
+			dvid.Log(dvid.Normal, "Finished transfer of data '%s' at node %s: %d key/value pairs, %d bytes\n",
+				dataname, uuid, transfer.Keys, transfer.Bytes)
+		}
+		reply = transfer
+
+	default:
+		BadRequest(w, r, "Transfer requests are GET .../transfer/<data name>/source, GET or POST "+
+			".../transfer/<data name>/batch, or POST .../transfer/<data name>/begin")
+		return
+	}
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	if action == "get" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		err = gob.NewEncoder(w).Encode(reply)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(reply)
+	}
+	if err != nil {
+		dvid.Log(dvid.Normal, "Error sending transfer of data '%s' to %s: %s\n", dataname, r.RemoteAddr, err.Error())
+	}
+}
@@ -8,9 +8,12 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/janelia-flyem/dvid/datastore"
@@ -92,9 +95,35 @@ func BadRequest(w http.ResponseWriter, r *http.Request, message string) {
 	errorMsg := fmt.Sprintf("ERROR using REST API: %s (%s).", message, r.URL.Path)
 	errorMsg += "  Use 'dvid help' to get proper API request format.\n"
 	dvid.Log(dvid.Normal, errorMsg)
+	// Errors must not be cached as data.
+	w.Header().Del("ETag")
+	w.Header().Del("Cache-Control")
 	http.Error(w, errorMsg, http.StatusBadRequest)
 }
 
+// BadUUID replies to a request whose UUID string did not match a node.  An ambiguous
+// partial UUID gets a JSON reply listing the matching UUIDs.
+func BadUUID(w http.ResponseWriter, r *http.Request, err error) {
+	ambiguous, ok := err.(*datastore.AmbiguousUUIDError)
+	if !ok {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	dvid.Log(dvid.Normal, "ERROR using REST API: %s (%s).\n", err.Error(), r.URL.Path)
+	m, jsonErr := json.Marshal(struct {
+		Error      string
+		Prefix     string
+		Candidates []dvid.UUID
+	}{err.Error(), ambiguous.Prefix, ambiguous.Candidates})
+	if jsonErr != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, string(m))
+}
+
 // DecodeJSON decodes JSON passed in a request into a dvid.Config.
 func DecodeJSON(r *http.Request) (dvid.Config, error) {
 	config := dvid.NewConfig()
@@ -126,6 +155,14 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		BadRequest(w, r, "Poorly formed request")
 		return
 	}
+	if datastore.KeysReadOnly() && !readMethod(r.Method) {
+		errorMsg := fmt.Sprintf("ERROR using REST API: data cannot be modified while data keys are migrated (%s).\n",
+			r.URL.Path)
+		dvid.Log(dvid.Normal, errorMsg)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, errorMsg, http.StatusServiceUnavailable)
+		return
+	}
 
 	// Handle the requests
 	switch parts[0] {
@@ -137,10 +174,32 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		serverRequest(w, r)
 	case "datasets":
 		datasetsRequest(w, r)
+	case "remotes":
+		remotesRequest(w, r)
 	case "dataset":
 		datasetRequest(w, r)
 	case "node":
 		nodeRequest(w, r)
+	case "jobs":
+		jobsRequest(w, r, parts[1:])
+	case "job":
+		jobRequest(w, r, parts[1:])
+	case "replicate":
+		replicateRequest(w, r, parts[1:])
+	case "login":
+		loginRequest(w, r, parts[1:])
+	case "logout":
+		logoutRequest(w, r)
+	case "admin":
+		adminRequest(w, r, parts[1:])
+	case "batch":
+		batchHandler(w, r)
+	case "stats":
+		statsRequest(w, r)
+	case "backup":
+		backupRequest(w, r)
+	case "restore":
+		restoreRequest(w, r)
 	default:
 		BadRequest(w, r, "Request not in API")
 	}
@@ -195,9 +254,23 @@ func serverRequest(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(url, "/")
 
 	badRequest := func() {
-		BadRequest(w, r, WebAPIPath+"server/ must be followed with 'info' or 'types'")
+		BadRequest(w, r, WebAPIPath+"server/ must be followed with 'info', 'types', 'capabilities', 'cache', 'tokens' or 'groups'")
 	}
 
+	if parts[0] == "groups" {
+		if len(parts) == 2 && parts[1] == "" {
+			parts = parts[:1]
+		}
+		groupsRequest(w, r, parts[1:])
+		return
+	}
+	if parts[0] == "tokens" {
+		if len(parts) == 2 && parts[1] == "" {
+			parts = parts[:1]
+		}
+		tokensRequest(w, r, parts[1:])
+		return
+	}
 	if len(parts) != 1 {
 		badRequest()
 		return
@@ -220,11 +293,259 @@ func serverRequest(w http.ResponseWriter, r *http.Request) {
 		}
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, jsonStr)
+	case "capabilities":
+		jsonStr, err := capabilitiesJSON()
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, jsonStr)
+	case "cache":
+		stats, cached := runningService.CacheStats()
+		m, err := json.Marshal(struct {
+			Enabled bool
+			storage.CacheStats
+		}{cached, stats})
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
 	default:
 		badRequest()
 	}
 }
 
+// statsRequest handles GET <api URL>/stats[?uuid=<UUID>][&refresh=true], which returns
+// the stats of all datasets, or the dataset with the UUID, as JSON.
+func statsRequest(w http.ResponseWriter, r *http.Request) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Stats must be requested with GET "+WebAPIPath+"stats")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	var uuid dvid.UUID
+	if uuidStr := query.Get("uuid"); uuidStr != "" {
+		var err error
+		if uuid, err = MatchingUUID(uuidStr); err != nil {
+			BadUUID(w, r, err)
+			return
+		}
+	}
+	jsonStr, err := runningService.StatsJSON(uuid, query.Get("refresh") == "true")
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, jsonStr)
+}
+
+// jobsRequest lists the running background jobs on GET <api URL>/jobs, and on
+// POST <api URL>/jobs/gc[?mode=dry-run&workers=<#>&iorate=<MB/s>] starts garbage
+// collection of abandoned versions as a background job.
+func jobsRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	action := strings.ToLower(r.Method)
+	switch {
+	case action == "get" && (len(parts) == 0 || parts[0] == ""):
+		jsonStr, err := datastore.JobsJSON()
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, jsonStr)
+	case action == "post" && len(parts) == 1 && parts[0] == "gc":
+		if !requireAdmin(w, r) {
+			return
+		}
+		query := r.URL.Query()
+		mode := query.Get("mode")
+		if mode != "" && mode != "dry-run" {
+			BadRequest(w, r, fmt.Sprintf("Unknown gc mode %q: use 'dry-run' or no mode", mode))
+			return
+		}
+		limits, err := datastore.JobLimitsFromConfig(queryConfig(r, "workers", "iorate"))
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		JobStarted(w, r, runningService.StartCollectVersions(mode == "dry-run", limits))
+	default:
+		BadRequest(w, r, "Use GET "+WebAPIPath+"jobs to list jobs or POST "+WebAPIPath+"jobs/gc to start one")
+	}
+}
+
+// queryConfig returns a dvid.Config with the given keys set from a request's query
+// string.
+func queryConfig(r *http.Request, keys ...string) dvid.Config {
+	config := dvid.NewConfig()
+	query := r.URL.Query()
+	for _, key := range keys {
+		if value := query.Get(key); value != "" {
+			config.Set(key, value)
+		}
+	}
+	return config
+}
+
+// JobStarted replies to a request that started a background job with a 202 status and
+// JSON giving the job ID, e.g., {"ID": 3}.  The Location header is the URL of the job,
+// whose progress can be followed at its "events" endpoint.  The user making the request
+// is recorded as the job's owner, who may change its limits.
+func JobStarted(w http.ResponseWriter, r *http.Request, job *datastore.Job) {
+	job.SetOwner(r.Header.Get(UserHeader))
+	w.Header().Set("Location", fmt.Sprintf("%sjob/%d", WebAPIPath, job.ID))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "{%q: %d}", "ID", job.ID)
+}
+
+// jobRequest handles requests on a job:
+//
+//	GET  <api URL>/job/<id>          status, result, and log of a running or finished job
+//	GET  <api URL>/job/<id>/events   server-sent events of progress until the job finishes
+//	POST <api URL>/job/<id>/limits?workers=<#>&iorate=<MB/s>   changes limits of a running job
+//
+// If authentication is required, only admins and the user that started a job can change
+// its limits.
+func jobRequest(w http.ResponseWriter, r *http.Request, parts []string) {
+	action := strings.ToLower(r.Method)
+	if len(parts) == 0 || parts[0] == "" {
+		BadRequest(w, r, "Job requests must be followed by a job id")
+		return
+	}
+	var endpoint string
+	if len(parts) > 1 {
+		endpoint = parts[1]
+	}
+	switch {
+	case action == "get" && endpoint == "":
+		job, err := findJob(parts[0])
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		m, err := json.Marshal(job)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(m)
+	case action == "get" && endpoint == "events":
+		job, err := findJob(parts[0])
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		jobEventsRequest(w, r, job)
+	case action == "post" && endpoint == "limits":
+		job, err := findJob(parts[0])
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		user, admin := r.Header.Get(UserHeader), !AuthRequired || isAdmin(r)
+		if err := checkJobOwner(job, user, admin); err != nil {
+			errorMsg := fmt.Sprintf("ERROR using REST API: %s (%s).\n", err.Error(), r.URL.Path)
+			dvid.Log(dvid.Normal, errorMsg)
+			http.Error(w, errorMsg, http.StatusForbidden)
+			return
+		}
+		if _, err := setJobLimits(parts[0], queryConfig(r, "workers", "iorate"), user, admin); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		jsonStr, err := datastore.JobsJSON()
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, jsonStr)
+	default:
+		BadRequest(w, r, "Job requests must be GET of "+WebAPIPath+"job/<id>[/events] or POST of "+
+			WebAPIPath+"job/<id>/limits")
+	}
+}
+
+// findJob returns the running or recently finished job with an id string.
+func findJob(idStr string) (*datastore.Job, error) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, fmt.Errorf("Illegal job id '%s'", idStr)
+	}
+	return datastore.FindJob(id)
+}
+
+// JobKeepAlive is the interval between comments sent on an idle job event stream so
+// proxies do not close it.
+const JobKeepAlive = 15 * time.Second
+
+// jobEventsRequest streams a job's progress as server-sent events.  The first "status"
+// event and the final "done" event give the job's JSON, and "progress" and "log" events
+// give JSON of each datastore.JobEvent in between.
+func jobEventsRequest(w http.ResponseWriter, r *http.Request, job *datastore.Job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		BadRequest(w, r, "Streaming of job events is not supported by this connection")
+		return
+	}
+	events, unsubscribe := job.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	sendEvent := func(eventType string, v interface{}) error {
+		m, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, m); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if err := sendEvent("status", job); err != nil {
+		return
+	}
+	keepAlive := time.NewTicker(JobKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, open := <-events:
+			if !open {
+				sendEvent("done", job)
+				return
+			}
+			if err := sendEvent(event.Type, event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// setMetadataVersion adds the datastore's metadata consistency version to a response
+// so clients can tell whether metadata has changed since an earlier request.
+func setMetadataVersion(w http.ResponseWriter) {
+	w.Header().Set("X-Dvid-Metadata-Version", strconv.FormatUint(runningService.MetadataVersion(), 10))
+}
+
 func datasetsRequest(w http.ResponseWriter, r *http.Request) {
 	lenPath := len(WebAPIPath + "datasets/")
 	url := r.URL.Path[lenPath:]
@@ -241,30 +562,24 @@ func datasetsRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	switch parts[0] {
-	case "list":
-		jsonStr, err := runningService.DatasetsListJSON()
-		if err != nil {
-			BadRequest(w, r, err.Error())
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, jsonStr)
-	case "info":
-		jsonStr, err := runningService.DatasetsAllJSON()
+	case "list", "info":
+		jsonStr, err := datasetsJSON(parts[0] == "info", isAdmin(r), r.Header.Get(UserHeader))
 		if err != nil {
 			BadRequest(w, r, err.Error())
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
+		setMetadataVersion(w)
 		fmt.Fprintf(w, jsonStr)
 	case "new":
 		if action != "post" {
 			BadRequest(w, r, "Datasets 'new' request must be made with HTTP POST method")
 			return
 		}
-		root, _, err := runningService.NewDataset()
+		root, err := newDataset(isAdmin(r), r.Header.Get(UserHeader))
 		if err != nil {
 			BadRequest(w, r, err.Error())
+			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, "{%q: %q}", "Root", root)
@@ -287,7 +602,16 @@ func datasetRequest(w http.ResponseWriter, r *http.Request) {
 	// Get particular dataset for this UUID
 	uuid, err := MatchingUUID(parts[0])
 	if err != nil {
-		BadRequest(w, r, err.Error())
+		BadUUID(w, r, err)
+		return
+	}
+
+	// Handle the ACL of the dataset or its data, which checks access itself.
+	if parts[1] == "acl" {
+		aclRequest(w, r, uuid, parts[2:])
+		return
+	}
+	if !checkDatasetAccess(w, r, uuid, parts) {
 		return
 	}
 
@@ -299,10 +623,68 @@ func datasetRequest(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
+		setMetadataVersion(w)
 		fmt.Fprintf(w, jsonStr)
 		return
 	}
 
+	// Handle listing of webhooks of the dataset.
+	if parts[1] == "webhooks" {
+		jsonStr, err := runningService.WebHooksJSON(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		setMetadataVersion(w)
+		fmt.Fprint(w, jsonStr)
+		return
+	}
+
+	// Handle listing of all node UUIDs in the dataset.
+	if parts[1] == "uuids" {
+		jsonStr, err := runningService.NodeUUIDsJSON(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		setMetadataVersion(w)
+		fmt.Fprint(w, jsonStr)
+		return
+	}
+
+	// Handle query of the version DAG as JSON or Graphviz DOT.
+	if parts[1] == "dag" {
+		format := "json"
+		if len(parts) > 2 && parts[2] != "" {
+			format = parts[2]
+		}
+		switch format {
+		case "json":
+			jsonStr, err := runningService.DAGJSON(uuid)
+			if err != nil {
+				BadRequest(w, r, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			setMetadataVersion(w)
+			fmt.Fprint(w, jsonStr)
+		case "dot":
+			dot, err := runningService.DAGDot(uuid)
+			if err != nil {
+				BadRequest(w, r, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			setMetadataVersion(w)
+			fmt.Fprint(w, dot)
+		default:
+			BadRequest(w, r, fmt.Sprintf("Unknown format %q for version DAG: use 'json' or 'dot'", format))
+		}
+		return
+	}
+
 	// Handle creation of new data in dataset via POST.
 	if parts[1] == "new" {
 		if action != "post" {
@@ -332,16 +714,185 @@ func datasetRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Forward all other commands to the data service.
+	// Handle creation, listing, and deletion of scratch data.
+	if parts[1] == "scratch" {
+		scratchRequest(w, r, uuid, parts[2:])
+		return
+	}
+
+	// Handle profiling of stored keys, which scans all keys of the dataset in a job
+	// whose result is the profile.
+	if parts[1] == "profile" {
+		query := r.URL.Query()
+		opts, err := profileOptions(query.Get("stride"), query.Get("prefix"))
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		limits, err := datastore.JobLimitsFromConfig(queryConfig(r, "workers", "iorate"))
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		JobStarted(w, r, runningService.StartProfileKeys(uuid, opts, limits))
+		return
+	}
+
+	// Handle listing and restoration of deleted data.
+	if parts[1] == "trash" {
+		jsonStr, err := runningService.TrashJSON(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, jsonStr)
+		return
+	}
+	if parts[1] == "restore" {
+		if action != "post" {
+			BadRequest(w, r, "Dataset 'restore' request must be made with HTTP POST method")
+			return
+		}
+		if len(parts) != 3 {
+			BadRequest(w, r, "Bad URL: Expecting /api/dataset/<UUID>/restore/<data name>")
+			return
+		}
+		dataname := dvid.DataString(parts[2])
+		if err = runningService.RestoreData(uuid, dataname); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{%q: %q}", "result", fmt.Sprintf("Restored %s to node %s", dataname, uuid))
+		return
+	}
+
+	// Handle deletion of data into the trash via DELETE, or its permanent deletion with
+	// the "purge" query string.
 	dataname := dvid.DataString(parts[1])
+	if action == "delete" && len(parts) == 2 {
+		if r.URL.Query().Get("purge") == "true" {
+			purgeRequest(w, r, uuid, dataname)
+			return
+		}
+		if err = runningService.DeleteData(uuid, dataname); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{%q: %q}", "result", fmt.Sprintf("Moved %s to trash", dataname))
+		return
+	}
+
+	// Forward all other commands to the data service.
 	dataservice, err := runningService.DataServiceByUUID(uuid, dataname)
 	if err != nil {
 		BadRequest(w, r, err.Error())
 		return
 	}
-	err = dataservice.DoHTTP(uuid, w, r)
+	err = dataservice.DoHTTP(r.Context(), uuid, w, r)
+	if err != nil {
+		dataServiceError(w, r, err)
+	}
+}
+
+// purgeRequest handles DELETE of data with the "purge=true" query string.  Without a
+// "confirm" query string, the reply has status 428 and gives a nonce that must be sent
+// as "confirm" within datastore.PurgeConfirmationTTL to permanently delete the data.
+// With "async=true", the key/value pairs of the data are deleted in the background.
+func purgeRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, dataname dvid.DataString) {
+	query := r.URL.Query()
+	nonce := query.Get("confirm")
+	if nonce == "" {
+		nonce, err := runningService.PurgeNonce(uuid, dataname)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		m, err := json.Marshal(struct {
+			Confirm string
+			Expires time.Time
+		}{nonce, time.Now().Add(datastore.PurgeConfirmationTTL)})
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPreconditionRequired)
+		fmt.Fprint(w, string(m))
+		return
+	}
+	async := query.Get("async") == "true"
+	numKeys, err := runningService.PurgeData(uuid, dataname, nonce, async)
 	if err != nil {
 		BadRequest(w, r, err.Error())
+		return
+	}
+	result := fmt.Sprintf("Purged %s and deleted %d key/value pairs", dataname, numKeys)
+	if async {
+		result = fmt.Sprintf("Purged %s and deleting its key/value pairs in the background", dataname)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{%q: %q}", "result", result)
+}
+
+// scratchRequest handles requests on scratch data given the URL parts after "scratch".
+// GET lists scratch data, POST to <datatype name>/<data name> creates scratch data with
+// optional "ttl" and "session" query strings, and DELETE of <data name> deletes it.
+func scratchRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) {
+	switch strings.ToLower(r.Method) {
+	case "get":
+		jsonStr, err := runningService.ScratchJSON(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, jsonStr)
+	case "post":
+		if len(parts) != 2 {
+			BadRequest(w, r, "Bad URL: Expecting /api/dataset/<UUID>/scratch/<datatype name>/<data name>")
+			return
+		}
+		typename := dvid.TypeString(parts[0])
+		dataname := dvid.DataString(parts[1])
+		ttl := datastore.DefaultScratchTTL
+		queryValues := r.URL.Query()
+		if ttlStr := queryValues.Get("ttl"); ttlStr != "" {
+			var err error
+			if ttl, err = time.ParseDuration(ttlStr); err != nil {
+				BadRequest(w, r, fmt.Sprintf("Illegal scratch time-to-live '%s': %s", ttlStr, err.Error()))
+				return
+			}
+		}
+		config := dvid.NewConfig()
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil && err != io.EOF {
+			BadRequest(w, r, fmt.Sprintf("Error decoding POSTed JSON config for scratch data: %s", err.Error()))
+			return
+		}
+		err := runningService.NewScratchData(uuid, typename, dataname, config, queryValues.Get("session"), ttl)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{%q: %q}", "result",
+			fmt.Sprintf("Added scratch %s [%s] to node %s for %s", dataname, typename, uuid, ttl))
+	case "delete":
+		if len(parts) != 1 {
+			BadRequest(w, r, "Bad URL: Expecting /api/dataset/<UUID>/scratch/<data name>")
+			return
+		}
+		dataname := dvid.DataString(parts[0])
+		if err := runningService.DeleteScratch(uuid, dataname); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{%q: %q}", "result", fmt.Sprintf("Deleted scratch %s", dataname))
+	default:
+		BadRequest(w, r, "Scratch requests must use HTTP GET, POST, or DELETE")
 	}
 }
 
@@ -358,14 +909,23 @@ func nodeRequest(w http.ResponseWriter, r *http.Request) {
 	// Get particular dataset for this UUID
 	uuid, err := MatchingUUID(parts[0])
 	if err != nil {
-		BadRequest(w, r, err.Error())
+		if proxyUnknownNode(err) {
+			proxyRequest(w, r)
+			return
+		}
+		BadUUID(w, r, err)
+		return
+	}
+
+	if !checkNodeAccess(w, r, uuid, parts) {
 		return
 	}
 
 	// Handle the dataset command.
 	switch parts[1] {
-	case "lock":
-		err := runningService.Lock(uuid)
+	case "lock", "commit":
+		info := requestCommitInfo(r)
+		err := runningService.Commit(uuid, info)
 		if err != nil {
 			BadRequest(w, r, err.Error())
 		} else {
@@ -373,8 +933,9 @@ func nodeRequest(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintln(w, "Lock on node %s successful.", uuid)
 		}
 
-	case "branch":
-		newuuid, err := runningService.NewVersion(uuid)
+	case "branch", "newversion":
+		info := requestCommitInfo(r)
+		newuuid, err := runningService.NewVersionWithInfo(uuid, info)
 		if err != nil {
 			BadRequest(w, r, err.Error())
 		} else {
@@ -382,16 +943,337 @@ func nodeRequest(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "{%q: %q}", "Branch", newuuid)
 		}
 
+	case "merge":
+		// POST /api/node/<UUID>/merge/<UUID>[/<UUID>...]
+		if strings.ToLower(r.Method) != "post" {
+			BadRequest(w, r, "Node 'merge' request must be made with HTTP POST method")
+			return
+		}
+		parents := []dvid.UUID{uuid}
+		for _, uuidStr := range parts[2:] {
+			if uuidStr == "" {
+				continue
+			}
+			parent, err := MatchingUUID(uuidStr)
+			if err != nil {
+				BadUUID(w, r, err)
+				return
+			}
+			parents = append(parents, parent)
+		}
+		newuuid, err := runningService.MergeVersions(parents)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, "{%q: %q}", "Merge", newuuid)
+		}
+
+	case "fork":
+		if strings.ToLower(r.Method) != "post" {
+			BadRequest(w, r, "Node 'fork' request must be made with HTTP POST method")
+			return
+		}
+		root, err := runningService.ForkDataset(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, "{%q: %q}", "Root", root)
+		}
+
+	case "parents", "children", "ancestors", "lca":
+		// GET /api/node/<UUID>/parents
+		// GET /api/node/<UUID>/children
+		// GET /api/node/<UUID>/ancestors
+		// GET /api/node/<UUID>/lca/<UUID>
+		traversalRequest(w, r, uuid, parts[1:])
+
+	case "permissions":
+		// GET /api/node/<UUID>/permissions
+		if strings.ToLower(r.Method) != "get" {
+			BadRequest(w, r, "Node 'permissions' request must be made with HTTP GET method")
+			return
+		}
+		jsonStr, err := runningService.WriteRuleJSON(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, jsonStr)
+		}
+
 	default:
 		dataname := dvid.DataString(parts[1])
+		if len(parts) == 3 && parts[2] == "changelog" {
+			changelogRequest(w, r, uuid, dataname)
+			return
+		}
+		if len(parts) == 3 && parts[2] == "rollback" {
+			rollbackRequest(w, r, uuid, dataname)
+			return
+		}
+		if len(parts) == 3 && parts[2] == "invalidations" {
+			invalidationsRequest(w, r, uuid, dataname)
+			return
+		}
+		if len(parts) == 3 && parts[2] == "notifications" {
+			notificationsRequest(w, r, uuid, dataname)
+			return
+		}
+		if len(parts) == 4 && parts[2] == "diff" {
+			diffRequest(w, r, uuid, dataname, parts[3])
+			return
+		}
+		if proxyData(uuid, dataname) {
+			proxyRequest(w, r)
+			return
+		}
 		dataservice, err := runningService.DataServiceByUUID(uuid, dataname)
 		if err != nil {
 			BadRequest(w, r, err.Error())
 			return
 		}
-		err = dataservice.DoHTTP(uuid, w, r)
+		switch strings.ToLower(r.Method) {
+		case "get", "head":
+			if checkNotModified(w, r, uuid, dataservice) {
+				return
+			}
+		case "options":
+		default:
+			if !checkWriteAccess(w, r, uuid, dataname) {
+				return
+			}
+		}
+		dataset, err := runningService.DatasetFromUUID(uuid)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		release, ok := acquireInstanceSlot(dataset.Root, dataname)
+		if !ok {
+			Unavailable(w, r, fmt.Sprintf("data %q is at its limit of %d concurrent requests",
+				dataname, MaxInstanceRequests), ShedWait)
+			return
+		}
+		defer release()
+		err = dataservice.DoHTTP(r.Context(), uuid, w, r)
+		if err != nil {
+			dataServiceError(w, r, err)
+		}
+	}
+}
+
+// traversalRequest handles GET requests for the parents, children, or ancestors of a
+// node, or the lowest common ancestors of a node and another node, as a JSON list of
+// UUIDs.  Ancestors are nearest first.
+func traversalRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, parts []string) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, fmt.Sprintf("Node '%s' request must be made with HTTP GET method", parts[0]))
+		return
+	}
+	dataset, err := runningService.DatasetFromUUID(uuid)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	var uuids []dvid.UUID
+	switch parts[0] {
+	case "parents":
+		uuids, err = dataset.Parents(uuid)
+	case "children":
+		uuids, err = dataset.Children(uuid)
+	case "ancestors":
+		uuids, err = dataset.Ancestors(uuid)
+	case "lca":
+		if len(parts) < 2 || parts[1] == "" {
+			BadRequest(w, r, "Node 'lca' request must give a second UUID")
+			return
+		}
+		var other dvid.UUID
+		if other, err = MatchingUUID(parts[1]); err != nil {
+			BadUUID(w, r, err)
+			return
+		}
+		uuids, err = dataset.LowestCommonAncestors(uuid, other)
+	}
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	m, err := json.Marshal(uuids)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	setMetadataVersion(w)
+	fmt.Fprint(w, string(m))
+}
+
+// diffRequest handles GET requests for the changes of data from one node to another.
+// If the "values" query string is "true", values of added and modified indices at the
+// later node are included.
+func diffRequest(w http.ResponseWriter, r *http.Request, from dvid.UUID, dataname dvid.DataString, toStr string) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Diff requests must use HTTP GET")
+		return
+	}
+	to, err := MatchingUUID(toStr)
+	if err != nil {
+		BadUUID(w, r, err)
+		return
+	}
+	jsonStr, err := runningService.DiffJSON(from, to, dataname, r.URL.Query().Get("values") == "true")
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, jsonStr)
+}
+
+// checkWriteAccess replies with an error and returns false if the node with the given
+// UUID is locked, the user in the request header may not write at the node, or the
+// named data is being converted.
+func checkWriteAccess(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, dataname dvid.DataString) bool {
+	err := CheckWriteAccess(uuid, dataname, r.Header.Get(UserHeader))
+	if _, denied := err.(*datastore.PermissionError); denied {
+		errorMsg := fmt.Sprintf("ERROR using REST API: %s (%s).\n", err.Error(), r.URL.Path)
+		dvid.Log(dvid.Normal, errorMsg)
+		http.Error(w, errorMsg, http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return false
+	}
+	return true
+}
+
+// rollbackRequest handles POST requests that discard all changes of data at an
+// unlocked node, restoring the state of its parent.
+func rollbackRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, dataname dvid.DataString) {
+	if strings.ToLower(r.Method) != "post" {
+		BadRequest(w, r, "Rollback must be requested with HTTP POST method")
+		return
+	}
+	if !checkWriteAccess(w, r, uuid, dataname) {
+		return
+	}
+	numDeleted, err := runningService.RollbackVersion(uuid, dataname)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{%q: %d}", "Discarded", numDeleted)
+}
+
+// InvalidationBuffer is the number of invalidations buffered for a streaming HTTP
+// subscriber.  A subscriber that falls further behind is disconnected since it can no
+// longer trust its cached data.
+const InvalidationBuffer = 1000
+
+// invalidationsRequest streams invalidations of data at any node of the dataset as
+// JSON, one per line, until the client disconnects.  If the client falls behind, a
+// final {"Overflow": true} line is sent and the stream ends.
+func invalidationsRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, dataname dvid.DataString) {
+	if strings.ToLower(r.Method) != "get" {
+		BadRequest(w, r, "Invalidations must be streamed with HTTP GET method")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		BadRequest(w, r, "Streaming of invalidations is not supported by this connection")
+		return
+	}
+	if _, err := runningService.DataServiceByUUID(uuid, dataname); err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	dataset, err := runningService.DatasetFromUUID(uuid)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+
+	invalidations := make(chan *datastore.Invalidation, InvalidationBuffer)
+	overflow := make(chan struct{})
+	var overflowOnce sync.Once
+	id := runningService.SubscribeInvalidations(func(inv *datastore.Invalidation) {
+		if inv.Name != dataname {
+			return
+		}
+		if dset, err := runningService.DatasetFromUUID(inv.Version); err != nil || dset != dataset {
+			return
+		}
+		select {
+		case invalidations <- inv:
+		default:
+			overflowOnce.Do(func() { close(overflow) })
+		}
+	})
+	defer runningService.UnsubscribeInvalidations(id)
+
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case inv := <-invalidations:
+			if err := encoder.Encode(inv); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-overflow:
+			fmt.Fprintf(w, "{%q: true}\n", "Overflow")
+			flusher.Flush()
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// changelogRequest handles requests on the changelog of data.  GET returns events
+// starting at the offset given by the "from" query string, up to the number given by
+// "max", and DELETE truncates the events before the offset given by "before".
+func changelogRequest(w http.ResponseWriter, r *http.Request, uuid dvid.UUID, dataname dvid.DataString) {
+	query := r.URL.Query()
+	switch strings.ToLower(r.Method) {
+	case "get":
+		from, max, err := changelogRange(query.Get("from"), query.Get("max"))
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		jsonStr, err := runningService.ChangelogJSON(uuid, dataname, from, max)
 		if err != nil {
 			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, jsonStr)
+	case "delete":
+		before, err := strconv.ParseUint(query.Get("before"), 10, 64)
+		if err != nil {
+			BadRequest(w, r, "Changelog truncation requires a 'before' offset query string")
+			return
 		}
+		numDeleted, err := runningService.TruncateChangelog(uuid, dataname, before)
+		if err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{%q: %d}", "Deleted", numDeleted)
+	default:
+		BadRequest(w, r, "Changelog requests must use HTTP GET or DELETE")
 	}
 }
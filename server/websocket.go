@@ -0,0 +1,188 @@
+/*
+	This file implements the server side of the WebSocket protocol (RFC 6455) for
+	pushing messages to clients such as browser-based viewers.  Only unfragmented
+	frames are read, which suffices for the control frames and short messages clients
+	send.
+*/
+
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// websocketGUID is appended to a client's key to compute the handshake accept key.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// MaxWebSocketRead is the largest frame payload accepted from a WebSocket client.
+const MaxWebSocketRead = 64 * 1024
+
+// WebSocket frame opcodes.
+const (
+	wsText  byte = 0x1
+	wsClose byte = 0x8
+	wsPing  byte = 0x9
+	wsPong  byte = 0xA
+)
+
+// websocketConn is a WebSocket connection upgraded from an HTTP request.
+type websocketConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	// Frames may be written by the handler and by the reader replying to pings.
+	writeLock sync.Mutex
+}
+
+// headerHas returns true if a comma-separated header contains the token, ignoring case.
+func headerHas(r *http.Request, header, token string) bool {
+	for _, value := range strings.Split(r.Header.Get(header), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket completes the WebSocket handshake of a request and returns the
+// connection, which the caller must close.  No reply has been written on error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	if strings.ToLower(r.Method) != "get" || !headerHas(r, "Connection", "upgrade") ||
+		!headerHas(r, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("Request is not a WebSocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("Only WebSocket protocol version 13 is supported")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("WebSocket upgrade has no Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("WebSockets are not supported by this connection")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(hash[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocketConn{conn: conn, rw: rw}, nil
+}
+
+// writeFrame writes an unmasked, unfragmented frame.
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := ws.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(payload); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+// WriteText sends a text message.
+func (ws *websocketConn) WriteText(message []byte) error {
+	return ws.writeFrame(wsText, message)
+}
+
+// readFrame reads a masked frame from the client and returns its opcode and payload.
+func (ws *websocketConn) readFrame() (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(ws.rw, header[:]); err != nil {
+		return
+	}
+	opcode = header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return opcode, nil, fmt.Errorf("WebSocket client sent an unmasked frame")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.rw, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.rw, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > MaxWebSocketRead {
+		return opcode, nil, fmt.Errorf("WebSocket frame of %d bytes exceeds %d bytes", length, MaxWebSocketRead)
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.rw, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.rw, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// discardReads reads frames from the client until it closes the connection, answering
+// pings, and then closes the returned channel.  Messages from the client are ignored.
+func (ws *websocketConn) discardReads() <-chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			opcode, payload, err := ws.readFrame()
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case wsPing:
+				if ws.writeFrame(wsPong, payload) != nil {
+					return
+				}
+			case wsClose:
+				ws.writeFrame(wsClose, payload)
+				return
+			}
+		}
+	}()
+	return closed
+}
+
+// Close sends a close frame and closes the connection.
+func (ws *websocketConn) Close() error {
+	ws.writeFrame(wsClose, nil)
+	return ws.conn.Close()
+}
@@ -4,6 +4,7 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 
 	"github.com/boltdb/bolt"
@@ -52,19 +53,16 @@ func NewStore(path string, create bool, config dvid.Config) (Engine, error) {
 		db:      db,
 	}
 
-	// Create buckets for each key type.
+	// Create buckets for each key type, skipping buckets that already exist.
 	db.Update(func(tx *bolt.Tx) error {
-		if err := tx.CreateBucket(KeyDatasets.String()); err != nil {
-			return err
-		}
-		if err := tx.CreateBucket(KeyDataset.String()); err != nil {
-			return err
-		}
-		if err := tx.CreateBucket(KeyData.String()); err != nil {
-			return err
-		}
-		if err := tx.CreateBucket(KeySync.String()); err != nil {
-			return err
+		keyTypes := []KeyType{KeyDatasets, KeyDataset, KeyData, KeySync, KeyChangelog, KeyEncodedData, KeyServer,
+			KeyQuarantine, KeyTombstone}
+		for _, keyType := range keyTypes {
+			if tx.Bucket(keyType.String()) == nil {
+				if err := tx.CreateBucket(keyType.String()); err != nil {
+					return err
+				}
+			}
 		}
 		return nil
 	})
@@ -113,7 +111,7 @@ func (bdb *BoltDB) Get(k Key) (v []byte, err error) {
 // GetRange returns a range of values spanning (kStart, kEnd) keys.  These key-value
 // pairs will be sorted in ascending key order.  It is assumed that all keys are
 // within one bucket.
-func (bdb *BoltDB) GetRange(kStart, kEnd Key) (values []KeyValue, err error) {
+func (bdb *BoltDB) GetRange(ctx context.Context, kStart, kEnd Key) (values []KeyValue, err error) {
 	values = []KeyValue{}
 	err = bdb.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(kStart.KeyType().String())
@@ -125,6 +123,9 @@ func (bdb *BoltDB) GetRange(kStart, kEnd Key) (values []KeyValue, err error) {
 		c := bucket.Cursor()
 		k, v := c.Seek(kStart.Bytes())
 		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			StoreKeyBytesRead <- len(k)
 			StoreValueBytesRead <- len(v)
 			if k == nil || bytes.Compare(k, endBytes) > 0 {
@@ -146,7 +147,7 @@ func (bdb *BoltDB) GetRange(kStart, kEnd Key) (values []KeyValue, err error) {
 
 // KeysInRange returns a range of present keys spanning (kStart, kEnd).
 // For bolt database, values are read but not returned.
-func (bdb *BoltDB) KeysInRange(kStart, kEnd Key) (keys []Key, err error) {
+func (bdb *BoltDB) KeysInRange(ctx context.Context, kStart, kEnd Key) (keys []Key, err error) {
 	keys = []Key{}
 	err = bdb.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(kStart.KeyType().String())
@@ -158,6 +159,9 @@ func (bdb *BoltDB) KeysInRange(kStart, kEnd Key) (keys []Key, err error) {
 		c := bucket.Cursor()
 		k, v := c.Seek(kStart.Bytes())
 		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			StoreKeyBytesRead <- len(k)
 			StoreValueBytesRead <- len(v)
 			if k == nil || bytes.Compare(k, endBytes) > 0 {
@@ -178,7 +182,7 @@ func (bdb *BoltDB) KeysInRange(kStart, kEnd Key) (keys []Key, err error) {
 }
 
 // ProcessRange sends a range of key-value pairs to chunk handlers.
-func (bdb *BoltDB) ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) error {
+func (bdb *BoltDB) ProcessRange(ctx context.Context, kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) error {
 	return bdb.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(kStart.KeyType().String())
 		if bucket == nil {
@@ -189,6 +193,9 @@ func (bdb *BoltDB) ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) e
 		c := bucket.Cursor()
 		k, v := c.Seek(kStart.Bytes())
 		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			StoreKeyBytesRead <- len(k)
 			StoreValueBytesRead <- len(v)
 			if k == nil || bytes.Compare(k, endBytes) > 0 {
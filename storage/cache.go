@@ -0,0 +1,438 @@
+/*
+	This file implements a cache hierarchy in front of a storage engine.  Values read by
+	key are kept in a bounded RAM cache, and values evicted from RAM can be kept in a
+	bounded directory on fast local disk, e.g., an SSD.  This keeps interactive requests
+	from paying the latency of slow backends, e.g., object stores, for recently used data.
+*/
+
+package storage
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// CacheConfig sets the sizes of the cache tiers.  A zero MemoryBytes disables caching.
+type CacheConfig struct {
+	// MemoryBytes bounds the total size of values cached in RAM.
+	MemoryBytes int64
+
+	// DiskDir is a directory on local disk for values evicted from RAM.  Values are
+	// kept in a subdirectory owned by the cache, so other contents are untouched.  If
+	// empty, there is no disk tier.
+	DiskDir string
+
+	// DiskBytes bounds the total size of values cached in DiskDir.
+	DiskBytes int64
+}
+
+// DefaultCache is the cache configuration used when opening datastores.
+var DefaultCache CacheConfig
+
+// cacheSubdir is the subdirectory of CacheConfig.DiskDir holding the disk tier.
+const cacheSubdir = "dvid-cache"
+
+// Enabled returns true if the configuration caches values.
+func (config CacheConfig) Enabled() bool {
+	return config.MemoryBytes > 0
+}
+
+// CacheStats reports the activity and current sizes of a cache hierarchy.
+type CacheStats struct {
+	MemoryHits      uint64
+	DiskHits        uint64
+	Misses          uint64
+	MemoryEvictions uint64
+	DiskEvictions   uint64
+	MemoryBytes     int64
+	MemoryEntries   int
+	DiskBytes       int64
+	DiskEntries     int
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+	size  int64
+}
+
+// cacheTier is a bounded LRU of values held in RAM or on disk.
+type cacheTier struct {
+	sync.Mutex
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	entries  map[string]*list.Element
+
+	// If dir is set, values are kept in files and entry values are nil.
+	dir string
+}
+
+func newCacheTier(maxBytes int64, dir string) *cacheTier {
+	return &cacheTier{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		dir:      dir,
+	}
+}
+
+func (t *cacheTier) filename(key string) string {
+	hash := sha1.Sum([]byte(key))
+	return filepath.Join(t.dir, hex.EncodeToString(hash[:]))
+}
+
+// get returns the value for a key and marks it as most recently used.
+func (t *cacheTier) get(key string) ([]byte, bool) {
+	t.Lock()
+	defer t.Unlock()
+	elem, found := t.entries[key]
+	if !found {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	value := entry.value
+	if t.dir != "" {
+		var err error
+		if value, err = ioutil.ReadFile(t.filename(key)); err != nil {
+			dvid.Error("Dropping unreadable disk cache entry: %s", err.Error())
+			t.remove(elem)
+			return nil, false
+		}
+	}
+	t.order.MoveToFront(elem)
+	return value, true
+}
+
+// put adds a value and returns the entries evicted to keep the tier within bounds.
+func (t *cacheTier) put(key string, value []byte) (evicted []*cacheEntry) {
+	size := int64(len(value))
+	if size > t.maxBytes {
+		return []*cacheEntry{{key, value, size}}
+	}
+	t.Lock()
+	defer t.Unlock()
+	if elem, found := t.entries[key]; found {
+		t.remove(elem)
+	}
+	entry := &cacheEntry{key: key}
+	if t.dir != "" {
+		if err := ioutil.WriteFile(t.filename(key), value, 0644); err != nil {
+			dvid.Error("Unable to write disk cache entry: %s", err.Error())
+			return nil
+		}
+	} else {
+		entry.value = value
+	}
+	entry.size = size
+	t.entries[key] = t.order.PushFront(entry)
+	t.bytes += size
+	for t.bytes > t.maxBytes {
+		elem := t.order.Back()
+		evicted = append(evicted, elem.Value.(*cacheEntry))
+		t.remove(elem)
+	}
+	return evicted
+}
+
+// remove deletes an entry.  The tier must be locked.
+func (t *cacheTier) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	t.order.Remove(elem)
+	delete(t.entries, entry.key)
+	t.bytes -= entry.size
+	if t.dir != "" {
+		os.Remove(t.filename(entry.key))
+	}
+}
+
+func (t *cacheTier) invalidate(key string) {
+	t.Lock()
+	if elem, found := t.entries[key]; found {
+		t.remove(elem)
+	}
+	t.Unlock()
+}
+
+func (t *cacheTier) size() (int64, int) {
+	t.Lock()
+	defer t.Unlock()
+	return t.bytes, len(t.entries)
+}
+
+// CachedStore is a storage engine whose key/value gets are cached in RAM and optionally
+// on local disk.  Writes go through to the underlying engine and invalidate cached
+// values.  Values of GetRange are read through the cache after their keys are listed
+// by the engine, while KeysInRange and ProcessRange, which are used to scan data, read
+// the engine so they do not evict interactively used values.
+type CachedStore struct {
+	// Counters are first to keep them 64-bit aligned for atomic access.
+	memoryHits, diskHits, misses   uint64
+	memoryEvictions, diskEvictions uint64
+
+	// generation is incremented after every write so values read before a write are
+	// not cached.  It is only changed while holding mu.
+	generation uint64
+
+	// mu serializes adding values to the tiers with invalidation, so values moved
+	// between tiers cannot miss an invalidation.
+	mu sync.Mutex
+
+	engine Engine
+	db     KeyValueDB
+	memory *cacheTier
+	disk   *cacheTier
+}
+
+// NewCachedStore returns a CachedStore for an engine that must be a KeyValueDB.  Any
+// previous contents of the cache's subdirectory of the disk cache directory are removed
+// since they may be stale.
+func NewCachedStore(engine Engine, config CacheConfig) (*CachedStore, error) {
+	db, ok := engine.(KeyValueDB)
+	if !ok {
+		return nil, fmt.Errorf("Cannot cache storage engine %s: not a key-value database", engine.GetName())
+	}
+	if !config.Enabled() {
+		return nil, fmt.Errorf("Cache configuration must give a positive RAM cache size")
+	}
+	cache := &CachedStore{
+		engine: engine,
+		db:     db,
+		memory: newCacheTier(config.MemoryBytes, ""),
+	}
+	if config.DiskDir != "" {
+		if config.DiskBytes <= 0 {
+			return nil, fmt.Errorf("Disk cache directory %s requires a positive size", config.DiskDir)
+		}
+		dir := filepath.Join(config.DiskDir, cacheSubdir)
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, fmt.Errorf("Unable to clear disk cache directory %s: %s", dir, err.Error())
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("Unable to create disk cache directory %s: %s", dir, err.Error())
+		}
+		cache.disk = newCacheTier(config.DiskBytes, dir)
+	}
+	return cache, nil
+}
+
+func cacheKey(k Key) string {
+	return string(append([]byte{byte(k.KeyType())}, k.Bytes()...))
+}
+
+// Stats returns the current statistics of the cache hierarchy.
+func (cache *CachedStore) Stats() CacheStats {
+	stats := CacheStats{
+		MemoryHits:      atomic.LoadUint64(&cache.memoryHits),
+		DiskHits:        atomic.LoadUint64(&cache.diskHits),
+		Misses:          atomic.LoadUint64(&cache.misses),
+		MemoryEvictions: atomic.LoadUint64(&cache.memoryEvictions),
+		DiskEvictions:   atomic.LoadUint64(&cache.diskEvictions),
+	}
+	stats.MemoryBytes, stats.MemoryEntries = cache.memory.size()
+	if cache.disk != nil {
+		stats.DiskBytes, stats.DiskEntries = cache.disk.size()
+	}
+	return stats
+}
+
+// store adds a value read at a generation to the RAM tier, moving evicted values to the
+// disk tier.  The value is not cached if a write happened since the generation.
+func (cache *CachedStore) store(key string, value []byte, generation uint64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if atomic.LoadUint64(&cache.generation) != generation {
+		return
+	}
+	for _, entry := range cache.memory.put(key, value) {
+		atomic.AddUint64(&cache.memoryEvictions, 1)
+		if cache.disk != nil {
+			evicted := cache.disk.put(entry.key, entry.value)
+			atomic.AddUint64(&cache.diskEvictions, uint64(len(evicted)))
+		}
+	}
+}
+
+// invalidate removes a key from all tiers.  It must be called after the key is written
+// to the engine.
+func (cache *CachedStore) invalidate(k Key) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	atomic.AddUint64(&cache.generation, 1)
+	key := cacheKey(k)
+	cache.memory.invalidate(key)
+	if cache.disk != nil {
+		cache.disk.invalidate(key)
+	}
+}
+
+// ---- Engine interface ----
+
+func (cache *CachedStore) GetName() string {
+	return cache.engine.GetName() + " with cache"
+}
+
+func (cache *CachedStore) GetConfig() dvid.Config {
+	return cache.engine.GetConfig()
+}
+
+func (cache *CachedStore) Close() {
+	cache.engine.Close()
+	if cache.disk != nil {
+		os.RemoveAll(cache.disk.dir)
+	}
+}
+
+// ---- Snapshotter interface ----
+
+// Snapshot returns a snapshot of the underlying engine.  Since writes go through to the
+// engine, the snapshot holds all writes made before it was taken.
+func (cache *CachedStore) Snapshot() (KeyValueGetter, func(), error) {
+	snapshotter, ok := cache.engine.(Snapshotter)
+	if !ok {
+		return nil, nil, fmt.Errorf("Storage engine %s does not support snapshots", cache.engine.GetName())
+	}
+	return snapshotter.Snapshot()
+}
+
+// ---- KeyValueGetter interface ----
+
+// Get returns a value from the fastest tier holding it, reading from the underlying
+// engine only if no tier does.
+func (cache *CachedStore) Get(k Key) ([]byte, error) {
+	key := cacheKey(k)
+	if value, found := cache.memory.get(key); found {
+		atomic.AddUint64(&cache.memoryHits, 1)
+		return dupBytes(value), nil
+	}
+	generation := atomic.LoadUint64(&cache.generation)
+	if cache.disk != nil {
+		if value, found := cache.disk.get(key); found {
+			atomic.AddUint64(&cache.diskHits, 1)
+			cache.store(key, dupBytes(value), generation)
+			return value, nil
+		}
+	}
+	atomic.AddUint64(&cache.misses, 1)
+	value, err := cache.db.Get(k)
+	if err != nil || value == nil {
+		return value, err
+	}
+	cache.store(key, dupBytes(value), generation)
+	return value, nil
+}
+
+// GetRange returns the key/value pairs in a range, listing keys with the engine and
+// reading each value from the fastest tier holding it.  Keys deleted after they are
+// listed are skipped.
+func (cache *CachedStore) GetRange(ctx context.Context, kStart, kEnd Key) ([]KeyValue, error) {
+	keys, err := cache.db.KeysInRange(ctx, kStart, kEnd)
+	if err != nil {
+		return nil, err
+	}
+	keyvalues := make([]KeyValue, 0, len(keys))
+	for _, k := range keys {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		value, err := cache.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			keyvalues = append(keyvalues, KeyValue{k, value})
+		}
+	}
+	return keyvalues, nil
+}
+
+func (cache *CachedStore) KeysInRange(ctx context.Context, kStart, kEnd Key) ([]Key, error) {
+	return cache.db.KeysInRange(ctx, kStart, kEnd)
+}
+
+func (cache *CachedStore) ProcessRange(ctx context.Context, kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) error {
+	return cache.db.ProcessRange(ctx, kStart, kEnd, op, f)
+}
+
+// ---- KeyValueSetter interface ----
+
+func (cache *CachedStore) Put(k Key, v []byte) error {
+	defer cache.invalidate(k)
+	return cache.db.Put(k, v)
+}
+
+func (cache *CachedStore) PutRange(values []KeyValue) error {
+	defer func() {
+		for _, kv := range values {
+			cache.invalidate(kv.K)
+		}
+	}()
+	return cache.db.PutRange(values)
+}
+
+func (cache *CachedStore) Delete(k Key) error {
+	defer cache.invalidate(k)
+	return cache.db.Delete(k)
+}
+
+// ---- Batcher interface ----
+
+// cachedBatch invalidates the cached values of its keys when committed.
+type cachedBatch struct {
+	cache *CachedStore
+	batch Batch
+	keys  []Key
+}
+
+// NewBatch returns a batch of the underlying engine.  If the engine does not support
+// batches, whose writes must be atomic, the batch fails when committed.
+func (cache *CachedStore) NewBatch() Batch {
+	b := &cachedBatch{cache: cache}
+	if batcher, ok := cache.engine.(Batcher); ok {
+		b.batch = batcher.NewBatch()
+	}
+	return b
+}
+
+func (b *cachedBatch) Delete(k Key) {
+	b.keys = append(b.keys, k)
+	if b.batch != nil {
+		b.batch.Delete(k)
+	}
+}
+
+func (b *cachedBatch) Put(k Key, v []byte) {
+	b.keys = append(b.keys, k)
+	if b.batch != nil {
+		b.batch.Put(k, v)
+	}
+}
+
+// Commit commits the operations and invalidates cached values of the batch keys.
+func (b *cachedBatch) Commit() error {
+	if b.batch == nil {
+		return fmt.Errorf("Storage engine %s does not support batch write", b.cache.engine.GetName())
+	}
+	defer func() {
+		for _, k := range b.keys {
+			b.cache.invalidate(k)
+		}
+	}()
+	return b.batch.Commit()
+}
+
+func dupBytes(b []byte) []byte {
+	dup := make([]byte, len(b))
+	copy(dup, b)
+	return dup
+}
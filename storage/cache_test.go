@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (s *DataSuite) TestCachedStore(c *C) {
+	// Only the cache's own subdirectory of the disk cache directory is cleared.
+	diskDir := c.MkDir()
+	kept := filepath.Join(diskDir, "kept")
+	c.Assert(ioutil.WriteFile(kept, []byte("kept"), 0644), IsNil)
+	cache, err := NewCachedStore(s.db, CacheConfig{MemoryBytes: 100, DiskDir: diskDir, DiskBytes: 150})
+	c.Assert(err, IsNil)
+	_, err = ioutil.ReadFile(kept)
+	c.Assert(err, IsNil)
+
+	value1 := bytes.Repeat([]byte{1}, 60)
+	value2 := bytes.Repeat([]byte{2}, 60)
+	c.Assert(cache.Put(NewKey("cache1"), value1), IsNil)
+	c.Assert(cache.Put(NewKey("cache2"), value2), IsNil)
+
+	// First read misses, second is served from RAM.
+	v, err := cache.Get(NewKey("cache1"))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, value1)
+	v, err = cache.Get(NewKey("cache1"))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, value1)
+	stats := cache.Stats()
+	c.Assert(stats.Misses, Equals, uint64(1))
+	c.Assert(stats.MemoryHits, Equals, uint64(1))
+
+	// Reading the second value evicts the first from RAM to disk.
+	v, err = cache.Get(NewKey("cache2"))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, value2)
+	stats = cache.Stats()
+	c.Assert(stats.MemoryEvictions, Equals, uint64(1))
+	c.Assert(stats.DiskEntries, Equals, 1)
+	v, err = cache.Get(NewKey("cache1"))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, value1)
+	c.Assert(cache.Stats().DiskHits, Equals, uint64(1))
+
+	// Writes invalidate cached values.
+	c.Assert(cache.Put(NewKey("cache1"), value2), IsNil)
+	v, err = cache.Get(NewKey("cache1"))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, value2)
+
+	// Range reads get values through the cache.
+	hits := cache.Stats().MemoryHits
+	kvs, err := cache.GetRange(context.Background(), NewKey("cache1"), NewKey("cache3"))
+	c.Assert(err, IsNil)
+	c.Assert(kvs, HasLen, 2)
+	c.Assert(kvs[0].V, DeepEquals, value2)
+	c.Assert(cache.Stats().MemoryHits, Equals, hits+1)
+
+	batch := cache.NewBatch()
+	batch.Delete(NewKey("cache1"))
+	c.Assert(batch.Commit(), IsNil)
+	v, err = cache.Get(NewKey("cache1"))
+	c.Assert(err, IsNil)
+	c.Assert(v, IsNil)
+
+	_, err = NewCachedStore(s.db, CacheConfig{})
+	c.Assert(err, NotNil)
+}
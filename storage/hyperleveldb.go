@@ -4,6 +4,7 @@ package storage
 
 import (
 	"bytes"
+	"context"
 
 	"github.com/janelia-flyem/dvid/dvid"
 	humanize "github.com/janelia-flyem/go/go-humanize"
@@ -259,6 +260,18 @@ func (db *LevelDB) Close() {
 	}
 }
 
+// Sync flushes the write-ahead log to disk with an empty synchronous write.
+func (db *LevelDB) Sync() error {
+	dvid.StartCgo()
+	defer dvid.StopCgo()
+	wo := levigo.NewWriteOptions()
+	wo.SetSync(true)
+	defer wo.Close()
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	return db.ldb.Write(wo, wb)
+}
+
 // ---- KeyValueGetter interface ------
 
 // Get returns a value given a key.
@@ -273,9 +286,12 @@ func (db *LevelDB) Get(k Key) (v []byte, err error) {
 
 // GetRange returns a range of values spanning (kStart, kEnd) keys.  These key-value
 // pairs will be sorted in ascending key order.
-func (db *LevelDB) GetRange(kStart, kEnd Key) (values []KeyValue, err error) {
+func (db *LevelDB) GetRange(ctx context.Context, kStart, kEnd Key) (values []KeyValue, err error) {
+	return db.getRange(ctx, levigo.NewReadOptions(), kStart, kEnd)
+}
+
+func (db *LevelDB) getRange(ctx context.Context, ro *levigo.ReadOptions, kStart, kEnd Key) (values []KeyValue, err error) {
 	dvid.StartCgo()
-	ro := levigo.NewReadOptions()
 	it := db.ldb.NewIterator(ro)
 	defer func() {
 		it.Close()
@@ -286,6 +302,9 @@ func (db *LevelDB) GetRange(kStart, kEnd Key) (values []KeyValue, err error) {
 	it.Seek(kStart.Bytes())
 	endBytes := kEnd.Bytes()
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		if it.Valid() {
 			itKey := it.Key()
 			StoreKeyBytesRead <- len(itKey)
@@ -312,9 +331,12 @@ func (db *LevelDB) GetRange(kStart, kEnd Key) (values []KeyValue, err error) {
 
 // KeysInRange returns a range of present keys spanning (kStart, kEnd).  Values
 // associated with the keys are not read.
-func (db *LevelDB) KeysInRange(kStart, kEnd Key) (keys []Key, err error) {
+func (db *LevelDB) KeysInRange(ctx context.Context, kStart, kEnd Key) (keys []Key, err error) {
+	return db.keysInRange(ctx, levigo.NewReadOptions(), kStart, kEnd)
+}
+
+func (db *LevelDB) keysInRange(ctx context.Context, ro *levigo.ReadOptions, kStart, kEnd Key) (keys []Key, err error) {
 	dvid.StartCgo()
-	ro := levigo.NewReadOptions()
 	it := db.ldb.NewIterator(ro)
 	defer func() {
 		it.Close()
@@ -325,6 +347,9 @@ func (db *LevelDB) KeysInRange(kStart, kEnd Key) (keys []Key, err error) {
 	it.Seek(kStart.Bytes())
 	endBytes := kEnd.Bytes()
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		if it.Valid() {
 			itKey := it.Key()
 			StoreKeyBytesRead <- len(itKey)
@@ -347,9 +372,14 @@ func (db *LevelDB) KeysInRange(kStart, kEnd Key) (keys []Key, err error) {
 }
 
 // ProcessRange sends a range of key-value pairs to chunk handlers.
-func (db *LevelDB) ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) error {
+func (db *LevelDB) ProcessRange(ctx context.Context, kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) error {
+	return db.processRange(ctx, levigo.NewReadOptions(), kStart, kEnd, op, f)
+}
+
+func (db *LevelDB) processRange(ctx context.Context, ro *levigo.ReadOptions, kStart, kEnd Key, op *ChunkOp,
+	f func(*Chunk)) error {
+
 	dvid.StartCgo()
-	ro := levigo.NewReadOptions()
 	it := db.ldb.NewIterator(ro)
 	defer func() {
 		it.Close()
@@ -359,6 +389,9 @@ func (db *LevelDB) ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) e
 	endBytes := kEnd.Bytes()
 	it.Seek(kStart.Bytes())
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if it.Valid() {
 			itValue := it.Value()
 			StoreValueBytesRead <- len(itValue)
@@ -389,6 +422,90 @@ func (db *LevelDB) ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) e
 	}
 }
 
+// ---- Snapshotter interface ------
+
+// leveldbSnapshot reads a LevelDB as of the time the snapshot was taken.
+type leveldbSnapshot struct {
+	db   *LevelDB
+	snap *levigo.Snapshot
+	ro   *levigo.ReadOptions
+}
+
+// Snapshot returns a getter reading the database as of now and a function releasing
+// the snapshot.
+func (db *LevelDB) Snapshot() (KeyValueGetter, func(), error) {
+	dvid.StartCgo()
+	snap := db.ldb.NewSnapshot()
+	ro := levigo.NewReadOptions()
+	ro.SetSnapshot(snap)
+	dvid.StopCgo()
+	release := func() {
+		dvid.StartCgo()
+		ro.Close()
+		db.ldb.ReleaseSnapshot(snap)
+		dvid.StopCgo()
+	}
+	return &leveldbSnapshot{db, snap, ro}, release, nil
+}
+
+func (s *leveldbSnapshot) Get(k Key) (v []byte, err error) {
+	dvid.StartCgo()
+	v, err = s.db.ldb.Get(s.ro, k.Bytes())
+	dvid.StopCgo()
+	StoreValueBytesRead <- len(v)
+	return
+}
+
+func (s *leveldbSnapshot) GetRange(ctx context.Context, kStart, kEnd Key) ([]KeyValue, error) {
+	return s.db.getRange(ctx, s.ro, kStart, kEnd)
+}
+
+func (s *leveldbSnapshot) KeysInRange(ctx context.Context, kStart, kEnd Key) ([]Key, error) {
+	return s.db.keysInRange(ctx, s.ro, kStart, kEnd)
+}
+
+func (s *leveldbSnapshot) ProcessRange(ctx context.Context, kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) error {
+	return s.db.processRange(ctx, s.ro, kStart, kEnd, op, f)
+}
+
+// ---- Compacter and Sizer interfaces ------
+
+// keyRange returns the leveldb range spanning two keys, where nil keys extend the range
+// to the first or last key of the database.
+func keyRange(kStart, kEnd Key) levigo.Range {
+	var r levigo.Range
+	if kStart != nil {
+		r.Start = kStart.Bytes()
+	}
+	if kEnd != nil {
+		r.Limit = kEnd.Bytes()
+	}
+	return r
+}
+
+// Compact compacts the keys spanning (kStart, kEnd), discarding deleted and overwritten
+// values.  It returns when compaction is complete.
+func (db *LevelDB) Compact(kStart, kEnd Key) error {
+	dvid.StartCgo()
+	db.ldb.CompactRange(keyRange(kStart, kEnd))
+	dvid.StopCgo()
+	return nil
+}
+
+// ApproximateSize returns the approximate number of bytes of the files holding the keys
+// spanning (kStart, kEnd).
+func (db *LevelDB) ApproximateSize(kStart, kEnd Key) (uint64, error) {
+	r := keyRange(kStart, kEnd)
+	if r.Limit == nil {
+		// Every key starts with a key type byte less than 0xff.
+		r.Limit = []byte{0xff}
+	}
+	dvid.StartCgo()
+	sizes := Sizes(db.ldb.GetApproximateSizes(Ranges{r}))
+	dvid.StopCgo()
+	return sizes[0], nil
+}
+
 // ---- KeyValueSetter interface ------
 
 // Put writes a value with given key.
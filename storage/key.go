@@ -34,6 +34,25 @@ const (
 	// Key group that holds Sync links between Data.  Sync key/value pairs designate
 	// what values need to be updated when its linked data changes.
 	KeySync
+
+	// Key group that holds the changelogs of mutation events for each Data.
+	KeyChangelog
+
+	// Key group that holds the Data in key encodings that store an encoding byte
+	// after the key type.
+	KeyEncodedData
+
+	// Key group that holds server-wide metadata that is not part of any Dataset,
+	// e.g., authentication tokens.
+	KeyServer
+
+	// Key group that holds key/value pairs moved out of other key groups because
+	// they were found corrupt or orphaned.
+	KeyQuarantine
+
+	// Key group that marks key/value pairs of Data deleted at a version, so the version
+	// no longer reads the values its ancestors store at those keys.
+	KeyTombstone
 )
 
 func (t KeyType) String() string {
@@ -46,6 +65,16 @@ func (t KeyType) String() string {
 		return "Data Key Type"
 	case KeySync:
 		return "Data Sync Key Type"
+	case KeyChangelog:
+		return "Changelog Key Type"
+	case KeyEncodedData:
+		return "Encoded Data Key Type"
+	case KeyServer:
+		return "Server Key Type"
+	case KeyQuarantine:
+		return "Quarantine Key Type"
+	case KeyTombstone:
+		return "Tombstone Key Type"
 	default:
 		return "Unknown Key Type"
 	}
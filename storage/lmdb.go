@@ -4,6 +4,7 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 
@@ -147,7 +148,7 @@ func (db *LMDB) Get(k Key) ([]byte, error) {
 // GetRange returns a range of values spanning (kStart, kEnd) keys.  These key-value
 // pairs will be sorted in ascending key order.  It is assumed that all keys are
 // within one bucket.
-func (db *LMDB) GetRange(kStart, kEnd Key) ([]KeyValue, error) {
+func (db *LMDB) GetRange(ctx context.Context, kStart, kEnd Key) ([]KeyValue, error) {
 	if db == nil || db.env == nil {
 		return nil, fmt.Errorf("Cannot GetRange() on invalid database.")
 	}
@@ -170,6 +171,9 @@ func (db *LMDB) GetRange(kStart, kEnd Key) ([]KeyValue, error) {
 	values := []KeyValue{}
 	var cursorOp uint = lmdb.SET_RANGE
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		k, v, rc := cursor.Get(seekKey, cursorOp)
 		if rc != nil {
 			break
@@ -194,7 +198,7 @@ func (db *LMDB) GetRange(kStart, kEnd Key) ([]KeyValue, error) {
 
 // KeysInRange returns a range of present keys spanning (kStart, kEnd).
 // For lmdb database, values are read but not returned.
-func (db *LMDB) KeysInRange(kStart, kEnd Key) ([]Key, error) {
+func (db *LMDB) KeysInRange(ctx context.Context, kStart, kEnd Key) ([]Key, error) {
 	if db == nil || db.env == nil {
 		return nil, fmt.Errorf("Cannot run KeysInRange() on invalid database.")
 	}
@@ -217,6 +221,9 @@ func (db *LMDB) KeysInRange(kStart, kEnd Key) ([]Key, error) {
 	keys := []Key{}
 	var cursorOp uint = lmdb.SET_RANGE
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		k, v, rc := cursor.Get(seekKey, cursorOp)
 		if rc != nil {
 			break
@@ -240,7 +247,7 @@ func (db *LMDB) KeysInRange(kStart, kEnd Key) ([]Key, error) {
 }
 
 // ProcessRange sends a range of key-value pairs to chunk handlers.
-func (db *LMDB) ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) error {
+func (db *LMDB) ProcessRange(ctx context.Context, kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) error {
 	if db == nil || db.env == nil {
 		return fmt.Errorf("Cannot ProcessRange() on invalid database.")
 	}
@@ -262,6 +269,9 @@ func (db *LMDB) ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) erro
 	endBytes := kEnd.Bytes()
 	var cursorOp uint = lmdb.SET_RANGE
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		k, v, rc := cursor.Get(seekKey, cursorOp)
 		if rc != nil {
 			break
@@ -17,6 +17,7 @@
 package storage
 
 import (
+	"context"
 	"sync"
 
 	"github.com/janelia-flyem/dvid/dvid"
@@ -67,22 +68,24 @@ type Engine interface {
 	Close()
 }
 
+// KeyValueGetter reads key-value pairs.  Range reads stop with the context's error if it
+// is canceled or its deadline passes, e.g., when the client of a request disconnects.
 type KeyValueGetter interface {
 	// Get returns a value given a key.
 	Get(k Key) (v []byte, err error)
 
 	// GetRange returns a range of values spanning (kStart, kEnd) keys.
-	GetRange(kStart, kEnd Key) (values []KeyValue, err error)
+	GetRange(ctx context.Context, kStart, kEnd Key) (values []KeyValue, err error)
 
 	// KeysInRange returns a range of keys spanning (kStart, kEnd).
-	KeysInRange(kStart, kEnd Key) (keys []Key, err error)
+	KeysInRange(ctx context.Context, kStart, kEnd Key) (keys []Key, err error)
 
 	// ProcessRange sends a range of key/value pairs to type-specific chunk handlers,
 	// allowing chunk processing to be concurrent with key/value sequential reads.
 	// Since the chunks are typically sent during sequential read iteration, the
 	// receiving function can be organized as a pool of chunk handling goroutines.
 	// See datatype.voxels.ProcessChunk() for an example.
-	ProcessRange(kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) (err error)
+	ProcessRange(ctx context.Context, kStart, kEnd Key, op *ChunkOp, f func(*Chunk)) (err error)
 }
 
 type KeyValueSetter interface {
@@ -110,6 +113,36 @@ type Batcher interface {
 	NewBatch() Batch
 }
 
+// Syncers can flush writes buffered by the operating system to disk, e.g., before a
+// server shuts down.
+type Syncer interface {
+	Sync() error
+}
+
+// Snapshotters can read a consistent view of the store as of a moment while writes
+// continue, e.g., for backups of a running server.
+type Snapshotter interface {
+	// Snapshot returns a getter reading the store as of now and a function that must
+	// be called to release the snapshot.
+	Snapshot() (KeyValueGetter, func(), error)
+}
+
+// Compacters can rewrite the stored form of a range of keys to reclaim the space of
+// deleted and overwritten values, e.g., after large deletions.
+type Compacter interface {
+	// Compact compacts the keys spanning (kStart, kEnd), where nil keys extend the
+	// range to the first or last key of the store.
+	Compact(kStart, kEnd Key) error
+}
+
+// Sizers can estimate the space used to store a range of keys.
+type Sizer interface {
+	// ApproximateSize returns the approximate number of bytes used to store the keys
+	// spanning (kStart, kEnd), where nil keys extend the range to the first or last
+	// key of the store.
+	ApproximateSize(kStart, kEnd Key) (uint64, error)
+}
+
 // Batch groups operations into a transaction.
 type Batch interface {
 	// Delete removes from the batch a put using the given key.
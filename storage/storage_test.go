@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -140,10 +141,48 @@ func (s *DataSuite) TestMultipleItems(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(string(value), Equals, "some value A")
 
-	values, err := kvDB.GetRange(NewKey("key a"), NewKey("yet another key F"))
+	values, err := kvDB.GetRange(context.Background(), NewKey("key a"), NewKey("yet another key F"))
 	c.Assert(err, IsNil)
 	c.Assert(len(values), Equals, 3)
 	for i, kv := range values {
 		c.Assert(string(kv.V), Equals, string(items[i].V))
 	}
 }
+
+func (s *DataSuite) TestCancelledRange(c *C) {
+	kvDB, ok := s.db.(KeyValueDB)
+	if !ok {
+		c.Fail()
+	}
+
+	items := []KeyValue{
+		{K: NewKey("cancel a"), V: []byte("value A")},
+		{K: NewKey("cancel b"), V: []byte("value B")},
+		{K: NewKey("cancel c"), V: []byte("value C")},
+	}
+	c.Assert(kvDB.PutRange(items), IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	values, err := kvDB.GetRange(ctx, NewKey("cancel a"), NewKey("cancel z"))
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(values, HasLen, 0)
+
+	// Cancelling while processing stops the range after the current chunk.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var processed []string
+	err = kvDB.ProcessRange(ctx, NewKey("cancel a"), NewKey("cancel z"), &ChunkOp{}, func(chunk *Chunk) {
+		processed = append(processed, string(chunk.V))
+		cancel()
+	})
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(processed, DeepEquals, []string{"value A"})
+
+	processed = nil
+	err = kvDB.ProcessRange(context.Background(), NewKey("cancel a"), NewKey("cancel z"), &ChunkOp{}, func(chunk *Chunk) {
+		processed = append(processed, string(chunk.V))
+	})
+	c.Assert(err, IsNil)
+	c.Assert(processed, HasLen, 3)
+}